@@ -1,17 +1,26 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jcodybaker/wgmesh/pkg/agent"
+	"github.com/jcodybaker/wgmesh/pkg/audit"
+	"github.com/jcodybaker/wgmesh/pkg/bgp"
 	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+	"github.com/jcodybaker/wgmesh/pkg/keys"
+	"github.com/jcodybaker/wgmesh/pkg/log"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/jcodybaker/wgmesh/pkg/routingd"
 
 	"github.com/Showmax/go-fqdn"
 	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
 	k8sLabels "k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/validation"
@@ -19,10 +28,63 @@ import (
 )
 
 var name, endpointAddr, registryNamespace, kubeNode, kubeconfig string
-var peerSelector, labels, registryKubeconfig, driver string
-var ips, offerRoutes []string
+var region, zone string
+var peerSelector, labels, labelsFile, registryKubeconfig, driver string
+var registryServer, registryTokenFile, registryCAFile, registryDNSZone string
+var registryCertFile, registryKeyFile string
+var registryDNSInterval time.Duration
+var peersFile string
+var peersFileInterval time.Duration
+var ips, offerRoutes, clampMSSRoutes, snatRoutes, endpointCandidates, nodeAddressTypes []string
+var mdnsPeerKeys, mdnsPeerCIDRs []string
+var endpointFamily string
+var bootstrapPeers []string
 var port uint16
 var keepAliveSeconds uint
+var mtu, routePriority, routeMetric, routeProtocol int
+var protected, allowProtectedRemoval bool
+var allowedEndpointCIDRs, peerNamespaces []string
+var pinnedKeysFile, keyPinning string
+var enforceMeshPolicies bool
+var podCIDRIPAM, offerPodCIDRs, operatorManaged, annotateNode, clearNetworkUnavailable bool
+var natTraversal, peerHealth, mdns, reflectRoutes, clientOnly, ecmp, installRoutes, clampMSS bool
+var controlSocket string
+var exportServices bool
+var exportServiceSelector, clusterDomain string
+var ipPools, staticIPs []string
+var ipFamily string
+var ipCount int
+var ipLeaseDuration time.Duration
+var deregisterOnExit, dryRun bool
+var peerCache string
+var keyProvider, vaultAddr, vaultTokenFile, vaultMount, keyPrefix, kmsKey string
+var initAttempts int
+var forceTakeover bool
+var takeoverGrace time.Duration
+var enableChaos bool
+var benchPort int
+var metricsAddr, probeMethod string
+var auditLog string
+var probeInterval, mtuProbeInterval time.Duration
+var mtuAuto bool
+var tcpTransportPort int
+var tcp2udpPath, udp2tcpPath string
+var tcpFallback bool
+var bgpASN uint32
+var bgpRouterID, gobgpdPath, gobgpPath string
+var bgpNeighbors []string
+var bgpListenPort int
+var bgpLearnRoutes bool
+var routingDaemon, birdConfig string
+var proxyARPInterface string
+var proxyARPCIDRs []string
+var probePort int
+var handshakeTimeout time.Duration
+var flapDampingLimit int
+var flapDampingWindow time.Duration
+var quarantineAttempts int
+var quarantinePeriod, quarantineRetry time.Duration
+var resyncPeriod time.Duration
 var wgIfaceOptions interfaces.WireGuardInterfaceOptions
 
 var agentCmd = &cobra.Command{
@@ -35,12 +97,35 @@ func init() {
 
 	agentCmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "path to kubeconfig file for the local cluster")
 	agentCmd.Flags().StringVar(&registryKubeconfig, "registry-kubeconfig", "", "path to kubeconfig file for registry")
+	agentCmd.Flags().StringVar(&registryServer, "registry-server", "", "URL of a wgmesh server to use as the registry instead of Kubernetes (ex. https://registry.example.com:8443)")
+	agentCmd.Flags().StringVar(&registryTokenFile, "registry-token-file", "", "with --registry-server, path to a file containing the bearer token")
+	agentCmd.Flags().StringVar(&registryCAFile, "registry-ca-file", "", "with --registry-server, path to PEM certificates used to verify the server; defaults to the system roots")
+	agentCmd.Flags().StringVar(&registryCertFile, "registry-cert-file", "", "with --registry-server, path to a PEM client certificate presented to the server; reloaded when modified")
+	agentCmd.Flags().StringVar(&registryKeyFile, "registry-key-file", "", "with --registry-cert-file, path to the client certificate's private key")
+	agentCmd.Flags().StringVar(&registryDNSZone, "registry-dns-zone", "", "discover peers from SRV and TXT records in this DNS zone instead of a Kubernetes registry")
+	agentCmd.Flags().DurationVar(&registryDNSInterval, "registry-dns-interval", time.Minute, "with --registry-dns-zone, how often the zone is polled")
+	agentCmd.Flags().StringVar(&peersFile, "peers-file", "", "run standalone: read WireGuardPeers and Meshes from this file of YAML documents instead of a registry; no kubeconfig is needed")
+	agentCmd.Flags().DurationVar(&peersFileInterval, "peers-file-interval", 30*time.Second, "with --peers-file, how often the file is read again")
 
 	hostname, _ := os.Hostname()
 	agentCmd.Flags().StringVar(&name, "name", hostname, "name of the endpoint (default hostname)")
 
-	agentCmd.Flags().StringVar(&endpointAddr, "endpoint-addr", fqdn.Get(), "endpoint address used by peers (default fqdn)")
-	agentCmd.Flags().UintVar(&keepAliveSeconds, "keepalive-seconds", 0, "send keepalive packets every x seconds")
+	agentCmd.Flags().StringVar(&endpointAddr, "endpoint-addr", fqdn.Get(), "endpoint address used by peers (default fqdn, or the --kube-node's address)")
+	agentCmd.Flags().BoolVar(&clientOnly, "client-only", false, "don't publish an endpoint; for peers which can't accept inbound connections. Peers wait for this peer to initiate, and keepalive defaults to 25s")
+	agentCmd.Flags().StringVar(&endpointFamily, "endpoint-family", agent.EndpointFamilyAuto, "preferred address family of peers' endpoints, for names with both; auto prefers v6 if this host has a global IPv6 address. With --kube-node, the node's addresses of a v4 or v6 preference are published first. Valid: auto,v4,v6")
+	agentCmd.Flags().StringSliceVar(&endpointCandidates, "endpoint-candidates", nil, "additional endpoint addresses, in order of preference, which peers try before --endpoint-addr (ex. a LAN address)")
+	agentCmd.Flags().IntVar(&tcpTransportPort, "tcp-transport-port", 0, "accept WireGuard traffic carried over TCP on this port with udp-over-tcp's tcp2udp, for peers on networks which block UDP, and publish it with --endpoint-addr's host as the TCP endpoint. 0 = disabled")
+	agentCmd.Flags().StringVar(&tcp2udpPath, "tcp2udp-path", "", "path to udp-over-tcp's tcp2udp (default from PATH)")
+	agentCmd.Flags().BoolVar(&tcpFallback, "tcp-fallback", false, "reach peers which publish a TCP endpoint through it with udp-over-tcp's udp2tcp once their UDP endpoints fail to handshake")
+	agentCmd.Flags().StringVar(&udp2tcpPath, "udp2tcp-path", "", "path to udp-over-tcp's udp2tcp (default from PATH)")
+	agentCmd.Flags().BoolVar(&natTraversal, "nat-traversal", true, "publish the addresses peers are observed at, and try the addresses other peers observe as endpoints, so peers behind NAT can hole punch")
+	agentCmd.Flags().BoolVar(&peerHealth, "publish-peer-health", false, "publish the health of this peer's connection to each peer, reachability and latest handshake, in its WireGuardPeer's status")
+	agentCmd.Flags().BoolVar(&mdns, "mdns", false, "announce this peer and browse for others via mDNS (_wgmesh._udp), so peers on the same LAN connect directly")
+	agentCmd.Flags().StringSliceVar(&mdnsPeerKeys, "mdns-peer-keys", nil, "with --mdns, peer with neighbors announcing these public keys even without a registry record")
+	agentCmd.Flags().StringSliceVar(&mdnsPeerCIDRs, "mdns-peer-cidrs", nil, "with --mdns, peer with neighbors announcing from these CIDRs even without a registry record (ex. a trusted home LAN)")
+	agentCmd.Flags().BoolVar(&reflectRoutes, "reflect-routes", false, "re-advertise routes learned from directly connected peers, so peers which only connect to this gateway can reach them")
+	agentCmd.Flags().UintVar(&keepAliveSeconds, "keepalive-seconds", 0, "send keepalive packets every x seconds; defaults to the Mesh's keepalive")
+	agentCmd.Flags().IntVar(&mtu, "mtu", 0, "WireGuard interface mtu; defaults to the Mesh's mtu")
 
 	agentCmd.Flags().Uint16Var(&port, "port", 0, "port to bind the wireguard service. 0 = random available port")
 	agentCmd.Flags().StringVar(&wgIfaceOptions.InterfaceName, "interface", interfaces.DefaultWireGuardInterfaceName, "network interface name for the wiregard interface. Use + suffix to auto-select the next available id (ex. wg+ for wg0,wg1...")
@@ -55,33 +140,114 @@ func init() {
 	// TODO - figure out how to default this to the namespace specified in the kubeconfig file.
 	agentCmd.Flags().StringVar(&registryNamespace, "registry-namespace", "", "kubernetes namespace")
 	agentCmd.Flags().StringVar(&kubeNode, "kube-node", "", "specify the Kubernetes node name (optional)")
+	agentCmd.Flags().StringSliceVar(&nodeAddressTypes, "node-address-types", []string{"ExternalIP", "InternalIP"}, "with --kube-node and no --endpoint-addr, publish the node's first address of these types, in order of preference, as the endpoint")
+	agentCmd.Flags().StringVar(&region, "region", "", "region published for the local peer; defaults to the --kube-node's topology label")
+	agentCmd.Flags().StringVar(&zone, "zone", "", "zone published for the local peer; defaults to the --kube-node's topology label")
+	agentCmd.Flags().BoolVar(&offerPodCIDRs, "offer-pod-cidrs", false, "offer routes to the --kube-node's podCIDRs, in addition to --offer-routes")
+	agentCmd.Flags().BoolVar(&clearNetworkUnavailable, "clear-network-unavailable", true, "with --pod-cidr-ipam, --offer-pod-cidrs, or --operator-managed, set the --kube-node's NetworkUnavailable condition to false once peers are configured")
+	agentCmd.Flags().BoolVar(&annotateNode, "annotate-node", false, "annotate the --kube-node with the local peer's mesh addresses")
+	agentCmd.Flags().BoolVar(&operatorManaged, "operator-managed", false, "let the controller's node operator publish the WireGuardPeer for the --kube-node; the agent announces its key on the node and only programs the interface")
+	agentCmd.Flags().BoolVar(&podCIDRIPAM, "pod-cidr-ipam", false, "derive the wireguard interface address and offered routes from the --kube-node's podCIDRs")
 
 	agentCmd.Flags().StringSliceVar(&ips, "ips", nil, "ip addresses which should be assigned to the local wireguard interface")
+	agentCmd.Flags().StringArrayVar(&bootstrapPeers, "bootstrap-peer", nil, "configure this peer at startup, before contacting the registry, and keep it configured alongside the registry's peers. Repeatable. Format: public-key,endpoint,allowed-ip[,allowed-ip...]; the endpoint may be empty (ex. KEY,vpn.example.com:51820,10.0.0.1/32)")
 	agentCmd.Flags().StringSliceVar(&offerRoutes, "offer-routes", nil, "routes which this node will offer to peers")
-
+	agentCmd.Flags().BoolVar(&installRoutes, "install-routes", true, "route peers' addresses and offered routes via the WireGuard interface")
+	agentCmd.Flags().BoolVar(&clampMSS, "clamp-mss", false, "with --install-routes, install iptables rules clamping the MSS of forwarded TCP connections to and from the routes peers offer in --clamp-mss-routes to the path MTU")
+	agentCmd.Flags().StringSliceVar(&clampMSSRoutes, "clamp-mss-routes", nil, "offered routes whose forwarded TCP connections peers running with --clamp-mss should clamp the MSS of")
+	agentCmd.Flags().StringSliceVar(&snatRoutes, "snat-routes", nil, "offered routes into which traffic forwarded from the mesh is source NATed to the address of the interface it leaves through, ex. for LANs without a route back to the mesh")
+	agentCmd.Flags().IntVar(&routeMetric, "route-metric", 0, "metric of installed routes, so they can win or lose against other routes. 0 = kernel default")
+	agentCmd.Flags().IntVar(&routeProtocol, "route-protocol", interfaces.DefaultRouteProtocol, "protocol number of installed routes; routes via the WireGuard interface with this protocol are managed by the agent")
+	agentCmd.Flags().Uint32Var(&bgpASN, "bgp-asn", 0, "run a BGP speaker, gobgpd, in this AS, advertising the mesh's routes to the --bgp-neighbor routers. 0 = disabled")
+	agentCmd.Flags().StringVar(&bgpRouterID, "bgp-router-id", "", "BGP router id (default the first IPv4 mesh address)")
+	agentCmd.Flags().StringSliceVar(&bgpNeighbors, "bgp-neighbor", nil, "upstream routers to advertise the mesh's routes to. Format: address=asn (ex. 10.0.0.1=65000)")
+	agentCmd.Flags().IntVar(&bgpListenPort, "bgp-listen-port", 179, "port where BGP sessions from neighbors are accepted. -1 = only initiate sessions")
+	agentCmd.Flags().BoolVar(&bgpLearnRoutes, "bgp-learn-routes", false, "offer the routes the --bgp-neighbor routers advertise to the mesh")
+	agentCmd.Flags().StringVar(&gobgpdPath, "gobgpd-path", "", "path to gobgpd (default from PATH)")
+	agentCmd.Flags().StringVar(&gobgpPath, "gobgp-path", "", "path to the gobgp CLI (default from PATH)")
+	agentCmd.Flags().StringVar(&routingDaemon, "routing-daemon", "", "export the addresses and routes of the peers this node routes to as static routes via the WireGuard interface to the routing daemon running on the host, bird or frr, for it to redistribute")
+	agentCmd.Flags().StringVar(&birdConfig, "bird-config", routingd.DefaultBIRDConfig, "with --routing-daemon=bird, file the static routes are written to; include it from bird.conf")
+	agentCmd.Flags().StringVar(&proxyARPInterface, "proxy-arp-interface", "", "answer ARP and NDP requests on this LAN interface for the mesh addresses of the peers this node routes to, so LAN devices can reach them without static routes")
+	agentCmd.Flags().StringSliceVar(&proxyARPCIDRs, "proxy-arp-cidrs", nil, "with --proxy-arp-interface, only answer for mesh addresses within these CIDRs (default all)")
+	agentCmd.Flags().BoolVar(&ecmp, "ecmp", false, "split routes offered by several peers with the same --route-priority between them, balancing traffic by destination")
+	agentCmd.Flags().DurationVar(&resyncPeriod, "resync-period", 0, "how often to redeliver every cached WireGuardPeer and Mesh, and reapply the full peer and route config to the interface, correcting changes made outside the agent. 0 = never")
+	agentCmd.Flags().IntVar(&quarantineAttempts, "quarantine-after-attempts", 0, "remove peers which have never completed a handshake from the interface once this many endpoint attempts have failed over at least --quarantine-after, retrying them every --quarantine-retry-interval. 0 = never quarantine")
+	agentCmd.Flags().DurationVar(&quarantinePeriod, "quarantine-after", 10*time.Minute, "with --quarantine-after-attempts, how long a peer must have been failing before it's quarantined")
+	agentCmd.Flags().DurationVar(&quarantineRetry, "quarantine-retry-interval", 30*time.Minute, "with --quarantine-after-attempts, how often quarantined peers are put back on the interface to retry them")
+	agentCmd.Flags().IntVar(&flapDampingLimit, "flap-damping-limit", 10, "damp peers whose spec changes more than this many times within --flap-damping-window, applying only their latest change once per window until they settle. 0 = never damp")
+	agentCmd.Flags().DurationVar(&flapDampingWindow, "flap-damping-window", time.Minute, "window over which --flap-damping-limit counts a peer's changes")
+	agentCmd.Flags().DurationVar(&handshakeTimeout, "handshake-timeout", 20*time.Second, "how long the agent sends to a peer without a handshake completing before the peer is stale: its endpoint is resolved again or failed over to the next candidate, and its routes move to other peers")
+	agentCmd.Flags().IntVar(&routePriority, "route-priority", 0, "priority of the offered routes; peers send a route offered by several peers to the highest priority peer which is completing handshakes")
+	agentCmd.Flags().StringSliceVar(&ipPools, "ip-pool", nil, "claim addresses for the local wireguard interface from IPPools in the registry namespace. Format: pool[:family[=count]] (ex. v4pool,v6pool:ipv6 or dual:ipv4,dual:ipv6=2)")
+	agentCmd.Flags().StringSliceVar(&staticIPs, "static-ip", nil, "claim specific addresses from IPPools in the registry namespace. Format: pool=ip (ex. gateways=10.0.0.1)")
+	agentCmd.Flags().IntVar(&ipCount, "ip-count", 1, "number of addresses to claim from --ip-pool entries which don't specify a count")
+	agentCmd.Flags().DurationVar(&ipLeaseDuration, "ip-lease-duration", 0, "lease claimed addresses for this long, renewing while the agent runs. 0 = addresses are held until the WireGuardPeer is deleted")
+	agentCmd.Flags().BoolVar(&deregisterOnExit, "deregister-on-exit", false, "delete the local WireGuardPeer and release claimed addresses when the agent exits")
+	agentCmd.Flags().BoolVar(&forceTakeover, "force-takeover", false, "claim the local peer's name when the registry holds a record of it with another endpoint, ex. a node rebuilt with the same hostname on a new address, rather than failing")
+	agentCmd.Flags().DurationVar(&takeoverGrace, "takeover-grace", time.Minute, "with --force-takeover, how long the existing record must go unchanged before it's taken over")
+	agentCmd.Flags().IntVar(&initAttempts, "init-attempts", 0, "attempts to start the agent when startup fails with transient errors, ex. the registry is unreachable; 0 retries until stopped")
+	agentCmd.Flags().StringVar(&peerCache, "peer-cache", "", "save the local key and the peers synced from the registry to this file, and configure the interface from it at startup, before the registry is reachable")
+	agentCmd.Flags().StringVar(&keyProvider, "key-provider", "", "hold the private key in vault, or the aws or gcp secret manager, which generates and stores it on first use, rather than generating it at startup; it's never written to disk")
+	agentCmd.Flags().StringVar(&vaultAddr, "vault-addr", "", "with --key-provider=vault, the address of the Vault server (default $VAULT_ADDR)")
+	agentCmd.Flags().StringVar(&vaultTokenFile, "vault-token-file", "", "with --key-provider=vault, path to a file containing the Vault token (default $VAULT_TOKEN)")
+	agentCmd.Flags().StringVar(&vaultMount, "vault-mount", keys.DefaultVaultMount, "with --key-provider=vault, the path of the KV version 2 secrets engine holding keys")
+	agentCmd.Flags().StringVar(&keyPrefix, "key-prefix", keys.DefaultPrefix, "with --key-provider, keys are stored as <prefix>/<name> in vault and aws, and <prefix>-<name> in gcp")
+	agentCmd.Flags().StringVar(&kmsKey, "kms-key", "", "with --key-provider=aws or gcp, the KMS key encrypting stored keys, an AWS KMS key id or ARN, or a Cloud KMS key resource name; the service's default key if empty")
+	agentCmd.Flags().StringVar(&ipFamily, "ip-family", string(registry.IPFamilyAny), "address family to claim from --ip-pool entries which don't specify a family. Valid: any,ipv4,ipv6")
+
+	agentCmd.Flags().BoolVar(&exportServices, "export-services", false, "publish the local cluster's Services annotated with wgmesh.codybaker.com/export=true, and offer routes to their cluster and load balancer IPs")
+	agentCmd.Flags().StringVar(&exportServiceSelector, "export-service-selector", "", "with --export-services, also export Services matching this label selector")
+	agentCmd.Flags().StringVar(&clusterDomain, "cluster-domain", "cluster.local", "DNS domain of the local cluster, used to name exported Services")
 	agentCmd.Flags().StringVar(&peerSelector, "peer-selector", "", "select a subset of peers based on labels")
 	agentCmd.Flags().StringVar(&labels, "labels", "", "apply kubernetes labels the local WireGuardPeer")
+	agentCmd.Flags().StringVar(&labelsFile, "labels-file", "", "apply labels from a file in the downward API's format to the local WireGuardPeer, except those controllers add to pods, ex. pod-template-hash; --labels take precedence")
+	agentCmd.Flags().StringSliceVar(&nodeLabels, "node-labels", nil, "copy these labels from the --kube-node to the local WireGuardPeer, keeping them in sync; --labels take precedence (ex. topology.kubernetes.io/zone,node.kubernetes.io/instance-type)")
+
+	agentCmd.Flags().BoolVar(&protected, "protected", false, "mark the local WireGuardPeer as protected; peers will not remove it if the record is deleted")
+	agentCmd.Flags().BoolVar(&allowProtectedRemoval, "allow-protected-peer-removal", false, "remove protected peers when their WireGuardPeer records are deleted")
+	agentCmd.Flags().StringSliceVar(&allowedEndpointCIDRs, "allowed-endpoint-cidrs", nil, "only configure peers whose published endpoints all fall within these CIDRs, ex. corporate ranges; overrides the Mesh's allowedEndpointCIDRs")
+	agentCmd.Flags().StringSliceVar(&peerNamespaces, "peer-namespaces", nil, "also mesh with the peers of these registry namespaces, once a Mesh in each lists this agent's --registry-namespace in sharedWithNamespaces")
+	agentCmd.Flags().StringVar(&pinnedKeysFile, "pinned-keys-file", "", "pin each peer's public key, by name, on first use, saving the pins to this file; approve key rotations with wgmesh pins approve. Requires --peer-cache or --key-provider, and peers should keep their keys the same way")
+	agentCmd.Flags().StringVar(&keyPinning, "key-pinning", agent.KeyPinningReject, "with --pinned-keys-file, how a peer whose public key differs from its pin is handled: reject ignores it, alert logs and records an event but configures it. Valid: reject,alert")
+	agentCmd.Flags().BoolVar(&enforceMeshPolicies, "enforce-mesh-policies", false, "enforce the registry namespace's WireGuardMeshPolicies with nftables rules on the interface, and by narrowing peers' allowed IPs; requires nft")
+
+	agentCmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the interface, addresses, peers, and routes the agent would configure as YAML, then exit without changing the host or the registry")
+	agentCmd.Flags().StringVar(&controlSocket, "control-socket", "", "path to a unix socket where the agent serves introspection requests")
+	agentCmd.Flags().BoolVar(&enableChaos, "enable-chaos", false, "enable failure injection hooks on the control socket (testing only)")
+	agentCmd.Flags().MarkHidden("enable-chaos")
+	agentCmd.Flags().IntVar(&benchPort, "bench-port", 0, "port on the mesh addresses where peers' wgmesh bench tests are served. 0 = disabled")
+	agentCmd.Flags().StringVar(&auditLog, "audit-log", "", "append a record of each peer and route the agent changes, and each registry write, to this file as JSON lines, or post each to this http(s) URL")
+	agentCmd.Flags().StringVar(&metricsAddr, "metrics-addr", "", "address where Prometheus metrics are served at /metrics (ex. :9586)")
+	agentCmd.Flags().DurationVar(&probeInterval, "probe-interval", 0, "probe every peer's mesh addresses this often, exporting their reachability and round trip times as metrics. 0 = disabled")
+	agentCmd.Flags().StringVar(&probeMethod, "probe-method", "icmp", "how peers are probed; udp probes need no privileges, but peers must set the same --probe-port. Valid: icmp,udp")
+	agentCmd.Flags().IntVar(&probePort, "probe-port", 0, "UDP port where peers' probes are echoed, and where peers are sent UDP probes. 0 = disabled")
+	agentCmd.Flags().DurationVar(&mtuProbeInterval, "mtu-probe-interval", 0, "measure the path mtu to every peer this often with UDP probes, warning of peers which can't take packets of the interface's mtu; peers must set the same --probe-port. 0 = disabled")
+	agentCmd.Flags().BoolVar(&mtuAuto, "mtu-auto", false, "with --mtu-probe-interval, lower the interface's mtu to the smallest path mtu rather than warning")
 
 	rootCmd.AddCommand(agentCmd)
 }
 
 func runAgent(cmd *cobra.Command, args []string) {
-	validateNodeName(name)
-	validateEndpointAddr(endpointAddr)
-
-	opts := []agent.OptionFunc{
-		agent.WithLogger(ll),
-		agent.WithIPs(ips),
-		agent.WithOfferRoutes(offerRoutes),
-		agent.WithRegistryNamespace(registryNamespace),
+	if err := applyFlagEnv(cmd, flagEnv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts, errs := agentOptions(cmd)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
 	}
+	opts = append(opts, agent.WithLogger(ll))
 
 	rules := clientcmd.NewDefaultClientConfigLoadingRules()
 	if kubeconfig != "" {
 		rules.ExplicitPath = kubeconfig
 	}
 	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
-	if config != nil {
+	// Standalone agents only use a local cluster if one is given.
+	if config != nil && (peersFile == "" || kubeconfig != "") {
 		opts = append(opts, agent.WithLocalKubeClientConfig(config))
 	}
 
@@ -93,61 +259,414 @@ func runAgent(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	if registryServer != "" {
+		r, err := serverRegistry(registryServer, registryTokenFile, registryCAFile, registryCertFile, registryKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--registry-server: %v\n", err)
+			os.Exit(1)
+		}
+		opts = append(opts, agent.WithRegistry(r))
+	}
+	if registryDNSZone != "" {
+		r, err := registry.NewDNS(registryDNSZone, registryNamespace, log.Subsystem(ll, log.SubsystemRegistry))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--registry-dns-zone: %v\n", err)
+			os.Exit(1)
+		}
+		err = r.Sync(ctx)
+		if err != nil {
+			ll.WithError(err).Warn("failed to sync peers from DNS")
+		}
+		go r.Run(ctx, registryDNSInterval)
+		opts = append(opts, agent.WithRegistry(r))
+	}
+	if peersFile != "" {
+		r, err := registry.NewFile(peersFile, registryNamespace, log.Subsystem(ll, log.SubsystemRegistry))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--peers-file: %v\n", err)
+			os.Exit(1)
+		}
+		if err = r.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "--peers-file: %v\n", err)
+			os.Exit(1)
+		}
+		go r.Run(ctx, peersFileInterval)
+		opts = append(opts, agent.WithRegistry(r))
+	}
+
+	if auditLog != "" && !dryRun {
+		sink, err := audit.Open(auditLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--audit-log: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := sink.Close(); err != nil {
+				ll.WithError(err).Error("failed to close audit log")
+			}
+		}()
+		opts = append(opts, agent.WithAuditLog(sink))
+	}
+
+	a, err := agent.NewAgent(name, opts...)
+	if err != nil {
+		ll.Fatalf("Failed to initialize agent: %v", err)
+	}
+	defer a.Close()
+	if dryRun {
+		plan, err := a.DryRun(ctx)
+		if err != nil {
+			ll.Fatalf("Failed to plan agent configuration: %v", err)
+		}
+		if err = printObject(os.Stdout, plan, "yaml"); err != nil {
+			ll.Fatalf("Failed to print plan: %v", err)
+		}
+		return
+	}
+	err = runService(ctx, a.Run)
+	if ctx.Err() == nil && err != nil {
+		ll.Fatalf("Failed to run agent: %v", err)
+	}
+	if err != nil {
+		ll.WithError(err).Error("agent shutdown failed")
+	}
+}
+
+// agentOptions checks the agent's flags, returning every problem rather than just the first, and
+// builds the agent's options. Options which depend on the host, the logger, kubeconfigs, and the
+// --registry-server or --registry-dns-zone registry, are left to the caller.
+func agentOptions(cmd *cobra.Command) ([]agent.OptionFunc, []error) {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if kubeNode != "" && !cmd.Flags().Changed("name") {
+		// In a DaemonSet, the node's name is a more stable identity than the pod's hostname.
+		name = kubeNode
+	}
+	if operatorManaged {
+		if kubeNode == "" {
+			check(errors.New("--operator-managed: requires --kube-node"))
+		}
+		// The operator names each peer for its node.
+		name = kubeNode
+	}
+	if !operatorManaged || kubeNode != "" {
+		check(validateNodeName(name))
+	}
+	if peersFile != "" && registryNamespace == "" {
+		// Without a kubeconfig, there's no current namespace to default to.
+		registryNamespace = "default"
+	}
+	// With a kube node, the node's address is a better default than our fqdn.
+	endpointFromNode := kubeNode != "" && !clientOnly && !cmd.Flags().Changed("endpoint-addr")
+	if !clientOnly && !endpointFromNode && !operatorManaged {
+		check(validateEndpointAddr(endpointAddr))
+	}
+	check(validateIPs(ips))
+	check(validateOfferRoutes(offerRoutes))
+	check(validateClampMSSRoutes(clampMSSRoutes, offerRoutes))
+	check(validateSNATRoutes(snatRoutes, offerRoutes))
+	if len(snatRoutes) > 0 && operatorManaged {
+		check(errors.New("--snat-routes: may not be combined with --operator-managed"))
+	}
+	if tcpTransportPort != 0 && clientOnly {
+		check(errors.New("--tcp-transport-port: client-only peers don't accept connections"))
+	}
+	switch routingDaemon {
+	case "", routingd.BIRD, routingd.FRR:
+	default:
+		check(fmt.Errorf("--routing-daemon: must be %s or %s", routingd.BIRD, routingd.FRR))
+	}
+	if proxyARPInterface != "" && operatorManaged {
+		check(errors.New("--proxy-arp-interface: may not be combined with --operator-managed"))
+	}
+	if len(proxyARPCIDRs) > 0 && proxyARPInterface == "" {
+		check(errors.New("--proxy-arp-cidrs: requires --proxy-arp-interface"))
+	}
+	for _, c := range proxyARPCIDRs {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			check(fmt.Errorf("--proxy-arp-cidrs: %w", err))
+		}
+	}
+	if routingDaemon != "" && operatorManaged {
+		check(errors.New("--routing-daemon: may not be combined with --operator-managed"))
+	}
+	if clampMSS && !installRoutes {
+		check(errors.New("--clamp-mss: requires --install-routes"))
+	}
+	if probeInterval > 0 && probeMethod == "udp" && probePort == 0 {
+		check(errors.New("--probe-method: udp requires --probe-port"))
+	}
+	if mtuProbeInterval > 0 && probePort == 0 {
+		check(errors.New("--mtu-probe-interval: requires --probe-port"))
+	}
+	if mtuAuto && mtuProbeInterval == 0 {
+		check(errors.New("--mtu-auto: requires --mtu-probe-interval"))
+	}
+	if (len(mdnsPeerKeys) > 0 || len(mdnsPeerCIDRs) > 0) && !mdns {
+		check(errors.New("--mdns-peer-keys, --mdns-peer-cidrs: require --mdns"))
+	}
+	if pinnedKeysFile != "" && peerCache == "" && keyProvider == "" {
+		// Without either, the agent generates a new key each start, which its peers' pins reject.
+		check(errors.New("--pinned-keys-file: requires --peer-cache or --key-provider, so the agent's own key survives restarts"))
+	}
+
+	opts := []agent.OptionFunc{
+		agent.WithIPs(ips),
+		agent.WithOfferRoutes(offerRoutes),
+		agent.WithRoutePriority(routePriority),
+		agent.WithECMP(ecmp),
+		agent.WithInstallRoutes(installRoutes),
+		agent.WithClampMSS(clampMSS),
+		agent.WithClampMSSRoutes(clampMSSRoutes),
+		agent.WithSNATRoutes(snatRoutes),
+		agent.WithTCPTransport(tcpTransportPort, tcp2udpPath),
+		agent.WithTCPFallback(tcpFallback, udp2tcpPath),
+		agent.WithRoutingDaemon(routingDaemon, birdConfig),
+		agent.WithProxyARP(proxyARPInterface, proxyARPCIDRs),
+		agent.WithRouteMetric(routeMetric),
+		agent.WithRouteProtocol(routeProtocol),
+		agent.WithRegistryNamespace(registryNamespace),
+		agent.WithProtected(protected),
+		agent.WithAllowProtectedRemoval(allowProtectedRemoval),
+		agent.WithAllowedEndpointCIDRs(allowedEndpointCIDRs),
+		agent.WithKeyPinning(pinnedKeysFile, keyPinning),
+		agent.WithMeshPolicyEnforcement(enforceMeshPolicies),
+		agent.WithControlSocket(controlSocket),
+		agent.WithChaos(enableChaos),
+		agent.WithBenchPort(benchPort),
+		agent.WithMetricsAddr(metricsAddr),
+		agent.WithProber(probeInterval, probeMethod),
+		agent.WithProbePort(probePort),
+		agent.WithMTUProbe(mtuProbeInterval, mtuAuto),
+		agent.WithHandshakeTimeout(handshakeTimeout),
+		agent.WithFlapDamping(flapDampingLimit, flapDampingWindow),
+		agent.WithQuarantine(quarantineAttempts, quarantinePeriod, quarantineRetry),
+		agent.WithResyncPeriod(resyncPeriod),
+		agent.WithDeregisterOnExit(deregisterOnExit),
+		agent.WithPeerCache(peerCache),
+		agent.WithInitAttempts(initAttempts),
+		agent.WithIPLeaseDuration(ipLeaseDuration),
+		agent.WithNATTraversal(natTraversal),
+		agent.WithPeerHealth(peerHealth),
+		agent.WithMDNS(mdns),
+		agent.WithMDNSPeers(mdnsPeerKeys, mdnsPeerCIDRs),
+		agent.WithZone(region, zone),
+		agent.WithRouteReflection(reflectRoutes),
+		agent.WithClientOnly(clientOnly),
+		agent.WithOperatorManaged(operatorManaged),
+		agent.WithClearNetworkUnavailable(clearNetworkUnavailable),
+	}
+
+	if keyProvider != "" {
+		p, err := newKeyProvider()
+		check(err)
+		if p != nil {
+			opts = append(opts, agent.WithKeyProvider(p))
+		}
+	} else if kmsKey != "" || vaultAddr != "" || vaultTokenFile != "" {
+		check(errors.New("--kms-key, --vault-addr, --vault-token-file: require --key-provider"))
+	}
+	if bgpASN != 0 {
+		if operatorManaged {
+			check(errors.New("--bgp-asn: may not be combined with --operator-managed"))
+		}
+		if bgpRouterID != "" && net.ParseIP(bgpRouterID).To4() == nil {
+			check(fmt.Errorf("--bgp-router-id: %q must be an IPv4 address", bgpRouterID))
+		}
+		if bgpListenPort == 0 || bgpListenPort > 65535 {
+			check(fmt.Errorf("--bgp-listen-port: invalid port %d", bgpListenPort))
+		}
+		c := bgp.Config{
+			ASN:        bgpASN,
+			RouterID:   bgpRouterID,
+			ListenPort: bgpListenPort,
+			GoBGPDPath: gobgpdPath,
+			GoBGPPath:  gobgpPath,
+		}
+		for _, s := range bgpNeighbors {
+			n, err := bgp.ParseNeighbor(s)
+			if err != nil {
+				check(fmt.Errorf("--bgp-neighbor: %w", err))
+				continue
+			}
+			c.Neighbors = append(c.Neighbors, n)
+		}
+		if len(bgpNeighbors) == 0 {
+			check(errors.New("--bgp-asn: requires at least one --bgp-neighbor"))
+		} else if len(c.Neighbors) == len(bgpNeighbors) {
+			opts = append(opts, agent.WithBGP(c, bgpLearnRoutes))
+		}
+	} else if len(bgpNeighbors) > 0 || bgpLearnRoutes {
+		check(errors.New("--bgp-neighbor, --bgp-learn-routes: require --bgp-asn"))
+	}
+	if registryDNSZone != "" && registryServer != "" {
+		check(errors.New("--registry-dns-zone: may not be combined with --registry-server"))
+	}
+	if len(peerNamespaces) > 0 {
+		for flag, set := range map[string]bool{
+			"--registry-server":   registryServer != "",
+			"--registry-dns-zone": registryDNSZone != "",
+			"--peers-file":        peersFile != "",
+		} {
+			if set {
+				check(fmt.Errorf("--peer-namespaces: requires a Kubernetes registry; may not be combined with %s", flag))
+			}
+		}
+		opts = append(opts, agent.WithPeerNamespaces(peerNamespaces))
+	}
+	if peersFile != "" {
+		for flag, set := range map[string]bool{
+			"--registry-server":     registryServer != "",
+			"--registry-dns-zone":   registryDNSZone != "",
+			"--registry-kubeconfig": registryKubeconfig != "",
+			"--ip-pool":             len(ipPools) > 0,
+			"--static-ip":           len(staticIPs) > 0,
+			"--operator-managed":    operatorManaged,
+		} {
+			if set {
+				check(fmt.Errorf("--peers-file: may not be combined with %s", flag))
+			}
+		}
+	}
+
 	if keepAliveSeconds > 0 {
 		keepalive := time.Duration(keepAliveSeconds) * time.Second
 		opts = append(opts, agent.WithKeepAliveDuration(keepalive))
 	}
+	if mtu > 0 {
+		opts = append(opts, agent.WithMTU(mtu))
+	}
+	if forceTakeover {
+		if operatorManaged {
+			check(errors.New("--force-takeover: the operator publishes the WireGuardPeer of an --operator-managed agent"))
+		}
+		opts = append(opts, agent.WithForceTakeover(takeoverGrace))
+	}
 
 	if kubeNode != "" {
 		// TODO - bail if there's not local kubeconfig
-		validateKubeNode(kubeNode)
+		check(validateKubeNode(kubeNode))
 		opts = append(opts, agent.WithKubeNode(kubeNode))
 	}
 
+	requireKubeNode := func(flag string) {
+		if kubeNode == "" {
+			check(fmt.Errorf("--%s: requires --kube-node", flag))
+		}
+	}
+	if podCIDRIPAM {
+		requireKubeNode("pod-cidr-ipam")
+		opts = append(opts, agent.WithPodCIDRIPAM(true))
+	}
+	if len(nodeLabels) > 0 {
+		requireKubeNode("node-labels")
+		opts = append(opts, agent.WithNodeLabels(nodeLabels))
+	}
+	if annotateNode {
+		requireKubeNode("annotate-node")
+		opts = append(opts, agent.WithAnnotateNode(true))
+	}
+	if offerPodCIDRs {
+		requireKubeNode("offer-pod-cidrs")
+		opts = append(opts, agent.WithOfferPodCIDRs(true))
+	}
+
+	if exportServices {
+		var selector k8sLabels.Selector
+		if exportServiceSelector != "" {
+			var err error
+			selector, err = k8sLabels.Parse(exportServiceSelector)
+			if err != nil {
+				check(fmt.Errorf("--export-service-selector: invalid %v", err))
+			}
+		}
+		opts = append(opts, agent.WithServiceExport(selector), agent.WithClusterDomain(clusterDomain))
+	}
+
 	if peerSelector != "" {
 		ps, err := k8sLabels.Parse(peerSelector)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "--peer-selector: invalid %w", err)
-			os.Exit(1)
+			check(fmt.Errorf("--peer-selector: invalid %v", err))
+		} else {
+			opts = append(opts, agent.WithPeerSelector(ps))
 		}
-		opts = append(opts, agent.WithPeerSelector(ps))
 	}
 
-	if labels != "" {
-		labelsSet, err := k8sLabels.ConvertSelectorToLabelsMap(labels)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "--labels: invalid %w", err)
-			os.Exit(1)
+	if labels != "" || labelsFile != "" {
+		labelsSet := make(k8sLabels.Set)
+		if labelsFile != "" {
+			fileLabels, err := readLabelsFile(labelsFile)
+			if err != nil {
+				check(fmt.Errorf("--labels-file: %v", err))
+			} else {
+				labelsSet = fileLabels
+			}
+		}
+		if labels != "" {
+			flagLabels, err := k8sLabels.ConvertSelectorToLabelsMap(labels)
+			if err != nil {
+				check(fmt.Errorf("--labels: invalid %v", err))
+			}
+			labelsSet = k8sLabels.Merge(labelsSet, flagLabels)
 		}
 		opts = append(opts, agent.WithLabels(labelsSet))
 	}
 
-	if endpointAddr != "" {
+	for _, p := range ipPools {
+		pool, family, count, err := parseIPPool(p)
+		if err != nil {
+			check(err)
+			continue
+		}
+		opts = append(opts, agent.WithIPPool(pool, count, family))
+	}
+	for _, s := range bootstrapPeers {
+		peer, err := parseBootstrapPeer(s)
+		if err != nil {
+			check(err)
+			continue
+		}
+		opts = append(opts, agent.WithBootstrapPeer(peer))
+	}
+	for _, s := range staticIPs {
+		pool, ip, err := parseStaticIP(s)
+		if err != nil {
+			check(err)
+			continue
+		}
+		opts = append(opts, agent.WithStaticIP(pool, ip))
+	}
+
+	if endpointFromNode {
+		opts = append(opts, agent.WithNodeEndpoint(nodeAddressTypes))
+	} else if endpointAddr != "" {
 		opts = append(opts, agent.WithEndpointAddr(endpointAddr))
 	}
+	if len(endpointCandidates) > 0 {
+		opts = append(opts, agent.WithEndpointCandidates(endpointCandidates))
+	}
+	opts = append(opts, agent.WithEndpointFamily(endpointFamily))
 
 	var err error
 	wgIfaceOptions.Driver, err = interfaces.WireGuardDriverFromString(driver)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "--driver: %w", err)
-		os.Exit(1)
+		check(fmt.Errorf("--driver: %v", err))
 	}
 	if err = interfaces.IsWireGuardInterfaceNameValid(wgIfaceOptions.InterfaceName); err != nil {
-		fmt.Fprintf(os.Stderr, "--interface: %w", err)
-		os.Exit(1)
+		check(fmt.Errorf("--interface: %v", err))
 	}
 	wgIfaceOptions.Port = int(port)
 	opts = append(opts, agent.WithWireGuardInterfaceOptions(&wgIfaceOptions))
 
-	a, err := agent.NewAgent(name, opts...)
-	if err != nil {
-		ll.Fatalf("Failed to initialize agent: %w", err)
-	}
-	defer a.Close()
-	err = a.Run(ctx)
-	if ctx.Err() == nil && err != nil {
-		ll.Fatalf("Failed to run agent: %w", err)
+	// The options check their own values, ex. the --mtu's range.
+	if _, err = agent.NewAgent(name, opts...); err != nil {
+		check(fmt.Errorf("invalid agent options: %w", err))
 	}
+	return opts, errs
 }
 
 func homeDir() string {
@@ -157,56 +676,184 @@ func homeDir() string {
 	return os.Getenv("USERPROFILE") // windows
 }
 
-func validateKubeNode(kubeNode string) {
+// newKeyProvider returns the --key-provider.
+func newKeyProvider() (keys.Provider, error) {
+	switch keyProvider {
+	case keys.Vault:
+		addr := vaultAddr
+		if addr == "" {
+			addr = os.Getenv("VAULT_ADDR")
+		}
+		if addr == "" {
+			return nil, errors.New("--vault-addr: required with --key-provider=vault, or set VAULT_ADDR")
+		}
+		token := os.Getenv("VAULT_TOKEN")
+		if vaultTokenFile != "" {
+			tokens, err := readTokenFile(vaultTokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("--vault-token-file: %w", err)
+			}
+			token = tokens[0]
+		}
+		if token == "" {
+			return nil, errors.New("--vault-token-file: required with --key-provider=vault, or set VAULT_TOKEN")
+		}
+		return keys.NewVault(addr, token, vaultMount, keyPrefix, nil), nil
+	case keys.AWS, keys.GCP:
+		p, err := keys.NewCloud(keyProvider, kmsKey, keyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("--key-provider: must be %s, %s, or %s", keys.Vault, keys.AWS, keys.GCP)
+	}
+}
+
+func validateKubeNode(kubeNode string) error {
 	errs := validation.IsDNS1123Subdomain(kubeNode)
 	if len(errs) == 0 {
-		return
+		return nil
 	}
-	fmt.Fprintf(os.Stderr, "--kube-node: %s\n", strings.Join(errs, " "))
-	os.Exit(1)
+	return fmt.Errorf("--kube-node: %s", strings.Join(errs, " "))
 }
 
-func validateNodeName(endpointName string) {
+func validateNodeName(endpointName string) error {
 	if endpointName == "" {
-		fmt.Fprintln(os.Stderr, "--endpoint-name: was empty")
-		os.Exit(1)
+		return errors.New("--name: was empty")
 	}
 	errs := validation.IsDNS1123Subdomain(endpointName)
 	if len(errs) == 0 {
-		return
+		return nil
 	}
-	fmt.Fprintf(os.Stderr, "--endpoint-name: %s\n", strings.Join(errs, " "))
-	os.Exit(1)
+	return fmt.Errorf("--name: %s", strings.Join(errs, " "))
 }
 
-func validateEndpointAddr(endpointAddr string) {
+func validateEndpointAddr(endpointAddr string) error {
 	_, _, err := net.SplitHostPort(endpointAddr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "--endpoint-addr: invalid: %v", err)
-		os.Exit(1)
+		if ip := net.ParseIP(endpointAddr); ip != nil && ip.To4() == nil {
+			return fmt.Errorf("--endpoint-addr: invalid: IPv6 addresses must be bracketed, ex. [%s]:51820", endpointAddr)
+		}
+		return fmt.Errorf("--endpoint-addr: invalid: %v", err)
 	}
+	return nil
 }
 
-func validateIPs(ips []string) {
+func validateIPs(ips []string) error {
 	for _, ip := range ips {
 		if strings.Index(ip, "/") == -1 {
-			fmt.Fprintf(os.Stderr, "--ips: %q missing prefix length", ip)
-			os.Exit(1)
+			return fmt.Errorf("--ips: %q missing prefix length", ip)
 		}
 		_, _, err := net.ParseCIDR(ip)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "--ips: invalid ip %q: %v", ip, err)
-			os.Exit(1)
+			return fmt.Errorf("--ips: invalid ip %q: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// parseIPPool parses a --ip-pool entry of the form pool[:family[=count]]. The family and count
+// default to --ip-family and --ip-count.
+func parseIPPool(p string) (string, registry.IPFamily, int, error) {
+	pool, familyCount := p, ""
+	if i := strings.Index(p, ":"); i != -1 {
+		pool, familyCount = p[:i], p[i+1:]
+	}
+	if pool == "" {
+		return "", "", 0, fmt.Errorf("--ip-pool: %q missing pool name", p)
+	}
+	familyStr, count := ipFamily, ipCount
+	if familyCount != "" {
+		familyStr = familyCount
+		if i := strings.Index(familyCount, "="); i != -1 {
+			var err error
+			familyStr = familyCount[:i]
+			count, err = strconv.Atoi(familyCount[i+1:])
+			if err != nil {
+				return "", "", 0, fmt.Errorf("--ip-pool: %q invalid count: %v", p, err)
+			}
+		}
+	}
+	family, err := registry.IPFamilyFromString(familyStr)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("--ip-pool: %q: %v", p, err)
+	}
+	if count < 1 {
+		return "", "", 0, fmt.Errorf("--ip-pool: %q: count must be at least 1", p)
+	}
+	return pool, family, count, nil
+}
+
+// parseStaticIP parses a --static-ip entry of the form pool=ip.
+func parseStaticIP(s string) (string, net.IP, error) {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return "", nil, fmt.Errorf("--static-ip: %q must be of the form pool=ip", s)
+	}
+	ip := net.ParseIP(s[i+1:])
+	if ip == nil {
+		return "", nil, fmt.Errorf("--static-ip: %q invalid ip", s)
+	}
+	return s[:i], ip, nil
+}
+
+// parseBootstrapPeer parses a --bootstrap-peer entry of the form
+// public-key,endpoint,allowed-ip[,allowed-ip...].
+func parseBootstrapPeer(s string) (agent.BootstrapPeer, error) {
+	var peer agent.BootstrapPeer
+	parts := strings.Split(s, ",")
+	if len(parts) < 3 {
+		return peer, fmt.Errorf("--bootstrap-peer: %q must be of the form public-key,endpoint,allowed-ip[,allowed-ip...]", s)
+	}
+	var err error
+	peer.PublicKey, err = wgtypes.ParseKey(parts[0])
+	if err != nil {
+		return peer, fmt.Errorf("--bootstrap-peer: %q invalid public key: %v", s, err)
+	}
+	peer.Endpoint = parts[1]
+	for _, cidr := range parts[2:] {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return peer, fmt.Errorf("--bootstrap-peer: %q invalid allowed IP %q: %v", s, cidr, err)
 		}
+		peer.AllowedIPs = append(peer.AllowedIPs, *n)
 	}
+	return peer, nil
 }
 
-func validateOfferRoutes(offerRoutes []string) {
+func validateOfferRoutes(offerRoutes []string) error {
 	for _, route := range offerRoutes {
 		_, _, err := net.ParseCIDR(route)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "--offer-routes: invalid CIDR %q: %v", route, err)
-			os.Exit(1)
+			return fmt.Errorf("--offer-routes: invalid CIDR %q: %v", route, err)
+		}
+	}
+	return nil
+}
+
+func validateClampMSSRoutes(clampMSSRoutes, offerRoutes []string) error {
+	offered := make(map[string]bool, len(offerRoutes))
+	for _, route := range offerRoutes {
+		offered[route] = true
+	}
+	for _, route := range clampMSSRoutes {
+		if !offered[route] {
+			return fmt.Errorf("--clamp-mss-routes: %q must also be in --offer-routes", route)
+		}
+	}
+	return nil
+}
+
+func validateSNATRoutes(snatRoutes, offerRoutes []string) error {
+	offered := make(map[string]bool, len(offerRoutes))
+	for _, route := range offerRoutes {
+		offered[route] = true
+	}
+	for _, route := range snatRoutes {
+		if !offered[route] {
+			return fmt.Errorf("--snat-routes: %q must also be in --offer-routes", route)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/agent"
+	"github.com/jcodybaker/wgmesh/pkg/bench"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var benchPeer, benchRate, benchOutput string
+var benchRequest agent.BenchRequest
+
+var benchCmd = &cobra.Command{
+	Run:   runBench,
+	Use:   "bench --peer NAME",
+	Short: "Measure throughput and loss across the tunnel to a peer",
+	Long: `Measure throughput and loss across the tunnel to a peer.
+
+The local agent, reached through its --control-socket, sends test traffic to the peer's mesh address,
+where the peer's agent must be run with --bench-port. TCP tests report throughput; UDP tests also
+report loss, and with --size and --rate can check that the MTU and driver handle a given packet size
+and load.`,
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	benchCmd.Flags().StringVar(&controlSocket, "control-socket", "", "path to the local agent's control socket")
+	benchCmd.Flags().StringVar(&benchPeer, "peer", "", "name of the peer to test")
+	benchCmd.Flags().IntVar(&benchRequest.Port, "port", bench.DefaultPort, "the peer agent's --bench-port")
+	benchCmd.Flags().StringVar(&benchRequest.Protocol, "protocol", "tcp", "protocol to test. Valid: tcp,udp")
+	benchCmd.Flags().DurationVar(&benchRequest.Duration, "duration", 10*time.Second, "how long to send")
+	benchCmd.Flags().StringVar(&benchRate, "rate", "", "with --protocol udp, bits per second to send, ex. 100M (default as fast as possible)")
+	benchCmd.Flags().IntVar(&benchRequest.Size, "size", bench.DefaultSize, "with --protocol udp, payload size of each datagram")
+	benchCmd.Flags().StringVarP(&benchOutput, "output", "o", "text", "output format. Valid: text,json")
+	benchCmd.MarkFlagRequired("control-socket")
+	benchCmd.MarkFlagRequired("peer")
+	rootCmd.AddCommand(benchCmd)
+}
+
+func runBench(cmd *cobra.Command, args []string) {
+	if benchOutput != "text" && benchOutput != "json" {
+		fmt.Fprintf(os.Stderr, "--output: unsupported output format %q\n", benchOutput)
+		os.Exit(1)
+	}
+	if benchRate != "" {
+		q, err := resource.ParseQuantity(benchRate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--rate: %v\n", err)
+			os.Exit(1)
+		}
+		benchRequest.Rate = q.Value()
+	}
+	benchRequest.Peer = benchPeer
+	if err := benchRequest.Options.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid test: %v\n", err)
+		os.Exit(1)
+	}
+	body, err := json.Marshal(benchRequest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode request: %v\n", err)
+		os.Exit(1)
+	}
+	if benchOutput == "text" {
+		fmt.Printf("Testing %s to %s for %s...\n", benchRequest.Protocol, benchPeer, benchRequest.Duration)
+	}
+	resp, err := agent.NewControlClient(controlSocket).Post(agent.ControlBaseURL+"/v1/bench", "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run test: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "Failed to run test: %s: %s", resp.Status, body)
+		os.Exit(1)
+	}
+	var res bench.Result
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read result: %v\n", err)
+		os.Exit(1)
+	}
+	if benchOutput == "json" {
+		err = json.NewEncoder(os.Stdout).Encode(res)
+	} else {
+		err = printBenchResult(os.Stdout, &res)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print result: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func printBenchResult(w io.Writer, res *bench.Result) error {
+	fmt.Fprintf(w, "peer:        %s (%s)\n", res.Peer, res.Address)
+	fmt.Fprintf(w, "duration:    %.1fs\n", res.Seconds)
+	fmt.Fprintf(w, "sent:        %s\n", siUnits(float64(res.BytesSent), "B"))
+	fmt.Fprintf(w, "received:    %s\n", siUnits(float64(res.BytesReceived), "B"))
+	if res.Protocol == "udp" {
+		fmt.Fprintf(w, "datagrams:   %d sent, %d received\n", res.PacketsSent, res.PacketsReceived)
+		fmt.Fprintf(w, "loss:        %.2f%%\n", res.Loss*100)
+	}
+	_, err := fmt.Fprintf(w, "throughput:  %s\n", siUnits(res.BitsPerSecond, "bit/s"))
+	return err
+}
+
+// siUnits formats v with an SI prefix, ex. 1.5 GB.
+func siUnits(v float64, unit string) string {
+	prefixes := []string{"", "k", "M", "G", "T"}
+	i := 0
+	for v >= 1000 && i < len(prefixes)-1 {
+		v /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s%s", v, prefixes[i], unit)
+}
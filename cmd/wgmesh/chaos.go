@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/jcodybaker/wgmesh/pkg/agent"
+
+	"github.com/spf13/cobra"
+)
+
+var chaosPeerName string
+
+var chaosCmd = &cobra.Command{
+	Use:    "chaos [drop-watch|kill-driver|corrupt-peer]",
+	Short:  "Inject failures into a running agent (requires agent --enable-chaos)",
+	Hidden: true,
+	Args:   cobra.ExactValidArgs(1),
+	ValidArgs: []string{
+		"drop-watch",
+		"kill-driver",
+		"corrupt-peer",
+	},
+	Run: runChaos,
+}
+
+func init() {
+	chaosCmd.Flags().StringVar(&controlSocket, "control-socket", "", "path to the agent's control socket")
+	chaosCmd.Flags().StringVar(&chaosPeerName, "peer", "", "peer to corrupt with corrupt-peer (default the agent's own peer)")
+	chaosCmd.MarkFlagRequired("control-socket")
+	rootCmd.AddCommand(chaosCmd)
+}
+
+func runChaos(cmd *cobra.Command, args []string) {
+	u := agent.ControlBaseURL + "/v1/chaos/" + args[0]
+	if chaosPeerName != "" {
+		u += "?" + url.Values{"name": []string{chaosPeerName}}.Encode()
+	}
+	resp, err := agent.NewControlClient(controlSocket).Post(u, "", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "chaos %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "chaos %s: %s: %s", args[0], resp.Status, body)
+		os.Exit(1)
+	}
+}
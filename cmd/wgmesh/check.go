@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+	"github.com/jcodybaker/wgmesh/pkg/probe"
+
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sLabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+var checkInterface, checkMethod, checkSelector, checkOutput string
+var checkTimeout time.Duration
+
+// checkDeviceLock serializes reads of the interface by concurrent probes.
+var checkDeviceLock sync.Mutex
+
+var checkCmd = &cobra.Command{
+	Run:   runCheck,
+	Use:   "check",
+	Short: "Probe every peer's mesh addresses from this host and report which are reachable",
+	Long: `Probe every peer's mesh addresses from this host and report which are reachable.
+
+Run on a host with a running agent. Each peer in the registry is probed with an ICMP echo request
+(--method icmp), or by waiting for a WireGuard handshake with it (--method handshake), which works
+even when peers' firewalls drop ICMP. DIRECT is whether the peer is configured on the local
+interface; a peer which is registered but not configured points to the registry or agent, rather
+than the network. Peers reached through a gateway aren't direct, and can only be checked with ICMP.
+Exits non-zero if any peer is unreachable.`,
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	addRegistryClientFlags(checkCmd)
+	checkCmd.Flags().StringVar(&checkInterface, "interface", interfaces.DefaultWireGuardInterfaceName, "the agent's wireguard interface")
+	checkCmd.Flags().StringVar(&checkMethod, "method", "icmp", "how to probe peers. Valid: icmp,handshake")
+	checkCmd.Flags().DurationVar(&checkTimeout, "timeout", probe.DefaultTimeout, "how long to wait for each peer to respond")
+	checkCmd.Flags().StringVarP(&checkSelector, "selector", "l", "", "only check peers matching this label selector")
+	checkCmd.Flags().StringVarP(&checkOutput, "output", "o", "table", "output format. Valid: table,json")
+	rootCmd.AddCommand(checkCmd)
+}
+
+// checkResult is the outcome of probing a single mesh address of a peer.
+type checkResult struct {
+	Peer   string `json:"peer"`
+	IP     string `json:"ip,omitempty"`
+	Direct bool   `json:"direct"`
+	// LastHandshake is nil if the peer isn't direct, or has never completed a handshake.
+	LastHandshake *time.Time `json:"lastHandshake,omitempty"`
+	Reachable     bool       `json:"reachable"`
+	// Latency is the ICMP round trip time, or with --method handshake, how long a new handshake
+	// took.
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func runCheck(cmd *cobra.Command, args []string) {
+	if checkMethod != "icmp" && checkMethod != "handshake" {
+		fmt.Fprintf(os.Stderr, "--method: unsupported method %q\n", checkMethod)
+		os.Exit(1)
+	}
+	if checkOutput != "table" && checkOutput != "json" {
+		fmt.Fprintf(os.Stderr, "--output: unsupported output format %q\n", checkOutput)
+		os.Exit(1)
+	}
+	selector, err := k8sLabels.Parse(checkSelector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--selector: %v\n", err)
+		os.Exit(1)
+	}
+	r, err := cliRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry: %v\n", err)
+		os.Exit(1)
+	}
+	list, err := r.WatchPeers(selector, nil).List(metav1.ListOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list WireGuardPeers: %v\n", err)
+		os.Exit(1)
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open wireguard control: %v\n", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+	device, err := checkDevice(client)
+	if err != nil {
+		if checkMethod == "handshake" {
+			fmt.Fprintf(os.Stderr, "Failed to read wireguard interface %q: %v\n", checkInterface, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: failed to read wireguard interface %q: %v\n", checkInterface, err)
+	}
+
+	results := checkPeers(client, device, list.(*wgk8s.WireGuardPeerList).Items)
+	if checkOutput == "json" {
+		err = json.NewEncoder(os.Stdout).Encode(results)
+	} else {
+		err = printCheckTable(os.Stdout, results, time.Now())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print results: %v\n", err)
+		os.Exit(1)
+	}
+	for _, res := range results {
+		if !res.Reachable {
+			os.Exit(1)
+		}
+	}
+}
+
+// checkDevice reads the --interface. A name ending in + selects the first matching interface, as
+// the agent would have created it.
+func checkDevice(client *wgctrl.Client) (*wgtypes.Device, error) {
+	if !strings.HasSuffix(checkInterface, "+") {
+		return client.Device(checkInterface)
+	}
+	devices, err := client.Devices()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	for _, d := range devices {
+		if strings.HasPrefix(d.Name, strings.TrimSuffix(checkInterface, "+")) {
+			checkInterface = d.Name
+			return d, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// checkPeers probes each mesh address of the peers, other than the local peer, concurrently.
+func checkPeers(client *wgctrl.Client, device *wgtypes.Device, peers []wgk8s.WireGuardPeer) []checkResult {
+	direct := make(map[string]bool)
+	var localKey string
+	if device != nil {
+		localKey = device.PublicKey.String()
+		for _, p := range device.Peers {
+			direct[p.PublicKey.String()] = true
+		}
+	}
+
+	var results []checkResult
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for _, p := range peers {
+		if p.Spec.PublicKey == localKey {
+			continue
+		}
+		res := checkResult{Peer: p.GetName(), Direct: direct[p.Spec.PublicKey]}
+		if len(p.Spec.IPs) == 0 {
+			res.Error = "no mesh addresses"
+			results = append(results, res)
+			continue
+		}
+		for _, addr := range p.Spec.IPs {
+			wg.Add(1)
+			go func(res checkResult, addr, key string) {
+				defer wg.Done()
+				res = checkAddress(client, res, addr, key)
+				lock.Lock()
+				results = append(results, res)
+				lock.Unlock()
+			}(res, addr, p.Spec.PublicKey)
+		}
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Peer != results[j].Peer {
+			return results[i].Peer < results[j].Peer
+		}
+		return results[i].IP < results[j].IP
+	})
+	return results
+}
+
+// checkAddress probes a single mesh address, in CIDR form, of the peer with the public key.
+func checkAddress(client *wgctrl.Client, res checkResult, addr, key string) checkResult {
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil {
+		res.IP = addr
+		res.Error = err.Error()
+		return res
+	}
+	res.IP = ip.String()
+	lastHandshake := func() (time.Time, error) {
+		checkDeviceLock.Lock()
+		defer checkDeviceLock.Unlock()
+		device, err := client.Device(checkInterface)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, p := range device.Peers {
+			if p.PublicKey.String() == key {
+				return p.LastHandshakeTime, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("peer was removed from %s", checkInterface)
+	}
+	var handshake time.Time
+	if res.Direct {
+		handshake, _ = lastHandshake()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	var latency time.Duration
+	switch {
+	case checkMethod == "icmp":
+		latency, err = probe.Ping(ctx, ip)
+	case res.Direct:
+		handshake, latency, err = probe.Handshake(ctx, ip, lastHandshake)
+	default:
+		err = fmt.Errorf("not configured on %s", checkInterface)
+	}
+	if !handshake.IsZero() {
+		res.LastHandshake = &handshake
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Reachable = true
+	if latency > 0 {
+		res.Latency = latency.Round(10 * time.Microsecond).String()
+	}
+	return res
+}
+
+// printCheckTable writes a row for each probed address, followed by a summary of reachable peers.
+func printCheckTable(w io.Writer, results []checkResult, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tIP\tDIRECT\tHANDSHAKE\tSTATUS\tLATENCY")
+	peers := make(map[string]bool)
+	for _, res := range results {
+		direct, handshake := "no", "<none>"
+		if res.Direct {
+			direct = "yes"
+			if res.LastHandshake != nil {
+				handshake = duration.HumanDuration(now.Sub(*res.LastHandshake)) + " ago"
+			}
+		}
+		status := "reachable"
+		if !res.Reachable {
+			status = "unreachable: " + res.Error
+		}
+		ip, latency := res.IP, res.Latency
+		if ip == "" {
+			ip = "<none>"
+		}
+		if latency == "" {
+			latency = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", res.Peer, ip, direct, handshake, status, latency)
+		if _, ok := peers[res.Peer]; !ok || !res.Reachable {
+			peers[res.Peer] = res.Reachable
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	reachable := 0
+	for _, ok := range peers {
+		if ok {
+			reachable++
+		}
+	}
+	_, err := fmt.Fprintf(w, "\n%d/%d peers reachable\n", reachable, len(peers))
+	return err
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var completionCmd = &cobra.Command{
+	Run:   runCompletion,
+	Use:   "completion SHELL",
+	Short: "Print a shell completion script for bash, zsh, or fish",
+	Long: `Print a shell completion script for bash, zsh, or fish.
+
+Bash and fish also complete --driver names, and --registry-namespace from the namespaces in the
+default kubeconfig's cluster. Zsh completes commands and flags.
+
+  source <(wgmesh completion bash)
+  wgmesh completion zsh > "${fpath[1]}/_wgmesh"
+  wgmesh completion fish > ~/.config/fish/completions/wgmesh.fish`,
+	ValidArgs: []string{"bash", "zsh", "fish"},
+	Args:      cobra.ExactValidArgs(1),
+}
+
+// namespacesCmd lists namespaces for completing --registry-namespace. It's silent on failure, so
+// completion just offers nothing.
+var namespacesCmd = &cobra.Command{
+	Run:    runNamespaces,
+	Use:    "__namespaces",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+}
+
+// completionFuncs maps flags to the shell functions which complete their values. The functions
+// are defined in bashCompletionFuncs and fishCompletionFuncs.
+var completionFuncs = map[string]string{
+	"driver":             "__wgmesh_drivers",
+	"registry-namespace": "__wgmesh_namespaces",
+}
+
+var bashCompletionFuncs = fmt.Sprintf(`
+__wgmesh_drivers()
+{
+    COMPREPLY=( $(compgen -W "%s" -- "$cur") )
+}
+
+__wgmesh_namespaces()
+{
+    local namespaces
+    if namespaces=$(wgmesh __namespaces 2>/dev/null); then
+        COMPREPLY=( $(compgen -W "${namespaces}" -- "$cur") )
+    fi
+}
+`, strings.Join(interfaces.GetValidWireGuardDrivers(), " "))
+
+var fishCompletionFuncs = fmt.Sprintf(`
+function __wgmesh_drivers
+    printf '%%s\n' %s
+end
+
+function __wgmesh_namespaces
+    wgmesh __namespaces 2>/dev/null
+end
+`, strings.Join(interfaces.GetValidWireGuardDrivers(), " "))
+
+func init() {
+	rootCmd.BashCompletionFunction = bashCompletionFuncs
+	rootCmd.AddCommand(completionCmd, namespacesCmd)
+}
+
+func runCompletion(cmd *cobra.Command, args []string) {
+	annotateCompletions(rootCmd)
+	var err error
+	switch args[0] {
+	case "bash":
+		err = rootCmd.GenBashCompletion(os.Stdout)
+	case "zsh":
+		err = rootCmd.GenZshCompletion(os.Stdout)
+	case "fish":
+		err = genFishCompletion(os.Stdout, rootCmd)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate %s completion: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+func runNamespaces(cmd *cobra.Command, args []string) {
+	restConfig, err := registryClientConfig().ClientConfig()
+	if err != nil {
+		os.Exit(1)
+	}
+	cs, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		os.Exit(1)
+	}
+	list, err := cs.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		os.Exit(1)
+	}
+	for _, ns := range list.Items {
+		fmt.Println(ns.GetName())
+	}
+}
+
+// annotateCompletions marks the flags of every command with how their values are completed:
+// with completionFuncs, or as file names.
+func annotateCompletions(c *cobra.Command) {
+	c.LocalFlags().VisitAll(func(f *pflag.Flag) {
+		if fn, ok := completionFuncs[f.Name]; ok {
+			c.MarkFlagCustom(f.Name, fn)
+		} else if isFilenameFlag(f.Name) {
+			c.MarkFlagFilename(f.Name)
+		}
+	})
+	for _, sub := range c.Commands() {
+		annotateCompletions(sub)
+	}
+}
+
+func isFilenameFlag(name string) bool {
+	return strings.HasSuffix(name, "kubeconfig") || strings.HasSuffix(name, "-file") || strings.HasSuffix(name, "-path")
+}
+
+// genFishCompletion writes a fish completion script for the command tree. Cobra only generates
+// bash and zsh completions.
+func genFishCompletion(w io.Writer, root *cobra.Command) error {
+	name := root.Name()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s\n", name)
+	b.WriteString(fishCompletionFuncs)
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "complete -c %s -f\n", name)
+	writeFishCommand(&b, name, root, nil)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeFishCommand writes completions for c's subcommands and flags. path holds the names of the
+// commands leading to c, excluding the root.
+func writeFishCommand(b *strings.Builder, name string, c *cobra.Command, path []string) {
+	// The condition under which c is the command being completed.
+	var cond string
+	if len(path) == 0 {
+		cond = "__fish_use_subcommand"
+	} else {
+		conds := make([]string, 0, len(path))
+		for _, p := range path {
+			conds = append(conds, "__fish_seen_subcommand_from "+p)
+		}
+		cond = strings.Join(conds, "; and ")
+	}
+	var subs []string
+	for _, sub := range c.Commands() {
+		if sub.IsAvailableCommand() {
+			subs = append(subs, sub.Name())
+		}
+	}
+	subCond := cond
+	if len(subs) > 0 && len(path) > 0 {
+		subCond += "; and not __fish_seen_subcommand_from " + strings.Join(subs, " ")
+	}
+	for _, sub := range c.Commands() {
+		if !sub.IsAvailableCommand() {
+			continue
+		}
+		fmt.Fprintf(b, "complete -c %s -n '%s' -a %s -d %s\n", name, subCond, sub.Name(), fishQuote(sub.Short))
+	}
+	for _, arg := range c.ValidArgs {
+		fmt.Fprintf(b, "complete -c %s -n '%s' -a %s\n", name, cond, arg)
+	}
+
+	flagCond := cond
+	if len(path) == 0 {
+		// Root flags are persistent; offer them everywhere.
+		flagCond = ""
+	}
+	c.LocalFlags().VisitAll(func(f *pflag.Flag) {
+		if f.Hidden {
+			return
+		}
+		fmt.Fprintf(b, "complete -c %s", name)
+		if flagCond != "" {
+			fmt.Fprintf(b, " -n '%s'", flagCond)
+		}
+		fmt.Fprintf(b, " -l %s", f.Name)
+		if f.Shorthand != "" {
+			fmt.Fprintf(b, " -s %s", f.Shorthand)
+		}
+		if f.NoOptDefVal == "" {
+			if fn, ok := completionFuncs[f.Name]; ok {
+				fmt.Fprintf(b, " -x -a '(%s)'", fn)
+			} else if isFilenameFlag(f.Name) {
+				b.WriteString(" -r -F")
+			} else {
+				b.WriteString(" -x")
+			}
+		}
+		fmt.Fprintf(b, " -d %s\n", fishQuote(f.Usage))
+	})
+
+	for _, sub := range c.Commands() {
+		if sub.IsAvailableCommand() {
+			writeFishCommand(b, name, sub, append(path[:len(path):len(path)], sub.Name()))
+		}
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/controller"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var gcInterval, gcGracePeriod, conflictInterval, poolStatusInterval, nodeSyncInterval time.Duration
+var leaseDuration, leaseRenewDeadline, leaseRetryPeriod time.Duration
+var manageNodes, leaderElect bool
+var leaderElectLease, leaderElectIdentity string
+var nodeLabels []string
+
+var controllerCmd = &cobra.Command{
+	Run:   runController,
+	Use:   "controller",
+	Short: "Run registry-wide wgmesh controllers",
+}
+
+func init() {
+	controllerCmd.Flags().StringVar(&registryKubeconfig, "registry-kubeconfig", "", "path to kubeconfig file for registry")
+	controllerCmd.Flags().StringVar(&registryNamespace, "registry-namespace", "", "kubernetes namespace")
+	controllerCmd.Flags().DurationVar(&gcInterval, "gc-interval", time.Minute, "how often to garbage collect orphaned IPClaims and stale protected finalizers")
+	controllerCmd.Flags().DurationVar(&conflictInterval, "conflict-check-interval", 30*time.Second, "how often to check WireGuardPeers for conflicting IPs")
+	controllerCmd.Flags().DurationVar(&poolStatusInterval, "pool-status-interval", 30*time.Second, "how often to report IPPool capacity and utilization")
+	controllerCmd.Flags().DurationVar(&gcGracePeriod, "gc-grace-period", 5*time.Minute, "how long an IPClaim must be orphaned before it is deleted")
+	controllerCmd.Flags().BoolVar(&leaderElect, "leader-elect", false, "only run controllers while holding a Lease in the registry namespace, so several replicas can be deployed")
+	controllerCmd.Flags().StringVar(&leaderElectLease, "leader-elect-lease", "wgmesh-controller", "name of the Lease used for leader election")
+	controllerCmd.Flags().StringVar(&leaderElectIdentity, "leader-elect-identity", "", "identity of this replica in the leader election; must be unique (default hostname)")
+	controllerCmd.Flags().DurationVar(&leaseDuration, "lease-duration", 15*time.Second, "how long standby replicas wait before taking over from a leader which stopped renewing")
+	controllerCmd.Flags().DurationVar(&leaseRenewDeadline, "lease-renew-deadline", 10*time.Second, "how long the leader retries renewing its Lease before giving up leadership")
+	controllerCmd.Flags().DurationVar(&leaseRetryPeriod, "lease-retry-period", 2*time.Second, "how often replicas try to acquire or renew the Lease")
+	controllerCmd.Flags().BoolVar(&manageNodes, "manage-nodes", false, "maintain a WireGuardPeer for each Node in the local cluster, for agents run with --operator-managed")
+	controllerCmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "with --manage-nodes, path to kubeconfig file for the local cluster")
+	controllerCmd.Flags().StringSliceVar(&nodeAddressTypes, "node-address-types", []string{"ExternalIP", "InternalIP"}, "with --manage-nodes, publish each node's first address of these types, in order of preference, as its endpoint")
+	controllerCmd.Flags().StringSliceVar(&nodeLabels, "node-labels", nil, "with --manage-nodes, node labels to copy to each WireGuardPeer")
+	controllerCmd.Flags().DurationVar(&nodeSyncInterval, "node-sync-interval", 30*time.Second, "with --manage-nodes, how often to reconcile WireGuardPeers with Nodes")
+
+	rootCmd.AddCommand(controllerCmd)
+}
+
+func runController(cmd *cobra.Command, args []string) {
+	opts := []controller.OptionFunc{
+		controller.WithLogger(ll),
+		controller.WithRegistryNamespace(registryNamespace),
+		controller.WithRegistryKubeClientConfig(registryClientConfig()),
+		controller.WithGCInterval(gcInterval),
+		controller.WithGCGracePeriod(gcGracePeriod),
+		controller.WithConflictInterval(conflictInterval),
+		controller.WithPoolStatusInterval(poolStatusInterval),
+	}
+	if leaderElect {
+		opts = append(opts,
+			controller.WithLeaderElection(leaderElectLease, leaderElectIdentity),
+			controller.WithLeaseTimings(leaseDuration, leaseRenewDeadline, leaseRetryPeriod),
+		)
+	}
+	if manageNodes {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		if kubeconfig != "" {
+			rules.ExplicitPath = kubeconfig
+		}
+		config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+		opts = append(opts,
+			controller.WithNodeOperator(config),
+			controller.WithNodeAddressTypes(nodeAddressTypes),
+			controller.WithNodeLabels(nodeLabels),
+			controller.WithNodeSyncInterval(nodeSyncInterval),
+		)
+	}
+	c, err := controller.NewController(opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize controller: %v\n", err)
+		os.Exit(1)
+	}
+	err = c.Run(ctx)
+	if ctx.Err() == nil && err != nil {
+		ll.Fatalf("Failed to run controller: %v", err)
+	}
+}
+
+// registryClientConfig loads the registry kubeconfig from --registry-kubeconfig, falling back to
+// the default loading rules (KUBECONFIG, ~/.kube/config, in-cluster).
+func registryClientConfig() clientcmd.ClientConfig {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if registryKubeconfig != "" {
+		rules.ExplicitPath = registryKubeconfig
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+	"github.com/jcodybaker/wgmesh/pkg/preflight"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var doctorCmd = &cobra.Command{
+	Run:   runDoctor,
+	Use:   "doctor",
+	Short: "Check whether this host and its clusters are ready to run the agent",
+	Long: `Check whether this host and its clusters are ready to run the agent, and suggest fixes.
+
+Pass the same driver, port, kubeconfig, and registry flags the agent will use. Exits non-zero if
+any check fails.`,
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	doctorCmd.Flags().StringVar(&driver, "driver", "auto",
+		fmt.Sprintf("wireguard driver to use. Valid: %s", strings.Join(interfaces.GetValidWireGuardDrivers(), ",")))
+	doctorCmd.Flags().StringVar(&wgIfaceOptions.BoringTunPath, "boringtun-path", "", "path to boringtun userspace driver")
+	doctorCmd.Flags().StringVar(&wgIfaceOptions.WireGuardGoPath, "wireguard-go-path", "", "path to wireguard-go userspace driver")
+	doctorCmd.Flags().Uint16Var(&port, "port", 0, "port to bind the wireguard service. 0 = random available port")
+	doctorCmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "path to kubeconfig file for the local cluster")
+	doctorCmd.Flags().StringVar(&kubeNode, "kube-node", "", "check the local cluster permissions needed for this Kubernetes node")
+	addRegistryClientFlags(doctorCmd)
+	rootCmd.AddCommand(doctorCmd)
+}
+
+func runDoctor(cmd *cobra.Command, args []string) {
+	var err error
+	wgIfaceOptions.Driver, err = interfaces.WireGuardDriverFromString(driver)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--driver: %v\n", err)
+		os.Exit(1)
+	}
+
+	var results []preflight.Result
+	results = append(results, preflight.Drivers(&wgIfaceOptions)...)
+	results = append(results, preflight.NetAdmin(), preflight.UDPPort(int(port)))
+	results = append(results, doctorLocalCluster()...)
+	results = append(results, doctorRegistry()...)
+
+	failed := false
+	for _, r := range results {
+		fmt.Printf("[%s] %s: %s\n", r.Status, r.Check, r.Message)
+		if r.Fix != "" {
+			fmt.Printf("       fix: %s\n", r.Fix)
+		}
+		failed = failed || r.Status == preflight.Fail
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// doctorLocalCluster checks access to the --kube-node in the local cluster.
+func doctorLocalCluster() []preflight.Result {
+	if kubeNode == "" {
+		return []preflight.Result{{
+			Check:   "local cluster",
+			Status:  preflight.Skip,
+			Message: "no --kube-node",
+		}}
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	}
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	cs, results := doctorKubeconfig("local cluster", "--kubeconfig", config)
+	if cs == nil {
+		return results
+	}
+	return append(results, doctorPermissions("local cluster", cs, preflight.NodePermissions(kubeNode)))
+}
+
+// doctorRegistry checks access to the registry selected by addRegistryClientFlags.
+func doctorRegistry() []preflight.Result {
+	if registryServer != "" {
+		r := preflight.Result{Check: "registry server"}
+		reg, err := cliRegistry()
+		if err == nil {
+			_, err = reg.WatchPeers(nil, nil).List(metav1.ListOptions{})
+		}
+		if err != nil {
+			r.Status = preflight.Fail
+			r.Message = fmt.Sprintf("listing peers from %s: %v", registryServer, err)
+			r.Fix = "check --registry-server is reachable, and --registry-token-file, --registry-ca-file, and --registry-cert-file"
+			return []preflight.Result{r}
+		}
+		r.Status = preflight.Pass
+		r.Message = fmt.Sprintf("listed peers from %s", registryServer)
+		return []preflight.Result{r}
+	}
+
+	config := registryClientConfig()
+	cs, results := doctorKubeconfig("registry", "--registry-kubeconfig", config)
+	if cs == nil {
+		return results
+	}
+	namespace := registryNamespace
+	if namespace == "" {
+		// The kubeconfig already loaded, so this can't fail.
+		namespace, _, _ = config.Namespace()
+	}
+	return append(results, doctorPermissions("registry", cs, preflight.RegistryPermissions(namespace)))
+}
+
+// doctorKubeconfig checks that the kubeconfig loads and its API server is reachable, returning a
+// client if so.
+func doctorKubeconfig(check, flag string, config clientcmd.ClientConfig) (kubernetes.Interface, []preflight.Result) {
+	r := preflight.Result{Check: check + " kubeconfig"}
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		r.Status = preflight.Fail
+		r.Message = fmt.Sprintf("loading kubeconfig: %v", err)
+		r.Fix = fmt.Sprintf("pass %s, or set KUBECONFIG; in a pod, mount a service account token", flag)
+		return nil, []preflight.Result{r}
+	}
+	cs, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		r.Status = preflight.Fail
+		r.Message = fmt.Sprintf("initializing client: %v", err)
+		return nil, []preflight.Result{r}
+	}
+	version, err := cs.Discovery().ServerVersion()
+	if err != nil {
+		r.Status = preflight.Fail
+		r.Message = fmt.Sprintf("connecting to %s: %v", restConfig.Host, err)
+		r.Fix = "check the API server address and credentials in the kubeconfig"
+		return nil, []preflight.Result{r}
+	}
+	r.Status = preflight.Pass
+	r.Message = fmt.Sprintf("connected to %s (%s)", restConfig.Host, version.GitVersion)
+	return cs, []preflight.Result{r}
+}
+
+func doctorPermissions(check string, cs kubernetes.Interface, perms []preflight.Permission) preflight.Result {
+	r := preflight.Result{Check: check + " permissions"}
+	denied, err := preflight.CheckPermissions(cs.AuthorizationV1().SelfSubjectAccessReviews(), perms)
+	switch {
+	case err != nil:
+		r.Status = preflight.Warn
+		r.Message = fmt.Sprintf("unable to review access: %v", err)
+	case len(denied) > 0:
+		var missing []string
+		for _, p := range denied {
+			missing = append(missing, p.String())
+		}
+		r.Status = preflight.Fail
+		r.Message = fmt.Sprintf("denied: %s", strings.Join(missing, "; "))
+		r.Fix = "grant the agent's user these permissions; `wgmesh init-registry` creates a suitable Role for the registry"
+	default:
+		r.Status = preflight.Pass
+		r.Message = fmt.Sprintf("all %d required permissions are allowed", len(perms))
+	}
+	return r
+}
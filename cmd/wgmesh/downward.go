@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	k8sLabels "k8s.io/apimachinery/pkg/labels"
+)
+
+// flagEnv lists, for each agent flag, the environment variables it may be read from, in order of
+// precedence. WGMESH_ variables come first, followed by the names conventionally given to
+// downward-API fields in DaemonSets, so the same manifest works on every node.
+var flagEnv = map[string][]string{
+	"name":               {"WGMESH_NAME"},
+	"kube-node":          {"WGMESH_KUBE_NODE", "NODE_NAME", "K8S_NODE_NAME"},
+	"registry-namespace": {"WGMESH_REGISTRY_NAMESPACE", "POD_NAMESPACE"},
+	"labels":             {"WGMESH_LABELS"},
+	"labels-file":        {"WGMESH_LABELS_FILE"},
+}
+
+// ignoredPodLabels are added to pods by their controllers and change with each rollout, so they
+// aren't copied from a labels file.
+var ignoredPodLabels = map[string]struct{}{
+	"controller-revision-hash": {},
+	"pod-template-generation":  {},
+	"pod-template-hash":        {},
+}
+
+// applyFlagEnv sets each flag which wasn't given on the command line from the first non-empty
+// environment variable listed for it. Flags take precedence over the environment.
+func applyFlagEnv(cmd *cobra.Command, env map[string][]string) error {
+	for name, vars := range env {
+		if cmd.Flags().Lookup(name) == nil || cmd.Flags().Changed(name) {
+			continue
+		}
+		for _, v := range vars {
+			value := os.Getenv(v)
+			if value == "" {
+				continue
+			}
+			if err := cmd.Flags().Set(name, value); err != nil {
+				return fmt.Errorf("%s: %w", v, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// readLabelsFile reads labels in the format of a downward-API volume's labels file: one
+// key="value" pair per line, with the value quoted. ignoredPodLabels are skipped.
+func readLabelsFile(path string) (k8sLabels.Set, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	out := make(k8sLabels.Set)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		value, err := strconv.Unquote(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in line %q: %w", line, err)
+		}
+		if _, ok := ignoredPodLabels[line[:i]]; ok {
+			continue
+		}
+		out[line[:i]] = value
+	}
+	return out, scanner.Err()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	k8sLabels "k8s.io/apimachinery/pkg/labels"
+)
+
+func TestApplyFlagEnv(t *testing.T) {
+	env := map[string][]string{
+		"name":    {"WGMESH_TEST_NAME", "WGMESH_TEST_NAME_FALLBACK"},
+		"port":    {"WGMESH_TEST_PORT"},
+		"missing": {"WGMESH_TEST_MISSING"},
+	}
+	tcs := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		expectName  string
+		expectPort  int
+		expectError string
+	}{
+		{
+			name:       "unset",
+			expectPort: 1,
+		},
+		{
+			name:       "from env",
+			env:        map[string]string{"WGMESH_TEST_NAME": "a", "WGMESH_TEST_PORT": "2"},
+			expectName: "a",
+			expectPort: 2,
+		},
+		{
+			name:       "first non-empty var",
+			env:        map[string]string{"WGMESH_TEST_NAME": "", "WGMESH_TEST_NAME_FALLBACK": "b"},
+			expectName: "b",
+			expectPort: 1,
+		},
+		{
+			name:       "flag overrides env",
+			args:       []string{"--name", "flag", "--port", "3"},
+			env:        map[string]string{"WGMESH_TEST_NAME": "a", "WGMESH_TEST_PORT": "2"},
+			expectName: "flag",
+			expectPort: 3,
+		},
+		{
+			name:        "invalid value",
+			env:         map[string]string{"WGMESH_TEST_PORT": "nope"},
+			expectError: `WGMESH_TEST_PORT: invalid argument "nope" for "--port" flag: strconv.ParseInt: parsing "nope": invalid syntax`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				require.NoError(t, os.Setenv(k, v))
+				defer os.Unsetenv(k)
+			}
+			var name string
+			var port int
+			cmd := &cobra.Command{}
+			cmd.Flags().StringVar(&name, "name", "", "")
+			cmd.Flags().IntVar(&port, "port", 1, "")
+			require.NoError(t, cmd.Flags().Parse(tc.args))
+
+			err := applyFlagEnv(cmd, env)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectName, name)
+			require.Equal(t, tc.expectPort, port)
+		})
+	}
+}
+
+func TestReadLabelsFile(t *testing.T) {
+	tcs := []struct {
+		name        string
+		contents    string
+		expect      k8sLabels.Set
+		expectError string
+	}{
+		{
+			name:     "downward api",
+			contents: "app=\"wgmesh\"\ntopology.kubernetes.io/zone=\"us-east-1a\"\n",
+			expect:   k8sLabels.Set{"app": "wgmesh", "topology.kubernetes.io/zone": "us-east-1a"},
+		},
+		{
+			name:     "blank lines and whitespace",
+			contents: "\n  app=\"wgmesh\"  \n\n",
+			expect:   k8sLabels.Set{"app": "wgmesh"},
+		},
+		{
+			name:     "escaped and empty values",
+			contents: "a=\"x\\\"y\"\nb=\"1=2\"\nc=\"\"\n",
+			expect:   k8sLabels.Set{"a": "x\"y", "b": "1=2", "c": ""},
+		},
+		{
+			name: "controller labels",
+			contents: "app=\"wgmesh\"\ncontroller-revision-hash=\"5d8f9c\"\n" +
+				"pod-template-generation=\"3\"\npod-template-hash=\"7b9d\"\n",
+			expect: k8sLabels.Set{"app": "wgmesh"},
+		},
+		{
+			name:        "missing equals",
+			contents:    "app\n",
+			expectError: `invalid line "app"`,
+		},
+		{
+			name:        "missing key",
+			contents:    "=\"wgmesh\"\n",
+			expectError: `invalid line "=\"wgmesh\""`,
+		},
+		{
+			name:        "unquoted value",
+			contents:    "app=wgmesh\n",
+			expectError: `invalid value in line "app=wgmesh": invalid syntax`,
+		},
+		{
+			name:        "unterminated quote",
+			contents:    "app=\"wgmesh\n",
+			expectError: `invalid value in line "app=\"wgmesh": invalid syntax`,
+		},
+	}
+	dir, err := ioutil.TempDir("", "labels")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for i, tc := range tcs {
+		tc, path := tc, filepath.Join(dir, string(rune('a'+i)))
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.contents), 0600))
+			got, err := readLabelsFile(path)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, got)
+		})
+	}
+
+	_, err = readLabelsFile(filepath.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	wgmeshClient "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/typed/wgmesh/v1alpha1"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/wgconf"
+
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var importConfig, importDevice, importSelfName, importSelfEndpointAddr, importIPPool string
+var importPrint bool
+
+var importCmd = &cobra.Command{
+	Run:   runImport,
+	Use:   "import",
+	Short: "Create or update WireGuardPeers from an existing WireGuard configuration or device",
+	Long: `Create or update WireGuardPeers from an existing WireGuard configuration or device.
+
+Reads ` + "`wg showconf`" + ` output or a wg-quick file with --config, or a running interface with --device.
+Each [Peer] becomes a WireGuardPeer named by a "# Name = ..." comment in the section, or else after
+its public key. AllowedIPs which are single addresses become the peer's IPs, and wider prefixes its
+routes. With --self-name, the interface itself is imported too. Re-importing updates the peers in
+place, so a hand-managed network can be migrated one host at a time.`,
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	importCmd.Flags().StringVar(&importConfig, "config", "", "path to a `wg showconf` or wg-quick file to import; - reads stdin")
+	importCmd.Flags().StringVar(&importDevice, "device", "", "name of a running WireGuard interface to import")
+	importCmd.Flags().StringVar(&importSelfName, "self-name", "", "also import the interface itself as a WireGuardPeer with this name; requires its private key")
+	importCmd.Flags().StringVar(&importSelfEndpointAddr, "self-endpoint-addr", "", "with --self-name, the address peers reach the interface at; its ListenPort is the endpoint's port")
+	importCmd.Flags().StringVar(&importIPPool, "ippool", "", "reserve the imported addresses within this IPPool with IPClaims, so IPAM won't assign them to other peers")
+	importCmd.Flags().BoolVar(&importPrint, "print", false, "print the resources as YAML instead of creating them")
+	addRegistryClientFlags(importCmd)
+	rootCmd.AddCommand(importCmd)
+}
+
+func runImport(cmd *cobra.Command, args []string) {
+	if (importConfig == "") == (importDevice == "") {
+		fmt.Fprintln(os.Stderr, "exactly one of --config or --device is required")
+		os.Exit(1)
+	}
+	if importIPPool != "" && registryServer != "" {
+		fmt.Fprintln(os.Stderr, "--ippool: not supported with --registry-server")
+		os.Exit(1)
+	}
+	conf, err := readImportConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read WireGuard configuration: %v\n", err)
+		os.Exit(1)
+	}
+	peers, err := conf.WireGuardPeers(importSelfName, importSelfEndpointAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to convert WireGuard configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	if importPrint {
+		var claims []*wgk8s.IPClaim
+		if importIPPool != "" {
+			claims, _, err = importIPClaims(peers)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to build IPClaims: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if err = printImport(os.Stdout, peers, claims); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print resources: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	r, err := cliRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry: %v\n", err)
+		os.Exit(1)
+	}
+	// Peers matched by public key take their existing names, which the claims must reference, so
+	// they're imported first.
+	if err = wgconf.Import(ll, r, peers); err != nil {
+		ll.Fatalf("Failed to import peers: %v", err)
+	}
+	if importIPPool == "" {
+		return
+	}
+	claims, client, err := importIPClaims(peers)
+	if err != nil {
+		ll.Fatalf("Failed to build IPClaims: %v", err)
+	}
+	if err = wgconf.CreateIPClaims(ll, client, claims); err != nil {
+		ll.Fatalf("Failed to reserve addresses: %v", err)
+	}
+}
+
+// importIPClaims returns the claims reserving the peers' addresses in the --ippool.
+func importIPClaims(peers []*wgk8s.WireGuardPeer) ([]*wgk8s.IPClaim, wgmeshClient.IPClaimInterface, error) {
+	cs, namespace, err := cliRegistryClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	pool, err := cs.WgmeshV1alpha1().IPPools(namespace).Get(importIPPool, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting IPPool %q: %w", importIPPool, err)
+	}
+	claims, err := wgconf.IPClaims(pool, peers)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claims, cs.WgmeshV1alpha1().IPClaims(namespace), nil
+}
+
+func readImportConfig() (*wgconf.Config, error) {
+	if importDevice != "" {
+		client, err := wgctrl.New()
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+		device, err := client.Device(importDevice)
+		if err != nil {
+			return nil, err
+		}
+		iface, err := net.InterfaceByName(importDevice)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		var addresses []net.IPNet
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				addresses = append(addresses, *ipNet)
+			}
+		}
+		return wgconf.FromDevice(device, addresses), nil
+	}
+	if importConfig == "-" {
+		return wgconf.Parse(os.Stdin)
+	}
+	f, err := os.Open(importConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return wgconf.Parse(f)
+}
+
+func printImport(w io.Writer, peers []*wgk8s.WireGuardPeer, claims []*wgk8s.IPClaim) error {
+	var objects []interface{}
+	for _, p := range peers {
+		p.APIVersion = wgk8s.SchemeGroupVersion.String()
+		p.Kind = "WireGuardPeer"
+		objects = append(objects, p)
+	}
+	for _, c := range claims {
+		c.APIVersion = wgk8s.SchemeGroupVersion.String()
+		c.Kind = "IPClaim"
+		objects = append(objects, c)
+	}
+	for i, obj := range objects {
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
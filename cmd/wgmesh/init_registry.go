@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	"github.com/jcodybaker/wgmesh/pkg/bootstrap"
+	"github.com/jcodybaker/wgmesh/pkg/crds"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+var initNamespace, initAgentName, initPoolName string
+var initPoolCIDRs []string
+
+var initRegistryCmd = &cobra.Command{
+	Run:   runInitRegistry,
+	Use:   "init-registry",
+	Short: "Create the registry namespace, CRDs, agent RBAC, and an initial IPPool for a new mesh",
+}
+
+func init() {
+	initRegistryCmd.Flags().StringVar(&registryKubeconfig, "registry-kubeconfig", "", "path to kubeconfig file for registry")
+	initRegistryCmd.Flags().StringVar(&initNamespace, "registry-namespace", "wgmesh", "namespace to create for the mesh's records")
+	initRegistryCmd.Flags().StringVar(&initAgentName, "agent-name", "wgmesh-agent", "name of the agents' ServiceAccount, Role, and RoleBinding")
+	initRegistryCmd.Flags().StringVar(&initPoolName, "ippool-name", "default", "name of the initial IPPool")
+	initRegistryCmd.Flags().StringSliceVar(&initPoolCIDRs, "ippool-cidrs", nil, "CIDRs of the initial IPPool's ranges; no pool is created if empty")
+	initRegistryCmd.Flags().BoolVar(&crdsPrint, "print", false, "print the resources as YAML instead of creating them")
+	initRegistryCmd.Flags().DurationVar(&crdsWait, "wait", 30*time.Second, "how long to wait for the CustomResourceDefinitions to be established before creating the IPPool")
+
+	rootCmd.AddCommand(initRegistryCmd)
+}
+
+func runInitRegistry(cmd *cobra.Command, args []string) {
+	b, err := bootstrap.New(
+		bootstrap.WithLogger(ll),
+		bootstrap.WithNamespace(initNamespace),
+		bootstrap.WithAgentName(initAgentName),
+		bootstrap.WithIPPool(initPoolName, initPoolCIDRs),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry bootstrap: %v\n", err)
+		os.Exit(1)
+	}
+	if crdsPrint {
+		crdManifest, err := crds.Manifest()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to render CustomResourceDefinitions: %v\n", err)
+			os.Exit(1)
+		}
+		manifest, err := b.Manifest()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to render registry resources: %v\n", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(crdManifest)
+		os.Stdout.WriteString("---\n")
+		os.Stdout.Write(manifest)
+		return
+	}
+
+	restConfig, err := registryClientConfig().ClientConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load registry kubeconfig: %v\n", err)
+		os.Exit(1)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry client: %v\n", err)
+		os.Exit(1)
+	}
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry client: %v\n", err)
+		os.Exit(1)
+	}
+	wgClient, err := wgmeshClientSet.NewForConfig(restConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry client: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err = crds.Install(ll, dynamicClient); err != nil {
+		ll.Fatalf("Failed to install CustomResourceDefinitions: %v", err)
+	}
+	if err = waitForCRDs(dynamicClient, crdsWait); err != nil {
+		ll.Fatalf("Waiting for CustomResourceDefinitions to be established: %v", err)
+	}
+	if err = b.Apply(kubeClient, wgClient); err != nil {
+		ll.Fatalf("Failed to initialize registry: %v", err)
+	}
+}
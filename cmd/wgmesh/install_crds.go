@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/crds"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+var crdsPrint bool
+var crdsWait time.Duration
+
+var installCRDsCmd = &cobra.Command{
+	Run:   runInstallCRDs,
+	Use:   "install-crds",
+	Short: "Create or update the wgmesh CustomResourceDefinitions in the registry",
+}
+
+func init() {
+	installCRDsCmd.Flags().StringVar(&registryKubeconfig, "registry-kubeconfig", "", "path to kubeconfig file for registry")
+	installCRDsCmd.Flags().BoolVar(&crdsPrint, "print", false, "print the CustomResourceDefinitions as YAML instead of installing them")
+	installCRDsCmd.Flags().DurationVar(&crdsWait, "wait", 30*time.Second, "how long to wait for the CustomResourceDefinitions to be established; 0 disables")
+
+	rootCmd.AddCommand(installCRDsCmd)
+}
+
+func runInstallCRDs(cmd *cobra.Command, args []string) {
+	if crdsPrint {
+		manifest, err := crds.Manifest()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to render CustomResourceDefinitions: %v\n", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(manifest)
+		return
+	}
+	restConfig, err := registryClientConfig().ClientConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load registry kubeconfig: %v\n", err)
+		os.Exit(1)
+	}
+	client, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry client: %v\n", err)
+		os.Exit(1)
+	}
+	if err = crds.Install(ll, client); err != nil {
+		ll.Fatalf("Failed to install CustomResourceDefinitions: %v", err)
+	}
+	if err = waitForCRDs(client, crdsWait); err != nil {
+		ll.Fatalf("Waiting for CustomResourceDefinitions to be established: %v", err)
+	}
+}
+
+// waitForCRDs waits up to timeout for the CustomResourceDefinitions to be established. A zero
+// timeout doesn't wait.
+func waitForCRDs(client dynamic.Interface, timeout time.Duration) error {
+	if timeout == 0 {
+		return nil
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		return crds.Established(client)
+	}, waitCtx.Done())
+}
@@ -0,0 +1,69 @@
+// +build linux darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jcodybaker/wgmesh/pkg/service"
+
+	"github.com/spf13/cobra"
+)
+
+var installServiceName string
+var installServicePrint, installServiceNoStart bool
+
+var installServiceCmd = &cobra.Command{
+	Run:   runInstallService,
+	Use:   "install-service [flags] -- [agent flags]",
+	Short: "Install the agent as a systemd (Linux) or launchd (macOS) service, and start it",
+	Long: `Install the agent as a systemd (Linux) or launchd (macOS) service, and start it.
+
+The service runs ` + "`wgmesh agent`" + ` with the flags given after --, from this executable's path. It
+starts at boot and is restarted if it fails. On Linux, the unit is written to
+/etc/systemd/system/<name>.service and its logs go to the journal. On macOS, the plist is written to
+/Library/LaunchDaemons/com.codybaker.<name>.plist and its logs to /var/log/<name>.log. Installing
+again replaces the service's flags.`,
+}
+
+func init() {
+	installServiceCmd.Flags().StringVar(&installServiceName, "name", service.DefaultName, "name of the service")
+	installServiceCmd.Flags().BoolVar(&installServicePrint, "print", false, "print the unit instead of installing it")
+	installServiceCmd.Flags().BoolVar(&installServiceNoStart, "no-start", false, "install the service without starting it; it starts at the next boot")
+	rootCmd.AddCommand(installServiceCmd)
+}
+
+func runInstallService(cmd *cobra.Command, args []string) {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find the wgmesh executable: %v\n", err)
+		os.Exit(1)
+	}
+	c := service.Config{
+		Name:        installServiceName,
+		Description: "wgmesh agent",
+		Executable:  exe,
+		Args:        append([]string{"agent"}, args...),
+	}
+	if installServicePrint {
+		fmt.Print(service.Unit(c))
+		return
+	}
+	if err = service.Install(c); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to install service: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Installed %s\n", service.UnitPath(installServiceName))
+	if installServiceNoStart {
+		return
+	}
+	if err = service.Start(installServiceName); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start service: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/controller"
+	"github.com/jcodybaker/wgmesh/pkg/webhook"
+
+	"github.com/spf13/cobra"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sLabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+var ippoolRanges, ippoolReserved, ippoolExclude []string
+var ippoolStrategy, ippoolListOutput string
+var ippoolPrint bool
+
+var ippoolCmd = &cobra.Command{
+	Use:   "ippool",
+	Short: "Manage the IPPools agents allocate mesh addresses from",
+}
+
+var ippoolCreateCmd = &cobra.Command{
+	Run:   runIPPoolCreate,
+	Use:   "create NAME",
+	Short: "Create an IPPool, checking that its ranges don't overlap existing pools",
+	Args:  cobra.ExactArgs(1),
+}
+
+var ippoolListCmd = &cobra.Command{
+	Run:   runIPPoolList,
+	Use:   "list",
+	Short: "List IPPools with their ranges and utilization",
+	Args:  cobra.NoArgs,
+}
+
+var ippoolDescribeCmd = &cobra.Command{
+	Run:   runIPPoolDescribe,
+	Use:   "describe NAME",
+	Short: "Show an IPPool's ranges, utilization, and claims",
+	Args:  cobra.ExactArgs(1),
+}
+
+func init() {
+	for _, c := range []*cobra.Command{ippoolCreateCmd, ippoolListCmd, ippoolDescribeCmd} {
+		c.Flags().StringVar(&registryKubeconfig, "registry-kubeconfig", "", "path to kubeconfig file for registry")
+		c.Flags().StringVar(&registryNamespace, "registry-namespace", "", "kubernetes namespace; defaults to the kubeconfig's namespace")
+	}
+	ippoolCreateCmd.Flags().StringArrayVar(&ippoolRanges, "range", nil, "a range to allocate from, as CIDR or CIDR=START-END to limit it to part of the subnet; repeatable")
+	ippoolCreateCmd.Flags().StringSliceVar(&ippoolReserved, "reserved", nil, "addresses which should not be assigned")
+	ippoolCreateCmd.Flags().StringSliceVar(&ippoolExclude, "exclude-cidrs", nil, "subnets within the ranges which should not be assigned")
+	ippoolCreateCmd.Flags().StringVar(&ippoolStrategy, "strategy", string(wgk8s.IPAllocationRandom),
+		fmt.Sprintf("how addresses are selected. Valid: %s,%s", wgk8s.IPAllocationRandom, wgk8s.IPAllocationSequential))
+	ippoolCreateCmd.Flags().BoolVar(&ippoolPrint, "print", false, "print the IPPool as YAML instead of creating it")
+	ippoolListCmd.Flags().StringVarP(&ippoolListOutput, "output", "o", "table", "output format. Valid: table,yaml,json")
+
+	ippoolCmd.AddCommand(ippoolCreateCmd, ippoolListCmd, ippoolDescribeCmd)
+	rootCmd.AddCommand(ippoolCmd)
+}
+
+// parseIPRange parses a --range of the form CIDR or CIDR=START-END.
+func parseIPRange(s string) (wgk8s.IPRange, error) {
+	parts := strings.SplitN(s, "=", 2)
+	r := wgk8s.IPRange{CIDR: parts[0]}
+	if len(parts) == 2 {
+		bounds := strings.SplitN(parts[1], "-", 2)
+		if len(bounds) != 2 {
+			return r, fmt.Errorf("%q: expected CIDR=START-END", s)
+		}
+		r.Start, r.End = bounds[0], bounds[1]
+	}
+	return r, nil
+}
+
+func runIPPoolCreate(cmd *cobra.Command, args []string) {
+	pool := &wgk8s.IPPool{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: wgk8s.SchemeGroupVersion.String(),
+			Kind:       "IPPool",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: args[0]},
+		Spec: wgk8s.IPPoolSpec{
+			Reserved:     ippoolReserved,
+			ExcludeCIDRs: ippoolExclude,
+			Strategy:     wgk8s.IPAllocationStrategy(ippoolStrategy),
+		},
+	}
+	for _, s := range ippoolRanges {
+		r, err := parseIPRange(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--range: %v\n", err)
+			os.Exit(1)
+		}
+		pool.Spec.IPRanges = append(pool.Spec.IPRanges, r)
+	}
+	if errs := webhook.ValidateIPPool(pool); len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "Invalid IPPool: %v\n", errs.ToAggregate())
+		os.Exit(1)
+	}
+
+	cs, namespace, err := cliRegistryClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry: %v\n", err)
+		os.Exit(1)
+	}
+	pool.Namespace = namespace
+	pools, err := cs.WgmeshV1alpha1().IPPools(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list IPPools: %v\n", err)
+		os.Exit(1)
+	}
+	if errs := webhook.ValidateIPPoolOverlap(pool, pools.Items); len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "Invalid IPPool: %v\n", errs.ToAggregate())
+		os.Exit(1)
+	}
+	if ippoolPrint {
+		if err = printObject(os.Stdout, pool, "yaml"); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print IPPool: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	_, err = cs.WgmeshV1alpha1().IPPools(namespace).Create(pool)
+	if k8sErrors.IsAlreadyExists(err) {
+		fmt.Fprintf(os.Stderr, "IPPool %q already exists\n", pool.GetName())
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create IPPool: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("ippool/%s created\n", pool.GetName())
+}
+
+func runIPPoolList(cmd *cobra.Command, args []string) {
+	cs, namespace, err := cliRegistryClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry: %v\n", err)
+		os.Exit(1)
+	}
+	pools, err := cs.WgmeshV1alpha1().IPPools(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list IPPools: %v\n", err)
+		os.Exit(1)
+	}
+	claims, err := cs.WgmeshV1alpha1().IPClaims(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list IPClaims: %v\n", err)
+		os.Exit(1)
+	}
+	// Utilization is counted from the claims rather than read from the status, which is only
+	// maintained while the controller runs.
+	allocated := make(map[string]int64)
+	for _, c := range claims.Items {
+		allocated[c.GetLabels()[wgk8s.IPPoolLabel]]++
+	}
+	sort.Slice(pools.Items, func(i, j int) bool { return pools.Items[i].GetName() < pools.Items[j].GetName() })
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		pool.Status, _ = controller.IPPoolStatus(&pool.Spec, allocated[pool.GetName()])
+	}
+
+	if ippoolListOutput == "table" {
+		err = printIPPoolTable(os.Stdout, pools.Items, time.Now())
+	} else {
+		pools.APIVersion, pools.Kind = "v1", "List"
+		err = printObject(os.Stdout, pools, ippoolListOutput)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print IPPools: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func printIPPoolTable(w io.Writer, pools []wgk8s.IPPool, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tRANGES\tSTRATEGY\tCAPACITY\tALLOCATED\tUTILIZATION\tAGE")
+	for _, p := range pools {
+		var ranges []string
+		for _, r := range p.Spec.IPRanges {
+			ranges = append(ranges, formatIPRange(r))
+		}
+		strategy := string(p.Spec.Strategy)
+		if strategy == "" {
+			strategy = string(wgk8s.IPAllocationRandom)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			p.GetName(),
+			listOrNone(ranges),
+			strategy,
+			valueOrUnknown(p.Status.Capacity),
+			p.Status.Allocated,
+			valueOrUnknown(p.Status.Utilization),
+			duration.HumanDuration(now.Sub(p.GetCreationTimestamp().Time)),
+		)
+	}
+	return tw.Flush()
+}
+
+func formatIPRange(r wgk8s.IPRange) string {
+	if r.Start == "" && r.End == "" {
+		return r.CIDR
+	}
+	return fmt.Sprintf("%s=%s-%s", r.CIDR, r.Start, r.End)
+}
+
+func valueOrUnknown(s string) string {
+	if s == "" {
+		return "<unknown>"
+	}
+	return s
+}
+
+func runIPPoolDescribe(cmd *cobra.Command, args []string) {
+	cs, namespace, err := cliRegistryClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry: %v\n", err)
+		os.Exit(1)
+	}
+	pool, err := cs.WgmeshV1alpha1().IPPools(namespace).Get(args[0], metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		fmt.Fprintf(os.Stderr, "IPPool %q not found\n", args[0])
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get IPPool: %v\n", err)
+		os.Exit(1)
+	}
+	claims, err := cs.WgmeshV1alpha1().IPClaims(namespace).List(metav1.ListOptions{
+		LabelSelector: k8sLabels.SelectorFromSet(k8sLabels.Set{wgk8s.IPPoolLabel: pool.GetName()}).String(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list IPClaims: %v\n", err)
+		os.Exit(1)
+	}
+	pool.Status, _ = controller.IPPoolStatus(&pool.Spec, int64(len(claims.Items)))
+	if err = describeIPPool(os.Stdout, pool, claims.Items, time.Now()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print IPPool: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func describeIPPool(w io.Writer, pool *wgk8s.IPPool, claims []wgk8s.IPClaim, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	strategy := string(pool.Spec.Strategy)
+	if strategy == "" {
+		strategy = string(wgk8s.IPAllocationRandom)
+	}
+	fmt.Fprintf(tw, "Name:\t%s\n", pool.GetName())
+	fmt.Fprintf(tw, "Namespace:\t%s\n", pool.GetNamespace())
+	fmt.Fprintf(tw, "Strategy:\t%s\n", strategy)
+	label := "Ranges:"
+	for _, r := range pool.Spec.IPRanges {
+		fmt.Fprintf(tw, "%s\t%s\n", label, formatIPRange(r))
+		label = ""
+	}
+	fmt.Fprintf(tw, "Reserved:\t%s\n", listOrNone(pool.Spec.Reserved))
+	fmt.Fprintf(tw, "Excluded:\t%s\n", listOrNone(pool.Spec.ExcludeCIDRs))
+	fmt.Fprintf(tw, "Capacity:\t%s\n", valueOrUnknown(pool.Status.Capacity))
+	fmt.Fprintf(tw, "Allocated:\t%d\n", pool.Status.Allocated)
+	fmt.Fprintf(tw, "Utilization:\t%s\n", valueOrUnknown(pool.Status.Utilization))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(claims) == 0 {
+		_, err := fmt.Fprintln(w, "Claims:      <none>")
+		return err
+	}
+	fmt.Fprintln(w, "Claims:")
+	sort.Slice(claims, func(i, j int) bool { return claims[i].GetName() < claims[j].GetName() })
+	tw = tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "  IP\tPEER\tLEASE EXPIRES")
+	for _, c := range claims {
+		peer := c.Spec.Peer
+		for _, o := range c.GetOwnerReferences() {
+			if o.Kind == "WireGuardPeer" {
+				peer = o.Name
+			}
+		}
+		expires := "<none>"
+		if c.Spec.LeaseExpires != nil {
+			expires = "in " + duration.HumanDuration(c.Spec.LeaseExpires.Sub(now))
+			if c.Spec.LeaseExpires.Time.Before(now) {
+				expires = duration.HumanDuration(now.Sub(c.Spec.LeaseExpires.Time)) + " ago"
+			}
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", c.Spec.IP, valueOrUnknown(peer), expires)
+	}
+	return tw.Flush()
+}
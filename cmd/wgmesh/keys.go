@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// The key commands match the output of `wg genkey`, `wg pubkey`, and `wg genpsk`: a base64 key
+// followed by a newline.
+
+var genkeyCmd = &cobra.Command{
+	Run:   runGenkey,
+	Use:   "genkey",
+	Short: "Generate a WireGuard private key and print it to stdout",
+	Args:  cobra.NoArgs,
+}
+
+var pubkeyCmd = &cobra.Command{
+	Run:   runPubkey,
+	Use:   "pubkey",
+	Short: "Read a WireGuard private key from stdin and print its public key to stdout",
+	Args:  cobra.NoArgs,
+}
+
+var genpskCmd = &cobra.Command{
+	Run:   runGenpsk,
+	Use:   "genpsk",
+	Short: "Generate a WireGuard preshared key and print it to stdout",
+	Args:  cobra.NoArgs,
+}
+
+func init() {
+	rootCmd.AddCommand(genkeyCmd, pubkeyCmd, genpskCmd)
+}
+
+func runGenkey(cmd *cobra.Command, args []string) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate private key: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(key.String())
+}
+
+func runPubkey(cmd *cobra.Command, args []string) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintf(os.Stderr, "Failed to read private key: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := wgtypes.ParseKey(strings.TrimSpace(line))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Key is not the correct length or format")
+		os.Exit(1)
+	}
+	fmt.Println(key.PublicKey().String())
+}
+
+func runGenpsk(cmd *cobra.Command, args []string) {
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate preshared key: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(key.String())
+}
@@ -2,30 +2,61 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/jcodybaker/wgmesh/pkg/log"
+	"github.com/jcodybaker/wgmesh/pkg/report"
 
 	"github.com/sirupsen/logrus"
 
-	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var debug bool
+var logLevel, logOutput, logFormat string
+var logFile log.FileOptions
+var errorReportURL string
 var ctx context.Context
 var ll logrus.FieldLogger
 
 var rootCmd = &cobra.Command{
+	Use: "wgmesh",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		levels, err := log.ParseLevels(logLevel)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--log-level: %v\n", err)
+			os.Exit(1)
+		}
 		if debug {
-			logrus.SetLevel(logrus.DebugLevel)
+			levels.Default = logrus.DebugLevel
+		}
+		log.SetLevels(levels)
+		if err = log.SetOutput(logOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "--log-output: %v\n", err)
+			os.Exit(1)
+		}
+		if logFile.Path != "" {
+			if err = log.SetFile(logFile); err != nil {
+				fmt.Fprintf(os.Stderr, "--log-file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if err = log.SetFormat(logFormat); err != nil {
+			fmt.Fprintf(os.Stderr, "--log-format: %v\n", err)
+			os.Exit(1)
 		}
-		if isatty.IsTerminal(os.Stdout.Fd()) {
-			logrus.SetFormatter(&logrus.TextFormatter{})
+		if errorReportURL != "" {
+			if u, err := url.Parse(errorReportURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				fmt.Fprintf(os.Stderr, "--error-report-url: must be an http or https URL\n")
+				os.Exit(1)
+			}
+			report.Install(report.NewHTTP(errorReportURL, nil))
 		}
 	},
 }
@@ -42,7 +73,16 @@ func init() {
 }
 
 func main() {
-	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "debug logging")
+	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "debug logging; shorthand for --log-level=default=debug")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "log level, or comma separated subsystem=level pairs, ex. ipam=debug,default=info. Subsystems: "+strings.Join(log.Subsystems, ","))
+	rootCmd.PersistentFlags().StringVar(&logOutput, "log-output", log.OutputStderr, "where logs are written; journald maps log fields to journal fields. Valid: "+strings.Join(log.Outputs, ","))
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", log.FormatAuto, "log format; auto is text when logs are written to a terminal, and json otherwise. Valid: "+strings.Join(log.Formats, ","))
+	rootCmd.PersistentFlags().StringVar(&logFile.Path, "log-file", "", "write logs to this file, rotating it by size and age, instead of stderr")
+	rootCmd.PersistentFlags().IntVar(&logFile.MaxSize, "log-file-max-size", 100, "with --log-file, rotate the file once it reaches this many megabytes")
+	rootCmd.PersistentFlags().DurationVar(&logFile.MaxAge, "log-file-max-age", 0, "with --log-file, rotate the file once it has been written to for this long. 0 = rotate by size only")
+	rootCmd.PersistentFlags().IntVar(&logFile.MaxBackups, "log-file-max-backups", 5, "with --log-file, how many rotated files to keep. 0 = keep all")
+	rootCmd.PersistentFlags().StringVar(&errorReportURL, "error-report-url", "", "post unexpected errors and panics as JSON to this URL, ex. an error tracking service's ingestion endpoint")
+	defer report.Recover()
 	rootCmd.Execute()
 }
 
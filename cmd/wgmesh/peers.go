@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sLabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"sigs.k8s.io/yaml"
+)
+
+var peersSelector, peersListOutput, peersGetOutput, peersDeleteMesh string
+var peersDeleteReleaseIPs, peersDeleteRevokeKey, peersDeleteForce bool
+
+var peersCmd = &cobra.Command{
+	Use:     "peers",
+	Aliases: []string{"peer"},
+	Short:   "Inspect and manage the WireGuardPeers in the registry",
+}
+
+var peersListCmd = &cobra.Command{
+	Run:   runPeersList,
+	Use:   "list",
+	Short: "List WireGuardPeers with their endpoints, addresses, routes, and health",
+	Args:  cobra.NoArgs,
+}
+
+var peersGetCmd = &cobra.Command{
+	Run:   runPeersGet,
+	Use:   "get NAME",
+	Short: "Print a WireGuardPeer",
+	Args:  cobra.ExactArgs(1),
+}
+
+var peersDeleteCmd = &cobra.Command{
+	Run:   runPeersDelete,
+	Use:   "delete NAME",
+	Short: "Remove a WireGuardPeer from the registry, disconnecting it from the mesh",
+	Long: `Remove a WireGuardPeer from the registry, disconnecting it from the mesh.
+
+Agents remove the peer and its routes once the record is gone, so a host which can no longer run the
+agent itself can be decommissioned from anywhere. --release-ips returns the peer's addresses to their
+IPPools, including those reserved for it by name. --revoke-key adds the peer's public key to a Mesh's
+revokedPublicKeys, so agents won't connect to the key even if it's registered again; use it when the
+host's private key may be compromised.`,
+	Args: cobra.ExactArgs(1),
+}
+
+func init() {
+	for _, c := range []*cobra.Command{peersListCmd, peersGetCmd, peersDeleteCmd} {
+		addRegistryClientFlags(c)
+	}
+	peersListCmd.Flags().StringVarP(&peersSelector, "selector", "l", "", "only list peers matching this label selector")
+	peersListCmd.Flags().StringVarP(&peersListOutput, "output", "o", "table", "output format. Valid: table,wide,yaml,json")
+	peersGetCmd.Flags().StringVarP(&peersGetOutput, "output", "o", "yaml", "output format. Valid: yaml,json")
+	peersDeleteCmd.Flags().BoolVar(&peersDeleteReleaseIPs, "release-ips", false, "release the peer's IPClaims; with --registry-server, only those its agent claimed")
+	peersDeleteCmd.Flags().BoolVar(&peersDeleteRevokeKey, "revoke-key", false, "revoke the peer's public key so agents won't connect to it again; not supported with --registry-server")
+	peersDeleteCmd.Flags().StringVar(&peersDeleteMesh, "mesh", "", "with --revoke-key, the Mesh to record the revocation in; defaults to the first Mesh by name selecting the peer, or else the first Mesh")
+	peersDeleteCmd.Flags().BoolVar(&peersDeleteForce, "force", false, "delete the peer even if it's protected")
+
+	peersCmd.AddCommand(peersListCmd, peersGetCmd, peersDeleteCmd)
+	rootCmd.AddCommand(peersCmd)
+}
+
+// addRegistryClientFlags adds the flags which select the registry used by cliRegistry.
+func addRegistryClientFlags(c *cobra.Command) {
+	c.Flags().StringVar(&registryKubeconfig, "registry-kubeconfig", "", "path to kubeconfig file for registry")
+	c.Flags().StringVar(&registryNamespace, "registry-namespace", "", "kubernetes namespace; defaults to the kubeconfig's namespace")
+	c.Flags().StringVar(&registryServer, "registry-server", "", "URL of a wgmesh server to use as the registry instead of Kubernetes")
+	c.Flags().StringVar(&registryTokenFile, "registry-token-file", "", "with --registry-server, path to a file containing the bearer token")
+	c.Flags().StringVar(&registryCAFile, "registry-ca-file", "", "with --registry-server, path to PEM certificates used to verify the server; defaults to the system roots")
+	c.Flags().StringVar(&registryCertFile, "registry-cert-file", "", "with --registry-server, path to a PEM client certificate presented to the server; reloaded when modified")
+	c.Flags().StringVar(&registryKeyFile, "registry-key-file", "", "with --registry-cert-file, path to the client certificate's private key")
+}
+
+// cliRegistry returns the registry selected by the flags added with addRegistryClientFlags.
+func cliRegistry() (registry.Registry, error) {
+	if registryServer != "" {
+		return serverRegistry(registryServer, registryTokenFile, registryCAFile, registryCertFile, registryKeyFile)
+	}
+	cs, namespace, err := cliRegistryClient()
+	if err != nil {
+		return nil, err
+	}
+	return registry.NewKubernetes(cs, namespace), nil
+}
+
+// cliRegistryClient returns a client and namespace for the Kubernetes registry selected by the
+// flags added with addRegistryClientFlags.
+func cliRegistryClient() (wgmeshClientSet.Interface, string, error) {
+	config := registryClientConfig()
+	namespace := registryNamespace
+	if namespace == "" {
+		var err error
+		namespace, _, err = config.Namespace()
+		if err != nil {
+			return nil, "", fmt.Errorf("looking up namespace for registry kubeconfig: %w", err)
+		}
+	}
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("loading registry kubeconfig: %w", err)
+	}
+	cs, err := wgmeshClientSet.NewForConfig(restConfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("initializing registry client: %w", err)
+	}
+	return cs, namespace, nil
+}
+
+func runPeersList(cmd *cobra.Command, args []string) {
+	selector, err := k8sLabels.Parse(peersSelector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--selector: %v\n", err)
+		os.Exit(1)
+	}
+	r, err := cliRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry: %v\n", err)
+		os.Exit(1)
+	}
+	// Health is judged by other peers' observations, so list everything and filter afterwards.
+	list, err := r.WatchPeers(nil, nil).List(metav1.ListOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list WireGuardPeers: %v\n", err)
+		os.Exit(1)
+	}
+	all := list.(*wgk8s.WireGuardPeerList).Items
+	out := &wgk8s.WireGuardPeerList{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "List"}}
+	for _, p := range all {
+		if selector.Matches(k8sLabels.Set(p.GetLabels())) {
+			out.Items = append(out.Items, p)
+		}
+	}
+	sort.Slice(out.Items, func(i, j int) bool { return out.Items[i].GetName() < out.Items[j].GetName() })
+
+	switch peersListOutput {
+	case "table", "wide":
+		err = printPeerTable(os.Stdout, out.Items, all, peersListOutput == "wide", time.Now())
+	default:
+		err = printObject(os.Stdout, out, peersListOutput)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print WireGuardPeers: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runPeersGet(cmd *cobra.Command, args []string) {
+	r, err := cliRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry: %v\n", err)
+		os.Exit(1)
+	}
+	peer, err := r.Get(args[0])
+	if k8sErrors.IsNotFound(err) {
+		fmt.Fprintf(os.Stderr, "WireGuardPeer %q not found\n", args[0])
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get WireGuardPeer: %v\n", err)
+		os.Exit(1)
+	}
+	peer.APIVersion = wgk8s.SchemeGroupVersion.String()
+	peer.Kind = "WireGuardPeer"
+	if err = printObject(os.Stdout, peer, peersGetOutput); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print WireGuardPeer: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runPeersDelete(cmd *cobra.Command, args []string) {
+	name := args[0]
+	if peersDeleteRevokeKey && registryServer != "" {
+		fmt.Fprintln(os.Stderr, "--revoke-key: not supported with --registry-server")
+		os.Exit(1)
+	}
+	if peersDeleteMesh != "" && !peersDeleteRevokeKey {
+		fmt.Fprintln(os.Stderr, "--mesh: requires --revoke-key")
+		os.Exit(1)
+	}
+	r, err := cliRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry: %v\n", err)
+		os.Exit(1)
+	}
+	peer, err := r.Get(name)
+	if k8sErrors.IsNotFound(err) {
+		fmt.Fprintf(os.Stderr, "WireGuardPeer %q not found\n", name)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get WireGuardPeer: %v\n", err)
+		os.Exit(1)
+	}
+	if peer.IsProtected() && !peersDeleteForce {
+		fmt.Fprintf(os.Stderr, "WireGuardPeer %q is protected; use --force to delete it\n", name)
+		os.Exit(1)
+	}
+	ll := ll.WithField("k8s_name", name)
+
+	// Revoke first, so the key is never left usable by a delete which succeeded without it.
+	if peersDeleteRevokeKey {
+		mesh, err := revokePeerKey(peer)
+		if err != nil {
+			ll.Fatalf("Failed to revoke public key: %v", err)
+		}
+		ll.WithField("mesh", mesh).Info("revoked public key")
+	}
+	if peer.IsProtected() || hasProtectedFinalizer(peer) {
+		// Agents keep protected peers, and the apiserver won't finalize the delete, until the
+		// protection is removed.
+		unprotectPeer(peer)
+		if peer, err = r.Update(peer); err != nil {
+			ll.Fatalf("Failed to remove protection: %v", err)
+		}
+		ll.Info("removed protection")
+	}
+	if err = r.Delete(name, peer.GetUID()); err != nil && !k8sErrors.IsNotFound(err) {
+		ll.Fatalf("Failed to delete WireGuardPeer: %v", err)
+	}
+	ll.Info("deleted WireGuardPeer")
+
+	if !peersDeleteReleaseIPs {
+		return
+	}
+	owner := &metav1.OwnerReference{
+		APIVersion: wgk8s.SchemeGroupVersion.String(),
+		Kind:       "WireGuardPeer",
+		Name:       name,
+		UID:        peer.GetUID(),
+	}
+	if err = r.IPAM(0).ReleaseIPs("", owner); err != nil {
+		ll.Fatalf("Failed to release IPClaims: %v", err)
+	}
+	if registryServer == "" {
+		if err = releaseReservedIPs(name); err != nil {
+			ll.Fatalf("Failed to release reserved IPClaims: %v", err)
+		}
+	}
+	ll.Info("released IPClaims")
+}
+
+// revokePeerKey adds the peer's public key to the revokedPublicKeys of the --mesh, or else of the
+// first Mesh by name selecting the peer, or else the first Mesh. It returns the Mesh's name.
+func revokePeerKey(peer *wgk8s.WireGuardPeer) (string, error) {
+	cs, namespace, err := cliRegistryClient()
+	if err != nil {
+		return "", err
+	}
+	meshes := cs.WgmeshV1alpha1().Meshes(namespace)
+	var mesh *wgk8s.Mesh
+	if peersDeleteMesh != "" {
+		mesh, err = meshes.Get(peersDeleteMesh, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("getting Mesh %q: %w", peersDeleteMesh, err)
+		}
+	} else {
+		list, err := meshes.List(metav1.ListOptions{})
+		if err != nil {
+			return "", fmt.Errorf("listing Meshes: %w", err)
+		}
+		if mesh = revocationMesh(list.Items, peer); mesh == nil {
+			return "", fmt.Errorf("no Mesh in namespace %q to record the revocation in; create one first", namespace)
+		}
+	}
+	for _, key := range mesh.Spec.RevokedPublicKeys {
+		if key == peer.Spec.PublicKey {
+			return mesh.GetName(), nil
+		}
+	}
+	mesh.Spec.RevokedPublicKeys = append(mesh.Spec.RevokedPublicKeys, peer.Spec.PublicKey)
+	if _, err = meshes.Update(mesh); err != nil {
+		return "", fmt.Errorf("updating Mesh %q: %w", mesh.GetName(), err)
+	}
+	return mesh.GetName(), nil
+}
+
+// revocationMesh returns the first Mesh by name whose selector matches the peer, or else the first
+// Mesh. Revocations apply to the whole namespace, so this only keeps them near the peer's settings.
+func revocationMesh(meshes []wgk8s.Mesh, peer *wgk8s.WireGuardPeer) *wgk8s.Mesh {
+	sort.Slice(meshes, func(i, j int) bool { return meshes[i].GetName() < meshes[j].GetName() })
+	for i := range meshes {
+		selector := k8sLabels.Everything()
+		if s := meshes[i].Spec.PeerSelector; s != nil {
+			var err error
+			if selector, err = metav1.LabelSelectorAsSelector(s); err != nil {
+				continue
+			}
+		}
+		if selector.Matches(k8sLabels.Set(peer.GetLabels())) {
+			return &meshes[i]
+		}
+	}
+	if len(meshes) == 0 {
+		return nil
+	}
+	return &meshes[0]
+}
+
+// releaseReservedIPs deletes the IPClaims which reserve addresses for the named peer without being
+// owned by it.
+func releaseReservedIPs(name string) error {
+	cs, namespace, err := cliRegistryClient()
+	if err != nil {
+		return err
+	}
+	claims := cs.WgmeshV1alpha1().IPClaims(namespace)
+	list, err := claims.List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing IPClaims: %w", err)
+	}
+	for _, claim := range list.Items {
+		if claim.Spec.Peer != name {
+			continue
+		}
+		err = claims.Delete(claim.GetName(), &metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(claim.GetUID()))})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("deleting IPClaim %q: %w", claim.GetName(), err)
+		}
+	}
+	return nil
+}
+
+func hasProtectedFinalizer(peer *wgk8s.WireGuardPeer) bool {
+	for _, f := range peer.GetFinalizers() {
+		if f == wgk8s.ProtectedFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// unprotectPeer removes the protected annotation and finalizer.
+func unprotectPeer(peer *wgk8s.WireGuardPeer) {
+	var finalizers []string
+	for _, f := range peer.GetFinalizers() {
+		if f != wgk8s.ProtectedFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	peer.SetFinalizers(finalizers)
+	annotations := peer.GetAnnotations()
+	delete(annotations, wgk8s.ProtectedAnnotation)
+	peer.SetAnnotations(annotations)
+}
+
+// printObject writes obj as yaml or json.
+func printObject(w io.Writer, obj interface{}, format string) error {
+	var out []byte
+	var err error
+	switch format {
+	case "yaml":
+		out, err = yaml.Marshal(obj)
+	case "json":
+		out, err = json.MarshalIndent(obj, "", "  ")
+		out = append(out, '\n')
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// printPeerTable writes a row for each of the peers. SEEN BY counts the peers in all which report
+// completing handshakes with the peer; a peer nobody has seen is likely down or unreachable.
+func printPeerTable(w io.Writer, peers, all []wgk8s.WireGuardPeer, wide bool, now time.Time) error {
+	seenBy := make(map[string]int)
+	for _, p := range all {
+		for _, o := range p.Status.ObservedEndpoints {
+			seenBy[o.PublicKey]++
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	header := "NAME\tENDPOINT\tIPS\tROUTES\tSEEN BY\tCONDITIONS\tAGE"
+	if wide {
+		header += "\tPUBLIC KEY\tOBSERVED AT"
+	}
+	fmt.Fprintln(tw, header)
+	for _, p := range peers {
+		endpoint := p.Spec.Endpoint
+		if endpoint == "" {
+			endpoint = "<client-only>"
+		}
+		var conditions []string
+		for _, c := range p.Status.Conditions {
+			if c.Status == corev1.ConditionTrue {
+				conditions = append(conditions, string(c.Type))
+			}
+		}
+		row := []string{
+			p.GetName(),
+			endpoint,
+			listOrNone(p.Spec.IPs),
+			listOrNone(p.Spec.Routes),
+			fmt.Sprintf("%d/%d", seenBy[p.Spec.PublicKey], len(all)-1),
+			listOrNone(conditions),
+			duration.HumanDuration(now.Sub(p.GetCreationTimestamp().Time)),
+		}
+		if wide {
+			var observedAt []string
+			for _, other := range all {
+				for _, o := range other.Status.ObservedEndpoints {
+					if o.PublicKey == p.Spec.PublicKey {
+						observedAt = append(observedAt, o.Endpoint)
+					}
+				}
+			}
+			sort.Strings(observedAt)
+			row = append(row, p.Spec.PublicKey, listOrNone(observedAt))
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "<none>"
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/agent"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+var pinsCmd = &cobra.Command{
+	Use:   "pins",
+	Short: "List and approve the public keys the local agent pinned for peers",
+	Long: `List and approve the public keys the local agent pinned for peers.
+
+An agent run with --pinned-keys-file pins each peer's public key the first time it sees the peer. A
+peer later seen with a different key, ex. impersonated through a compromised registry, is ignored,
+or with --key-pinning=alert, reported. Approve a legitimate key rotation on each agent, before or
+after the peer registers its new key; until the peer is seen with the new key, either is accepted.
+
+Agents in a mesh which pins keys must keep theirs across restarts, with --peer-cache or
+--key-provider. An agent which loses its key, ex. with its peer cache, registers a new one, which
+is a rotation like any other.`,
+}
+
+var pinsListCmd = &cobra.Command{
+	Run:   runPinsList,
+	Use:   "list",
+	Short: "List the pinned public keys",
+	Args:  cobra.NoArgs,
+}
+
+var pinsApproveCmd = &cobra.Command{
+	Run:   runPinsApprove,
+	Use:   "approve NAME PUBLIC_KEY",
+	Short: "Approve a rotation of a peer's public key",
+	Args:  cobra.ExactArgs(2),
+}
+
+func init() {
+	pinsCmd.PersistentFlags().StringVar(&controlSocket, "control-socket", "", "path to the local agent's control socket")
+	pinsCmd.MarkPersistentFlagRequired("control-socket")
+	pinsCmd.AddCommand(pinsListCmd, pinsApproveCmd)
+	rootCmd.AddCommand(pinsCmd)
+}
+
+func runPinsList(cmd *cobra.Command, args []string) {
+	resp, err := agent.NewControlClient(controlSocket).Get(agent.ControlBaseURL + "/v1/pins")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pins: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "pins: %s: %s", resp.Status, body)
+		os.Exit(1)
+	}
+	var pins []*agent.KeyPin
+	if err = json.NewDecoder(resp.Body).Decode(&pins); err != nil {
+		fmt.Fprintf(os.Stderr, "pins: %v\n", err)
+		os.Exit(1)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPUBLIC KEY\tPINNED\tAPPROVED")
+	for _, p := range pins {
+		approved := p.Approved
+		if approved == "" {
+			approved = "<none>"
+		}
+		pinned := duration.HumanDuration(time.Since(p.PinnedAt)) + " ago"
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Name, p.PublicKey, pinned, approved)
+	}
+	tw.Flush()
+}
+
+func runPinsApprove(cmd *cobra.Command, args []string) {
+	u := agent.ControlBaseURL + "/v1/pins/approve?" + url.Values{"name": {args[0]}, "publicKey": {args[1]}}.Encode()
+	resp, err := agent.NewControlClient(controlSocket).Post(u, "", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pins approve: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "pins approve: %s: %s", resp.Status, body)
+		os.Exit(1)
+	}
+}
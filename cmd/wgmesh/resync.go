@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/jcodybaker/wgmesh/pkg/agent"
+
+	"github.com/spf13/cobra"
+)
+
+var resyncCmd = &cobra.Command{
+	Run:   runResync,
+	Use:   "resync",
+	Short: "Force the local agent to list the registry again and reapply its full config",
+	Long: `Force the local agent to list the registry again and reapply its full config.
+
+The local agent, reached through its --control-socket, lists its WireGuardPeers from the registry
+rather than relying on its watch, applying any changes it missed, then replaces the interface's peers
+and routes with the config it wants, correcting changes made outside the agent. Useful after
+suspected drift, or when debugging missed watch events.`,
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	resyncCmd.Flags().StringVar(&controlSocket, "control-socket", "", "path to the local agent's control socket")
+	resyncCmd.MarkFlagRequired("control-socket")
+	rootCmd.AddCommand(resyncCmd)
+}
+
+func runResync(cmd *cobra.Command, args []string) {
+	resp, err := agent.NewControlClient(controlSocket).Post(agent.ControlBaseURL+"/v1/resync", "", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "resync: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "resync: %s: %s", resp.Status, body)
+		os.Exit(1)
+	}
+}
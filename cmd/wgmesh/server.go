@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	"github.com/jcodybaker/wgmesh/pkg/controller"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/jcodybaker/wgmesh/pkg/server"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var serverListenAddr, serverCertFile, serverKeyFile, serverTokenFile string
+var serverStore, serverSeedFile, serverNamespace, serverAuthFile, serverClientCAFile string
+var serverGCInterval, serverGCGracePeriod time.Duration
+
+var serverCmd = &cobra.Command{
+	Run:   runServer,
+	Use:   "server",
+	Short: "Serve a registry over HTTP for agents run with --registry-server",
+}
+
+func init() {
+	serverCmd.Flags().StringVar(&serverListenAddr, "listen-addr", ":8443", "address to serve registry requests")
+	serverCmd.Flags().StringVar(&serverCertFile, "tls-cert-file", "", "path to the TLS certificate; without it the registry is served over plain HTTP")
+	serverCmd.Flags().StringVar(&serverKeyFile, "tls-key-file", "", "path to the TLS private key")
+	serverCmd.Flags().StringVar(&serverTokenFile, "token-file", "", "path to a file of bearer tokens accepted from agents, one per line; each grants full access")
+	serverCmd.Flags().StringVar(&serverAuthFile, "auth-file", "", "path to a YAML policy of identities, authenticated by token or client certificate, and the peers and pools each may change; reloaded when modified")
+	serverCmd.Flags().StringVar(&serverClientCAFile, "client-ca-file", "", "with --tls-cert-file, path to PEM certificates used to verify client certificates; reloaded when modified")
+	serverCmd.Flags().StringVar(&serverStore, "store", "memory", "where records are stored. Valid: memory,kubernetes")
+	serverCmd.Flags().StringVar(&serverSeedFile, "seed-file", "", "with --store=memory, path to YAML Meshes, IPPools, and WireGuardPeers to load at startup")
+	serverCmd.Flags().StringVar(&registryKubeconfig, "registry-kubeconfig", "", "with --store=kubernetes, path to kubeconfig file for registry")
+	serverCmd.Flags().StringVar(&serverNamespace, "registry-namespace", "default", "namespace of the served records")
+	serverCmd.Flags().DurationVar(&serverGCInterval, "gc-interval", time.Minute, "with --store=memory, how often to garbage collect expired and orphaned IPClaims, and peers whose leases expired; 0 disables")
+	serverCmd.Flags().DurationVar(&serverGCGracePeriod, "gc-grace-period", 5*time.Minute, "with --store=memory, how long an IPClaim must be orphaned before it is deleted")
+
+	rootCmd.AddCommand(serverCmd)
+}
+
+func runServer(cmd *cobra.Command, args []string) {
+	if serverTokenFile == "" && serverAuthFile == "" {
+		fmt.Fprintln(os.Stderr, "--token-file or --auth-file is required")
+		os.Exit(1)
+	}
+	var tokens []string
+	var err error
+	if serverTokenFile != "" {
+		tokens, err = readTokenFile(serverTokenFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--token-file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if (serverCertFile == "") != (serverKeyFile == "") {
+		fmt.Fprintln(os.Stderr, "--tls-cert-file and --tls-key-file must be specified together")
+		os.Exit(1)
+	}
+	if serverClientCAFile != "" && serverCertFile == "" {
+		fmt.Fprintln(os.Stderr, "--client-ca-file requires --tls-cert-file")
+		os.Exit(1)
+	}
+
+	var store registry.Registry
+	switch serverStore {
+	case "memory":
+		var seed []runtime.Object
+		if serverSeedFile != "" {
+			seed, err = registry.ReadManifests(serverSeedFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "--seed-file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		store, err = registry.NewMemory(serverNamespace, seed...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "--seed-file: %v\n", err)
+			os.Exit(1)
+		}
+		// Nothing else collects the in-memory registry's records, so collect them here.
+		if serverGCInterval > 0 {
+			c, err := controller.NewController(
+				controller.WithLogger(ll),
+				controller.WithRegistry(store),
+				controller.WithRegistryNamespace(serverNamespace),
+				controller.WithGCInterval(serverGCInterval),
+				controller.WithGCGracePeriod(serverGCGracePeriod),
+			)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to initialize garbage collection: %v\n", err)
+				os.Exit(1)
+			}
+			go c.Run(ctx)
+		}
+	case "kubernetes":
+		restConfig, err := registryClientConfig().ClientConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load registry kubeconfig: %v\n", err)
+			os.Exit(1)
+		}
+		cs, err := wgmeshClientSet.NewForConfig(restConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to initialize registry client: %v\n", err)
+			os.Exit(1)
+		}
+		store = registry.NewKubernetes(cs, serverNamespace)
+	default:
+		fmt.Fprintf(os.Stderr, "--store: invalid %q; valid: memory,kubernetes\n", serverStore)
+		os.Exit(1)
+	}
+
+	s, err := server.NewServer(
+		server.WithLogger(ll),
+		server.WithListenAddr(serverListenAddr),
+		server.WithTLSFiles(serverCertFile, serverKeyFile),
+		server.WithTokens(tokens),
+		server.WithAuthFile(serverAuthFile),
+		server.WithClientCAFile(serverClientCAFile),
+		server.WithRegistry(store),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize server: %v\n", err)
+		os.Exit(1)
+	}
+	err = s.Run(ctx)
+	if ctx.Err() == nil && err != nil {
+		ll.Fatalf("Failed to run server: %v", err)
+	}
+}
+
+// readTokenFile reads bearer tokens, one per line. Blank lines and lines starting with # are
+// ignored.
+func readTokenFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tokens []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens in %q", path)
+	}
+	return tokens, nil
+}
+
+// serverRegistry returns a registry backed by a `wgmesh server`. With certFile and keyFile, a client
+// certificate is presented, and reloaded when the files are modified.
+func serverRegistry(url, tokenFile, caFile, certFile, keyFile string) (registry.Registry, error) {
+	var token string
+	if tokenFile != "" {
+		tokens, err := readTokenFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading token: %w", err)
+		}
+		token = tokens[0]
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", caFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("the client certificate and key files must be specified together")
+	}
+	if certFile != "" {
+		keyPair, err := server.NewKeyPairReloader(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client certificate: %w", err)
+		}
+		transport.TLSClientConfig.GetClientCertificate = keyPair.GetClientCertificate
+	}
+	return registry.NewHTTP(url, token, &http.Client{Transport: transport}), nil
+}
@@ -0,0 +1,10 @@
+// +build !windows
+
+package main
+
+import "context"
+
+// runService runs the agent in the foreground.
+func runService(ctx context.Context, run func(ctx context.Context) error) error {
+	return run(ctx)
+}
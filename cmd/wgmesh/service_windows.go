@@ -0,0 +1,130 @@
+// +build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jcodybaker/wgmesh/pkg/service"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// windowsService is set, by the service's command line, when the agent is run by the service
+// control manager.
+var windowsService, serviceName string
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Manage the agent as a Windows service",
+}
+
+var serviceInstallCmd = &cobra.Command{
+	Run:   runServiceInstall,
+	Use:   "install [flags] -- [agent flags]",
+	Short: "Install the agent as an automatically started Windows service",
+	Long: `Install the agent as an automatically started Windows service.
+
+The service runs ` + "`wgmesh agent`" + ` with the flags given after --, from this executable's path. The
+service control manager restarts the agent if it fails, and its logs are written to the Application
+event log under the service's name. Settings not given by flag are taken from the registry's Meshes,
+as with any agent.`,
+}
+
+var serviceUninstallCmd = &cobra.Command{
+	Run:   runServiceUninstall,
+	Use:   "uninstall",
+	Short: "Stop and remove the agent's Windows service",
+	Args:  cobra.NoArgs,
+}
+
+var serviceStartCmd = &cobra.Command{
+	Run:   runServiceStart,
+	Use:   "start",
+	Short: "Start the agent's Windows service",
+	Args:  cobra.NoArgs,
+}
+
+var serviceStopCmd = &cobra.Command{
+	Run:   runServiceStop,
+	Use:   "stop",
+	Short: "Stop the agent's Windows service",
+	Args:  cobra.NoArgs,
+}
+
+func init() {
+	for _, c := range []*cobra.Command{serviceInstallCmd, serviceUninstallCmd, serviceStartCmd, serviceStopCmd} {
+		c.Flags().StringVar(&serviceName, "name", service.DefaultName, "name of the Windows service")
+	}
+	serviceCmd.AddCommand(serviceInstallCmd, serviceUninstallCmd, serviceStartCmd, serviceStopCmd)
+	rootCmd.AddCommand(serviceCmd)
+
+	agentCmd.Flags().StringVar(&windowsService, "windows-service", "", "run as the named Windows service; set by `wgmesh service install`")
+	agentCmd.Flags().MarkHidden("windows-service")
+}
+
+func runServiceInstall(cmd *cobra.Command, args []string) {
+	for _, a := range args {
+		if a == "--windows-service" || strings.HasPrefix(a, "--windows-service=") {
+			fmt.Fprintln(os.Stderr, "--windows-service: set by the service; may not be given")
+			os.Exit(1)
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find the wgmesh executable: %v\n", err)
+		os.Exit(1)
+	}
+	err = service.Install(service.Config{
+		Name:        serviceName,
+		DisplayName: "wgmesh agent (" + serviceName + ")",
+		Description: "Connects this host to a WireGuard mesh of the peers in a wgmesh registry.",
+		Executable:  exe,
+		Args:        append([]string{"agent", "--windows-service", serviceName}, args...),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to install service: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Installed service %q; start it with `wgmesh service start --name %s`\n", serviceName, serviceName)
+}
+
+func runServiceUninstall(cmd *cobra.Command, args []string) {
+	if err := service.Uninstall(serviceName); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to uninstall service: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runServiceStart(cmd *cobra.Command, args []string) {
+	if err := service.Start(serviceName); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start service: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runServiceStop(cmd *cobra.Command, args []string) {
+	if err := service.Stop(serviceName); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stop service: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runService runs the agent under the service control manager when started by the service, sending
+// its logs to the event log. Otherwise, the agent runs in the foreground.
+func runService(ctx context.Context, run func(ctx context.Context) error) error {
+	if windowsService == "" {
+		return run(ctx)
+	}
+	hook, err := service.NewEventLogHook(windowsService)
+	if err != nil {
+		return err
+	}
+	defer hook.Close()
+	logrus.AddHook(hook)
+	return service.Run(windowsService, run)
+}
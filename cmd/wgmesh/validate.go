@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/jcodybaker/wgmesh/pkg/webhook"
+
+	"github.com/spf13/cobra"
+)
+
+var validateFiles []string
+
+var validateCmd = &cobra.Command{
+	Run:   runValidate,
+	Use:   "validate [-f FILE]... [-- agent flags]",
+	Short: "Check agent flags and registry objects for mistakes without starting anything",
+	Long: `Check agent flags and registry objects for mistakes without starting anything.
+
+Agent flags given after -- are checked as the agent would check them at startup, reporting every
+problem rather than just the first. Files of Mesh, IPPool, IPClaim, and WireGuardPeer YAML documents
+are checked as the admission webhook would check each object, and against each other: names must be
+unique, peers may not share public keys or mesh addresses, and IPPools may not overlap. Given both,
+the agent's --ips must not be published by other peers, its --ip-pool and --static-ip pools must
+exist, and static addresses must be within their pools. Nothing is read from the registry. Prints
+each problem and exits non-zero if there are any; suitable for CI pipelines managing mesh config.`,
+}
+
+func init() {
+	validateCmd.Flags().StringSliceVarP(&validateFiles, "filename", "f", nil, "file of registry objects to validate; may be repeated")
+	rootCmd.AddCommand(validateCmd)
+}
+
+func runValidate(cmd *cobra.Command, args []string) {
+	if len(validateFiles) == 0 && len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to validate: pass -f FILE and/or agent flags after --")
+		os.Exit(1)
+	}
+	var problems []string
+	var objects webhook.Objects
+	count := 0
+	for _, f := range validateFiles {
+		objs, err := registry.ReadManifests(f)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f, err))
+			continue
+		}
+		count += len(objs)
+		for _, obj := range objs {
+			switch obj := obj.(type) {
+			case *wgk8s.Mesh:
+				objects.Meshes = append(objects.Meshes, *obj)
+			case *wgk8s.WireGuardMeshPolicy:
+				objects.Policies = append(objects.Policies, *obj)
+			case *wgk8s.IPPool:
+				objects.IPPools = append(objects.IPPools, *obj)
+			case *wgk8s.IPClaim:
+				objects.IPClaims = append(objects.IPClaims, *obj)
+			case *wgk8s.WireGuardPeer:
+				objects.Peers = append(objects.Peers, *obj)
+			}
+		}
+	}
+	for _, err := range webhook.ValidateObjects(objects) {
+		problems = append(problems, err.Error())
+	}
+
+	if len(args) > 0 {
+		if err := agentCmd.Flags().Parse(args); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse agent flags: %v\n", err)
+			os.Exit(1)
+		}
+		if err := applyFlagEnv(agentCmd, flagEnv); err != nil {
+			problems = append(problems, "agent: "+err.Error())
+		}
+		_, errs := agentOptions(agentCmd)
+		for _, err := range errs {
+			problems = append(problems, "agent: "+err.Error())
+		}
+		if len(errs) == 0 {
+			problems = append(problems, validateAgentObjects(objects)...)
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "\n%d problem(s) found\n", len(problems))
+		os.Exit(1)
+	}
+	if len(args) > 0 {
+		fmt.Println("agent flags are valid")
+	}
+	if len(validateFiles) > 0 {
+		fmt.Printf("%d objects are valid\n", count)
+	}
+}
+
+// validateAgentObjects checks the parsed agent flags against the registry objects.
+func validateAgentObjects(objects webhook.Objects) []string {
+	var out []string
+	for _, ipStr := range ips {
+		ip, _, _ := net.ParseCIDR(ipStr) // Validated by agentOptions.
+		for _, p := range objects.Peers {
+			if p.GetName() == name {
+				// The agent's own, possibly outdated, WireGuardPeer.
+				continue
+			}
+			for _, other := range p.Spec.IPs {
+				if otherIP, _, err := net.ParseCIDR(other); err == nil && otherIP.Equal(ip) {
+					out = append(out, fmt.Sprintf("agent: --ips: %s is also published by WireGuardPeer %q", ipStr, p.GetName()))
+				}
+			}
+		}
+	}
+	if len(objects.IPPools) == 0 {
+		return out
+	}
+	pools := make(map[string]wgk8s.IPPool)
+	for _, p := range objects.IPPools {
+		pools[p.GetName()] = p
+	}
+	for _, p := range ipPools {
+		pool, _, _, _ := parseIPPool(p) // Validated by agentOptions.
+		if _, ok := pools[pool]; !ok {
+			out = append(out, fmt.Sprintf("agent: --ip-pool: IPPool %q not found", pool))
+		}
+	}
+	for _, s := range staticIPs {
+		pool, ip, _ := parseStaticIP(s) // Validated by agentOptions.
+		p, ok := pools[pool]
+		if !ok {
+			out = append(out, fmt.Sprintf("agent: --static-ip: IPPool %q not found", pool))
+			continue
+		}
+		if !ipPoolContains(p, ip) {
+			out = append(out, fmt.Sprintf("agent: --static-ip: %s is outside IPPool %q", ip, pool))
+		}
+	}
+	return out
+}
+
+// ipPoolContains returns whether any of the pool's range CIDRs contain the ip.
+func ipPoolContains(pool wgk8s.IPPool, ip net.IP) bool {
+	for _, r := range pool.Spec.IPRanges {
+		if _, cidr, err := net.ParseCIDR(r.CIDR); err == nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/agent"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sLabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchRetryInterval is how long to wait before reconnecting to the registry or control socket.
+const watchRetryInterval = 5 * time.Second
+
+var watchSelector, watchOutput string
+
+var watchCmd = &cobra.Command{
+	Run:   runWatch,
+	Use:   "watch",
+	Short: "Stream changes to WireGuardPeers in the registry, and to the local agent's interface",
+	Long: `Stream changes to WireGuardPeers in the registry, and to the local agent's interface.
+
+Registry events report peers added, updated, or deleted, and what changed. With --control-socket, the
+local agent's events report peers added to, updated on, or removed from its interface as it applies
+them, peers becoming stale, by not completing handshakes, or recovering, peers being damped for
+changing too often, or undamped, and peers being quarantined for never completing a handshake, or
+released. Events are printed as lines of text, or with -o json, as JSON objects. Runs until
+interrupted, reconnecting if the registry or agent is unavailable.`,
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	addRegistryClientFlags(watchCmd)
+	watchCmd.Flags().StringVar(&controlSocket, "control-socket", "", "path to the local agent's control socket, to include its events")
+	watchCmd.Flags().StringVarP(&watchSelector, "selector", "l", "", "only watch registry events for peers matching this label selector")
+	watchCmd.Flags().StringVarP(&watchOutput, "output", "o", "text", "output format. Valid: text,json")
+	rootCmd.AddCommand(watchCmd)
+}
+
+// watchEvent is a change reported by the registry or the local agent.
+type watchEvent struct {
+	Time time.Time `json:"time"`
+	// Source is "registry" or "agent".
+	Source string `json:"source"`
+	Type   string `json:"type"`
+	Peer   string `json:"peer"`
+	// Changes describe the peer, or for updates, what changed.
+	Changes []string `json:"changes,omitempty"`
+}
+
+func runWatch(cmd *cobra.Command, args []string) {
+	if watchOutput != "text" && watchOutput != "json" {
+		fmt.Fprintf(os.Stderr, "--output: unsupported output format %q\n", watchOutput)
+		os.Exit(1)
+	}
+	selector, err := k8sLabels.Parse(watchSelector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--selector: %v\n", err)
+		os.Exit(1)
+	}
+	r, err := cliRegistry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize registry: %v\n", err)
+		os.Exit(1)
+	}
+
+	events := make(chan watchEvent)
+	go watchRegistry(ctx, r.WatchPeers(selector, nil), events)
+	if controlSocket != "" {
+		go watchAgent(ctx, controlSocket, events)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			if watchOutput == "json" {
+				enc.Encode(e)
+				continue
+			}
+			fmt.Printf("%s  %-8s  %-7s  %s", e.Time.Format(time.RFC3339), e.Source, e.Type, e.Peer)
+			if len(e.Changes) > 0 {
+				fmt.Printf("  %s", strings.Join(e.Changes, "; "))
+			}
+			fmt.Println()
+		}
+	}
+}
+
+// watchRegistry sends events for changes to the listed peers until the context is canceled. When
+// the watch is lost, the peers are listed again, and changes made in the meantime are sent.
+func watchRegistry(ctx context.Context, lw cache.ListerWatcher, events chan<- watchEvent) {
+	var known map[string]*wgk8s.WireGuardPeer
+	send := func(typ string, old, cur *wgk8s.WireGuardPeer) {
+		changes := peerChanges(old, cur)
+		if typ == "updated" && len(changes) == 0 {
+			return
+		}
+		name := cur.GetName()
+		if typ == "deleted" {
+			changes = nil
+		}
+		select {
+		case events <- watchEvent{Time: time.Now(), Source: "registry", Type: typ, Peer: name, Changes: changes}:
+		case <-ctx.Done():
+		}
+	}
+	for ctx.Err() == nil {
+		list, err := lw.List(metav1.ListOptions{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list WireGuardPeers: %v\n", err)
+			sleepContext(ctx, watchRetryInterval)
+			continue
+		}
+		peers := list.(*wgk8s.WireGuardPeerList)
+		current := make(map[string]*wgk8s.WireGuardPeer, len(peers.Items))
+		for i := range peers.Items {
+			p := &peers.Items[i]
+			current[p.GetName()] = p
+			if known == nil {
+				continue
+			}
+			if old, ok := known[p.GetName()]; ok {
+				send("updated", old, p)
+			} else {
+				send("added", nil, p)
+			}
+		}
+		for name, old := range known {
+			if _, ok := current[name]; !ok {
+				send("deleted", old, old)
+			}
+		}
+		known = current
+
+		w, err := lw.Watch(metav1.ListOptions{ResourceVersion: peers.ResourceVersion})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to watch WireGuardPeers: %v\n", err)
+			sleepContext(ctx, watchRetryInterval)
+			continue
+		}
+		watchPeerEvents(ctx, w, known, send)
+		w.Stop()
+	}
+}
+
+// watchPeerEvents sends the watch's events, updating known, until the watch ends or fails.
+func watchPeerEvents(ctx context.Context, w watch.Interface, known map[string]*wgk8s.WireGuardPeer, send func(typ string, old, cur *wgk8s.WireGuardPeer)) {
+	for {
+		var e watch.Event
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok = <-w.ResultChan():
+		}
+		if !ok {
+			return
+		}
+		p, isPeer := e.Object.(*wgk8s.WireGuardPeer)
+		if !isPeer {
+			// An error, likely an expired resourceVersion; list again.
+			return
+		}
+		switch e.Type {
+		case watch.Added:
+			send("added", nil, p)
+			known[p.GetName()] = p
+		case watch.Modified:
+			send("updated", known[p.GetName()], p)
+			known[p.GetName()] = p
+		case watch.Deleted:
+			send("deleted", p, p)
+			delete(known, p.GetName())
+		}
+	}
+}
+
+// peerChanges describes cur, or if old is set, what changed from old to cur.
+func peerChanges(old, cur *wgk8s.WireGuardPeer) []string {
+	var out []string
+	field := func(name string, a, b interface{}, empty bool) {
+		switch {
+		case old == nil && !empty:
+			out = append(out, fmt.Sprintf("%s: %v", name, b))
+		case old != nil && !reflect.DeepEqual(a, b):
+			out = append(out, fmt.Sprintf("%s: %v -> %v", name, a, b))
+		}
+	}
+	var o wgk8s.WireGuardPeer
+	if old != nil {
+		o = *old
+	}
+	field("endpoint", orNone(o.Spec.Endpoint), orNone(cur.Spec.Endpoint), false)
+	field("endpoints", o.Spec.Endpoints, cur.Spec.Endpoints, len(cur.Spec.Endpoints) == 0)
+	field("public key", o.Spec.PublicKey, cur.Spec.PublicKey, false)
+	field("ips", o.Spec.IPs, cur.Spec.IPs, len(cur.Spec.IPs) == 0)
+	field("routes", o.Spec.Routes, cur.Spec.Routes, len(cur.Spec.Routes) == 0)
+	field("labels", k8sLabels.Set(o.GetLabels()).String(), k8sLabels.Set(cur.GetLabels()).String(), len(cur.GetLabels()) == 0)
+	if old != nil && len(out) == 0 && !reflect.DeepEqual(old.Spec, cur.Spec) {
+		out = append(out, "spec")
+	}
+	if old != nil && !reflect.DeepEqual(old.Status, cur.Status) {
+		out = append(out, "status")
+	}
+	return out
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+// watchAgent sends the agent's events until the context is canceled, reconnecting if the agent
+// restarts.
+func watchAgent(ctx context.Context, socket string, events chan<- watchEvent) {
+	client := agent.NewControlClient(socket)
+	for ctx.Err() == nil {
+		err := streamAgentEvents(ctx, client, events)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Lost agent events: %v\n", err)
+		sleepContext(ctx, watchRetryInterval)
+	}
+}
+
+func streamAgentEvents(ctx context.Context, client *http.Client, events chan<- watchEvent) error {
+	req, err := http.NewRequest(http.MethodGet, agent.ControlBaseURL+"/v1/events", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e agent.Event
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		select {
+		case events <- watchEvent{Time: e.Time, Source: "agent", Type: e.Type, Peer: e.Peer, Changes: e.Changes}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sleepContext waits for the duration, or until the context is canceled.
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jcodybaker/wgmesh/pkg/webhook"
+
+	"github.com/spf13/cobra"
+)
+
+var webhookListenAddr, webhookCertFile, webhookKeyFile string
+var webhookCheckConflicts bool
+
+var webhookCmd = &cobra.Command{
+	Run:   runWebhook,
+	Use:   "webhook",
+	Short: "Run the validating admission webhook for wgmesh resources",
+}
+
+func init() {
+	webhookCmd.Flags().StringVar(&webhookListenAddr, "listen-addr", ":8443", "address to serve HTTPS admission requests")
+	webhookCmd.Flags().StringVar(&webhookCertFile, "tls-cert-file", "", "path to the TLS certificate")
+	webhookCmd.Flags().StringVar(&webhookKeyFile, "tls-key-file", "", "path to the TLS private key")
+	webhookCmd.Flags().BoolVar(&webhookCheckConflicts, "check-conflicts", false, "watch the registry's WireGuardPeers, and reject peers which reuse another peer's public key or address")
+	webhookCmd.Flags().StringVar(&registryKubeconfig, "registry-kubeconfig", "", "with --check-conflicts, path to kubeconfig file for registry")
+	webhookCmd.MarkFlagRequired("tls-cert-file")
+	webhookCmd.MarkFlagRequired("tls-key-file")
+
+	rootCmd.AddCommand(webhookCmd)
+}
+
+func runWebhook(cmd *cobra.Command, args []string) {
+	opts := []webhook.OptionFunc{
+		webhook.WithLogger(ll),
+		webhook.WithListenAddr(webhookListenAddr),
+		webhook.WithTLSFiles(webhookCertFile, webhookKeyFile),
+	}
+	if webhookCheckConflicts {
+		opts = append(opts, webhook.WithRegistryKubeClientConfig(registryClientConfig()))
+	}
+	s, err := webhook.NewServer(opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize webhook: %v\n", err)
+		os.Exit(1)
+	}
+	err = s.Run(ctx)
+	if ctx.Err() == nil && err != nil {
+		ll.Fatalf("Failed to run webhook: %v", err)
+	}
+}
@@ -11,13 +11,25 @@ import (
 	"k8s.io/client-go/tools/cache"
 
 	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
-	wgInformer "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/informers/externalversions"
 	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/audit"
+	"github.com/jcodybaker/wgmesh/pkg/bgp"
 	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/jcodybaker/wgmesh/pkg/routingd"
+	"github.com/jcodybaker/wgmesh/pkg/transport"
 
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -27,14 +39,36 @@ import (
 type Agent struct {
 	options
 
-	localCS      *kubernetes.Clientset
-	regClientset *wgmeshClientSet.Clientset
+	localCS  kubernetes.Interface
+	registry registry.Registry
+	// audit, if set, records the changes we make to the device and the registry.
+	audit *audit.Log
+	// recorder, if set, publishes Kubernetes events in the registry namespace until eventSink is
+	// stopped.
+	recorder  record.EventRecorder
+	eventSink watch.Interface
+	// registryHealth tracks whether the registry is reachable.
+	registryHealth *registryHealth
+	// tcpServer, if set, is the tcp2udp process accepting WireGuard traffic over TCP.
+	tcpServer *transport.Process
+	// bgpSpeaker, if set, is the gobgpd process advertising the mesh's routes.
+	bgpSpeaker *bgp.Speaker
+	// routingd, if set, holds the mesh's routes in the routing daemon.
+	routingd routingd.Daemon
+	// proxyNeighbors, if set, answers ARP and NDP for mesh addresses on the LAN interface.
+	proxyNeighbors interfaces.ProxyNeighbors
+	// snat, if set, source NATs traffic forwarded from the mesh into the SNAT routes.
+	snat *snatter
 
 	initOnce  sync.Once
 	closeOnce sync.Once
 	wg        sync.WaitGroup
+	// stop cancels the context of the successful start attempt.
+	stop context.CancelFunc
 
 	localPeer *wgk8s.WireGuardPeer
+	// hostID identifies this host in the local peer's host annotation. It's read on first use.
+	hostID string
 
 	iface interfaces.WireGuardInterface
 
@@ -42,12 +76,58 @@ type Agent struct {
 	publicKey   wgtypes.Key
 	psk         wgtypes.Key
 	peerTracker *peerTracker
+	peerWatch   droppableWatch
+	peerGuard   *localPeerGuard
+	// events receives the changes applied to the interface, for the control socket.
+	events  eventBroadcaster
+	metrics *metrics
+
+	// cache, if loaded, holds the keys and peers saved to the peer cache by a previous run.
+	cache *peerCache
+	// peerNamespaceRegistries holds the registries of the peer namespaces, by namespace.
+	peerNamespaceRegistries map[string]registry.Registry
+	// keyPins, if set, holds the public keys pinned for peers.
+	keyPins *keyPins
+
+	// ipamLock serializes claiming addresses, which happens at startup, when the local peer is
+	// re-created, and when leases are lost.
+	ipamLock sync.Mutex
+	// poolAddrs are the addresses currently claimed from each IPPool, keyed by pool name.
+	poolAddrs map[string][]*net.IPNet
+
+	// publishLock serializes updates to the local peer's published spec.
+	publishLock sync.Mutex
+
+	// meshLock guards the Mesh selecting the local peer, the public keys revoked by any Mesh, the
+	// peer namespaces shared with ours, the mesh policies, and the settings applied from them.
+	meshLock         sync.Mutex
+	mesh             *wgk8s.Mesh
+	revokedKeys      map[string]bool
+	sharedNamespaces map[string]bool
+	// meshPolicies are the WireGuardMeshPolicies of the registry namespace, sorted by name.
+	meshPolicies []*wgk8s.WireGuardMeshPolicy
+	meshUpdates  bool
+	appliedMTU   int
+	// pathMTU, if set, is the smallest path MTU measured to a peer, with mtuAuto.
+	pathMTU int
+
+	// bgpLock guards the routes learned over BGP, which are offered alongside offerRoutes.
+	bgpLock       sync.Mutex
+	learnedRoutes []string
+
+	// labelsLock guards the labels synced from the kube node.
+	labelsLock sync.Mutex
+	nodeLabels labels.Set
+
+	// annotatedIPs is the value of the mesh addresses annotation we last set on the kube node.
+	annotatedIPs string
 }
 
 // NewAgent creates an agent to manage a local WireGuard peer.
 func NewAgent(name string, optionFuncs ...OptionFunc) (*Agent, error) {
 	a := &Agent{
 		options: defaultOptions(),
+		metrics: newMetrics(),
 	}
 	a.name = name
 	for _, f := range optionFuncs {
@@ -59,7 +139,24 @@ func NewAgent(name string, optionFuncs ...OptionFunc) (*Agent, error) {
 	return a, nil
 }
 
+// init prepares the agent's keys and clients, without changing the host.
 func (a *Agent) init(ctx context.Context) error {
+	err := a.initKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if a.keyPinsPath != "" {
+		// A pinned keys file which can't be read fails startup, rather than trusting every key.
+		a.keyPins, err = loadKeyPins(wglog.Subsystem(a.ll, wglog.SubsystemPeerTracker), a.keyPinsPath, a.keyPinning)
+		if err != nil {
+			return err
+		}
+	}
+	return a.initClients()
+}
+
+// initClients builds the registry and local cluster clients, and checks their permissions.
+func (a *Agent) initClients() error {
 	// setup the clientsets
 	if a.localKubeClientConfig != nil {
 		a.ll.Debugf("building local kubernetes clientset")
@@ -73,33 +170,97 @@ func (a *Agent) init(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("building local clientset: %w", err)
 		}
+		err = a.checkPermissions("local cluster", a.localCS, a.localPermissions())
+		if err != nil {
+			return err
+		}
 	} else {
 		a.ll.Debugf("skipping local kubernetes client, no kubeconfig specified")
 	}
 
-	a.ll.Debugf("building registry kubernetes clientset")
-	registryConfig, err := a.registryKubeClientConfig.ClientConfig()
-	if err != nil {
-		return fmt.Errorf("building restconfig from registry kubeconfig: %w", err)
+	if a.registryBackend != nil {
+		if len(a.peerNamespaces) > 0 {
+			return fmt.Errorf("peer namespaces require a Kubernetes registry")
+		}
+		a.registry = a.registryBackend
+	} else {
+		a.ll.Debugf("building registry kubernetes clientset")
+		registryConfig, err := a.registryKubeClientConfig.ClientConfig()
+		if err != nil {
+			return fmt.Errorf("building restconfig from registry kubeconfig: %w", err)
+		}
+		regClientset, err := wgmeshClientSet.NewForConfig(registryConfig)
+		if err != nil {
+			return fmt.Errorf("building registry wgmesh clientset: %w", err)
+		}
+		a.registry = registry.NewKubernetes(regClientset, a.registryNamespace)
+		a.peerNamespaceRegistries = make(map[string]registry.Registry)
+		for _, ns := range a.peerNamespaces {
+			if ns == a.registryNamespace {
+				return fmt.Errorf("peer namespace %q is the registry namespace", ns)
+			}
+			a.peerNamespaceRegistries[ns] = registry.NewKubernetes(regClientset, ns)
+		}
+		regCS, err := kubernetes.NewForConfig(registryConfig)
+		if err != nil {
+			return fmt.Errorf("building registry kubernetes clientset: %w", err)
+		}
+		err = a.checkPermissions("registry", regCS, a.registryPermissions())
+		if err != nil {
+			return err
+		}
+		a.eventSink, a.recorder = newEventRecorder(regCS, a.registryNamespace, a.name)
 	}
-	a.regClientset, err = wgmeshClientSet.NewForConfig(registryConfig)
-	if err != nil {
-		return fmt.Errorf("building registry wgmesh clientset: %w", err)
+	a.registryHealth = newRegistryHealth(wglog.Subsystem(a.ll, wglog.SubsystemRegistry), a.metrics)
+	if a.auditSink != nil {
+		a.audit = audit.New(a.auditSink, "agent/"+a.name, a.ll)
+		a.registry = newAuditedRegistry(a.registry, a.audit)
 	}
+	return nil
+}
 
-	// Step 1 - Configure WireGuard
-	a.ll.Debugln("generating private key")
-	a.privateKey, err = wgtypes.GeneratePrivateKey()
-	if err != nil {
-		return fmt.Errorf("generating WireGuard private key: %w", err)
+// initKeys loads the peer cache, reusing its keys, or generates new ones. With a key provider, the
+// private key always comes from the provider.
+func (a *Agent) initKeys(ctx context.Context) error {
+	var err error
+	if a.peerCachePath != "" {
+		a.cache, err = loadPeerCache(a.peerCachePath)
+		if err == nil && a.cache != nil {
+			a.privateKey, a.psk, err = a.cache.keys()
+		}
+		if err == nil && a.cache != nil && a.keyProvider == nil && a.cache.PrivateKey == "" {
+			err = fmt.Errorf("peer cache has no private key")
+		}
+		if err != nil {
+			a.ll.WithError(err).Warn("ignoring invalid peer cache")
+			a.cache = nil
+		}
 	}
+	if a.keyProvider != nil {
+		a.ll.Debugln("loading private key from the key provider")
+		a.privateKey, err = a.keyProvider.PrivateKey(ctx, a.name)
+		if err != nil {
+			return fmt.Errorf("loading WireGuard private key: %w", err)
+		}
+	}
+	if a.cache != nil {
+		a.ll.Debugln("reusing cached keys")
+		a.publicKey = a.privateKey.PublicKey()
+		return nil
+	}
+	if a.keyProvider == nil {
+		a.ll.Debugln("generating private key")
+		a.privateKey, err = wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return fmt.Errorf("generating WireGuard private key: %w", err)
+		}
+	}
+	a.publicKey = a.privateKey.PublicKey()
 	a.ll.Debugln("generating pre-shared key")
 	a.psk, err = wgtypes.GenerateKey()
 	if err != nil {
 		return fmt.Errorf("generating WireGuard pre-shared key: %w", err)
 	}
-
-	// TODO - Validate K8s permissions w/ CanI
 	return nil
 }
 
@@ -107,48 +268,337 @@ func (a *Agent) init(ctx context.Context) error {
 func (a *Agent) Run(ctx context.Context) error {
 	var err error
 	a.initOnce.Do(func() {
-		err = a.init(ctx)
+		err = a.initKeys(ctx)
+		if err == nil && len(a.bootstrapPeers) > 0 && !a.operatorManaged {
+			// The registry may only be reachable over the mesh, via the bootstrap peers, so they're
+			// configured before the clients are built.
+			err = a.configureBootstrapPeers(ctx)
+		}
+		if err == nil {
+			err = a.initClients()
+		}
 	})
 	if err != nil {
 		return err
 	}
 
+	if a.cache != nil && !a.operatorManaged {
+		err = a.restorePeerCache(ctx)
+		if err != nil {
+			a.ll.WithError(err).Warn("failed to configure interface from peer cache")
+		}
+		err = a.waitForRegistry(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = a.superviseStart(ctx)
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	if a.deregisterOnExit && !a.operatorManaged {
+		return a.deregisterK8sLocalPeer()
+	}
+	return nil
+}
+
+// start configures the interface, registers the local peer, and starts the agent's watches and
+// servers, which run until the context is canceled.
+func (a *Agent) start(ctx context.Context) error {
+	var err error
+	if len(a.nodeLabelKeys) > 0 && !a.operatorManaged {
+		err = a.configureNodeLabels()
+		if err != nil {
+			return fmt.Errorf("reading node labels: %w", err)
+		}
+	}
+
+	err = a.watchMeshes(ctx)
+	if err != nil {
+		return err
+	}
+	a.syncRegistryCondition(ctx)
+
+	if a.enforceMeshPolicies {
+		err = a.watchMeshPolicies(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.operatorManaged {
+		return a.runManaged(ctx)
+	}
+
+	err = a.configureNodeZone()
+	if err != nil {
+		return fmt.Errorf("reading node topology: %w", err)
+	}
+
+	if len(a.nodeAddressTypes) > 0 && !a.clientOnly {
+		err = a.configureNodeEndpoint()
+		if err != nil {
+			return fmt.Errorf("deriving endpoint from node address: %w", err)
+		}
+	}
+
+	if a.podCIDRIPAM {
+		err = a.configurePodCIDRIPAM(ctx)
+		if err != nil {
+			return fmt.Errorf("deriving addresses from podCIDR: %w", err)
+		}
+	} else if a.offerPodCIDRs {
+		err = a.configurePodCIDRRoutes(ctx)
+		if err != nil {
+			return fmt.Errorf("offering podCIDR: %w", err)
+		}
+	}
+
+	err = a.initializeWireGuard(ctx)
+	if err != nil {
+		return fmt.Errorf("initializing WireGuard interface: %w", err)
+	}
+
 	// Step 2 - Install our Kubernetes WireGuardPeer resource on to the server.
 	a.updateK8sLocalPeer()
-	err = a.registerK8sLocalPeer()
+	err = a.registerK8sLocalPeer(ctx)
+	if err != nil {
+		return err
+	}
+	if len(a.ipPools) > 0 {
+		err = a.claimPoolIPs()
+		if err != nil {
+			return err
+		}
+	}
+	err = a.annotateNodeIPs(a.localPeer.Spec.IPs)
 	if err != nil {
 		return err
 	}
+	err = a.guardK8sLocalPeer(ctx)
+	if err != nil {
+		return err
+	}
+	if len(a.ipPools) > 0 && a.ipLeaseDuration > 0 {
+		a.renewIPLeases(ctx)
+	}
+	if len(a.nodeAddressTypes) > 0 && !a.clientOnly {
+		a.watchNodeEndpoint(ctx)
+	}
+	if len(a.nodeLabelKeys) > 0 {
+		a.watchNodeLabels(ctx)
+	}
+	if a.serviceExport {
+		a.exportServices(ctx)
+	}
 	a.configureWireGuardPeers(ctx)
-	<-ctx.Done()
+	if len(a.peerNamespaces) > 0 {
+		err = a.watchPeerNamespaces(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if a.installRoutes {
+		a.watchRoutes(ctx)
+	}
+	if a.peerCachePath != "" {
+		a.savePeerCache(ctx)
+	}
+	err = a.clearNodeNetworkUnavailable()
+	if err != nil {
+		return err
+	}
+	a.monitorEndpoints(ctx)
+	if a.flapDampingLimit > 0 {
+		a.runFlapDamping(ctx)
+	}
+	if a.natTraversal {
+		a.publishObservedEndpoints(ctx)
+	}
+	if a.peerHealth {
+		a.publishPeerHealth(ctx)
+	}
+	if a.mdns {
+		err = a.discoverLANPeers(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if a.routeReflection {
+		a.reflectRoutes(ctx)
+	}
+	if a.bgp != nil {
+		err = a.runBGP(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if a.routingDaemon != "" {
+		err = a.exportRoutingDaemonRoutes(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if a.proxyARPInterface != "" {
+		err = a.publishProxyARP(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if len(a.snatRoutes) > 0 {
+		err = a.installSNAT()
+		if err != nil {
+			return err
+		}
+	}
+	if a.benchPort != 0 {
+		err = a.serveBench(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	err = a.enableMeshUpdates()
+	if err != nil {
+		return fmt.Errorf("applying mesh settings: %w", err)
+	}
+	if a.controlSocket != "" {
+		err = a.serveControl(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if a.metricsAddr != "" {
+		err = a.serveMetrics(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if a.probePort != 0 {
+		err = a.serveProbeEcho(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if a.tcpTransportPort != 0 {
+		err = a.serveTCPTransport()
+		if err != nil {
+			return err
+		}
+	}
+	if a.probeInterval > 0 {
+		a.runProber(ctx)
+	}
+	if a.mtuProbeInterval > 0 {
+		a.runMTUProber(ctx)
+	}
 	return nil
 }
 
+// deregisterK8sLocalPeer releases our IPClaims and removes our WireGuardPeer from the registry.
+func (a *Agent) deregisterK8sLocalPeer() error {
+	a.ll.Infoln("deregistering local peer")
+	if a.peerGuard != nil {
+		a.peerGuard.disable()
+	}
+	err := a.registry.IPAM(a.ipLeaseDuration).ReleaseIPs("", a.localPeerOwnerReference())
+	if err != nil {
+		return fmt.Errorf("releasing IPClaims: %w", err)
+	}
+	err = a.annotateNodeIPs(nil)
+	if err != nil {
+		a.ll.WithError(err).Warnln("failed to remove mesh addresses from node")
+	}
+	if a.protected {
+		a.ll.Warnln("local peer is protected; leaving WireGuardPeer registered")
+		return nil
+	}
+	err = a.registry.Delete(a.name, a.localPeer.GetUID())
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("deleting k8s WireGuardPeer %q: %w", a.name, err)
+	}
+	return nil
+}
+
+// onK8sLocalPeerRecreated re-adopts our IPClaims after the local peer guard re-creates our record.
+// The new record has a new UID; claims referencing the old UID would be garbage collected.
+func (a *Agent) onK8sLocalPeerRecreated(peer *wgk8s.WireGuardPeer) {
+	a.publishLock.Lock()
+	a.localPeer = peer
+	a.publishLock.Unlock()
+	if len(a.ipPools) == 0 {
+		return
+	}
+	err := a.claimPoolIPs()
+	if err != nil {
+		a.ll.WithError(err).Error("failed to re-claim addresses for re-created local peer")
+	}
+}
+
 // updateK8sLocalPeer populates the Kubernetes WireGuardPeer object.
 func (a *Agent) updateK8sLocalPeer() {
 	if a.localPeer == nil {
 		a.localPeer = &wgk8s.WireGuardPeer{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:   a.name,
-				Labels: a.labels,
+				Labels: a.peerLabels(),
 			},
 		}
 	}
-	a.localPeer.Spec = wgk8s.WireGuardPeerSpec{
+	a.meshLock.Lock()
+	keepalive := a.effectiveKeepalive()
+	a.meshLock.Unlock()
+	spec := wgk8s.WireGuardPeerSpec{
 		PublicKey:        a.publicKey.String(),
 		Endpoint:         a.endpointAddr,
+		Endpoints:        a.endpointCandidates,
+		TCPEndpoint:      a.tcpEndpoint(a.endpointAddr),
 		PresharedKey:     a.psk.String(),
 		IPs:              a.ips,
-		Routes:           a.offerRoutes,
-		KeepAliveSeconds: int(a.keepalive.Seconds()),
+		Routes:           a.offeredRoutes(),
+		ClampMSSRoutes:   a.clampMSSRoutes,
+		RoutePriority:    a.routePriority,
+		KeepAliveSeconds: int(keepalive.Seconds()),
+		Region:           a.region,
+		Zone:             a.zone,
+	}
+	if a.clientOnly {
+		spec.Endpoint, spec.Endpoints, spec.TCPEndpoint = "", nil, ""
+	}
+	a.localPeer.Spec = spec
+	a.updateK8sLocalPeerProtection(a.localPeer)
+	a.updateK8sLocalPeerHost(a.localPeer)
+}
+
+// updateK8sLocalPeerProtection adds or removes the protected annotation and finalizer.
+func (a *Agent) updateK8sLocalPeerProtection(peer *wgk8s.WireGuardPeer) {
+	annotations := peer.GetAnnotations()
+	var finalizers []string
+	for _, f := range peer.GetFinalizers() {
+		if f != wgk8s.ProtectedFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	if a.protected {
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[wgk8s.ProtectedAnnotation] = "true"
+		finalizers = append(finalizers, wgk8s.ProtectedFinalizer)
+	} else {
+		delete(annotations, wgk8s.ProtectedAnnotation)
 	}
+	peer.SetAnnotations(annotations)
+	peer.SetFinalizers(finalizers)
 }
 
-func (a *Agent) registerK8sLocalPeer() error {
+func (a *Agent) registerK8sLocalPeer(ctx context.Context) error {
 	a.ll.Infoln("registering local peer")
-	var err error
-	a.localPeer, err = a.regClientset.WgmeshV1alpha1().WireGuardPeers(a.registryNamespace).Create(a.localPeer)
+	desired := a.localPeer
+	created, err := a.registry.Register(desired)
 	if err == nil {
+		a.localPeer = created
 		return nil
 	}
 	if !k8sErrors.IsAlreadyExists(err) {
@@ -157,33 +607,246 @@ func (a *Agent) registerK8sLocalPeer() error {
 
 	// The record already exists. Determine if its sane, and updates.
 	a.ll.Infoln("a local peer wih our name was already registered, trying to update")
-	a.localPeer, err = a.regClientset.WgmeshV1alpha1().WireGuardPeers(a.registryNamespace).Get(a.name, metav1.GetOptions{})
+	a.localPeer, err = a.registry.Get(a.name)
 	if err != nil {
 		return fmt.Errorf("fetching existing k8s WireGuardPeer object %q: %w", a.name, err)
 	}
-	if a.endpointAddr != a.localPeer.Spec.Endpoint {
-		// This may mean two peers are trying to use the same name, which
-		// would result flapping and constant rekeying.
-		return fmt.Errorf(
-			"existing k8s WireGuardPeer had endpoint %q, we have %q. Two or more peers may be sharing the same name",
-			a.localPeer.Spec.Endpoint, a.endpointAddr)
+	previous := a.localPeer.Spec
+	conflict := nameConflict(a.localPeer, desired)
+	takeover := conflict != ""
+	if takeover {
+		if !a.forceTakeover {
+			// This may mean two peers are trying to use the same name, which
+			// would result flapping and constant rekeying.
+			return fmt.Errorf("%s. Two or more peers may be sharing the same name", conflict)
+		}
+		a.localPeer, err = a.takeOverK8sLocalPeer(ctx, a.localPeer)
+		if err != nil {
+			return err
+		}
+		if a.localPeer == nil {
+			// The record was deleted during the grace period.
+			a.localPeer = desired
+			return a.registerK8sLocalPeer(ctx)
+		}
 	}
+	a.localPeer.Spec = desired.Spec
+	a.localPeer.SetLabels(labels.Merge(a.localPeer.GetLabels(), desired.GetLabels()))
+	a.updateK8sLocalPeerProtection(a.localPeer)
+	a.updateK8sLocalPeerHost(a.localPeer)
 	// TODO: If our wg interface is configured w/ a private key and the public key matches the
 	// record, we shouldn't rekey.
-	a.localPeer, err = a.regClientset.WgmeshV1alpha1().WireGuardPeers(a.registryNamespace).Update(a.localPeer)
+	a.localPeer, err = a.registry.Update(a.localPeer)
 	if err != nil {
 		return fmt.Errorf("updating k8s WireGuardPeer %q: %w", a.name, err)
 	}
+	if takeover {
+		a.recordTakeover(a.localPeer, previous)
+	}
+	return nil
+}
+
+// guardK8sLocalPeer watches our own WireGuardPeer record, defending it against deletion and
+// unexpected modification.
+func (a *Agent) guardK8sLocalPeer(ctx context.Context) error {
+	a.peerGuard = &localPeerGuard{
+		ll:          a.ll.WithField("k8s_name", a.name),
+		client:      a.registry,
+		onRecreate:  a.onK8sLocalPeerRecreated,
+		publishLock: &a.publishLock,
+	}
+	a.peerGuard.setDesired(a.localPeer)
+
+	informer := cache.NewSharedIndexInformer(
+		a.registryHealth.listWatch(ctx, a.registry.WatchPeers(nil, fields.OneTermEqualSelector("metadata.name", a.name))),
+		&wgk8s.WireGuardPeer{},
+		a.resyncPeriod,
+		cache.Indexers{},
+	)
+	informer.AddEventHandler(a.peerGuard)
+
+	a.ll.Debugln("launching local peer guard")
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		informer.Run(ctx.Done())
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync local WireGuardPeer")
+	}
 	return nil
 }
 
-func (a *Agent) initializeWireGuard() error {
+// claimPoolIPs claims addresses for the local peer from each IPPool, assigns them to the
+// interface, and publishes them in the registry. Claims held from a previous run are reused.
+// Addresses which were previously claimed, but are no longer held, are removed from the interface.
+func (a *Agent) claimPoolIPs() error {
+	a.ipamLock.Lock()
+	defer a.ipamLock.Unlock()
+	ipam := a.registry.IPAM(a.ipLeaseDuration)
+	ipamLL := wglog.Subsystem(a.ll, wglog.SubsystemIPAM)
+	ips := append([]string(nil), a.ips...)
+	poolAddrs := make(map[string][]*net.IPNet, len(a.ipPools))
+	for _, pool := range a.ipPools {
+		ll := ipamLL.WithField("ip_pool", pool.name)
+		ll.Infoln("claiming addresses from pool")
+		claimed, err := ipam.ClaimIPs(pool.name, a.localPeerOwnerReference(), pool.counts, pool.static)
+		if err != nil {
+			return fmt.Errorf("claiming addresses from pool %q: %w", pool.name, err)
+		}
+		for _, addr := range claimed {
+			ll.WithField("ip", addr.String()).Infoln("claimed address")
+			err = a.iface.EnsureIP(addr)
+			if err != nil {
+				return fmt.Errorf("assigning claimed address: %w", err)
+			}
+			ips = append(ips, addr.String())
+		}
+		poolAddrs[pool.name] = claimed
+	}
+	held := make(map[string]struct{}, len(ips))
+	for _, ip := range ips {
+		held[ip] = struct{}{}
+	}
+	for _, addrs := range a.poolAddrs {
+		for _, addr := range addrs {
+			if _, ok := held[addr.String()]; ok {
+				continue
+			}
+			ipamLL.WithField("ip", addr.String()).Warnln("removing address which is no longer claimed")
+			err := a.iface.RemoveIP(addr)
+			if err != nil {
+				return fmt.Errorf("removing released address: %w", err)
+			}
+		}
+	}
+	a.poolAddrs = poolAddrs
+
+	err := a.publishLocalPeerSpec(func(spec *wgk8s.WireGuardPeerSpec) bool {
+		spec.IPs = ips
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("publishing claimed addresses: %w", err)
+	}
+	return a.annotateNodeIPs(ips)
+}
+
+// publishLocalPeerSpec applies update to a copy of the local peer's spec and, if update reports a
+// change, writes it to the registry.
+func (a *Agent) publishLocalPeerSpec(update func(spec *wgk8s.WireGuardPeerSpec) bool) error {
+	if a.operatorManaged {
+		// The operator maintains our record.
+		return nil
+	}
+	a.publishLock.Lock()
+	defer a.publishLock.Unlock()
+	spec := *a.localPeer.Spec.DeepCopy()
+	if !update(&spec) {
+		return nil
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// The controller may have updated the record's status since we last wrote it.
+		latest, err := a.registry.Get(a.name)
+		if err != nil {
+			return err
+		}
+		latest.Spec = spec
+		updated, err := a.registry.Update(latest)
+		if err != nil {
+			return err
+		}
+		a.localPeer = updated
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if a.peerGuard != nil {
+		a.peerGuard.setDesired(a.localPeer)
+	}
+	return nil
+}
+
+// renewIPLeases periodically renews the leases on our IPClaims until the context is canceled. If a
+// claim is lost, ex. because the agent couldn't reach the registry for longer than the lease, the
+// address is dropped and a replacement is claimed.
+func (a *Agent) renewIPLeases(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			lost, err := a.renewIPLeasesOnce()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to renew IPClaim leases")
+				return
+			}
+			if !lost {
+				return
+			}
+			err = a.claimPoolIPs()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to replace lost IPClaims")
+			}
+		}, a.ipLeaseDuration/3, ctx.Done())
+	}()
+}
+
+// renewIPLeasesOnce renews the lease on each of our claims, returning true if any were lost.
+func (a *Agent) renewIPLeasesOnce() (bool, error) {
+	a.ipamLock.Lock()
+	defer a.ipamLock.Unlock()
+	ipam := a.registry.IPAM(a.ipLeaseDuration)
+	ll := wglog.Subsystem(a.ll, wglog.SubsystemIPAM)
+	anyLost := false
+	for pool, addrs := range a.poolAddrs {
+		lost, err := ipam.RenewLeases(pool, a.localPeerOwnerReference(), addrs)
+		for _, addr := range lost {
+			ll.WithFields(logrus.Fields{"ip_pool": pool, "ip": addr.String()}).
+				Warnln("lost IPClaim; another peer may now hold the address")
+			anyLost = true
+		}
+		if err != nil {
+			return anyLost, fmt.Errorf("renewing leases in pool %q: %w", pool, err)
+		}
+	}
+	return anyLost, nil
+}
+
+// localPeerOwnerReference returns a reference to our registered WireGuardPeer, suitable for
+// marking objects (like IPClaims) as owned by this peer.
+func (a *Agent) localPeerOwnerReference() *metav1.OwnerReference {
+	return &metav1.OwnerReference{
+		APIVersion: wgk8s.SchemeGroupVersion.String(),
+		Kind:       "WireGuardPeer",
+		Name:       a.localPeer.GetName(),
+		UID:        a.localPeer.GetUID(),
+	}
+}
+
+func (a *Agent) initializeWireGuard(ctx context.Context) error {
 	a.ll.Debugln("initializing WireGuard client")
 
-	ll := a.ll.WithField("interface", a.iface)
+	ifaceLL := wglog.Subsystem(a.ll, wglog.SubsystemInterfaces)
+	ll := wglog.WithInterface(ifaceLL, a.wgIfaceOptions.InterfaceName)
 	ll.Infoln("creating WireGuard interface")
 	var err error
-	a.iface, err = interfaces.EnsureWireGuardInterface(a.ctx, a.wgIfaceOptions)
+	a.iface, err = interfaces.EnsureWireGuardInterface(ctx, a.wgIfaceOptions)
+	if err != nil {
+		return err
+	}
+	ll = wglog.WithInterface(ifaceLL, a.iface.GetName())
+
+	a.meshLock.Lock()
+	mtu := a.effectiveMTU()
+	if mtu > 0 {
+		ll.WithField("mtu", mtu).Infoln("setting interface mtu")
+		err = a.iface.SetMTU(mtu)
+		if err == nil {
+			a.appliedMTU = mtu
+		}
+	}
+	a.meshLock.Unlock()
 	if err != nil {
 		return err
 	}
@@ -197,15 +860,9 @@ func (a *Agent) initializeWireGuard() error {
 		return err
 	}
 
-	for _, ip := range a.ips {
-		addr, subnet, err := net.ParseCIDR(ip)
-		if err != nil {
-			return fmt.Errorf("parsing IP %q", err)
-		}
-		// net.ParseCIDR puts the network base addr in IP by default, but we need to
-		// specify the specific addr we want.
-		subnet.IP = addr
-		err = a.iface.EnsureIP(subnet)
+	err = a.ensureIPs(a.ips)
+	if err != nil {
+		return err
 	}
 
 	ll.Debugln("setting device state up")
@@ -219,20 +876,56 @@ func (a *Agent) initializeWireGuard() error {
 		return err
 	}
 
-	endpointAddr, endpointPort, err := net.SplitHostPort(a.endpointAddr)
+	if a.clientOnly || a.operatorManaged {
+		// We don't publish an endpoint.
+		return nil
+	}
+	a.endpointAddr, err = endpointWithPort(a.endpointAddr, ifacePort)
 	if err != nil {
 		return err
 	}
+	for i, addr := range a.endpointCandidates {
+		a.endpointCandidates[i], err = endpointWithPort(addr, ifacePort)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureIPs assigns the addresses to the WireGuard interface.
+func (a *Agent) ensureIPs(ips []string) error {
+	for _, ip := range ips {
+		addr, subnet, err := net.ParseCIDR(ip)
+		if err != nil {
+			return fmt.Errorf("parsing IP %q", err)
+		}
+		// net.ParseCIDR puts the network base addr in IP by default, but we need to
+		// specify the specific addr we want.
+		subnet.IP = addr
+		err = a.iface.EnsureIP(subnet)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endpointWithPort adds the port bound by the WireGuard driver to an endpoint without one.
+func endpointWithPort(endpoint string, ifacePort int) (string, error) {
+	endpointAddr, endpointPort, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
 	if endpointPort == "" || endpointPort == "0" {
 		// If endpointAddr included a port, we should trust it. The user likely has some flavor
 		// of DNAT between the public internet and this app. If no port is specified, we'll add
 		// the port bound by the WireGuard driver.
-		a.endpointAddr = net.JoinHostPort(endpointAddr, strconv.FormatInt(int64(ifacePort), 10))
 		// TODO - Do we actually want to do this? If we're behind NAT it may mean nothing.
-		ll.Debugln("adding port to endpoint")
+		return net.JoinHostPort(endpointAddr, strconv.FormatInt(int64(ifacePort), 10)), nil
 	}
-
-	return nil
+	return endpoint, nil
 }
 
 func (a *Agent) configureWireGuardPeers(ctx context.Context) error {
@@ -243,23 +936,27 @@ func (a *Agent) configureWireGuardPeers(ctx context.Context) error {
 		"labels":    a.peerSelector.String(),
 	})
 	ll.Debugln("building informer")
-	factory := wgInformer.NewSharedInformerFactoryWithOptions(
-		a.regClientset, 0,
-		wgInformer.WithTweakListOptions(func(listOptions *metav1.ListOptions) {
-			listOptions.LabelSelector = a.peerSelector.String()
-		}),
-		wgInformer.WithNamespace(a.registryNamespace))
-
-	informer := factory.Wgmesh().V1alpha1().WireGuardPeers().Informer()
-
-	a.peerTracker = &peerTracker{
-		keepalive: a.keepalive,
-		ll:        a.ll,
-		iface:     a.iface,
-		peers:     make(map[string]*wgk8s.WireGuardPeer),
-		localPeer: a.localPeer,
-	}
+	peers := a.registryHealth.listWatch(ctx, a.registry.WatchPeers(a.peerSelector, nil))
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				o, err := peers.List(options)
+				if err == nil {
+					a.peerWatch.listed()
+				}
+				return o, err
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				// Track the watch so the chaos hooks and resyncs can drop it.
+				return a.peerWatch.watch(func() (watch.Interface, error) { return peers.Watch(options) })
+			},
+		},
+		&wgk8s.WireGuardPeer{},
+		a.resyncPeriod,
+		peerIndexers(),
+	)
 
+	a.peerTracker = a.newPeerTracker(a.localPeer, informer.GetIndexer())
 	informer.AddEventHandler(a.peerTracker)
 
 	ll.Infoln("launching informer")
@@ -274,21 +971,141 @@ func (a *Agent) configureWireGuardPeers(ctx context.Context) error {
 	}
 	ll.Infoln("cache fully synced; applying initial config to interface")
 	// Ok, everything should be sync'ed now.
-	return a.peerTracker.applyInitialConfig()
+	err := a.peerTracker.applyInitialConfig()
+	if err != nil {
+		return err
+	}
+	if a.resyncPeriod > 0 {
+		a.reapplyPeriodically(ctx)
+	}
+	return nil
+}
+
+// newPeerTracker returns a peerTracker which configures the agent's interface with the peers in the
+// registry store, for the local peer.
+func (a *Agent) newPeerTracker(localPeer *wgk8s.WireGuardPeer, registry cache.Indexer) *peerTracker {
+	a.meshLock.Lock()
+	keepalive := a.effectiveKeepalive()
+	revoked := a.revokedKeys
+	shared := a.sharedNamespaces
+	policies := a.meshPolicies
+	allowed, err := a.effectiveAllowedEndpoints()
+	a.meshLock.Unlock()
+	if err != nil {
+		// Nothing is admitted until the Mesh is fixed.
+		a.ll.WithError(err).Error("invalid mesh allowed endpoint cidrs")
+		allowed = []*net.IPNet{}
+	}
+	var mssClamp *mssClamper
+	if a.clampMSS {
+		mssClamp = newMSSClamper(a.iface.GetName())
+	}
+	var tcpFallback *tcpTransports
+	if a.tcpFallback {
+		tcpFallback = newTCPTransports(a.ll, a.udp2tcpPath)
+	}
+	var q *quarantine
+	if a.quarantineAttempts > 0 {
+		q = newQuarantine(a.quarantineAttempts, a.quarantinePeriod, a.quarantineRetry)
+	}
+	var flaps *flapDamper
+	if a.flapDampingLimit > 0 {
+		flaps = newFlapDamper(a.flapDampingLimit, a.flapDampingWindow)
+	}
+	var policyFirewall *meshPolicyFirewall
+	if a.enforceMeshPolicies {
+		policyFirewall = newMeshPolicyFirewall(a.iface.GetName())
+	}
+	return &peerTracker{
+		keepalive:             keepalive,
+		ll:                    wglog.WithInterface(wglog.Subsystem(a.ll, wglog.SubsystemPeerTracker), a.iface.GetName()),
+		iface:                 a.iface,
+		registry:              registry,
+		localPeer:             localPeer,
+		allowProtectedRemoval: a.allowProtectedRemoval,
+		natTraversal:          a.natTraversal,
+		clientOnly:            a.clientOnly,
+		ecmp:                  a.ecmp,
+		installRoutes:         a.installRoutes,
+		mssClamp:              mssClamp,
+		tcpFallback:           tcpFallback,
+		routeOptions:          interfaces.RouteOptions{Metric: a.routeMetric, Protocol: a.routeProtocol},
+		events:                &a.events,
+		audit:                 a.audit,
+		metrics:               a.metrics,
+		handshakeTimeout:      a.handshakeTimeout,
+		bootstrap:             a.bootstrapPeers,
+		families:              newEndpointFamilies(a.endpointFamily),
+		namespace:             localPeer.GetNamespace(),
+		sharedNamespaces:      shared,
+		revokedKeys:           revoked,
+		allowedEndpoints:      allowed,
+		keyPins:               a.keyPins,
+		onReject:              a.recordRejection,
+		flaps:                 flaps,
+		onDamped:              a.recordDamping,
+		quarantine:            q,
+		onQuarantine:          a.recordQuarantine,
+		policyFirewall:        policyFirewall,
+		meshPolicies:          compileMeshPolicies(a.ll, policies),
+	}
 }
 
 // Close shuts down and cleans up the agent.
 func (a *Agent) Close() error {
 	var err error
 	a.closeOnce.Do(func() {
-		// TODO cancel informer context.
-
+		if a.stop != nil {
+			a.stop()
+		}
 		// Wait for the informer to stop so we don't apply any to a closing interface.
 		a.wg.Wait()
 
+		if a.peerTracker != nil {
+			if err := a.peerTracker.removeMSSClamping(); err != nil {
+				a.ll.WithError(err).Error("failed to remove mss clamping rules")
+			}
+			if err := a.peerTracker.removeMeshPolicyRules(); err != nil {
+				a.ll.WithError(err).Error("failed to remove mesh policy rules")
+			}
+			a.peerTracker.stopTCPTransports()
+		}
+		if a.keyPins != nil {
+			if err := a.keyPins.flush(); err != nil {
+				a.ll.WithError(err).Error("failed to save pinned keys")
+			}
+		}
+		if a.bgpSpeaker != nil {
+			if err := a.bgpSpeaker.Stop(); err != nil {
+				a.ll.WithError(err).Error("failed to stop gobgpd")
+			}
+		}
+		if a.routingd != nil {
+			if err := a.routingd.Remove(); err != nil {
+				a.ll.WithError(err).Error("failed to remove routes from routing daemon")
+			}
+		}
+		if a.proxyNeighbors != nil {
+			if err := a.proxyNeighbors.Close(); err != nil {
+				a.ll.WithError(err).Error("failed to remove proxy neighbor entries")
+			}
+		}
+		if a.snat != nil {
+			if err := a.snat.remove(); err != nil {
+				a.ll.WithError(err).Error("failed to remove snat rules")
+			}
+		}
+		if a.tcpServer != nil {
+			if err := a.tcpServer.Stop(); err != nil {
+				a.ll.WithError(err).Error("failed to stop tcp2udp")
+			}
+		}
 		if a.iface != nil {
 			a.iface.Close()
 		}
+		if a.eventSink != nil {
+			a.eventSink.Stop()
+		}
 	})
 	return err
 }
@@ -0,0 +1,252 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/audit"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+)
+
+// auditedRegistry records each write the agent makes to the registry.
+type auditedRegistry struct {
+	registry.Registry
+	audit *audit.Log
+
+	lock sync.Mutex
+	// stored holds the last version of each WireGuardPeer we read or wrote, keyed by name, so
+	// updates can be recorded as changes.
+	stored map[string]*wgk8s.WireGuardPeer
+}
+
+func newAuditedRegistry(r registry.Registry, l *audit.Log) *auditedRegistry {
+	return &auditedRegistry{Registry: r, audit: l, stored: make(map[string]*wgk8s.WireGuardPeer)}
+}
+
+func (r *auditedRegistry) Register(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	created, err := r.Registry.Register(peer)
+	if err != nil {
+		return nil, err
+	}
+	r.audit.Record("registry.register", created.GetName(), peerChanges(nil, created)...)
+	r.store(created)
+	return created, nil
+}
+
+func (r *auditedRegistry) Get(name string) (*wgk8s.WireGuardPeer, error) {
+	peer, err := r.Registry.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	r.store(peer)
+	return peer, nil
+}
+
+func (r *auditedRegistry) Update(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	updated, err := r.Registry.Update(peer)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	prev := r.stored[updated.GetName()]
+	r.lock.Unlock()
+	r.audit.Record("registry.update", updated.GetName(), peerChanges(prev, updated)...)
+	r.store(updated)
+	return updated, nil
+}
+
+func (r *auditedRegistry) Delete(name string, uid types.UID) error {
+	if err := r.Registry.Delete(name, uid); err != nil {
+		return err
+	}
+	r.audit.Record("registry.delete", name, "uid: "+string(uid))
+	r.lock.Lock()
+	delete(r.stored, name)
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *auditedRegistry) IPAM(leaseDuration time.Duration) registry.IPAM {
+	return &auditedIPAM{IPAM: r.Registry.IPAM(leaseDuration), audit: r.audit}
+}
+
+func (r *auditedRegistry) store(peer *wgk8s.WireGuardPeer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stored[peer.GetName()] = peer.DeepCopy()
+}
+
+// peerChanges describes the fields of the peer's spec, labels, and status which differ from prev,
+// with the new values of those in the spec and labels. Status fields, which the agent publishes
+// frequently, are only named. Without prev, the whole spec and labels are described.
+func peerChanges(prev, cur *wgk8s.WireGuardPeer) []string {
+	if prev == nil {
+		prev = &wgk8s.WireGuardPeer{}
+	}
+	out := fieldChanges("spec.", prev.Spec, cur.Spec, true)
+	if !reflect.DeepEqual(prev.GetLabels(), cur.GetLabels()) && (len(prev.GetLabels()) > 0 || len(cur.GetLabels()) > 0) {
+		out = append(out, fmt.Sprintf("labels: %s", jsonString(cur.GetLabels())))
+	}
+	return append(out, fieldChanges("status.", prev.Status, cur.Status, false)...)
+}
+
+// fieldChanges compares the JSON fields of a and b, returning those which differ, prefixed.
+func fieldChanges(prefix string, a, b interface{}, values bool) []string {
+	af, bf := jsonFields(a), jsonFields(b)
+	var names []string
+	for k, v := range bf {
+		if !reflect.DeepEqual(af[k], v) {
+			names = append(names, k)
+		}
+	}
+	for k := range af {
+		if _, ok := bf[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	out := make([]string, 0, len(names))
+	for _, k := range names {
+		switch {
+		case !values:
+			out = append(out, prefix+k+" changed")
+		case bf[k] == nil:
+			out = append(out, prefix+k+": <none>")
+		default:
+			out = append(out, prefix+k+": "+jsonString(bf[k]))
+		}
+	}
+	return out
+}
+
+func jsonFields(v interface{}) map[string]interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out map[string]interface{}
+	if err = json.Unmarshal(b, &out); err != nil {
+		return nil
+	}
+	return out
+}
+
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// auditedIPAM records the claims the agent makes, releases, and renews.
+type auditedIPAM struct {
+	registry.IPAM
+	audit *audit.Log
+}
+
+func (i *auditedIPAM) ClaimIPs(pool string, owner *metav1.OwnerReference, counts map[registry.IPFamily]int, static []net.IP) ([]*net.IPNet, error) {
+	addrs, err := i.IPAM.ClaimIPs(pool, owner, counts, static)
+	if err != nil {
+		return nil, err
+	}
+	i.audit.Record("ipam.claim", pool, fmt.Sprintf("addresses: %v", ipNetPtrStrings(addrs)))
+	return addrs, nil
+}
+
+func (i *auditedIPAM) ReleaseIPs(pool string, owner *metav1.OwnerReference) error {
+	if err := i.IPAM.ReleaseIPs(pool, owner); err != nil {
+		return err
+	}
+	if pool == "" {
+		pool = "*"
+	}
+	i.audit.Record("ipam.release", pool)
+	return nil
+}
+
+func (i *auditedIPAM) RenewLeases(pool string, owner *metav1.OwnerReference, addrs []*net.IPNet) ([]*net.IPNet, error) {
+	lost, err := i.IPAM.RenewLeases(pool, owner, addrs)
+	if err != nil {
+		return nil, err
+	}
+	details := []string{fmt.Sprintf("addresses: %v", ipNetPtrStrings(addrs))}
+	if len(lost) > 0 {
+		details = append(details, fmt.Sprintf("lost: %v", ipNetPtrStrings(lost)))
+	}
+	i.audit.Record("ipam.renew", pool, details...)
+	return lost, nil
+}
+
+func ipNetPtrStrings(addrs []*net.IPNet) []string {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, a.String())
+	}
+	return out
+}
+
+// auditApplied records the peers added to, removed from, rekeyed on, and updated on the device. A
+// peer removed and added again under a new public key was rekeyed.
+func auditApplied(l *audit.Log, events []Event) {
+	events = append([]Event(nil), events...)
+	sort.Slice(events, func(i, j int) bool { return events[i].Peer < events[j].Peer })
+	removed := make(map[string]Event)
+	for _, e := range events {
+		if e.Type == "removed" {
+			removed[e.Peer] = e
+		}
+	}
+	for _, e := range events {
+		switch e.Type {
+		case "added":
+			if prev, ok := removed[e.Peer]; ok {
+				delete(removed, e.Peer)
+				details := append([]string{fmt.Sprintf("public key: %s -> %s", prev.PublicKey, e.PublicKey)}, e.Changes...)
+				l.Record("peer.rekeyed", e.Peer, details...)
+				continue
+			}
+			l.Record("peer.added", e.Peer, append([]string{"public key: " + e.PublicKey}, e.Changes...)...)
+		case "updated":
+			l.Record("peer.updated", e.Peer, append([]string{"public key: " + e.PublicKey}, e.Changes...)...)
+		}
+	}
+	for _, e := range events {
+		if _, ok := removed[e.Peer]; ok && e.Type == "removed" {
+			l.Record("peer.removed", e.Peer, "public key: "+e.PublicKey)
+		}
+	}
+}
+
+// auditRoutes records the routes added and removed when the interface's routes change from prev to
+// cur, keyed by prefix.
+func auditRoutes(l *audit.Log, iface string, prev, cur map[string]bool) {
+	var added, removed []string
+	for r := range cur {
+		if !prev[r] {
+			added = append(added, r)
+		}
+	}
+	for r := range prev {
+		if !cur[r] {
+			removed = append(removed, r)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	for _, r := range added {
+		l.Record("route.added", r, "interface: "+iface)
+	}
+	for _, r := range removed {
+		l.Record("route.removed", r, "interface: "+iface)
+	}
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/audit"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// memorySink holds the records written to it.
+type memorySink struct {
+	records []audit.Record
+}
+
+func (s *memorySink) Write(r audit.Record) error {
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+// summary returns each record's action, object, and details, clearing the sink.
+func (s *memorySink) summary() [][]string {
+	var out [][]string
+	for _, r := range s.records {
+		out = append(out, append([]string{r.Action, r.Object}, r.Details...))
+	}
+	s.records = nil
+	return out
+}
+
+func TestAuditedRegistry(t *testing.T) {
+	sink := &memorySink{}
+	m, err := registry.NewMemory("ns")
+	require.NoError(t, err)
+	r := newAuditedRegistry(m, audit.New(sink, "agent/a", logrus.New()))
+
+	p, err := r.Register(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "ns", Labels: map[string]string{"site": "x"}},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: "key1", Endpoint: "192.0.2.1:51820"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "agent/a", sink.records[0].Actor)
+	require.Equal(t, [][]string{
+		{"registry.register", "a", `spec.endpoint: "192.0.2.1:51820"`, `spec.publicKey: "key1"`, `labels: {"site":"x"}`},
+	}, sink.summary())
+
+	stale := p.DeepCopy()
+	p.Spec.PublicKey = "key2"
+	p.Spec.Endpoint = ""
+	p.Status.PeerHealth = []wgk8s.PeerHealth{{Name: "b", Reachable: true}}
+	p, err = r.Update(p)
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"registry.update", "a", "spec.endpoint: <none>", `spec.publicKey: "key2"`, "status.peerHealth changed"},
+	}, sink.summary())
+
+	_, err = r.Update(stale)
+	require.Error(t, err, "stale resourceVersions aren't written, or recorded")
+	require.Empty(t, sink.summary())
+
+	require.NoError(t, r.Delete("a", p.GetUID()))
+	require.Equal(t, [][]string{{"registry.delete", "a", "uid: " + string(p.GetUID())}}, sink.summary())
+}
+
+func TestAuditApplied(t *testing.T) {
+	sink := &memorySink{}
+	l := audit.New(sink, "agent/a", logrus.New())
+	auditApplied(l, []Event{
+		{Type: "removed", Peer: "b", PublicKey: "old"},
+		{Type: "removed", Peer: "c", PublicKey: "c-key"},
+		{Type: "added", Peer: "b", PublicKey: "new", Changes: []string{"endpoint: <none>"}},
+		{Type: "added", Peer: "d", PublicKey: "d-key", Changes: []string{"allowed IPs: [10.0.0.4/32]"}},
+		{Type: "updated", Peer: "e", PublicKey: "e-key", Changes: []string{"keepalive: <none> -> 25s"}},
+		{Type: "stale", Peer: "f", PublicKey: "f-key"},
+	})
+	require.Equal(t, [][]string{
+		{"peer.rekeyed", "b", "public key: old -> new", "endpoint: <none>"},
+		{"peer.added", "d", "public key: d-key", "allowed IPs: [10.0.0.4/32]"},
+		{"peer.updated", "e", "public key: e-key", "keepalive: <none> -> 25s"},
+		{"peer.removed", "c", "public key: c-key"},
+	}, sink.summary())
+
+	auditRoutes(l, "wg0", map[string]bool{"10.0.0.2/32": true, "10.0.0.3/32": true}, map[string]bool{"10.0.0.3/32": true, "10.0.0.4/32": true})
+	require.Equal(t, [][]string{
+		{"route.added", "10.0.0.4/32", "interface: wg0"},
+		{"route.removed", "10.0.0.2/32", "interface: wg0"},
+	}, sink.summary())
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/jcodybaker/wgmesh/pkg/bench"
+)
+
+// BenchRequest asks the agent, via the control socket, to run a throughput test against a peer's
+// agent.
+type BenchRequest struct {
+	Peer string `json:"peer"`
+	// Port is where the peer's agent serves tests, bench.DefaultPort if zero.
+	Port int `json:"port,omitempty"`
+	bench.Options
+}
+
+// serveBench answers throughput tests from peers' agents, which connect to the local peer's mesh
+// addresses through the tunnel.
+func (a *Agent) serveBench(ctx context.Context) error {
+	s, err := bench.Listen(net.JoinHostPort("", strconv.Itoa(a.benchPort)), a.isMeshAddr, a.ll)
+	if err != nil {
+		return fmt.Errorf("serving bench tests: %w", err)
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		if err := s.Serve(ctx); err != nil {
+			a.ll.WithError(err).Error("bench server failed")
+		}
+	}()
+	return nil
+}
+
+// isMeshAddr returns true if addr is one of the local peer's mesh addresses.
+func (a *Agent) isMeshAddr(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	a.publishLock.Lock()
+	ips := a.localPeer.Spec.IPs
+	a.publishLock.Unlock()
+	for _, cidr := range ips {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err == nil && ip.Equal(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Agent) handleBench(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req BenchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Options.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Port == 0 {
+		req.Port = bench.DefaultPort
+	}
+	addr, err := a.benchAddr(req.Peer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	a.ll.WithField("k8s_name", req.Peer).Infof("running %s bench test", req.Protocol)
+	res, err := bench.Run(r.Context(), net.JoinHostPort(addr, strconv.Itoa(req.Port)), req.Options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	res.Peer = req.Peer
+	writeJSON(w, res)
+}
+
+// benchAddr returns the first mesh address of the named peer, which must be connected.
+func (a *Agent) benchAddr(name string) (string, error) {
+	if a.peerTracker == nil {
+		return "", fmt.Errorf("peers aren't configured yet")
+	}
+	a.peerTracker.Lock()
+	defer a.peerTracker.Unlock()
+	p, ok := a.peerTracker.peer(name)
+	if !ok {
+		return "", fmt.Errorf("peer %q isn't connected", name)
+	}
+	for _, cidr := range p.Spec.IPs {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("peer %q has no mesh addresses", name)
+}
@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"net"
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsMeshAddr(t *testing.T) {
+	a := &Agent{localPeer: &wgk8s.WireGuardPeer{
+		Spec: wgk8s.WireGuardPeerSpec{IPs: []string{"10.10.0.1/32", "fd00::1/128"}},
+	}}
+	require.True(t, a.isMeshAddr(&net.TCPAddr{IP: net.ParseIP("10.10.0.1"), Port: 5201}))
+	require.True(t, a.isMeshAddr(&net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 5201}))
+	require.False(t, a.isMeshAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5201}))
+	require.False(t, a.isMeshAddr(&net.UDPAddr{IP: net.ParseIP("10.10.0.1"), Port: 5201}))
+}
+
+func TestBenchAddr(t *testing.T) {
+	a := &Agent{}
+	_, err := a.benchAddr("b")
+	require.EqualError(t, err, "peers aren't configured yet")
+
+	a.peerTracker = &peerTracker{registry: testRegistry(
+		&wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: "b", SelfLink: "b"},
+			Spec:       wgk8s.WireGuardPeerSpec{IPs: []string{"10.10.0.2/32"}},
+		},
+		&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "c", SelfLink: "c"}},
+	)}
+	addr, err := a.benchAddr("b")
+	require.NoError(t, err)
+	require.Equal(t, "10.10.0.2", addr)
+	_, err = a.benchAddr("c")
+	require.EqualError(t, err, `peer "c" has no mesh addresses`)
+	_, err = a.benchAddr("d")
+	require.EqualError(t, err, `peer "d" isn't connected`)
+}
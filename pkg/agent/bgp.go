@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/bgp"
+)
+
+// bgpSyncInterval is how often the advertised routes are updated, and learned routes are read.
+const bgpSyncInterval = 10 * time.Second
+
+// runBGP starts the BGP speaker, and periodically advertises the mesh's routes, and offers the
+// routes learned from the neighbors, until the context is canceled. gobgpd is restarted if it exits.
+func (a *Agent) runBGP(ctx context.Context) error {
+	c := *a.bgp
+	if c.RouterID == "" {
+		c.RouterID = firstIPv4(a.localPeer.Spec.IPs)
+		if c.RouterID == "" {
+			return fmt.Errorf("bgp requires a router id: the local peer has no IPv4 address")
+		}
+	}
+	// A retried start reuses the speaker of the failed attempt.
+	if a.bgpSpeaker == nil {
+		speaker, err := bgp.Start(c)
+		if err != nil {
+			return fmt.Errorf("starting bgp speaker: %w", err)
+		}
+		a.bgpSpeaker = speaker
+		a.ll.WithField("router_id", c.RouterID).Infof("started bgp speaker with %d neighbors", len(c.Neighbors))
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			if a.bgpSpeaker.Exited() {
+				a.ll.Warn("gobgpd exited; restarting it")
+				a.bgpSpeaker.Stop()
+				speaker, err := bgp.Start(c)
+				if err != nil {
+					a.ll.WithError(err).Error("failed to restart bgp speaker")
+					return
+				}
+				a.bgpSpeaker = speaker
+			}
+			err := a.syncBGPOnce(a.bgpSpeaker)
+			if err != nil {
+				a.ll.WithError(err).Error("failed to sync bgp routes")
+			}
+		}, bgpSyncInterval, ctx.Done())
+	}()
+	return nil
+}
+
+func (a *Agent) syncBGPOnce(s *bgp.Speaker) error {
+	if err := s.Advertise(a.peerTracker.meshRoutes(true)); err != nil {
+		return fmt.Errorf("advertising mesh routes: %w", err)
+	}
+	if !a.bgpLearnRoutes {
+		return nil
+	}
+	learned, err := s.Learned()
+	if err != nil {
+		return fmt.Errorf("reading learned routes: %w", err)
+	}
+	return a.offerLearnedRoutes(learned)
+}
+
+// offerLearnedRoutes offers the routes learned over BGP to the mesh, replacing those learned
+// previously. Default routes aren't offered; the mesh shouldn't capture peers' traffic.
+func (a *Agent) offerLearnedRoutes(learned []string) error {
+	var routes []string
+	for _, r := range learned {
+		if _, n, err := net.ParseCIDR(r); err == nil {
+			if ones, _ := n.Mask.Size(); ones > 0 {
+				routes = append(routes, n.String())
+			}
+		}
+	}
+	a.bgpLock.Lock()
+	changed := !reflect.DeepEqual(a.learnedRoutes, routes)
+	a.learnedRoutes = routes
+	a.bgpLock.Unlock()
+	if changed {
+		a.ll.WithField("routes", len(routes)).Info("routes learned over bgp changed")
+	}
+	err := a.publishLocalPeerSpec(func(spec *wgk8s.WireGuardPeerSpec) bool {
+		routes := serviceRoutes(a.offeredRoutes(), spec.Services)
+		if reflect.DeepEqual(spec.Routes, routes) {
+			return false
+		}
+		spec.Routes = routes
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("publishing learned routes: %w", err)
+	}
+	return nil
+}
+
+// offeredRoutes returns the offered routes, followed by those learned over BGP which they don't
+// include.
+func (a *Agent) offeredRoutes() []string {
+	a.bgpLock.Lock()
+	defer a.bgpLock.Unlock()
+	if len(a.learnedRoutes) == 0 {
+		return a.offerRoutes
+	}
+	routes := append([]string(nil), a.offerRoutes...)
+	offered := make(map[string]bool, len(a.offerRoutes))
+	for _, r := range a.offerRoutes {
+		offered[r] = true
+	}
+	for _, r := range a.learnedRoutes {
+		if !offered[r] {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// meshRoutes returns the prefixes reached through the mesh, to export to routing daemons: the
+// allowed IPs of the applied peers, and with local, the local peer's addresses, sorted.
+func (pt *peerTracker) meshRoutes(local bool) []string {
+	pt.Lock()
+	defer pt.Unlock()
+	seen := make(map[string]bool)
+	var routes []string
+	add := func(n net.IPNet) {
+		if s := n.String(); !seen[s] {
+			seen[s] = true
+			routes = append(routes, s)
+		}
+	}
+	for _, ipStr := range pt.localPeer.Spec.IPs {
+		ip, _, err := net.ParseCIDR(ipStr)
+		if err != nil || !local {
+			continue
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		add(net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	for _, c := range pt.applied {
+		for _, n := range c.AllowedIPs {
+			add(n)
+		}
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// firstIPv4 returns the first IPv4 address of the CIDRs, or "" if there isn't one.
+func firstIPv4(cidrs []string) string {
+	for _, s := range cidrs {
+		ip, _, err := net.ParseCIDR(s)
+		if err == nil && ip.To4() != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMeshRoutes(t *testing.T) {
+	cidr := func(s string) net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return *n
+	}
+	pt := &peerTracker{
+		localPeer: &wgk8s.WireGuardPeer{Spec: wgk8s.WireGuardPeerSpec{
+			IPs:    []string{"10.10.0.1/16", "fd00::1/64"},
+			Routes: []string{"192.168.1.0/24"},
+		}},
+		applied: map[string]wgtypes.PeerConfig{
+			"a": {AllowedIPs: []net.IPNet{cidr("10.10.0.2/32"), cidr("192.168.2.0/24")}},
+			"b": {AllowedIPs: []net.IPNet{cidr("10.10.0.3/32"), cidr("192.168.2.0/24")}},
+		},
+	}
+	require.Equal(t, []string{
+		"10.10.0.1/32", "10.10.0.2/32", "10.10.0.3/32", "192.168.2.0/24", "fd00::1/128",
+	}, pt.meshRoutes(true), "our own offered routes aren't advertised")
+	require.Equal(t, []string{"10.10.0.2/32", "10.10.0.3/32", "192.168.2.0/24"}, pt.meshRoutes(false))
+}
+
+func TestOfferLearnedRoutes(t *testing.T) {
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.name = "gateway"
+	a.offerRoutes = []string{"10.244.0.0/16"}
+	a.localPeer = &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "gateway"},
+		Spec: wgk8s.WireGuardPeerSpec{
+			Routes:   []string{"10.244.0.0/16", "10.96.0.10/32"},
+			Services: []wgk8s.ExportedService{{Name: "web.default.svc.cluster.local", IPs: []string{"10.96.0.10"}}},
+		},
+	}
+	a.registry = registry.NewKubernetes(fake.NewSimpleClientset(a.localPeer), "ns")
+	routes := func() []string {
+		peer, err := a.registry.Get("gateway")
+		require.NoError(t, err)
+		return peer.Spec.Routes
+	}
+
+	require.NoError(t, a.offerLearnedRoutes([]string{"0.0.0.0/0", "10.244.0.0/16", "172.16.0.0/12"}))
+	require.Equal(t, []string{"10.244.0.0/16", "172.16.0.0/12", "10.96.0.10/32"}, routes(),
+		"default routes aren't offered, and exported services keep their routes")
+	require.Equal(t, []string{"10.244.0.0/16", "172.16.0.0/12"}, a.offeredRoutes())
+
+	require.NoError(t, a.offerLearnedRoutes(nil))
+	require.Equal(t, []string{"10.244.0.0/16", "10.96.0.10/32"}, routes(), "withdrawn routes are no longer offered")
+}
+
+func TestFirstIPv4(t *testing.T) {
+	require.Equal(t, "10.10.0.1", firstIPv4([]string{"fd00::1/64", "10.10.0.1/16"}))
+	require.Equal(t, "", firstIPv4([]string{"fd00::1/64"}))
+}
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+)
+
+// bootstrapKeyPrefix prefixes the keys of bootstrap peers' configs, which can't collide with the
+// registry peers' self links.
+const bootstrapKeyPrefix = "bootstrap/"
+
+// BootstrapPeer is a peer configured from the agent's flags rather than the registry, ex. a jump
+// host, or the host serving the registry when it's reached over WireGuard.
+type BootstrapPeer struct {
+	PublicKey wgtypes.Key
+	// Endpoint is the peer's host:port, resolved each time it's configured. It may be empty, if the
+	// peer connects to us.
+	Endpoint   string
+	AllowedIPs []net.IPNet
+}
+
+// config builds the bootstrap peer's config.
+func (p BootstrapPeer) config(keepalive time.Duration, families endpointFamilies) (wgtypes.PeerConfig, error) {
+	c := wgtypes.PeerConfig{
+		PublicKey:                   p.PublicKey,
+		AllowedIPs:                  append([]net.IPNet(nil), p.AllowedIPs...),
+		PersistentKeepaliveInterval: &keepalive,
+	}
+	if p.Endpoint != "" {
+		addr, err := families.resolve(p.Endpoint)
+		if err != nil {
+			return c, fmt.Errorf("failed to resolve endpoint %q: %w", p.Endpoint, err)
+		}
+		c.Endpoint = addr
+	}
+	return c, nil
+}
+
+// addBootstrapPeers adds the bootstrap peers to the desired configs. A bootstrap peer which is also
+// in the registry keeps the registry's config, plus the bootstrap peer's allowed IPs. The caller
+// must hold the lock.
+func (pt *peerTracker) addBootstrapPeers(out map[string]wgtypes.PeerConfig) {
+	byKey := make(map[wgtypes.Key]string, len(out))
+	for name, c := range out {
+		byKey[c.PublicKey] = name
+	}
+	for _, p := range pt.bootstrap {
+		if name, ok := byKey[p.PublicKey]; ok {
+			c := out[name]
+			c.AllowedIPs = appendMissingIPNets(c.AllowedIPs, p.AllowedIPs)
+			out[name] = c
+			continue
+		}
+		c, err := p.config(pt.keepalive, pt.families)
+		if err != nil {
+			pt.ll.WithField("public_key", p.PublicKey.String()).WithError(err).Warn("failed to build bootstrap peer")
+			continue
+		}
+		out[bootstrapKeyPrefix+p.PublicKey.String()] = c
+	}
+}
+
+// appendMissingIPNets appends the prefixes from add which aren't already in nets.
+func appendMissingIPNets(nets, add []net.IPNet) []net.IPNet {
+	have := make(map[string]bool, len(nets))
+	for _, n := range nets {
+		have[n.String()] = true
+	}
+	for _, n := range add {
+		if !have[n.String()] {
+			nets = append(nets, n)
+			have[n.String()] = true
+		}
+	}
+	return nets
+}
+
+// configureBootstrapPeers brings up the interface with the bootstrap peers and routes to them,
+// before the registry is contacted, so it may be reached through them. They stay configured
+// alongside the registry's peers.
+func (a *Agent) configureBootstrapPeers(ctx context.Context) error {
+	err := a.initializeWireGuard(ctx)
+	if err != nil {
+		return fmt.Errorf("initializing WireGuard interface: %w", err)
+	}
+	// Static addresses are assigned now, so traffic over the mesh, ex. to the registry, has a source
+	// address the bootstrap peers accept.
+	err = a.ensureIPs(a.ips)
+	if err != nil {
+		return err
+	}
+	a.meshLock.Lock()
+	keepalive := a.effectiveKeepalive()
+	a.meshLock.Unlock()
+	var config wgtypes.Config
+	var routes []net.IPNet
+	for _, p := range a.bootstrapPeers {
+		c, err := p.config(keepalive, newEndpointFamilies(a.endpointFamily))
+		if err != nil {
+			// It's retried each time the peers are synced.
+			a.ll.WithField("public_key", p.PublicKey.String()).WithError(err).Warn("failed to build bootstrap peer")
+			continue
+		}
+		config.Peers = append(config.Peers, c)
+		routes = append(routes, c.AllowedIPs...)
+	}
+	a.ll.WithField("peers", len(config.Peers)).Info("configuring bootstrap peers")
+	err = a.iface.ConfigureWireGuard(config)
+	if err != nil {
+		return fmt.Errorf("configuring bootstrap peers: %w", err)
+	}
+	// The registry's address is routed via the interface if a bootstrap peer carries it, even if
+	// peers' routes aren't installed; otherwise the agent couldn't reach it.
+	registryRoutes := a.bootstrapRegistryRoutes(ctx, routes)
+	if !a.installRoutes {
+		if len(registryRoutes) == 0 {
+			return nil
+		}
+		routes = registryRoutes
+	}
+	err = a.iface.SyncRoutes(routes, interfaces.RouteOptions{Metric: a.routeMetric, Protocol: a.routeProtocol})
+	if err != nil {
+		return fmt.Errorf("routing bootstrap peers: %w", err)
+	}
+	return nil
+}
+
+// registryURL returns the URL of the registry's API server or registry server, or "" if it has
+// none, ex. a DNS registry.
+func (a *Agent) registryURL() string {
+	if a.registryBackend != nil {
+		if h, ok := a.registryBackend.(*registry.HTTP); ok {
+			return h.URL()
+		}
+		return ""
+	}
+	if a.registryKubeClientConfig == nil {
+		return ""
+	}
+	config, err := a.registryKubeClientConfig.ClientConfig()
+	if err != nil {
+		return ""
+	}
+	return config.Host
+}
+
+// bootstrapRegistryRoutes returns host routes for the registry's addresses which are among the
+// bootstrap peers' allowed IPs, ie. the registry is reached over the mesh.
+func (a *Agent) bootstrapRegistryRoutes(ctx context.Context, allowedIPs []net.IPNet) []net.IPNet {
+	raw := a.registryURL()
+	if raw == "" {
+		return nil
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil
+	}
+	ll := a.ll.WithField("registry", u.Host)
+	var ips []net.IP
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+		if err != nil {
+			// Its name may only resolve over the mesh, too. Routes to the bootstrap peers' allowed
+			// IPs still apply.
+			ll.WithError(err).Debug("unable to resolve the registry's address")
+			return nil
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	var out []net.IPNet
+	for _, ip := range ips {
+		for _, allowed := range allowedIPs {
+			if !allowed.Contains(ip) {
+				continue
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			ll.WithField("ip", ip.String()).Info("reaching the registry over the mesh, via a bootstrap peer")
+			out = append(out, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			break
+		}
+	}
+	return out
+}
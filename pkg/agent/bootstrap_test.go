@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestAddBootstrapPeers(t *testing.T) {
+	mustCIDR := func(s string) net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return *n
+	}
+	jumpKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	registryKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+
+	wgPeer := testPeer("registry", nil, "10.0.0.2/32")
+	wgPeer.Spec.PublicKey = registryKey.PublicKey().String()
+	pt := &peerTracker{
+		ll:        logrus.New(),
+		localPeer: testPeer("local", nil, "10.0.0.1/32"),
+		registry:  testRegistry(wgPeer),
+		bootstrap: []BootstrapPeer{
+			{PublicKey: jumpKey.PublicKey(), Endpoint: "192.0.2.1:51820", AllowedIPs: []net.IPNet{mustCIDR("10.9.0.0/16")}},
+			// Also in the registry.
+			{PublicKey: registryKey.PublicKey(), AllowedIPs: []net.IPNet{mustCIDR("10.0.0.2/32"), mustCIDR("172.16.0.0/12")}},
+		},
+	}
+
+	desired := pt.desiredPeers()
+	require.Len(t, desired, 2)
+	jump := desired[bootstrapKeyPrefix+jumpKey.PublicKey().String()]
+	require.Equal(t, jumpKey.PublicKey(), jump.PublicKey)
+	require.Equal(t, "192.0.2.1:51820", jump.Endpoint.String())
+	require.Equal(t, []string{"10.9.0.0/16"}, ipNetStrings(jump.AllowedIPs))
+	require.Equal(t, []string{"10.0.0.2/32", "172.16.0.0/12"}, ipNetStrings(desired["/registry"].AllowedIPs),
+		"the registry's peer keeps its config, plus the bootstrap allowed IPs")
+
+	require.NoError(t, pt.registry.Delete(wgPeer))
+	desired = pt.desiredPeers()
+	require.Len(t, desired, 2, "bootstrap peers stay configured without the registry")
+	require.Contains(t, desired, bootstrapKeyPrefix+registryKey.PublicKey().String())
+}
+
+func TestBootstrapRegistryRoutes(t *testing.T) {
+	_, mesh, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	routes := func(url string) []string {
+		a.registryBackend = registry.NewHTTP(url, "", nil)
+		var out []string
+		for _, r := range a.bootstrapRegistryRoutes(context.Background(), []net.IPNet{*mesh}) {
+			out = append(out, r.String())
+		}
+		return out
+	}
+
+	require.Equal(t, []string{"10.0.0.2/32"}, routes("https://10.0.0.2:8443"))
+	require.Empty(t, routes("https://192.0.2.1:8443"), "the registry isn't reached over the mesh")
+	require.Empty(t, routes("http://registry.invalid"), "the name doesn't resolve")
+
+	a.registryBackend = nil
+	require.Empty(t, a.bootstrapRegistryRoutes(context.Background(), []net.IPNet{*mesh}), "no registry kubeconfig")
+}
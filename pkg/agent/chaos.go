@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// corruptPublicKey is written into peer records by the corrupt-peer chaos hook. It is not valid
+// base64, so any consumer which parses it will fail.
+const corruptPublicKey = "chaos-corrupted-public-key"
+
+// droppableWatch tracks the active registry watch so it can be forcibly dropped, simulating a
+// broken connection to the apiserver, or to force a relist.
+type droppableWatch struct {
+	sync.Mutex
+	current watch.Interface
+	// relisted, if set, is closed once the informer next lists the registry.
+	relisted chan struct{}
+}
+
+func (d *droppableWatch) track(w watch.Interface, err error) (watch.Interface, error) {
+	if err != nil {
+		return w, err
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.current = w
+	return w, nil
+}
+
+// drop stops the active watch. The informer's reflector will notice the closed result channel and
+// re-establish the watch, just as it would after a network failure.
+func (d *droppableWatch) drop() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.current == nil {
+		return errors.New("no active watch")
+	}
+	d.current.Stop()
+	d.current = nil
+	return nil
+}
+
+func (a *Agent) registerChaosHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/chaos/drop-watch", chaosHandler(func(r *http.Request) error {
+		a.ll.Warnln("chaos: dropping registry watch")
+		return a.peerWatch.drop()
+	}))
+	mux.HandleFunc("/v1/chaos/kill-driver", chaosHandler(func(r *http.Request) error {
+		if a.iface == nil {
+			return errors.New("no WireGuard interface")
+		}
+		a.ll.Warnln("chaos: killing userspace driver")
+		return interfaces.KillUserspaceDriver(a.iface)
+	}))
+	mux.HandleFunc("/v1/chaos/corrupt-peer", chaosHandler(func(r *http.Request) error {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = a.name
+		}
+		a.ll.WithField("k8s_name", name).Warnln("chaos: corrupting peer record")
+		p, err := a.registry.Get(name)
+		if err != nil {
+			return err
+		}
+		p.Spec.PublicKey = corruptPublicKey
+		_, err = a.registry.Update(p)
+		return err
+	}))
+}
+
+func chaosHandler(f func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := f(r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,23 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestDroppableWatch(t *testing.T) {
+	var d droppableWatch
+	require.Error(t, d.drop(), "dropping without an active watch should fail")
+
+	fw := watch.NewFake()
+	w, err := d.track(fw, nil)
+	require.NoError(t, err)
+	require.Equal(t, fw, w)
+
+	require.NoError(t, d.drop())
+	_, open := <-fw.ResultChan()
+	require.False(t, open, "watch should be stopped")
+	require.Error(t, d.drop(), "watch should only be dropped once")
+}
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+const controlShutdownTimeout = 5 * time.Second
+
+// Status describes the agent's current state, as reported by the control socket.
+type Status struct {
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace"`
+	Interface string   `json:"interface,omitempty"`
+	Endpoint  string   `json:"endpoint"`
+	PublicKey string   `json:"publicKey"`
+	Peers     []string `json:"peers"`
+	// RegistryUnreachableSince is when the registry became unreachable, while the agent keeps its
+	// last known configuration.
+	RegistryUnreachableSince *time.Time `json:"registryUnreachableSince,omitempty"`
+	RegistryError            string     `json:"registryError,omitempty"`
+}
+
+// serveControl exposes introspection (and, if enabled, chaos) endpoints on a unix socket until
+// the context is canceled.
+func (a *Agent) serveControl(ctx context.Context) error {
+	// Remove stale sockets from previous runs; the listener fails if the path exists.
+	if err := os.Remove(a.controlSocket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing stale control socket %q: %w", a.controlSocket, err)
+	}
+	l, err := net.Listen("unix", a.controlSocket)
+	if err != nil {
+		return fmt.Errorf("listening on control socket %q: %w", a.controlSocket, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", a.handleStatus)
+	mux.HandleFunc("/v1/bench", a.handleBench)
+	mux.HandleFunc("/v1/events", a.handleEvents)
+	mux.HandleFunc("/v1/resync", a.handleResync)
+	mux.HandleFunc("/v1/pins", a.handlePins)
+	mux.HandleFunc("/v1/pins/approve", a.handleApprovePin)
+	if a.chaos {
+		a.ll.Warnln("chaos hooks are enabled on the control socket")
+		a.registerChaosHandlers(mux)
+	}
+	srv := &http.Server{
+		Handler: mux,
+		// Cancel streaming requests when the agent stops.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		<-ctx.Done()
+		sCtx, cancel := context.WithTimeout(context.Background(), controlShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(sCtx)
+	}()
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		err := srv.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			a.ll.WithError(err).Error("control socket failed")
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) status() Status {
+	s := Status{
+		Name:      a.name,
+		Namespace: a.registryNamespace,
+		PublicKey: a.publicKey.String(),
+		Peers:     []string{},
+	}
+	a.publishLock.Lock()
+	if a.localPeer != nil {
+		s.Endpoint = a.localPeer.Spec.Endpoint
+	}
+	a.publishLock.Unlock()
+	if a.iface != nil {
+		s.Interface = a.iface.GetName()
+	}
+	if a.registryHealth != nil {
+		if since, err := a.registryHealth.state(); !since.IsZero() {
+			s.RegistryUnreachableSince = &since
+			s.RegistryError = err.Error()
+		}
+	}
+	if a.peerTracker != nil {
+		a.peerTracker.Lock()
+		for _, p := range a.peerTracker.listPeers() {
+			s.Peers = append(s.Peers, p.GetName())
+		}
+		a.peerTracker.Unlock()
+		sort.Strings(s.Peers)
+	}
+	return s
+}
+
+func (a *Agent) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.status())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// ControlBaseURL is the base URL for requests made with a client from NewControlClient.
+const ControlBaseURL = "http://wgmesh"
+
+// NewControlClient returns an http.Client which dials the agent control socket at the specified
+// path, regardless of the request URL's host.
+func NewControlClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// deviceDelta returns the peer configs which move the device's peers, as read back from it, to the
+// desired configs, so they're applied without ReplacePeers. Peers already configured as desired
+// are left alone so their sessions aren't disturbed, and peers on the device which aren't desired,
+// ex. added outside the agent, are removed. A peer's endpoint is only set if the device has none, or
+// it changed since it was applied, since WireGuard may have roamed to the peer's actual address.
+func deviceDelta(devPeers []wgtypes.Peer, applied, desired map[string]wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	byKey := make(map[wgtypes.Key]*wgtypes.Peer, len(devPeers))
+	for i := range devPeers {
+		byKey[devPeers[i].PublicKey] = &devPeers[i]
+	}
+	appliedEndpoints := make(map[wgtypes.Key]*net.UDPAddr, len(applied))
+	for _, c := range applied {
+		appliedEndpoints[c.PublicKey] = c.Endpoint
+	}
+	names := make([]string, 0, len(desired))
+	wanted := make(map[wgtypes.Key]bool, len(desired))
+	for name, c := range desired {
+		names = append(names, name)
+		wanted[c.PublicKey] = true
+	}
+	sort.Strings(names)
+
+	var out []wgtypes.PeerConfig
+	// Peers are removed first, so their allowed IPs are free for the peers which replace them.
+	for _, dp := range devPeers {
+		if !wanted[dp.PublicKey] {
+			out = append(out, wgtypes.PeerConfig{PublicKey: dp.PublicKey, Remove: true})
+		}
+	}
+	for _, name := range names {
+		c := desired[name]
+		if dp, ok := byKey[c.PublicKey]; ok {
+			if dp.Endpoint != nil && (udpAddrEqual(c.Endpoint, dp.Endpoint) || udpAddrEqual(c.Endpoint, appliedEndpoints[c.PublicKey])) {
+				c.Endpoint = nil
+			}
+			if c.Endpoint == nil && devicePeerEqual(dp, c) {
+				continue
+			}
+		}
+		c.ReplaceAllowedIPs = true
+		out = append(out, c)
+	}
+	return out
+}
+
+// devicePeerEqual returns true if the peer on the device has the config's allowed IPs and
+// keepalive. Endpoints are compared by the caller.
+func devicePeerEqual(dp *wgtypes.Peer, c wgtypes.PeerConfig) bool {
+	if c.PersistentKeepaliveInterval != nil && dp.PersistentKeepaliveInterval != *c.PersistentKeepaliveInterval {
+		return false
+	}
+	return ipNetsEqual(dp.AllowedIPs, c.AllowedIPs)
+}
+
+// configureDevice applies the delta from the device's peers to the desired configs, in a single
+// ConfigureDevice call if there's any. The caller must hold the lock.
+func (pt *peerTracker) configureDevice(desired map[string]wgtypes.PeerConfig) error {
+	devPeers, err := pt.iface.GetPeers()
+	if err != nil {
+		return fmt.Errorf("reading WireGuard peers: %w", err)
+	}
+	delta := deviceDelta(devPeers, pt.applied, desired)
+	if len(delta) == 0 {
+		return nil
+	}
+	return pt.iface.ConfigureWireGuard(wgtypes.Config{Peers: delta})
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/interfaces/interfacestest"
+)
+
+func TestDeviceDelta(t *testing.T) {
+	keys := make([]wgtypes.Key, 6)
+	for i := range keys {
+		k, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		keys[i] = k.PublicKey()
+	}
+	endpoint := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	roamed := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4242}
+	moved := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 51820}
+	prefix := func(s string) []net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return []net.IPNet{*n}
+	}
+	keepalive := 25 * time.Second
+	devPeers := []wgtypes.Peer{
+		{PublicKey: keys[0], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.1/32"), PersistentKeepaliveInterval: keepalive},
+		{PublicKey: keys[1], Endpoint: roamed, AllowedIPs: prefix("10.0.0.2/32")},
+		{PublicKey: keys[2], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.3/32")},
+		{PublicKey: keys[3], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.4/32")},
+		{PublicKey: keys[4], Endpoint: endpoint},
+	}
+	applied := map[string]wgtypes.PeerConfig{
+		"/roamed": {PublicKey: keys[1], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.2/32")},
+		"/moved":  {PublicKey: keys[3], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.4/32")},
+	}
+	desired := map[string]wgtypes.PeerConfig{
+		"/same":    {PublicKey: keys[0], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.1/32"), PersistentKeepaliveInterval: &keepalive},
+		"/roamed":  {PublicKey: keys[1], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.2/32")},
+		"/changed": {PublicKey: keys[2], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.0/24")},
+		"/moved":   {PublicKey: keys[3], Endpoint: moved, AllowedIPs: prefix("10.0.0.4/32")},
+		"/added":   {PublicKey: keys[5], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.6/32")},
+	}
+	require.Equal(t, []wgtypes.PeerConfig{
+		// Peers on the device which aren't desired are removed first.
+		{PublicKey: keys[4], Remove: true},
+		{PublicKey: keys[5], Endpoint: endpoint, ReplaceAllowedIPs: true, AllowedIPs: prefix("10.0.0.6/32")},
+		{PublicKey: keys[2], ReplaceAllowedIPs: true, AllowedIPs: prefix("10.0.0.0/24")},
+		{PublicKey: keys[3], Endpoint: moved, ReplaceAllowedIPs: true, AllowedIPs: prefix("10.0.0.4/32")},
+		// The roamed peer is left alone, since its applied endpoint is unchanged.
+	}, deviceDelta(devPeers, applied, desired))
+
+	devPeers = devPeers[:2]
+	delete(desired, "/changed")
+	delete(desired, "/moved")
+	delete(desired, "/added")
+	require.Empty(t, deviceDelta(devPeers, applied, desired))
+
+	keepalive = 10 * time.Second
+	require.Equal(t, []wgtypes.PeerConfig{
+		{PublicKey: keys[0], ReplaceAllowedIPs: true, AllowedIPs: prefix("10.0.0.1/32"), PersistentKeepaliveInterval: &keepalive},
+	}, deviceDelta(devPeers, applied, desired))
+}
+
+func TestConfigureDevice(t *testing.T) {
+	iface := interfacestest.NewWireGuardInterface("wg0")
+	pt := &peerTracker{
+		ll:            logrus.New(),
+		iface:         iface,
+		registry:      newPeerStore(),
+		applied:       make(map[string]wgtypes.PeerConfig),
+		localPeer:     testPeer("local", nil),
+		installRoutes: true,
+	}
+	keys := make(map[string]wgtypes.Key)
+	for _, name := range []string{"a", "b", "stray"} {
+		k, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		keys[name] = k.PublicKey()
+	}
+	peer := func(name, ip, endpoint string) *wgk8s.WireGuardPeer {
+		p := testPeer(name, nil, ip)
+		p.Spec.PublicKey = keys[name].String()
+		p.Spec.Endpoint = endpoint
+		return p
+	}
+	require.NoError(t, pt.storePeer(peer("a", "10.0.0.1/32", "192.0.2.1:51820")))
+	require.NoError(t, pt.storePeer(peer("b", "10.0.0.2/32", "192.0.2.2:51820")))
+	// A peer added outside the agent, ex. with `wg set`.
+	require.NoError(t, iface.ConfigureWireGuard(wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: keys["stray"]}}}))
+	iface.ResetCalls()
+
+	require.NoError(t, pt.applyInitialConfig())
+	var configured []wgtypes.Key
+	for _, p := range iface.Peers() {
+		configured = append(configured, p.PublicKey)
+	}
+	require.ElementsMatch(t, []wgtypes.Key{keys["a"], keys["b"]}, configured)
+	calls := iface.CallsTo("ConfigureWireGuard")
+	require.Len(t, calls, 1)
+	require.False(t, calls[0].Args[0].(wgtypes.Config).ReplacePeers)
+	require.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32"}, iface.Routes())
+
+	// The device roams to a's actual address, and b's spec changes.
+	roamed := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4242}
+	iface.UpdatePeer(keys["a"], func(p *wgtypes.Peer) { p.Endpoint = roamed })
+	iface.ResetCalls()
+	require.NoError(t, pt.storePeer(peer("b", "10.0.0.3/32", "192.0.2.2:51820")))
+	calls = iface.CallsTo("ConfigureWireGuard")
+	require.Len(t, calls, 1)
+	require.Len(t, calls[0].Args[0].(wgtypes.Config).Peers, 1, "only the changed peer is configured")
+	a, ok := iface.Peer(keys["a"])
+	require.True(t, ok)
+	require.Equal(t, roamed, a.Endpoint)
+
+	// Reapplying the full config with nothing changed leaves the device alone.
+	iface.ResetCalls()
+	pt.Lock()
+	require.NoError(t, pt.replaceConfig())
+	pt.Unlock()
+	require.Empty(t, iface.CallsTo("ConfigureWireGuard"))
+	a, _ = iface.Peer(keys["a"])
+	require.Equal(t, roamed, a.Endpoint, "resyncs don't reset roamed endpoints")
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+// disallowedEndpoint returns the first of the peer's published endpoints, its endpoint candidates
+// and TCP endpoint, which isn't within allowedEndpoints, or "" if they all are, or any endpoint is
+// allowed. The caller must hold the lock.
+func (pt *peerTracker) disallowedEndpoint(wgPeer *wgk8s.WireGuardPeer) string {
+	if pt.allowedEndpoints == nil {
+		return ""
+	}
+	endpoints := wgPeer.Spec.EndpointCandidates()
+	if wgPeer.Spec.TCPEndpoint != "" {
+		endpoints = append(endpoints, wgPeer.Spec.TCPEndpoint)
+	}
+	for _, e := range endpoints {
+		if !pt.endpointAllowed(e) {
+			return e
+		}
+	}
+	return ""
+}
+
+// endpointAllowed reports whether the host:port endpoint is within allowedEndpoints. A DNS name must
+// only resolve to allowed addresses; one which doesn't resolve isn't allowed. The caller must hold
+// the lock.
+func (pt *peerTracker) endpointAllowed(endpoint string) bool {
+	if pt.allowedEndpoints == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = lookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if !cidrsContain(pt.allowedEndpoints, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func cidrsContain(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, n := range cidrs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveAllowedEndpoints returns the agent's allowed endpoint CIDRs if set, falling back to the
+// Mesh's, or nil if any endpoint is allowed. The Mesh's are validated by the webhook; if they're
+// invalid anyway, an error is returned. The caller must hold meshLock.
+func (a *Agent) effectiveAllowedEndpoints() ([]*net.IPNet, error) {
+	if a.allowedEndpointCIDRs != nil || a.mesh == nil || len(a.mesh.Spec.AllowedEndpointCIDRs) == 0 {
+		return a.allowedEndpointCIDRs, nil
+	}
+	return parseCIDRs(a.mesh.Spec.AllowedEndpointCIDRs)
+}
+
+// recordRejection records an event on a peer the policy rejects, if events are recorded. Events are
+// only recorded in the registry namespace.
+func (a *Agent) recordRejection(wgPeer *wgk8s.WireGuardPeer, reason, msg string) {
+	if a.recorder != nil && wgPeer.GetNamespace() == a.registryNamespace {
+		a.recorder.Event(wgPeer, corev1.EventTypeWarning, reason, msg)
+	}
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+func TestPeerTrackerAllowedEndpoints(t *testing.T) {
+	defer func(orig func(string) ([]net.IP, error)) { lookupIP = orig }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "corp.example.com":
+			return []net.IP{net.ParseIP("10.1.0.5")}, nil
+		case "split.example.com":
+			return []net.IP{net.ParseIP("10.1.0.6"), net.ParseIP("203.0.113.6")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	corp, err := parseCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	inside := testPeer("inside", nil, "10.10.0.1/32")
+	inside.Spec.Endpoint = "10.1.0.1:51820"
+	named := testPeer("named", nil, "10.10.0.2/32")
+	named.Spec.Endpoint = "corp.example.com:51820"
+	clientOnly := testPeer("client-only", nil, "10.10.0.3/32")
+	outside := testPeer("outside", nil, "10.10.0.4/32")
+	outside.Spec.Endpoint = "10.1.0.4:51820"
+	outside.Spec.Endpoints = []string{"192.168.1.4:51820"}
+	split := testPeer("split", nil, "10.10.0.5/32")
+	split.Spec.Endpoint = "split.example.com:51820"
+	tcp := testPeer("tcp", nil, "10.10.0.6/32")
+	tcp.Spec.Endpoint = "10.1.0.6:51820"
+	tcp.Spec.TCPEndpoint = "198.51.100.6:443"
+
+	var rejected []string
+	pt := &peerTracker{
+		ll:               logrus.New(),
+		registry:         newPeerStore(),
+		allowedEndpoints: corp,
+		onReject: func(wgPeer *wgk8s.WireGuardPeer, reason, msg string) {
+			rejected = append(rejected, wgPeer.GetName()+": "+reason+": "+msg)
+		},
+	}
+	for _, p := range []*wgk8s.WireGuardPeer{inside, named, clientOnly, outside, split, tcp} {
+		require.NoError(t, pt.storePeer(p))
+	}
+	require.ElementsMatch(t, []string{"/inside", "/named", "/client-only"}, peerNames(pt.listPeers()))
+	require.Equal(t, []string{
+		"outside: EndpointNotAllowed: WireGuardPeer's endpoint 192.168.1.4:51820 isn't within the allowed endpoint CIDRs, ignoring peer",
+		"split: EndpointNotAllowed: WireGuardPeer's endpoint split.example.com:51820 isn't within the allowed endpoint CIDRs, ignoring peer",
+		"tcp: EndpointNotAllowed: WireGuardPeer's endpoint 198.51.100.6:443 isn't within the allowed endpoint CIDRs, ignoring peer",
+	}, rejected)
+
+	// Updates to a rejected peer aren't reported again.
+	outside.Spec.IPs = []string{"10.10.0.40/32"}
+	require.NoError(t, pt.storePeer(outside))
+	require.Len(t, rejected, 3)
+
+	// A peer moving outside the allowed CIDRs is removed.
+	moved := inside.DeepCopy()
+	moved.Spec.Endpoint = "203.0.113.1:51820"
+	require.NoError(t, pt.storePeer(moved))
+	require.NotContains(t, pt.listPeers(), "/inside")
+	require.Len(t, rejected, 4)
+
+	// Widening the allowlist restores rejected peers.
+	all, err := parseCIDRs([]string{"0.0.0.0/0"})
+	require.NoError(t, err)
+	require.NoError(t, pt.setAllowedEndpoints(all))
+	require.Len(t, pt.listPeers(), 6)
+	require.Equal(t, "10.10.0.40/32", pt.listPeers()["/outside"].Spec.IPs[0], "the latest update is restored")
+	require.Empty(t, pt.rejectedPeers)
+
+	require.NoError(t, pt.setAllowedEndpoints(corp))
+	require.Len(t, pt.listPeers(), 2)
+	require.NoError(t, pt.setAllowedEndpoints(nil))
+	require.Len(t, pt.listPeers(), 6, "nil allows any endpoint")
+
+	// A deleted rejected peer isn't restored.
+	require.NoError(t, pt.setAllowedEndpoints(corp))
+	require.NoError(t, testDeletePeer(pt, tcp))
+	require.NoError(t, pt.setAllowedEndpoints(nil))
+	require.NotContains(t, pt.listPeers(), "/tcp")
+}
+
+func TestEndpointCandidatesAllowedObserved(t *testing.T) {
+	corp, err := parseCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	a := testPeer("a", nil, "10.10.0.1/32")
+	a.Spec.PublicKey = "key-a"
+	a.Spec.Endpoint = "10.1.0.1:51820"
+	b := testPeer("b", nil, "10.10.0.2/32")
+	b.Status.ObservedEndpoints = []wgk8s.ObservedEndpoint{
+		{PublicKey: "key-a", Endpoint: "10.2.0.1:40000"},
+		{PublicKey: "key-a", Endpoint: "203.0.113.1:40000"},
+	}
+	pt := &peerTracker{
+		registry:         testRegistry(a, b),
+		natTraversal:     true,
+		allowedEndpoints: corp,
+	}
+	require.Equal(t, []string{"10.1.0.1:51820", "10.2.0.1:40000"}, pt.endpointCandidates(a),
+		"observed endpoints outside the allowed CIDRs aren't tried")
+}
+
+func peerNames(m map[string]*wgk8s.WireGuardPeer) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,353 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// endpointCheckInterval is how often peer handshakes are checked for endpoint failover.
+	endpointCheckInterval = 5 * time.Second
+	// endpointFailoverTimeout is the default handshake timeout: how long we'll send to an endpoint
+	// without completing a handshake before trying the next candidate. WireGuard retries
+	// handshakes every 5s.
+	endpointFailoverTimeout = 20 * time.Second
+	// staleHandshake is the age after which WireGuard sessions expire (REJECT_AFTER_TIME), so a
+	// handshake older than this doesn't show the endpoint is reachable.
+	staleHandshake = 180 * time.Second
+	// rekeyAfterTime is the session age after which WireGuard handshakes again when sending
+	// (REKEY_AFTER_TIME).
+	rekeyAfterTime = 120 * time.Second
+	// endpointRevisitInterval is how long a peer stays on a fallback address of its endpoint before
+	// its most preferred address is tried again.
+	endpointRevisitInterval = 10 * time.Minute
+)
+
+// endpointState tracks which of a peer's endpoint candidates is in use.
+type endpointState struct {
+	candidates []string
+	index      int
+	// since is when the current candidate was selected. Only handshakes after this confirm it.
+	since time.Time
+	// txBytes is the transmit counter when the endpoint was last known good, or -1 if the
+	// device hasn't been observed since the candidate was selected.
+	txBytes int64
+	// sending is when we first observed traffic to the peer without a fresh handshake.
+	sending time.Time
+	// addrs are the current candidate's addresses, in the order they're tried, and addrIndex is
+	// the one in use. They're resolved when the candidate is selected.
+	addrs     []*net.UDPAddr
+	addrIndex int
+}
+
+// monitorEndpoints periodically fails over peers which have stopped completing handshakes to
+// their next endpoint candidate, until the context is canceled.
+func (a *Agent) monitorEndpoints(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := a.peerTracker.checkEndpoints()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to check peer endpoints")
+			}
+		}, endpointCheckInterval, ctx.Done())
+	}()
+}
+
+// selectEndpoint returns the endpoint candidate currently in use for the peer. The caller must
+// hold the lock.
+func (pt *peerTracker) selectEndpoint(wgPeer *wgk8s.WireGuardPeer) string {
+	st := pt.endpointState(wgPeer)
+	if st == nil {
+		return wgPeer.Spec.Endpoint
+	}
+	return st.candidates[st.index]
+}
+
+// selectAddr returns the address currently in use for the peer's endpoint, or nil if it has none,
+// resolving the current candidate if it hasn't been. The caller must hold the lock.
+func (pt *peerTracker) selectAddr(wgPeer *wgk8s.WireGuardPeer) (*net.UDPAddr, error) {
+	st := pt.endpointState(wgPeer)
+	if st == nil {
+		return nil, nil
+	}
+	if len(st.addrs) == 0 {
+		addrs, err := pt.resolveCandidate(wgPeer, st.candidates[st.index])
+		if err != nil {
+			return nil, err
+		}
+		st.addrs, st.addrIndex = addrs, 0
+	}
+	return st.addrs[st.addrIndex], nil
+}
+
+// endpointState returns the peer's endpoint state, updated with its current candidates, or nil if
+// the peer has none. Peers start on their most preferred candidate. If the candidates change, we
+// keep using the current candidate if it's still listed. The caller must hold the lock.
+func (pt *peerTracker) endpointState(wgPeer *wgk8s.WireGuardPeer) *endpointState {
+	name := wgPeer.GetSelfLink()
+	candidates := pt.endpointCandidates(wgPeer)
+	if len(candidates) == 0 {
+		delete(pt.endpoints, name)
+		return nil
+	}
+	st, ok := pt.endpoints[name]
+	if ok && reflect.DeepEqual(st.candidates, candidates) {
+		return st
+	}
+	if ok {
+		current := st.candidates[st.index]
+		st.candidates = candidates
+		st.index = 0
+		for i, c := range candidates {
+			if c == current {
+				st.index = i
+				return st
+			}
+		}
+		st.addrs, st.addrIndex = nil, 0
+		// The current candidate is gone, so start over.
+	}
+	if pt.endpoints == nil {
+		pt.endpoints = make(map[string]*endpointState)
+	}
+	st = &endpointState{
+		candidates: candidates,
+		since:      pt.clock(),
+		txBytes:    -1,
+	}
+	pt.endpoints[name] = st
+	return st
+}
+
+// endpointCandidates returns the endpoints to try for the peer: the address it was discovered at
+// on the local network, if it published that host, then its published candidates followed, with NAT traversal, by the
+// addresses other peers have observed it at which are allowed, and with TCP fallback, by its TCP
+// endpoint. The caller must hold the lock.
+func (pt *peerTracker) endpointCandidates(wgPeer *wgk8s.WireGuardPeer) []string {
+	candidates := wgPeer.Spec.EndpointCandidates()
+	if lan, ok := pt.lanEndpoint(wgPeer.Spec.PublicKey); ok && publishedHost(wgPeer, lan) {
+		candidates = append([]string{lan}, candidates...)
+		for i := 1; i < len(candidates); i++ {
+			if candidates[i] == lan {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+	if !pt.natTraversal {
+		return pt.withTCPCandidate(wgPeer, pt.families.order(candidates))
+	}
+	seen := make(map[string]struct{}, len(candidates))
+	for _, c := range candidates {
+		seen[c] = struct{}{}
+	}
+	var observed []string
+	for _, other := range pt.listPeers() {
+		for _, o := range other.Status.ObservedEndpoints {
+			if _, ok := seen[o.Endpoint]; ok || o.PublicKey != wgPeer.Spec.PublicKey || !pt.endpointAllowed(o.Endpoint) {
+				continue
+			}
+			seen[o.Endpoint] = struct{}{}
+			observed = append(observed, o.Endpoint)
+		}
+	}
+	sort.Strings(observed)
+	return pt.withTCPCandidate(wgPeer, pt.families.order(append(candidates, observed...)))
+}
+
+// checkEndpoints reconfigures any peers which should fail over to another endpoint, moves routes
+// away from peers which are down, and with a quarantine, removes peers which never complete a
+// handshake.
+func (pt *peerTracker) checkEndpoints() error {
+	devPeers, err := pt.iface.GetPeers()
+	if err != nil {
+		return fmt.Errorf("reading WireGuard peers: %w", err)
+	}
+	pt.Lock()
+	defer pt.Unlock()
+	if !pt.initialConfigApplied {
+		return nil
+	}
+	configs := pt.failoverEndpoints(devPeers)
+	if len(configs) > 0 {
+		err = pt.iface.ConfigureWireGuard(wgtypes.Config{Peers: configs})
+		if err != nil {
+			return err
+		}
+	}
+	changed := pt.updateLiveness(devPeers)
+	if pt.updateQuarantine(devPeers) {
+		changed = true
+	}
+	if changed {
+		return pt.sync()
+	}
+	return nil
+}
+
+// failoverEndpoints advances each peer which we've been sending to for the handshake timeout
+// without a fresh handshake to the next address of its endpoint candidate, or once those are
+// exhausted, to its next candidate, returning the updated peer configs. After the last candidate we
+// wrap around to the most preferred, and a peer with a single candidate has it resolved again, in
+// case its DNS name has moved. Idle peers never fail over, since WireGuard only handshakes when
+// there's traffic. A peer left on a fallback address has its most preferred address revisited
+// periodically. The caller must hold the lock.
+func (pt *peerTracker) failoverEndpoints(devPeers []wgtypes.Peer) []wgtypes.PeerConfig {
+	byKey := make(map[wgtypes.Key]*wgtypes.Peer, len(devPeers))
+	for i := range devPeers {
+		byKey[devPeers[i].PublicKey] = &devPeers[i]
+	}
+	now := pt.clock()
+	var configs []wgtypes.PeerConfig
+	for name, wgPeer := range pt.listPeers() {
+		st := pt.endpointState(wgPeer)
+		if st == nil {
+			continue
+		}
+		key, err := wgtypes.ParseKey(wgPeer.Spec.PublicKey)
+		if err != nil {
+			continue
+		}
+		dp, ok := byKey[key]
+		if !ok {
+			continue
+		}
+		if st.txBytes < 0 {
+			st.txBytes = dp.TransmitBytes
+			continue
+		}
+		handshake := dp.LastHandshakeTime
+		fresh := handshake.After(st.since) && now.Sub(handshake) < staleHandshake
+		if fresh || dp.TransmitBytes == st.txBytes {
+			st.txBytes = dp.TransmitBytes
+			st.sending = time.Time{}
+			if pt.shouldRevisit(st, handshake, now) {
+				if addr := pt.revisitEndpoint(wgPeer, st, now); addr != nil {
+					pt.setAppliedEndpoint(name, addr)
+					configs = append(configs, wgtypes.PeerConfig{PublicKey: key, UpdateOnly: true, Endpoint: addr})
+				}
+			}
+			continue
+		}
+		// We're sending without a fresh handshake.
+		if st.sending.IsZero() {
+			st.sending = now
+			continue
+		}
+		if now.Sub(st.sending) < pt.staleAfter() {
+			continue
+		}
+
+		previous := st.candidates[st.index]
+		st.since = now
+		st.txBytes = dp.TransmitBytes
+		st.sending = time.Time{}
+		var addr *net.UDPAddr
+		if st.addrIndex+1 < len(st.addrs) {
+			previousAddr := st.addrs[st.addrIndex]
+			st.addrIndex++
+			addr = st.addrs[st.addrIndex]
+			wglog.WithPeer(pt.ll, wgPeer).WithFields(log.Fields{
+				"endpoint":         previous,
+				"previous_address": previousAddr.String(),
+				"address":          addr.String(),
+			}).Info("peer endpoint address not completing handshakes; trying its next address")
+		} else {
+			st.index = (st.index + 1) % len(st.candidates)
+			st.addrs, st.addrIndex = nil, 0
+			endpoint := st.candidates[st.index]
+			ll := wglog.WithPeer(pt.ll, wgPeer).WithFields(log.Fields{
+				"previous_endpoint": previous,
+				"endpoint":          endpoint,
+			})
+			addrs, err := pt.resolveCandidate(wgPeer, endpoint)
+			if err != nil {
+				// We'll move on to the next candidate after another timeout.
+				ll.WithError(err).Warn("failed to resolve endpoint candidate")
+				continue
+			}
+			st.addrs = addrs
+			addr = addrs[0]
+			if len(st.candidates) == 1 {
+				ll.Info("peer endpoint not completing handshakes; resolving it again")
+			} else {
+				ll.Info("peer endpoint not completing handshakes; trying next candidate")
+			}
+		}
+		pt.metrics.endpointRefreshed(wgPeer.GetName())
+		pt.attemptFailed(name, dp)
+		pt.setAppliedEndpoint(name, addr)
+		configs = append(configs, wgtypes.PeerConfig{
+			PublicKey:  key,
+			UpdateOnly: true,
+			Endpoint:   addr,
+		})
+	}
+	pt.pruneTCPTransports()
+	return configs
+}
+
+// shouldRevisit returns true if the peer has been on a fallback address of its endpoint for the
+// revisit interval and its session is due to be rekeyed, so the handshake which confirms the most
+// preferred address, or fails it over again, follows shortly.
+func (pt *peerTracker) shouldRevisit(st *endpointState, handshake time.Time, now time.Time) bool {
+	if st.addrIndex == 0 || now.Sub(st.since) < endpointRevisitInterval {
+		return false
+	}
+	return now.Sub(handshake) >= rekeyAfterTime-2*endpointCheckInterval
+}
+
+// revisitEndpoint resolves the peer's current candidate again and returns its most preferred
+// address, or nil if it can't be resolved. The caller must hold the lock.
+func (pt *peerTracker) revisitEndpoint(wgPeer *wgk8s.WireGuardPeer, st *endpointState, now time.Time) *net.UDPAddr {
+	st.since = now
+	endpoint := st.candidates[st.index]
+	ll := wglog.WithPeer(pt.ll, wgPeer).WithField("endpoint", endpoint)
+	addrs, err := pt.resolveCandidate(wgPeer, endpoint)
+	if err != nil {
+		ll.WithError(err).Warn("failed to resolve endpoint candidate")
+		return nil
+	}
+	ll.WithFields(log.Fields{
+		"previous_address": st.addrs[st.addrIndex].String(),
+		"address":          addrs[0].String(),
+	}).Info("retrying the peer endpoint's preferred address")
+	st.addrs, st.addrIndex = addrs, 0
+	return addrs[0]
+}
+
+// setAppliedEndpoint records the endpoint configured for the peer outside of a sync. The caller
+// must hold the lock.
+func (pt *peerTracker) setAppliedEndpoint(name string, addr *net.UDPAddr) {
+	if applied, ok := pt.applied[name]; ok {
+		applied.Endpoint = addr
+		pt.applied[name] = applied
+	}
+}
+
+// staleAfter returns how long we send to a peer without a handshake before it's stale.
+func (pt *peerTracker) staleAfter() time.Duration {
+	if pt.handshakeTimeout == 0 {
+		return endpointFailoverTimeout
+	}
+	return pt.handshakeTimeout
+}
+
+func (pt *peerTracker) clock() time.Time {
+	if pt.now == nil {
+		return time.Now()
+	}
+	return pt.now()
+}
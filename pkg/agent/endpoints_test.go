@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFailoverEndpoints(t *testing.T) {
+	const (
+		lan    = "192.168.1.10:51820"
+		public = "203.0.113.1:51820"
+	)
+	type step struct {
+		advance time.Duration
+		tx      int64
+		// handshakeAgo, if non-zero, reports a handshake this long before the step.
+		handshakeAgo time.Duration
+		expect       string
+	}
+	tcs := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "idle peer stays on preferred",
+			steps: []step{
+				{expect: lan},
+				{advance: time.Minute, expect: lan},
+				{advance: time.Minute, expect: lan},
+			},
+		},
+		{
+			name: "handshake keeps preferred",
+			steps: []step{
+				{expect: lan},
+				{advance: 10 * time.Second, tx: 100, handshakeAgo: time.Second, expect: lan},
+				{advance: time.Minute, tx: 200, handshakeAgo: 30 * time.Second, expect: lan},
+			},
+		},
+		{
+			name: "sending without handshake fails over",
+			steps: []step{
+				{expect: lan},
+				{advance: 5 * time.Second, tx: 148, expect: lan},
+				{advance: 10 * time.Second, tx: 296, expect: lan},
+				{advance: 20 * time.Second, tx: 444, expect: public},
+			},
+		},
+		{
+			name: "wraps around to preferred",
+			steps: []step{
+				{expect: lan},
+				{advance: 5 * time.Second, tx: 148, expect: lan},
+				{advance: 5 * time.Second, tx: 296, expect: lan},
+				{advance: 20 * time.Second, tx: 444, expect: public},
+				{advance: 5 * time.Second, tx: 592, expect: public},
+				{advance: 20 * time.Second, tx: 740, expect: lan},
+			},
+		},
+		{
+			name: "handshake before failover doesn't confirm new endpoint",
+			steps: []step{
+				{handshakeAgo: time.Second, expect: lan},
+				{advance: 5 * time.Second, tx: 148, handshakeAgo: 6 * time.Second, expect: lan},
+				{advance: 5 * time.Second, tx: 296, handshakeAgo: 11 * time.Second, expect: lan},
+				{advance: 20 * time.Second, tx: 444, handshakeAgo: 31 * time.Second, expect: public},
+			},
+		},
+		{
+			name: "stale handshake fails over",
+			steps: []step{
+				{expect: lan},
+				{advance: 5 * time.Second, tx: 148, handshakeAgo: time.Second, expect: lan},
+				{advance: 4 * time.Minute, tx: 296, handshakeAgo: 4 * time.Minute, expect: lan},
+				{advance: 20 * time.Second, tx: 444, handshakeAgo: 4*time.Minute + 20*time.Second, expect: public},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := wgtypes.GeneratePrivateKey()
+			require.NoError(t, err)
+			wgPeer := &wgk8s.WireGuardPeer{
+				ObjectMeta: metav1.ObjectMeta{Name: "peer", Namespace: "ns", SelfLink: "/peer"},
+				Spec: wgk8s.WireGuardPeerSpec{
+					PublicKey: key.PublicKey().String(),
+					Endpoint:  public,
+					Endpoints: []string{lan},
+				},
+			}
+			now := time.Unix(1000000, 0)
+			pt := &peerTracker{
+				ll:       logrus.New(),
+				registry: testRegistry(wgPeer),
+				now:      func() time.Time { return now },
+			}
+			current := pt.selectEndpoint(wgPeer)
+			for i, s := range tc.steps {
+				now = now.Add(s.advance)
+				devPeer := wgtypes.Peer{PublicKey: key.PublicKey(), TransmitBytes: s.tx}
+				if s.handshakeAgo > 0 {
+					devPeer.LastHandshakeTime = now.Add(-s.handshakeAgo)
+				}
+				configs := pt.failoverEndpoints([]wgtypes.Peer{devPeer})
+				if len(configs) > 0 {
+					require.Len(t, configs, 1)
+					require.True(t, configs[0].UpdateOnly)
+					current = configs[0].Endpoint.String()
+				}
+				require.Equal(t, s.expect, current, "step %d", i)
+				require.Equal(t, current, pt.selectEndpoint(wgPeer), "step %d", i)
+			}
+		})
+	}
+}
+
+func TestFailoverEndpointsSingleCandidate(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	wgPeer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "peer", Namespace: "ns", SelfLink: "/peer"},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: key.PublicKey().String(), Endpoint: "localhost:51820"},
+	}
+	now := time.Unix(1000000, 0)
+	pt := &peerTracker{
+		ll:               logrus.New(),
+		registry:         testRegistry(wgPeer),
+		now:              func() time.Time { return now },
+		metrics:          newMetrics(),
+		handshakeTimeout: 30 * time.Second,
+	}
+	var configs []wgtypes.PeerConfig
+	for _, tx := range []int64{0, 148, 296, 444, 592} {
+		configs = pt.failoverEndpoints([]wgtypes.Peer{{PublicKey: key.PublicKey(), TransmitBytes: tx}})
+		now = now.Add(10 * time.Second)
+	}
+	// The lone candidate is resolved again once the timeout passes.
+	require.Len(t, configs, 1)
+	require.Equal(t, 51820, configs[0].Endpoint.Port)
+	require.True(t, configs[0].Endpoint.IP.IsLoopback())
+	require.Equal(t, 1.0, testutil.ToFloat64(pt.metrics.endpointRefreshes.WithLabelValues("peer")))
+}
+
+func TestEndpointCandidatesObserved(t *testing.T) {
+	const (
+		lan      = "192.168.1.10:51820"
+		public   = "203.0.113.1:51820"
+		observed = "198.51.100.7:40123"
+	)
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	target := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "target", Namespace: "ns", SelfLink: "/target"},
+		Spec: wgk8s.WireGuardPeerSpec{
+			PublicKey: key.PublicKey().String(),
+			Endpoint:  public,
+			Endpoints: []string{lan},
+		},
+	}
+	observer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "observer", Namespace: "ns", SelfLink: "/observer"},
+		Status: wgk8s.WireGuardPeerStatus{
+			ObservedEndpoints: []wgk8s.ObservedEndpoint{
+				{PublicKey: key.PublicKey().String(), Endpoint: observed},
+				{PublicKey: key.PublicKey().String(), Endpoint: public},
+			},
+		},
+	}
+	pt := &peerTracker{
+		ll:       logrus.New(),
+		registry: testRegistry(target, observer),
+	}
+	require.Equal(t, []string{lan, public}, pt.endpointCandidates(target))
+
+	pt.natTraversal = true
+	require.Equal(t, []string{lan, public, observed}, pt.endpointCandidates(target))
+
+	// The current candidate is kept when observations change.
+	st := pt.endpointState(target)
+	st.index = 2
+	observer.Status.ObservedEndpoints = append([]wgk8s.ObservedEndpoint{
+		{PublicKey: key.PublicKey().String(), Endpoint: "198.51.100.1:1234"},
+	}, observer.Status.ObservedEndpoints...)
+	require.Equal(t, observed, pt.selectEndpoint(target))
+
+	// Once it's gone, we start over with the most preferred.
+	observer.Status.ObservedEndpoints = nil
+	require.Equal(t, lan, pt.selectEndpoint(target))
+}
+
+func TestFailoverEndpointAddresses(t *testing.T) {
+	defer func(orig func(string) ([]net.IP, error)) { lookupIP = orig }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		require.Equal(t, "peer.example.com", host)
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+	const (
+		v4 = "192.0.2.1:51820"
+		v6 = "[2001:db8::1]:51820"
+	)
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	wgPeer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "peer", Namespace: "ns", SelfLink: "/peer"},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: key.PublicKey().String(), Endpoint: "peer.example.com:51820"},
+	}
+	now := time.Unix(1000000, 0)
+	pt := &peerTracker{
+		ll:       logrus.New(),
+		registry: testRegistry(wgPeer),
+		now:      func() time.Time { return now },
+		families: endpointFamilies{preferIPv6: true},
+	}
+	addr, err := pt.selectAddr(wgPeer)
+	require.NoError(t, err)
+	require.Equal(t, v6, addr.String())
+
+	// handshakeAgo, if non-zero, reports a handshake this long before the check.
+	check := func(advance, handshakeAgo time.Duration, tx int64, expect string, msg string) {
+		now = now.Add(advance)
+		devPeer := wgtypes.Peer{PublicKey: key.PublicKey(), TransmitBytes: tx}
+		if handshakeAgo > 0 {
+			devPeer.LastHandshakeTime = now.Add(-handshakeAgo)
+		}
+		configs := pt.failoverEndpoints([]wgtypes.Peer{devPeer})
+		if len(configs) > 0 {
+			require.Len(t, configs, 1)
+			addr = configs[0].Endpoint
+		}
+		require.Equal(t, expect, addr.String(), msg)
+		current, err := pt.selectAddr(wgPeer)
+		require.NoError(t, err)
+		require.Equal(t, addr, current, msg)
+	}
+	check(0, 0, 0, v6, "preferred family first")
+	check(5*time.Second, 0, 148, v6, "sending")
+	check(25*time.Second, 0, 296, v4, "the name's next address is tried")
+	check(5*time.Second, time.Second, 444, v4, "handshake confirms the fallback")
+	check(endpointRevisitInterval, time.Minute, 592, v4, "the session isn't due for a rekey")
+	check(time.Minute, 2*time.Minute, 740, v6, "the preferred address is revisited")
+	check(5*time.Second, 0, 888, v6, "sending")
+	check(25*time.Second, 0, 1036, v4, "it's still unreachable")
+	require.Equal(t, 1, pt.endpoints[wgPeer.GetSelfLink()].addrIndex)
+}
@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// eventBufferSize is how many events a subscriber may fall behind before missing them.
+const eventBufferSize = 64
+
+// Event describes a change the agent applied to the local interface, a peer becoming stale or
+// recovering, a peer being damped or undamped, or a peer being quarantined or released, as streamed
+// by the control socket.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Type is "added", "updated", "removed", "stale", "recovered", "damped", "undamped",
+	// "quarantined", or "released".
+	Type      string `json:"type"`
+	Peer      string `json:"peer"`
+	PublicKey string `json:"publicKey"`
+	// Changes describe the peer's config, or for updates, what changed, ex.
+	// "endpoint: 192.0.2.1:51820 -> 192.0.2.2:51820".
+	Changes []string `json:"changes,omitempty"`
+}
+
+// eventBroadcaster fans events out to the control socket's subscribers. A subscriber which falls
+// behind misses events, rather than blocking the agent.
+type eventBroadcaster struct {
+	sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func (b *eventBroadcaster) publish(e Event) {
+	b.Lock()
+	defer b.Unlock()
+	for c := range b.subscribers {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving events until the returned func is called.
+func (b *eventBroadcaster) subscribe() (<-chan Event, func()) {
+	c := make(chan Event, eventBufferSize)
+	b.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]struct{})
+	}
+	b.subscribers[c] = struct{}{}
+	b.Unlock()
+	return c, func() {
+		b.Lock()
+		delete(b.subscribers, c)
+		b.Unlock()
+	}
+}
+
+// appliedEvents describes the difference between the applied and desired peer configs, keyed by
+// peer name.
+func appliedEvents(applied, desired map[string]wgtypes.PeerConfig, now time.Time) []Event {
+	var out []Event
+	for name, prev := range applied {
+		if cur, ok := desired[name]; !ok || cur.PublicKey != prev.PublicKey {
+			out = append(out, Event{Time: now, Type: "removed", Peer: name, PublicKey: prev.PublicKey.String()})
+		}
+	}
+	for name, cur := range desired {
+		prev, ok := applied[name]
+		e := Event{Time: now, Peer: name, PublicKey: cur.PublicKey.String()}
+		switch {
+		case !ok || prev.PublicKey != cur.PublicKey:
+			e.Type = "added"
+			e.Changes = append(e.Changes, "endpoint: "+orNone(udpAddrString(cur.Endpoint)))
+			e.Changes = append(e.Changes, fmt.Sprintf("allowed IPs: %v", ipNetStrings(cur.AllowedIPs)))
+			if k := keepaliveString(cur.PersistentKeepaliveInterval); k != "" {
+				e.Changes = append(e.Changes, "keepalive: "+k)
+			}
+		case !peerConfigEqual(prev, cur):
+			e.Type = "updated"
+			if a, b := udpAddrString(prev.Endpoint), udpAddrString(cur.Endpoint); a != b {
+				e.Changes = append(e.Changes, fmt.Sprintf("endpoint: %s -> %s", orNone(a), orNone(b)))
+			}
+			if a, b := ipNetStrings(prev.AllowedIPs), ipNetStrings(cur.AllowedIPs); !reflect.DeepEqual(a, b) {
+				e.Changes = append(e.Changes, fmt.Sprintf("allowed IPs: %v -> %v", a, b))
+			}
+			a, b := keepaliveString(prev.PersistentKeepaliveInterval), keepaliveString(cur.PersistentKeepaliveInterval)
+			if a != b {
+				e.Changes = append(e.Changes, fmt.Sprintf("keepalive: %s -> %s", orNone(a), orNone(b)))
+			}
+		default:
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func keepaliveString(k *time.Duration) string {
+	if k == nil || *k == 0 {
+		return ""
+	}
+	return k.String()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
+
+// handleEvents streams events as JSON lines until the client disconnects or the agent stops.
+func (a *Agent) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := a.events.subscribe()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
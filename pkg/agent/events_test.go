@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestAppliedEvents(t *testing.T) {
+	keyA, err := wgtypes.GenerateKey()
+	require.NoError(t, err)
+	keyB, err := wgtypes.GenerateKey()
+	require.NoError(t, err)
+	_, netA, _ := net.ParseCIDR("10.0.0.1/32")
+	_, netB, _ := net.ParseCIDR("10.0.0.2/32")
+	keepalive := 25 * time.Second
+	now := time.Now()
+
+	applied := map[string]wgtypes.PeerConfig{
+		"a": {PublicKey: keyA, Endpoint: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}, AllowedIPs: []net.IPNet{*netA}},
+		"b": {PublicKey: keyB, AllowedIPs: []net.IPNet{*netB}},
+	}
+	desired := map[string]wgtypes.PeerConfig{
+		"a": {
+			PublicKey:                   keyA,
+			Endpoint:                    &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 51820},
+			AllowedIPs:                  []net.IPNet{*netA},
+			PersistentKeepaliveInterval: &keepalive,
+		},
+		"c": {PublicKey: keyB, AllowedIPs: []net.IPNet{*netB}},
+	}
+	events := appliedEvents(applied, desired, now)
+	require.ElementsMatch(t, []Event{
+		{Time: now, Type: "removed", Peer: "b", PublicKey: keyB.String()},
+		{Time: now, Type: "updated", Peer: "a", PublicKey: keyA.String(), Changes: []string{
+			"endpoint: 192.0.2.1:51820 -> 192.0.2.2:51820",
+			"keepalive: <none> -> 25s",
+		}},
+		{Time: now, Type: "added", Peer: "c", PublicKey: keyB.String(), Changes: []string{
+			"endpoint: <none>",
+			"allowed IPs: [10.0.0.2/32]",
+		}},
+	}, events)
+
+	require.Empty(t, appliedEvents(desired, desired, now))
+}
+
+func TestEventBroadcaster(t *testing.T) {
+	var b eventBroadcaster
+	b.publish(Event{Peer: "nobody listening"})
+	events, unsubscribe := b.subscribe()
+	b.publish(Event{Peer: "a"})
+	require.Equal(t, "a", (<-events).Peer)
+
+	// A subscriber which falls behind misses events.
+	for i := 0; i < eventBufferSize+1; i++ {
+		b.publish(Event{Peer: "a"})
+	}
+	require.Len(t, events, eventBufferSize)
+
+	unsubscribe()
+	require.Empty(t, b.subscribers)
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"net"
+	"sort"
+)
+
+// Endpoint families for WithEndpointFamily.
+const (
+	// EndpointFamilyAuto prefers IPv6 if the host has a global IPv6 address, and IPv4 otherwise.
+	EndpointFamilyAuto = "auto"
+	EndpointFamilyIPv4 = "v4"
+	EndpointFamilyIPv6 = "v6"
+)
+
+// endpointFamilies chooses between the IPv4 and IPv6 addresses of peers' endpoints. The zero value
+// prefers IPv4.
+type endpointFamilies struct {
+	// preferIPv6 resolves names to their IPv6 addresses, if they have any, rather than IPv4.
+	preferIPv6 bool
+	// noIPv6 is true if the host has no global IPv6 address, so IPv6 candidates are tried last.
+	noIPv6 bool
+}
+
+// newEndpointFamilies returns the families for the preference, one of the EndpointFamily values.
+func newEndpointFamilies(family string) endpointFamilies {
+	hasIPv6 := hostHasIPv6()
+	f := endpointFamilies{noIPv6: !hasIPv6}
+	switch family {
+	case EndpointFamilyIPv4:
+	case EndpointFamilyIPv6:
+		f.preferIPv6 = true
+	default:
+		f.preferIPv6 = hasIPv6
+	}
+	return f
+}
+
+// lookupIP looks up a name's addresses; tests replace it.
+var lookupIP = net.LookupIP
+
+// resolve resolves the endpoint's host, if it's a name, to an address of the preferred family, or
+// of the other family if it has none.
+func (f endpointFamilies) resolve(endpoint string) (*net.UDPAddr, error) {
+	addrs, err := f.resolveAll(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+// resolveAll resolves the endpoint's host, if it's a name, to all of its addresses in the order
+// they should be tried. Like Happy Eyeballs (RFC 8305), the families alternate, starting with the
+// preferred one, so a family which is unreachable only costs every other attempt. A host without
+// IPv6 tries the IPv6 addresses last.
+func (f endpointFamilies) resolveAll(endpoint string) ([]*net.UDPAddr, error) {
+	host, portName, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		addr, err := net.ResolveUDPAddr("udp", endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPAddr{addr}, nil
+	}
+	port, err := net.LookupPort("udp", portName)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []*net.UDPAddr
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, &net.UDPAddr{IP: ip, Port: port})
+		} else {
+			v6 = append(v6, &net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+	if len(v4)+len(v6) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	if f.noIPv6 {
+		return append(v4, v6...), nil
+	}
+	preferred, other := v4, v6
+	if f.preferIPv6 {
+		preferred, other = v6, v4
+	}
+	out := make([]*net.UDPAddr, 0, len(preferred)+len(other))
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			out = append(out, preferred[i])
+		}
+		if i < len(other) {
+			out = append(out, other[i])
+		}
+	}
+	return out, nil
+}
+
+// order moves IPv6 address candidates after the others if the host has no IPv6 address to reach
+// them from, otherwise keeping the peer's order.
+func (f endpointFamilies) order(candidates []string) []string {
+	if !f.noIPv6 {
+		return candidates
+	}
+	out := append([]string(nil), candidates...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return !isIPv6Endpoint(out[i]) && isIPv6Endpoint(out[j])
+	})
+	return out
+}
+
+// isIPv6Endpoint returns true if the endpoint's host is an IPv6 address.
+func isIPv6Endpoint(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// hostHasIPv6 returns true if one of the host's interfaces has a global IPv6 address. Link-local
+// and unique local addresses, ex. a mesh's own, don't reach other sites.
+func hostHasIPv6() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	_, ula, _ := net.ParseCIDR("fc00::/7")
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok || n.IP.To4() != nil {
+			continue
+		}
+		if n.IP.IsGlobalUnicast() && !ula.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointFamilies(t *testing.T) {
+	f := endpointFamilies{preferIPv6: true}
+	addr, err := f.resolve("[2001:db8::1]:51820")
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:51820", addr.String())
+	addr, err = f.resolve("192.0.2.1:51820")
+	require.NoError(t, err, "addresses are used whatever the preference")
+	require.Equal(t, "192.0.2.1:51820", addr.String())
+	_, err = f.resolve("2001:db8::1")
+	require.Error(t, err, "missing port")
+
+	candidates := []string{"[2001:db8::1]:51820", "lan.example.com:51820", "192.0.2.1:51820"}
+	require.Equal(t, candidates, f.order(candidates))
+	f.noIPv6 = true
+	require.Equal(t, []string{"lan.example.com:51820", "192.0.2.1:51820", "[2001:db8::1]:51820"}, f.order(candidates),
+		"without IPv6, IPv6 addresses are tried last")
+}
+
+func TestEndpointFamiliesResolveAll(t *testing.T) {
+	defer func(orig func(string) ([]net.IP, error)) { lookupIP = orig }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{
+			net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3"),
+			net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"),
+		}, nil
+	}
+	resolve := func(f endpointFamilies) []string {
+		addrs, err := f.resolveAll("peer.example.com:51820")
+		require.NoError(t, err)
+		var out []string
+		for _, a := range addrs {
+			out = append(out, a.String())
+		}
+		return out
+	}
+	require.Equal(t, []string{
+		"[2001:db8::1]:51820", "192.0.2.1:51820", "[2001:db8::2]:51820", "192.0.2.2:51820", "192.0.2.3:51820",
+	}, resolve(endpointFamilies{preferIPv6: true}), "families alternate")
+	require.Equal(t, []string{
+		"192.0.2.1:51820", "[2001:db8::1]:51820", "192.0.2.2:51820", "[2001:db8::2]:51820", "192.0.2.3:51820",
+	}, resolve(endpointFamilies{}))
+	require.Equal(t, []string{
+		"192.0.2.1:51820", "192.0.2.2:51820", "192.0.2.3:51820", "[2001:db8::1]:51820", "[2001:db8::2]:51820",
+	}, resolve(endpointFamilies{preferIPv6: true, noIPv6: true}), "without IPv6, IPv6 addresses are tried last")
+
+	addr, err := endpointFamilies{}.resolve("peer.example.com:51820")
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:51820", addr.String())
+}
@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// reasonPeerFlapping is the event reason recorded on peers as they're damped.
+const reasonPeerFlapping = "PeerFlapping"
+
+// flapDamper limits how often the changes of a churning peer, ex. one managed by bad automation or a
+// crash-looping agent, are applied to the device. A peer whose spec changes more than limit times
+// within window is damped: only its latest change is applied, at most once per window, until it
+// goes a whole window without changing.
+type flapDamper struct {
+	limit  int
+	window time.Duration
+	// peers tracks the recent changes of each peer, keyed by self link.
+	peers map[string]*flapState
+}
+
+type flapState struct {
+	// changes are the times of the peer's spec changes within the window.
+	changes []time.Time
+	damped  bool
+	// applied is when the peer's latest update was applied.
+	applied time.Time
+	// held is the version applied before the updates held while the peer is damped, if any. It's
+	// configured in place of the registry's latest.
+	held *wgk8s.WireGuardPeer
+}
+
+func newFlapDamper(limit int, window time.Duration) *flapDamper {
+	return &flapDamper{
+		limit:  limit,
+		window: window,
+		peers:  make(map[string]*flapState),
+	}
+}
+
+// prune drops the changes which have fallen out of the window.
+func (st *flapState) prune(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(st.changes) && now.Sub(st.changes[i]) >= window {
+		i++
+	}
+	st.changes = st.changes[i:]
+}
+
+// dampen records the update from old, and returns true if it's held because the peer is damped. The
+// caller must hold the lock.
+func (pt *peerTracker) dampen(name string, old, wgPeer *wgk8s.WireGuardPeer) bool {
+	if pt.flaps == nil {
+		return false
+	}
+	now := pt.clock()
+	st, ok := pt.flaps.peers[name]
+	if !ok {
+		st = &flapState{}
+		pt.flaps.peers[name] = st
+	}
+	if st.held != nil && reflect.DeepEqual(st.held.Spec, wgPeer.Spec) {
+		// Reverting to the applied spec supersedes the held updates.
+		st.held = nil
+		return false
+	}
+	if old == nil || !reflect.DeepEqual(old.Spec, wgPeer.Spec) {
+		st.changes = append(st.changes, now)
+	}
+	st.prune(now, pt.flaps.window)
+	if !st.damped && len(st.changes) > pt.flaps.limit {
+		st.damped = true
+		pt.peerDamped(wgPeer, true, len(st.changes))
+	}
+	// Peers added again after they're deleted have nothing to hold.
+	if st.damped && now.Sub(st.applied) < pt.flaps.window && old != nil {
+		if st.held == nil {
+			st.held = old
+		}
+		return true
+	}
+	st.applied = now
+	st.held = nil
+	return false
+}
+
+// heldPeer returns the version configured in place of the registry's while the peer's updates are
+// held, or nil. The caller must hold the lock.
+func (pt *peerTracker) heldPeer(name string) *wgk8s.WireGuardPeer {
+	if pt.flaps == nil {
+		return nil
+	}
+	if st, ok := pt.flaps.peers[name]; ok {
+		return st.held
+	}
+	return nil
+}
+
+// discardDamped drops the updates held for the peer, if any, ex. as it's deleted. The caller must
+// hold the lock.
+func (pt *peerTracker) discardDamped(name string) {
+	if pt.flaps == nil {
+		return
+	}
+	if st, ok := pt.flaps.peers[name]; ok {
+		st.held = nil
+	}
+}
+
+// releaseDamped applies the registry's latest version of damped peers once a window has passed since
+// their last applied update, and undamps peers which have settled.
+func (pt *peerTracker) releaseDamped() error {
+	pt.Lock()
+	defer pt.Unlock()
+	now := pt.clock()
+	var changed bool
+	for name, st := range pt.flaps.peers {
+		st.prune(now, pt.flaps.window)
+		if st.held != nil && now.Sub(st.applied) >= pt.flaps.window {
+			held := st.held
+			st.held = nil
+			st.applied = now
+			if wgPeer := pt.registryPeer(name); wgPeer != nil && pt.admit(name, held, wgPeer) {
+				changed = true
+			}
+		}
+		if len(st.changes) > 0 || st.held != nil {
+			continue
+		}
+		// Peers deleted since they were damped are forgotten quietly.
+		if wgPeer := pt.current(name); st.damped && wgPeer != nil {
+			pt.peerDamped(wgPeer, false, 0)
+		}
+		delete(pt.flaps.peers, name)
+	}
+	if !changed || !pt.initialConfigApplied {
+		return nil
+	}
+	return pt.sync()
+}
+
+// peerDamped records that the peer was damped, after the number of changes within the window, or
+// undamped, in the logs, metrics, and events. The caller must hold the lock.
+func (pt *peerTracker) peerDamped(wgPeer *wgk8s.WireGuardPeer, damped bool, changes int) {
+	ll := wglog.WithPeer(pt.ll, wgPeer)
+	pt.metrics.setDamped(wgPeer.GetName(), damped)
+	e := Event{Time: pt.clock(), Type: "undamped", Peer: wgPeer.GetName(), PublicKey: wgPeer.Spec.PublicKey}
+	if damped {
+		msg := fmt.Sprintf("WireGuardPeer changed %d times within %s, applying its changes at most once per %s",
+			changes, pt.flaps.window, pt.flaps.window)
+		ll.Warn(msg)
+		if pt.onDamped != nil {
+			pt.onDamped(wgPeer, msg)
+		}
+		e.Type = "damped"
+		e.Changes = append(e.Changes, fmt.Sprintf("changes: %d within %s", changes, pt.flaps.window))
+	} else {
+		ll.Info("WireGuardPeer has settled, applying its changes as they're made")
+	}
+	if pt.events != nil {
+		pt.events.publish(e)
+	}
+}
+
+// runFlapDamping releases damped peers' held updates until the context is canceled.
+func (a *Agent) runFlapDamping(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		// Held updates wait at most a quarter window longer than they must.
+		wait.Until(func() {
+			if err := a.peerTracker.releaseDamped(); err != nil {
+				a.ll.WithError(err).Error("failed to apply damped peer updates")
+			}
+		}, a.flapDampingWindow/4, ctx.Done())
+	}()
+}
+
+// recordDamping records an event on a peer as it's damped, if events are recorded. Events are only
+// recorded in the registry namespace.
+func (a *Agent) recordDamping(wgPeer *wgk8s.WireGuardPeer, msg string) {
+	if a.recorder != nil && wgPeer.GetNamespace() == a.registryNamespace {
+		a.recorder.Event(wgPeer, corev1.EventTypeWarning, reasonPeerFlapping, msg)
+	}
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+func TestFlapDamping(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var damped []string
+	pt := &peerTracker{
+		ll:        logrus.New(),
+		registry:  newPeerStore(),
+		localPeer: testPeer("local", nil),
+		now:       func() time.Time { return now },
+		flaps:     newFlapDamper(2, time.Minute),
+		onDamped: func(wgPeer *wgk8s.WireGuardPeer, msg string) {
+			damped = append(damped, wgPeer.GetName()+": "+msg)
+		},
+	}
+	version := func(ip string) *wgk8s.WireGuardPeer {
+		return testPeer("churn", nil, ip)
+	}
+	ips := func() []string {
+		return pt.listPeers()["/churn"].Spec.IPs
+	}
+
+	require.NoError(t, pt.storePeer(version("10.0.0.1/32")))
+	now = now.Add(time.Second)
+	require.NoError(t, pt.storePeer(version("10.0.0.2/32")))
+	require.Empty(t, damped)
+
+	now = now.Add(time.Second)
+	require.NoError(t, pt.storePeer(version("10.0.0.3/32")))
+	require.Equal(t, []string{"churn: WireGuardPeer changed 3 times within 1m0s, applying its changes at most once per 1m0s"}, damped)
+	require.Equal(t, []string{"10.0.0.2/32"}, ips(), "the change is held")
+	now = now.Add(time.Second)
+	require.NoError(t, pt.storePeer(version("10.0.0.4/32")))
+	require.Equal(t, []string{"10.0.0.2/32"}, ips())
+	require.Len(t, damped, 1, "damping is only reported once")
+
+	now = now.Add(30 * time.Second)
+	require.NoError(t, pt.storePeer(version("10.0.0.5/32")))
+	require.NoError(t, pt.releaseDamped())
+	require.Equal(t, []string{"10.0.0.2/32"}, ips(), "held until a window has passed since the last applied change")
+
+	now = now.Add(30 * time.Second)
+	require.NoError(t, pt.releaseDamped())
+	require.Equal(t, []string{"10.0.0.5/32"}, ips(), "the latest change is applied")
+	require.True(t, pt.flaps.peers["/churn"].damped, "changes within the window keep the peer damped")
+
+	now = now.Add(time.Second)
+	require.NoError(t, pt.storePeer(version("10.0.0.6/32")))
+	require.Equal(t, []string{"10.0.0.5/32"}, ips())
+	require.NoError(t, pt.storePeer(version("10.0.0.5/32")))
+	now = now.Add(time.Minute)
+	require.NoError(t, pt.releaseDamped())
+	require.Equal(t, []string{"10.0.0.5/32"}, ips(), "reverting to the applied spec discards the held change")
+	require.Empty(t, pt.flaps.peers, "the peer settled")
+
+	require.NoError(t, pt.storePeer(version("10.0.0.7/32")))
+	require.Equal(t, []string{"10.0.0.7/32"}, ips(), "settled peers' changes are applied right away")
+	require.Len(t, damped, 1)
+}
+
+func TestFlapDampingDelete(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	pt := &peerTracker{
+		ll:        logrus.New(),
+		registry:  newPeerStore(),
+		localPeer: testPeer("local", nil),
+		now:       func() time.Time { return now },
+		flaps:     newFlapDamper(1, time.Minute),
+		events:    &eventBroadcaster{},
+	}
+	events, unsubscribe := pt.events.subscribe()
+	defer unsubscribe()
+
+	require.NoError(t, pt.storePeer(testPeer("churn", nil, "10.0.0.1/32")))
+	require.NoError(t, pt.storePeer(testPeer("churn", nil, "10.0.0.2/32")))
+	require.Equal(t, "damped", (<-events).Type)
+	require.NoError(t, testDeletePeer(pt, testPeer("churn", nil)))
+	require.Empty(t, pt.listPeers(), "deletes aren't damped")
+
+	now = now.Add(time.Minute)
+	require.NoError(t, pt.releaseDamped())
+	require.Empty(t, pt.listPeers(), "the held change doesn't restore the deleted peer")
+	require.Empty(t, pt.flaps.peers)
+	require.Empty(t, events, "deleted peers are forgotten quietly")
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+// peerHealthInterval is how often we publish our view of peers' health.
+const peerHealthInterval = 30 * time.Second
+
+// publishPeerHealth periodically publishes the health of our connection to each peer to our
+// WireGuardPeer's status, until the context is canceled. The record is only written when the health
+// changes.
+func (a *Agent) publishPeerHealth(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := a.publishPeerHealthOnce()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to publish peer health")
+			}
+		}, peerHealthInterval, ctx.Done())
+	}()
+}
+
+func (a *Agent) publishPeerHealthOnce() error {
+	devPeers, err := a.iface.GetPeers()
+	if err != nil {
+		return fmt.Errorf("reading WireGuard peers: %w", err)
+	}
+	health := a.peerTracker.peerHealth(devPeers)
+
+	a.publishLock.Lock()
+	defer a.publishLock.Unlock()
+	if reflect.DeepEqual(health, a.localPeer.Status.PeerHealth) {
+		return nil
+	}
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := a.registry.Get(a.name)
+		if err != nil {
+			return err
+		}
+		latest.Status.PeerHealth = health
+		updated, err := a.registry.Update(latest)
+		if err != nil {
+			return err
+		}
+		a.localPeer = updated
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if a.peerGuard != nil {
+		a.peerGuard.setDesired(a.localPeer)
+	}
+	return nil
+}
+
+// peerHealth returns the health of our connection to each peer configured on the device, and each
+// quarantined peer, sorted by name.
+func (pt *peerTracker) peerHealth(devPeers []wgtypes.Peer) []wgk8s.PeerHealth {
+	byKey := make(map[string]*wgtypes.Peer, len(devPeers))
+	for i := range devPeers {
+		byKey[devPeers[i].PublicKey.String()] = &devPeers[i]
+	}
+	pt.Lock()
+	defer pt.Unlock()
+	now := pt.clock()
+	var out []wgk8s.PeerHealth
+	for name := range pt.applied {
+		wgPeer, ok := pt.peer(name)
+		if !ok {
+			continue
+		}
+		dp, ok := byKey[wgPeer.Spec.PublicKey]
+		if !ok {
+			continue
+		}
+		h := wgk8s.PeerHealth{
+			Name:             wgPeer.GetName(),
+			Reachable:        now.Sub(dp.LastHandshakeTime) < staleHandshake,
+			QuarantinedSince: registryTime(pt.quarantineSince(name)),
+		}
+		if l, ok := pt.liveness[name]; ok {
+			h.Stale = !l.stale.IsZero()
+		}
+		if !dp.LastHandshakeTime.IsZero() {
+			h.LastHandshakeTime = registryTime(&dp.LastHandshakeTime)
+		}
+		out = append(out, h)
+	}
+	// Quarantined peers are listed too, though they're off the device.
+	for name, wgPeer := range pt.listPeers() {
+		if _, ok := pt.applied[name]; ok || !pt.quarantined(name) {
+			continue
+		}
+		out = append(out, wgk8s.PeerHealth{
+			Name:             wgPeer.GetName(),
+			QuarantinedSince: registryTime(pt.quarantineSince(name)),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// registryTime converts t, if set, to a metav1.Time with the second precision the registry stores,
+// so it compares equal once stored.
+func registryTime(t *time.Time) *metav1.Time {
+	if t == nil {
+		return nil
+	}
+	mt := metav1.NewTime(time.Unix(t.Unix(), 0))
+	return &mt
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPeerHealth(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	pt := &peerTracker{
+		registry: newPeerStore(),
+		applied:  make(map[string]wgtypes.PeerConfig),
+		liveness: make(map[string]*peerLiveness),
+		now:      func() time.Time { return now },
+	}
+	var devPeers []wgtypes.Peer
+	add := func(name string, applied bool, handshake time.Time) {
+		k, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		p := testPeer(name, nil)
+		p.Spec.PublicKey = k.PublicKey().String()
+		require.NoError(t, pt.registry.Add(p))
+		if applied {
+			pt.applied[p.GetSelfLink()] = wgtypes.PeerConfig{PublicKey: k.PublicKey()}
+		}
+		devPeers = append(devPeers, wgtypes.Peer{PublicKey: k.PublicKey(), LastHandshakeTime: handshake})
+	}
+	add("c-live", true, now.Add(-time.Minute+time.Millisecond))
+	add("a-expired", true, now.Add(-5*time.Minute))
+	add("b-never", true, time.Time{})
+	// Peers we reach through a hub aren't configured on the device.
+	add("d-via-hub", false, time.Time{})
+	pt.liveness["/b-never"] = &peerLiveness{stale: now.Add(-time.Minute)}
+
+	ts := func(d time.Duration) *metav1.Time {
+		t := metav1.NewTime(now.Add(d))
+		return &t
+	}
+	require.Equal(t, []wgk8s.PeerHealth{
+		{Name: "a-expired", LastHandshakeTime: ts(-5 * time.Minute)},
+		{Name: "b-never", Stale: true},
+		// Truncated to seconds, like the registry stores it.
+		{Name: "c-live", Reachable: true, LastHandshakeTime: ts(-time.Minute)},
+	}, pt.peerHealth(devPeers))
+	require.Nil(t, (&peerTracker{now: pt.now}).peerHealth(devPeers))
+}
@@ -0,0 +1,290 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+)
+
+// keyPinsSaveDelay is how long newly pinned keys wait to be saved, so the pins of a mesh seen at
+// startup are written once rather than once per peer.
+const keyPinsSaveDelay = time.Second
+
+// How a peer whose public key differs from its pinned key is handled.
+const (
+	// KeyPinningReject ignores the peer until the new key is approved.
+	KeyPinningReject = "reject"
+	// KeyPinningAlert logs and records an event, but configures the peer.
+	KeyPinningAlert = "alert"
+)
+
+// KeyPin is the public key trusted for a peer.
+type KeyPin struct {
+	Name      string    `json:"name"`
+	PublicKey string    `json:"publicKey"`
+	PinnedAt  time.Time `json:"pinnedAt"`
+	// Approved is a new public key approved by the operator. Either key is accepted until the peer
+	// is seen with the approved one, which then replaces the pinned key.
+	Approved string `json:"approved,omitempty"`
+}
+
+// keyPins is a trust-on-first-use store of peers' public keys, by peer name, qualified with the
+// namespace for peers of other namespaces, saved to a file. A peer's key is pinned the first time
+// it's seen; a peer seen with a different key is impersonating it, ex. through a compromised
+// registry, unless the key was approved. Pins outlive the peers' records, so a name deleted and
+// registered again with a new key is caught too.
+type keyPins struct {
+	sync.Mutex
+	ll        log.FieldLogger
+	path      string
+	alertOnly bool
+	pins      map[string]*KeyPin
+	// alerted holds the unapproved key last alerted on for each peer, so each change alerts once.
+	alerted map[string]string
+	now     func() time.Time
+	// dirty is set when the pins have changed since they were saved; saveTimer, if set, will save
+	// them.
+	dirty     bool
+	saveTimer *time.Timer
+	// saveLock serializes writes to the file, which are made without holding the lock.
+	saveLock sync.Mutex
+}
+
+// keyPinsFile is the format of the pinned keys file.
+type keyPinsFile struct {
+	// Pins are sorted by name.
+	Pins []*KeyPin `json:"pins"`
+}
+
+// loadKeyPins reads the pinned keys file at path, which needn't exist.
+func loadKeyPins(ll log.FieldLogger, path, mode string) (*keyPins, error) {
+	k := &keyPins{
+		ll:        ll,
+		path:      path,
+		alertOnly: mode == KeyPinningAlert,
+		pins:      make(map[string]*KeyPin),
+		alerted:   make(map[string]string),
+		now:       time.Now,
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading pinned keys: %w", err)
+	}
+	f := &keyPinsFile{}
+	if err = json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("parsing pinned keys %q: %w", path, err)
+	}
+	for _, p := range f.Pins {
+		k.pins[p.Name] = p
+	}
+	return k, nil
+}
+
+// changed schedules the pins to be saved. The caller must hold the lock.
+func (k *keyPins) changed() {
+	k.dirty = true
+	if k.saveTimer == nil {
+		k.saveTimer = time.AfterFunc(keyPinsSaveDelay, func() {
+			if err := k.flush(); err != nil {
+				// The pins hold in memory, and are saved again with the next change or on exit.
+				k.ll.WithError(err).Error("failed to save pinned keys")
+			}
+		})
+	}
+}
+
+// flush writes the pins to the file if they've changed since they were last saved. The caller must
+// not hold the lock.
+func (k *keyPins) flush() error {
+	k.saveLock.Lock()
+	defer k.saveLock.Unlock()
+	k.Lock()
+	if k.saveTimer != nil {
+		k.saveTimer.Stop()
+		k.saveTimer = nil
+	}
+	if !k.dirty {
+		k.Unlock()
+		return nil
+	}
+	k.dirty = false
+	pins := k.sorted()
+	k.Unlock()
+	b, err := json.MarshalIndent(&keyPinsFile{Pins: pins}, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(k.path, b)
+	}
+	if err != nil {
+		k.Lock()
+		k.dirty = true
+		k.Unlock()
+	}
+	return err
+}
+
+// sorted returns copies of the pins, sorted by name. The caller must hold the lock.
+func (k *keyPins) sorted() []*KeyPin {
+	pins := make([]*KeyPin, 0, len(k.pins))
+	for _, p := range k.pins {
+		c := *p
+		pins = append(pins, &c)
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Name < pins[j].Name })
+	return pins
+}
+
+func (k *keyPins) list() []*KeyPin {
+	k.Lock()
+	defer k.Unlock()
+	return k.sorted()
+}
+
+// check reports whether the peer's key is trusted, pinning it if the peer hasn't been seen, and
+// replacing the pinned key once the peer is seen with an approved one. If it isn't trusted, the
+// pinned key is returned.
+func (k *keyPins) check(name, key string) (pinned string, ok bool) {
+	k.Lock()
+	defer k.Unlock()
+	p := k.pins[name]
+	switch {
+	case p == nil:
+		k.pins[name] = &KeyPin{Name: name, PublicKey: key, PinnedAt: k.now()}
+		k.ll.WithField("k8s_name", name).WithField("public_key", key).Info("pinned peer's public key on first use")
+	case p.PublicKey == key:
+		delete(k.alerted, name)
+		return key, true
+	case p.Approved == key:
+		k.ll.WithField("k8s_name", name).WithField("public_key", key).Info("peer rotated to its approved public key")
+		p.PublicKey, p.Approved, p.PinnedAt = key, "", k.now()
+	default:
+		return p.PublicKey, false
+	}
+	delete(k.alerted, name)
+	k.changed()
+	return key, true
+}
+
+// alert reports whether a peer's unapproved key hasn't been alerted on yet, recording that it has.
+func (k *keyPins) alert(name, key string) bool {
+	k.Lock()
+	defer k.Unlock()
+	if k.alerted[name] == key {
+		return false
+	}
+	k.alerted[name] = key
+	return true
+}
+
+// approve approves a rotation of the peer's public key to key. A peer which hasn't been seen is
+// pinned to it.
+func (k *keyPins) approve(name, key string) error {
+	if _, err := wgtypes.ParseKey(key); err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	k.Lock()
+	p := k.pins[name]
+	switch {
+	case p == nil:
+		k.pins[name] = &KeyPin{Name: name, PublicKey: key, PinnedAt: k.now()}
+	case p.PublicKey == key:
+		p.Approved = ""
+	default:
+		p.Approved = key
+	}
+	k.dirty = true
+	k.Unlock()
+	k.ll.WithField("k8s_name", name).WithField("public_key", key).Info("approved peer's public key")
+	// Approvals are saved immediately, so the operator learns if they weren't.
+	if err := k.flush(); err != nil {
+		return fmt.Errorf("saving pinned keys: %w", err)
+	}
+	return nil
+}
+
+// pinnedKeyRejection checks the peer's public key against its pin, pinning it on first use. With
+// KeyPinningAlert, a changed key is reported once, then admitted. The caller must hold the lock.
+func (pt *peerTracker) pinnedKeyRejection(wgPeer *wgk8s.WireGuardPeer) (reason, msg string) {
+	if pt.keyPins == nil {
+		return "", ""
+	}
+	name := pt.qualifiedName(wgPeer)
+	pinned, ok := pt.keyPins.check(name, wgPeer.Spec.PublicKey)
+	if ok {
+		return "", ""
+	}
+	msg = fmt.Sprintf("WireGuardPeer's public key differs from its pinned key %s, without an approved rotation", pinned)
+	if !pt.keyPins.alertOnly {
+		return reasonKeyChanged, msg
+	}
+	if pt.keyPins.alert(name, wgPeer.Spec.PublicKey) {
+		wglog.WithPeer(pt.ll, wgPeer).Warn(msg + ", adding peer anyway")
+		if pt.onReject != nil {
+			pt.onReject(wgPeer, reasonKeyChanged, msg)
+		}
+	}
+	return "", ""
+}
+
+// approveKey approves a rotation of the named peer's public key, restoring the peer if it was
+// rejected for using the key.
+func (pt *peerTracker) approveKey(name, key string) error {
+	pt.Lock()
+	defer pt.Unlock()
+	if err := pt.keyPins.approve(name, key); err != nil {
+		return err
+	}
+	return pt.applyPolicy()
+}
+
+func (a *Agent) handlePins(w http.ResponseWriter, r *http.Request) {
+	if a.keyPins == nil {
+		http.Error(w, "key pinning isn't enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.keyPins.list())
+}
+
+func (a *Agent) handleApprovePin(w http.ResponseWriter, r *http.Request) {
+	if a.keyPins == nil {
+		http.Error(w, "key pinning isn't enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, key := r.URL.Query().Get("name"), r.URL.Query().Get("publicKey")
+	if name == "" || key == "" {
+		http.Error(w, "name and publicKey are required", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if a.peerTracker != nil {
+		err = a.peerTracker.approveKey(name, key)
+	} else {
+		err = a.keyPins.approve(name, key)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+func testPublicKey(t *testing.T) string {
+	k, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return k.PublicKey().String()
+}
+
+func TestPeerTrackerKeyPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pins")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pins.json")
+	original, impostor, rotated := testPublicKey(t), testPublicKey(t), testPublicKey(t)
+
+	pins, err := loadKeyPins(logrus.New(), path, KeyPinningReject)
+	require.NoError(t, err)
+	var rejected []string
+	pt := &peerTracker{
+		ll:       logrus.New(),
+		registry: newPeerStore(),
+		keyPins:  pins,
+		onReject: func(wgPeer *wgk8s.WireGuardPeer, reason, msg string) {
+			rejected = append(rejected, wgPeer.GetName()+": "+reason)
+		},
+	}
+	a := testPeer("a", nil, "10.10.0.1/32")
+	a.Spec.PublicKey = original
+	require.NoError(t, pt.storePeer(a))
+	require.Equal(t, []string{"/a"}, peerNames(pt.listPeers()), "the key is pinned on first use")
+
+	changed := a.DeepCopy()
+	changed.Spec.PublicKey = impostor
+	require.NoError(t, pt.storePeer(changed))
+	require.Empty(t, pt.listPeers(), "a changed key is rejected")
+	require.Equal(t, []string{"a: PublicKeyChanged"}, rejected)
+
+	// Deleting and registering the peer again doesn't reset its pin.
+	require.NoError(t, testDeletePeer(pt, changed))
+	require.NoError(t, pt.storePeer(changed))
+	require.Empty(t, pt.listPeers())
+
+	// The pins survive a restart, once saved.
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "pins are saved after a delay, not as each is pinned")
+	require.NoError(t, pt.keyPins.flush())
+	pins, err = loadKeyPins(logrus.New(), path, KeyPinningReject)
+	require.NoError(t, err)
+	require.Len(t, pins.list(), 1)
+	require.Equal(t, original, pins.list()[0].PublicKey)
+
+	// An approved rotation restores the rejected peer, and replaces the pin once it's seen.
+	rotate := a.DeepCopy()
+	rotate.Spec.PublicKey = rotated
+	require.Error(t, pt.approveKey("a", "nope"), "an invalid key can't be approved")
+	require.NoError(t, pt.approveKey("a", rotated))
+	require.Empty(t, pt.listPeers(), "the impostor's key isn't approved")
+	require.NoError(t, pt.storePeer(a))
+	require.Equal(t, []string{"/a"}, peerNames(pt.listPeers()), "the pinned key is accepted until the rotation")
+	require.NoError(t, pt.storePeer(rotate))
+	require.Equal(t, []string{"/a"}, peerNames(pt.listPeers()))
+	require.NoError(t, pt.storePeer(a))
+	require.Empty(t, pt.listPeers(), "the old key is rejected once the peer rotates")
+
+	require.NoError(t, pt.keyPins.flush())
+	pins, err = loadKeyPins(logrus.New(), path, KeyPinningReject)
+	require.NoError(t, err)
+	require.Equal(t, rotated, pins.list()[0].PublicKey)
+	require.Empty(t, pins.list()[0].Approved)
+}
+
+func TestPeerTrackerKeyPinsAlert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pins")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pins, err := loadKeyPins(logrus.New(), filepath.Join(dir, "pins.json"), KeyPinningAlert)
+	require.NoError(t, err)
+	var alerts []string
+	pt := &peerTracker{
+		ll:       logrus.New(),
+		registry: newPeerStore(),
+		keyPins:  pins,
+		onReject: func(wgPeer *wgk8s.WireGuardPeer, reason, msg string) {
+			alerts = append(alerts, wgPeer.GetName()+": "+reason)
+		},
+	}
+	a := testPeer("a", nil, "10.10.0.1/32")
+	a.Spec.PublicKey = testPublicKey(t)
+	require.NoError(t, pt.storePeer(a))
+	changed := a.DeepCopy()
+	changed.Spec.PublicKey = testPublicKey(t)
+	require.NoError(t, pt.storePeer(changed))
+	changed.Spec.IPs = []string{"10.10.0.2/32"}
+	require.NoError(t, pt.storePeer(changed))
+	require.Equal(t, []string{"/a"}, peerNames(pt.listPeers()), "a changed key is admitted")
+	require.Equal(t, []string{"a: PublicKeyChanged"}, alerts, "each change alerts once")
+	require.Equal(t, a.Spec.PublicKey, pins.list()[0].PublicKey, "the pin is kept")
+}
+
+func TestKeyPinsSaveDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pins")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pins.json")
+	pins, err := loadKeyPins(logrus.New(), path, KeyPinningReject)
+	require.NoError(t, err)
+
+	for _, name := range []string{"a", "b", "c"} {
+		_, ok := pins.check(name, testPublicKey(t))
+		require.True(t, ok)
+	}
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "pinning doesn't write the file")
+	require.Eventually(t, func() bool {
+		saved, err := loadKeyPins(logrus.New(), path, KeyPinningReject)
+		return err == nil && len(saved.list()) == 3
+	}, 5*keyPinsSaveDelay, 10*time.Millisecond, "the pins are saved together after the delay")
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// localPeerGuard watches the agent's own WireGuardPeer record. If the record is deleted it is
+// re-created, and unexpected changes to its spec are reverted. Without this, a stray delete would
+// silently eject this node from the mesh until the agent restarts.
+type localPeerGuard struct {
+	sync.Mutex
+
+	ll      log.FieldLogger
+	client  registry.Registry
+	desired *wgk8s.WireGuardPeer
+	// disabled stops the guard from acting, ex. when the agent intentionally deregisters.
+	disabled bool
+	// onRecreate, if set, is called after the record is re-created.
+	onRecreate func(*wgk8s.WireGuardPeer)
+	// publishLock, if set, is held by the agent while it writes the record and updates the desired
+	// record. The guard waits for it, so the agent's own write, which may be observed before the
+	// desired record is updated, isn't mistaken for an unexpected change and reverted.
+	publishLock sync.Locker
+}
+
+// disable stops the guard from defending the record.
+func (g *localPeerGuard) disable() {
+	g.Lock()
+	defer g.Unlock()
+	g.disabled = true
+}
+
+// setDesired updates the record which the guard defends.
+func (g *localPeerGuard) setDesired(peer *wgk8s.WireGuardPeer) {
+	g.Lock()
+	defer g.Unlock()
+	g.desired = peer.DeepCopy()
+}
+
+func (g *localPeerGuard) OnAdd(obj interface{}) {
+	g.OnUpdate(nil, obj)
+}
+
+func (g *localPeerGuard) OnUpdate(_, newObj interface{}) {
+	wgPeer, ok := newObj.(*wgk8s.WireGuardPeer)
+	if !ok {
+		g.ll.WithField("unexpected_type", fmt.Sprintf("%T", newObj)).
+			Warn("unexpected type")
+		return
+	}
+	if g.publishLock != nil {
+		g.publishLock.Lock()
+		defer g.publishLock.Unlock()
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.disabled || wgPeer.GetName() != g.desired.GetName() || reflect.DeepEqual(wgPeer.Spec, g.desired.Spec) {
+		return
+	}
+	if wgPeer.GetDeletionTimestamp() != nil {
+		// Someone is deleting the record, but a finalizer is holding it. Don't fight them.
+		g.ll.Warn("local WireGuardPeer is being deleted; not reverting changes")
+		return
+	}
+	if takenOver := wgPeer.GetAnnotations()[wgk8s.TakenOverAnnotation]; takenOver != g.desired.GetAnnotations()[wgk8s.TakenOverAnnotation] {
+		// Another agent claimed our name, ex. our node was rebuilt elsewhere. Reverting would flap
+		// the record between us.
+		g.ll.WithFields(log.Fields{"taken_over": takenOver, "endpoint": wgPeer.Spec.Endpoint}).
+			Error("local WireGuardPeer was taken over by another agent; no longer defending it")
+		g.disabled = true
+		return
+	}
+	g.ll.Warn("local WireGuardPeer spec was modified unexpectedly, reverting")
+	revert := wgPeer.DeepCopy()
+	revert.Spec = g.desired.Spec
+	updated, err := g.client.Update(revert)
+	if err != nil {
+		g.ll.WithError(err).Error("failed to revert local WireGuardPeer")
+		return
+	}
+	g.desired = updated.DeepCopy()
+}
+
+func (g *localPeerGuard) OnDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		// The delete was missed while the watch was down.
+		obj = tombstone.Obj
+	}
+	wgPeer, ok := obj.(*wgk8s.WireGuardPeer)
+	if !ok {
+		g.ll.WithField("unexpected_type", fmt.Sprintf("%T", obj)).
+			Warn("unexpected type")
+		return
+	}
+	created := g.recreate(wgPeer)
+	if created != nil && g.onRecreate != nil {
+		// Called without holding the lock, so the callback may update the desired record.
+		g.onRecreate(created)
+	}
+}
+
+func (g *localPeerGuard) recreate(wgPeer *wgk8s.WireGuardPeer) *wgk8s.WireGuardPeer {
+	if g.publishLock != nil {
+		g.publishLock.Lock()
+		defer g.publishLock.Unlock()
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.disabled || wgPeer.GetName() != g.desired.GetName() {
+		return nil
+	}
+	g.ll.Warn("local WireGuardPeer was deleted, re-creating")
+	created, err := g.client.Register(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        g.desired.GetName(),
+			Labels:      g.desired.GetLabels(),
+			Annotations: g.desired.GetAnnotations(),
+			Finalizers:  g.desired.GetFinalizers(),
+		},
+		Spec: g.desired.Spec,
+	})
+	if err != nil {
+		g.ll.WithError(err).Error("failed to re-create local WireGuardPeer")
+		return nil
+	}
+	g.desired = created.DeepCopy()
+	return created
+}
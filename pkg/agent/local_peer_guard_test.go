@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestLocalPeerGuard(t *testing.T) {
+	desired := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "local",
+			Namespace: "ns",
+			Labels:    map[string]string{"a": "b"},
+		},
+		Spec: wgk8s.WireGuardPeerSpec{
+			Endpoint:  "192.168.1.1:51820",
+			PublicKey: "pubkey",
+		},
+	}
+	cs := fake.NewSimpleClientset()
+	peers := cs.WgmeshV1alpha1().WireGuardPeers("ns")
+	g := &localPeerGuard{
+		ll:     logrus.New(),
+		client: registry.NewKubernetes(cs, "ns"),
+	}
+	g.setDesired(desired)
+
+	t.Run("re-create on delete", func(t *testing.T) {
+		g.OnDelete(desired)
+		got, err := peers.Get("local", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, desired.Spec, got.Spec)
+		require.Equal(t, desired.Labels, got.Labels)
+	})
+
+	t.Run("re-create on a delete missed while the watch was down", func(t *testing.T) {
+		current, err := peers.Get("local", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.NoError(t, peers.Delete("local", &metav1.DeleteOptions{}))
+		g.OnDelete(cache.DeletedFinalStateUnknown{Key: "ns/local", Obj: current})
+		got, err := peers.Get("local", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, desired.Spec, got.Spec)
+	})
+
+	t.Run("revert modified spec", func(t *testing.T) {
+		current, err := peers.Get("local", metav1.GetOptions{})
+		require.NoError(t, err)
+		current.Spec.Endpoint = "10.0.0.1:51820"
+		current, err = peers.Update(current)
+		require.NoError(t, err)
+
+		g.OnUpdate(nil, current)
+		got, err := peers.Get("local", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, desired.Spec, got.Spec)
+	})
+
+	t.Run("ignore pending deletion", func(t *testing.T) {
+		current, err := peers.Get("local", metav1.GetOptions{})
+		require.NoError(t, err)
+		now := metav1.Now()
+		current.DeletionTimestamp = &now
+		current.Spec.Endpoint = "10.0.0.1:51820"
+		current, err = peers.Update(current)
+		require.NoError(t, err)
+
+		g.OnUpdate(nil, current)
+		got, err := peers.Get("local", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1:51820", got.Spec.Endpoint)
+	})
+
+	t.Run("yield to a takeover", func(t *testing.T) {
+		current, err := peers.Get("local", metav1.GetOptions{})
+		require.NoError(t, err)
+		current.DeletionTimestamp = nil
+		current.Annotations = map[string]string{wgk8s.TakenOverAnnotation: "2019-08-01T12:00:00Z"}
+		current.Spec.Endpoint = "10.0.0.2:51820"
+		current, err = peers.Update(current)
+		require.NoError(t, err)
+
+		g.OnUpdate(nil, current)
+		got, err := peers.Get("local", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.2:51820", got.Spec.Endpoint)
+		require.True(t, g.disabled, "the guard stops defending the record")
+	})
+}
+
+func TestLocalPeerGuardOwnWrite(t *testing.T) {
+	desired := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "local", Namespace: "ns"},
+		Spec:       wgk8s.WireGuardPeerSpec{Endpoint: "192.168.1.1:51820", PublicKey: "pubkey"},
+	}
+	cs := fake.NewSimpleClientset(desired)
+	peers := cs.WgmeshV1alpha1().WireGuardPeers("ns")
+	var publishLock sync.Mutex
+	g := &localPeerGuard{
+		ll:          logrus.New(),
+		client:      registry.NewKubernetes(cs, "ns"),
+		publishLock: &publishLock,
+	}
+	g.setDesired(desired)
+
+	// The agent publishes a new endpoint, and the watch delivers the write before the agent updates
+	// the desired record.
+	publishLock.Lock()
+	current, err := peers.Get("local", metav1.GetOptions{})
+	require.NoError(t, err)
+	current.Spec.Endpoint = "10.0.0.1:51820"
+	current, err = peers.Update(current)
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.OnUpdate(nil, current)
+	}()
+	g.setDesired(current)
+	publishLock.Unlock()
+	<-done
+
+	got, err := peers.Get("local", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:51820", got.Spec.Endpoint, "the agent's own write isn't reverted")
+}
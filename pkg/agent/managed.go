@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// managedPeerPollInterval is how often we check for the operator to publish our record.
+const managedPeerPollInterval = 5 * time.Second
+
+// runManaged starts the agent in operator-managed mode, running until the context is canceled.
+// Rather than registering our own WireGuardPeer, we announce our key and port on the kube node and
+// wait for the operator to publish a record for us.
+func (a *Agent) runManaged(ctx context.Context) error {
+	if a.localCS == nil || a.kubeNode == "" {
+		return fmt.Errorf("operator-managed mode requires a local kubeconfig and kube node name")
+	}
+	err := a.initializeWireGuard(ctx)
+	if err != nil {
+		return fmt.Errorf("initializing WireGuard interface: %w", err)
+	}
+	err = a.announceToNode()
+	if err != nil {
+		return err
+	}
+	err = a.waitForManagedPeer(ctx)
+	if err != nil {
+		return err
+	}
+	a.ips = a.localPeer.Spec.IPs
+	err = a.ensureIPs(a.ips)
+	if err != nil {
+		return fmt.Errorf("assigning addresses from managed WireGuardPeer: %w", err)
+	}
+	err = a.annotateNodeIPs(a.ips)
+	if err != nil {
+		return err
+	}
+
+	a.configureWireGuardPeers(ctx)
+	err = a.clearNodeNetworkUnavailable()
+	if err != nil {
+		return err
+	}
+	a.monitorEndpoints(ctx)
+	err = a.enableMeshUpdates()
+	if err != nil {
+		return fmt.Errorf("applying mesh settings: %w", err)
+	}
+	if a.controlSocket != "" {
+		err = a.serveControl(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// announceToNode publishes our public key and listen port as annotations on the kube node.
+func (a *Agent) announceToNode() error {
+	port, err := a.iface.GetListenPort()
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				wgk8s.NodePublicKeyAnnotation:  a.publicKey.String(),
+				wgk8s.NodeListenPortAnnotation: strconv.Itoa(port),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	a.ll.WithField("kube_node", a.kubeNode).Infoln("announcing public key on node")
+	_, err = a.localCS.CoreV1().Nodes().Patch(a.kubeNode, types.MergePatchType, patch)
+	if err != nil {
+		return fmt.Errorf("annotating node %q: %w", a.kubeNode, err)
+	}
+	return nil
+}
+
+// waitForManagedPeer waits until the operator has published a WireGuardPeer with our public key.
+func (a *Agent) waitForManagedPeer(ctx context.Context) error {
+	ll := a.ll.WithField("k8s_name", a.name)
+	return wait.PollImmediateUntil(managedPeerPollInterval, func() (bool, error) {
+		peer, err := a.registry.Get(a.name)
+		if k8sErrors.IsNotFound(err) {
+			ll.Debugln("waiting for operator to create our WireGuardPeer")
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("getting WireGuardPeer %q: %w", a.name, err)
+		}
+		if peer.Spec.PublicKey != a.publicKey.String() {
+			ll.Debugln("waiting for operator to publish our public key")
+			return false, nil
+		}
+		a.localPeer = peer
+		return true, nil
+	}, ctx.Done())
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWaitForManagedPeer(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	peer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "node-a"},
+		Spec: wgk8s.WireGuardPeerSpec{
+			PublicKey: key.PublicKey().String(),
+			IPs:       []string{"10.244.1.1/32"},
+		},
+	}
+	a := &Agent{
+		options: options{
+			ll:                logrus.New(),
+			name:              "node-a",
+			registryNamespace: "ns",
+			operatorManaged:   true,
+		},
+		registry:  registry.NewKubernetes(fake.NewSimpleClientset(peer), "ns"),
+		publicKey: key.PublicKey(),
+	}
+	require.NoError(t, a.waitForManagedPeer(context.Background()))
+	require.Equal(t, peer.Spec, a.localPeer.Spec)
+
+	// A record which still has our previous key isn't ours yet.
+	other, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	a.publicKey = other.PublicKey()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, a.waitForManagedPeer(ctx))
+
+	// Managed agents never write their own record.
+	require.NoError(t, a.publishLocalPeerSpec(func(spec *wgk8s.WireGuardPeerSpec) bool {
+		spec.Endpoint = "203.0.113.1:51820"
+		return true
+	}))
+	latest, err := a.registry.Get("node-a")
+	require.NoError(t, err)
+	require.Empty(t, latest.Spec.Endpoint)
+}
@@ -0,0 +1,515 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+const (
+	// mdnsService is the DNS-SD service type agents announce and browse.
+	mdnsService = "_wgmesh._udp.local."
+	// mdnsInterval is how often we re-announce ourselves and expire neighbors which haven't.
+	mdnsInterval = 30 * time.Second
+	// mdnsTTL is how long neighbors remember our announcements.
+	mdnsTTL = 2 * time.Minute
+	// lanKeyPrefix prefixes the keys of the configs of neighbors peered with from their announcements,
+	// which can't collide with the registry peers' self links.
+	lanKeyPrefix = "mdns/"
+)
+
+// mdnsGroup is the IPv4 mDNS multicast group.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsAnnouncement describes an agent announced over mDNS.
+type mdnsAnnouncement struct {
+	// instance is the DNS-SD service instance name, ex. "peer-a._wgmesh._udp.local.".
+	instance  string
+	publicKey string
+	// namespace is the announcing agent's registry namespace. Agents ignore other meshes.
+	namespace string
+	port      int
+	// ips are the announcing agent's mesh addresses, ex. "10.0.0.1/32".
+	ips []string
+	// ttl is how long the announcement is valid. Zero withdraws it.
+	ttl time.Duration
+}
+
+// lanEndpoint is an address a peer was discovered at on the local network.
+type lanEndpoint struct {
+	endpoint string
+	expires  time.Time
+	// peer is the neighbor as a peer, if its key or address is allowed to be peered with from its
+	// announcements alone.
+	peer *wgk8s.WireGuardPeer
+}
+
+// discoverLANPeers announces the local peer via mDNS, and prefers the local network addresses of
+// the peers we hear announcements from, until the context is canceled. Announcements aren't
+// authenticated, so a registry peer is only moved to an address it published itself, and
+// neighbors without a registry record are only peered with if their key or address is allowed.
+func (a *Agent) discoverLANPeers(ctx context.Context) error {
+	port, err := a.iface.GetListenPort()
+	if err != nil {
+		return fmt.Errorf("reading WireGuard listen port: %w", err)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("listening for mDNS: %w", err)
+	}
+	ann := mdnsAnnouncement{
+		instance:  mdnsInstance(a.name),
+		publicKey: a.localPeer.Spec.PublicKey,
+		namespace: a.registryNamespace,
+		port:      port,
+		ips:       a.localPeer.Spec.IPs,
+		ttl:       mdnsTTL,
+	}
+	announcement, err := buildMDNSAnnouncement(ann)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("building mDNS announcement: %w", err)
+	}
+	ann.ttl = 0
+	goodbye, err := buildMDNSAnnouncement(ann)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("building mDNS announcement: %w", err)
+	}
+	query, err := buildMDNSQuery()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("building mDNS query: %w", err)
+	}
+	// Client-only peers can't accept connections, so they browse without announcing.
+	announce := func(msg []byte) {
+		if a.clientOnly {
+			return
+		}
+		if _, err := conn.WriteToUDP(msg, mdnsGroup); err != nil {
+			a.ll.WithError(err).Warn("failed to send mDNS announcement")
+		}
+	}
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		a.ll.WithError(err).Warn("failed to send mDNS query")
+	}
+
+	a.wg.Add(2)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			announce(announcement)
+			if err := a.peerTracker.expireLANEndpoints(); err != nil {
+				a.ll.WithError(err).Error("failed to expire LAN endpoints")
+			}
+		}, mdnsInterval, ctx.Done())
+		announce(goodbye)
+		conn.Close()
+	}()
+	go func() {
+		defer a.wg.Done()
+		buf := make([]byte, 9000)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					a.ll.WithError(err).Error("failed to read mDNS")
+				}
+				return
+			}
+			isQuery, anns, err := parseMDNS(buf[:n])
+			if err != nil {
+				a.ll.WithError(err).WithField("source", src).Debug("ignoring invalid mDNS message")
+				continue
+			}
+			if isQuery {
+				announce(announcement)
+			}
+			for _, ann := range anns {
+				a.onMDNSAnnouncement(src, ann)
+			}
+		}
+	}()
+	return nil
+}
+
+// onMDNSAnnouncement records the endpoint of a neighbor which announced itself from src.
+func (a *Agent) onMDNSAnnouncement(src *net.UDPAddr, ann mdnsAnnouncement) {
+	if ann.publicKey == a.localPeer.Spec.PublicKey || ann.namespace != a.registryNamespace {
+		return
+	}
+	endpoint := net.JoinHostPort(src.IP.String(), strconv.Itoa(ann.port))
+	ll := a.ll.WithField("public_key", ann.publicKey).WithField("endpoint", endpoint)
+	lan := lanEndpoint{endpoint: endpoint, expires: time.Now().Add(ann.ttl)}
+	if a.mdnsPeerAllowed(ann.publicKey, src.IP) {
+		lan.peer = lanPeer(ann, endpoint)
+	}
+	known, err := a.peerTracker.setLANEndpoint(ann.publicKey, lan)
+	if err != nil {
+		ll.WithError(err).Error("failed to apply LAN endpoint")
+		return
+	}
+	if !known {
+		ll.Debug("ignoring mDNS announcement from unknown peer")
+	}
+}
+
+// mdnsPeerAllowed returns true if a neighbor announcing the public key from the address may be
+// peered with without a registry record.
+func (a *Agent) mdnsPeerAllowed(publicKey string, ip net.IP) bool {
+	if a.mdnsPeerKeys[publicKey] {
+		return true
+	}
+	for _, n := range a.mdnsPeerCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lanPeer returns the neighbor which announced ann from the endpoint as a peer, so it's admitted and
+// configured like the registry's.
+func lanPeer(ann mdnsAnnouncement, endpoint string) *wgk8s.WireGuardPeer {
+	return &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      strings.TrimSuffix(ann.instance, "."+mdnsService),
+			Namespace: ann.namespace,
+			SelfLink:  lanKeyPrefix + ann.publicKey,
+		},
+		Spec: wgk8s.WireGuardPeerSpec{
+			PublicKey: ann.publicKey,
+			Endpoint:  endpoint,
+			IPs:       ann.ips,
+		},
+	}
+}
+
+// setLANEndpoint records that the peer with the public key was discovered at lan's endpoint until
+// it expires, and reports whether we know the peer, either from the registry, or as a neighbor we
+// may peer with. Newly discovered endpoints are tried right away; re-announcements only extend them.
+func (pt *peerTracker) setLANEndpoint(publicKey string, lan lanEndpoint) (bool, error) {
+	pt.Lock()
+	defer pt.Unlock()
+	current, _ := pt.lanEndpoint(publicKey)
+	prev := pt.lanEndpoints[publicKey]
+	endpoint := lan.endpoint
+	if pt.clock().Before(lan.expires) {
+		if pt.lanEndpoints == nil {
+			pt.lanEndpoints = make(map[string]lanEndpoint)
+		}
+		pt.lanEndpoints[publicKey] = lan
+	} else {
+		// The announcement was withdrawn.
+		delete(pt.lanEndpoints, publicKey)
+		endpoint = ""
+		lan.peer = nil
+	}
+	if prev.peer != nil && lan.peer == nil {
+		pt.forgetLANPeer(prev.peer)
+	}
+	var known bool
+	for name, wgPeer := range pt.listPeers() {
+		if wgPeer.Spec.PublicKey != publicKey {
+			continue
+		}
+		known = true
+		if endpoint != "" && endpoint != current {
+			// Start over on the most preferred candidate rather than keeping the current one.
+			delete(pt.endpoints, name)
+		}
+	}
+	changed := current != endpoint || !lanPeersEqual(prev.peer, lan.peer)
+	if !known && lan.peer == nil && prev.peer == nil {
+		return false, nil
+	}
+	if !changed || !pt.initialConfigApplied {
+		return true, nil
+	}
+	return true, pt.sync()
+}
+
+// lanPeersEqual returns true if the neighbors would be configured the same.
+func lanPeersEqual(a, b *wgk8s.WireGuardPeer) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.GetName() == b.GetName() && a.Spec.Endpoint == b.Spec.Endpoint &&
+		reflect.DeepEqual(a.Spec.IPs, b.Spec.IPs)
+}
+
+// forgetLANPeer drops everything tracked about a neighbor no longer peered with. The caller must
+// hold the lock.
+func (pt *peerTracker) forgetLANPeer(wgPeer *wgk8s.WireGuardPeer) {
+	pt.forget(wgPeer)
+	pt.drop(wgPeer.GetSelfLink())
+}
+
+// addLANPeers adds the neighbors we may peer with from their announcements alone to the desired
+// configs, if the policy admits them. Peers which are already configured, ex. from the registry,
+// keep their config, and neighbors don't take allowed IPs from other peers. The caller must hold
+// the lock.
+func (pt *peerTracker) addLANPeers(out map[string]wgtypes.PeerConfig) {
+	var keys []string
+	for key, lan := range pt.lanEndpoints {
+		if lan.peer != nil && pt.clock().Before(lan.expires) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+	configured := make(map[wgtypes.Key]bool, len(out))
+	owned := make(map[string]bool)
+	for _, c := range out {
+		configured[c.PublicKey] = true
+		for _, n := range c.AllowedIPs {
+			owned[n.String()] = true
+		}
+	}
+	if pt.localPeer != nil {
+		local, _ := pt.prefixes(pt.localPeer)
+		for _, n := range local {
+			owned[n.String()] = true
+		}
+	}
+	for _, key := range keys {
+		wgPeer := pt.lanEndpoints[key].peer
+		ll := pt.ll.WithField("public_key", key)
+		if reason, msg := pt.rejection(wgPeer); reason != "" {
+			ll.Debugf("not peering with LAN neighbor: %s", msg)
+			continue
+		}
+		c, err := pt.k8sToWgctrl(wgPeer)
+		if err != nil {
+			ll.WithError(err).Warn("failed to build LAN neighbor")
+			continue
+		}
+		if configured[c.PublicKey] {
+			continue
+		}
+		allowed := c.AllowedIPs[:0]
+		for _, n := range c.AllowedIPs {
+			if !owned[n.String()] {
+				owned[n.String()] = true
+				allowed = append(allowed, n)
+			}
+		}
+		c.AllowedIPs = allowed
+		out[wgPeer.GetSelfLink()] = c
+	}
+}
+
+// expireLANEndpoints forgets the LAN endpoints of peers which haven't re-announced themselves.
+func (pt *peerTracker) expireLANEndpoints() error {
+	pt.Lock()
+	defer pt.Unlock()
+	now := pt.clock()
+	var expired bool
+	for key, lan := range pt.lanEndpoints {
+		if now.Before(lan.expires) {
+			continue
+		}
+		delete(pt.lanEndpoints, key)
+		if lan.peer != nil {
+			pt.forgetLANPeer(lan.peer)
+		}
+		expired = true
+	}
+	if !expired || !pt.initialConfigApplied {
+		return nil
+	}
+	return pt.sync()
+}
+
+// lanEndpoint returns the unexpired LAN endpoint of the peer with the public key. The caller must
+// hold the lock.
+func (pt *peerTracker) lanEndpoint(publicKey string) (string, bool) {
+	lan, ok := pt.lanEndpoints[publicKey]
+	if !ok || !pt.clock().Before(lan.expires) {
+		return "", false
+	}
+	return lan.endpoint, true
+}
+
+// publishedHost returns true if the endpoint's address is the host of one of the peer's published
+// endpoint candidates. Candidates published by name don't match, since they'd be resolved under the
+// lock.
+func publishedHost(wgPeer *wgk8s.WireGuardPeer, endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, c := range wgPeer.Spec.EndpointCandidates() {
+		h, _, err := net.SplitHostPort(c)
+		if err == nil && ip != nil && ip.Equal(net.ParseIP(h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mdnsInstance returns the DNS-SD service instance name for the peer name.
+func mdnsInstance(name string) string {
+	// Instance labels are limited to 63 bytes, and dots would split them.
+	label := strings.Replace(name, ".", "-", -1)
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label + "." + mdnsService
+}
+
+// buildMDNSQuery returns a query for agents' announcements.
+func buildMDNSQuery() ([]byte, error) {
+	service, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	err = b.Question(dnsmessage.Question{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// buildMDNSAnnouncement returns an unsolicited response announcing ann. Neighbors dial the
+// announcement's source address, so it carries no address records.
+func buildMDNSAnnouncement(ann mdnsAnnouncement) ([]byte, error) {
+	service, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(ann.instance)
+	if err != nil {
+		return nil, err
+	}
+	ttl := uint32(ann.ttl / time.Second)
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	hdr := dnsmessage.ResourceHeader{Name: service, Class: dnsmessage.ClassINET, TTL: ttl}
+	if err := b.PTRResource(hdr, dnsmessage.PTRResource{PTR: instance}); err != nil {
+		return nil, err
+	}
+	hdr = dnsmessage.ResourceHeader{Name: instance, Class: dnsmessage.ClassINET, TTL: ttl}
+	err = b.SRVResource(hdr, dnsmessage.SRVResource{Port: uint16(ann.port), Target: instance})
+	if err != nil {
+		return nil, err
+	}
+	txt := []string{
+		"pk=" + ann.publicKey,
+		"ns=" + ann.namespace,
+	}
+	for _, ip := range ann.ips {
+		txt = append(txt, "ip="+ip)
+	}
+	err = b.TXTResource(hdr, dnsmessage.TXTResource{TXT: txt})
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseMDNS parses an mDNS message, reporting whether it queries for agents, and returning the
+// agents it announces. Records about other services are ignored.
+func parseMDNS(msg []byte) (bool, []mdnsAnnouncement, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return false, nil, err
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return false, nil, err
+	}
+	if !h.Response {
+		for _, q := range questions {
+			if strings.EqualFold(q.Name.String(), mdnsService) &&
+				(q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL) {
+				return true, nil, nil
+			}
+		}
+		return false, nil, nil
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return false, nil, err
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return false, nil, err
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return false, nil, err
+	}
+
+	byInstance := make(map[string]*mdnsAnnouncement)
+	var instances []string
+	get := func(name string) *mdnsAnnouncement {
+		name = strings.ToLower(name)
+		ann, ok := byInstance[name]
+		if !ok {
+			ann = &mdnsAnnouncement{instance: name, port: -1}
+			byInstance[name] = ann
+			instances = append(instances, name)
+		}
+		return ann
+	}
+	for _, r := range append(answers, additionals...) {
+		name := r.Header.Name.String()
+		if !strings.HasSuffix(strings.ToLower(name), "."+mdnsService) {
+			continue
+		}
+		switch body := r.Body.(type) {
+		case *dnsmessage.SRVResource:
+			ann := get(name)
+			ann.port = int(body.Port)
+			ann.ttl = time.Duration(r.Header.TTL) * time.Second
+		case *dnsmessage.TXTResource:
+			ann := get(name)
+			for _, kv := range body.TXT {
+				switch {
+				case strings.HasPrefix(kv, "pk="):
+					ann.publicKey = strings.TrimPrefix(kv, "pk=")
+				case strings.HasPrefix(kv, "ns="):
+					ann.namespace = strings.TrimPrefix(kv, "ns=")
+				case strings.HasPrefix(kv, "ip="):
+					ip := strings.TrimPrefix(kv, "ip=")
+					if _, _, err := net.ParseCIDR(ip); err == nil {
+						ann.ips = append(ann.ips, ip)
+					}
+				}
+			}
+		}
+	}
+	var out []mdnsAnnouncement
+	for _, name := range instances {
+		ann := byInstance[name]
+		if ann.publicKey == "" || ann.port <= 0 {
+			continue
+		}
+		out = append(out, *ann)
+	}
+	return false, out, nil
+}
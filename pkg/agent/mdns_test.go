@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces/interfacestest"
+)
+
+func TestMDNSMessages(t *testing.T) {
+	query, err := buildMDNSQuery()
+	require.NoError(t, err)
+	isQuery, anns, err := parseMDNS(query)
+	require.NoError(t, err)
+	require.True(t, isQuery)
+	require.Empty(t, anns)
+
+	ann := mdnsAnnouncement{
+		instance:  mdnsInstance("node-a.example.com"),
+		publicKey: "pk",
+		namespace: "ns",
+		port:      51820,
+		ips:       []string{"10.0.0.1/32", "fd00::1/128"},
+		ttl:       mdnsTTL,
+	}
+	require.Equal(t, "node-a-example-com._wgmesh._udp.local.", ann.instance)
+	msg, err := buildMDNSAnnouncement(ann)
+	require.NoError(t, err)
+	isQuery, anns, err = parseMDNS(msg)
+	require.NoError(t, err)
+	require.False(t, isQuery)
+	require.Equal(t, []mdnsAnnouncement{ann}, anns)
+
+	_, _, err = parseMDNS([]byte("garbage"))
+	require.Error(t, err)
+}
+
+func TestLANEndpoints(t *testing.T) {
+	const (
+		lan    = "192.168.1.10:51820"
+		public = "203.0.113.1:51820"
+	)
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	wgPeer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "peer", Namespace: "ns", SelfLink: "/peer"},
+		Spec: wgk8s.WireGuardPeerSpec{
+			PublicKey: key.PublicKey().String(),
+			Endpoints: []string{public},
+			Endpoint:  lan,
+		},
+	}
+	now := time.Unix(1000000, 0)
+	pt := &peerTracker{
+		ll:       logrus.New(),
+		registry: testRegistry(wgPeer),
+		now:      func() time.Time { return now },
+	}
+	announce := func(endpoint string, expires time.Time) (bool, error) {
+		return pt.setLANEndpoint(wgPeer.Spec.PublicKey, lanEndpoint{endpoint: endpoint, expires: expires})
+	}
+	require.Equal(t, public, pt.selectEndpoint(wgPeer))
+
+	// Peers which the registry hasn't admitted are remembered, but not configured.
+	known, err := pt.setLANEndpoint("other", lanEndpoint{endpoint: "192.168.1.11:51820", expires: now.Add(mdnsTTL)})
+	require.NoError(t, err)
+	require.False(t, known)
+
+	// Announcements aren't authenticated, so an address the peer didn't publish isn't tried.
+	known, err = announce("192.168.1.66:51820", now.Add(mdnsTTL))
+	require.NoError(t, err)
+	require.True(t, known)
+	require.Equal(t, []string{public, lan}, pt.endpointCandidates(wgPeer))
+	require.Equal(t, public, pt.selectEndpoint(wgPeer))
+
+	// A discovered peer switches to its LAN address.
+	known, err = announce(lan, now.Add(mdnsTTL))
+	require.NoError(t, err)
+	require.True(t, known)
+	require.Equal(t, []string{lan, public}, pt.endpointCandidates(wgPeer))
+	require.Equal(t, lan, pt.selectEndpoint(wgPeer))
+
+	// Re-announcements don't undo failover away from the LAN address.
+	pt.endpoints[wgPeer.GetSelfLink()].index = 1
+	now = now.Add(mdnsInterval)
+	_, err = announce(lan, now.Add(mdnsTTL))
+	require.NoError(t, err)
+	require.Equal(t, public, pt.selectEndpoint(wgPeer))
+
+	// The LAN address is forgotten once it's no longer announced.
+	now = now.Add(mdnsTTL)
+	require.NoError(t, pt.expireLANEndpoints())
+	require.Empty(t, pt.lanEndpoints)
+	require.Equal(t, []string{public, lan}, pt.endpointCandidates(wgPeer))
+
+	// Goodbyes withdraw it immediately.
+	delete(pt.endpoints, wgPeer.GetSelfLink())
+	_, err = announce(lan, now.Add(mdnsTTL))
+	require.NoError(t, err)
+	require.Equal(t, lan, pt.selectEndpoint(wgPeer))
+	_, err = announce(lan, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{public, lan}, pt.endpointCandidates(wgPeer))
+}
+
+func TestLANPeers(t *testing.T) {
+	const lan = "192.168.1.10:51820"
+	key := func() string {
+		k, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		return k.PublicKey().String()
+	}
+	registryPeer := testPeer("registry", nil, "10.0.0.2/32")
+	registryPeer.Spec.PublicKey = key()
+	registryPeer.Spec.Endpoint = "192.0.2.2:51820"
+	now := time.Unix(1000000, 0)
+	pt := &peerTracker{
+		ll:        logrus.New(),
+		iface:     interfacestest.NewWireGuardInterface("wg0"),
+		registry:  testRegistry(registryPeer),
+		applied:   make(map[string]wgtypes.PeerConfig),
+		localPeer: testPeer("local", nil, "10.0.0.1/32"),
+		now:       func() time.Time { return now },
+	}
+	require.NoError(t, pt.applyInitialConfig())
+
+	a := &Agent{}
+	require.NoError(t, WithMDNSPeers(nil, []string{"192.168.1.0/24"})(&a.options))
+	ann := mdnsAnnouncement{
+		instance:  mdnsInstance("neighbor"),
+		publicKey: key(),
+		namespace: "ns",
+		port:      51820,
+		// The neighbor can't take the registry peer's or our addresses.
+		ips: []string{"10.0.0.3/32", "10.0.0.2/32", "10.0.0.1/32"},
+	}
+	require.True(t, a.mdnsPeerAllowed(ann.publicKey, net.ParseIP("192.168.1.10")))
+	require.False(t, a.mdnsPeerAllowed(ann.publicKey, net.ParseIP("192.168.2.10")))
+
+	// An allowed neighbor is peered with from its announcement alone.
+	name := lanKeyPrefix + ann.publicKey
+	known, err := pt.setLANEndpoint(ann.publicKey, lanEndpoint{endpoint: lan, expires: now.Add(mdnsTTL), peer: lanPeer(ann, lan)})
+	require.NoError(t, err)
+	require.True(t, known)
+	require.Contains(t, pt.applied, name)
+	require.Equal(t, lan, pt.applied[name].Endpoint.String())
+	require.Equal(t, "[{10.0.0.3 ffffffff}]", fmt.Sprint(pt.applied[name].AllowedIPs))
+
+	// It's still subject to the policy.
+	require.NoError(t, pt.setRevokedKeys(map[string]bool{ann.publicKey: true}))
+	require.NotContains(t, pt.applied, name)
+	require.NoError(t, pt.setRevokedKeys(nil))
+	require.Contains(t, pt.applied, name)
+
+	// It's removed once it's no longer announced.
+	now = now.Add(mdnsTTL)
+	require.NoError(t, pt.expireLANEndpoints())
+	require.NotContains(t, pt.applied, name)
+	require.Contains(t, pt.applied, registryPeer.GetSelfLink())
+}
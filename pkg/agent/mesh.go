@@ -0,0 +1,211 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	log "github.com/sirupsen/logrus"
+
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchMeshes tracks the Mesh which selects the local peer. It returns once the initial Meshes
+// have been loaded; settings from later changes are applied once enableMeshUpdates is called.
+func (a *Agent) watchMeshes(ctx context.Context) error {
+	meshes := a.registryHealth.listWatch(ctx, a.registry.WatchMeshes())
+	_, err := meshes.List(metav1.ListOptions{Limit: 1})
+	if k8sErrors.IsNotFound(err) {
+		a.ll.Warnln("Mesh resource is not installed in the registry; using agent settings only")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("listing Meshes: %w", err)
+	}
+
+	informer := cache.NewSharedIndexInformer(
+		meshes,
+		&wgk8s.Mesh{},
+		a.resyncPeriod,
+		cache.Indexers{},
+	)
+	onChange := func() { a.onMeshChange(informer.GetStore()) }
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { onChange() },
+		UpdateFunc: func(interface{}, interface{}) { onChange() },
+		DeleteFunc: func(interface{}) { onChange() },
+	})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		informer.Run(ctx.Done())
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync Meshes")
+	}
+	onChange()
+	return nil
+}
+
+// onMeshChange re-selects the local peer's Mesh from the store.
+func (a *Agent) onMeshChange(store cache.Store) {
+	var meshes []*wgk8s.Mesh
+	for _, obj := range store.List() {
+		if m, ok := obj.(*wgk8s.Mesh); ok {
+			meshes = append(meshes, m)
+		}
+	}
+	mesh, ignored := selectMesh(a.ll, meshes, a.peerLabels())
+	revoked := revokedKeys(meshes)
+
+	a.meshLock.Lock()
+	defer a.meshLock.Unlock()
+	if reflect.DeepEqual(mesh, a.mesh) && revokedKeysEqual(revoked, a.revokedKeys) {
+		return
+	}
+	ll := a.ll
+	if mesh != nil {
+		ll = ll.WithField("mesh", mesh.GetName())
+	}
+	if len(ignored) > 0 {
+		ll.WithField("ignored_meshes", ignored).Warnln("multiple Meshes select the local peer; using the first by name")
+	}
+	ll.Infoln("mesh settings changed")
+	a.mesh = mesh
+	a.revokedKeys = revoked
+	if !a.meshUpdates {
+		return
+	}
+	if err := a.applyMeshSettings(); err != nil {
+		ll.WithError(err).Error("failed to apply mesh settings")
+	}
+}
+
+// enableMeshUpdates applies mesh settings which changed during startup, and any future changes.
+func (a *Agent) enableMeshUpdates() error {
+	a.meshLock.Lock()
+	defer a.meshLock.Unlock()
+	a.meshUpdates = true
+	return a.applyMeshSettings()
+}
+
+// applyMeshSettings brings the interface, peers, and published record in line with the effective
+// settings. The caller must hold meshLock.
+func (a *Agent) applyMeshSettings() error {
+	if mtu := a.effectiveMTU(); mtu > 0 && mtu != a.appliedMTU {
+		a.ll.WithField("mtu", mtu).Infoln("setting interface mtu")
+		if err := a.iface.SetMTU(mtu); err != nil {
+			return err
+		}
+		a.appliedMTU = mtu
+	}
+	t, err := meshTopology(a.mesh)
+	if err != nil {
+		// Keep the current topology rather than connecting peers which shouldn't be.
+		a.ll.WithError(err).Error("ignoring invalid mesh topology")
+	} else if err := a.peerTracker.setTopology(t); err != nil {
+		return fmt.Errorf("reconfiguring peers for topology: %w", err)
+	}
+	if err := a.peerTracker.setRevokedKeys(a.revokedKeys); err != nil {
+		return fmt.Errorf("removing peers with revoked keys: %w", err)
+	}
+	allowed, err := a.effectiveAllowedEndpoints()
+	if err != nil {
+		// Keep the current allowlist rather than admitting peers which shouldn't be.
+		a.ll.WithError(err).Error("ignoring invalid mesh allowed endpoint cidrs")
+	} else if err := a.peerTracker.setAllowedEndpoints(allowed); err != nil {
+		return fmt.Errorf("removing peers with disallowed endpoints: %w", err)
+	}
+	keepalive := a.effectiveKeepalive()
+	if err := a.peerTracker.setKeepalive(keepalive); err != nil {
+		return fmt.Errorf("reconfiguring peer keepalives: %w", err)
+	}
+	err = a.publishLocalPeerSpec(func(spec *wgk8s.WireGuardPeerSpec) bool {
+		if spec.KeepAliveSeconds == int(keepalive.Seconds()) {
+			return false
+		}
+		spec.KeepAliveSeconds = int(keepalive.Seconds())
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("publishing keepalive: %w", err)
+	}
+	return nil
+}
+
+// effectiveKeepalive returns the agent's keepalive if set, falling back to the Mesh's. Client-only
+// peers always keep alive, since peers can't reach them otherwise. The caller must hold meshLock.
+func (a *Agent) effectiveKeepalive() time.Duration {
+	keepalive := a.keepalive
+	if keepalive == 0 && a.mesh != nil {
+		keepalive = time.Duration(a.mesh.Spec.KeepAliveSeconds) * time.Second
+	}
+	if keepalive == 0 && a.clientOnly {
+		keepalive = defaultClientOnlyKeepalive
+	}
+	return keepalive
+}
+
+// effectiveMTU returns the configured MTU, lowered to the path MTU, if it's been tuned. Zero leaves
+// the interface's MTU alone. The caller must hold meshLock.
+func (a *Agent) effectiveMTU() int {
+	mtu := a.configuredMTU()
+	if a.pathMTU > 0 && (mtu == 0 || a.pathMTU < mtu) {
+		return a.pathMTU
+	}
+	return mtu
+}
+
+// configuredMTU returns the agent's MTU if set, falling back to the Mesh's. The caller must hold
+// meshLock.
+func (a *Agent) configuredMTU() int {
+	if a.mtu > 0 || a.mesh == nil {
+		return a.mtu
+	}
+	return a.mesh.Spec.MTU
+}
+
+// revokedKeys returns the public keys revoked by any of the meshes.
+func revokedKeys(meshes []*wgk8s.Mesh) map[string]bool {
+	out := make(map[string]bool)
+	for _, m := range meshes {
+		for _, key := range m.Spec.RevokedPublicKeys {
+			out[key] = true
+		}
+	}
+	return out
+}
+
+// selectMesh returns the first Mesh, by name, whose peer selector matches the local peer's labels,
+// along with the names of any other matching Meshes. Meshes with invalid selectors are skipped.
+func selectMesh(ll log.FieldLogger, meshes []*wgk8s.Mesh, peerLabels labels.Set) (*wgk8s.Mesh, []string) {
+	sort.Slice(meshes, func(i, j int) bool { return meshes[i].GetName() < meshes[j].GetName() })
+	var selected *wgk8s.Mesh
+	var ignored []string
+	for _, m := range meshes {
+		selector := labels.Everything()
+		if m.Spec.PeerSelector != nil {
+			var err error
+			selector, err = metav1.LabelSelectorAsSelector(m.Spec.PeerSelector)
+			if err != nil {
+				ll.WithField("mesh", m.GetName()).WithError(err).Warnln("ignoring Mesh with invalid peerSelector")
+				continue
+			}
+		}
+		if !selector.Matches(peerLabels) {
+			continue
+		}
+		if selected == nil {
+			selected = m
+			continue
+		}
+		ignored = append(ignored, m.GetName())
+	}
+	return selected, ignored
+}
@@ -0,0 +1,424 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// meshPolicyTablePrefix names the nftables table holding an interface's mesh policy rules.
+const meshPolicyTablePrefix = "wgmesh-policy-"
+
+// meshPolicy is a WireGuardMeshPolicy with its selectors parsed.
+type meshPolicy struct {
+	namespace string
+	peers     labels.Selector
+	ingress   []meshPolicyRule
+}
+
+// meshPolicyRule is an ingress rule with its selectors parsed.
+type meshPolicyRule struct {
+	// from selects the peers allowed, or every peer if empty.
+	from  []labels.Selector
+	ports []wgk8s.MeshPolicyPort
+}
+
+// compileMeshPolicies parses the policies' selectors. Selectors which can't be parsed fail closed:
+// an invalid peerSelector selects every peer, and an invalid from selector selects none.
+func compileMeshPolicies(ll log.FieldLogger, policies []*wgk8s.WireGuardMeshPolicy) []meshPolicy {
+	out := make([]meshPolicy, 0, len(policies))
+	for _, p := range policies {
+		ll := ll.WithField("mesh_policy", p.GetName())
+		peers, err := metav1.LabelSelectorAsSelector(&p.Spec.PeerSelector)
+		if err != nil {
+			ll.WithError(err).Error("invalid peerSelector; applying the policy to every peer")
+			peers = labels.Everything()
+		}
+		mp := meshPolicy{namespace: p.GetNamespace(), peers: peers}
+		for _, r := range p.Spec.Ingress {
+			rule := meshPolicyRule{ports: r.Ports}
+			for _, f := range r.From {
+				from, err := metav1.LabelSelectorAsSelector(&f.PeerSelector)
+				if err != nil {
+					ll.WithError(err).Error("invalid from peerSelector; allowing no peers through it")
+					from = labels.Nothing()
+				}
+				rule.from = append(rule.from, from)
+			}
+			mp.ingress = append(mp.ingress, rule)
+		}
+		out = append(out, mp)
+	}
+	return out
+}
+
+// selects returns true if the policy applies to the peer. Policies only select peers of their own
+// namespace.
+func (p *meshPolicy) selects(wgPeer *wgk8s.WireGuardPeer) bool {
+	return p.namespace == wgPeer.GetNamespace() && p.peers.Matches(labels.Set(wgPeer.GetLabels()))
+}
+
+// admits returns true if the rule allows traffic from the peer, a peer of namespace ns.
+func (r *meshPolicyRule) admits(ns string, wgPeer *wgk8s.WireGuardPeer) bool {
+	if len(r.from) == 0 {
+		return true
+	}
+	if wgPeer.GetNamespace() != ns {
+		return false
+	}
+	for _, from := range r.from {
+		if from.Matches(labels.Set(wgPeer.GetLabels())) {
+			return true
+		}
+	}
+	return false
+}
+
+// meshPolicyIsolated returns true if any of the policies select the peer, so it only accepts the
+// traffic they allow.
+func meshPolicyIsolated(policies []meshPolicy, wgPeer *wgk8s.WireGuardPeer) bool {
+	for i := range policies {
+		if policies[i].selects(wgPeer) {
+			return true
+		}
+	}
+	return false
+}
+
+// meshPolicyAllows returns true if the policies allow src to reach dst on any port.
+func meshPolicyAllows(policies []meshPolicy, src, dst *wgk8s.WireGuardPeer) bool {
+	isolated := false
+	for i := range policies {
+		p := &policies[i]
+		if !p.selects(dst) {
+			continue
+		}
+		isolated = true
+		for j := range p.ingress {
+			if p.ingress[j].admits(p.namespace, src) {
+				return true
+			}
+		}
+	}
+	return !isolated
+}
+
+// narrowAllowedIPs drops a peer's own mesh addresses from its allowed IPs when the policies allow
+// traffic neither from it to the local peer, nor from the local peer to it, so its packets are
+// dropped by WireGuard before they reach the firewall. A local peer which forwards traffic between
+// other peers, as a hub or gateway, or by reflecting routes, keeps every address. The caller must
+// hold the lock.
+func (pt *peerTracker) narrowAllowedIPs(wgPeer *wgk8s.WireGuardPeer, allowedIPs []net.IPNet) []net.IPNet {
+	if pt.policyFirewall == nil || pt.localPeer == nil || pt.localForwards() {
+		return allowedIPs
+	}
+	if meshPolicyAllows(pt.meshPolicies, wgPeer, pt.localPeer) || meshPolicyAllows(pt.meshPolicies, pt.localPeer, wgPeer) {
+		return allowedIPs
+	}
+	own := make(map[string]bool, len(wgPeer.Spec.IPs))
+	for _, ipStr := range wgPeer.Spec.IPs {
+		if ip, _, err := net.ParseCIDR(ipStr); err == nil {
+			own[ip.String()] = true
+		}
+	}
+	out := make([]net.IPNet, 0, len(allowedIPs))
+	for _, n := range allowedIPs {
+		if ones, bits := n.Mask.Size(); ones == bits && own[n.IP.String()] {
+			continue
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// localForwards returns true if the local peer carries traffic between other peers. The caller must
+// hold the lock.
+func (pt *peerTracker) localForwards() bool {
+	return (pt.topology.hubs != nil && pt.topology.isHub(pt.localPeer)) || len(pt.localPeer.Spec.ReflectedRoutes) > 0
+}
+
+// meshPolicyRules returns the nftables rules accepting the traffic the policies allow to the local
+// peer, and whether it's isolated at all. The caller must hold the lock.
+func (pt *peerTracker) meshPolicyRules() ([]string, bool) {
+	if pt.localPeer == nil || !meshPolicyIsolated(pt.meshPolicies, pt.localPeer) {
+		return nil, false
+	}
+	peers := pt.listPeers()
+	names := make([]string, 0, len(peers))
+	for name := range peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seen := make(map[string]bool)
+	var out []string
+	add := func(rule string) {
+		if !seen[rule] {
+			seen[rule] = true
+			out = append(out, rule)
+		}
+	}
+	for i := range pt.meshPolicies {
+		p := &pt.meshPolicies[i]
+		if !p.selects(pt.localPeer) {
+			continue
+		}
+		for j := range p.ingress {
+			r := &p.ingress[j]
+			var sources []string
+			if len(r.from) == 0 {
+				sources = []string{""}
+			} else {
+				for _, name := range names {
+					if wgPeer := peers[name]; r.admits(p.namespace, wgPeer) {
+						sources = append(sources, peerSourceMatches(wgPeer)...)
+					}
+				}
+			}
+			for _, src := range sources {
+				for _, port := range portMatches(r.ports) {
+					add(strings.TrimSpace(src + " " + port + " accept"))
+				}
+			}
+		}
+	}
+	return out, true
+}
+
+// peerSourceMatches returns nftables matches for packets from each of the peer's mesh addresses.
+func peerSourceMatches(wgPeer *wgk8s.WireGuardPeer) []string {
+	var out []string
+	for _, ipStr := range wgPeer.Spec.IPs {
+		ip, _, err := net.ParseCIDR(ipStr)
+		if err != nil {
+			continue
+		}
+		if ip.To4() != nil {
+			out = append(out, "ip saddr "+ip.String())
+		} else {
+			out = append(out, "ip6 saddr "+ip.String())
+		}
+	}
+	return out
+}
+
+// portMatches returns nftables matches for packets to each of the ports, or a match of every
+// packet if there are none.
+func portMatches(ports []wgk8s.MeshPolicyPort) []string {
+	if len(ports) == 0 {
+		return []string{""}
+	}
+	out := make([]string, 0, len(ports))
+	for _, p := range ports {
+		proto := p.Protocol
+		if proto == "" {
+			proto = corev1.ProtocolTCP
+		}
+		l4 := strings.ToLower(string(proto))
+		switch {
+		case p.Port == 0:
+			out = append(out, "meta l4proto "+l4)
+		case p.EndPort > p.Port:
+			out = append(out, fmt.Sprintf("%s dport %d-%d", l4, p.Port, p.EndPort))
+		default:
+			out = append(out, fmt.Sprintf("%s dport %d", l4, p.Port))
+		}
+	}
+	return out
+}
+
+// meshPolicyFirewall maintains an nftables table which filters the traffic the interface delivers
+// to the local peer, accepting established connections and what the mesh policies allow, and
+// dropping the rest. Traffic arriving through other interfaces, or forwarded, is left alone. The
+// table is replaced atomically as the rules change, and removed while no policy isolates the peer.
+type meshPolicyFirewall struct {
+	iface string
+	// run runs nft with args, feeding it stdin, and returns its combined output.
+	run func(stdin string, args ...string) ([]byte, error)
+	// installed holds the rules last installed, or nil if the table isn't.
+	installed []string
+	// synced is set once the table is known to match installed, ex. after a table left by a
+	// previous run has been removed.
+	synced bool
+}
+
+func newMeshPolicyFirewall(iface string) *meshPolicyFirewall {
+	return &meshPolicyFirewall{
+		iface: iface,
+		run: func(stdin string, args ...string) ([]byte, error) {
+			cmd := exec.Command("nft", args...)
+			cmd.Stdin = strings.NewReader(stdin)
+			return cmd.CombinedOutput()
+		},
+	}
+}
+
+func (f *meshPolicyFirewall) table() string {
+	return "inet " + meshPolicyTablePrefix + f.iface
+}
+
+// sync installs the rules, or removes the table if the local peer isn't isolated.
+func (f *meshPolicyFirewall) sync(rules []string, isolated bool) error {
+	if !isolated {
+		if f.synced && f.installed == nil {
+			return nil
+		}
+		return f.remove()
+	}
+	if rules == nil {
+		rules = []string{}
+	}
+	if f.synced && reflect.DeepEqual(f.installed, rules) {
+		return nil
+	}
+	var b strings.Builder
+	// Declaring the table first lets it be deleted whether or not it exists.
+	fmt.Fprintf(&b, "table %s\ndelete table %s\ntable %s {\n", f.table(), f.table(), f.table())
+	b.WriteString("\tchain input {\n\t\ttype filter hook input priority 0; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname != %q accept\n", f.iface)
+	b.WriteString("\t\tct state established,related accept\n")
+	for _, r := range rules {
+		fmt.Fprintf(&b, "\t\t%s\n", r)
+	}
+	b.WriteString("\t\tdrop\n\t}\n}\n")
+	if err := f.nft(b.String()); err != nil {
+		return err
+	}
+	f.installed, f.synced = rules, true
+	return nil
+}
+
+// remove removes the table, if it exists.
+func (f *meshPolicyFirewall) remove() error {
+	if err := f.nft(fmt.Sprintf("table %s\ndelete table %s\n", f.table(), f.table())); err != nil {
+		return err
+	}
+	f.installed, f.synced = nil, true
+	return nil
+}
+
+// nft runs the nftables script, failing with nft's output.
+func (f *meshPolicyFirewall) nft(script string) error {
+	out, err := f.run(script, "-f", "-")
+	if err != nil {
+		return fmt.Errorf("running nft -f -: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// syncMeshPolicyRules makes the firewall match the mesh policies, if they're enforced. The caller
+// must hold the lock.
+func (pt *peerTracker) syncMeshPolicyRules() error {
+	if pt.policyFirewall == nil {
+		return nil
+	}
+	rules, isolated := pt.meshPolicyRules()
+	if err := pt.policyFirewall.sync(rules, isolated); err != nil {
+		return fmt.Errorf("installing mesh policy rules: %w", err)
+	}
+	return nil
+}
+
+// setMeshPolicies changes the mesh policies enforced and, once the initial config has been applied,
+// reconfigures peers and the firewall to match them.
+func (pt *peerTracker) setMeshPolicies(policies []meshPolicy) error {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.meshPolicies = policies
+	if !pt.initialConfigApplied {
+		return nil
+	}
+	return pt.sync()
+}
+
+// removeMeshPolicyRules removes the firewall's table, if any, ex. before the interface is deleted.
+func (pt *peerTracker) removeMeshPolicyRules() error {
+	pt.Lock()
+	defer pt.Unlock()
+	if pt.policyFirewall == nil || (pt.policyFirewall.synced && pt.policyFirewall.installed == nil) {
+		return nil
+	}
+	return pt.policyFirewall.remove()
+}
+
+// watchMeshPolicies tracks the WireGuardMeshPolicies of the registry namespace. It returns once the
+// initial policies have been loaded, so the initial config already enforces them.
+func (a *Agent) watchMeshPolicies(ctx context.Context) error {
+	lw := a.registryHealth.listWatch(ctx, a.registry.WatchPolicies())
+	_, err := lw.List(metav1.ListOptions{Limit: 1})
+	if k8sErrors.IsNotFound(err) {
+		return fmt.Errorf("enforcing mesh policies requires the WireGuardMeshPolicy resource, which isn't installed in the registry")
+	}
+	if err != nil {
+		return fmt.Errorf("listing WireGuardMeshPolicies: %w", err)
+	}
+	informer := cache.NewSharedIndexInformer(lw, &wgk8s.WireGuardMeshPolicy{}, a.resyncPeriod, cache.Indexers{})
+	onChange := func() { a.onMeshPolicyChange(informer.GetStore()) }
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { onChange() },
+		UpdateFunc: func(interface{}, interface{}) { onChange() },
+		DeleteFunc: func(interface{}) { onChange() },
+	})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		informer.Run(ctx.Done())
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync WireGuardMeshPolicies")
+	}
+	onChange()
+	return nil
+}
+
+// onMeshPolicyChange applies the policies in the store.
+func (a *Agent) onMeshPolicyChange(store cache.Store) {
+	var policies []*wgk8s.WireGuardMeshPolicy
+	for _, obj := range store.List() {
+		if p, ok := obj.(*wgk8s.WireGuardMeshPolicy); ok {
+			policies = append(policies, p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].GetName() < policies[j].GetName() })
+
+	a.meshLock.Lock()
+	defer a.meshLock.Unlock()
+	if meshPoliciesEqual(policies, a.meshPolicies) {
+		return
+	}
+	a.meshPolicies = policies
+	a.ll.WithField("mesh_policies", len(policies)).Info("mesh policies changed")
+	if a.peerTracker == nil {
+		return
+	}
+	if err := a.peerTracker.setMeshPolicies(compileMeshPolicies(a.ll, policies)); err != nil {
+		a.ll.WithError(err).Error("failed to apply mesh policies")
+	}
+}
+
+// meshPoliciesEqual returns true if the policies, sorted by name, have the same names and specs.
+func meshPoliciesEqual(a, b []*wgk8s.WireGuardMeshPolicy) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].GetName() != b[i].GetName() || a[i].GetNamespace() != b[i].GetNamespace() ||
+			!reflect.DeepEqual(a[i].Spec, b[i].Spec) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+func testMeshPolicy(name string, selects map[string]string, ingress ...wgk8s.MeshPolicyIngressRule) *wgk8s.WireGuardMeshPolicy {
+	return &wgk8s.WireGuardMeshPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+		Spec: wgk8s.WireGuardMeshPolicySpec{
+			PeerSelector: metav1.LabelSelector{MatchLabels: selects},
+			Ingress:      ingress,
+		},
+	}
+}
+
+func fromPeers(lbls map[string]string) []wgk8s.MeshPolicyPeer {
+	return []wgk8s.MeshPolicyPeer{{PeerSelector: metav1.LabelSelector{MatchLabels: lbls}}}
+}
+
+func TestMeshPolicyAllows(t *testing.T) {
+	web := testPeer("web", map[string]string{"app": "web"}, "10.0.0.1/32")
+	db := testPeer("db", map[string]string{"app": "db"}, "10.0.0.2/32")
+	batch := testPeer("batch", map[string]string{"app": "batch"}, "10.0.0.3/32")
+	otherNS := testPeerIn("other", "web", "10.1.0.1/32")
+	otherNS.SetLabels(map[string]string{"app": "web"})
+
+	policies := compileMeshPolicies(logrus.New(), []*wgk8s.WireGuardMeshPolicy{
+		testMeshPolicy("db", map[string]string{"app": "db"}, wgk8s.MeshPolicyIngressRule{
+			From:  fromPeers(map[string]string{"app": "web"}),
+			Ports: []wgk8s.MeshPolicyPort{{Port: 5432}},
+		}),
+	})
+	require.True(t, meshPolicyAllows(policies, web, db))
+	require.False(t, meshPolicyAllows(policies, batch, db))
+	require.False(t, meshPolicyAllows(policies, otherNS, db), "selectors only match peers of the policy's namespace")
+	require.True(t, meshPolicyAllows(policies, db, web), "unselected peers aren't isolated")
+	require.True(t, meshPolicyAllows(policies, batch, web))
+
+	denyAll := compileMeshPolicies(logrus.New(), []*wgk8s.WireGuardMeshPolicy{testMeshPolicy("deny", nil)})
+	require.False(t, meshPolicyAllows(denyAll, web, db), "an empty selector isolates every peer")
+
+	invalid := testMeshPolicy("invalid", map[string]string{"app": "web"}, wgk8s.MeshPolicyIngressRule{
+		From: []wgk8s.MeshPolicyPeer{{PeerSelector: metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "app", Operator: "Bogus"},
+		}}}},
+	})
+	invalid.Spec.PeerSelector.MatchExpressions = []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Bogus"}}
+	closed := compileMeshPolicies(logrus.New(), []*wgk8s.WireGuardMeshPolicy{invalid})
+	require.False(t, meshPolicyAllows(closed, web, batch), "invalid selectors fail closed")
+}
+
+func TestMeshPolicyRules(t *testing.T) {
+	local := testPeer("local", map[string]string{"app": "db"}, "10.0.0.10/32")
+	pt := &peerTracker{
+		ll:        logrus.New(),
+		localPeer: local,
+		registry: testRegistry(
+			testPeer("web", map[string]string{"app": "web"}, "10.0.0.1/32", "fd00::1/128"),
+			testPeer("batch", map[string]string{"app": "batch"}, "10.0.0.3/32"),
+		),
+	}
+	rules, isolated := pt.meshPolicyRules()
+	require.False(t, isolated)
+	require.Empty(t, rules)
+
+	pt.meshPolicies = compileMeshPolicies(pt.ll, []*wgk8s.WireGuardMeshPolicy{
+		testMeshPolicy("db", map[string]string{"app": "db"},
+			wgk8s.MeshPolicyIngressRule{
+				From: fromPeers(map[string]string{"app": "web"}),
+				Ports: []wgk8s.MeshPolicyPort{
+					{Port: 5432},
+					{Protocol: corev1.ProtocolUDP, Port: 8000, EndPort: 8010},
+				},
+			},
+			wgk8s.MeshPolicyIngressRule{Ports: []wgk8s.MeshPolicyPort{{Protocol: corev1.ProtocolUDP}}},
+		),
+		testMeshPolicy("web", map[string]string{"app": "web"}),
+	})
+	rules, isolated = pt.meshPolicyRules()
+	require.True(t, isolated)
+	require.Equal(t, []string{
+		"ip saddr 10.0.0.1 tcp dport 5432 accept",
+		"ip saddr 10.0.0.1 udp dport 8000-8010 accept",
+		"ip6 saddr fd00::1 tcp dport 5432 accept",
+		"ip6 saddr fd00::1 udp dport 8000-8010 accept",
+		"meta l4proto udp accept",
+	}, rules)
+}
+
+func TestNarrowAllowedIPs(t *testing.T) {
+	local := testPeer("local", map[string]string{"app": "db"}, "10.0.0.10/32")
+	web := testPeer("web", map[string]string{"app": "web"}, "10.0.0.1/32")
+	batch := testPeer("batch", map[string]string{"app": "batch"}, "10.0.0.3/32")
+	batch.Spec.Routes = []string{"192.168.3.0/24"}
+	pt := &peerTracker{
+		ll:             logrus.New(),
+		localPeer:      local,
+		policyFirewall: newMeshPolicyFirewall("wg0"),
+	}
+	pt.meshPolicies = compileMeshPolicies(pt.ll, []*wgk8s.WireGuardMeshPolicy{
+		testMeshPolicy("db", map[string]string{"app": "db"}, wgk8s.MeshPolicyIngressRule{
+			From: fromPeers(map[string]string{"app": "web"}),
+		}),
+		testMeshPolicy("batch", map[string]string{"app": "batch"}),
+	})
+	allowed := func(wgPeer *wgk8s.WireGuardPeer) []string {
+		prefixes, err := peerPrefixes(wgPeer)
+		require.NoError(t, err)
+		return ipNetStrings(pt.narrowAllowedIPs(wgPeer, prefixes))
+	}
+	require.Equal(t, []string{"10.0.0.1/32"}, allowed(web), "web may reach us")
+	require.Equal(t, []string{"192.168.3.0/24"}, allowed(batch), "neither may reach the other")
+
+	pt.localPeer.Spec.ReflectedRoutes = []wgk8s.ReflectedRoute{{CIDR: "10.9.0.0/16", Path: []string{"x"}}}
+	require.Equal(t, []string{"10.0.0.3/32", "192.168.3.0/24"}, allowed(batch), "peers forwarding traffic keep every address")
+
+	pt.localPeer.Spec.ReflectedRoutes = nil
+	pt.policyFirewall = nil
+	require.Equal(t, []string{"10.0.0.3/32", "192.168.3.0/24"}, allowed(batch), "policies aren't enforced")
+}
+
+func TestMeshPolicyFirewall(t *testing.T) {
+	var scripts []string
+	f := newMeshPolicyFirewall("wg0")
+	f.run = func(stdin string, args ...string) ([]byte, error) {
+		require.Equal(t, []string{"-f", "-"}, args)
+		scripts = append(scripts, stdin)
+		return nil, nil
+	}
+
+	require.NoError(t, f.sync(nil, false))
+	require.Equal(t, []string{
+		"table inet wgmesh-policy-wg0\ndelete table inet wgmesh-policy-wg0\n",
+	}, scripts, "a table left by a previous run is removed")
+	scripts = nil
+	require.NoError(t, f.sync(nil, false))
+	require.Empty(t, scripts)
+
+	require.NoError(t, f.sync([]string{"ip saddr 10.0.0.1 tcp dport 5432 accept"}, true))
+	require.Equal(t, []string{`table inet wgmesh-policy-wg0
+delete table inet wgmesh-policy-wg0
+table inet wgmesh-policy-wg0 {
+	chain input {
+		type filter hook input priority 0; policy accept;
+		iifname != "wg0" accept
+		ct state established,related accept
+		ip saddr 10.0.0.1 tcp dport 5432 accept
+		drop
+	}
+}
+`}, scripts)
+	scripts = nil
+	require.NoError(t, f.sync([]string{"ip saddr 10.0.0.1 tcp dport 5432 accept"}, true))
+	require.Empty(t, scripts, "unchanged rules are left alone")
+
+	require.NoError(t, f.sync(nil, true))
+	require.Len(t, scripts, 1)
+	require.NotContains(t, scripts[0], "saddr", "an isolated peer with no allowed sources drops everything")
+
+	scripts = nil
+	require.NoError(t, f.sync(nil, false))
+	require.Equal(t, []string{"table inet wgmesh-policy-wg0\ndelete table inet wgmesh-policy-wg0\n"}, scripts)
+
+	f.run = func(stdin string, args ...string) ([]byte, error) {
+		return []byte("Error: Could not process rule: Operation not permitted"), errors.New("exit status 1")
+	}
+	require.EqualError(t, f.sync([]string{"meta l4proto udp accept"}, true),
+		"running nft -f -: exit status 1: Error: Could not process rule: Operation not permitted")
+}
+
+func TestOnMeshPolicyChange(t *testing.T) {
+	var scripts []string
+	pt := &peerTracker{
+		// Without peers, syncing never configures the interface.
+		ll:                   logrus.New(),
+		registry:             newPeerStore(),
+		localPeer:            testPeer("local", map[string]string{"app": "db"}, "10.0.0.10/32"),
+		initialConfigApplied: true,
+		policyFirewall:       newMeshPolicyFirewall("wg0"),
+	}
+	pt.policyFirewall.run = func(stdin string, args ...string) ([]byte, error) {
+		scripts = append(scripts, stdin)
+		return nil, nil
+	}
+	a := &Agent{options: defaultOptions(), peerTracker: pt}
+	a.ll = logrus.New()
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	require.NoError(t, store.Add(testMeshPolicy("db", map[string]string{"app": "db"})))
+	a.onMeshPolicyChange(store)
+	require.Len(t, scripts, 1)
+	require.Contains(t, scripts[0], "drop", "the local peer is isolated")
+
+	scripts = nil
+	a.onMeshPolicyChange(store)
+	require.Empty(t, scripts, "unchanged policies aren't reapplied")
+
+	require.NoError(t, store.Delete(testMeshPolicy("db", nil)))
+	a.onMeshPolicyChange(store)
+	require.Equal(t, []string{"table inet wgmesh-policy-wg0\ndelete table inet wgmesh-policy-wg0\n"}, scripts)
+	require.Empty(t, a.meshPolicies)
+}
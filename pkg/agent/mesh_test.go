@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestSelectMesh(t *testing.T) {
+	mesh := func(name string, selector *metav1.LabelSelector) *wgk8s.Mesh {
+		return &wgk8s.Mesh{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       wgk8s.MeshSpec{PeerSelector: selector},
+		}
+	}
+	site := &metav1.LabelSelector{MatchLabels: map[string]string{"site": "a"}}
+	invalid := &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "site", Operator: "Bogus"},
+	}}
+	tcs := []struct {
+		name          string
+		meshes        []*wgk8s.Mesh
+		labels        labels.Set
+		expect        string
+		expectIgnored []string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:   "no selector matches everything",
+			meshes: []*wgk8s.Mesh{mesh("default", nil)},
+			expect: "default",
+		},
+		{
+			name:   "selector mismatch",
+			meshes: []*wgk8s.Mesh{mesh("site-a", site)},
+			labels: labels.Set{"site": "b"},
+		},
+		{
+			name:          "first by name",
+			meshes:        []*wgk8s.Mesh{mesh("z-default", nil), mesh("site-a", site), mesh("bad", invalid)},
+			labels:        labels.Set{"site": "a"},
+			expect:        "site-a",
+			expectIgnored: []string{"z-default"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			selected, ignored := selectMesh(logrus.New(), tc.meshes, tc.labels)
+			if tc.expect == "" {
+				require.Nil(t, selected)
+			} else {
+				require.NotNil(t, selected)
+				require.Equal(t, tc.expect, selected.GetName())
+			}
+			require.Equal(t, tc.expectIgnored, ignored)
+		})
+	}
+}
+
+func TestApplyMeshSettingsKeepalive(t *testing.T) {
+	tcs := []struct {
+		name      string
+		keepalive time.Duration
+		mesh      *wgk8s.Mesh
+		expect    time.Duration
+	}{
+		{
+			name: "no mesh",
+		},
+		{
+			name:   "mesh default",
+			mesh:   &wgk8s.Mesh{Spec: wgk8s.MeshSpec{KeepAliveSeconds: 25}},
+			expect: 25 * time.Second,
+		},
+		{
+			name:      "agent setting takes precedence",
+			keepalive: 10 * time.Second,
+			mesh:      &wgk8s.Mesh{Spec: wgk8s.MeshSpec{KeepAliveSeconds: 25}},
+			expect:    10 * time.Second,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cs := fake.NewSimpleClientset()
+			peer, err := cs.WgmeshV1alpha1().WireGuardPeers("ns").Create(&wgk8s.WireGuardPeer{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "local"},
+			})
+			require.NoError(t, err)
+			a := &Agent{options: defaultOptions()}
+			a.ll = logrus.New()
+			a.name = "local"
+			a.registryNamespace = "ns"
+			a.keepalive = tc.keepalive
+			a.registry = registry.NewKubernetes(cs, "ns")
+			a.localPeer = peer
+			a.peerTracker = &peerTracker{ll: a.ll}
+			a.mesh = tc.mesh
+
+			require.NoError(t, a.enableMeshUpdates())
+			require.Equal(t, tc.expect, a.peerTracker.keepalive)
+			published, err := cs.WgmeshV1alpha1().WireGuardPeers("ns").Get("local", metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, int(tc.expect.Seconds()), published.Spec.KeepAliveSeconds)
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the agent's Prometheus metrics. A nil *metrics discards updates, so peerTrackers built
+// without one, ex. in tests, needn't check.
+type metrics struct {
+	registry *prometheus.Registry
+
+	lastHandshake     *prometheus.GaugeVec
+	stale             *prometheus.GaugeVec
+	staleTotal        *prometheus.CounterVec
+	endpointRefreshes *prometheus.CounterVec
+	damped            *prometheus.GaugeVec
+	dampedTotal       *prometheus.CounterVec
+	quarantined       *prometheus.GaugeVec
+
+	probeUp       *prometheus.GaugeVec
+	probeRTT      *prometheus.HistogramVec
+	probesTotal   *prometheus.CounterVec
+	probeFailures *prometheus.CounterVec
+	pathMTU       *prometheus.GaugeVec
+
+	registryReachable prometheus.Gauge
+	registryFailures  *prometheus.CounterVec
+	registryBackoff   prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		lastHandshake: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_last_handshake_timestamp_seconds",
+			Help:      "Unix time of the peer's latest completed handshake, or 0 if it has never completed one.",
+		}, []string{"peer"}),
+		stale: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_stale",
+			Help:      "1 if traffic has been sent to the peer for the handshake timeout without a handshake completing, until one does.",
+		}, []string{"peer"}),
+		staleTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_stale_total",
+			Help:      "Times the peer has become stale.",
+		}, []string{"peer"}),
+		endpointRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_endpoint_refreshes_total",
+			Help:      "Times the peer's endpoint was re-resolved or failed over to another candidate because handshakes stopped completing.",
+		}, []string{"peer"}),
+		damped: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_damped",
+			Help:      "1 while the peer's changes are damped because its spec changed too often, until it settles.",
+		}, []string{"peer"}),
+		dampedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_damped_total",
+			Help:      "Times the peer has been damped.",
+		}, []string{"peer"}),
+		quarantined: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_quarantined",
+			Help:      "1 while the peer is held off the device because it never completed a handshake, until it does or changes.",
+		}, []string{"peer"}),
+
+		probeUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_probe_success",
+			Help:      "1 if the latest probe of the peer's mesh address was answered.",
+		}, []string{"peer", "ip"}),
+		probeRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_probe_rtt_seconds",
+			Help:      "Round trip time of answered probes of the peer's mesh address.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 13), // 0.5ms to ~2s
+		}, []string{"peer", "ip"}),
+		probesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_probes_total",
+			Help:      "Probes sent to the peer's mesh address.",
+		}, []string{"peer", "ip"}),
+		probeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_probe_failures_total",
+			Help:      "Probes of the peer's mesh address which weren't answered.",
+		}, []string{"peer", "ip"}),
+		pathMTU: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "wgmesh",
+			Name:      "peer_path_mtu_bytes",
+			Help:      "Largest packet the peer's probe echo server answered through the tunnel, up to the interface's untuned MTU.",
+		}, []string{"peer"}),
+
+		registryReachable: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "wgmesh",
+			Name:      "registry_reachable",
+			Help:      "1 if the latest request to list or watch the registry succeeded, 0 while the agent keeps its last known configuration.",
+		}),
+		registryFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "wgmesh",
+			Name:      "registry_request_failures_total",
+			Help:      "Requests to list or watch the registry which failed, by reason: unreachable, unauthorized, forbidden, throttled, rejected, or watch_closed for watches which closed soon after opening.",
+		}, []string{"reason"}),
+		registryBackoff: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "wgmesh",
+			Name:      "registry_backoff_seconds",
+			Help:      "Delay before the latest list or watch request to the registry, 0 unless earlier requests failed.",
+		}),
+	}
+	m.registry.MustRegister(m.lastHandshake, m.stale, m.staleTotal, m.endpointRefreshes, m.damped, m.dampedTotal, m.quarantined,
+		m.probeUp, m.probeRTT, m.probesTotal, m.probeFailures, m.pathMTU,
+		m.registryReachable, m.registryFailures, m.registryBackoff)
+	return m
+}
+
+func (m *metrics) observeHandshake(peer string, handshake time.Time) {
+	if m == nil {
+		return
+	}
+	var ts float64
+	if !handshake.IsZero() {
+		ts = float64(handshake.UnixNano()) / float64(time.Second)
+	}
+	m.lastHandshake.WithLabelValues(peer).Set(ts)
+}
+
+func (m *metrics) setStale(peer string, stale bool) {
+	if m == nil {
+		return
+	}
+	if stale {
+		m.stale.WithLabelValues(peer).Set(1)
+		m.staleTotal.WithLabelValues(peer).Inc()
+		return
+	}
+	m.stale.WithLabelValues(peer).Set(0)
+}
+
+func (m *metrics) setDamped(peer string, damped bool) {
+	if m == nil {
+		return
+	}
+	if damped {
+		m.damped.WithLabelValues(peer).Set(1)
+		m.dampedTotal.WithLabelValues(peer).Inc()
+		return
+	}
+	m.damped.WithLabelValues(peer).Set(0)
+}
+
+func (m *metrics) setQuarantined(peer string, quarantined bool) {
+	if m == nil {
+		return
+	}
+	if quarantined {
+		m.quarantined.WithLabelValues(peer).Set(1)
+		return
+	}
+	m.quarantined.WithLabelValues(peer).Set(0)
+}
+
+func (m *metrics) endpointRefreshed(peer string) {
+	if m == nil {
+		return
+	}
+	m.endpointRefreshes.WithLabelValues(peer).Inc()
+}
+
+// forgetPeer drops the series of a peer which was removed.
+func (m *metrics) forgetPeer(peer string) {
+	if m == nil {
+		return
+	}
+	m.lastHandshake.DeleteLabelValues(peer)
+	m.stale.DeleteLabelValues(peer)
+	m.staleTotal.DeleteLabelValues(peer)
+	m.endpointRefreshes.DeleteLabelValues(peer)
+	m.damped.DeleteLabelValues(peer)
+	m.dampedTotal.DeleteLabelValues(peer)
+	m.quarantined.DeleteLabelValues(peer)
+}
+
+func (m *metrics) observeProbe(peer, ip string, rtt time.Duration, ok bool) {
+	if m == nil {
+		return
+	}
+	m.probesTotal.WithLabelValues(peer, ip).Inc()
+	if !ok {
+		m.probeUp.WithLabelValues(peer, ip).Set(0)
+		m.probeFailures.WithLabelValues(peer, ip).Inc()
+		return
+	}
+	m.probeUp.WithLabelValues(peer, ip).Set(1)
+	// Create the failures series too, so failure ratios are zero, rather than missing, until a probe
+	// fails.
+	m.probeFailures.WithLabelValues(peer, ip)
+	m.probeRTT.WithLabelValues(peer, ip).Observe(rtt.Seconds())
+}
+
+// forgetProbe drops the probe series of a mesh address which is no longer probed.
+func (m *metrics) forgetProbe(peer, ip string) {
+	if m == nil {
+		return
+	}
+	m.probeUp.DeleteLabelValues(peer, ip)
+	m.probeRTT.DeleteLabelValues(peer, ip)
+	m.probesTotal.DeleteLabelValues(peer, ip)
+	m.probeFailures.DeleteLabelValues(peer, ip)
+}
+
+func (m *metrics) observePathMTU(peer string, mtu int) {
+	if m == nil {
+		return
+	}
+	m.pathMTU.WithLabelValues(peer).Set(float64(mtu))
+}
+
+// forgetPathMTU drops the path MTU series of a peer which is no longer measured.
+func (m *metrics) forgetPathMTU(peer string) {
+	if m == nil {
+		return
+	}
+	m.pathMTU.DeleteLabelValues(peer)
+}
+
+func (m *metrics) observeRegistry(err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.registryReachable.Set(0)
+		return
+	}
+	m.registryReachable.Set(1)
+}
+
+func (m *metrics) observeRegistryFailure(reason string) {
+	if m == nil {
+		return
+	}
+	m.registryFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) setRegistryBackoff(delay time.Duration) {
+	if m == nil {
+		return
+	}
+	m.registryBackoff.Set(delay.Seconds())
+}
+
+// serveMetrics serves the metrics at /metrics on the metrics address until the context is canceled.
+func (a *Agent) serveMetrics(ctx context.Context) error {
+	l, err := net.Listen("tcp", a.metricsAddr)
+	if err != nil {
+		return fmt.Errorf("listening for metrics on %q: %w", a.metricsAddr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(a.metrics.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		<-ctx.Done()
+		sCtx, cancel := context.WithTimeout(context.Background(), controlShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(sCtx)
+	}()
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		err := srv.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			a.ll.WithError(err).Error("metrics server failed")
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+// mssChainPrefix names the mangle table chain holding an interface's MSS clamping rules.
+const mssChainPrefix = "WGMESH-MSS-"
+
+// mssClamper maintains firewall rules which clamp the MSS of TCP connections forwarded through the
+// interface to and from routes, to the path MTU, so hosts behind gateways don't negotiate segments
+// too large for the tunnel. The rules live in their own chain of the mangle table, jumped to from
+// FORWARD, per family.
+type mssClamper struct {
+	iface string
+	// run runs an iptables command, returning its combined output.
+	run func(cmd string, args ...string) ([]byte, error)
+	// clamped holds the routes rules were last installed for, by iptables command.
+	clamped map[string][]string
+}
+
+func newMSSClamper(iface string) *mssClamper {
+	return &mssClamper{
+		iface: iface,
+		run: func(cmd string, args ...string) ([]byte, error) {
+			return exec.Command(cmd, args...).CombinedOutput()
+		},
+	}
+}
+
+func (c *mssClamper) chain() string {
+	return mssChainPrefix + c.iface
+}
+
+// sync makes the clamping rules match the routes, which must be CIDRs. Families without routes
+// have their chain removed.
+func (c *mssClamper) sync(routes []string) error {
+	byCmd := map[string][]string{"iptables": nil, "ip6tables": nil}
+	for _, r := range routes {
+		ip, _, err := net.ParseCIDR(r)
+		if err != nil {
+			return fmt.Errorf("clamping mss for route %q: %w", r, err)
+		}
+		cmd := "iptables"
+		if ip.To4() == nil {
+			cmd = "ip6tables"
+		}
+		byCmd[cmd] = append(byCmd[cmd], r)
+	}
+	if c.clamped == nil {
+		c.clamped = make(map[string][]string)
+	}
+	for cmd, routes := range byCmd {
+		current, installed := c.clamped[cmd]
+		if installed && reflect.DeepEqual(current, routes) {
+			continue
+		}
+		if len(routes) == 0 {
+			if installed {
+				if err := c.removeChain(cmd); err != nil {
+					return err
+				}
+				delete(c.clamped, cmd)
+			}
+			continue
+		}
+		if err := c.installChain(cmd, routes); err != nil {
+			return err
+		}
+		c.clamped[cmd] = routes
+	}
+	return nil
+}
+
+// installChain replaces the rules in the family's chain with those for routes.
+func (c *mssClamper) installChain(cmd string, routes []string) error {
+	chain := c.chain()
+	// Creating the chain fails if it exists, ex. left by a previous run, which flushing handles.
+	c.run(cmd, "-w", "-t", "mangle", "-N", chain)
+	if err := c.iptables(cmd, "-t", "mangle", "-F", chain); err != nil {
+		return err
+	}
+	clamp := []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--clamp-mss-to-pmtu"}
+	for _, r := range routes {
+		out := append([]string{"-t", "mangle", "-A", chain, "-o", c.iface, "-d", r}, clamp...)
+		if err := c.iptables(cmd, out...); err != nil {
+			return err
+		}
+		in := append([]string{"-t", "mangle", "-A", chain, "-i", c.iface, "-s", r}, clamp...)
+		if err := c.iptables(cmd, in...); err != nil {
+			return err
+		}
+	}
+	if c.iptables(cmd, "-t", "mangle", "-C", "FORWARD", "-j", chain) == nil {
+		return nil
+	}
+	return c.iptables(cmd, "-t", "mangle", "-A", "FORWARD", "-j", chain)
+}
+
+// removeChain removes the family's chain and the jump to it.
+func (c *mssClamper) removeChain(cmd string) error {
+	chain := c.chain()
+	if err := c.iptables(cmd, "-t", "mangle", "-D", "FORWARD", "-j", chain); err != nil {
+		return err
+	}
+	if err := c.iptables(cmd, "-t", "mangle", "-F", chain); err != nil {
+		return err
+	}
+	return c.iptables(cmd, "-t", "mangle", "-X", chain)
+}
+
+// remove removes every chain we installed.
+func (c *mssClamper) remove() error {
+	for cmd := range c.clamped {
+		if err := c.removeChain(cmd); err != nil {
+			return err
+		}
+		delete(c.clamped, cmd)
+	}
+	return nil
+}
+
+func (c *mssClamper) iptables(cmd string, args ...string) error {
+	return runIPTables(c.run, cmd, args...)
+}
+
+// runIPTables runs the iptables command with run, waiting for the xtables lock, and fails with its
+// output.
+func runIPTables(run func(cmd string, args ...string) ([]byte, error), cmd string, args ...string) error {
+	args = append([]string{"-w"}, args...)
+	out, err := run(cmd, args...)
+	if err != nil {
+		return fmt.Errorf("running %s %s: %w: %s", cmd, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// clampMSSRoutes returns the routes, offered by the local peer or an applied peer, whose forwarded
+// TCP connections should be clamped. The caller must hold the lock.
+func (pt *peerTracker) clampMSSRoutes() []string {
+	seen := make(map[string]bool)
+	var out []string
+	add := func(wgPeer *wgk8s.WireGuardPeer) {
+		offered := make(map[string]bool, len(wgPeer.Spec.Routes))
+		for _, r := range wgPeer.Spec.Routes {
+			offered[r] = true
+		}
+		for _, r := range wgPeer.Spec.ClampMSSRoutes {
+			if _, _, err := net.ParseCIDR(r); err != nil || !offered[r] || seen[r] {
+				continue
+			}
+			seen[r] = true
+			out = append(out, r)
+		}
+	}
+	if pt.localPeer != nil {
+		add(pt.localPeer)
+	}
+	for name := range pt.applied {
+		if wgPeer, ok := pt.peer(name); ok {
+			add(wgPeer)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// removeMSSClamping removes the clamping rules, if any, ex. before the interface is deleted.
+func (pt *peerTracker) removeMSSClamping() error {
+	pt.Lock()
+	defer pt.Unlock()
+	if pt.mssClamp == nil {
+		return nil
+	}
+	return pt.mssClamp.remove()
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestMSSClamper(t *testing.T) {
+	var cmds []string
+	// chains holds the chains which exist, by command.
+	chains := map[string]bool{}
+	c := newMSSClamper("wg0")
+	c.run = func(cmd string, args ...string) ([]byte, error) {
+		line := cmd + " " + strings.Join(args, " ")
+		cmds = append(cmds, line)
+		switch {
+		case strings.Contains(line, " -N "):
+			if chains[cmd] {
+				return []byte("Chain already exists."), errors.New("exit status 1")
+			}
+			chains[cmd] = true
+		case strings.Contains(line, " -X "):
+			delete(chains, cmd)
+		case strings.Contains(line, " -C FORWARD"):
+			return []byte("Bad rule"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}
+
+	require.NoError(t, c.sync([]string{"10.1.0.0/16"}))
+	require.Equal(t, []string{
+		"iptables -w -t mangle -N WGMESH-MSS-wg0",
+		"iptables -w -t mangle -F WGMESH-MSS-wg0",
+		"iptables -w -t mangle -A WGMESH-MSS-wg0 -o wg0 -d 10.1.0.0/16 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu",
+		"iptables -w -t mangle -A WGMESH-MSS-wg0 -i wg0 -s 10.1.0.0/16 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu",
+		"iptables -w -t mangle -C FORWARD -j WGMESH-MSS-wg0",
+		"iptables -w -t mangle -A FORWARD -j WGMESH-MSS-wg0",
+	}, cmds)
+
+	cmds = nil
+	require.NoError(t, c.sync([]string{"10.1.0.0/16"}))
+	require.Empty(t, cmds, "unchanged routes are left alone")
+
+	require.NoError(t, c.sync([]string{"fd00:1::/64"}))
+	require.Contains(t, cmds, "ip6tables -w -t mangle -A WGMESH-MSS-wg0 -o wg0 -d fd00:1::/64 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu")
+	require.Contains(t, cmds, "iptables -w -t mangle -X WGMESH-MSS-wg0", "the IPv4 chain is removed")
+	require.Equal(t, map[string]bool{"ip6tables": true}, chains)
+
+	require.NoError(t, c.remove())
+	require.Empty(t, chains)
+	require.Empty(t, c.clamped)
+
+	c.run = func(cmd string, args ...string) ([]byte, error) {
+		return []byte("iptables: No chain/target/match by that name."), errors.New("exit status 1")
+	}
+	require.EqualError(t, c.sync([]string{"10.1.0.0/16"}),
+		"running iptables -w -t mangle -F WGMESH-MSS-wg0: exit status 1: iptables: No chain/target/match by that name.")
+}
+
+func TestClampMSSRoutes(t *testing.T) {
+	local := testPeer("local", nil)
+	local.Spec.Routes = []string{"192.168.0.0/24"}
+	local.Spec.ClampMSSRoutes = []string{"192.168.0.0/24"}
+	a := testPeer("a", nil)
+	a.Spec.Routes = []string{"10.1.0.0/16", "10.2.0.0/16"}
+	a.Spec.ClampMSSRoutes = []string{"10.2.0.0/16", "10.3.0.0/16", "bogus"}
+	b := testPeer("b", nil)
+	b.Spec.Routes = []string{"10.2.0.0/16"}
+	b.Spec.ClampMSSRoutes = []string{"10.2.0.0/16"}
+	unapplied := testPeer("unapplied", nil)
+	unapplied.Spec.Routes = []string{"10.4.0.0/16"}
+	unapplied.Spec.ClampMSSRoutes = []string{"10.4.0.0/16"}
+	pt := &peerTracker{
+		localPeer: local,
+		registry:  testRegistry(a, b, unapplied),
+		applied:   map[string]wgtypes.PeerConfig{a.GetSelfLink(): {}, b.GetSelfLink(): {}},
+	}
+	require.Equal(t, []string{"10.2.0.0/16", "192.168.0.0/24"}, pt.clampMSSRoutes(),
+		"routes which aren't offered, or are invalid, are ignored")
+}
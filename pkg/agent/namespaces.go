@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchPeerNamespaces meshes with the peers of each peer namespace whose Meshes share them with the
+// agent's namespace. It returns once each namespace's Meshes and peers are synced.
+func (a *Agent) watchPeerNamespaces(ctx context.Context) error {
+	for _, ns := range a.peerNamespaces {
+		r := a.peerNamespaceRegistries[ns]
+		meshLW := a.registryHealth.listWatch(ctx, r.WatchMeshes())
+		_, err := meshLW.List(metav1.ListOptions{Limit: 1})
+		if k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("peer namespaces require the Mesh resource, which isn't installed in the registry")
+		}
+		if err != nil {
+			return fmt.Errorf("listing Meshes in peer namespace %q: %w", ns, err)
+		}
+		meshes := cache.NewSharedIndexInformer(meshLW, &wgk8s.Mesh{}, a.resyncPeriod, cache.Indexers{})
+		ns := ns
+		onChange := func() { a.onPeerNamespaceMeshChange(ns, meshes.GetStore()) }
+		meshes.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { onChange() },
+			UpdateFunc: func(interface{}, interface{}) { onChange() },
+			DeleteFunc: func(interface{}) { onChange() },
+		})
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			meshes.Run(ctx.Done())
+		}()
+		if !cache.WaitForCacheSync(ctx.Done(), meshes.HasSynced) {
+			return fmt.Errorf("failed to sync Meshes in peer namespace %q", ns)
+		}
+		// Learn whether the namespace is shared before its peers are added, so they aren't rejected
+		// in the meantime.
+		onChange()
+
+		peers := cache.NewSharedIndexInformer(
+			a.registryHealth.listWatch(ctx, r.WatchPeers(a.peerSelector, nil)),
+			&wgk8s.WireGuardPeer{},
+			a.resyncPeriod,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		)
+		peers.AddEventHandler(a.peerTracker)
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			peers.Run(ctx.Done())
+		}()
+		if !cache.WaitForCacheSync(ctx.Done(), peers.HasSynced) {
+			return fmt.Errorf("failed to sync WireGuardPeers in peer namespace %q", ns)
+		}
+		a.ll.WithField("peer_namespace", ns).Info("synced peers from peer namespace")
+	}
+	return nil
+}
+
+// onPeerNamespaceMeshChange records whether the peer namespace's Meshes share its peers with the
+// agent's namespace, adding or removing its peers.
+func (a *Agent) onPeerNamespaceMeshChange(ns string, store cache.Store) {
+	shared := false
+	for _, obj := range store.List() {
+		if m, ok := obj.(*wgk8s.Mesh); ok && containsString(m.Spec.SharedWithNamespaces, a.registryNamespace) {
+			shared = true
+		}
+	}
+	a.meshLock.Lock()
+	defer a.meshLock.Unlock()
+	if a.sharedNamespaces[ns] == shared {
+		return
+	}
+	ll := a.ll.WithField("peer_namespace", ns)
+	// The peer tracker holds the previous set, so it's replaced rather than modified.
+	namespaces := make(map[string]bool, len(a.sharedNamespaces)+1)
+	for n := range a.sharedNamespaces {
+		namespaces[n] = true
+	}
+	if shared {
+		ll.Info("peer namespace shares its peers with the agent's namespace")
+		namespaces[ns] = true
+	} else {
+		ll.Warn("peer namespace doesn't share its peers with the agent's namespace; ignoring its peers")
+		delete(namespaces, ns)
+	}
+	a.sharedNamespaces = namespaces
+	if a.peerTracker == nil {
+		return
+	}
+	if err := a.peerTracker.setSharedNamespaces(namespaces); err != nil {
+		ll.WithError(err).Error("failed to apply shared namespaces")
+	}
+}
+
+// namespaceRejection returns the reason the peer is rejected for being in another namespace, which
+// doesn't share its peers with ours, and a message describing it, or "" if it's admitted. The caller
+// must hold the lock.
+func (pt *peerTracker) namespaceRejection(wgPeer *wgk8s.WireGuardPeer) (reason, msg string) {
+	ns := wgPeer.GetNamespace()
+	if pt.namespace == "" || ns == pt.namespace || pt.sharedNamespaces[ns] {
+		return "", ""
+	}
+	return reasonNamespaceNotShared, fmt.Sprintf("WireGuardPeer's namespace %s doesn't share its peers with namespace %s", ns, pt.namespace)
+}
+
+// setSharedNamespaces changes the other namespaces whose peers are configured, removing the peers
+// of namespaces no longer shared, and restoring those of namespaces which now are.
+func (pt *peerTracker) setSharedNamespaces(namespaces map[string]bool) error {
+	pt.Lock()
+	defer pt.Unlock()
+	if revokedKeysEqual(pt.sharedNamespaces, namespaces) {
+		return nil
+	}
+	pt.sharedNamespaces = namespaces
+	return pt.applyPolicy()
+}
+
+// qualifiedName returns the peer's name, qualified with its namespace if it's in another namespace
+// than ours, so peers of the same name in different namespaces are told apart.
+func (pt *peerTracker) qualifiedName(wgPeer *wgk8s.WireGuardPeer) string {
+	if pt.namespace == "" || wgPeer.GetNamespace() == pt.namespace {
+		return wgPeer.GetName()
+	}
+	return wgPeer.GetNamespace() + "/" + wgPeer.GetName()
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+// testPeerIn returns a test peer in the namespace.
+func testPeerIn(ns, name string, ips ...string) *wgk8s.WireGuardPeer {
+	p := testPeer(name, nil, ips...)
+	p.SetNamespace(ns)
+	p.SetSelfLink("/" + ns + "/" + name)
+	return p
+}
+
+func TestPeerNamespaces(t *testing.T) {
+	var rejected []string
+	pt := &peerTracker{
+		ll:        logrus.New(),
+		registry:  newPeerStore(),
+		namespace: "tenant-a",
+		onReject: func(wgPeer *wgk8s.WireGuardPeer, reason, msg string) {
+			rejected = append(rejected, wgPeer.GetNamespace()+"/"+wgPeer.GetName()+": "+reason+": "+msg)
+		},
+	}
+	a := &Agent{options: defaultOptions(), peerTracker: pt}
+	a.ll = logrus.New()
+	a.registryNamespace = "tenant-a"
+
+	require.NoError(t, pt.storePeer(testPeerIn("tenant-a", "a", "10.10.0.1/32")))
+	require.NoError(t, pt.storePeer(testPeerIn("tenant-b", "a", "10.20.0.1/32")))
+	require.Equal(t, []string{"/tenant-a/a"}, peerNames(pt.listPeers()), "peers of other namespaces aren't shared by default")
+	require.Equal(t, []string{
+		"tenant-b/a: NamespaceNotShared: WireGuardPeer's namespace tenant-b doesn't share its peers with namespace tenant-a, ignoring peer",
+	}, rejected)
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	other := &wgk8s.Mesh{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-b", Name: "other"},
+		Spec:       wgk8s.MeshSpec{SharedWithNamespaces: []string{"tenant-c"}},
+	}
+	require.NoError(t, store.Add(other))
+	a.onPeerNamespaceMeshChange("tenant-b", store)
+	require.Equal(t, []string{"/tenant-a/a"}, peerNames(pt.listPeers()), "the namespace is shared with another")
+
+	shares := &wgk8s.Mesh{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-b", Name: "shares"},
+		Spec:       wgk8s.MeshSpec{SharedWithNamespaces: []string{"tenant-a"}},
+	}
+	require.NoError(t, store.Add(shares))
+	a.onPeerNamespaceMeshChange("tenant-b", store)
+	require.ElementsMatch(t, []string{"/tenant-a/a", "/tenant-b/a"}, peerNames(pt.listPeers()), "the namespace opted in")
+
+	require.NoError(t, store.Delete(shares))
+	a.onPeerNamespaceMeshChange("tenant-b", store)
+	require.Equal(t, []string{"/tenant-a/a"}, peerNames(pt.listPeers()), "the namespace opted out")
+	require.Empty(t, a.sharedNamespaces)
+}
+
+func TestPeerNamespacesKeyPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pins")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pins, err := loadKeyPins(logrus.New(), filepath.Join(dir, "pins.json"), KeyPinningReject)
+	require.NoError(t, err)
+	pt := &peerTracker{
+		ll:               logrus.New(),
+		registry:         newPeerStore(),
+		namespace:        "tenant-a",
+		sharedNamespaces: map[string]bool{"tenant-b": true},
+		keyPins:          pins,
+	}
+	local, shared := testPeerIn("tenant-a", "a", "10.10.0.1/32"), testPeerIn("tenant-b", "a", "10.20.0.1/32")
+	local.Spec.PublicKey, shared.Spec.PublicKey = testPublicKey(t), testPublicKey(t)
+	require.NoError(t, pt.storePeer(local))
+	require.NoError(t, pt.storePeer(shared))
+	require.ElementsMatch(t, []string{"/tenant-a/a", "/tenant-b/a"}, peerNames(pt.listPeers()), "peers of the same name are pinned apart")
+	var names []string
+	for _, p := range pins.list() {
+		names = append(names, p.Name)
+	}
+	require.Equal(t, []string{"a", "tenant-b/a"}, names)
+}
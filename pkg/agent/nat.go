@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+// observedEndpointsInterval is how often we publish the addresses peers are seen at.
+const observedEndpointsInterval = 30 * time.Second
+
+// publishObservedEndpoints periodically publishes the source addresses which peers are completing
+// handshakes from to our WireGuardPeer's status, until the context is canceled. For a NATed peer
+// this is its external mapping, which lets another NATed peer hole punch to it.
+func (a *Agent) publishObservedEndpoints(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := a.publishObservedEndpointsOnce()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to publish observed endpoints")
+			}
+		}, observedEndpointsInterval, ctx.Done())
+	}()
+}
+
+func (a *Agent) publishObservedEndpointsOnce() error {
+	devPeers, err := a.iface.GetPeers()
+	if err != nil {
+		return fmt.Errorf("reading WireGuard peers: %w", err)
+	}
+	observed := observedEndpoints(devPeers, time.Now())
+
+	a.publishLock.Lock()
+	defer a.publishLock.Unlock()
+	if reflect.DeepEqual(observed, a.localPeer.Status.ObservedEndpoints) {
+		return nil
+	}
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := a.registry.Get(a.name)
+		if err != nil {
+			return err
+		}
+		latest.Status.ObservedEndpoints = observed
+		updated, err := a.registry.Update(latest)
+		if err != nil {
+			return err
+		}
+		a.localPeer = updated
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if a.peerGuard != nil {
+		a.peerGuard.setDesired(a.localPeer)
+	}
+	return nil
+}
+
+// observedEndpoints returns the address of each peer which has completed a handshake recently
+// enough that its session is live, sorted by public key. Loopback addresses, ex. of peers reached
+// over the TCP transport, aren't useful to other peers, so they're left out.
+func observedEndpoints(devPeers []wgtypes.Peer, now time.Time) []wgk8s.ObservedEndpoint {
+	var out []wgk8s.ObservedEndpoint
+	for _, p := range devPeers {
+		if p.Endpoint == nil || p.Endpoint.IP.IsLoopback() || now.Sub(p.LastHandshakeTime) >= staleHandshake {
+			continue
+		}
+		out = append(out, wgk8s.ObservedEndpoint{
+			PublicKey: p.PublicKey.String(),
+			Endpoint:  p.Endpoint.String(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PublicKey < out[j].PublicKey })
+	return out
+}
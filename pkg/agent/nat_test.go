@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestObservedEndpoints(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	var keys []wgtypes.Key
+	for i := 0; i < 4; i++ {
+		k, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		keys = append(keys, k.PublicKey())
+	}
+	devPeers := []wgtypes.Peer{
+		{
+			PublicKey:         keys[0],
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40123},
+			LastHandshakeTime: now.Add(-time.Minute),
+		},
+		{
+			// Stale sessions don't show the address is current.
+			PublicKey:         keys[1],
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("198.51.100.8"), Port: 40123},
+			LastHandshakeTime: now.Add(-5 * time.Minute),
+		},
+		{
+			// Never contacted.
+			PublicKey: keys[2],
+		},
+		{
+			// Reached over the TCP transport.
+			PublicKey:         keys[3],
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40123},
+			LastHandshakeTime: now.Add(-time.Minute),
+		},
+	}
+	got := observedEndpoints(devPeers, now)
+	require.Equal(t, []wgk8s.ObservedEndpoint{
+		{PublicKey: keys[0].String(), Endpoint: "198.51.100.7:40123"},
+	}, got)
+	require.Nil(t, observedEndpoints(nil, now))
+}
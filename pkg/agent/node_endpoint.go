@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// nodeAddressInterval is how often we check the local Node's addresses for changes.
+const nodeAddressInterval = time.Minute
+
+// configureNodeEndpoint sets the endpoint address from the local Node's addresses.
+func (a *Agent) configureNodeEndpoint() error {
+	if a.localCS == nil || a.kubeNode == "" {
+		return fmt.Errorf("node endpoint requires a local kubeconfig and kube node name")
+	}
+	addr, err := a.getNodeAddress()
+	if err != nil {
+		return err
+	}
+	// The WireGuard listen port is filled in once the interface is up.
+	a.endpointAddr = net.JoinHostPort(addr, "0")
+	a.ll.WithField("kube_node", a.kubeNode).WithField("endpoint_addr", addr).Debugln("using node address as endpoint")
+	return nil
+}
+
+// getNodeAddress returns the local Node's most preferred address.
+func (a *Agent) getNodeAddress() (string, error) {
+	node, err := a.localCS.CoreV1().Nodes().Get(a.kubeNode, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("getting node %q: %w", a.kubeNode, err)
+	}
+	addr := NodeAddress(preferFamily(node.Status.Addresses, a.endpointFamily), a.nodeAddressTypes)
+	if addr == "" {
+		return "", fmt.Errorf("node %q has no address of types %v", a.kubeNode, a.nodeAddressTypes)
+	}
+	return addr, nil
+}
+
+// watchNodeEndpoint periodically republishes our endpoint if the local Node's address changes,
+// until the context is canceled.
+func (a *Agent) watchNodeEndpoint(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := a.updateNodeEndpoint()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to update endpoint from node address")
+			}
+		}, nodeAddressInterval, ctx.Done())
+	}()
+}
+
+func (a *Agent) updateNodeEndpoint() error {
+	addr, err := a.getNodeAddress()
+	if err != nil {
+		return err
+	}
+	err = a.publishLocalPeerSpec(func(spec *wgk8s.WireGuardPeerSpec) bool {
+		_, port, err := net.SplitHostPort(spec.Endpoint)
+		if err != nil {
+			return false
+		}
+		endpoint := net.JoinHostPort(addr, port)
+		if endpoint == spec.Endpoint {
+			return false
+		}
+		a.ll.WithField("previous_endpoint", spec.Endpoint).WithField("endpoint", endpoint).
+			Infoln("node address changed; updating endpoint")
+		spec.Endpoint = endpoint
+		spec.TCPEndpoint = a.tcpEndpoint(endpoint)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("publishing endpoint: %w", err)
+	}
+	return nil
+}
+
+// preferFamily orders the node's addresses of the endpoint family, if it's IPv4 or IPv6, first.
+func preferFamily(addresses []corev1.NodeAddress, family string) []corev1.NodeAddress {
+	if family != EndpointFamilyIPv4 && family != EndpointFamilyIPv6 {
+		return addresses
+	}
+	preferred := func(addr corev1.NodeAddress) bool {
+		ip := net.ParseIP(addr.Address)
+		return ip != nil && (ip.To4() == nil) == (family == EndpointFamilyIPv6)
+	}
+	out := append([]corev1.NodeAddress(nil), addresses...)
+	sort.SliceStable(out, func(i, j int) bool { return preferred(out[i]) && !preferred(out[j]) })
+	return out
+}
+
+// NodeAddress returns the first of the node's addresses with the most preferred type, or "" if it has
+// none of the types.
+func NodeAddress(addresses []corev1.NodeAddress, types []corev1.NodeAddressType) string {
+	for _, t := range types {
+		for _, addr := range addresses {
+			if addr.Type == t && addr.Address != "" {
+				return addr.Address
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"sync"
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeAddress(t *testing.T) {
+	addresses := []corev1.NodeAddress{
+		{Type: corev1.NodeHostName, Address: "node-1"},
+		{Type: corev1.NodeInternalIP, Address: "10.128.0.7"},
+		{Type: corev1.NodeInternalIP, Address: "fd00::7"},
+		{Type: corev1.NodeExternalIP, Address: "203.0.113.7"},
+	}
+	tcs := []struct {
+		name      string
+		addresses []corev1.NodeAddress
+		types     []corev1.NodeAddressType
+		expect    string
+	}{
+		{
+			name:      "external preferred",
+			addresses: addresses,
+			types:     []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP},
+			expect:    "203.0.113.7",
+		},
+		{
+			name:      "first of type",
+			addresses: addresses,
+			types:     []corev1.NodeAddressType{corev1.NodeInternalIP, corev1.NodeExternalIP},
+			expect:    "10.128.0.7",
+		},
+		{
+			name:      "fallback",
+			addresses: addresses[:3],
+			types:     []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP},
+			expect:    "10.128.0.7",
+		},
+		{
+			name:      "ipv6 preferred",
+			addresses: preferFamily(addresses, EndpointFamilyIPv6),
+			types:     []corev1.NodeAddressType{corev1.NodeInternalIP, corev1.NodeExternalIP},
+			expect:    "fd00::7",
+		},
+		{
+			name:      "ipv4 preferred",
+			addresses: preferFamily(addresses, EndpointFamilyIPv4),
+			types:     []corev1.NodeAddressType{corev1.NodeInternalIP, corev1.NodeExternalIP},
+			expect:    "10.128.0.7",
+		},
+		{
+			name:      "none",
+			addresses: addresses[:1],
+			types:     []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP},
+			expect:    "",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, NodeAddress(tc.addresses, tc.types))
+		})
+	}
+}
+
+func TestUpdateNodeEndpoint(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node"},
+		Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+			{Type: corev1.NodeInternalIP, Address: "10.128.0.8"},
+		}},
+	}
+	r, err := registry.NewMemory("ns")
+	require.NoError(t, err)
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.name = "peer"
+	a.kubeNode = "node"
+	a.nodeAddressTypes = []corev1.NodeAddressType{corev1.NodeInternalIP}
+	a.localCS = kubefake.NewSimpleClientset(node)
+	a.registry = r
+	a.endpointAddr = "10.128.0.7:51820"
+	a.localPeer, err = r.Register(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "peer"},
+		Spec:       wgk8s.WireGuardPeerSpec{Endpoint: a.endpointAddr},
+	})
+	require.NoError(t, err)
+
+	// The status is served while the endpoint is updated; run with -race.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.status()
+	}()
+	require.NoError(t, a.updateNodeEndpoint())
+	wg.Wait()
+
+	peer, err := r.Get("peer")
+	require.NoError(t, err)
+	require.Equal(t, "10.128.0.8:51820", peer.Spec.Endpoint)
+	require.Equal(t, "10.128.0.8:51820", a.status().Endpoint)
+}
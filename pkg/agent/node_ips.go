@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// annotateNodeIPs sets the mesh addresses annotation on the kube node to the addresses of ips,
+// removing it if there are none. Node status addresses are owned by the kubelet and cloud
+// provider, which would overwrite ours, so an annotation is the only place we can publish them.
+func (a *Agent) annotateNodeIPs(ips []string) error {
+	if !a.annotateNode {
+		return nil
+	}
+	if a.localCS == nil || a.kubeNode == "" {
+		return fmt.Errorf("annotating node requires a local kubeconfig and kube node name")
+	}
+	value := nodeMeshIPs(ips)
+	if value == a.annotatedIPs {
+		return nil
+	}
+	// A null value removes the annotation in a merge patch.
+	var annotation interface{}
+	if value != "" {
+		annotation = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				wgk8s.NodeMeshIPsAnnotation: annotation,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	a.ll.WithField("kube_node", a.kubeNode).WithField("mesh_ips", value).Infoln("annotating node with mesh addresses")
+	_, err = a.localCS.CoreV1().Nodes().Patch(a.kubeNode, types.MergePatchType, patch)
+	if err != nil {
+		return fmt.Errorf("annotating node %q: %w", a.kubeNode, err)
+	}
+	a.annotatedIPs = value
+	return nil
+}
+
+// nodeMeshIPs returns the addresses of ips, without their prefix lengths, comma separated.
+func nodeMeshIPs(ips []string) string {
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addr, _, err := net.ParseCIDR(ip)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, addr.String())
+	}
+	return strings.Join(addrs, ",")
+}
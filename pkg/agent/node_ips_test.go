@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAnnotateNodeIPs(t *testing.T) {
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.kubeNode = "node"
+	a.annotateNode = true
+	a.localCS = kubefake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node",
+			Annotations: map[string]string{"other": "kept"},
+		},
+	})
+	annotations := func() map[string]string {
+		node, err := a.localCS.CoreV1().Nodes().Get("node", metav1.GetOptions{})
+		require.NoError(t, err)
+		return node.GetAnnotations()
+	}
+
+	require.NoError(t, a.annotateNodeIPs([]string{"10.0.0.1/24", "fd00::1/64"}))
+	require.Equal(t, map[string]string{
+		"other":                     "kept",
+		wgk8s.NodeMeshIPsAnnotation: "10.0.0.1,fd00::1",
+	}, annotations())
+
+	require.NoError(t, a.annotateNodeIPs(nil))
+	require.Equal(t, map[string]string{"other": "kept"}, annotations())
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+// nodeLabelsInterval is how often we check the local Node's labels for changes.
+const nodeLabelsInterval = time.Minute
+
+// peerLabels returns the local peer's labels: the synced node labels, overridden by any labels set
+// explicitly.
+func (a *Agent) peerLabels() labels.Set {
+	a.labelsLock.Lock()
+	defer a.labelsLock.Unlock()
+	if len(a.nodeLabels) == 0 {
+		return a.labels
+	}
+	return labels.Merge(a.nodeLabels, a.labels)
+}
+
+// readNodeLabels returns the configured labels from the local Node.
+func (a *Agent) readNodeLabels() (labels.Set, error) {
+	if a.localCS == nil || a.kubeNode == "" {
+		return nil, fmt.Errorf("syncing node labels requires a local kubeconfig and kube node name")
+	}
+	node, err := a.localCS.CoreV1().Nodes().Get(a.kubeNode, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting node %q: %w", a.kubeNode, err)
+	}
+	synced := make(labels.Set)
+	for _, k := range a.nodeLabelKeys {
+		if v, ok := node.GetLabels()[k]; ok {
+			synced[k] = v
+		}
+	}
+	return synced, nil
+}
+
+// configureNodeLabels reads the labels which are synced from the local Node.
+func (a *Agent) configureNodeLabels() error {
+	synced, err := a.readNodeLabels()
+	if err != nil {
+		return err
+	}
+	a.labelsLock.Lock()
+	a.nodeLabels = synced
+	a.labelsLock.Unlock()
+	a.ll.WithField("node_labels", synced.String()).Debugln("using node labels")
+	return nil
+}
+
+// watchNodeLabels periodically republishes our labels if the local Node's labels change, until the
+// context is canceled.
+func (a *Agent) watchNodeLabels(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := a.updateNodeLabels()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to sync node labels")
+			}
+		}, nodeLabelsInterval, ctx.Done())
+	}()
+}
+
+func (a *Agent) updateNodeLabels() error {
+	synced, err := a.readNodeLabels()
+	if err != nil {
+		return err
+	}
+	a.labelsLock.Lock()
+	previous := a.nodeLabels
+	a.nodeLabels = synced
+	a.labelsLock.Unlock()
+	if reflect.DeepEqual(previous, synced) {
+		return nil
+	}
+	a.ll.WithField("node_labels", synced.String()).Infoln("node labels changed; updating local peer")
+	desired := a.peerLabels()
+	return a.publishLocalPeerLabels(func(current map[string]string) map[string]string {
+		out := make(map[string]string, len(current))
+		for k, v := range current {
+			// Drop the synced labels which were removed from the node.
+			if _, wasSynced := previous[k]; wasSynced && !desired.Has(k) {
+				continue
+			}
+			out[k] = v
+		}
+		for k, v := range desired {
+			out[k] = v
+		}
+		return out
+	})
+}
+
+// publishLocalPeerLabels replaces the local peer's labels with those returned by update, which is
+// passed the record's current labels.
+func (a *Agent) publishLocalPeerLabels(update func(current map[string]string) map[string]string) error {
+	if a.operatorManaged {
+		// The operator maintains our record.
+		return nil
+	}
+	a.publishLock.Lock()
+	defer a.publishLock.Unlock()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := a.registry.Get(a.name)
+		if err != nil {
+			return err
+		}
+		latest.SetLabels(update(latest.GetLabels()))
+		updated, err := a.registry.Update(latest)
+		if err != nil {
+			return err
+		}
+		a.localPeer = updated
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("publishing labels: %w", err)
+	}
+	if a.peerGuard != nil {
+		a.peerGuard.setDesired(a.localPeer)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSyncNodeLabels(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node",
+			Labels: map[string]string{
+				labelTopologyZone:                  "nyc1",
+				"node.kubernetes.io/instance-type": "s-2vcpu",
+				"role":                             "node",
+				"unsynced":                         "x",
+			},
+		},
+	}
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.name = "peer"
+	a.registryNamespace = "ns"
+	a.kubeNode = "node"
+	a.labels = labels.Set{"role": "gateway"}
+	a.nodeLabelKeys = []string{labelTopologyZone, "node.kubernetes.io/instance-type", "role"}
+	a.localCS = kubefake.NewSimpleClientset(node)
+	a.registry = registry.NewKubernetes(fake.NewSimpleClientset(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      "peer",
+			Labels:    map[string]string{"other": "kept"},
+		},
+	}), "ns")
+
+	require.NoError(t, a.configureNodeLabels())
+	require.Equal(t, labels.Set{
+		labelTopologyZone:                  "nyc1",
+		"node.kubernetes.io/instance-type": "s-2vcpu",
+		"role":                             "gateway",
+	}, a.peerLabels(), "explicit labels should take precedence")
+
+	node.Labels[labelTopologyZone] = "nyc3"
+	delete(node.Labels, "node.kubernetes.io/instance-type")
+	_, err := a.localCS.CoreV1().Nodes().Update(node)
+	require.NoError(t, err)
+	require.NoError(t, a.updateNodeLabels())
+
+	peer, err := a.registry.Get("peer")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		labelTopologyZone: "nyc3",
+		"role":            "gateway",
+		"other":           "kept",
+	}, peer.GetLabels())
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// networkAvailableReason is the reason we set on the NetworkUnavailable condition, following other
+// network providers (ex. CalicoIsUp, FlannelIsUp).
+const networkAvailableReason = "WgmeshIsUp"
+
+// carriesPodNetwork returns true if the agent routes the kube node's pod network.
+func (a *Agent) carriesPodNetwork() bool {
+	return a.podCIDRIPAM || a.offerPodCIDRs || a.operatorManaged
+}
+
+// clearNodeNetworkUnavailable sets the kube node's NetworkUnavailable condition to false. Cloud
+// providers set the condition on new nodes, which keeps pods from being scheduled until the network
+// provider clears it.
+func (a *Agent) clearNodeNetworkUnavailable() error {
+	if !a.clearNetworkUnavailable || !a.carriesPodNetwork() {
+		return nil
+	}
+	if a.localCS == nil || a.kubeNode == "" {
+		return fmt.Errorf("updating node conditions requires a local kubeconfig and kube node name")
+	}
+	node, err := a.localCS.CoreV1().Nodes().Get(a.kubeNode, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting node %q: %w", a.kubeNode, err)
+	}
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeNetworkUnavailable && c.Status == corev1.ConditionFalse && c.Reason == networkAvailableReason {
+			return nil
+		}
+	}
+	now := metav1.Now()
+	// Conditions are merged by type, so we leave the others alone.
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []corev1.NodeCondition{{
+				Type:               corev1.NodeNetworkUnavailable,
+				Status:             corev1.ConditionFalse,
+				Reason:             networkAvailableReason,
+				Message:            "wgmesh is routing the node's pod network",
+				LastTransitionTime: now,
+				LastHeartbeatTime:  now,
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	a.ll.WithField("kube_node", a.kubeNode).Infoln("clearing node NetworkUnavailable condition")
+	_, err = a.localCS.CoreV1().Nodes().PatchStatus(a.kubeNode, patch)
+	if err != nil {
+		return fmt.Errorf("updating node %q conditions: %w", a.kubeNode, err)
+	}
+	return nil
+}
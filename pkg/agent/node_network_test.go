@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestClearNodeNetworkUnavailable(t *testing.T) {
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.kubeNode = "node"
+	a.localCS = kubefake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node"},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				{Type: corev1.NodeNetworkUnavailable, Status: corev1.ConditionTrue, Reason: "NoRouteCreated"},
+			},
+		},
+	})
+	conditions := func() map[corev1.NodeConditionType]corev1.NodeCondition {
+		node, err := a.localCS.CoreV1().Nodes().Get("node", metav1.GetOptions{})
+		require.NoError(t, err)
+		out := make(map[corev1.NodeConditionType]corev1.NodeCondition)
+		for _, c := range node.Status.Conditions {
+			out[c.Type] = c
+		}
+		return out
+	}
+
+	// We only touch the condition when we carry the pod network.
+	require.NoError(t, a.clearNodeNetworkUnavailable())
+	require.Equal(t, corev1.ConditionTrue, conditions()[corev1.NodeNetworkUnavailable].Status)
+
+	a.offerPodCIDRs = true
+	require.NoError(t, a.clearNodeNetworkUnavailable())
+	c := conditions()
+	require.Len(t, c, 2)
+	require.Equal(t, corev1.ConditionTrue, c[corev1.NodeReady].Status)
+	require.Equal(t, corev1.ConditionFalse, c[corev1.NodeNetworkUnavailable].Status)
+	require.Equal(t, networkAvailableReason, c[corev1.NodeNetworkUnavailable].Reason)
+}
@@ -3,13 +3,21 @@ package agent
 import (
 	"context"
 	"fmt"
+	"net"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/jcodybaker/wgmesh/pkg/audit"
+	"github.com/jcodybaker/wgmesh/pkg/bgp"
 	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+	"github.com/jcodybaker/wgmesh/pkg/keys"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/jcodybaker/wgmesh/pkg/routingd"
 )
 
 type options struct {
@@ -21,24 +29,212 @@ type options struct {
 	localKubeClientConfig    clientcmd.ClientConfig
 	registryKubeClientConfig clientcmd.ClientConfig
 	registryNamespace        string
+	// registryBackend, if set, is used instead of the Kubernetes registry.
+	registryBackend registry.Registry
+	// peerNamespaces are other namespaces of the Kubernetes registry whose peers are meshed with,
+	// if their Meshes share them with the registry namespace.
+	peerNamespaces []string
 
 	keepalive time.Duration
+	mtu       int
 
+	// endpointAddr is the endpoint published at registration. Once registered, the local peer's spec
+	// holds the current endpoint, ex. after the kube node's address changes.
 	endpointAddr string
-	ips          []string
-	offerRoutes  []string
+	// endpointCandidates are published ahead of endpointAddr as preferred endpoints.
+	endpointCandidates []string
+	// endpointFamily is the preferred address family of peers' endpoints, and of the kube node
+	// address published as our endpoint.
+	endpointFamily string
+	// natTraversal publishes the addresses peers are observed at, and tries the addresses other
+	// peers observe as endpoint candidates.
+	natTraversal bool
+	// peerHealth publishes the health of our connection to each peer.
+	peerHealth bool
+	// mdns announces the local peer on the LAN, and prefers the LAN addresses of peers announcing
+	// themselves.
+	mdns bool
+	// mdnsPeerKeys and mdnsPeerCIDRs allow neighbors announcing one of the public keys, or from an
+	// address within one of the networks, to be peered with without a registry record.
+	mdnsPeerKeys  map[string]bool
+	mdnsPeerCIDRs []*net.IPNet
+	// clientOnly peers don't publish an endpoint, and always keep alive their sessions.
+	clientOnly bool
+	// routeReflection re-advertises the routes learned from peers we connect to directly.
+	routeReflection bool
+	ips             []string
+	offerRoutes     []string
+	// routePriority chooses between peers offering the same route.
+	routePriority int
+	// installRoutes routes peers' allowed IPs via the WireGuard interface.
+	installRoutes bool
+	routeMetric   int
+	routeProtocol int
+	// clampMSS installs firewall rules clamping the MSS of TCP connections forwarded to and from
+	// routes which peers list in ClampMSSRoutes, alongside the routes.
+	clampMSS bool
+	// clampMSSRoutes are offered routes published for peers to clamp the MSS of.
+	clampMSSRoutes []string
+	// snatRoutes are offered routes into which traffic forwarded from the mesh is source NATed to
+	// the address of the interface it leaves through.
+	snatRoutes []string
+	// tcpTransportPort, if set, is where WireGuard traffic carried over TCP is accepted, by
+	// tcp2udp at tcp2udpPath. It's published with the endpoint's host as the TCP endpoint.
+	tcpTransportPort int
+	tcp2udpPath      string
+	// tcpFallback reaches peers through their TCP endpoints, with udp2tcp at udp2tcpPath, once
+	// their UDP candidates fail.
+	tcpFallback bool
+	udp2tcpPath string
+	// ecmp splits routes offered by several equally preferred peers between them.
+	ecmp bool
+	// bgp, if set, runs a BGP speaker advertising the mesh's routes to upstream routers. With
+	// bgpLearnRoutes, the routes they advertise are offered to the mesh.
+	bgp            *bgp.Config
+	bgpLearnRoutes bool
+	// routingDaemon, if set, is the routing daemon, routingd.BIRD or routingd.FRR, which the
+	// mesh's routes are exported to as static routes. BIRD's are written to birdConfig.
+	routingDaemon string
+	birdConfig    string
+	// proxyARPInterface, if set, is the LAN interface where ARP and NDP requests for peers' mesh
+	// addresses within proxyARPCIDRs, or all of them if empty, are answered.
+	proxyARPInterface string
+	proxyARPCIDRs     []*net.IPNet
+	// handshakeTimeout is how long we send to a peer without a handshake completing before it's
+	// stale: its endpoint is refreshed, and its routes move to other peers.
+	handshakeTimeout time.Duration
+	// resyncPeriod is how often the informers redeliver their cached objects, and the full config
+	// is reapplied to the interface. Zero disables periodic resyncs.
+	resyncPeriod time.Duration
+	// flapDampingLimit is how many times a peer's spec may change within flapDampingWindow before
+	// its changes are damped. Zero disables damping.
+	flapDampingLimit  int
+	flapDampingWindow time.Duration
+	// quarantineAttempts, if set, is how many endpoint attempts a peer which has never completed a
+	// handshake may fail, over at least quarantinePeriod, before it's quarantined: removed from the
+	// device, and retried every quarantineRetry.
+	quarantineAttempts int
+	quarantinePeriod   time.Duration
+	quarantineRetry    time.Duration
 
 	wgIfaceOptions *interfaces.WireGuardInterfaceOptions
 
 	kubeNode string
+	// nodeAddressTypes, if set, publishes the kube node's first address of these types, in order of
+	// preference, as the endpoint.
+	nodeAddressTypes []corev1.NodeAddressType
+	// clearNetworkUnavailable clears the kube node's NetworkUnavailable condition once peers are
+	// configured, when we carry the node's pod network.
+	clearNetworkUnavailable bool
+	// serviceExport publishes the local cluster's exported Services, and offers routes to them.
+	// Services are exported if annotated, or if they match serviceSelector.
+	serviceExport   bool
+	serviceSelector labels.Selector
+	clusterDomain   string
+	// nodeLabelKeys are the kube node's labels which are synced onto the local peer.
+	nodeLabelKeys []string
+	// annotateNode publishes the local peer's mesh addresses in an annotation on the kube node.
+	annotateNode bool
+	// operatorManaged leaves the local WireGuardPeer to the node operator. The agent announces its
+	// public key and listen port on the kube node, and only programs the interface.
+	operatorManaged bool
+	// region and zone locate the peer. If unset, they're read from the kube node's labels.
+	region string
+	zone   string
+	// podCIDRIPAM derives ips and offerRoutes from the kube node's podCIDRs.
+	podCIDRIPAM bool
+	// offerPodCIDRs appends the kube node's podCIDRs to offerRoutes.
+	offerPodCIDRs bool
 
 	peerSelector labels.Selector
 	labels       labels.Set
+
+	protected             bool
+	allowProtectedRemoval bool
+	// allowedEndpointCIDRs, if set, limits the peers configured to those whose published endpoints
+	// fall within them, overriding the Mesh's.
+	allowedEndpointCIDRs []*net.IPNet
+	// keyPinsPath, if set, is where peers' public keys are pinned on first use; keyPinning is how
+	// a peer whose key differs from its pin is handled.
+	keyPinsPath string
+	keyPinning  string
+	// enforceMeshPolicies filters the traffic peers send us by the WireGuardMeshPolicies of the
+	// registry namespace.
+	enforceMeshPolicies bool
+
+	controlSocket string
+	chaos         bool
+	// benchPort, if set, is where throughput tests from peers' agents are served on the local
+	// peer's mesh addresses.
+	benchPort int
+	// metricsAddr, if set, is where Prometheus metrics are served.
+	metricsAddr string
+	// probeInterval, if set, is how often peers' mesh addresses are probed with probeMethod, "icmp"
+	// or "udp".
+	probeInterval time.Duration
+	probeMethod   string
+	// probePort, if set, is where peers' UDP probes are echoed, and where UDP probes are sent.
+	probePort int
+	// mtuProbeInterval, if set, is how often the path MTU to each peer is measured with UDP probes.
+	// With mtuAuto, the interface's MTU is lowered to fit the smallest.
+	mtuProbeInterval time.Duration
+	mtuAuto          bool
+
+	// ipPools lists the pools which addresses are claimed from, with per-family counts.
+	ipPools []*ipPoolRequest
+	// ipLeaseDuration, if non-zero, is the lease on claimed addresses. Leases are renewed at a
+	// third of the duration.
+	ipLeaseDuration time.Duration
+
+	deregisterOnExit bool
+	// forceTakeover claims the local peer's name from an existing record with another endpoint,
+	// once the record goes unchanged for takeoverGracePeriod.
+	forceTakeover       bool
+	takeoverGracePeriod time.Duration
+
+	// peerCachePath, if set, is where the peers synced from the registry are saved, and the
+	// interface is configured from at startup.
+	peerCachePath string
+	// keyProvider, if set, holds the private key, which is then never written to disk.
+	keyProvider keys.Provider
+
+	// bootstrapPeers are configured before the registry is contacted, and stay configured.
+	bootstrapPeers []BootstrapPeer
+
+	// initAttempts limits attempts to start the agent when they fail with transient errors. Zero
+	// retries until the agent is stopped.
+	initAttempts int
+
+	// auditSink, if set, records the changes the agent makes to the device and the registry.
+	auditSink audit.Sink
 }
 
+// Peers whose specs change more often than this are damped by default.
+const (
+	defaultFlapDampingLimit  = 10
+	defaultFlapDampingWindow = time.Minute
+)
+
+// defaultClientOnlyKeepalive is used by client-only peers when no keepalive is configured. It's
+// comfortably shorter than typical NAT UDP mapping timeouts.
+const defaultClientOnlyKeepalive = 25 * time.Second
+
 func defaultOptions() options {
 	return options{
-		peerSelector: labels.Everything(),
+		peerSelector:  labels.Everything(),
+		natTraversal:  true,
+		installRoutes: true,
+		routeProtocol: interfaces.DefaultRouteProtocol,
+
+		endpointFamily: EndpointFamilyAuto,
+
+		handshakeTimeout: endpointFailoverTimeout,
+
+		flapDampingLimit:  defaultFlapDampingLimit,
+		flapDampingWindow: defaultFlapDampingWindow,
+
+		clearNetworkUnavailable: true,
+		clusterDomain:           "cluster.local",
 	}
 }
 
@@ -84,6 +280,25 @@ func WithRegistryKubeClientConfig(config clientcmd.ClientConfig) OptionFunc {
 	}
 }
 
+// WithRegistry sets a registry backend, ex. a `wgmesh server`, to use instead of the Kubernetes
+// registry.
+func WithRegistry(r registry.Registry) OptionFunc {
+	return func(o *options) error {
+		o.registryBackend = r
+		return nil
+	}
+}
+
+// WithPeerNamespaces also meshes with the peers of other namespaces of the Kubernetes registry. A
+// namespace's peers are only configured while one of its Meshes lists the registry namespace in
+// sharedWithNamespaces; otherwise peers only mesh within their namespace.
+func WithPeerNamespaces(namespaces []string) OptionFunc {
+	return func(o *options) error {
+		o.peerNamespaces = namespaces
+		return nil
+	}
+}
+
 // WithRegistryNamespace sets the namespace for the registry.
 func WithRegistryNamespace(registryNamespace string) OptionFunc {
 	return func(o *options) error {
@@ -101,6 +316,17 @@ func WithKeepAliveDuration(keepalive time.Duration) OptionFunc {
 	}
 }
 
+// WithMTU sets the MTU of the WireGuard interface. If zero, the Mesh's MTU is used, if any.
+func WithMTU(mtu int) OptionFunc {
+	return func(o *options) error {
+		if mtu != 0 && (mtu < 576 || mtu > 65535) {
+			return fmt.Errorf("mtu %d must be between 576 and 65535", mtu)
+		}
+		o.mtu = mtu
+		return nil
+	}
+}
+
 // WithIPs sets a list of IP addresses to add to the WireGuard interface.
 func WithIPs(ips []string) OptionFunc {
 	return func(o *options) error {
@@ -143,6 +369,57 @@ func WithKubeNode(kubeNode string) OptionFunc {
 	}
 }
 
+// WithNodeEndpoint publishes the Kubernetes node's first address of the specified types, in order
+// of preference, as the endpoint, with the WireGuard interface's port. The endpoint is updated if
+// the node's address changes. Requires a local kube client config and WithKubeNode.
+func WithNodeEndpoint(addressTypes []string) OptionFunc {
+	return func(o *options) error {
+		if len(addressTypes) == 0 {
+			return fmt.Errorf("node endpoint requires at least one address type")
+		}
+		o.nodeAddressTypes = nil
+		for _, t := range addressTypes {
+			switch corev1.NodeAddressType(t) {
+			case corev1.NodeExternalIP, corev1.NodeInternalIP, corev1.NodeExternalDNS, corev1.NodeInternalDNS, corev1.NodeHostName:
+			default:
+				return fmt.Errorf("invalid node address type %q", t)
+			}
+			o.nodeAddressTypes = append(o.nodeAddressTypes, corev1.NodeAddressType(t))
+		}
+		return nil
+	}
+}
+
+// WithZone sets the region and zone published for the local peer. Either may be empty, in which
+// case it's read from the Kubernetes node's topology labels when WithKubeNode is set.
+func WithZone(region, zone string) OptionFunc {
+	return func(o *options) error {
+		o.region = region
+		o.zone = zone
+		return nil
+	}
+}
+
+// WithPodCIDRIPAM derives the mesh addresses and offered routes from the Kubernetes node's
+// podCIDRs, in addition to any specified with WithIPs and WithOfferRoutes. Requires a local kube
+// client config and WithKubeNode.
+func WithPodCIDRIPAM(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.podCIDRIPAM = enabled
+		return nil
+	}
+}
+
+// WithOfferPodCIDRs offers routes to the Kubernetes node's podCIDRs, in addition to any specified
+// with WithOfferRoutes, so peers can reach the node's pods. Unlike WithPodCIDRIPAM, the mesh
+// addresses aren't derived from the podCIDRs. Requires a local kube client config and WithKubeNode.
+func WithOfferPodCIDRs(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.offerPodCIDRs = enabled
+		return nil
+	}
+}
+
 // WithEndpointAddr ...
 func WithEndpointAddr(endpointAddr string) OptionFunc {
 	return func(o *options) error {
@@ -151,6 +428,275 @@ func WithEndpointAddr(endpointAddr string) OptionFunc {
 	}
 }
 
+// WithEndpointCandidates sets additional endpoint addresses, in order of preference, which peers
+// try before the endpoint addr. Ex. a LAN address lets peers on the same network connect directly.
+// Like the endpoint addr, candidates without a port use the WireGuard interface's port.
+func WithEndpointCandidates(addrs []string) OptionFunc {
+	return func(o *options) error {
+		for _, addr := range addrs {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("invalid endpoint candidate %q: %w", addr, err)
+			}
+		}
+		o.endpointCandidates = addrs
+		return nil
+	}
+}
+
+// WithEndpointFamily sets the preferred address family of peers' endpoints, EndpointFamilyIPv4,
+// EndpointFamilyIPv6, or EndpointFamilyAuto, the default. Names with addresses of both families
+// resolve to the preferred one. With IPv4 or IPv6, the kube node's addresses of that family are
+// also preferred as our endpoint.
+func WithEndpointFamily(family string) OptionFunc {
+	return func(o *options) error {
+		switch family {
+		case EndpointFamilyAuto, EndpointFamilyIPv4, EndpointFamilyIPv6:
+		default:
+			return fmt.Errorf("unsupported endpoint family %q", family)
+		}
+		o.endpointFamily = family
+		return nil
+	}
+}
+
+// WithNATTraversal enables exchanging the addresses peers are observed at, so that two peers behind
+// NAT can hole punch to each other. Enabled by default.
+func WithNATTraversal(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.natTraversal = enabled
+		return nil
+	}
+}
+
+// WithPeerHealth enables publishing the health of our connection to each peer, reachability and
+// latest handshake, in the local WireGuardPeer's status.
+func WithPeerHealth(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.peerHealth = enabled
+		return nil
+	}
+}
+
+// WithMDNS enables announcing the local peer and browsing for others via mDNS, so peers on the
+// same LAN connect directly. Discovered peers must be admitted by the registry and peer selector,
+// unless they're allowed by WithMDNSPeers.
+func WithMDNS(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.mdns = enabled
+		return nil
+	}
+}
+
+// WithMDNSPeers peers with neighbors discovered via mDNS which announce one of the public keys, or
+// announce from an address within one of the CIDRs, even without a registry record, for zero-config
+// LAN meshes. They're still subject to revocation and the allowed endpoint CIDRs.
+func WithMDNSPeers(keys, cidrs []string) OptionFunc {
+	return func(o *options) error {
+		o.mdnsPeerKeys = nil
+		for _, k := range keys {
+			key, err := wgtypes.ParseKey(k)
+			if err != nil {
+				return fmt.Errorf("invalid mdns peer key %q: %w", k, err)
+			}
+			if o.mdnsPeerKeys == nil {
+				o.mdnsPeerKeys = make(map[string]bool)
+			}
+			o.mdnsPeerKeys[key.String()] = true
+		}
+		o.mdnsPeerCIDRs = nil
+		if len(cidrs) > 0 {
+			n, err := parseCIDRs(cidrs)
+			if err != nil {
+				return fmt.Errorf("invalid mdns peer cidr: %w", err)
+			}
+			o.mdnsPeerCIDRs = n
+		}
+		return nil
+	}
+}
+
+// WithRoutePriority sets the priority of the local peer's offered routes. When several peers offer
+// the same route, peers send it to the highest priority peer which is completing handshakes.
+func WithRoutePriority(priority int) OptionFunc {
+	return func(o *options) error {
+		o.routePriority = priority
+		return nil
+	}
+}
+
+// WithInstallRoutes sets whether the agent routes its peers' addresses and offered routes via the
+// WireGuard interface.
+func WithInstallRoutes(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.installRoutes = enabled
+		return nil
+	}
+}
+
+// WithClampMSS sets whether installing routes also installs iptables rules which clamp the MSS of
+// forwarded TCP connections to and from the routes peers list in ClampMSSRoutes to the path MTU.
+func WithClampMSS(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.clampMSS = enabled
+		return nil
+	}
+}
+
+// WithClampMSSRoutes publishes offered routes whose forwarded TCP connections peers installing them
+// with MSS clamping should clamp.
+func WithClampMSSRoutes(routes []string) OptionFunc {
+	return func(o *options) error {
+		o.clampMSSRoutes = routes
+		return nil
+	}
+}
+
+// WithSNATRoutes source NATs traffic forwarded from the mesh into the offered routes to the address
+// of the interface it leaves through, ex. the LAN address, for networks without a route back to the
+// mesh.
+func WithSNATRoutes(routes []string) OptionFunc {
+	return func(o *options) error {
+		for _, r := range routes {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				return fmt.Errorf("invalid snat route %q: %w", r, err)
+			}
+		}
+		o.snatRoutes = routes
+		return nil
+	}
+}
+
+// WithTCPTransport accepts WireGuard traffic carried over TCP on the port, by running udp-over-tcp's
+// tcp2udp at path, or from PATH if empty, and publishes the endpoint's host with the port as the TCP
+// endpoint. Zero disables the TCP transport.
+func WithTCPTransport(port int, path string) OptionFunc {
+	return func(o *options) error {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid tcp transport port %d", port)
+		}
+		o.tcpTransportPort = port
+		o.tcp2udpPath = path
+		return nil
+	}
+}
+
+// WithTCPFallback sets whether peers which publish a TCP endpoint are reached through it, by running
+// udp-over-tcp's udp2tcp at path, or from PATH if empty, once their UDP endpoint candidates fail to
+// complete a handshake.
+func WithTCPFallback(enabled bool, path string) OptionFunc {
+	return func(o *options) error {
+		o.tcpFallback = enabled
+		o.udp2tcpPath = path
+		return nil
+	}
+}
+
+// WithRouteMetric sets the metric of installed routes, so they can win or lose against routes from
+// other sources. Zero uses the kernel default.
+func WithRouteMetric(metric int) OptionFunc {
+	return func(o *options) error {
+		if metric < 0 {
+			return fmt.Errorf("invalid route metric %d: must not be negative", metric)
+		}
+		o.routeMetric = metric
+		return nil
+	}
+}
+
+// WithRouteProtocol sets the protocol number of installed routes. Routes via the WireGuard
+// interface with this protocol are managed by the agent; others are left alone.
+func WithRouteProtocol(protocol int) OptionFunc {
+	return func(o *options) error {
+		// 0-2 are reserved by the kernel.
+		if protocol < 3 || protocol > 255 {
+			return fmt.Errorf("invalid route protocol %d: must be between 3 and 255", protocol)
+		}
+		o.routeProtocol = protocol
+		return nil
+	}
+}
+
+// WithECMP load balances routes offered by several peers with the same priority across them.
+// WireGuard routes each address to a single peer, so the route is split into equal parts, which are
+// spread across the peers which are up. Traffic is balanced by destination address.
+func WithECMP(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.ecmp = enabled
+		return nil
+	}
+}
+
+// WithBGP runs a BGP speaker, gobgpd, with the config. It advertises the local peer's mesh addresses,
+// and the addresses and routes of the peers it routes to, to the neighbors. With learnRoutes, the
+// routes the neighbors advertise are offered to the mesh alongside the offered routes.
+func WithBGP(config bgp.Config, learnRoutes bool) OptionFunc {
+	return func(o *options) error {
+		if config.ASN == 0 {
+			return fmt.Errorf("bgp requires an asn")
+		}
+		if len(config.Neighbors) == 0 {
+			return fmt.Errorf("bgp requires at least one neighbor")
+		}
+		o.bgp = &config
+		o.bgpLearnRoutes = learnRoutes
+		return nil
+	}
+}
+
+// WithRoutingDaemon exports the addresses and routes of the peers we route to as static routes via
+// the interface to a routing daemon running on the host, routingd.BIRD or routingd.FRR, for it to
+// redistribute. BIRD's routes are written to birdConfig, or routingd.DefaultBIRDConfig if empty.
+func WithRoutingDaemon(daemon, birdConfig string) OptionFunc {
+	return func(o *options) error {
+		switch daemon {
+		case "", routingd.BIRD, routingd.FRR:
+		default:
+			return fmt.Errorf("unsupported routing daemon %q", daemon)
+		}
+		o.routingDaemon = daemon
+		o.birdConfig = birdConfig
+		return nil
+	}
+}
+
+// WithProxyARP answers ARP and NDP requests on the LAN interface for the mesh addresses of the peers
+// we route to which are within the CIDRs, or all of them if none are given, so devices on the LAN
+// can reach them through us without routes.
+func WithProxyARP(iface string, cidrs []string) OptionFunc {
+	return func(o *options) error {
+		o.proxyARPInterface = iface
+		o.proxyARPCIDRs = nil
+		for _, c := range cidrs {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return fmt.Errorf("invalid proxy arp cidr %q: %w", c, err)
+			}
+			o.proxyARPCIDRs = append(o.proxyARPCIDRs, n)
+		}
+		return nil
+	}
+}
+
+// WithClientOnly configures a peer which can't accept inbound connections, ex. behind a NAT which
+// doesn't allow hole punching. It registers without an endpoint, and keeps alive its sessions so
+// peers can reply through its NAT. Other peers wait for it to initiate.
+func WithClientOnly(clientOnly bool) OptionFunc {
+	return func(o *options) error {
+		o.clientOnly = clientOnly
+		return nil
+	}
+}
+
+// WithRouteReflection makes the local peer a route reflector: it re-advertises the routes it
+// learns from the peers it connects to directly, so peers which only connect to it can reach them.
+// Gateways should enable this, and must forward IP traffic.
+func WithRouteReflection(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.routeReflection = enabled
+		return nil
+	}
+}
+
 // WithWireGuardInterfaceOptions sets parameters used to create/reuse a WireGuard network interface.
 func WithWireGuardInterfaceOptions(wgIfaceOptions *interfaces.WireGuardInterfaceOptions) OptionFunc {
 	return func(o *options) error {
@@ -158,3 +704,430 @@ func WithWireGuardInterfaceOptions(wgIfaceOptions *interfaces.WireGuardInterface
 		return nil
 	}
 }
+
+// WithProtected marks the local peer as protected. Peers will refuse to remove a protected peer
+// when its record is deleted, unless they explicitly allow it.
+func WithProtected(protected bool) OptionFunc {
+	return func(o *options) error {
+		o.protected = protected
+		return nil
+	}
+}
+
+// WithAllowProtectedRemoval allows this agent to remove protected peers when their records are
+// deleted from the registry.
+func WithAllowProtectedRemoval(allow bool) OptionFunc {
+	return func(o *options) error {
+		o.allowProtectedRemoval = allow
+		return nil
+	}
+}
+
+// WithAllowedEndpointCIDRs only configures peers whose published endpoints all fall within the
+// CIDRs, ex. corporate ranges, overriding the Mesh's allowedEndpointCIDRs. Empty defers to the Mesh.
+func WithAllowedEndpointCIDRs(cidrs []string) OptionFunc {
+	return func(o *options) error {
+		if len(cidrs) == 0 {
+			o.allowedEndpointCIDRs = nil
+			return nil
+		}
+		n, err := parseCIDRs(cidrs)
+		if err != nil {
+			return fmt.Errorf("invalid allowed endpoint cidr: %w", err)
+		}
+		o.allowedEndpointCIDRs = n
+		return nil
+	}
+}
+
+// WithKeyPinning pins each peer's public key, by name, on first use, saving the pins to the file at
+// path. A peer later seen with a different key, ex. impersonated through a compromised registry, is
+// handled by mode: KeyPinningReject ignores it, and KeyPinningAlert logs and records an event, but
+// configures it. Rotations are approved through the control socket. Peers must keep their keys,
+// ex. with WithPeerCache or WithKeyProvider, or each restart is a rotation to approve.
+func WithKeyPinning(path, mode string) OptionFunc {
+	return func(o *options) error {
+		switch mode {
+		case KeyPinningReject, KeyPinningAlert:
+		default:
+			return fmt.Errorf("invalid key pinning mode %q; valid: %s,%s", mode, KeyPinningReject, KeyPinningAlert)
+		}
+		o.keyPinsPath = path
+		o.keyPinning = mode
+		return nil
+	}
+}
+
+// WithMeshPolicyEnforcement sets whether the WireGuardMeshPolicies of the registry namespace are
+// enforced, by installing nftables rules on the interface, and by narrowing the allowed IPs of peers
+// the policies cut off from the local peer in both directions.
+func WithMeshPolicyEnforcement(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.enforceMeshPolicies = enabled
+		return nil
+	}
+}
+
+// WithControlSocket sets the path of a unix socket where the agent serves introspection requests.
+func WithControlSocket(path string) OptionFunc {
+	return func(o *options) error {
+		o.controlSocket = path
+		return nil
+	}
+}
+
+// WithChaos enables failure injection hooks on the control socket. These are intended only for
+// resilience testing.
+func WithChaos(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.chaos = enabled
+		return nil
+	}
+}
+
+// WithBenchPort serves throughput tests from peers' agents on the port of the local peer's mesh
+// addresses. Zero disables the server.
+func WithBenchPort(port int) OptionFunc {
+	return func(o *options) error {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid bench port %d", port)
+		}
+		o.benchPort = port
+		return nil
+	}
+}
+
+// WithHandshakeTimeout sets how long we send to a peer without a handshake completing before it's
+// stale. Stale peers' endpoints are re-resolved, or failed over to their next candidate, and their
+// routes move to other peers offering them. WireGuard retries handshakes every 5s.
+func WithHandshakeTimeout(timeout time.Duration) OptionFunc {
+	return func(o *options) error {
+		if timeout < 10*time.Second {
+			return fmt.Errorf("handshake timeout %s must be at least 10s", timeout)
+		}
+		o.handshakeTimeout = timeout
+		return nil
+	}
+}
+
+// WithFlapDamping damps peers whose specs change more than limit times within the window, ex.
+// because of bad automation or a crash-looping agent, applying only their latest change at most once
+// per window until they go a whole window without changing. Zero disables damping.
+func WithFlapDamping(limit int, window time.Duration) OptionFunc {
+	return func(o *options) error {
+		if limit < 0 {
+			return fmt.Errorf("flap damping limit must not be negative; got %d", limit)
+		}
+		if limit > 0 && window < 10*time.Second {
+			return fmt.Errorf("flap damping window %s must be at least 10s", window)
+		}
+		o.flapDampingLimit = limit
+		o.flapDampingWindow = window
+		return nil
+	}
+}
+
+// WithQuarantine removes peers which have never completed a handshake from the device once their
+// endpoints have failed attempts times, over at least the period, keeping the device and logs clean
+// of dead entries. Quarantined peers are put back on the device every retry interval, and released
+// once they complete a handshake, or their WireGuardPeer changes. Zero attempts disables quarantine.
+func WithQuarantine(attempts int, period, retry time.Duration) OptionFunc {
+	return func(o *options) error {
+		if attempts < 0 {
+			return fmt.Errorf("quarantine attempts must not be negative; got %d", attempts)
+		}
+		if attempts > 0 && period < 0 {
+			return fmt.Errorf("quarantine period must not be negative; got %s", period)
+		}
+		if attempts > 0 && retry < time.Minute {
+			return fmt.Errorf("quarantine retry interval %s must be at least 1m", retry)
+		}
+		o.quarantineAttempts = attempts
+		o.quarantinePeriod = period
+		o.quarantineRetry = retry
+		return nil
+	}
+}
+
+// WithResyncPeriod sets how often the registry informers redeliver every cached WireGuardPeer and
+// Mesh, and the full peer and route config is reapplied to the interface, correcting changes made
+// outside the agent. Zero, the default, disables periodic resyncs.
+func WithResyncPeriod(period time.Duration) OptionFunc {
+	return func(o *options) error {
+		if period < 0 {
+			return fmt.Errorf("invalid resync period %s: must not be negative", period)
+		}
+		o.resyncPeriod = period
+		return nil
+	}
+}
+
+// WithMetricsAddr serves Prometheus metrics at /metrics on the address, ex. ":9586".
+func WithMetricsAddr(addr string) OptionFunc {
+	return func(o *options) error {
+		o.metricsAddr = addr
+		return nil
+	}
+}
+
+// WithPeerCache saves the local key, the local peer, and the peers synced from the registry to the
+// file at path. At startup, the interface is configured from the file before the registry is
+// reachable, so a node restarted during an outage rejoins the mesh, and startup waits for the
+// registry rather than failing.
+func WithPeerCache(path string) OptionFunc {
+	return func(o *options) error {
+		o.peerCachePath = path
+		return nil
+	}
+}
+
+// WithKeyProvider loads the private key from the provider, which generates and stores it if it
+// doesn't hold one for the peer, rather than generating it at startup or reading the peer cache.
+// The private key is then left out of the peer cache.
+func WithKeyProvider(p keys.Provider) OptionFunc {
+	return func(o *options) error {
+		o.keyProvider = p
+		return nil
+	}
+}
+
+// WithBootstrapPeer configures the peer on the interface at startup, before the registry is
+// contacted, and keeps it configured alongside the registry's peers, ex. a jump host, or the host
+// serving the registry when it's reached over WireGuard.
+func WithBootstrapPeer(peer BootstrapPeer) OptionFunc {
+	return func(o *options) error {
+		if len(peer.AllowedIPs) == 0 {
+			return fmt.Errorf("bootstrap peer %s: at least one allowed IP is required", peer.PublicKey)
+		}
+		if peer.Endpoint != "" {
+			if _, _, err := net.SplitHostPort(peer.Endpoint); err != nil {
+				return fmt.Errorf("bootstrap peer %s: invalid endpoint %q: %w", peer.PublicKey, peer.Endpoint, err)
+			}
+		}
+		for _, p := range o.bootstrapPeers {
+			if p.PublicKey == peer.PublicKey {
+				return fmt.Errorf("bootstrap peer %s was specified more than once", peer.PublicKey)
+			}
+		}
+		o.bootstrapPeers = append(o.bootstrapPeers, peer)
+		return nil
+	}
+}
+
+// WithInitAttempts limits how many times the agent tries to start, when earlier attempts fail with
+// transient errors, ex. the registry is unreachable or the interface is busy. Zero, the default,
+// retries until the agent is stopped; one fails on the first error.
+func WithInitAttempts(attempts int) OptionFunc {
+	return func(o *options) error {
+		if attempts < 0 {
+			return fmt.Errorf("invalid init attempts %d: must not be negative", attempts)
+		}
+		o.initAttempts = attempts
+		return nil
+	}
+}
+
+// WithForceTakeover claims the local peer's name when the registry already holds a record of it
+// with another endpoint, ex. a node rebuilt with the same hostname on a new address, rather than
+// failing. The record is taken over once it goes unchanged for the grace period; if its holder
+// updates it in the meantime, startup fails as it would without this option.
+func WithForceTakeover(gracePeriod time.Duration) OptionFunc {
+	return func(o *options) error {
+		if gracePeriod < 0 {
+			return fmt.Errorf("takeover grace period must not be negative; got %s", gracePeriod)
+		}
+		o.forceTakeover = true
+		o.takeoverGracePeriod = gracePeriod
+		return nil
+	}
+}
+
+// WithAuditLog records the peers the agent adds, removes, rekeys, and updates on the device, the
+// routes it changes, and each write it makes to the registry, in the sink. The caller closes it.
+func WithAuditLog(sink audit.Sink) OptionFunc {
+	return func(o *options) error {
+		o.auditSink = sink
+		return nil
+	}
+}
+
+// WithProber probes every peer's mesh addresses at the interval, with ICMP echo requests ("icmp") or
+// UDP probes ("udp") answered by the peers' probe echo servers, and exports their reachability and
+// round trip times as metrics. Zero disables the prober.
+func WithProber(interval time.Duration, method string) OptionFunc {
+	return func(o *options) error {
+		if interval < 0 {
+			return fmt.Errorf("probe interval must not be negative; got %s", interval)
+		}
+		if method != "icmp" && method != "udp" {
+			return fmt.Errorf("unsupported probe method %q", method)
+		}
+		o.probeInterval = interval
+		o.probeMethod = method
+		return nil
+	}
+}
+
+// WithMTUProbe measures the path MTU to every peer at the interval, with UDP probes answered by the
+// peers' probe echo servers, warning of peers which can't take packets of the interface's MTU. With
+// auto, the interface's MTU is lowered to fit them instead. Zero disables MTU probes.
+func WithMTUProbe(interval time.Duration, auto bool) OptionFunc {
+	return func(o *options) error {
+		if interval < 0 {
+			return fmt.Errorf("mtu probe interval must not be negative; got %s", interval)
+		}
+		o.mtuProbeInterval = interval
+		o.mtuAuto = auto
+		return nil
+	}
+}
+
+// WithProbePort echoes peers' UDP probes on the port, and sends UDP probes to the same port of
+// peers. Zero disables the echo server.
+func WithProbePort(port int) OptionFunc {
+	return func(o *options) error {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid probe port %d", port)
+		}
+		o.probePort = port
+		return nil
+	}
+}
+
+// ipPoolRequest describes the addresses claimed from a single IPPool.
+type ipPoolRequest struct {
+	name   string
+	counts map[registry.IPFamily]int
+	static []net.IP
+}
+
+// ipPoolRequest returns the request for the named pool, adding one if needed.
+func (o *options) ipPoolRequest(pool string) *ipPoolRequest {
+	for _, r := range o.ipPools {
+		if r.name == pool {
+			return r
+		}
+	}
+	req := &ipPoolRequest{name: pool, counts: make(map[registry.IPFamily]int)}
+	o.ipPools = append(o.ipPools, req)
+	return req
+}
+
+// WithIPPool claims count addresses of the specified family from the named IPPool in the registry
+// namespace. Claimed addresses are assigned to the WireGuard interface and published to peers.
+// WithIPPool may be specified multiple times to claim from several pools (ex. an IPv4 pool and an
+// IPv6 pool), or to claim several families from a single dual-stack pool.
+func WithIPPool(pool string, count int, family registry.IPFamily) OptionFunc {
+	return func(o *options) error {
+		if count < 1 {
+			return fmt.Errorf("ip count must be at least 1; got %d", count)
+		}
+		req := o.ipPoolRequest(pool)
+		if _, ok := req.counts[family]; ok {
+			return fmt.Errorf("ip pool %q: family %q was specified more than once", pool, family)
+		}
+		req.counts[family] = count
+		if _, ok := req.counts[registry.IPFamilyAny]; ok && len(req.counts) > 1 {
+			return fmt.Errorf("ip pool %q: family %q may not be combined with other families", pool, registry.IPFamilyAny)
+		}
+		return nil
+	}
+}
+
+// WithStaticIP claims a specific address from the named IPPool, in addition to any addresses
+// claimed with WithIPPool. Claiming fails if another peer already holds the address.
+func WithStaticIP(pool string, ip net.IP) OptionFunc {
+	return func(o *options) error {
+		if ip == nil {
+			return fmt.Errorf("ip pool %q: invalid static ip", pool)
+		}
+		req := o.ipPoolRequest(pool)
+		req.static = append(req.static, ip)
+		return nil
+	}
+}
+
+// WithIPLeaseDuration sets an expiry on addresses claimed from IPPools. The agent renews the lease
+// while it runs; if the agent is offline longer than the lease, the claim is garbage collected and
+// the address may be reassigned. Zero disables leases.
+func WithIPLeaseDuration(lease time.Duration) OptionFunc {
+	return func(o *options) error {
+		if lease < 0 {
+			return fmt.Errorf("ip lease duration must not be negative; got %s", lease)
+		}
+		o.ipLeaseDuration = lease
+		return nil
+	}
+}
+
+// WithDeregisterOnExit removes the local WireGuardPeer and releases its IPClaims when the agent
+// exits, returning claimed addresses to their pools.
+func WithDeregisterOnExit(deregister bool) OptionFunc {
+	return func(o *options) error {
+		o.deregisterOnExit = deregister
+		return nil
+	}
+}
+
+// WithOperatorManaged leaves publishing the local WireGuardPeer to the controller's node operator.
+// The agent announces its public key and listen port with annotations on the Kubernetes node, and
+// applies the addresses from the record the operator creates. Requires a local kube client config
+// and WithKubeNode, and the peer must be named for the node.
+func WithOperatorManaged(managed bool) OptionFunc {
+	return func(o *options) error {
+		o.operatorManaged = managed
+		return nil
+	}
+}
+
+// WithAnnotateNode publishes the local peer's mesh addresses in an annotation on the Kubernetes
+// node, so other controllers can discover how to reach the node over the mesh. Requires a local
+// kube client config and WithKubeNode.
+func WithAnnotateNode(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.annotateNode = enabled
+		return nil
+	}
+}
+
+// WithClearNetworkUnavailable sets the Kubernetes node's NetworkUnavailable condition to false once
+// peers are configured, like other network providers, when the agent carries the node's pod network
+// (WithPodCIDRIPAM, WithOfferPodCIDRs, or WithOperatorManaged). Enabled by default.
+func WithClearNetworkUnavailable(enabled bool) OptionFunc {
+	return func(o *options) error {
+		o.clearNetworkUnavailable = enabled
+		return nil
+	}
+}
+
+// WithNodeLabels copies the specified labels from the Kubernetes node onto the local peer, and keeps
+// them in sync as the node's labels change. Labels set with WithLabels take precedence. Requires a
+// local kube client config and WithKubeNode.
+func WithNodeLabels(keys []string) OptionFunc {
+	return func(o *options) error {
+		o.nodeLabelKeys = keys
+		return nil
+	}
+}
+
+// WithServiceExport publishes the local Kubernetes cluster's Services which are annotated for
+// export, or which match the selector, and offers routes to their cluster and load balancer IPs.
+// The selector may be nil. Requires a local kube client config.
+func WithServiceExport(selector labels.Selector) OptionFunc {
+	return func(o *options) error {
+		o.serviceExport = true
+		o.serviceSelector = selector
+		return nil
+	}
+}
+
+// WithClusterDomain sets the local cluster's DNS domain, used to name exported Services.
+func WithClusterDomain(domain string) OptionFunc {
+	return func(o *options) error {
+		if domain == "" {
+			return fmt.Errorf("cluster domain must not be empty")
+		}
+		o.clusterDomain = domain
+		return nil
+	}
+}
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+// peerCacheInterval is how often the peer cache is saved, if it changed.
+const peerCacheInterval = 30 * time.Second
+
+// peerCache is the state saved to the peer cache file. At startup, the interface is configured
+// from it before the registry is reachable.
+type peerCache struct {
+	// PrivateKey and PresharedKey are reused, so peers which still hold our record accept us.
+	// PrivateKey is omitted when it's held by a key provider.
+	PrivateKey   string `json:"privateKey,omitempty"`
+	PresharedKey string `json:"presharedKey"`
+	// LocalPeer is our record, as last published.
+	LocalPeer *wgk8s.WireGuardPeer `json:"localPeer"`
+	// Peers are those last synced from the registry, sorted by name.
+	Peers []*wgk8s.WireGuardPeer `json:"peers"`
+	// Mesh selected the local peer, if any.
+	Mesh *wgk8s.Mesh `json:"mesh,omitempty"`
+}
+
+// loadPeerCache reads the peer cache at path, returning nil if there isn't one.
+func loadPeerCache(path string) (*peerCache, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading peer cache: %w", err)
+	}
+	c := &peerCache{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("parsing peer cache %q: %w", path, err)
+	}
+	if c.LocalPeer == nil {
+		return nil, fmt.Errorf("peer cache %q is missing the local peer", path)
+	}
+	return c, nil
+}
+
+// keys parses the cached private and pre-shared keys. The private key is zero if it wasn't cached.
+func (c *peerCache) keys() (privateKey, psk wgtypes.Key, err error) {
+	if c.PrivateKey != "" {
+		privateKey, err = wgtypes.ParseKey(c.PrivateKey)
+		if err != nil {
+			return privateKey, psk, fmt.Errorf("parsing cached private key: %w", err)
+		}
+	}
+	psk, err = wgtypes.ParseKey(c.PresharedKey)
+	if err != nil {
+		return privateKey, psk, fmt.Errorf("parsing cached pre-shared key: %w", err)
+	}
+	return privateKey, psk, nil
+}
+
+// restorePeerCache configures the interface with the cached addresses and peers, so the mesh is
+// usable, possibly including a route to the registry, before the registry is reachable.
+func (a *Agent) restorePeerCache(ctx context.Context) error {
+	c := a.cache
+	a.meshLock.Lock()
+	a.mesh = c.Mesh
+	a.meshLock.Unlock()
+	err := a.initializeWireGuard(ctx)
+	if err != nil {
+		return err
+	}
+	err = a.ensureIPs(c.LocalPeer.Spec.IPs)
+	if err != nil {
+		return err
+	}
+	pt := a.newPeerTracker(c.LocalPeer, newPeerStore())
+	if t, err := meshTopology(c.Mesh); err == nil {
+		pt.topology = t
+	}
+	for _, wgPeer := range c.Peers {
+		if err = pt.storePeer(wgPeer); err != nil {
+			return err
+		}
+	}
+	a.ll.WithField("peers", len(c.Peers)).Info("configuring interface from peer cache")
+	err = pt.applyInitialConfig()
+	if err != nil {
+		return err
+	}
+	// Until the registry's peers are synced, report the cached ones.
+	a.peerTracker = pt
+	return nil
+}
+
+// waitForRegistry blocks until the registry answers, retrying with backoff. After the interface is
+// configured from the peer cache, startup waits for the registry, rather than failing and tearing
+// the interface down.
+func (a *Agent) waitForRegistry(ctx context.Context) error {
+	lw := a.registryHealth.listWatch(ctx, a.registry.WatchPeers(nil, fields.OneTermEqualSelector("metadata.name", a.name)))
+	for {
+		// The ListerWatcher backs off between failed requests.
+		_, err := lw.List(metav1.ListOptions{})
+		if !registryUnreachable(err) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// savePeerCache periodically saves the peers synced from the registry to the peer cache, until the
+// context is canceled.
+func (a *Agent) savePeerCache(ctx context.Context) {
+	var saved []byte
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			b, err := json.MarshalIndent(a.currentPeerCache(), "", "  ")
+			if err != nil {
+				a.ll.WithError(err).Error("failed to encode peer cache")
+				return
+			}
+			if bytes.Equal(b, saved) {
+				return
+			}
+			if err = writeFileAtomic(a.peerCachePath, b); err != nil {
+				a.ll.WithError(err).Error("failed to save peer cache")
+				return
+			}
+			saved = b
+		}, peerCacheInterval, ctx.Done())
+	}()
+}
+
+// currentPeerCache returns the state to be cached.
+func (a *Agent) currentPeerCache() *peerCache {
+	c := &peerCache{
+		PresharedKey: a.psk.String(),
+		Peers:        []*wgk8s.WireGuardPeer{},
+	}
+	if a.keyProvider == nil {
+		c.PrivateKey = a.privateKey.String()
+	}
+	a.publishLock.Lock()
+	c.LocalPeer = a.localPeer.DeepCopy()
+	a.publishLock.Unlock()
+	a.meshLock.Lock()
+	c.Mesh = a.mesh.DeepCopy()
+	a.meshLock.Unlock()
+	a.peerTracker.Lock()
+	for _, wgPeer := range a.peerTracker.listPeers() {
+		c.Peers = append(c.Peers, wgPeer.DeepCopy())
+	}
+	a.peerTracker.Unlock()
+	sort.Slice(c.Peers, func(i, j int) bool { return c.Peers[i].GetName() < c.Peers[j].GetName() })
+	return c
+}
+
+// writeFileAtomic replaces the file at path with one readable only by its owner, so a crash
+// mid-write leaves the previous contents.
+func writeFileAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "peers.json")
+
+	c, err := loadPeerCache(path)
+	require.NoError(t, err)
+	require.Nil(t, c, "no cache yet")
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	psk, err := wgtypes.GenerateKey()
+	require.NoError(t, err)
+	a := &Agent{options: defaultOptions(), privateKey: privateKey, psk: psk}
+	a.localPeer = &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "local"},
+		Spec:       wgk8s.WireGuardPeerSpec{IPs: []string{"10.0.0.1/32"}},
+	}
+	a.mesh = &wgk8s.Mesh{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	a.peerTracker = &peerTracker{registry: testRegistry(
+		&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "b", SelfLink: "/b"}},
+		&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "a", SelfLink: "/a"}},
+	)}
+
+	b, err := json.Marshal(a.currentPeerCache())
+	require.NoError(t, err)
+	require.NoError(t, writeFileAtomic(path, b))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm(), "the cache holds the private key")
+
+	c, err = loadPeerCache(path)
+	require.NoError(t, err)
+	require.Equal(t, "local", c.LocalPeer.GetName())
+	require.Equal(t, []string{"10.0.0.1/32"}, c.LocalPeer.Spec.IPs)
+	require.Equal(t, "default", c.Mesh.GetName())
+	require.Len(t, c.Peers, 2)
+	require.Equal(t, "a", c.Peers[0].GetName())
+	require.Equal(t, "/b", c.Peers[1].GetSelfLink(), "peers are keyed by self link")
+	cachedKey, cachedPSK, err := c.keys()
+	require.NoError(t, err)
+	require.Equal(t, privateKey, cachedKey)
+	require.Equal(t, psk, cachedPSK)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"privateKey": "x"}`), 0600))
+	_, err = loadPeerCache(path)
+	require.Error(t, err, "missing the local peer")
+}
+
+// fakeKeyProvider holds keys in memory.
+type fakeKeyProvider map[string]wgtypes.Key
+
+func (f fakeKeyProvider) PrivateKey(ctx context.Context, name string) (wgtypes.Key, error) {
+	if _, ok := f[name]; !ok {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return key, err
+		}
+		f[name] = key
+	}
+	return f[name], nil
+}
+
+func TestInitKeysKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.json")
+	provider := fakeKeyProvider{}
+
+	a, err := NewAgent("local", WithKeyProvider(provider), WithPeerCache(path))
+	require.NoError(t, err)
+	a.ll = logrus.New()
+	require.NoError(t, a.initKeys(context.Background()))
+	require.Equal(t, provider["local"], a.privateKey)
+	require.Equal(t, provider["local"].PublicKey(), a.publicKey)
+	psk := a.psk
+
+	a.localPeer = &wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "local"}}
+	a.peerTracker = &peerTracker{}
+	b, err := json.Marshal(a.currentPeerCache())
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "privateKey", "the provider's key isn't cached")
+	require.NoError(t, writeFileAtomic(path, b))
+
+	a, err = NewAgent("local", WithKeyProvider(provider), WithPeerCache(path))
+	require.NoError(t, err)
+	a.ll = logrus.New()
+	require.NoError(t, a.initKeys(context.Background()))
+	require.NotNil(t, a.cache)
+	require.Equal(t, provider["local"], a.privateKey)
+	require.Equal(t, psk, a.psk, "the cached pre-shared key is reused")
+
+	a, err = NewAgent("local", WithPeerCache(path))
+	require.NoError(t, err)
+	a.ll = logrus.New()
+	require.NoError(t, a.initKeys(context.Background()))
+	require.Nil(t, a.cache, "without a provider, a cache without the private key is ignored")
+	require.NotEqual(t, provider["local"], a.privateKey)
+}
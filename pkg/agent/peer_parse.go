@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+// parsedPeer holds the parsed key and prefixes of a version of a peer, so they're not parsed again on
+// every sync.
+type parsedPeer struct {
+	// from is the version they were parsed from. Versions are never modified, so a new version is a
+	// new object.
+	from      *wgk8s.WireGuardPeer
+	key       wgtypes.Key
+	keyErr    error
+	prefixes  []net.IPNet
+	prefixErr error
+}
+
+// parse returns the parsed peer, parsing it if this version hasn't been. The caller must hold the
+// lock.
+func (pt *peerTracker) parse(wgPeer *wgk8s.WireGuardPeer) *parsedPeer {
+	name := wgPeer.GetSelfLink()
+	if p, ok := pt.parsed[name]; ok && p.from == wgPeer {
+		return p
+	}
+	p := &parsedPeer{from: wgPeer}
+	p.key, p.keyErr = wgtypes.ParseKey(wgPeer.Spec.PublicKey)
+	p.prefixes, p.prefixErr = peerPrefixes(wgPeer)
+	if pt.parsed == nil {
+		pt.parsed = make(map[string]*parsedPeer)
+	}
+	pt.parsed[name] = p
+	return p
+}
+
+// publicKey returns the peer's parsed public key. The caller must hold the lock.
+func (pt *peerTracker) publicKey(wgPeer *wgk8s.WireGuardPeer) (wgtypes.Key, error) {
+	p := pt.parse(wgPeer)
+	if p.keyErr != nil {
+		return wgtypes.Key{}, fmt.Errorf("failed to parse public key: %w", p.keyErr)
+	}
+	return p.key, nil
+}
+
+// prefixes returns the prefixes routed to the peer, as peerPrefixes does. The slice is the caller's
+// to modify. The caller must hold the lock.
+func (pt *peerTracker) prefixes(wgPeer *wgk8s.WireGuardPeer) ([]net.IPNet, error) {
+	p := pt.parse(wgPeer)
+	if p.prefixErr != nil {
+		return nil, p.prefixErr
+	}
+	return append([]net.IPNet(nil), p.prefixes...), nil
+}
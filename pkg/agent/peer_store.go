@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+// selfLinkIndex indexes the registry's peers by self link, which the peer tracker keys them by.
+const selfLinkIndex = "selfLink"
+
+// peerIndexers are the indexes of the store of the registry's peers.
+func peerIndexers() cache.Indexers {
+	return cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		selfLinkIndex: func(obj interface{}) ([]string, error) {
+			m, err := meta.Accessor(obj)
+			if err != nil {
+				return nil, err
+			}
+			return []string{m.GetSelfLink()}, nil
+		},
+	}
+}
+
+// newPeerStore returns a store for peers which don't come from an informer, ex. those of the peer
+// cache. They're added with storePeer.
+func newPeerStore() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, peerIndexers())
+}
+
+// storePeer adds or updates the peer in the tracker's store, as an informer would, and applies it.
+func (pt *peerTracker) storePeer(wgPeer *wgk8s.WireGuardPeer) error {
+	old := pt.registryPeer(wgPeer.GetSelfLink())
+	if err := pt.registry.Update(wgPeer); err != nil {
+		return err
+	}
+	return pt.applyUpdate(old, wgPeer)
+}
+
+// registryPeer returns the registry's latest version of the peer, or nil if it has none.
+func (pt *peerTracker) registryPeer(name string) *wgk8s.WireGuardPeer {
+	if pt.registry == nil {
+		return nil
+	}
+	objs, err := pt.registry.ByIndex(selfLinkIndex, name)
+	if err != nil || len(objs) == 0 {
+		return nil
+	}
+	return objs[0].(*wgk8s.WireGuardPeer)
+}
+
+// current returns the version of the peer in effect, whether it's admitted or rejected, or nil if
+// there's none: the version applied before a damped peer's held changes, the registry's, or the last
+// version of a protected peer deleted from the registry. The caller must hold the lock.
+func (pt *peerTracker) current(name string) *wgk8s.WireGuardPeer {
+	if wgPeer := pt.heldPeer(name); wgPeer != nil {
+		return wgPeer
+	}
+	if wgPeer := pt.registryPeer(name); wgPeer != nil {
+		return wgPeer
+	}
+	return pt.protectedPeers[name]
+}
+
+// peer returns the version of the peer in effect, if it's configured. It's shared with the
+// informer's store, and mustn't be modified. The caller must hold the lock.
+func (pt *peerTracker) peer(name string) (*wgk8s.WireGuardPeer, bool) {
+	if pt.localPeer != nil && name == pt.localPeer.GetSelfLink() {
+		return nil, false
+	}
+	wgPeer := pt.current(name)
+	if wgPeer == nil || !pt.admitted(name, wgPeer) {
+		return nil, false
+	}
+	return wgPeer, true
+}
+
+// admitted returns true if the policy admits the version of the peer. Versions which haven't been
+// checked, ex. as the informer's store is updated ahead of calling the tracker, are checked here, so
+// they're never configured before they're admitted. The caller must hold the lock.
+func (pt *peerTracker) admitted(name string, wgPeer *wgk8s.WireGuardPeer) bool {
+	if version, ok := pt.checked[name]; ok && version == wgPeer.GetResourceVersion() {
+		_, rejected := pt.rejectedPeers[name]
+		return !rejected
+	}
+	reason, _ := pt.rejection(wgPeer)
+	return reason == ""
+}
+
+// names returns the self links of the peers in effect, whether they're admitted or rejected. The
+// caller must hold the lock.
+func (pt *peerTracker) names() []string {
+	var out []string
+	seen := make(map[string]bool)
+	if pt.registry != nil {
+		for _, obj := range pt.registry.List() {
+			name := obj.(*wgk8s.WireGuardPeer).GetSelfLink()
+			if pt.localPeer != nil && name == pt.localPeer.GetSelfLink() {
+				continue
+			}
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	for name := range pt.protectedPeers {
+		if !seen[name] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// listPeers returns the configured peers, keyed by self link. They're shared with the informer's
+// store, and mustn't be modified. The caller must hold the lock.
+func (pt *peerTracker) listPeers() map[string]*wgk8s.WireGuardPeer {
+	out := make(map[string]*wgk8s.WireGuardPeer)
+	add := func(name string, wgPeer *wgk8s.WireGuardPeer) {
+		if pt.localPeer != nil && name == pt.localPeer.GetSelfLink() {
+			return
+		}
+		if held := pt.heldPeer(name); held != nil {
+			wgPeer = held
+		}
+		if pt.admitted(name, wgPeer) {
+			out[name] = wgPeer
+		}
+	}
+	// The registry's peers are listed at once, rather than looked up by name, which is costly in
+	// large meshes.
+	seen := make(map[string]bool)
+	if pt.registry != nil {
+		for _, obj := range pt.registry.List() {
+			wgPeer := obj.(*wgk8s.WireGuardPeer)
+			seen[wgPeer.GetSelfLink()] = true
+			add(wgPeer.GetSelfLink(), wgPeer)
+		}
+	}
+	for name, wgPeer := range pt.protectedPeers {
+		if !seen[name] {
+			add(name, wgPeer)
+		}
+	}
+	return out
+}
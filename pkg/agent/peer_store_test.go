@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/cache"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+// testRegistry returns a store of the registry's peers holding the peers.
+func testRegistry(peers ...*wgk8s.WireGuardPeer) cache.Indexer {
+	store := newPeerStore()
+	for _, p := range peers {
+		if err := store.Add(p); err != nil {
+			panic(err)
+		}
+	}
+	return store
+}
+
+// testDeletePeer deletes the peer from the tracker's store, as an informer would, and applies it.
+func testDeletePeer(pt *peerTracker, wgPeer *wgk8s.WireGuardPeer) error {
+	if err := pt.registry.Delete(wgPeer); err != nil {
+		return err
+	}
+	return pt.deletePeer(wgPeer)
+}
+
+func TestPeerStore(t *testing.T) {
+	pt := &peerTracker{
+		ll:          logrus.New(),
+		registry:    newPeerStore(),
+		localPeer:   testPeer("local", nil),
+		revokedKeys: map[string]bool{"revoked": true},
+	}
+	a := testPeer("a", nil, "10.0.0.1/32")
+	a.ResourceVersion = "1"
+	require.NoError(t, pt.storePeer(a))
+	require.NoError(t, pt.registry.Add(pt.localPeer))
+	require.Equal(t, []string{"/a"}, peerNames(pt.listPeers()), "the local peer isn't configured")
+
+	// The informer's store is updated before the tracker hears of the update.
+	revoked := testPeer("a", nil, "10.0.0.1/32")
+	revoked.ResourceVersion = "2"
+	revoked.Spec.PublicKey = "revoked"
+	require.NoError(t, pt.registry.Update(revoked))
+	require.Empty(t, pt.listPeers(), "unchecked versions are checked as they're listed")
+	require.NoError(t, pt.applyUpdate(a, revoked))
+	require.Empty(t, pt.listPeers())
+	require.Contains(t, pt.rejectedPeers, "/a")
+
+	protected := testPeer("a", nil, "10.0.0.1/32")
+	protected.ResourceVersion = "3"
+	protected.Annotations = map[string]string{wgk8s.ProtectedAnnotation: "true"}
+	require.NoError(t, pt.storePeer(protected))
+	require.Equal(t, []string{"/a"}, peerNames(pt.listPeers()))
+	require.NoError(t, pt.registry.Delete(protected))
+	require.Equal(t, []string{"/a"}, peerNames(pt.listPeers()), "protected peers are kept before the tracker hears of the delete")
+	require.Equal(t, errProtectedPeer, pt.deletePeer(protected))
+	require.Same(t, protected, pt.listPeers()["/a"], "peers are shared with the store rather than copied")
+}
@@ -1,97 +1,543 @@
 package agent
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"reflect"
+	"sort"
 	"sync"
 	"time"
 
 	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/audit"
 	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
 	log "github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/client-go/tools/cache"
 )
 
+var errProtectedPeer = errors.New("peer is protected; refusing to remove it")
+
 type peerTracker struct {
 	sync.Mutex
 
 	ll                   log.FieldLogger
 	iface                interfaces.WireGuardInterface
-	peers                map[string]*wgk8s.WireGuardPeer
 	initialConfigApplied bool
 	localPeer            *wgk8s.WireGuardPeer
+	// registry is the informer's store of the registry's peers, indexed by peerIndexers. The peers
+	// are read from it rather than copied; the tracker only keeps what it needs to apply them.
+	registry cache.Indexer
+	// checked holds the resource version of each peer whose admission by the policy is recorded in
+	// rejectedPeers, keyed by self link, like the tracker's other maps.
+	checked map[string]string
+	// protectedPeers hold the latest version of each protected peer, so it's kept once it's deleted
+	// from the registry.
+	protectedPeers map[string]*wgk8s.WireGuardPeer
+
+	// applied holds the config last applied to the device for each peer.
+	applied map[string]wgtypes.PeerConfig
+	// topology decides which peers we connect to directly.
+	topology topology
 
 	keepalive time.Duration
+
+	// endpoints tracks which endpoint candidate is in use for each peer.
+	endpoints map[string]*endpointState
+	now       func() time.Time
+	// liveness tracks whether each peer is completing handshakes. Routes offered by several peers
+	// avoid those which are down.
+	liveness map[string]*peerLiveness
+	// handshakeTimeout is how long we send to a peer without a handshake before it's stale, or
+	// endpointFailoverTimeout if zero.
+	handshakeTimeout time.Duration
+	// installRoutes routes the peers' allowed IPs via the interface, with routeOptions.
+	installRoutes bool
+	routeOptions  interfaces.RouteOptions
+	// mssClamp, if set, clamps the MSS of TCP connections forwarded to and from the routes peers
+	// list in ClampMSSRoutes, as routes are installed.
+	mssClamp *mssClamper
+	// ecmp splits routes offered by several equally preferred peers between them.
+	ecmp bool
+	// clientOnly keeps alive our sessions with every peer, since we can't accept inbound connections.
+	clientOnly bool
+	// natTraversal adds the addresses other peers observe a peer at to its endpoint candidates.
+	natTraversal bool
+	// lanEndpoints are the addresses peers were discovered at on the local network, keyed by
+	// public key. They're preferred over every other candidate if the peer published their host,
+	// and carry the neighbors which are peered with from their announcements alone.
+	lanEndpoints map[string]lanEndpoint
+
+	// bootstrap peers are configured alongside the registry's.
+	bootstrap []BootstrapPeer
+	// tcpFallback, if set, reaches peers over TCP through their TCP endpoints once their UDP
+	// candidates fail.
+	tcpFallback *tcpTransports
+	// families chooses between the IPv4 and IPv6 addresses of peers' endpoints.
+	families endpointFamilies
+
+	// allowProtectedRemoval permits removing peers annotated as protected.
+	allowProtectedRemoval bool
+
+	// namespace, if set, is the local peer's namespace. Peers of other namespaces are only
+	// configured if their namespace is in sharedNamespaces, because its Meshes share them with ours.
+	namespace        string
+	sharedNamespaces map[string]bool
+	// revokedKeys are public keys listed by a Mesh as revoked.
+	revokedKeys map[string]bool
+	// allowedEndpoints, if set, are the networks peers' published endpoints must fall within.
+	allowedEndpoints []*net.IPNet
+	// keyPins, if set, pins each peer's public key on first use.
+	keyPins *keyPins
+	// policyFirewall, if set, enforces meshPolicies, filtering the traffic peers send us, and
+	// narrowing the allowed IPs of peers which may neither reach us nor be reached.
+	policyFirewall *meshPolicyFirewall
+	meshPolicies   []meshPolicy
+	// rejectedPeers hold the reason the policy rejects peers, because their namespace isn't shared,
+	// their key is revoked or differs from its pin, or their endpoints aren't allowed. They're left
+	// unconfigured, and return if the policy changes to admit them.
+	rejectedPeers map[string]string
+	// parsed holds the parsed keys and prefixes of the peers, keyed by self link.
+	parsed map[string]*parsedPeer
+	// onReject, if set, is called as a peer is rejected, ex. to record an event.
+	onReject func(wgPeer *wgk8s.WireGuardPeer, reason, msg string)
+	// flaps, if set, damps peers whose specs change too often.
+	flaps *flapDamper
+	// onDamped, if set, is called as a peer is damped, ex. to record an event.
+	onDamped func(wgPeer *wgk8s.WireGuardPeer, msg string)
+	// quarantine, if set, holds peers which never complete a handshake off the device.
+	quarantine *quarantine
+	// onQuarantine, if set, is called as a peer is quarantined, ex. to record an event.
+	onQuarantine func(wgPeer *wgk8s.WireGuardPeer, msg string)
+
+	// events, if set, receives the changes applied to the device, and peers becoming stale.
+	events  *eventBroadcaster
+	metrics *metrics
+	// audit, if set, records the peers and routes changed on the device.
+	audit *audit.Log
+	// routed holds the prefixes last routed via the interface.
+	routed map[string]bool
 }
 
-func (pt *peerTracker) applyUpdate(wgPeer *wgk8s.WireGuardPeer) error {
+// applyUpdate applies the peer's update from old, which is nil if it was added. The registry's store
+// already holds the update.
+func (pt *peerTracker) applyUpdate(old, wgPeer *wgk8s.WireGuardPeer) error {
 	pt.Lock()
 	defer pt.Unlock()
 	name := wgPeer.GetSelfLink()
-	if current, ok := pt.peers[name]; ok && reflect.DeepEqual(current, wgPeer) {
-		// No update
+	if old != nil && unchangedPeer(old, wgPeer) {
+		return nil // No update, ex. a resync.
+	}
+	// The version in effect is held while the peer is damped.
+	prev := pt.heldPeer(name)
+	if prev == nil {
+		prev = old
+	}
+	if pt.dampen(name, old, wgPeer) {
 		return nil
 	}
-	pt.peers[name] = wgPeer.DeepCopy()
-	if !pt.initialConfigApplied {
+	if !pt.admit(name, prev, wgPeer) || !pt.initialConfigApplied {
 		return nil
 	}
-	peer, err := pt.k8sToWgctrl(wgPeer)
-	if err != nil {
-		return err
+	// A change to one peer may change the routes of others, ex. a leaf's hub.
+	return pt.sync()
+}
+
+// admit checks the peer's version against the policy, setting it aside if it's rejected, and returns
+// true if the configured peers changed. prev is the version in effect before it, if any. The caller
+// must hold the lock.
+func (pt *peerTracker) admit(name string, prev, wgPeer *wgk8s.WireGuardPeer) bool {
+	_, wasRejected := pt.rejectedPeers[name]
+	wasChecked := pt.check(name, wgPeer)
+	pt.protect(name, wgPeer)
+	if reason, msg := pt.rejection(wgPeer); reason != "" {
+		pt.reject(name, wgPeer, reason, msg+", ignoring peer")
+		if !wasChecked || wasRejected {
+			return false
+		}
+		pt.forget(wgPeer)
+		return true
 	}
-	return pt.iface.ConfigureWireGuard(wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{peer},
-	})
+	delete(pt.rejectedPeers, name)
+	if prev != nil && !reflect.DeepEqual(prev.Spec, wgPeer.Spec) {
+		pt.releaseQuarantine(name)
+	}
+	return true
 }
 
 func (pt *peerTracker) deletePeer(wgPeer *wgk8s.WireGuardPeer) error {
 	pt.Lock()
 	defer pt.Unlock()
 	name := wgPeer.GetSelfLink()
-	current, ok := pt.peers[name]
-	if !ok {
-		return nil // We've never heard of it, goodbye.
+	_, known := pt.checked[name]
+	_, rejected := pt.rejectedPeers[name]
+	if current := pt.current(name); current != nil {
+		// The version in effect, ex. while the peer is damped.
+		wgPeer = current
+	}
+	pt.discardDamped(name)
+	if !known || rejected {
+		// It was never configured, goodbye.
+		pt.drop(name)
+		return nil
+	}
+	if wgPeer.IsProtected() && !pt.allowProtectedRemoval {
+		// Keep the last known config so the peer's routes survive an accidental delete.
+		pt.protect(name, wgPeer)
+		return errProtectedPeer
 	}
+	pt.drop(name)
+	pt.forget(wgPeer)
 	if !pt.initialConfigApplied {
-		delete(pt.peers, name)
 		return nil
 	}
-	// Ok, we actually have to wind this one back.
-	peer, err := pt.k8sToWgctrl(current)
-	if err != nil {
-		return err
+	return pt.sync()
+}
+
+// check records that the peer's version is checked against the policy, and returns true if an
+// earlier version was. The caller must hold the lock.
+func (pt *peerTracker) check(name string, wgPeer *wgk8s.WireGuardPeer) bool {
+	if pt.checked == nil {
+		pt.checked = make(map[string]string)
+	}
+	_, ok := pt.checked[name]
+	pt.checked[name] = wgPeer.GetResourceVersion()
+	return ok
+}
+
+// protect keeps the version of the peer if it's protected, so it outlives its deletion from the
+// registry. The caller must hold the lock.
+func (pt *peerTracker) protect(name string, wgPeer *wgk8s.WireGuardPeer) {
+	if !wgPeer.IsProtected() {
+		delete(pt.protectedPeers, name)
+		return
+	}
+	if pt.protectedPeers == nil {
+		pt.protectedPeers = make(map[string]*wgk8s.WireGuardPeer)
+	}
+	pt.protectedPeers[name] = wgPeer
+}
+
+// drop drops the policy's record of a peer deleted from the registry. The caller must hold the lock.
+func (pt *peerTracker) drop(name string) {
+	delete(pt.checked, name)
+	delete(pt.rejectedPeers, name)
+	delete(pt.protectedPeers, name)
+	delete(pt.parsed, name)
+}
+
+// forget drops everything tracked about applying the peer, as it's removed. The caller must hold
+// the lock.
+func (pt *peerTracker) forget(wgPeer *wgk8s.WireGuardPeer) {
+	name := wgPeer.GetSelfLink()
+	pt.metrics.forgetPeer(wgPeer.GetName())
+	delete(pt.endpoints, name)
+	delete(pt.liveness, name)
+	if pt.quarantine != nil {
+		delete(pt.quarantine.peers, name)
 	}
-	peer.Remove = true
-	return pt.iface.ConfigureWireGuard(wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{peer},
-	})
+}
+
+// Reasons peers are rejected, used as event reasons.
+const (
+	reasonNamespaceNotShared = "NamespaceNotShared"
+	reasonKeyRevoked         = "PublicKeyRevoked"
+	reasonKeyChanged         = "PublicKeyChanged"
+	reasonEndpointNotAllowed = "EndpointNotAllowed"
+)
+
+// rejection returns the reason the policy rejects the peer, and a message describing it, or "" if
+// it's admitted. The caller must hold the lock.
+func (pt *peerTracker) rejection(wgPeer *wgk8s.WireGuardPeer) (reason, msg string) {
+	if reason, msg := pt.namespaceRejection(wgPeer); reason != "" {
+		return reason, msg
+	}
+	if pt.revokedKeys[wgPeer.Spec.PublicKey] {
+		return reasonKeyRevoked, "WireGuardPeer's public key is revoked"
+	}
+	if reason, msg := pt.pinnedKeyRejection(wgPeer); reason != "" {
+		return reason, msg
+	}
+	if endpoint := pt.disallowedEndpoint(wgPeer); endpoint != "" {
+		return reasonEndpointNotAllowed, fmt.Sprintf("WireGuardPeer's endpoint %s isn't within the allowed endpoint CIDRs", endpoint)
+	}
+	return "", ""
+}
+
+// reject sets aside a peer the policy rejects, logging, and with onReject reporting, newly rejected
+// peers. The caller must hold the lock.
+func (pt *peerTracker) reject(name string, wgPeer *wgk8s.WireGuardPeer, reason, msg string) {
+	if pt.rejectedPeers == nil {
+		pt.rejectedPeers = make(map[string]string)
+	}
+	if current, ok := pt.rejectedPeers[name]; !ok || current != reason {
+		wglog.WithPeer(pt.ll, wgPeer).Warn(msg)
+		if pt.onReject != nil {
+			pt.onReject(wgPeer, reason, msg)
+		}
+	}
+	pt.rejectedPeers[name] = reason
+}
+
+// setRevokedKeys changes the revoked public keys, removing peers which use a newly revoked key and
+// restoring those whose key is no longer revoked. Revocation overrides peer protection, since it's
+// an explicit request to disconnect the peer.
+func (pt *peerTracker) setRevokedKeys(keys map[string]bool) error {
+	pt.Lock()
+	defer pt.Unlock()
+	if revokedKeysEqual(pt.revokedKeys, keys) {
+		return nil
+	}
+	pt.revokedKeys = keys
+	return pt.applyPolicy()
+}
+
+// setAllowedEndpoints changes the networks peers' endpoints must fall within, removing peers whose
+// endpoints are no longer allowed, and restoring those whose are. Like revocation, it overrides peer
+// protection. Nil allows any endpoint.
+func (pt *peerTracker) setAllowedEndpoints(cidrs []*net.IPNet) error {
+	pt.Lock()
+	defer pt.Unlock()
+	if reflect.DeepEqual(pt.allowedEndpoints, cidrs) {
+		return nil
+	}
+	pt.allowedEndpoints = cidrs
+	return pt.applyPolicy()
+}
+
+// applyPolicy rejects the peers the policy no longer admits, and restores the rejected peers it now
+// admits. The caller must hold the lock.
+func (pt *peerTracker) applyPolicy() error {
+	for _, name := range pt.names() {
+		wgPeer := pt.current(name)
+		_, wasRejected := pt.rejectedPeers[name]
+		wasChecked := pt.check(name, wgPeer)
+		reason, msg := pt.rejection(wgPeer)
+		switch {
+		case reason != "" && wasChecked && !wasRejected:
+			pt.reject(name, wgPeer, reason, msg+", removing peer")
+			pt.forget(wgPeer)
+		case reason != "":
+			pt.reject(name, wgPeer, reason, msg+", ignoring peer")
+		case wasRejected:
+			wglog.WithPeer(pt.ll, wgPeer).Info("WireGuardPeer is no longer rejected, adding peer")
+			delete(pt.rejectedPeers, name)
+		}
+	}
+	if !pt.initialConfigApplied {
+		return nil
+	}
+	return pt.sync()
+}
+
+func revokedKeysEqual(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
 }
 
 func (pt *peerTracker) applyInitialConfig() error {
 	pt.Lock()
 	defer pt.Unlock()
 	pt.initialConfigApplied = true
+	return pt.replaceConfig()
+}
+
+// replaceConfig brings the device's peers, as read back from it, to the desired config, and syncs
+// routes. Only the delta is applied, so peers which are already configured keep their sessions. The
+// caller must hold the lock.
+func (pt *peerTracker) replaceConfig() error {
+	if err := pt.syncMeshPolicyRules(); err != nil {
+		return err
+	}
+	desired := pt.desiredPeers()
+	if err := pt.configureDevice(desired); err != nil {
+		return err
+	}
+	pt.publishApplied(desired)
+	pt.applied = desired
+	return pt.syncRoutes()
+}
 
-	var config = wgtypes.Config{
-		ReplacePeers: true,
+// sync applies the difference between the device's peers and the desired peer configs, if the
+// desired configs changed since they were applied. The caller must hold the lock.
+func (pt *peerTracker) sync() error {
+	// Policies are enforced before the peers they allow are configured.
+	if err := pt.syncMeshPolicyRules(); err != nil {
+		return err
+	}
+	desired := pt.desiredPeers()
+	if len(peerConfigDelta(pt.applied, desired)) == 0 {
+		return nil
+	}
+	if err := pt.configureDevice(desired); err != nil {
+		return err
+	}
+	pt.publishApplied(desired)
+	pt.applied = desired
+	return pt.syncRoutes()
+}
+
+// publishApplied publishes events for the changes from the applied to the desired configs. The
+// caller must hold the lock.
+func (pt *peerTracker) publishApplied(desired map[string]wgtypes.PeerConfig) {
+	if pt.events == nil && pt.audit == nil {
+		return
+	}
+	events := appliedEvents(pt.applied, desired, time.Now())
+	if pt.events != nil {
+		for _, e := range events {
+			pt.events.publish(e)
+		}
 	}
-	for _, wgPeer := range pt.peers {
+	auditApplied(pt.audit, events)
+}
+
+// desiredPeers builds the config for each peer we connect to directly, keyed by self link. Peers
+// whose config can't be built are skipped. The caller must hold the lock.
+func (pt *peerTracker) desiredPeers() map[string]wgtypes.PeerConfig {
+	peers := pt.listPeers()
+	direct, via := pt.topology.plan(pt.localPeer, peers)
+	out := make(map[string]wgtypes.PeerConfig, len(direct))
+	for name := range direct {
+		if pt.quarantined(name) {
+			continue
+		}
+		wgPeer := peers[name]
 		peer, err := pt.k8sToWgctrl(wgPeer)
 		if err != nil {
 			// Don't fail out if a single peer fails.
 			// TODO - add retry for temporary erors (ex. dns resolution)
-			pt.ll.WithFields(log.Fields{
-				"k8s_namespace": wgPeer.Namespace,
-				"k8s_kind":      wgPeer.Kind,
-				"k8s_name":      wgPeer.Name,
-			}).WithError(err).Warn("failed to build control peer")
+			wglog.WithPeer(pt.ll, wgPeer).WithError(err).Warn("failed to build control peer")
 			continue
 		}
-		config.Peers = append(config.Peers, peer)
+		for _, leafName := range via[name] {
+			leaf := peers[leafName]
+			prefixes, err := pt.prefixes(leaf)
+			if err != nil {
+				wglog.WithPeer(pt.ll, wgPeer).WithField("leaf", leaf.GetName()).WithError(err).Warn("failed to route leaf through hub")
+				continue
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, prefixes...)
+		}
+		peer.AllowedIPs = pt.narrowAllowedIPs(wgPeer, peer.AllowedIPs)
+		out[name] = peer
+	}
+	pt.assignDuplicateRoutes(out)
+	pt.addReflectedRoutes(out, peers)
+	pt.addBootstrapPeers(out)
+	pt.addLANPeers(out)
+	return out
+}
+
+// peerConfigDelta returns the peer configs which move the device from the applied to the desired
+// configs. Peers which are unchanged are left alone so their sessions aren't disturbed, and an
+// unchanged endpoint isn't re-set, since WireGuard may have roamed to the peer's actual address.
+func peerConfigDelta(applied, desired map[string]wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	var out []wgtypes.PeerConfig
+	for name, prev := range applied {
+		if cur, ok := desired[name]; !ok || cur.PublicKey != prev.PublicKey {
+			out = append(out, wgtypes.PeerConfig{PublicKey: prev.PublicKey, Remove: true})
+		}
 	}
-	return pt.iface.ConfigureWireGuard(config)
+	for name, cur := range desired {
+		prev, ok := applied[name]
+		if ok && prev.PublicKey == cur.PublicKey {
+			if peerConfigEqual(prev, cur) {
+				continue
+			}
+			if udpAddrEqual(prev.Endpoint, cur.Endpoint) {
+				cur.Endpoint = nil
+			}
+		}
+		cur.ReplaceAllowedIPs = true
+		out = append(out, cur)
+	}
+	return out
+}
+
+func peerConfigEqual(a, b wgtypes.PeerConfig) bool {
+	return a.PublicKey == b.PublicKey &&
+		udpAddrEqual(a.Endpoint, b.Endpoint) &&
+		reflect.DeepEqual(a.PersistentKeepaliveInterval, b.PersistentKeepaliveInterval) &&
+		ipNetsEqual(a.AllowedIPs, b.AllowedIPs)
+}
+
+// ipNetsEqual returns true if a and b hold the same prefixes, in any order. Prefixes in the same
+// order, as configs built from the same spec are, are compared without formatting them.
+func ipNetsEqual(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].IP.Equal(b[i].IP) || !bytes.Equal(a[i].Mask, b[i].Mask) {
+			return reflect.DeepEqual(ipNetStrings(a), ipNetStrings(b))
+		}
+	}
+	return true
+}
+
+func udpAddrString(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// udpAddrEqual returns true if a and b are the same address, or both nil.
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
+
+func ipNetStrings(nets []net.IPNet) []string {
+	out := make([]string, 0, len(nets))
+	for _, n := range nets {
+		out = append(out, n.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+// setKeepalive changes the local keepalive limit and, once the initial config has been applied,
+// reconfigures every peer with it.
+func (pt *peerTracker) setKeepalive(keepalive time.Duration) error {
+	pt.Lock()
+	defer pt.Unlock()
+	if pt.keepalive == keepalive {
+		return nil
+	}
+	pt.keepalive = keepalive
+	if !pt.initialConfigApplied {
+		return nil
+	}
+	return pt.sync()
+}
+
+// setTopology changes the topology and, once the initial config has been applied, reconfigures
+// peers to match it.
+func (pt *peerTracker) setTopology(t topology) error {
+	pt.Lock()
+	defer pt.Unlock()
+	if pt.topology.equal(t) {
+		return nil
+	}
+	pt.topology = t
+	if !pt.initialConfigApplied {
+		return nil
+	}
+	return pt.sync()
 }
 
 func (pt *peerTracker) OnAdd(obj interface{}) {
@@ -104,13 +550,9 @@ func (pt *peerTracker) OnAdd(obj interface{}) {
 		// Got ourselves, no-op
 		return
 	}
-	ll := pt.ll.WithFields(log.Fields{
-		"k8s_namespace": wgPeer.Namespace,
-		"k8s_kind":      wgPeer.Kind,
-		"k8s_name":      wgPeer.Name,
-	})
+	ll := wglog.WithPeer(pt.ll, wgPeer)
 	ll.Info("WireGuardPeer added, adding peer")
-	err := pt.applyUpdate(wgPeer)
+	err := pt.applyUpdate(nil, wgPeer)
 	if err != nil {
 		// TODO - requeue when appropriate
 		ll.Errorf("WireGuardPeer failed to add: %v", err)
@@ -118,7 +560,8 @@ func (pt *peerTracker) OnAdd(obj interface{}) {
 	ll.Info("WireGuardPeer added successfully")
 }
 
-func (pt *peerTracker) OnUpdate(_, newObj interface{}) {
+func (pt *peerTracker) OnUpdate(oldObj, newObj interface{}) {
+	old, _ := oldObj.(*wgk8s.WireGuardPeer)
 	wgPeer, ok := newObj.(*wgk8s.WireGuardPeer)
 	if !ok {
 		pt.ll.WithField("unexpected_type", fmt.Sprintf("%T", newObj)).
@@ -128,13 +571,13 @@ func (pt *peerTracker) OnUpdate(_, newObj interface{}) {
 		// Got ourselves, no-op
 		return
 	}
-	ll := pt.ll.WithFields(log.Fields{
-		"k8s_namespace": wgPeer.Namespace,
-		"k8s_kind":      wgPeer.Kind,
-		"k8s_name":      wgPeer.Name,
-	})
+	if old != nil && unchangedPeer(old, wgPeer) {
+		// Redelivered on resync; skip the logging, which adds up across a large mesh.
+		return
+	}
+	ll := wglog.WithPeer(pt.ll, wgPeer)
 	ll.Info("WireGuardPeer updated, applying changes")
-	err := pt.applyUpdate(wgPeer)
+	err := pt.applyUpdate(old, wgPeer)
 	if err != nil {
 		// TODO - requeue when appropriate
 		ll.Errorf("WireGuardPeer failed to apply updates: %v", err)
@@ -143,6 +586,10 @@ func (pt *peerTracker) OnUpdate(_, newObj interface{}) {
 }
 
 func (pt *peerTracker) OnDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		// The delete was missed while the watch was down.
+		obj = tombstone.Obj
+	}
 	wgPeer, ok := obj.(*wgk8s.WireGuardPeer)
 	if !ok {
 		pt.ll.WithField("unexpected_type", fmt.Sprintf("%T", obj)).
@@ -152,13 +599,13 @@ func (pt *peerTracker) OnDelete(obj interface{}) {
 		// Got ourselves, no-op
 		return
 	}
-	ll := pt.ll.WithFields(log.Fields{
-		"k8s_namespace": wgPeer.Namespace,
-		"k8s_kind":      wgPeer.Kind,
-		"k8s_name":      wgPeer.Name,
-	})
+	ll := wglog.WithPeer(pt.ll, wgPeer)
 	ll.Info("WireGuardPeer deleted, removing peer")
 	err := pt.deletePeer(wgPeer)
+	if err == errProtectedPeer {
+		ll.Warn("WireGuardPeer is protected; keeping peer. Use --allow-protected-peer-removal to override")
+		return
+	}
 	if err != nil {
 		// TODO - requeue when appropriate
 		ll.Errorf("WireGuardPeer failed to apply delete: %v", err)
@@ -167,28 +614,78 @@ func (pt *peerTracker) OnDelete(obj interface{}) {
 }
 
 func (pt *peerTracker) k8sToWgctrl(wgPeer *wgk8s.WireGuardPeer) (config wgtypes.PeerConfig, err error) {
-	config.PublicKey, err = wgtypes.ParseKey(wgPeer.Spec.PublicKey)
+	config.PublicKey, err = pt.publicKey(wgPeer)
+	if err != nil {
+		return
+	}
+
+	// Client-only peers don't have an endpoint; we wait for them to initiate.
+	config.Endpoint, err = pt.selectAddr(wgPeer)
 	if err != nil {
-		err = fmt.Errorf("failed to parse public key: %w", err)
+		err = fmt.Errorf("failed to resolve endpoint %q: %w", pt.selectEndpoint(wgPeer), err)
 		return
 	}
 
-	config.Endpoint, err = net.ResolveUDPAddr("udp", wgPeer.Spec.Endpoint)
+	config.AllowedIPs, err = pt.prefixes(wgPeer)
 	if err != nil {
-		err = fmt.Errorf("failed to resolve endpoint %q: %w", wgPeer.Spec.Endpoint, err)
 		return
 	}
 
+	// Always set the keepalive so that disabling it is applied too.
+	var keepalive time.Duration
 	if wgPeer.Spec.KeepAliveSeconds > 0 {
-		keepalive := time.Duration(time.Duration(wgPeer.Spec.KeepAliveSeconds) * time.Second)
+		keepalive = time.Duration(time.Duration(wgPeer.Spec.KeepAliveSeconds) * time.Second)
 		if pt.keepalive > 0 && pt.keepalive < keepalive {
 			keepalive = pt.keepalive
 		}
-		config.PersistentKeepaliveInterval = &keepalive
 	}
+	if pt.clientOnly && keepalive == 0 {
+		// Peers can only reach us through the NAT mappings our own traffic opens.
+		keepalive = pt.keepalive
+	}
+	config.PersistentKeepaliveInterval = &keepalive
 	return
 }
 
+// peerPrefixes returns the prefixes routed to the peer: a host prefix for each of its addresses,
+// and its offered routes.
+func peerPrefixes(wgPeer *wgk8s.WireGuardPeer) ([]net.IPNet, error) {
+	var out []net.IPNet
+	for _, ipStr := range wgPeer.Spec.IPs {
+		ip, _, err := net.ParseCIDR(ipStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ip %q: %w", ipStr, err)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		out = append(out, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	for _, route := range wgPeer.Spec.Routes {
+		_, cidr, err := net.ParseCIDR(route)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse route %q: %w", route, err)
+		}
+		out = append(out, *cidr)
+	}
+	return out, nil
+}
+
+// unchangedPeer returns true if wgPeer is the same version of the peer as old, ex. as the informer
+// redelivers every peer on resync. Versions are compared by resource version, which is much cheaper
+// than comparing whole objects in large meshes. Those without one, ex. from the peer cache, are
+// compared in full.
+func unchangedPeer(old, wgPeer *wgk8s.WireGuardPeer) bool {
+	if old == wgPeer {
+		return true
+	}
+	if rv := old.GetResourceVersion(); rv != "" {
+		return rv == wgPeer.GetResourceVersion()
+	}
+	return reflect.DeepEqual(old, wgPeer)
+}
+
 func wireGuardPeerIsEqual(old, new *wgk8s.WireGuardPeer) bool {
 	return reflect.DeepEqual(old.Spec, new.Spec)
 }
@@ -1 +1,204 @@
 package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestPeerTrackerDeleteProtected(t *testing.T) {
+	tcs := []struct {
+		name        string
+		annotations map[string]string
+		allow       bool
+		expectError error
+		expectKept  bool
+	}{
+		{
+			name: "unprotected",
+		},
+		{
+			name:        "protected",
+			annotations: map[string]string{wgk8s.ProtectedAnnotation: "true"},
+			expectError: errProtectedPeer,
+			expectKept:  true,
+		},
+		{
+			name:        "protected with override",
+			annotations: map[string]string{wgk8s.ProtectedAnnotation: "true"},
+			allow:       true,
+		},
+		{
+			name:        "protected false",
+			annotations: map[string]string{wgk8s.ProtectedAnnotation: "false"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			wgPeer := &wgk8s.WireGuardPeer{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "peer",
+					Namespace:   "ns",
+					SelfLink:    "/peer",
+					Annotations: tc.annotations,
+				},
+			}
+			pt := &peerTracker{
+				ll:                    logrus.New(),
+				registry:              newPeerStore(),
+				allowProtectedRemoval: tc.allow,
+			}
+			require.NoError(t, pt.storePeer(wgPeer))
+			err := testDeletePeer(pt, wgPeer)
+			require.Equal(t, tc.expectError, err)
+			_, kept := pt.listPeers()[wgPeer.GetSelfLink()]
+			require.Equal(t, tc.expectKept, kept)
+		})
+	}
+}
+
+func TestPeerTrackerRevokedKeys(t *testing.T) {
+	a := testPeer("a", nil, "10.0.0.1/24")
+	a.Spec.PublicKey = "key-a"
+	b := testPeer("b", nil, "10.0.0.2/24")
+	b.Spec.PublicKey = "key-b"
+	pt := &peerTracker{
+		ll:       logrus.New(),
+		registry: testRegistry(a, b),
+	}
+
+	require.NoError(t, pt.setRevokedKeys(map[string]bool{"key-a": true}))
+	require.NotContains(t, pt.listPeers(), "/a")
+	require.Contains(t, pt.listPeers(), "/b")
+
+	// Re-registering the revoked key doesn't bring the peer back.
+	require.NoError(t, pt.storePeer(a))
+	require.NotContains(t, pt.listPeers(), "/a")
+	c := testPeer("c", nil, "10.0.0.3/24")
+	c.Spec.PublicKey = "key-a"
+	require.NoError(t, pt.storePeer(c))
+	require.NotContains(t, pt.listPeers(), "/c")
+
+	// A deleted peer isn't restored when its key is unrevoked.
+	require.NoError(t, testDeletePeer(pt, c))
+	require.NoError(t, pt.setRevokedKeys(nil))
+	require.Contains(t, pt.listPeers(), "/a")
+	require.NotContains(t, pt.listPeers(), "/c")
+}
+
+func TestPeerTrackerDesiredPeersHubAndSpoke(t *testing.T) {
+	hub := map[string]string{"role": "hub"}
+	peers := []*wgk8s.WireGuardPeer{
+		testPeer("hub", hub, "10.0.0.1/24"),
+		testPeer("leaf", nil, "10.0.0.2/24", "fd00::2/64"),
+	}
+	pt := &peerTracker{
+		ll:        logrus.New(),
+		registry:  newPeerStore(),
+		localPeer: testPeer("local", nil, "10.0.0.3/24"),
+		topology:  topology{hubs: labels.SelectorFromSet(hub)},
+	}
+	for _, p := range peers {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		p.Spec.PublicKey = key.PublicKey().String()
+		p.Spec.Endpoint = "192.0.2.1:51820"
+		require.NoError(t, pt.registry.Add(p))
+	}
+	pt.registryPeer("/hub").Spec.Routes = []string{"192.168.0.0/16"}
+
+	desired := pt.desiredPeers()
+	require.Len(t, desired, 1)
+	require.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32", "192.168.0.0/16", "fd00::2/128"},
+		ipNetStrings(desired["/hub"].AllowedIPs))
+
+	pt.topology = topology{}
+	desired = pt.desiredPeers()
+	require.Len(t, desired, 2)
+	require.Equal(t, []string{"10.0.0.1/32", "192.168.0.0/16"}, ipNetStrings(desired["/hub"].AllowedIPs))
+}
+
+func TestPeerConfigDelta(t *testing.T) {
+	keys := make([]wgtypes.Key, 3)
+	for i := range keys {
+		k, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		keys[i] = k.PublicKey()
+	}
+	endpoint := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	prefix := func(s string) []net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return []net.IPNet{*n}
+	}
+	applied := map[string]wgtypes.PeerConfig{
+		"/same":    {PublicKey: keys[0], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.1/32")},
+		"/changed": {PublicKey: keys[1], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.2/32")},
+		"/removed": {PublicKey: keys[2], Endpoint: endpoint},
+	}
+	desired := map[string]wgtypes.PeerConfig{
+		"/same":    {PublicKey: keys[0], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.1/32")},
+		"/changed": {PublicKey: keys[1], Endpoint: endpoint, AllowedIPs: prefix("10.0.0.0/24")},
+	}
+	delta := peerConfigDelta(applied, desired)
+	require.Equal(t, []wgtypes.PeerConfig{
+		{PublicKey: keys[2], Remove: true},
+		// The endpoint is unchanged, so it's left for WireGuard's roaming.
+		{PublicKey: keys[1], ReplaceAllowedIPs: true, AllowedIPs: prefix("10.0.0.0/24")},
+	}, delta)
+	require.Empty(t, peerConfigDelta(desired, desired))
+}
+
+func TestK8sToWgctrlClientOnly(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	wgPeer := testPeer("client", nil, "10.0.0.5/24")
+	wgPeer.Spec.PublicKey = key.PublicKey().String()
+	tcs := []struct {
+		name            string
+		clientOnly      bool
+		peerKeepalive   int
+		expectKeepalive time.Duration
+	}{
+		{
+			name:            "no keepalive",
+			expectKeepalive: 0,
+		},
+		{
+			name:            "peer keepalive",
+			peerKeepalive:   10,
+			expectKeepalive: 10 * time.Second,
+		},
+		{
+			name:            "client-only keeps alive",
+			clientOnly:      true,
+			expectKeepalive: 25 * time.Second,
+		},
+		{
+			name:            "client-only uses shorter peer keepalive",
+			clientOnly:      true,
+			peerKeepalive:   10,
+			expectKeepalive: 10 * time.Second,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			pt := &peerTracker{ll: logrus.New(), keepalive: 25 * time.Second, clientOnly: tc.clientOnly}
+			wgPeer.Spec.KeepAliveSeconds = tc.peerKeepalive
+			config, err := pt.k8sToWgctrl(wgPeer)
+			require.NoError(t, err)
+			// Peers without an endpoint wait for us to hear from them.
+			require.Nil(t, config.Endpoint)
+			require.Equal(t, tc.expectKeepalive, *config.PersistentKeepaliveInterval)
+		})
+	}
+}
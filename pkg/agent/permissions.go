@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/jcodybaker/wgmesh/pkg/preflight"
+)
+
+// registryPermissions returns the permissions the agent needs in a Kubernetes registry's namespace,
+// given its options.
+func (a *Agent) registryPermissions() []preflight.Permission {
+	var out []preflight.Permission
+	for _, p := range preflight.RegistryPermissions(a.registryNamespace) {
+		required := true
+		switch p.Resource {
+		case "wireguardpeers":
+			// The node operator publishes the record of an operator-managed agent.
+			switch p.Verb {
+			case "create", "update":
+				required = !a.operatorManaged
+			case "delete":
+				required = a.deregisterOnExit && !a.operatorManaged
+			}
+		case "ippools", "ipclaims":
+			required = len(a.ipPools) > 0
+		case "wireguardmeshpolicies":
+			required = a.enforceMeshPolicies
+		}
+		if required {
+			out = append(out, p)
+		}
+	}
+	for _, ns := range a.peerNamespaces {
+		for _, p := range preflight.RegistryPermissions(ns) {
+			if (p.Resource == "wireguardpeers" || p.Resource == "meshes") && (p.Verb == "list" || p.Verb == "watch") {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
+// localPermissions returns the permissions the agent needs in the local cluster, given its options.
+func (a *Agent) localPermissions() []preflight.Permission {
+	var out []preflight.Permission
+	if a.kubeNode != "" {
+		for _, p := range preflight.NodePermissions(a.kubeNode) {
+			required := true
+			switch {
+			case p.Subresource == "status":
+				// Setting the registry condition is best effort, so only clearing NetworkUnavailable
+				// requires it.
+				required = a.clearNetworkUnavailable && a.carriesPodNetwork()
+			case p.Verb == "patch":
+				required = a.annotateNode || a.operatorManaged
+			}
+			if required {
+				out = append(out, p)
+			}
+		}
+	}
+	if a.serviceExport {
+		out = append(out, preflight.Permission{Resource: "services", Verb: "list"})
+	}
+	return out
+}
+
+// checkPermissions asks the cluster whether the agent's user has each permission, failing with
+// those which are denied, rather than partway through startup or later. If access can't be
+// reviewed, ex. the cluster is unreachable, the check is skipped.
+func (a *Agent) checkPermissions(cluster string, cs kubernetes.Interface, perms []preflight.Permission) error {
+	if len(perms) == 0 {
+		return nil
+	}
+	denied, err := preflight.CheckPermissions(cs.AuthorizationV1().SelfSubjectAccessReviews(), perms)
+	if err != nil {
+		a.ll.WithError(err).WithField("cluster", cluster).Warn("unable to review the agent's permissions; skipping the check")
+		return nil
+	}
+	if len(denied) > 0 {
+		var missing []string
+		for _, p := range denied {
+			missing = append(missing, p.String())
+		}
+		return fmt.Errorf("the %s denies permissions the agent needs: %s; grant them to the agent's user",
+			cluster, strings.Join(missing, "; "))
+	}
+	a.ll.WithField("cluster", cluster).Debugf("all %d required permissions are allowed", len(perms))
+	return nil
+}
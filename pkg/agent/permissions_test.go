@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.registryNamespace = "ns"
+	a.kubeNode = "node-a"
+
+	cs := kubefake.NewSimpleClientset()
+	cs.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = attrs.Verb != "delete" && attrs.Verb != "patch"
+		return true, review, nil
+	})
+	require.NoError(t, a.checkPermissions("registry", cs, a.registryPermissions()), "delete isn't needed")
+	require.NoError(t, a.checkPermissions("local cluster", cs, a.localPermissions()), "patch isn't needed")
+
+	a.deregisterOnExit = true
+	a.annotateNode = true
+	require.EqualError(t, a.checkPermissions("registry", cs, a.registryPermissions()),
+		"the registry denies permissions the agent needs: delete wireguardpeers.wgmesh.codybaker.com -n ns; grant them to the agent's user")
+	require.EqualError(t, a.checkPermissions("local cluster", cs, a.localPermissions()),
+		"the local cluster denies permissions the agent needs: patch nodes/node-a; grant them to the agent's user")
+
+	a.operatorManaged = true
+	require.NoError(t, a.checkPermissions("registry", cs, a.registryPermissions()), "the operator publishes the record")
+
+	cs.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, &authorizationv1.SelfSubjectAccessReview{}, errors.New("connection refused")
+	})
+	require.NoError(t, a.checkPermissions("local cluster", cs, a.localPermissions()), "the check is skipped")
+}
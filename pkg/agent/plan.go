@@ -0,0 +1,259 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Plan is the state an agent would apply, as computed by DryRun.
+type Plan struct {
+	Interface PlanInterface `json:"interface"`
+	// Mesh is the name of the Mesh selecting the local peer, if any.
+	Mesh string `json:"mesh,omitempty"`
+	// IPPools are the pools addresses would be claimed from, in addition to Interface.Addresses.
+	IPPools []PlanIPPool `json:"ipPools,omitempty"`
+	// LocalPeer is the WireGuardPeer which would be published. A new key pair is generated each
+	// time the agent starts, so its keys are omitted.
+	LocalPeer *wgk8s.WireGuardPeer `json:"localPeer,omitempty"`
+	// Registration is "create" or "update", depending on whether the local peer is registered, or
+	// "takeover" if the record would be claimed from a peer with another endpoint.
+	Registration string     `json:"registration,omitempty"`
+	Peers        []PlanPeer `json:"peers"`
+	// Routes are the prefixes which would be routed via the interface.
+	Routes []string `json:"routes,omitempty"`
+	// Notes describe what can't be known until the agent runs.
+	Notes []string `json:"notes,omitempty"`
+}
+
+// PlanInterface describes the WireGuard interface.
+type PlanInterface struct {
+	Name string `json:"name"`
+	// ListenPort is zero if the driver picks a port.
+	ListenPort int      `json:"listenPort,omitempty"`
+	MTU        int      `json:"mtu,omitempty"`
+	Addresses  []string `json:"addresses,omitempty"`
+}
+
+// PlanIPPool describes the addresses claimed from a single IPPool.
+type PlanIPPool struct {
+	Name string `json:"name"`
+	// Counts are the number of addresses claimed of each family.
+	Counts map[string]int `json:"counts,omitempty"`
+	Static []string       `json:"static,omitempty"`
+}
+
+// PlanPeer describes the config of a peer we'd connect to directly.
+type PlanPeer struct {
+	Name                string   `json:"name"`
+	PublicKey           string   `json:"publicKey"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowedIPs,omitempty"`
+	PersistentKeepalive string   `json:"persistentKeepalive,omitempty"`
+}
+
+// DryRun reads the registry and computes the interface, addresses, peers, and routes the agent
+// would apply, without changing the host or writing to the registry.
+func (a *Agent) DryRun(ctx context.Context) (*Plan, error) {
+	// Stop watching Meshes once the plan is computed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var err error
+	a.initOnce.Do(func() {
+		err = a.init(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if a.operatorManaged {
+		return nil, fmt.Errorf("dry run isn't supported for operator-managed agents")
+	}
+	if len(a.nodeLabelKeys) > 0 {
+		if err = a.configureNodeLabels(); err != nil {
+			return nil, fmt.Errorf("reading node labels: %w", err)
+		}
+	}
+	if err = a.watchMeshes(ctx); err != nil {
+		return nil, err
+	}
+	if err = a.configureNodeZone(); err != nil {
+		return nil, fmt.Errorf("reading node topology: %w", err)
+	}
+	if len(a.nodeAddressTypes) > 0 && !a.clientOnly {
+		if err = a.configureNodeEndpoint(); err != nil {
+			return nil, fmt.Errorf("deriving endpoint from node address: %w", err)
+		}
+	}
+	if a.podCIDRIPAM {
+		err = a.configurePodCIDRIPAM(ctx)
+	} else if a.offerPodCIDRs {
+		err = a.configurePodCIDRRoutes(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading podCIDR: %w", err)
+	}
+
+	plan := &Plan{
+		Interface: PlanInterface{
+			Name:       a.wgIfaceOptions.InterfaceName,
+			ListenPort: a.wgIfaceOptions.Port,
+			Addresses:  a.ips,
+		},
+		Peers: []PlanPeer{},
+	}
+	a.meshLock.Lock()
+	plan.Interface.MTU = a.effectiveMTU()
+	if a.mesh != nil {
+		plan.Mesh = a.mesh.GetName()
+	}
+	t, topologyErr := meshTopology(a.mesh)
+	revoked := a.revokedKeys
+	allowed, allowedErr := a.effectiveAllowedEndpoints()
+	keepalive := a.effectiveKeepalive()
+	a.meshLock.Unlock()
+	if topologyErr != nil {
+		return nil, fmt.Errorf("mesh topology: %w", topologyErr)
+	}
+	if allowedErr != nil {
+		return nil, fmt.Errorf("mesh allowed endpoint cidrs: %w", allowedErr)
+	}
+	if a.wgIfaceOptions.Port == 0 {
+		plan.Notes = append(plan.Notes, "the listen port is chosen by the driver when the interface is created")
+	}
+
+	for _, pool := range a.ipPools {
+		p := PlanIPPool{Name: pool.name, Counts: make(map[string]int)}
+		for family, count := range pool.counts {
+			p.Counts[string(family)] = count
+		}
+		for _, ip := range pool.static {
+			p.Static = append(p.Static, ip.String())
+		}
+		plan.IPPools = append(plan.IPPools, p)
+	}
+	if len(a.ipPools) > 0 {
+		plan.Notes = append(plan.Notes, "addresses are claimed from ipPools when the agent starts, and aren't included in the local peer's ips or peers' allowed IPs")
+	}
+	if a.serviceExport {
+		plan.Notes = append(plan.Notes, "routes to exported Services are offered once the agent starts, and aren't included in the local peer's routes")
+	}
+	if a.bgp != nil && a.bgpLearnRoutes {
+		plan.Notes = append(plan.Notes, "routes learned over BGP are offered once the agent starts, and aren't included in the local peer's routes")
+	}
+
+	if err = a.planLocalPeer(plan); err != nil {
+		return nil, err
+	}
+
+	list, err := a.registry.WatchPeers(a.peerSelector, nil).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing WireGuardPeers: %w", err)
+	}
+	pt := &peerTracker{
+		ll:               a.ll,
+		registry:         newPeerStore(),
+		localPeer:        a.localPeer,
+		topology:         t,
+		keepalive:        keepalive,
+		clientOnly:       a.clientOnly,
+		natTraversal:     a.natTraversal,
+		ecmp:             a.ecmp,
+		revokedKeys:      revoked,
+		allowedEndpoints: allowed,
+		bootstrap:        a.bootstrapPeers,
+		families:         newEndpointFamilies(a.endpointFamily),
+	}
+	for i := range list.(*wgk8s.WireGuardPeerList).Items {
+		wgPeer := &list.(*wgk8s.WireGuardPeerList).Items[i]
+		if wgPeer.GetName() == a.name {
+			continue
+		}
+		if err = pt.storePeer(wgPeer); err != nil {
+			return nil, err
+		}
+	}
+	pt.Lock()
+	desired := pt.desiredPeers()
+	pt.Unlock()
+	var routes []string
+	for name, c := range desired {
+		p := PlanPeer{
+			Name:      name,
+			PublicKey: c.PublicKey.String(),
+		}
+		if wgPeer, ok := pt.peer(name); ok {
+			p.Name = wgPeer.GetName()
+		}
+		if c.Endpoint != nil {
+			p.Endpoint = c.Endpoint.String()
+		}
+		p.AllowedIPs = ipNetStrings(c.AllowedIPs)
+		if c.PersistentKeepaliveInterval != nil && *c.PersistentKeepaliveInterval > 0 {
+			p.PersistentKeepalive = c.PersistentKeepaliveInterval.String()
+		}
+		plan.Peers = append(plan.Peers, p)
+		routes = append(routes, p.AllowedIPs...)
+	}
+	sort.Slice(plan.Peers, func(i, j int) bool { return plan.Peers[i].Name < plan.Peers[j].Name })
+	if a.installRoutes {
+		sort.Strings(routes)
+		plan.Routes = routes
+	}
+	return plan, nil
+}
+
+// planLocalPeer adds the local peer which would be published to the plan, failing where
+// registering it would.
+func (a *Agent) planLocalPeer(plan *Plan) error {
+	a.updateK8sLocalPeer()
+	a.localPeer.Spec.PublicKey = ""
+	a.localPeer.Spec.PresharedKey = ""
+	if a.wgIfaceOptions.Port != 0 && !a.clientOnly {
+		var err error
+		if a.localPeer.Spec.Endpoint != "" {
+			a.localPeer.Spec.Endpoint, err = endpointWithPort(a.localPeer.Spec.Endpoint, a.wgIfaceOptions.Port)
+			if err != nil {
+				return fmt.Errorf("endpoint: %w", err)
+			}
+		}
+		for i, addr := range a.localPeer.Spec.Endpoints {
+			a.localPeer.Spec.Endpoints[i], err = endpointWithPort(addr, a.wgIfaceOptions.Port)
+			if err != nil {
+				return fmt.Errorf("endpoint candidate: %w", err)
+			}
+		}
+	}
+	existing, err := a.registry.Get(a.name)
+	switch {
+	case k8sErrors.IsNotFound(err):
+		plan.Registration = "create"
+	case err != nil:
+		return fmt.Errorf("fetching existing k8s WireGuardPeer object %q: %w", a.name, err)
+	default:
+		// Without a fixed listen port, the endpoint's port isn't known until the interface is created.
+		_, port, _ := net.SplitHostPort(a.localPeer.Spec.Endpoint)
+		plan.Registration = "update"
+		if conflict := nameConflict(existing, a.localPeer); port != "0" && conflict != "" {
+			if !a.forceTakeover {
+				return fmt.Errorf("%s. Two or more peers may be sharing the same name", conflict)
+			}
+			plan.Registration = "takeover"
+			plan.Notes = append(plan.Notes, fmt.Sprintf(
+				"the existing WireGuardPeer, with endpoint %q, would be taken over if it's unchanged for %s",
+				existing.Spec.Endpoint, a.takeoverGracePeriod))
+		}
+		a.localPeer.SetLabels(labels.Merge(existing.GetLabels(), a.localPeer.GetLabels()))
+	}
+	plan.LocalPeer = a.localPeer.DeepCopy()
+	plan.LocalPeer.APIVersion = wgk8s.SchemeGroupVersion.String()
+	plan.LocalPeer.Kind = "WireGuardPeer"
+	plan.LocalPeer.Namespace = a.registryNamespace
+	return nil
+}
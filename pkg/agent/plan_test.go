@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDryRun(t *testing.T) {
+	const (
+		keyA = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+		keyB = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+	)
+	r, err := registry.NewMemory("ns",
+		&wgk8s.Mesh{
+			ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "ns"},
+			Spec:       wgk8s.MeshSpec{KeepAliveSeconds: 25, MTU: 1400, RevokedPublicKeys: []string{keyB}},
+		},
+		&wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "ns"},
+			Spec: wgk8s.WireGuardPeerSpec{
+				PublicKey: keyA,
+				Endpoint:  "192.0.2.1:51820",
+				IPs:       []string{"10.0.0.1/32"},
+				Routes:    []string{"192.168.1.0/24"},
+			},
+		},
+		&wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: "revoked", Namespace: "ns"},
+			Spec:       wgk8s.WireGuardPeerSpec{PublicKey: keyB, IPs: []string{"10.0.0.3/32"}},
+		},
+		&wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: "local", Namespace: "ns", Labels: map[string]string{"site": "a"}},
+			Spec:       wgk8s.WireGuardPeerSpec{Endpoint: "local.example.com:51821"},
+		},
+	)
+	require.NoError(t, err)
+	a, err := NewAgent("local",
+		WithLogger(logrus.New()),
+		WithRegistry(r),
+		WithRegistryNamespace("ns"),
+		WithIPs([]string{"10.0.0.2/24"}),
+		WithEndpointAddr("local.example.com:0"),
+		WithWireGuardInterfaceOptions(&interfaces.WireGuardInterfaceOptions{InterfaceName: "wg0", Port: 51821}),
+	)
+	require.NoError(t, err)
+
+	plan, err := a.DryRun(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, PlanInterface{Name: "wg0", ListenPort: 51821, MTU: 1400, Addresses: []string{"10.0.0.2/24"}}, plan.Interface)
+	require.Equal(t, "default", plan.Mesh)
+	require.Equal(t, "update", plan.Registration)
+	require.Equal(t, "local.example.com:51821", plan.LocalPeer.Spec.Endpoint)
+	require.Equal(t, "a", plan.LocalPeer.GetLabels()["site"], "existing labels are kept")
+	require.Empty(t, plan.LocalPeer.Spec.PublicKey)
+	require.Equal(t, []PlanPeer{{
+		Name:       "a",
+		PublicKey:  keyA,
+		Endpoint:   "192.0.2.1:51820",
+		AllowedIPs: []string{"10.0.0.1/32", "192.168.1.0/24"},
+	}}, plan.Peers, "revoked keys are skipped")
+	require.Equal(t, []string{"10.0.0.1/32", "192.168.1.0/24"}, plan.Routes)
+
+	// Nothing was written to the registry.
+	local, err := r.Get("local")
+	require.NoError(t, err)
+	require.Empty(t, local.Spec.IPs)
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/jcodybaker/wgmesh/pkg/probe"
+)
+
+// minPathMTU is the smallest MTU probed for, and the floor for tuning the interface.
+const minPathMTU = 576
+
+// runMTUProber measures the path MTU to every peer each MTU probe interval, until the context is
+// canceled, warning of peers which can't take packets of the interface's MTU, or with mtuAuto,
+// lowering the interface's MTU to fit them.
+func (a *Agent) runMTUProber(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		// The interface's MTU before we tune it, if it's not configured.
+		var initial int
+		previous := make(map[string]int)
+		wait.Until(func() {
+			a.meshLock.Lock()
+			ceiling := a.configuredMTU()
+			a.meshLock.Unlock()
+			if ceiling == 0 {
+				if initial == 0 {
+					iface, err := net.InterfaceByName(a.iface.GetName())
+					if err != nil {
+						a.ll.WithError(err).Error("failed to read the interface's mtu")
+						return
+					}
+					initial = iface.MTU
+				}
+				ceiling = initial
+			}
+			mtus := a.probePathMTUs(ctx, ceiling)
+			if ctx.Err() != nil {
+				return
+			}
+			if err := a.applyPathMTUs(mtus, previous, ceiling); err != nil {
+				a.ll.WithError(err).Error("failed to tune the interface's mtu")
+			}
+			previous = mtus
+		}, a.mtuProbeInterval, ctx.Done())
+	}()
+}
+
+// probePathMTUs measures the largest packet, up to ceiling bytes, each peer's probe echo server
+// answers through the tunnel, returning the smallest of each peer's mesh addresses. Peers which
+// don't answer at all are left out.
+func (a *Agent) probePathMTUs(ctx context.Context, ceiling int) map[string]int {
+	targets := a.peerTracker.probeTargets()
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+	)
+	out := make(map[string]int)
+	for t := range targets {
+		wg.Add(1)
+		go func(t probeTarget) {
+			defer wg.Done()
+			mtu, err := probe.MTU(ctx, net.ParseIP(t.ip), a.probePort, minPathMTU, ceiling)
+			if err != nil {
+				a.ll.WithError(err).WithField("k8s_name", t.peer).WithField("ip", t.ip).Debug("mtu probe failed")
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if current, ok := out[t.peer]; !ok || mtu < current {
+				out[t.peer] = mtu
+			}
+		}(t)
+	}
+	wg.Wait()
+	return out
+}
+
+// applyPathMTUs records the peers' path MTUs in the metrics, and warns of those below ceiling, the
+// interface's untuned MTU, when they change from the previous measurements. With mtuAuto, the
+// interface's MTU is set to the smallest, or restored to ceiling once every peer fits.
+func (a *Agent) applyPathMTUs(mtus, previous map[string]int, ceiling int) error {
+	smallest := ceiling
+	for peer, mtu := range mtus {
+		a.metrics.observePathMTU(peer, mtu)
+		if mtu < smallest {
+			smallest = mtu
+		}
+		if mtu >= ceiling || mtu == previous[peer] {
+			continue
+		}
+		ll := a.ll.WithFields(log.Fields{"k8s_name": peer, "path_mtu": mtu, "mtu": ceiling})
+		if a.mtuAuto {
+			ll.Info("path mtu to peer is below the interface's mtu")
+		} else {
+			ll.Warn("path mtu to peer is below the interface's mtu; larger packets to it will be dropped. Lower --mtu, or set --mtu-auto")
+		}
+	}
+	for peer := range previous {
+		if _, ok := mtus[peer]; !ok {
+			a.metrics.forgetPathMTU(peer)
+		}
+	}
+	if !a.mtuAuto {
+		return nil
+	}
+
+	a.meshLock.Lock()
+	defer a.meshLock.Unlock()
+	if smallest == a.pathMTU {
+		return nil
+	}
+	a.ll.WithFields(log.Fields{"path_mtu": smallest, "previous_path_mtu": a.pathMTU}).Info("tuning the interface's mtu to the smallest path mtu")
+	a.pathMTU = smallest
+	if !a.meshUpdates {
+		return nil
+	}
+	if err := a.applyMeshSettings(); err != nil {
+		return fmt.Errorf("applying path mtu %d: %w", smallest, err)
+	}
+	return nil
+}
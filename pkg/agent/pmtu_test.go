@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/probe"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbePathMTUs(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go probe.ServeEcho(ctx, conn)
+
+	up := testPeer("up", nil, "127.0.0.1/32")
+	a := &Agent{
+		options: options{
+			ll:        logrus.New(),
+			probePort: conn.LocalAddr().(*net.UDPAddr).Port,
+		},
+		peerTracker: &peerTracker{
+			registry: testRegistry(up),
+		},
+	}
+	mtus := a.probePathMTUs(ctx, 1420)
+	if len(mtus) == 0 {
+		t.Skip("mtu probes unsupported")
+	}
+	require.Equal(t, map[string]int{"up": 1420}, mtus)
+}
+
+func TestApplyPathMTUs(t *testing.T) {
+	a := &Agent{options: defaultOptions(), metrics: newMetrics()}
+	a.ll = logrus.New()
+	a.mtu = 1420
+
+	require.NoError(t, a.applyPathMTUs(map[string]int{"a": 1420, "b": 1380}, nil, 1420))
+	require.Equal(t, 1380.0, testutil.ToFloat64(a.metrics.pathMTU.WithLabelValues("b")))
+	require.Equal(t, 1420, a.effectiveMTU(), "only warns without mtu auto")
+
+	a.mtuAuto = true
+	require.NoError(t, a.applyPathMTUs(map[string]int{"a": 1420, "b": 1380}, nil, 1420))
+	require.Equal(t, 1380, a.effectiveMTU())
+
+	require.NoError(t, a.applyPathMTUs(map[string]int{"a": 1420}, map[string]int{"a": 1420, "b": 1380}, 1420))
+	require.Equal(t, 1420, a.effectiveMTU(), "restored once every peer fits")
+	require.False(t, a.metrics.pathMTU.DeleteLabelValues("b"), "b's series is dropped")
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// podCIDRPollInterval is how often we check for the node's podCIDR while waiting for the
+// controller-manager to assign one.
+const podCIDRPollInterval = 5 * time.Second
+
+// configurePodCIDRIPAM derives our mesh addresses and offered routes from the local Node's
+// podCIDRs. If the node hasn't been assigned a podCIDR yet, we wait for one.
+func (a *Agent) configurePodCIDRIPAM(ctx context.Context) error {
+	if a.localCS == nil || a.kubeNode == "" {
+		return fmt.Errorf("podCIDR IPAM requires a local kubeconfig and kube node name")
+	}
+	cidrs, err := a.waitForPodCIDRs(ctx)
+	if err != nil {
+		return err
+	}
+	ips, routes, err := PodCIDRAddresses(cidrs)
+	if err != nil {
+		return fmt.Errorf("node %q: %w", a.kubeNode, err)
+	}
+	a.ll.WithField("ips", ips).WithField("routes", routes).Infoln("derived addresses from node podCIDRs")
+	a.ips = append(append([]string(nil), a.ips...), ips...)
+	a.offerRoutes = append(append([]string(nil), a.offerRoutes...), routes...)
+	return nil
+}
+
+// configurePodCIDRRoutes offers routes to the local Node's podCIDRs, without deriving addresses from
+// them. If the node hasn't been assigned a podCIDR yet, we wait for one.
+func (a *Agent) configurePodCIDRRoutes(ctx context.Context) error {
+	if a.localCS == nil || a.kubeNode == "" {
+		return fmt.Errorf("offering podCIDRs requires a local kubeconfig and kube node name")
+	}
+	cidrs, err := a.waitForPodCIDRs(ctx)
+	if err != nil {
+		return err
+	}
+	offered := make(map[string]struct{}, len(a.offerRoutes))
+	for _, r := range a.offerRoutes {
+		offered[r] = struct{}{}
+	}
+	routes := append([]string(nil), a.offerRoutes...)
+	for _, c := range cidrs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("node %q: parsing podCIDR %q: %w", a.kubeNode, c, err)
+		}
+		if _, ok := offered[cidr.String()]; ok {
+			continue
+		}
+		routes = append(routes, cidr.String())
+	}
+	a.ll.WithField("routes", routes).Infoln("offering node podCIDRs")
+	a.offerRoutes = routes
+	return nil
+}
+
+// waitForPodCIDRs returns the local Node's podCIDRs, waiting for the controller-manager to assign
+// them if necessary.
+func (a *Agent) waitForPodCIDRs(ctx context.Context) ([]string, error) {
+	ll := a.ll.WithField("kube_node", a.kubeNode)
+	var cidrs []string
+	err := wait.PollImmediateUntil(podCIDRPollInterval, func() (bool, error) {
+		node, err := a.localCS.CoreV1().Nodes().Get(a.kubeNode, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("getting node %q: %w", a.kubeNode, err)
+		}
+		cidrs = NodePodCIDRs(node)
+		if len(cidrs) == 0 {
+			ll.Infoln("waiting for node to be assigned a podCIDR")
+			return false, nil
+		}
+		return true, nil
+	}, ctx.Done())
+	if err != nil {
+		return nil, err
+	}
+	return cidrs, nil
+}
+
+// NodePodCIDRs returns the node's podCIDRs, falling back to the single podCIDR set by older
+// controller-managers.
+func NodePodCIDRs(node *corev1.Node) []string {
+	if len(node.Spec.PodCIDRs) > 0 {
+		return node.Spec.PodCIDRs
+	}
+	if node.Spec.PodCIDR != "" {
+		return []string{node.Spec.PodCIDR}
+	}
+	return nil
+}
+
+// PodCIDRAddresses returns a mesh address and an offered route for each podCIDR. The mesh address
+// is the first usable address in the podCIDR with a host-length prefix, so the WireGuard interface
+// doesn't install a connected route which would compete with the CNI's bridge. Peers reach the
+// address through the offered podCIDR route.
+func PodCIDRAddresses(cidrs []string) (ips, routes []string, err error) {
+	for _, c := range cidrs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing podCIDR %q: %w", c, err)
+		}
+		cidr, err = registry.CanonicalIPInCIDR(cidr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing podCIDR %q: %w", c, err)
+		}
+		start, err := registry.DefaultRangeStart(cidr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("selecting address in podCIDR %q: %w", c, err)
+		}
+		bits := len(cidr.IP) * 8
+		ips = append(ips, (&net.IPNet{IP: start, Mask: net.CIDRMask(bits, bits)}).String())
+		routes = append(routes, cidr.String())
+	}
+	return ips, routes, nil
+}
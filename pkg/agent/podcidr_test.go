@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPodCIDRAddresses(t *testing.T) {
+	tcs := []struct {
+		name         string
+		cidrs        []string
+		expectIPs    []string
+		expectRoutes []string
+		expectError  string
+	}{
+		{
+			name:         "ipv4",
+			cidrs:        []string{"10.244.1.0/24"},
+			expectIPs:    []string{"10.244.1.1/32"},
+			expectRoutes: []string{"10.244.1.0/24"},
+		},
+		{
+			name:         "dual-stack",
+			cidrs:        []string{"10.244.1.0/24", "fd00:10:244:1::/64"},
+			expectIPs:    []string{"10.244.1.1/32", "fd00:10:244:1::1/128"},
+			expectRoutes: []string{"10.244.1.0/24", "fd00:10:244:1::/64"},
+		},
+		{
+			name:        "invalid",
+			cidrs:       []string{"10.244.1.0"},
+			expectError: `parsing podCIDR "10.244.1.0": invalid CIDR address: 10.244.1.0`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ips, routes, err := PodCIDRAddresses(tc.cidrs)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectIPs, ips)
+			require.Equal(t, tc.expectRoutes, routes)
+		})
+	}
+}
+
+func TestConfigurePodCIDRIPAM(t *testing.T) {
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.kubeNode = "node"
+	a.ips = []string{"192.168.0.1/24"}
+	a.localCS = kubefake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node"},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.244.3.0/24"},
+	})
+	require.NoError(t, a.configurePodCIDRIPAM(context.Background()))
+	require.Equal(t, []string{"192.168.0.1/24", "10.244.3.1/32"}, a.ips)
+	require.Equal(t, []string{"10.244.3.0/24"}, a.offerRoutes)
+}
+
+func TestConfigurePodCIDRRoutes(t *testing.T) {
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.kubeNode = "node"
+	a.ips = []string{"192.168.0.1/24"}
+	a.offerRoutes = []string{"172.16.0.0/12", "10.244.3.0/24"}
+	a.localCS = kubefake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node"},
+		Spec:       corev1.NodeSpec{PodCIDRs: []string{"10.244.3.0/24", "fd00:10:244:3::/64"}},
+	})
+	require.NoError(t, a.configurePodCIDRRoutes(context.Background()))
+	require.Equal(t, []string{"192.168.0.1/24"}, a.ips)
+	require.Equal(t, []string{"172.16.0.0/12", "10.244.3.0/24", "fd00:10:244:3::/64"}, a.offerRoutes)
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/probe"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// probeTarget is a mesh address of a peer.
+type probeTarget struct {
+	peer string
+	ip   string
+}
+
+// serveProbeEcho echoes peers' UDP probes on the probe port until the context is canceled.
+func (a *Agent) serveProbeEcho(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort("", strconv.Itoa(a.probePort)))
+	if err != nil {
+		return fmt.Errorf("serving probe echoes: %w", err)
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		if err := probe.ServeEcho(ctx, conn); err != nil {
+			a.ll.WithError(err).Error("probe echo server failed")
+		}
+	}()
+	return nil
+}
+
+// runProber probes every peer's mesh addresses each probe interval, until the context is canceled,
+// recording their reachability and round trip times in the metrics.
+func (a *Agent) runProber(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		var probed map[probeTarget]bool
+		wait.Until(func() {
+			probed = a.probePeers(ctx, probed)
+		}, a.probeInterval, ctx.Done())
+	}()
+}
+
+// probePeers probes each peer's mesh addresses concurrently, returning the addresses probed. The
+// series of previously probed addresses which are gone are dropped.
+func (a *Agent) probePeers(ctx context.Context, previous map[probeTarget]bool) map[probeTarget]bool {
+	targets := a.peerTracker.probeTargets()
+	timeout := probe.DefaultTimeout
+	if a.probeInterval < timeout {
+		timeout = a.probeInterval
+	}
+	var wg sync.WaitGroup
+	for t := range targets {
+		wg.Add(1)
+		go func(t probeTarget) {
+			defer wg.Done()
+			pCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			rtt, err := a.probe(pCtx, net.ParseIP(t.ip))
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				a.ll.WithError(err).WithField("k8s_name", t.peer).WithField("ip", t.ip).Debug("probe failed")
+			}
+			a.metrics.observeProbe(t.peer, t.ip, rtt, err == nil)
+		}(t)
+	}
+	wg.Wait()
+	for t := range previous {
+		if !targets[t] {
+			a.metrics.forgetProbe(t.peer, t.ip)
+		}
+	}
+	return targets
+}
+
+func (a *Agent) probe(ctx context.Context, ip net.IP) (time.Duration, error) {
+	if a.probeMethod == "udp" {
+		return probe.UDP(ctx, ip, a.probePort)
+	}
+	return probe.Ping(ctx, ip)
+}
+
+// probeTargets returns the mesh addresses of every peer.
+func (pt *peerTracker) probeTargets() map[probeTarget]bool {
+	pt.Lock()
+	defer pt.Unlock()
+	out := make(map[probeTarget]bool)
+	for _, wgPeer := range pt.listPeers() {
+		for _, cidr := range wgPeer.Spec.IPs {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				continue
+			}
+			out[probeTarget{peer: wgPeer.GetName(), ip: ip.String()}] = true
+		}
+	}
+	return out
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/probe"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbePeers(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go probe.ServeEcho(ctx, conn)
+
+	up := testPeer("up", nil, "127.0.0.1/32")
+	// Nothing answers on 127.0.0.2.
+	down := testPeer("down", nil, "127.0.0.2/32", "invalid")
+	a := &Agent{
+		options: options{
+			ll:            logrus.New(),
+			probeInterval: 200 * time.Millisecond,
+			probeMethod:   "udp",
+			probePort:     conn.LocalAddr().(*net.UDPAddr).Port,
+		},
+		metrics: newMetrics(),
+		peerTracker: &peerTracker{
+			registry: testRegistry(up, down),
+		},
+	}
+	probed := a.probePeers(ctx, nil)
+	require.Equal(t, map[probeTarget]bool{
+		{peer: "up", ip: "127.0.0.1"}:   true,
+		{peer: "down", ip: "127.0.0.2"}: true,
+	}, probed)
+	m := a.metrics
+	require.Equal(t, 1.0, testutil.ToFloat64(m.probeUp.WithLabelValues("up", "127.0.0.1")))
+	require.Equal(t, 0.0, testutil.ToFloat64(m.probeFailures.WithLabelValues("up", "127.0.0.1")))
+	require.Equal(t, 0.0, testutil.ToFloat64(m.probeUp.WithLabelValues("down", "127.0.0.2")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.probeFailures.WithLabelValues("down", "127.0.0.2")))
+
+	// Removed peers' series are dropped.
+	require.NoError(t, a.peerTracker.registry.Delete(down))
+	a.probePeers(ctx, probed)
+	require.Equal(t, 2.0, testutil.ToFloat64(m.probesTotal.WithLabelValues("up", "127.0.0.1")))
+	require.Equal(t, 0.0, testutil.ToFloat64(m.probesTotal.WithLabelValues("down", "127.0.0.2")))
+}
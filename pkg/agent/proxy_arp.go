@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+)
+
+// proxyARPInterval is how often the mesh addresses answered for on the LAN are updated.
+const proxyARPInterval = 10 * time.Second
+
+// publishProxyARP periodically answers ARP and NDP requests on the LAN interface for the selected
+// mesh addresses of the peers we route to, until the context is canceled.
+func (a *Agent) publishProxyARP(ctx context.Context) error {
+	// A retried start reuses the entries of the failed attempt.
+	if a.proxyNeighbors == nil {
+		p, err := interfaces.NewProxyNeighbors(a.proxyARPInterface)
+		if err != nil {
+			return fmt.Errorf("publishing mesh addresses on %q: %w", a.proxyARPInterface, err)
+		}
+		a.proxyNeighbors = p
+	}
+	p := a.proxyNeighbors
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := p.Sync(proxyARPIPs(a.peerTracker.peerIPs(), a.proxyARPCIDRs))
+			if err != nil {
+				a.ll.WithError(err).WithField("lan_interface", a.proxyARPInterface).Error("failed to publish mesh addresses")
+			}
+		}, proxyARPInterval, ctx.Done())
+	}()
+	return nil
+}
+
+// proxyARPIPs returns the addresses within the CIDRs, or all of them if there are none.
+func proxyARPIPs(ips []net.IP, cidrs []*net.IPNet) []net.IP {
+	if len(cidrs) == 0 {
+		return ips
+	}
+	var out []net.IP
+	for _, ip := range ips {
+		for _, n := range cidrs {
+			if n.Contains(ip) {
+				out = append(out, ip)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// peerIPs returns the mesh addresses of the applied peers, sorted.
+func (pt *peerTracker) peerIPs() []net.IP {
+	pt.Lock()
+	defer pt.Unlock()
+	var ips []net.IP
+	for key := range pt.applied {
+		p, ok := pt.peer(key)
+		if !ok {
+			continue
+		}
+		for _, s := range p.Spec.IPs {
+			ip, _, err := net.ParseCIDR(s)
+			if err != nil {
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			ips = append(ips, ip)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].String() < ips[j].String() })
+	return ips
+}
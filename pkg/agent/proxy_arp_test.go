@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProxyARPIPs(t *testing.T) {
+	pt := &peerTracker{
+		registry: testRegistry(
+			&wgk8s.WireGuardPeer{
+				ObjectMeta: metav1.ObjectMeta{Name: "a", SelfLink: "a"},
+				Spec:       wgk8s.WireGuardPeerSpec{IPs: []string{"10.10.0.2/16", "fd00::2/64"}, Routes: []string{"192.168.2.0/24"}},
+			},
+			&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "b", SelfLink: "b"}, Spec: wgk8s.WireGuardPeerSpec{IPs: []string{"10.20.0.3/16"}}},
+			&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "c", SelfLink: "c"}, Spec: wgk8s.WireGuardPeerSpec{IPs: []string{"10.10.0.4/16"}}},
+		),
+		applied: map[string]wgtypes.PeerConfig{"a": {}, "b": {}},
+	}
+	ips := pt.peerIPs()
+	require.Equal(t, "[10.10.0.2 10.20.0.3 fd00::2]", fmt.Sprint(ips), "only applied peers' addresses are published")
+
+	_, v4, err := net.ParseCIDR("10.10.0.0/16")
+	require.NoError(t, err)
+	_, v6, err := net.ParseCIDR("fd00::/64")
+	require.NoError(t, err)
+	require.Equal(t, "[10.10.0.2 fd00::2]", fmt.Sprint(proxyARPIPs(ips, []*net.IPNet{v4, v6})))
+	require.Equal(t, ips, proxyARPIPs(ips, nil))
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// reasonPeerQuarantined is the event reason recorded on peers as they're quarantined.
+const reasonPeerQuarantined = "PeerQuarantined"
+
+// quarantine removes peers which have never completed a handshake from the device, once their
+// endpoints have failed over attempts times across at least period, so dead entries in large meshes
+// don't keep the device busy. Quarantined peers are put back on the device every retry interval, and
+// quarantined again if their first attempt fails.
+type quarantine struct {
+	attempts int
+	period   time.Duration
+	retry    time.Duration
+	// peers tracks the failing peers, keyed by self link.
+	peers map[string]*quarantineState
+}
+
+type quarantineState struct {
+	// attempts counts the peer's failed endpoint attempts since first, without a handshake.
+	attempts int
+	first    time.Time
+	// since is when the peer was quarantined, or zero if it isn't.
+	since time.Time
+	// removed is when the quarantined peer was last removed from the device.
+	removed time.Time
+	// retrying is when the quarantined peer was put back on the device to retry it, or zero.
+	retrying time.Time
+}
+
+func newQuarantine(attempts int, period, retry time.Duration) *quarantine {
+	return &quarantine{
+		attempts: attempts,
+		period:   period,
+		retry:    retry,
+		peers:    make(map[string]*quarantineState),
+	}
+}
+
+// attemptFailed records that the peer's endpoint failed over without a handshake having ever
+// completed. The caller must hold the lock.
+func (pt *peerTracker) attemptFailed(name string, dp *wgtypes.Peer) {
+	if pt.quarantine == nil || !dp.LastHandshakeTime.IsZero() {
+		return
+	}
+	st, ok := pt.quarantine.peers[name]
+	if !ok {
+		st = &quarantineState{}
+		pt.quarantine.peers[name] = st
+	}
+	if st.first.IsZero() {
+		st.first = pt.clock()
+	}
+	st.attempts++
+}
+
+// updateQuarantine quarantines the peers which have failed for long enough, retries quarantined
+// peers which are due, and releases those which complete a handshake. Returns true if the peers on
+// the device changed. The caller must hold the lock.
+func (pt *peerTracker) updateQuarantine(devPeers []wgtypes.Peer) bool {
+	if pt.quarantine == nil {
+		return false
+	}
+	byKey := make(map[string]*wgtypes.Peer, len(devPeers))
+	for i := range devPeers {
+		byKey[devPeers[i].PublicKey.String()] = &devPeers[i]
+	}
+	now := pt.clock()
+	var changed bool
+	for name, st := range pt.quarantine.peers {
+		wgPeer, ok := pt.peer(name)
+		if !ok {
+			delete(pt.quarantine.peers, name)
+			continue
+		}
+		ll := wglog.WithPeer(pt.ll, wgPeer)
+		if dp, ok := byKey[wgPeer.Spec.PublicKey]; ok && !dp.LastHandshakeTime.IsZero() {
+			if !st.since.IsZero() {
+				ll.Info("quarantined peer completed a handshake; releasing it")
+				pt.peerQuarantined(wgPeer, nil, now)
+			}
+			delete(pt.quarantine.peers, name)
+			continue
+		}
+		switch {
+		case st.since.IsZero():
+			if st.attempts < pt.quarantine.attempts || now.Sub(st.first) < pt.quarantine.period {
+				continue
+			}
+			st.since = now
+			pt.peerQuarantined(wgPeer, st, now)
+		case !st.retrying.IsZero():
+			if st.attempts == 0 {
+				continue
+			}
+			ll.Info("quarantined peer still not completing handshakes; removing it again")
+		case now.Sub(st.removed) >= pt.quarantine.retry:
+			ll.Info("retrying quarantined peer")
+			st.retrying = now
+			st.attempts = 0
+			changed = true
+			continue
+		default:
+			continue
+		}
+		st.removed = now
+		st.retrying = time.Time{}
+		// The device forgets the peer's counters, so start over when it's configured again.
+		delete(pt.endpoints, name)
+		delete(pt.liveness, name)
+		changed = true
+	}
+	return changed
+}
+
+// quarantined returns true if the peer is held off the device. The caller must hold the lock.
+func (pt *peerTracker) quarantined(name string) bool {
+	if pt.quarantine == nil {
+		return false
+	}
+	st, ok := pt.quarantine.peers[name]
+	return ok && !st.since.IsZero() && st.retrying.IsZero()
+}
+
+// releaseQuarantine forgets the peer's failures, ex. as its spec changes, so a fixed peer isn't kept
+// off the device. The caller must hold the lock.
+func (pt *peerTracker) releaseQuarantine(name string) {
+	if pt.quarantine == nil {
+		return
+	}
+	if st, ok := pt.quarantine.peers[name]; ok && !st.since.IsZero() {
+		if wgPeer := pt.current(name); wgPeer != nil {
+			wglog.WithPeer(pt.ll, wgPeer).Info("quarantined peer changed; releasing it")
+			pt.peerQuarantined(wgPeer, nil, pt.clock())
+		}
+	}
+	delete(pt.quarantine.peers, name)
+}
+
+// quarantineSince returns when the peer was quarantined, or nil if it isn't. The caller must hold
+// the lock.
+func (pt *peerTracker) quarantineSince(name string) *time.Time {
+	if pt.quarantine == nil {
+		return nil
+	}
+	st, ok := pt.quarantine.peers[name]
+	if !ok || st.since.IsZero() {
+		return nil
+	}
+	return &st.since
+}
+
+// peerQuarantined records that the peer was quarantined after the failures in st, or released if
+// st is nil, in the logs, metrics, and events. The caller must hold the lock.
+func (pt *peerTracker) peerQuarantined(wgPeer *wgk8s.WireGuardPeer, st *quarantineState, now time.Time) {
+	pt.metrics.setQuarantined(wgPeer.GetName(), st != nil)
+	e := Event{Time: now, Type: "released", Peer: wgPeer.GetName(), PublicKey: wgPeer.Spec.PublicKey}
+	if st != nil {
+		msg := fmt.Sprintf("WireGuardPeer never completed a handshake in %d endpoint attempts over %s, removing it; retrying every %s",
+			st.attempts, now.Sub(st.first).Round(time.Second), pt.quarantine.retry)
+		wglog.WithPeer(pt.ll, wgPeer).Warn(msg)
+		if pt.onQuarantine != nil {
+			pt.onQuarantine(wgPeer, msg)
+		}
+		e.Type = "quarantined"
+		e.Changes = append(e.Changes, fmt.Sprintf("attempts: %d since %s", st.attempts, st.first.UTC().Format(time.RFC3339)))
+	}
+	if pt.events != nil {
+		pt.events.publish(e)
+	}
+}
+
+// recordQuarantine records an event on a peer as it's quarantined, if events are recorded. Events
+// are only recorded in the registry namespace.
+func (a *Agent) recordQuarantine(wgPeer *wgk8s.WireGuardPeer, msg string) {
+	if a.recorder != nil && wgPeer.GetNamespace() == a.registryNamespace {
+		a.recorder.Event(wgPeer, corev1.EventTypeWarning, reasonPeerQuarantined, msg)
+	}
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+func TestQuarantine(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var quarantined []string
+	pt := &peerTracker{
+		ll:         logrus.New(),
+		registry:   newPeerStore(),
+		applied:    make(map[string]wgtypes.PeerConfig),
+		localPeer:  testPeer("local", nil),
+		now:        func() time.Time { return now },
+		quarantine: newQuarantine(3, time.Minute, time.Hour),
+		events:     &eventBroadcaster{},
+		onQuarantine: func(wgPeer *wgk8s.WireGuardPeer, msg string) {
+			quarantined = append(quarantined, wgPeer.GetName()+": "+msg)
+		},
+	}
+	events, unsubscribe := pt.events.subscribe()
+	defer unsubscribe()
+
+	k, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	wgPeer := testPeer("dead", nil, "10.0.0.1/32")
+	wgPeer.Spec.PublicKey = k.PublicKey().String()
+	require.NoError(t, pt.storePeer(wgPeer))
+	dp := wgtypes.Peer{PublicKey: k.PublicKey()}
+	devPeers := []wgtypes.Peer{dp}
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			pt.attemptFailed("/dead", &dp)
+		}
+	}
+
+	fail(3)
+	require.False(t, pt.updateQuarantine(devPeers), "attempts must fail over the whole period")
+	require.False(t, pt.quarantined("/dead"))
+
+	now = now.Add(time.Minute)
+	require.True(t, pt.updateQuarantine(devPeers))
+	require.True(t, pt.quarantined("/dead"))
+	require.Equal(t, []string{"dead: WireGuardPeer never completed a handshake in 3 endpoint attempts over 1m0s, removing it; retrying every 1h0m0s"}, quarantined)
+	e := <-events
+	require.Equal(t, "quarantined", e.Type)
+	require.Equal(t, []string{"attempts: 3 since 2020-09-13T12:26:40Z"}, e.Changes)
+	since := metav1.NewTime(now)
+	require.Equal(t, []wgk8s.PeerHealth{{Name: "dead", QuarantinedSince: &since}}, pt.peerHealth(nil),
+		"quarantined peers are listed though they're off the device")
+
+	now = now.Add(30 * time.Minute)
+	require.False(t, pt.updateQuarantine(nil))
+	now = now.Add(30 * time.Minute)
+	require.True(t, pt.updateQuarantine(nil), "the peer is retried")
+	require.False(t, pt.quarantined("/dead"))
+	require.False(t, pt.updateQuarantine(devPeers))
+
+	fail(1)
+	require.True(t, pt.updateQuarantine(devPeers), "the failed retry removes the peer again")
+	require.True(t, pt.quarantined("/dead"))
+	require.Len(t, quarantined, 1, "quarantine is only reported once")
+
+	now = now.Add(time.Hour)
+	require.True(t, pt.updateQuarantine(nil))
+	dp.LastHandshakeTime = now
+	require.False(t, pt.updateQuarantine([]wgtypes.Peer{dp}))
+	require.Equal(t, "released", (<-events).Type)
+	require.Empty(t, pt.quarantine.peers, "a handshake releases the peer")
+	fail(3)
+	require.Empty(t, pt.quarantine.peers, "peers which have completed a handshake aren't quarantined")
+}
+
+func TestQuarantineReleasedOnChange(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	pt := &peerTracker{
+		ll:         logrus.New(),
+		registry:   newPeerStore(),
+		localPeer:  testPeer("local", nil),
+		now:        func() time.Time { return now },
+		quarantine: newQuarantine(1, 0, time.Hour),
+		events:     &eventBroadcaster{},
+	}
+	events, unsubscribe := pt.events.subscribe()
+	defer unsubscribe()
+
+	require.NoError(t, pt.storePeer(testPeer("dead", nil, "10.0.0.1/32")))
+	pt.attemptFailed("/dead", &wgtypes.Peer{})
+	require.True(t, pt.updateQuarantine(nil))
+	require.True(t, pt.quarantined("/dead"))
+	require.Equal(t, "quarantined", (<-events).Type)
+
+	require.NoError(t, pt.storePeer(testPeer("dead", nil, "10.0.0.1/32")))
+	require.True(t, pt.quarantined("/dead"), "unchanged updates don't release the peer")
+	require.NoError(t, pt.storePeer(testPeer("dead", nil, "10.0.0.2/32")))
+	require.False(t, pt.quarantined("/dead"))
+	require.Equal(t, "released", (<-events).Type)
+	require.Empty(t, pt.quarantine.peers)
+}
@@ -0,0 +1,248 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// reflectRoutesInterval is how often a gateway re-computes the routes it reflects.
+const reflectRoutesInterval = 10 * time.Second
+
+// reflectRoutes periodically publishes the routes we learn from the peers we connect to directly,
+// so peers which only connect to us can reach them, until the context is canceled.
+func (a *Agent) reflectRoutes(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := a.reflectRoutesOnce()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to publish reflected routes")
+			}
+		}, reflectRoutesInterval, ctx.Done())
+	}()
+}
+
+func (a *Agent) reflectRoutesOnce() error {
+	routes := a.peerTracker.learnedRoutes()
+	err := a.publishLocalPeerSpec(func(spec *wgk8s.WireGuardPeerSpec) bool {
+		if reflect.DeepEqual(spec.ReflectedRoutes, routes) {
+			return false
+		}
+		spec.ReflectedRoutes = routes
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("publishing reflected routes: %w", err)
+	}
+	return nil
+}
+
+// learnedRoutes returns the routes to reflect: the prefixes of each peer we're connected to, and the
+// routes they reflect, with the local peer appended to their paths. Routes whose path already
+// includes the local peer are dropped.
+func (pt *peerTracker) learnedRoutes() []wgk8s.ReflectedRoute {
+	pt.Lock()
+	defer pt.Unlock()
+	local := pt.localPeer.GetName()
+	var learned []wgk8s.ReflectedRoute
+	for key := range pt.applied {
+		p, ok := pt.peer(key)
+		if !ok {
+			continue
+		}
+		prefixes, err := pt.prefixes(p)
+		if err != nil {
+			continue
+		}
+		for _, n := range prefixes {
+			learned = append(learned, wgk8s.ReflectedRoute{CIDR: n.String(), Path: []string{p.GetName(), local}})
+		}
+		for _, r := range p.Spec.ReflectedRoutes {
+			if pathContains(r.Path, local) {
+				continue
+			}
+			path := append(append([]string(nil), r.Path...), local)
+			learned = append(learned, wgk8s.ReflectedRoute{CIDR: r.CIDR, Path: path})
+		}
+	}
+	return aggregateRoutes(learned)
+}
+
+// addReflectedRoutes routes prefixes reflected by the peers in out through them, unless the prefix
+// is already routed. If several peers reflect a prefix, the shortest path wins, then the lowest peer
+// name. peers are the configured peers, as listed by listPeers. The caller must hold the lock.
+func (pt *peerTracker) addReflectedRoutes(out map[string]wgtypes.PeerConfig, peers map[string]*wgk8s.WireGuardPeer) {
+	var reflecting []string
+	for key := range out {
+		if p, ok := peers[key]; ok && len(p.Spec.ReflectedRoutes) > 0 {
+			reflecting = append(reflecting, key)
+		}
+	}
+	if len(reflecting) == 0 {
+		return
+	}
+	local := pt.localPeer.GetName()
+	routed := make(map[string]struct{})
+	for _, c := range out {
+		for _, n := range c.AllowedIPs {
+			routed[n.String()] = struct{}{}
+		}
+	}
+	type choice struct {
+		key, name string
+		pathLen   int
+		cidr      net.IPNet
+	}
+	best := make(map[string]choice)
+	for _, key := range reflecting {
+		p := peers[key]
+		for _, r := range p.Spec.ReflectedRoutes {
+			if pathContains(r.Path, local) {
+				continue
+			}
+			_, cidr, err := net.ParseCIDR(r.CIDR)
+			if err != nil {
+				continue
+			}
+			s := cidr.String()
+			if _, ok := routed[s]; ok {
+				continue
+			}
+			c := choice{key: key, name: p.GetName(), pathLen: len(r.Path), cidr: *cidr}
+			if b, ok := best[s]; ok && (b.pathLen < c.pathLen || (b.pathLen == c.pathLen && b.name < c.name)) {
+				continue
+			}
+			best[s] = c
+		}
+	}
+	for _, c := range best {
+		config := out[c.key]
+		config.AllowedIPs = append(config.AllowedIPs, c.cidr)
+		out[c.key] = config
+	}
+}
+
+func pathContains(path []string, name string) bool {
+	for _, p := range path {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateRoutes merges routes which share a path, dropping covered prefixes and combining
+// siblings into their parent. Routes with different paths aren't merged, since a peer on one path
+// must still be able to ignore just its own routes. Where the same prefix is learned over several
+// paths, the shortest is kept. Routes are sorted by CIDR.
+func aggregateRoutes(routes []wgk8s.ReflectedRoute) []wgk8s.ReflectedRoute {
+	type group struct {
+		path []string
+		nets []*net.IPNet
+	}
+	groups := make(map[string]*group)
+	for _, r := range routes {
+		_, cidr, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			continue
+		}
+		k := strings.Join(r.Path, "\x00")
+		g, ok := groups[k]
+		if !ok {
+			g = &group{path: r.Path}
+			groups[k] = g
+		}
+		g.nets = append(g.nets, cidr)
+	}
+	byCIDR := make(map[string]wgk8s.ReflectedRoute)
+	for _, g := range groups {
+		for _, n := range aggregatePrefixes(g.nets) {
+			s := n.String()
+			if existing, ok := byCIDR[s]; ok && !shorterPath(g.path, existing.Path) {
+				continue
+			}
+			byCIDR[s] = wgk8s.ReflectedRoute{CIDR: s, Path: g.path}
+		}
+	}
+	var out []wgk8s.ReflectedRoute
+	for _, r := range byCIDR {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CIDR < out[j].CIDR })
+	return out
+}
+
+func shorterPath(a, b []string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return strings.Join(a, "\x00") < strings.Join(b, "\x00")
+}
+
+// aggregatePrefixes drops prefixes covered by another, and merges sibling prefixes into their
+// parent, until neither applies.
+func aggregatePrefixes(nets []*net.IPNet) []*net.IPNet {
+	set := make(map[string]*net.IPNet, len(nets))
+	for _, n := range nets {
+		set[n.String()] = n
+	}
+	for changed := true; changed; {
+		changed = false
+		for k, n := range set {
+			for k2, m := range set {
+				if k != k2 && prefixCovers(m, n) {
+					delete(set, k)
+					changed = true
+					break
+				}
+			}
+		}
+		for k, n := range set {
+			ones, bits := n.Mask.Size()
+			if ones == 0 {
+				continue
+			}
+			sib := siblingPrefix(n)
+			if _, ok := set[sib.String()]; !ok {
+				continue
+			}
+			mask := net.CIDRMask(ones-1, bits)
+			parent := &net.IPNet{IP: n.IP.Mask(mask), Mask: mask}
+			delete(set, k)
+			delete(set, sib.String())
+			set[parent.String()] = parent
+			changed = true
+			break
+		}
+	}
+	out := make([]*net.IPNet, 0, len(set))
+	for _, n := range set {
+		out = append(out, n)
+	}
+	return out
+}
+
+// prefixCovers returns true if m contains every address in n.
+func prefixCovers(m, n *net.IPNet) bool {
+	mOnes, mBits := m.Mask.Size()
+	nOnes, nBits := n.Mask.Size()
+	return mBits == nBits && mOnes <= nOnes && m.Contains(n.IP)
+}
+
+// siblingPrefix returns the prefix which shares n's parent.
+func siblingPrefix(n *net.IPNet) *net.IPNet {
+	ones, _ := n.Mask.Size()
+	ip := append(net.IP(nil), n.IP...)
+	ip[(ones-1)/8] ^= 0x80 >> uint((ones-1)%8)
+	return &net.IPNet{IP: ip, Mask: n.Mask}
+}
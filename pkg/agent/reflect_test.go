@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestAggregateRoutes(t *testing.T) {
+	route := func(cidr string, path ...string) wgk8s.ReflectedRoute {
+		return wgk8s.ReflectedRoute{CIDR: cidr, Path: path}
+	}
+	tcs := []struct {
+		name   string
+		routes []wgk8s.ReflectedRoute
+		expect []wgk8s.ReflectedRoute
+	}{
+		{
+			name:   "none",
+			expect: nil,
+		},
+		{
+			name: "siblings merge",
+			routes: []wgk8s.ReflectedRoute{
+				route("10.1.0.0/25", "a", "gw"),
+				route("10.1.0.128/25", "a", "gw"),
+				route("10.1.1.0/24", "a", "gw"),
+			},
+			expect: []wgk8s.ReflectedRoute{route("10.1.0.0/23", "a", "gw")},
+		},
+		{
+			name: "covered dropped",
+			routes: []wgk8s.ReflectedRoute{
+				route("10.1.0.0/16", "a", "gw"),
+				route("10.1.2.0/24", "a", "gw"),
+				route("fd00::1/128", "a", "gw"),
+			},
+			expect: []wgk8s.ReflectedRoute{route("10.1.0.0/16", "a", "gw"), route("fd00::1/128", "a", "gw")},
+		},
+		{
+			name: "different paths aren't merged",
+			routes: []wgk8s.ReflectedRoute{
+				route("10.0.0.0/32", "a", "gw"),
+				route("10.0.0.1/32", "b", "gw"),
+			},
+			expect: []wgk8s.ReflectedRoute{route("10.0.0.0/32", "a", "gw"), route("10.0.0.1/32", "b", "gw")},
+		},
+		{
+			name: "shortest path wins",
+			routes: []wgk8s.ReflectedRoute{
+				route("192.168.0.0/16", "a", "b", "gw"),
+				route("192.168.0.0/16", "c", "gw"),
+				route("bogus", "c", "gw"),
+			},
+			expect: []wgk8s.ReflectedRoute{route("192.168.0.0/16", "c", "gw")},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, aggregateRoutes(tc.routes))
+		})
+	}
+}
+
+func TestRouteReflection(t *testing.T) {
+	hub := map[string]string{"role": "hub"}
+	newTracker := func(local *wgk8s.WireGuardPeer, peers ...*wgk8s.WireGuardPeer) *peerTracker {
+		pt := &peerTracker{
+			ll:        logrus.New(),
+			registry:  newPeerStore(),
+			localPeer: local,
+			topology:  topology{hubs: labels.SelectorFromSet(hub)},
+		}
+		for _, p := range peers {
+			require.NoError(t, pt.registry.Add(p))
+		}
+		pt.applied = pt.desiredPeers()
+		return pt
+	}
+	withKey := func(p *wgk8s.WireGuardPeer) *wgk8s.WireGuardPeer {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		p.Spec.PublicKey = key.PublicKey().String()
+		p.Spec.Endpoint = "192.0.2.1:51820"
+		return p
+	}
+	gw1 := withKey(testPeer("gw1", hub, "10.0.0.1/24"))
+	gw2 := withKey(testPeer("gw2", hub, "10.0.0.2/24"))
+	leaf := withKey(testPeer("leaf", nil, "10.0.0.3/24"))
+	leaf.Spec.Routes = []string{"192.168.0.0/24", "192.168.1.0/24"}
+
+	// gw1 learns the leaf's prefixes and aggregates its routes.
+	learned := newTracker(gw1, gw2, leaf).learnedRoutes()
+	require.Equal(t, []wgk8s.ReflectedRoute{
+		{CIDR: "10.0.0.2/32", Path: []string{"gw2", "gw1"}},
+		{CIDR: "10.0.0.3/32", Path: []string{"leaf", "gw1"}},
+		{CIDR: "192.168.0.0/23", Path: []string{"leaf", "gw1"}},
+	}, learned)
+	gw1.Spec.ReflectedRoutes = learned
+
+	// gw2 doesn't re-learn its own prefix from gw1, and prefers its direct path to the leaf.
+	require.Equal(t, []wgk8s.ReflectedRoute{
+		{CIDR: "10.0.0.1/32", Path: []string{"gw1", "gw2"}},
+		{CIDR: "10.0.0.3/32", Path: []string{"leaf", "gw2"}},
+		{CIDR: "192.168.0.0/23", Path: []string{"leaf", "gw2"}},
+	}, newTracker(gw2, gw1, leaf).learnedRoutes())
+
+	// A remote peer which only connects to gw1 routes the reflected prefixes through it, except
+	// those it already reaches.
+	remote := withKey(testPeer("remote", nil, "10.0.0.4/24"))
+	pt := newTracker(remote, gw1)
+	gw1.Spec.ReflectedRoutes = append(gw1.Spec.ReflectedRoutes,
+		wgk8s.ReflectedRoute{CIDR: "10.0.0.4/32", Path: []string{"remote", "gw1"}},
+		wgk8s.ReflectedRoute{CIDR: "10.0.0.1/32", Path: []string{"other", "gw1"}},
+	)
+	desired := pt.desiredPeers()
+	require.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32", "192.168.0.0/23"},
+		ipNetStrings(desired["/gw1"].AllowedIPs))
+}
@@ -0,0 +1,308 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// registryUnreachableCondition is the kube node condition which is True while the registry is
+// unreachable.
+const registryUnreachableCondition corev1.NodeConditionType = "WgmeshRegistryUnreachable"
+
+// registryHealth tracks whether the registry is reachable, from the results of the informers' list
+// and watch requests. While it isn't, the agent keeps the last known configuration; the informers
+// retry in the background, and changes made in the meantime are applied once they resync.
+type registryHealth struct {
+	ll      log.FieldLogger
+	metrics *metrics
+	now     func() time.Time
+
+	lock sync.Mutex
+	// unreachableSince is when requests began failing, or zero while they succeed.
+	unreachableSince time.Time
+	lastErr          error
+	// denied is true while the registry answers with Unauthorized or Forbidden.
+	denied bool
+	// changed is signaled when the registry becomes unreachable, or reachable again.
+	changed chan struct{}
+}
+
+func newRegistryHealth(ll log.FieldLogger, m *metrics) *registryHealth {
+	return &registryHealth{ll: ll, metrics: m, now: time.Now, changed: make(chan struct{}, 1)}
+}
+
+// registryUnreachable returns true if the error means the registry couldn't be reached. Errors the
+// registry answered with, ex. NotFound, don't, though server errors do.
+func registryUnreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if status, ok := err.(k8sErrors.APIStatus); ok {
+		code := status.Status().Code
+		return code < 400 || code >= 500
+	}
+	return true
+}
+
+// registryErrorReason classifies a failed registry request, for the failures metric.
+func registryErrorReason(err error) string {
+	switch {
+	case k8sErrors.IsUnauthorized(err):
+		return "unauthorized"
+	case k8sErrors.IsForbidden(err):
+		return "forbidden"
+	case k8sErrors.IsTooManyRequests(err):
+		return "throttled"
+	case registryUnreachable(err):
+		return "unreachable"
+	default:
+		return "rejected"
+	}
+}
+
+// observe records the result of a request to the registry.
+func (h *registryHealth) observe(err error) {
+	if err != nil {
+		h.metrics.observeRegistryFailure(registryErrorReason(err))
+	}
+	var denied error
+	if k8sErrors.IsUnauthorized(err) || k8sErrors.IsForbidden(err) {
+		denied = err
+	}
+	if !registryUnreachable(err) {
+		err = nil
+	}
+	h.metrics.observeRegistry(err)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	// Retrying won't help until the credentials or RBAC rules are fixed, so we say so once, rather
+	// than on each retry.
+	switch {
+	case denied != nil && !h.denied:
+		h.denied = true
+		h.ll.WithError(denied).Error("registry denied the agent's request; check its credentials and RBAC rules; retrying with backoff")
+	case denied == nil && err == nil && h.denied:
+		h.denied = false
+		h.ll.Info("registry accepted the agent's requests again")
+	}
+	h.lastErr = err
+	switch {
+	case err != nil && h.unreachableSince.IsZero():
+		h.unreachableSince = h.now()
+		h.ll.WithError(err).Warn("registry unreachable; keeping the last known configuration while retrying")
+	case err == nil && !h.unreachableSince.IsZero():
+		outage := h.now().Sub(h.unreachableSince).Round(time.Second)
+		h.ll.WithField("outage", outage.String()).Info("registry reachable again; resyncing")
+		h.unreachableSince = time.Time{}
+	default:
+		return
+	}
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+// state returns when the registry became unreachable and the latest error, or zero and nil if it's
+// reachable.
+func (h *registryHealth) state() (time.Time, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.unreachableSince.IsZero() {
+		return time.Time{}, nil
+	}
+	return h.unreachableSince, h.lastErr
+}
+
+// listWatch wraps the ListerWatcher, observing the result of each request. Failed requests, and
+// watches which close soon after opening, are retried with exponential backoff, rather than as fast
+// as the informer would, until the context is canceled.
+func (h *registryHealth) listWatch(ctx context.Context, lw cache.ListerWatcher) cache.ListerWatcher {
+	b := &requestBackoff{now: h.now}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			if err := h.wait(ctx, b.before(false)); err != nil {
+				return nil, err
+			}
+			o, err := lw.List(options)
+			h.observe(err)
+			b.after(false, err)
+			return o, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			delay := b.before(true)
+			if b.flapping() {
+				h.metrics.observeRegistryFailure("watch_closed")
+			}
+			if err := h.wait(ctx, delay); err != nil {
+				return nil, err
+			}
+			w, err := lw.Watch(options)
+			h.observe(err)
+			b.after(true, err)
+			return w, err
+		},
+	}
+}
+
+// wait blocks for the delay, or until the context is canceled.
+func (h *registryHealth) wait(ctx context.Context, delay time.Duration) error {
+	h.metrics.setRegistryBackoff(delay)
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+const (
+	// registryBackoffBase and registryBackoffCap bound the delay before retrying a registry request.
+	registryBackoffBase = time.Second
+	registryBackoffCap  = time.Minute
+	// watchFlapInterval is how long a watch must stay open before it's considered healthy. Those which
+	// close sooner, ex. dropped by a flapping connection or proxy, are backed off like failures.
+	watchFlapInterval = 10 * time.Second
+)
+
+// requestBackoff tracks the failures of one ListerWatcher's requests, to delay its retries.
+type requestBackoff struct {
+	now func() time.Time
+
+	lock sync.Mutex
+	// failures is the number of failed requests and flapping watches since the last healthy watch.
+	failures int
+	// retryAfter is the delay the registry asked for with its latest error, if any.
+	retryAfter time.Duration
+	// watchOpened is when the latest watch opened, or zero.
+	watchOpened time.Time
+	flapped     bool
+}
+
+// before returns how long to wait before the next request.
+func (b *requestBackoff) before(isWatch bool) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.flapped = false
+	if isWatch && !b.watchOpened.IsZero() {
+		if b.now().Sub(b.watchOpened) < watchFlapInterval {
+			b.flapped = true
+			b.failures++
+		} else {
+			b.failures = 0
+		}
+		b.watchOpened = time.Time{}
+	}
+	if b.failures == 0 {
+		return 0
+	}
+	delay := registryBackoffCap
+	if b.failures < 8 {
+		delay = registryBackoffBase << uint(b.failures-1)
+		if delay > registryBackoffCap {
+			delay = registryBackoffCap
+		}
+	}
+	delay = wait.Jitter(delay, 0.1)
+	if b.retryAfter > delay {
+		delay = b.retryAfter
+	}
+	return delay
+}
+
+// flapping returns true if the previous watch closed too soon after it opened.
+func (b *requestBackoff) flapping() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.flapped
+}
+
+// after records the result of a request.
+func (b *requestBackoff) after(isWatch bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.retryAfter = 0
+	if err != nil {
+		b.failures++
+		if seconds, ok := k8sErrors.SuggestsClientDelay(err); ok {
+			b.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return
+	}
+	if isWatch {
+		b.watchOpened = b.now()
+	}
+}
+
+// syncRegistryCondition sets the kube node's WgmeshRegistryUnreachable condition each time the
+// registry becomes unreachable or reachable again, until the context is canceled. It's only useful
+// where the kube node's cluster isn't also the registry.
+func (a *Agent) syncRegistryCondition(ctx context.Context) {
+	if a.localCS == nil || a.kubeNode == "" {
+		return
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-a.registryHealth.changed:
+			}
+			since, err := a.registryHealth.state()
+			if err := a.setRegistryCondition(since, err); err != nil {
+				a.ll.WithError(err).Warn("failed to set node registry condition")
+			}
+		}
+	}()
+}
+
+func (a *Agent) setRegistryCondition(since time.Time, unreachable error) error {
+	now := metav1.Now()
+	c := corev1.NodeCondition{
+		Type:               registryUnreachableCondition,
+		Status:             corev1.ConditionFalse,
+		Reason:             "RegistryReachable",
+		Message:            "wgmesh can reach the registry",
+		LastTransitionTime: now,
+		LastHeartbeatTime:  now,
+	}
+	if !since.IsZero() {
+		c.Status = corev1.ConditionTrue
+		c.Reason = "RegistryUnreachable"
+		c.Message = fmt.Sprintf("wgmesh is keeping its last known configuration: %v", unreachable)
+		c.LastTransitionTime = metav1.NewTime(since)
+	}
+	// Conditions are merged by type, so we leave the others alone.
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []corev1.NodeCondition{c},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.localCS.CoreV1().Nodes().PatchStatus(a.kubeNode, patch)
+	if err != nil {
+		return fmt.Errorf("updating node %q conditions: %w", a.kubeNode, err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRegistryHealth(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	h := newRegistryHealth(logrus.New(), newMetrics())
+	h.now = func() time.Time { return now }
+	changed := func() bool {
+		select {
+		case <-h.changed:
+			return true
+		default:
+			return false
+		}
+	}
+
+	h.observe(nil)
+	require.False(t, changed())
+	h.observe(k8sErrors.NewNotFound(schema.GroupResource{Group: "wgmesh.codybaker.com", Resource: "meshes"}, ""))
+	since, err := h.state()
+	require.True(t, since.IsZero(), "the registry answered")
+	require.NoError(t, err)
+
+	h.observe(errors.New("connection refused"))
+	require.True(t, changed())
+	now = now.Add(time.Minute)
+	h.observe(k8sErrors.NewServiceUnavailable("etcd unavailable"))
+	require.False(t, changed(), "still unreachable")
+	since, err = h.state()
+	require.Equal(t, time.Unix(1000000, 0), since)
+	require.EqualError(t, err, "etcd unavailable")
+
+	h.observe(nil)
+	require.True(t, changed())
+	since, err = h.state()
+	require.True(t, since.IsZero())
+	require.NoError(t, err)
+}
+
+func TestSetRegistryCondition(t *testing.T) {
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.kubeNode = "node"
+	a.localCS = kubefake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node"},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	})
+	condition := func() *corev1.NodeCondition {
+		node, err := a.localCS.CoreV1().Nodes().Get("node", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Len(t, node.Status.Conditions, 2, "other conditions are left alone")
+		for _, c := range node.Status.Conditions {
+			if c.Type == registryUnreachableCondition {
+				return &c
+			}
+		}
+		return nil
+	}
+
+	since := time.Unix(1000000, 0)
+	require.NoError(t, a.setRegistryCondition(since, errors.New("connection refused")))
+	c := condition()
+	require.Equal(t, corev1.ConditionTrue, c.Status)
+	require.Equal(t, "RegistryUnreachable", c.Reason)
+	require.Equal(t, "wgmesh is keeping its last known configuration: connection refused", c.Message)
+	require.True(t, since.Equal(c.LastTransitionTime.Time))
+
+	require.NoError(t, a.setRegistryCondition(time.Time{}, nil))
+	c = condition()
+	require.Equal(t, corev1.ConditionFalse, c.Status)
+	require.Equal(t, "RegistryReachable", c.Reason)
+}
+
+func TestRegistryErrorReason(t *testing.T) {
+	gr := schema.GroupResource{Group: "wgmesh.codybaker.com", Resource: "wireguardpeers"}
+	for err, reason := range map[error]string{
+		errors.New("connection refused"):                   "unreachable",
+		k8sErrors.NewServiceUnavailable("etcd down"):       "unreachable",
+		k8sErrors.NewUnauthorized("bad token"):             "unauthorized",
+		k8sErrors.NewForbidden(gr, "", errors.New("rbac")): "forbidden",
+		k8sErrors.NewTooManyRequests("slow down", 5):       "throttled",
+		k8sErrors.NewNotFound(gr, "a"):                     "rejected",
+	} {
+		require.Equal(t, reason, registryErrorReason(err), err.Error())
+	}
+}
+
+func TestRequestBackoff(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	b := &requestBackoff{now: func() time.Time { return now }}
+	within := func(expected, delay time.Duration, msgAndArgs ...interface{}) {
+		require.InDelta(t, float64(expected), float64(delay), float64(expected)*0.1+1, msgAndArgs...)
+	}
+
+	require.Zero(t, b.before(false), "the first request isn't delayed")
+	b.after(false, errors.New("connection refused"))
+	within(time.Second, b.before(false))
+	b.after(false, errors.New("connection refused"))
+	within(2*time.Second, b.before(false))
+	b.after(false, nil)
+	within(2*time.Second, b.before(true), "only a healthy watch resets the backoff")
+	b.after(true, nil)
+
+	// The watch closes right away, ex. dropped by a proxy.
+	now = now.Add(time.Second)
+	within(4*time.Second, b.before(true))
+	require.True(t, b.flapping())
+	b.after(true, nil)
+
+	now = now.Add(watchFlapInterval)
+	require.Zero(t, b.before(true), "the watch stayed open")
+	require.False(t, b.flapping())
+	b.after(true, k8sErrors.NewTooManyRequests("slow down", 30))
+	require.Equal(t, 30*time.Second, b.before(true), "the registry's requested delay is honored")
+	b.after(true, k8sErrors.NewUnauthorized("bad token"))
+	within(2*time.Second, b.before(true))
+
+	for i := 0; i < 100; i++ {
+		b.after(false, errors.New("connection refused"))
+	}
+	within(registryBackoffCap, b.before(false))
+}
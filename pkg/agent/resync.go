@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// resyncTimeout is how long a requested resync waits for the registry to be listed.
+const resyncTimeout = time.Minute
+
+// relist drops the active watch, and fails the next until the informer lists the registry again,
+// which replaces its cache, delivering any changes it missed. The returned channel is closed once
+// it has.
+func (d *droppableWatch) relist() <-chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	if d.relisted == nil {
+		d.relisted = make(chan struct{})
+	}
+	if d.current != nil {
+		d.current.Stop()
+		d.current = nil
+	}
+	return d.relisted
+}
+
+// listed records that the informer listed the registry.
+func (d *droppableWatch) listed() {
+	d.Lock()
+	defer d.Unlock()
+	if d.relisted != nil {
+		close(d.relisted)
+		d.relisted = nil
+	}
+}
+
+// watch opens a watch with f, unless a relist is pending. The reflector treats io.EOF as a watch
+// which closed normally, and lists again.
+func (d *droppableWatch) watch(f func() (watch.Interface, error)) (watch.Interface, error) {
+	d.Lock()
+	pending := d.relisted != nil
+	d.Unlock()
+	if pending {
+		return nil, io.EOF
+	}
+	return d.track(f())
+}
+
+// reapply replaces the interface's peers and routes with the desired config, correcting changes
+// made outside the agent.
+func (pt *peerTracker) reapply() error {
+	pt.Lock()
+	defer pt.Unlock()
+	if !pt.initialConfigApplied {
+		return nil
+	}
+	return pt.replaceConfig()
+}
+
+// reapplyPeriodically reapplies the full config every resync period, until the context is
+// canceled.
+func (a *Agent) reapplyPeriodically(ctx context.Context) {
+	t := time.NewTicker(a.resyncPeriod)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			if err := a.peerTracker.reapply(); err != nil {
+				a.ll.WithError(err).Error("failed to reapply config")
+			}
+		}
+	}()
+}
+
+// resync lists the registry's peers again, then reapplies the full config to the interface.
+func (a *Agent) resync(ctx context.Context) error {
+	if a.peerTracker == nil {
+		return errors.New("peers haven't been synced yet")
+	}
+	a.ll.Info("resyncing peers from the registry")
+	ctx, cancel := context.WithTimeout(ctx, resyncTimeout)
+	defer cancel()
+	select {
+	case <-a.peerWatch.relist():
+	case <-ctx.Done():
+		return errors.New("timed out waiting to list the registry")
+	}
+	return a.peerTracker.reapply()
+}
+
+func (a *Agent) handleResync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.resync(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
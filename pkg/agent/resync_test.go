@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestDroppableWatchRelist(t *testing.T) {
+	var d droppableWatch
+	open := func() (watch.Interface, error) { return watch.NewFake(), nil }
+
+	w, err := d.watch(open)
+	require.NoError(t, err)
+	relisted := d.relist()
+	_, ok := <-w.ResultChan()
+	require.False(t, ok, "the active watch is stopped")
+
+	_, err = d.watch(open)
+	require.Equal(t, io.EOF, err, "watches fail until the informer lists again")
+	select {
+	case <-relisted:
+		t.Fatal("not relisted yet")
+	default:
+	}
+
+	d.listed()
+	<-relisted
+	_, err = d.watch(open)
+	require.NoError(t, err)
+	d.listed()
+}
@@ -0,0 +1,321 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// routeRestoreDelay is how long after a route is removed out-of-band it's restored, so a burst
+	// of removals, ex. a network manager flushing the interface, is restored at once.
+	routeRestoreDelay = time.Second
+	// routeWatchRetryInterval is how long after the route watch fails it's restarted.
+	routeWatchRetryInterval = 10 * time.Second
+)
+
+// peerLiveness tracks whether a peer is completing handshakes while we send to it.
+type peerLiveness struct {
+	// txBytes is the transmit counter when the peer was last observed, or -1 if it hasn't been.
+	txBytes int64
+	// sending is when we first observed traffic to the peer without a fresh handshake.
+	sending time.Time
+	// down is when the peer was marked down, or zero if it's up.
+	down time.Time
+	// stale is when the peer was first marked down without a handshake completing since, or zero.
+	// Unlike down, it isn't cleared when a down peer's routes are retried.
+	stale time.Time
+}
+
+// updateLiveness marks down peers we've been sending to for the handshake timeout without a fresh
+// handshake. A down peer is up again after its next handshake, or after staleHandshake, when we
+// retry it. Peers are stale from when they're first marked down until their next handshake, which
+// distinguishes a dead endpoint from an idle one. Returns true if any peer changed state. The
+// caller must hold the lock.
+func (pt *peerTracker) updateLiveness(devPeers []wgtypes.Peer) bool {
+	byKey := make(map[wgtypes.Key]*wgtypes.Peer, len(devPeers))
+	for i := range devPeers {
+		byKey[devPeers[i].PublicKey] = &devPeers[i]
+	}
+	if pt.liveness == nil {
+		pt.liveness = make(map[string]*peerLiveness)
+	}
+	now := pt.clock()
+	var changed bool
+	for name, wgPeer := range pt.listPeers() {
+		key, err := wgtypes.ParseKey(wgPeer.Spec.PublicKey)
+		if err != nil {
+			continue
+		}
+		dp, ok := byKey[key]
+		if !ok {
+			continue
+		}
+		pt.metrics.observeHandshake(wgPeer.GetName(), dp.LastHandshakeTime)
+		l, ok := pt.liveness[name]
+		if !ok {
+			l = &peerLiveness{txBytes: -1}
+			pt.liveness[name] = l
+		}
+		tx := l.txBytes
+		l.txBytes = dp.TransmitBytes
+		if tx < 0 {
+			continue
+		}
+		ll := wglog.WithPeer(pt.ll, wgPeer)
+		handshake := dp.LastHandshakeTime
+		switch {
+		case !l.down.IsZero():
+			if handshake.After(l.down) || now.Sub(l.down) >= staleHandshake {
+				ll.Info("retrying down peer's routes")
+				l.down = time.Time{}
+				l.sending = time.Time{}
+				changed = true
+			}
+		case now.Sub(handshake) < staleHandshake || dp.TransmitBytes == tx:
+			l.sending = time.Time{}
+		case l.sending.IsZero():
+			l.sending = now
+		case now.Sub(l.sending) >= pt.staleAfter():
+			ll.Warn("peer not completing handshakes; moving its routes to other peers")
+			l.down = now
+			changed = true
+		}
+		switch {
+		case !l.down.IsZero() && l.stale.IsZero():
+			l.stale = now
+			pt.peerStale(wgPeer, dp, true, now)
+		case !l.stale.IsZero() && handshake.After(l.stale):
+			l.stale = time.Time{}
+			pt.peerStale(wgPeer, dp, false, now)
+		}
+	}
+	return changed
+}
+
+// peerStale records that the peer became stale, or recovered, in the metrics and events. The caller
+// must hold the lock.
+func (pt *peerTracker) peerStale(wgPeer *wgk8s.WireGuardPeer, dp *wgtypes.Peer, stale bool, now time.Time) {
+	pt.metrics.setStale(wgPeer.GetName(), stale)
+	if pt.events == nil {
+		return
+	}
+	e := Event{Time: now, Type: "recovered", Peer: wgPeer.GetName(), PublicKey: wgPeer.Spec.PublicKey}
+	if stale {
+		e.Type = "stale"
+		last := "never"
+		if !dp.LastHandshakeTime.IsZero() {
+			last = dp.LastHandshakeTime.UTC().Format(time.RFC3339)
+		}
+		e.Changes = append(e.Changes, "last handshake: "+last)
+	}
+	e.Changes = append(e.Changes, "endpoint: "+orNone(udpAddrString(dp.Endpoint)))
+	pt.events.publish(e)
+}
+
+// isDown returns true if the peer has been marked down. The caller must hold the lock.
+func (pt *peerTracker) isDown(name string) bool {
+	l, ok := pt.liveness[name]
+	return ok && !l.down.IsZero()
+}
+
+// syncRoutes routes the allowed IPs of every applied peer via the interface, if enabled. The caller
+// must hold the lock.
+func (pt *peerTracker) syncRoutes() error {
+	if !pt.installRoutes {
+		return nil
+	}
+	var routes []net.IPNet
+	routed := make(map[string]bool)
+	for _, c := range pt.applied {
+		routes = append(routes, c.AllowedIPs...)
+		for _, n := range c.AllowedIPs {
+			routed[n.String()] = true
+		}
+	}
+	err := pt.iface.SyncRoutes(routes, pt.routeOptions)
+	if err != nil {
+		return fmt.Errorf("installing routes: %w", err)
+	}
+	if pt.mssClamp != nil {
+		if err := pt.mssClamp.sync(pt.clampMSSRoutes()); err != nil {
+			return fmt.Errorf("clamping mss: %w", err)
+		}
+	}
+	auditRoutes(pt.audit, pt.iface.GetName(), pt.routed, routed)
+	pt.routed = routed
+	return nil
+}
+
+// watchRoutes restores the mesh routes which are removed from the interface out-of-band, ex. by a
+// network manager or a DHCP renewal, until the context is canceled.
+func (a *Agent) watchRoutes(ctx context.Context) {
+	pt := a.peerTracker
+	restore := make(chan struct{}, 1)
+	a.wg.Add(2)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := a.iface.WatchRoutes(ctx, pt.routeOptions, func(dst net.IPNet) {
+				if !pt.isRouted(dst) {
+					// We removed it.
+					return
+				}
+				a.ll.WithField("route", dst.String()).Warn("mesh route was removed out-of-band; restoring it")
+				select {
+				case restore <- struct{}{}:
+				default:
+				}
+			})
+			if err != nil {
+				a.ll.WithError(err).Error("failed to watch routes")
+			}
+		}, routeWatchRetryInterval, ctx.Done())
+	}()
+	go func() {
+		defer a.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-restore:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(routeRestoreDelay):
+			}
+			pt.Lock()
+			err := pt.syncRoutes()
+			pt.Unlock()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to restore routes")
+			}
+		}
+	}()
+}
+
+// isRouted returns true if the prefix is one of the routes we last installed.
+func (pt *peerTracker) isRouted(dst net.IPNet) bool {
+	pt.Lock()
+	defer pt.Unlock()
+	return pt.routed[dst.String()]
+}
+
+// assignDuplicateRoutes leaves each prefix routed to more than one peer in out with only the
+// preferred peer, since WireGuard routes a prefix to a single peer. Peers which are up are preferred,
+// then those with the highest route priority, then the lowest name. With ECMP, the prefix is instead
+// split between all of the equally preferred peers which are up. The caller must hold the lock.
+func (pt *peerTracker) assignDuplicateRoutes(out map[string]wgtypes.PeerConfig) {
+	owners := make(map[string][]string)
+	for name, c := range out {
+		for _, n := range c.AllowedIPs {
+			s := n.String()
+			if len(owners[s]) == 0 || owners[s][len(owners[s])-1] != name {
+				owners[s] = append(owners[s], name)
+			}
+		}
+	}
+	// split holds, by prefix, the parts of the prefix assigned to each peer.
+	split := make(map[string]map[string][]net.IPNet)
+	for s, names := range owners {
+		if len(names) < 2 {
+			continue
+		}
+		sort.Slice(names, func(i, j int) bool { return pt.preferRoute(names[i], names[j]) })
+		if !pt.ecmp {
+			owners[s] = names[:1]
+			continue
+		}
+		equal := 1
+		for equal < len(names) && !pt.isDown(names[0]) && pt.equalCost(names[0], names[equal]) {
+			equal++
+		}
+		_, n, _ := net.ParseCIDR(s)
+		parts := splitPrefix(*n, equal)
+		if len(parts) < 2 {
+			owners[s] = names[:1]
+			continue
+		}
+		split[s] = make(map[string][]net.IPNet)
+		for i, part := range parts {
+			owner := names[i%equal]
+			split[s][owner] = append(split[s][owner], part)
+		}
+	}
+	for name, c := range out {
+		allowed := c.AllowedIPs[:0:0]
+		seen := make(map[string]struct{}, len(c.AllowedIPs))
+		for _, n := range c.AllowedIPs {
+			s := n.String()
+			if _, ok := seen[s]; ok {
+				continue
+			}
+			seen[s] = struct{}{}
+			if parts, ok := split[s]; ok {
+				allowed = append(allowed, parts[name]...)
+			} else if owners[s][0] == name {
+				allowed = append(allowed, n)
+			}
+		}
+		c.AllowedIPs = allowed
+		out[name] = c
+	}
+}
+
+// equalCost returns true if routes are equally well sent to peers a and b.
+func (pt *peerTracker) equalCost(a, b string) bool {
+	pa, _ := pt.peer(a)
+	pb, _ := pt.peer(b)
+	return pt.isDown(a) == pt.isDown(b) && pa.Spec.RoutePriority == pb.Spec.RoutePriority
+}
+
+// splitPrefix splits n into parts which can be spread evenly across count peers. When count isn't a
+// power of two, it's split into 4x as many parts so the remainder is small. Prefixes too long to
+// split into count parts are returned whole.
+func splitPrefix(n net.IPNet, count int) []net.IPNet {
+	ones, bits := n.Mask.Size()
+	k := 0
+	for 1<<uint(k) < count {
+		k++
+	}
+	if 1<<uint(k) != count {
+		k += 2
+	}
+	if k == 0 || ones+k > bits {
+		return []net.IPNet{n}
+	}
+	mask := net.CIDRMask(ones+k, bits)
+	parts := make([]net.IPNet, 0, 1<<uint(k))
+	for i := 0; i < 1<<uint(k); i++ {
+		ip := append(net.IP(nil), n.IP.Mask(n.Mask)...)
+		for j := 0; j < k; j++ {
+			if i>>uint(k-1-j)&1 == 1 {
+				b := ones + j
+				ip[b/8] |= 0x80 >> uint(b%8)
+			}
+		}
+		parts = append(parts, net.IPNet{IP: ip, Mask: mask})
+	}
+	return parts
+}
+
+// preferRoute returns true if a route is better sent to peer a than peer b.
+func (pt *peerTracker) preferRoute(a, b string) bool {
+	if aDown, bDown := pt.isDown(a), pt.isDown(b); aDown != bDown {
+		return bDown
+	}
+	pa, _ := pt.peer(a)
+	pb, _ := pt.peer(b)
+	if pa.Spec.RoutePriority != pb.Spec.RoutePriority {
+		return pa.Spec.RoutePriority > pb.Spec.RoutePriority
+	}
+	return pa.GetName() < pb.GetName()
+}
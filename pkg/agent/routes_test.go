@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPeerTrackerDuplicateRoutes(t *testing.T) {
+	const route = "192.168.0.0/16"
+	tcs := []struct {
+		name     string
+		priority map[string]int
+		down     []string
+		expect   string
+	}{
+		{
+			name:   "lowest name",
+			expect: "/gw-a",
+		},
+		{
+			name:     "highest priority",
+			priority: map[string]int{"/gw-b": 10},
+			expect:   "/gw-b",
+		},
+		{
+			name:     "down peer loses",
+			priority: map[string]int{"/gw-b": 10},
+			down:     []string{"/gw-b"},
+			expect:   "/gw-a",
+		},
+		{
+			name:   "all down",
+			down:   []string{"/gw-a", "/gw-b"},
+			expect: "/gw-a",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			pt := &peerTracker{
+				ll:        logrus.New(),
+				registry:  newPeerStore(),
+				localPeer: testPeer("local", nil, "10.0.0.3/24"),
+				liveness:  make(map[string]*peerLiveness),
+			}
+			for i, name := range []string{"gw-b", "gw-a"} {
+				key, err := wgtypes.GeneratePrivateKey()
+				require.NoError(t, err)
+				p := testPeer(name, nil, []string{"10.0.0.1/24", "10.0.0.2/24"}[i])
+				p.Spec.PublicKey = key.PublicKey().String()
+				p.Spec.Endpoint = "192.0.2.1:51820"
+				p.Spec.Routes = []string{route}
+				p.Spec.RoutePriority = tc.priority[p.GetSelfLink()]
+				require.NoError(t, pt.registry.Add(p))
+			}
+			for _, name := range tc.down {
+				pt.liveness[name] = &peerLiveness{down: time.Unix(1000000, 0)}
+			}
+			desired := pt.desiredPeers()
+			require.Equal(t, []string{"10.0.0.1/32"}, ipNetStrings(desired["/gw-b"].AllowedIPs[:1]))
+			require.Equal(t, []string{"10.0.0.2/32"}, ipNetStrings(desired["/gw-a"].AllowedIPs[:1]))
+			for name, c := range desired {
+				if name == tc.expect {
+					require.Contains(t, ipNetStrings(c.AllowedIPs), route)
+				} else {
+					require.NotContains(t, ipNetStrings(c.AllowedIPs), route)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateLiveness(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	wgPeer := testPeer("gw", nil, "10.0.0.1/24")
+	wgPeer.Spec.PublicKey = key.PublicKey().String()
+	now := time.Unix(1000000, 0)
+	pt := &peerTracker{
+		ll:       logrus.New(),
+		registry: testRegistry(wgPeer),
+		now:      func() time.Time { return now },
+	}
+	steps := []struct {
+		advance      time.Duration
+		tx           int64
+		handshakeAgo time.Duration
+		expectDown   bool
+	}{
+		{},
+		// Idle.
+		{advance: time.Minute},
+		// Sending with a fresh handshake.
+		{advance: 5 * time.Second, tx: 100, handshakeAgo: time.Second},
+		// Sending without one.
+		{advance: 4 * time.Minute, tx: 200, handshakeAgo: 4 * time.Minute},
+		{advance: 10 * time.Second, tx: 300, handshakeAgo: 4*time.Minute + 10*time.Second},
+		{advance: 10 * time.Second, tx: 400, handshakeAgo: 4*time.Minute + 20*time.Second, expectDown: true},
+		// Traffic stops once routes have moved, but the peer stays down until it handshakes.
+		{advance: time.Minute, tx: 400, handshakeAgo: 5*time.Minute + 20*time.Second, expectDown: true},
+		{advance: 5 * time.Second, tx: 400, handshakeAgo: time.Second},
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		devPeer := wgtypes.Peer{PublicKey: key.PublicKey(), TransmitBytes: s.tx}
+		if s.handshakeAgo > 0 {
+			devPeer.LastHandshakeTime = now.Add(-s.handshakeAgo)
+		}
+		wasDown := pt.isDown(wgPeer.GetSelfLink())
+		changed := pt.updateLiveness([]wgtypes.Peer{devPeer})
+		require.Equal(t, s.expectDown, pt.isDown(wgPeer.GetSelfLink()), "step %d", i)
+		require.Equal(t, wasDown != s.expectDown, changed, "step %d", i)
+	}
+
+	// Down peers are retried after staleHandshake.
+	pt.liveness[wgPeer.GetSelfLink()].down = now
+	now = now.Add(staleHandshake)
+	require.True(t, pt.updateLiveness([]wgtypes.Peer{{PublicKey: key.PublicKey(), TransmitBytes: 400}}))
+	require.False(t, pt.isDown(wgPeer.GetSelfLink()))
+}
+
+func TestPeerStale(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	wgPeer := testPeer("gw", nil, "10.0.0.1/24")
+	wgPeer.Spec.PublicKey = key.PublicKey().String()
+	now := time.Unix(1000000, 0)
+	var events eventBroadcaster
+	received, unsubscribe := events.subscribe()
+	defer unsubscribe()
+	pt := &peerTracker{
+		ll:               logrus.New(),
+		registry:         testRegistry(wgPeer),
+		now:              func() time.Time { return now },
+		events:           &events,
+		metrics:          newMetrics(),
+		handshakeTimeout: time.Minute,
+	}
+	endpoint := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	steps := []struct {
+		advance      time.Duration
+		tx           int64
+		handshakeAgo time.Duration
+		expectEvent  string
+	}{
+		{},
+		// Sending without a handshake for less than the timeout.
+		{advance: 5 * time.Second, tx: 100},
+		{advance: 30 * time.Second, tx: 200},
+		{advance: time.Minute, tx: 300, expectEvent: "stale"},
+		// Retrying the peer's routes doesn't end or repeat the staleness.
+		{advance: staleHandshake, tx: 300},
+		{advance: 5 * time.Second, tx: 400},
+		{advance: time.Minute, tx: 500},
+		{advance: 5 * time.Second, tx: 600, handshakeAgo: time.Second, expectEvent: "recovered"},
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		devPeer := wgtypes.Peer{PublicKey: key.PublicKey(), TransmitBytes: s.tx, Endpoint: endpoint}
+		if s.handshakeAgo > 0 {
+			devPeer.LastHandshakeTime = now.Add(-s.handshakeAgo)
+		}
+		pt.updateLiveness([]wgtypes.Peer{devPeer})
+		select {
+		case e := <-received:
+			require.Equal(t, s.expectEvent, e.Type, "step %d", i)
+			require.Equal(t, "gw", e.Peer)
+			require.Contains(t, e.Changes, "endpoint: 192.0.2.1:51820")
+		default:
+			require.Empty(t, s.expectEvent, "step %d", i)
+		}
+		stale := 0.0
+		if s.expectEvent == "stale" {
+			stale = 1
+		}
+		if s.expectEvent != "" {
+			require.Equal(t, stale, testutil.ToFloat64(pt.metrics.stale.WithLabelValues("gw")), "step %d", i)
+		}
+	}
+	require.Equal(t, 1.0, testutil.ToFloat64(pt.metrics.staleTotal.WithLabelValues("gw")))
+	require.Equal(t, float64(now.Add(-time.Second).Unix()),
+		testutil.ToFloat64(pt.metrics.lastHandshake.WithLabelValues("gw")))
+
+	pt.forget(wgPeer)
+	require.Equal(t, 0.0, testutil.ToFloat64(pt.metrics.staleTotal.WithLabelValues("gw")))
+}
+
+func TestSplitPrefix(t *testing.T) {
+	tcs := []struct {
+		prefix string
+		count  int
+		expect []string
+	}{
+		{prefix: "10.0.0.0/8", count: 1, expect: []string{"10.0.0.0/8"}},
+		{prefix: "10.0.0.0/8", count: 2, expect: []string{"10.0.0.0/9", "10.128.0.0/9"}},
+		{prefix: "10.0.0.0/8", count: 3, expect: []string{
+			"10.0.0.0/12", "10.16.0.0/12", "10.32.0.0/12", "10.48.0.0/12",
+			"10.64.0.0/12", "10.80.0.0/12", "10.96.0.0/12", "10.112.0.0/12",
+			"10.128.0.0/12", "10.144.0.0/12", "10.160.0.0/12", "10.176.0.0/12",
+			"10.192.0.0/12", "10.208.0.0/12", "10.224.0.0/12", "10.240.0.0/12",
+		}},
+		{prefix: "fd00::/64", count: 4, expect: []string{"fd00::/66", "fd00::4000:0:0:0/66", "fd00::8000:0:0:0/66", "fd00::c000:0:0:0/66"}},
+		{prefix: "10.0.0.1/32", count: 2, expect: []string{"10.0.0.1/32"}},
+	}
+	for _, tc := range tcs {
+		_, n, err := net.ParseCIDR(tc.prefix)
+		require.NoError(t, err)
+		var out []string
+		for _, p := range splitPrefix(*n, tc.count) {
+			out = append(out, p.String())
+		}
+		require.Equal(t, tc.expect, out, "%s/%d", tc.prefix, tc.count)
+	}
+}
+
+func TestPeerTrackerECMP(t *testing.T) {
+	pt := &peerTracker{
+		ll:        logrus.New(),
+		registry:  newPeerStore(),
+		localPeer: testPeer("local", nil, "10.0.0.9/24"),
+		liveness:  make(map[string]*peerLiveness),
+		ecmp:      true,
+	}
+	for i, name := range []string{"gw-a", "gw-b", "gw-c", "backup"} {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		p := testPeer(name, nil, []string{"10.0.0.1/24", "10.0.0.2/24", "10.0.0.3/24", "10.0.0.4/24"}[i])
+		p.Spec.PublicKey = key.PublicKey().String()
+		p.Spec.Endpoint = "192.0.2.1:51820"
+		p.Spec.Routes = []string{"192.168.0.0/16"}
+		p.Spec.RoutePriority = 10
+		require.NoError(t, pt.registry.Add(p))
+	}
+	pt.registryPeer("/backup").Spec.RoutePriority = 0
+
+	desired := pt.desiredPeers()
+	require.Equal(t, []string{"10.0.0.4/32"}, ipNetStrings(desired["/backup"].AllowedIPs))
+	// 16 parts, plus each gateway's address; the first gets the remainder.
+	expectLen := map[string]int{"/gw-a": 7, "/gw-b": 6, "/gw-c": 6}
+	for name, l := range expectLen {
+		require.Len(t, desired[name].AllowedIPs, l, name)
+	}
+
+	// Parts are withdrawn from down peers.
+	pt.liveness["/gw-b"] = &peerLiveness{down: time.Unix(1000000, 0)}
+	desired = pt.desiredPeers()
+	require.Equal(t, []string{"10.0.0.2/32"}, ipNetStrings(desired["/gw-b"].AllowedIPs))
+	require.Equal(t, []string{"10.0.0.1/32", "192.168.0.0/17"}, ipNetStrings(desired["/gw-a"].AllowedIPs))
+	require.Equal(t, []string{"10.0.0.3/32", "192.168.128.0/17"}, ipNetStrings(desired["/gw-c"].AllowedIPs))
+}
+
+func TestIsRouted(t *testing.T) {
+	pt := &peerTracker{routed: map[string]bool{"10.0.0.0/24": true}}
+	_, routed, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+	_, other, err := net.ParseCIDR("10.0.1.0/24")
+	require.NoError(t, err)
+	require.True(t, pt.isRouted(*routed))
+	require.False(t, pt.isRouted(*other), "routes we removed aren't restored")
+}
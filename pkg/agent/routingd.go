@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/jcodybaker/wgmesh/pkg/routingd"
+)
+
+// routingDaemonInterval is how often the mesh's routes are exported to the routing daemon.
+const routingDaemonInterval = 10 * time.Second
+
+// exportRoutingDaemonRoutes periodically exports the mesh's routes to the routing daemon, until the
+// context is canceled.
+func (a *Agent) exportRoutingDaemonRoutes(ctx context.Context) error {
+	// A retried start reuses the routes of the failed attempt.
+	if a.routingd == nil {
+		d, err := routingd.New(a.routingDaemon, a.iface.GetName(), a.birdConfig)
+		if err != nil {
+			return fmt.Errorf("exporting routes to %s: %w", a.routingDaemon, err)
+		}
+		a.routingd = d
+	}
+	d := a.routingd
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := d.Sync(a.peerTracker.meshRoutes(false))
+			if err != nil {
+				a.ll.WithError(err).WithField("daemon", a.routingDaemon).Error("failed to export routes to routing daemon")
+			}
+		}, routingDaemonInterval, ctx.Done())
+	}()
+	return nil
+}
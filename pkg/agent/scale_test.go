@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/interfaces/interfacestest"
+)
+
+// benchSizes are the fleet sizes the scale benchmarks run at.
+var benchSizes = []int{1000, 10000}
+
+// benchTracker returns a peer tracker holding n peers, as the informer's store would, and the peers.
+func benchTracker(b *testing.B, n int) (*peerTracker, []*wgk8s.WireGuardPeer) {
+	ll := logrus.New()
+	ll.Out = ioutil.Discard
+	pt := &peerTracker{
+		ll:        ll,
+		registry:  newPeerStore(),
+		applied:   make(map[string]wgtypes.PeerConfig),
+		localPeer: testPeer("local", nil, "10.255.255.254/32"),
+	}
+	peers := make([]*wgk8s.WireGuardPeer, n)
+	for i := range peers {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			b.Fatal(err)
+		}
+		p := testPeer(fmt.Sprintf("peer-%d", i), map[string]string{"zone": strconv.Itoa(i % 8)},
+			fmt.Sprintf("10.%d.%d.%d/32", i>>16&0xff, i>>8&0xff, i&0xff))
+		p.ResourceVersion = "1"
+		p.Spec.PublicKey = k.PublicKey().String()
+		p.Spec.Endpoint = fmt.Sprintf("192.0.2.%d:%d", i%250+1, 51820+i/250)
+		p.Spec.KeepAliveSeconds = 25
+		if err := pt.storePeer(p); err != nil {
+			b.Fatal(err)
+		}
+		peers[i] = p
+	}
+	return pt, peers
+}
+
+// BenchmarkResyncRedelivery measures the informer redelivering every peer unchanged, as it does each
+// resync period.
+func BenchmarkResyncRedelivery(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			pt, peers := benchTracker(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, p := range peers {
+					pt.OnUpdate(p, p)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPeerChurn measures updating a single peer's spec in a large fleet, and syncing it to the
+// interface.
+func BenchmarkPeerChurn(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			pt, peers := benchTracker(b, n)
+			pt.iface = interfacestest.NewWireGuardInterface("wg0")
+			if err := pt.applyInitialConfig(); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				old := peers[i%n]
+				p := old.DeepCopy()
+				p.ResourceVersion = strconv.Itoa(i + 2)
+				p.Spec.Routes = []string{fmt.Sprintf("172.16.%d.0/24", i%256)}
+				if err := pt.registry.Update(p); err != nil {
+					b.Fatal(err)
+				}
+				pt.OnUpdate(old, p)
+				peers[i%n] = p
+			}
+		})
+	}
+}
+
+// BenchmarkDesiredPeers measures building the full desired config, as each sync and resync does.
+func BenchmarkDesiredPeers(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			pt, _ := benchTracker(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pt.Lock()
+				desired := pt.desiredPeers()
+				pt.Unlock()
+				if len(desired) != n {
+					b.Fatalf("expected %d desired peers, got %d", n, len(desired))
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDeviceDelta measures diffing a large device which is already configured as desired.
+func BenchmarkDeviceDelta(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			pt, _ := benchTracker(b, n)
+			desired := pt.desiredPeers()
+			devPeers := make([]wgtypes.Peer, 0, len(desired))
+			for _, c := range desired {
+				devPeers = append(devPeers, wgtypes.Peer{
+					PublicKey:                   c.PublicKey,
+					Endpoint:                    c.Endpoint,
+					AllowedIPs:                  c.AllowedIPs,
+					PersistentKeepaliveInterval: *c.PersistentKeepaliveInterval,
+				})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if delta := deviceDelta(devPeers, desired, desired); len(delta) != 0 {
+					b.Fatalf("expected no delta, got %d peers", len(delta))
+				}
+			}
+		})
+	}
+}
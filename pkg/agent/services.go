@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// serviceExportInterval is how often exported Services are checked for changes.
+const serviceExportInterval = 30 * time.Second
+
+// exportServices periodically publishes the local cluster's exported Services, and routes to their
+// addresses, until the context is canceled.
+func (a *Agent) exportServices(ctx context.Context) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		wait.Until(func() {
+			err := a.exportServicesOnce()
+			if err != nil {
+				a.ll.WithError(err).Error("failed to export services")
+			}
+		}, serviceExportInterval, ctx.Done())
+	}()
+}
+
+func (a *Agent) exportServicesOnce() error {
+	if a.localCS == nil {
+		return fmt.Errorf("exporting services requires a local kubeconfig")
+	}
+	list, err := a.localCS.CoreV1().Services(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing services: %w", err)
+	}
+	services := exportedServices(list.Items, a.serviceSelector, a.clusterDomain)
+	routes := serviceRoutes(a.offeredRoutes(), services)
+	return a.publishLocalPeerSpec(func(spec *wgk8s.WireGuardPeerSpec) bool {
+		if reflect.DeepEqual(spec.Services, services) && reflect.DeepEqual(spec.Routes, routes) {
+			return false
+		}
+		a.ll.WithField("services", len(services)).Infoln("exported services changed")
+		spec.Services = services
+		spec.Routes = routes
+		return true
+	})
+}
+
+// exportedServices returns the services which are annotated for export, or which match the
+// selector, sorted by name. Services without addresses, ex. headless services, are skipped.
+func exportedServices(services []corev1.Service, selector labels.Selector, clusterDomain string) []wgk8s.ExportedService {
+	var out []wgk8s.ExportedService
+	for i := range services {
+		svc := &services[i]
+		exported := svc.GetAnnotations()[wgk8s.ServiceExportAnnotation] == "true" ||
+			(selector != nil && selector.Matches(labels.Set(svc.GetLabels())))
+		if !exported {
+			continue
+		}
+		ips := serviceIPs(svc)
+		if len(ips) == 0 {
+			continue
+		}
+		out = append(out, wgk8s.ExportedService{
+			Name: fmt.Sprintf("%s.%s.svc.%s", svc.GetName(), svc.GetNamespace(), clusterDomain),
+			IPs:  ips,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// serviceIPs returns the service's cluster IP and load balancer IPs.
+func serviceIPs(svc *corev1.Service) []string {
+	var ips []string
+	seen := make(map[string]struct{})
+	add := func(s string) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return
+		}
+		if _, ok := seen[ip.String()]; ok {
+			return
+		}
+		seen[ip.String()] = struct{}{}
+		ips = append(ips, ip.String())
+	}
+	if svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		add(svc.Spec.ClusterIP)
+	}
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		add(ingress.IP)
+	}
+	return ips
+}
+
+// serviceRoutes returns the offered routes followed by a host route to each service address which
+// they don't already cover.
+func serviceRoutes(offerRoutes []string, services []wgk8s.ExportedService) []string {
+	routes := append([]string(nil), offerRoutes...)
+	var covering []*net.IPNet
+	for _, r := range offerRoutes {
+		if _, cidr, err := net.ParseCIDR(r); err == nil {
+			covering = append(covering, cidr)
+		}
+	}
+	seen := make(map[string]struct{})
+	for _, svc := range services {
+	ips:
+		for _, s := range svc.IPs {
+			ip := net.ParseIP(s)
+			for _, cidr := range covering {
+				if cidr.Contains(ip) {
+					continue ips
+				}
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			route := (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}).String()
+			if _, ok := seen[route]; ok {
+				continue
+			}
+			seen[route] = struct{}{}
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
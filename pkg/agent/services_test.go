@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func testService(namespace, name, clusterIP string, annotated bool, lbIPs ...string) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{"app": name},
+		},
+		Spec: corev1.ServiceSpec{ClusterIP: clusterIP},
+	}
+	if annotated {
+		svc.Annotations = map[string]string{wgk8s.ServiceExportAnnotation: "true"}
+	}
+	for _, ip := range lbIPs {
+		svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+	}
+	return svc
+}
+
+func TestExportedServices(t *testing.T) {
+	services := []corev1.Service{
+		*testService("default", "web", "10.96.0.10", true, "203.0.113.5", "10.96.0.10"),
+		*testService("default", "private", "10.96.0.11", false),
+		*testService("db", "postgres", "10.96.0.12", false),
+		*testService("default", "headless", corev1.ClusterIPNone, true),
+	}
+	require.Equal(t, []wgk8s.ExportedService{
+		{Name: "web.default.svc.cluster.local", IPs: []string{"10.96.0.10", "203.0.113.5"}},
+	}, exportedServices(services, nil, "cluster.local"))
+
+	selector := labels.SelectorFromSet(labels.Set{"app": "postgres"})
+	require.Equal(t, []wgk8s.ExportedService{
+		{Name: "postgres.db.svc.example.com", IPs: []string{"10.96.0.12"}},
+		{Name: "web.default.svc.example.com", IPs: []string{"10.96.0.10", "203.0.113.5"}},
+	}, exportedServices(services, selector, "example.com"))
+}
+
+func TestServiceRoutes(t *testing.T) {
+	services := []wgk8s.ExportedService{
+		{Name: "a", IPs: []string{"10.96.0.10", "203.0.113.5"}},
+		{Name: "b", IPs: []string{"10.96.0.10", "fd00::10"}},
+		{Name: "c", IPs: []string{"192.168.1.5"}},
+	}
+	require.Equal(t,
+		[]string{"192.168.0.0/16", "10.96.0.10/32", "203.0.113.5/32", "fd00::10/128"},
+		serviceRoutes([]string{"192.168.0.0/16"}, services))
+}
+
+func TestExportServicesOnce(t *testing.T) {
+	a := &Agent{options: defaultOptions()}
+	a.ll = logrus.New()
+	a.name = "gateway"
+	a.registryNamespace = "ns"
+	a.offerRoutes = []string{"10.244.0.0/16"}
+	a.localCS = kubefake.NewSimpleClientset(testService("default", "web", "10.96.0.10", true))
+	a.localPeer = &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "gateway"},
+		Spec:       wgk8s.WireGuardPeerSpec{Routes: a.offerRoutes},
+	}
+	a.registry = registry.NewKubernetes(fake.NewSimpleClientset(a.localPeer), "ns")
+
+	require.NoError(t, a.exportServicesOnce())
+	peer, err := a.registry.Get("gateway")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.244.0.0/16", "10.96.0.10/32"}, peer.Spec.Routes)
+	require.Equal(t, []wgk8s.ExportedService{
+		{Name: "web.default.svc.cluster.local", IPs: []string{"10.96.0.10"}},
+	}, peer.Spec.Services)
+
+	// Unexporting the service withdraws its route.
+	require.NoError(t, a.localCS.CoreV1().Services("default").Delete("web", nil))
+	require.NoError(t, a.exportServicesOnce())
+	peer, err = a.registry.Get("gateway")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.244.0.0/16"}, peer.Spec.Routes)
+	require.Empty(t, peer.Spec.Services)
+}
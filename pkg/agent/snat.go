@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+const (
+	// snatChainPrefix names the mangle and nat table chains holding an interface's SNAT rules.
+	snatChainPrefix = "WGMESH-SNAT-"
+	// snatMark marks packets forwarded from the mesh to SNAT routes, so they're masqueraded in
+	// POSTROUTING, where the interface they arrived on is no longer known.
+	snatMark = "0x10000/0x10000"
+)
+
+// snatter maintains firewall rules which source NAT traffic forwarded from the mesh into routes to
+// the address of the interface it leaves through, ex. the gateway's LAN address, for networks
+// which can't be given a return route to the mesh. Packets are marked in a chain of the mangle
+// table, jumped to from FORWARD, and masqueraded in a chain of the nat table, jumped to from
+// POSTROUTING, per family.
+type snatter struct {
+	iface string
+	// run runs an iptables command, returning its combined output.
+	run func(cmd string, args ...string) ([]byte, error)
+	// installed holds the families, by iptables command, whose chains are installed.
+	installed map[string]bool
+}
+
+func newSNATter(iface string) *snatter {
+	return &snatter{
+		iface: iface,
+		run: func(cmd string, args ...string) ([]byte, error) {
+			return exec.Command(cmd, args...).CombinedOutput()
+		},
+		installed: make(map[string]bool),
+	}
+}
+
+func (s *snatter) chain() string {
+	return snatChainPrefix + s.iface
+}
+
+func (s *snatter) iptables(cmd string, args ...string) error {
+	return runIPTables(s.run, cmd, args...)
+}
+
+// install installs the rules for routes, which must be CIDRs, replacing any left by a previous run.
+func (s *snatter) install(routes []string) error {
+	byCmd := make(map[string][]string)
+	for _, r := range routes {
+		ip, _, err := net.ParseCIDR(r)
+		if err != nil {
+			return fmt.Errorf("snat for route %q: %w", r, err)
+		}
+		cmd := "iptables"
+		if ip.To4() == nil {
+			cmd = "ip6tables"
+		}
+		byCmd[cmd] = append(byCmd[cmd], r)
+	}
+	for cmd, routes := range byCmd {
+		if err := s.installChains(cmd, routes); err != nil {
+			return err
+		}
+		s.installed[cmd] = true
+	}
+	return nil
+}
+
+// installChains replaces the rules in the family's chains with those for routes.
+func (s *snatter) installChains(cmd string, routes []string) error {
+	chain := s.chain()
+	for _, table := range []string{"mangle", "nat"} {
+		// Creating the chain fails if it exists, ex. left by a previous run, which flushing handles.
+		s.run(cmd, "-w", "-t", table, "-N", chain)
+		if err := s.iptables(cmd, "-t", table, "-F", chain); err != nil {
+			return err
+		}
+	}
+	for _, r := range routes {
+		err := s.iptables(cmd, "-t", "mangle", "-A", chain, "-i", s.iface, "-d", r, "-j", "MARK", "--set-xmark", snatMark)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.iptables(cmd, "-t", "nat", "-A", chain, "-m", "mark", "--mark", snatMark, "-j", "MASQUERADE")
+	if err != nil {
+		return err
+	}
+	for _, jump := range [][]string{{"mangle", "FORWARD"}, {"nat", "POSTROUTING"}} {
+		if s.iptables(cmd, "-t", jump[0], "-C", jump[1], "-j", chain) == nil {
+			continue
+		}
+		if err := s.iptables(cmd, "-t", jump[0], "-A", jump[1], "-j", chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes the chains we installed, and the jumps to them.
+func (s *snatter) remove() error {
+	chain := s.chain()
+	for cmd := range s.installed {
+		for _, jump := range [][]string{{"mangle", "FORWARD"}, {"nat", "POSTROUTING"}} {
+			if err := s.iptables(cmd, "-t", jump[0], "-D", jump[1], "-j", chain); err != nil {
+				return err
+			}
+			if err := s.iptables(cmd, "-t", jump[0], "-F", chain); err != nil {
+				return err
+			}
+			if err := s.iptables(cmd, "-t", jump[0], "-X", chain); err != nil {
+				return err
+			}
+		}
+		delete(s.installed, cmd)
+	}
+	return nil
+}
+
+// installSNAT installs the rules source NATing traffic forwarded from the mesh into the SNAT routes.
+func (a *Agent) installSNAT() error {
+	// A retried start reuses, and reinstalls, the rules of the failed attempt.
+	if a.snat == nil {
+		a.snat = newSNATter(a.iface.GetName())
+	}
+	if err := a.snat.install(a.snatRoutes); err != nil {
+		return fmt.Errorf("installing snat rules: %w", err)
+	}
+	a.ll.WithField("routes", a.snatRoutes).Info("source NATing mesh traffic into routes")
+	return nil
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSNATter(t *testing.T) {
+	var cmds []string
+	// chains holds the chains which exist, by command and table.
+	chains := map[string]bool{}
+	s := newSNATter("wg0")
+	s.run = func(cmd string, args ...string) ([]byte, error) {
+		line := cmd + " " + strings.Join(args, " ")
+		cmds = append(cmds, line)
+		key := cmd + " " + args[2]
+		switch {
+		case strings.Contains(line, " -N "):
+			if chains[key] {
+				return []byte("Chain already exists."), errors.New("exit status 1")
+			}
+			chains[key] = true
+		case strings.Contains(line, " -X "):
+			delete(chains, key)
+		case strings.Contains(line, " -C "):
+			return []byte("Bad rule"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}
+
+	require.NoError(t, s.install([]string{"192.168.1.0/24"}))
+	require.Equal(t, []string{
+		"iptables -w -t mangle -N WGMESH-SNAT-wg0",
+		"iptables -w -t mangle -F WGMESH-SNAT-wg0",
+		"iptables -w -t nat -N WGMESH-SNAT-wg0",
+		"iptables -w -t nat -F WGMESH-SNAT-wg0",
+		"iptables -w -t mangle -A WGMESH-SNAT-wg0 -i wg0 -d 192.168.1.0/24 -j MARK --set-xmark 0x10000/0x10000",
+		"iptables -w -t nat -A WGMESH-SNAT-wg0 -m mark --mark 0x10000/0x10000 -j MASQUERADE",
+		"iptables -w -t mangle -C FORWARD -j WGMESH-SNAT-wg0",
+		"iptables -w -t mangle -A FORWARD -j WGMESH-SNAT-wg0",
+		"iptables -w -t nat -C POSTROUTING -j WGMESH-SNAT-wg0",
+		"iptables -w -t nat -A POSTROUTING -j WGMESH-SNAT-wg0",
+	}, cmds)
+
+	cmds = nil
+	require.NoError(t, s.install([]string{"192.168.1.0/24", "fd00:1::/64"}), "a retried install replaces the rules")
+	require.Contains(t, cmds, "ip6tables -w -t mangle -A WGMESH-SNAT-wg0 -i wg0 -d fd00:1::/64 -j MARK --set-xmark 0x10000/0x10000")
+	require.Contains(t, cmds, "iptables -w -t mangle -F WGMESH-SNAT-wg0")
+	require.Len(t, chains, 4)
+
+	require.NoError(t, s.remove())
+	require.Empty(t, chains)
+	require.Empty(t, s.installed)
+
+	require.EqualError(t, s.install([]string{"bogus"}), `snat for route "bogus": invalid CIDR address: bogus`)
+	s.run = func(cmd string, args ...string) ([]byte, error) {
+		return []byte("iptables: No chain/target/match by that name."), errors.New("exit status 1")
+	}
+	require.EqualError(t, s.install([]string{"192.168.1.0/24"}),
+		"running iptables -w -t mangle -F WGMESH-SNAT-wg0: exit status 1: iptables: No chain/target/match by that name.")
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// initRetryBase and initRetryCap bound the delay between attempts to start the agent.
+const (
+	initRetryBase = time.Second
+	initRetryCap  = time.Minute
+)
+
+// superviseStart starts the agent, retrying attempts which fail with transient errors, ex. a node
+// booting faster than its network, with backoff. A failed attempt's goroutines are stopped before
+// the next begins; what it set up, ex. the interface and the registered peer, is reused.
+func (a *Agent) superviseStart(ctx context.Context) error {
+	backoff := wait.Backoff{Duration: initRetryBase, Factor: 2, Jitter: 0.1, Steps: math.MaxInt32, Cap: initRetryCap}
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		err := a.start(attemptCtx)
+		if err == nil {
+			a.stop = cancel
+			return nil
+		}
+		cancel()
+		a.wg.Wait()
+		// Mesh changes wait for the next attempt's peers.
+		a.meshLock.Lock()
+		a.meshUpdates = false
+		a.meshLock.Unlock()
+		if ctx.Err() != nil || !transientError(err) {
+			return err
+		}
+		if a.initAttempts > 0 && attempt >= a.initAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		delay := backoff.Step()
+		a.ll.WithError(err).WithFields(log.Fields{
+			"attempt":  attempt,
+			"retry_in": delay.String(),
+		}).Warn("failed to start agent; retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// transientError returns true if err may clear up on its own, ex. the registry or kube apiserver
+// is unreachable or overloaded, or the interface is busy. Other errors, ex. from invalid
+// configuration or missing permissions, won't be fixed by retrying.
+func transientError(err error) bool {
+	var status k8sErrors.APIStatus
+	if errors.As(err, &status) {
+		code := status.Status().Code
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EBUSY, syscall.EAGAIN, syscall.ENETUNREACH, syscall.EHOSTUNREACH,
+			syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ETIMEDOUT, syscall.EADDRNOTAVAIL:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
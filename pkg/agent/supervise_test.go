@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestTransientError(t *testing.T) {
+	gr := schema.GroupResource{Group: "wgmesh.codybaker.com", Resource: "wireguardpeers"}
+	refused := &url.Error{Op: "Get", URL: "https://registry", Err: &net.OpError{
+		Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+	}}
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{fmt.Errorf("listing Meshes: %w", refused), true},
+		{fmt.Errorf("listing Meshes: %w", k8sErrors.NewServiceUnavailable("etcd down")), true},
+		{k8sErrors.NewTooManyRequests("slow down", 1), true},
+		{fmt.Errorf("creating interface: %w", syscall.EBUSY), true},
+		{&net.DNSError{Err: "no such host", Name: "registry"}, true},
+		{fmt.Errorf("registering: %w", k8sErrors.NewForbidden(gr, "a", errors.New("rbac"))), false},
+		{k8sErrors.NewUnauthorized("bad token"), false},
+		{fmt.Errorf("creating interface: %w", syscall.EPERM), false},
+		{errors.New("existing k8s WireGuardPeer had endpoint"), false},
+	} {
+		require.Equal(t, tc.transient, transientError(tc.err), tc.err.Error())
+	}
+}
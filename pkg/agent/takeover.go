@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	wgmeshScheme "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/scheme"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+const (
+	agentComponent  = "wgmesh-agent"
+	reasonTakenOver = "TakenOver"
+)
+
+// newEventRecorder returns a recorder which publishes events in the namespace, from the agent on
+// host, until the returned sink is stopped.
+func newEventRecorder(cs kubernetes.Interface, namespace, host string) (watch.Interface, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster()
+	sink := broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events(namespace)})
+	return sink, broadcaster.NewRecorder(wgmeshScheme.Scheme, corev1.EventSource{Component: agentComponent, Host: host})
+}
+
+// takeOverK8sLocalPeer claims an existing record of our name which was published with another
+// endpoint, ex. by a node rebuilt with the same hostname on a new address. The record is left alone
+// for the grace period first; if its holder updates it in the meantime, it's likely still running,
+// and we fail rather than fight over the name. It returns the record to update, marked as taken
+// over, or nil if the record was deleted during the grace period.
+func (a *Agent) takeOverK8sLocalPeer(ctx context.Context, existing *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	a.ll.WithFields(log.Fields{
+		"existing_endpoint":   existing.Spec.Endpoint,
+		"existing_public_key": existing.Spec.PublicKey,
+		"grace_period":        a.takeoverGracePeriod.String(),
+	}).Warn("a WireGuardPeer with our name has another endpoint; taking it over after the grace period")
+	t := time.NewTimer(a.takeoverGracePeriod)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.C:
+	}
+
+	current, err := a.registry.Get(a.name)
+	if k8sErrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetching existing k8s WireGuardPeer object %q: %w", a.name, err)
+	}
+	if current.GetResourceVersion() != existing.GetResourceVersion() {
+		return nil, fmt.Errorf(
+			"existing k8s WireGuardPeer %q was updated during the %s takeover grace period; another peer may still be using the name",
+			a.name, a.takeoverGracePeriod)
+	}
+	annotations := current.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[wgk8s.TakenOverAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	current.SetAnnotations(annotations)
+	return current, nil
+}
+
+// recordTakeover reports that we took over the record from a holder with the previous spec.
+func (a *Agent) recordTakeover(peer *wgk8s.WireGuardPeer, previous wgk8s.WireGuardPeerSpec) {
+	msg := fmt.Sprintf("taken over from the peer at endpoint %q with public key %s", previous.Endpoint, previous.PublicKey)
+	a.ll.Warn("took over the existing WireGuardPeer; its previous holder will stop defending it")
+	a.audit.Record("registry.takeover", peer.GetName(),
+		fmt.Sprintf("endpoint: %s -> %s", previous.Endpoint, peer.Spec.Endpoint),
+		fmt.Sprintf("public key: %s -> %s", previous.PublicKey, peer.Spec.PublicKey))
+	if a.recorder != nil {
+		a.recorder.Event(peer, corev1.EventTypeWarning, reasonTakenOver, msg)
+	}
+}
+
+// nameConflict returns why existing, the registered record of our name, may belong to another
+// peer than desired, or "" if it appears to be ours. Peers with endpoints are told apart by them.
+// Peers without one, ex. client-only peers, are told apart by the host annotation; records without
+// it predate the annotation and are assumed to be ours.
+func nameConflict(existing, desired *wgk8s.WireGuardPeer) string {
+	if existing.Spec.Endpoint != desired.Spec.Endpoint {
+		return fmt.Sprintf("existing k8s WireGuardPeer had endpoint %q, we have %q",
+			existing.Spec.Endpoint, desired.Spec.Endpoint)
+	}
+	if desired.Spec.Endpoint != "" {
+		return ""
+	}
+	host := existing.GetAnnotations()[wgk8s.HostAnnotation]
+	if ours := desired.GetAnnotations()[wgk8s.HostAnnotation]; host != "" && host != ours {
+		return fmt.Sprintf("existing k8s WireGuardPeer without an endpoint was registered by host %q, we're %q", host, ours)
+	}
+	return ""
+}
+
+// updateK8sLocalPeerHost sets the host annotation identifying this host.
+func (a *Agent) updateK8sLocalPeerHost(peer *wgk8s.WireGuardPeer) {
+	if a.hostID == "" {
+		a.hostID = hostIdentity()
+	}
+	annotations := peer.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[wgk8s.HostAnnotation] = a.hostID
+	peer.SetAnnotations(annotations)
+}
+
+// hostIdentity returns an identifier for this host which survives restarts, derived from its
+// machine ID, or its hostname if it has none. The machine ID is hashed rather than published, as
+// it's meant to be kept private.
+func hostIdentity() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		b, err := ioutil.ReadFile(path)
+		if id := strings.TrimSpace(string(b)); err == nil && id != "" {
+			sum := sha256.Sum256([]byte("wgmesh:" + id))
+			return hex.EncodeToString(sum[:8])
+		}
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+)
+
+func TestRegisterK8sLocalPeerTakeover(t *testing.T) {
+	r, err := registry.NewMemory("ns", &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "local"},
+		Spec:       wgk8s.WireGuardPeerSpec{Endpoint: "192.168.1.1:51820", PublicKey: "old"},
+	})
+	require.NoError(t, err)
+	recorder := record.NewFakeRecorder(1)
+	a := &Agent{options: defaultOptions(), registry: r, recorder: recorder}
+	a.ll = logrus.New()
+	a.name = "local"
+	desired := func() *wgk8s.WireGuardPeer {
+		return &wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: "local"},
+			Spec:       wgk8s.WireGuardPeerSpec{Endpoint: "10.0.0.1:51820", PublicKey: "new"},
+		}
+	}
+
+	a.localPeer = desired()
+	require.Error(t, a.registerK8sLocalPeer(context.Background()), "the name is held by a peer with another endpoint")
+
+	a.forceTakeover = true
+	a.localPeer = desired()
+	require.NoError(t, a.registerK8sLocalPeer(context.Background()))
+	got, err := r.Get("local")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:51820", got.Spec.Endpoint)
+	require.Equal(t, "new", got.Spec.PublicKey)
+	require.NotEmpty(t, got.GetAnnotations()[wgk8s.TakenOverAnnotation])
+	require.Contains(t, <-recorder.Events, "TakenOver")
+}
+
+func TestRegisterK8sLocalPeerClientOnly(t *testing.T) {
+	r, err := registry.NewMemory("ns", &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "laptop",
+			Annotations: map[string]string{wgk8s.HostAnnotation: "other-host"},
+		},
+		Spec: wgk8s.WireGuardPeerSpec{PublicKey: "old"},
+	})
+	require.NoError(t, err)
+	a := &Agent{options: defaultOptions(), registry: r}
+	a.ll = logrus.New()
+	a.name = "laptop"
+	a.clientOnly = true
+	a.hostID = "this-host"
+	a.publicKey = wgtypes.Key{1}
+
+	a.updateK8sLocalPeer()
+	require.Error(t, a.registerK8sLocalPeer(context.Background()),
+		"the name is held by a client-only peer on another host, though neither has an endpoint")
+
+	// The same host re-registering, ex. after a restart which rekeyed it, isn't a conflict.
+	a.hostID = "other-host"
+	a.localPeer = nil
+	a.updateK8sLocalPeer()
+	require.NoError(t, a.registerK8sLocalPeer(context.Background()))
+	got, err := r.Get("laptop")
+	require.NoError(t, err)
+	require.Equal(t, a.publicKey.String(), got.Spec.PublicKey)
+	require.Equal(t, "other-host", got.GetAnnotations()[wgk8s.HostAnnotation])
+}
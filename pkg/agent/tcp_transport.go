@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/transport"
+)
+
+// tcpCandidatePrefix marks the endpoint candidate for a peer's TCP endpoint.
+const tcpCandidatePrefix = "tcp://"
+
+// transportProcess is a running udp-over-tcp process.
+type transportProcess interface {
+	Exited() bool
+	Stop() error
+}
+
+// tcpTransports runs a udp2tcp client for each peer currently reached over TCP.
+type tcpTransports struct {
+	ll   log.FieldLogger
+	path string
+	// clients are keyed by the peer's public key.
+	clients map[string]*tcpClient
+	// start starts a client; tests replace it.
+	start func(path, remote string) (transportProcess, *net.UDPAddr, error)
+}
+
+type tcpClient struct {
+	remote string
+	local  *net.UDPAddr
+	proc   transportProcess
+}
+
+func newTCPTransports(ll log.FieldLogger, path string) *tcpTransports {
+	return &tcpTransports{
+		ll:   ll,
+		path: path,
+		start: func(path, remote string) (transportProcess, *net.UDPAddr, error) {
+			return transport.Client(path, remote)
+		},
+	}
+}
+
+// ensure returns the loopback address of the peer's client for remote, starting it if it isn't
+// running.
+func (t *tcpTransports) ensure(key, remote string) (*net.UDPAddr, error) {
+	if c, ok := t.clients[key]; ok {
+		if c.remote == remote && !c.proc.Exited() {
+			return c.local, nil
+		}
+		t.stop(key)
+	}
+	proc, local, err := t.start(t.path, remote)
+	if err != nil {
+		return nil, err
+	}
+	if t.clients == nil {
+		t.clients = make(map[string]*tcpClient)
+	}
+	t.ll.WithFields(log.Fields{"public_key": key, "tcp_endpoint": remote, "local": local.String()}).
+		Info("started udp2tcp for peer")
+	t.clients[key] = &tcpClient{remote: remote, local: local, proc: proc}
+	return local, nil
+}
+
+// prune stops the clients of peers which aren't in keep.
+func (t *tcpTransports) prune(keep map[string]bool) {
+	for key := range t.clients {
+		if !keep[key] {
+			t.stop(key)
+		}
+	}
+}
+
+func (t *tcpTransports) stop(key string) {
+	if err := t.clients[key].proc.Stop(); err != nil {
+		t.ll.WithError(err).WithField("public_key", key).Warn("failed to stop udp2tcp")
+	}
+	delete(t.clients, key)
+}
+
+// withTCPCandidate appends the peer's TCP endpoint, if any, to its candidates when TCP fallback is
+// enabled, so it's tried once the UDP candidates fail. The caller must hold the lock.
+func (pt *peerTracker) withTCPCandidate(wgPeer *wgk8s.WireGuardPeer, candidates []string) []string {
+	if pt.tcpFallback == nil || wgPeer.Spec.TCPEndpoint == "" {
+		return candidates
+	}
+	return append(candidates, tcpCandidatePrefix+wgPeer.Spec.TCPEndpoint)
+}
+
+// resolveCandidate returns the addresses of an endpoint candidate, in the order they're tried. A TCP
+// candidate's address is the loopback address of the peer's udp2tcp client. The caller must hold
+// the lock.
+func (pt *peerTracker) resolveCandidate(wgPeer *wgk8s.WireGuardPeer, candidate string) ([]*net.UDPAddr, error) {
+	if remote := strings.TrimPrefix(candidate, tcpCandidatePrefix); remote != candidate && pt.tcpFallback != nil {
+		local, err := pt.tcpFallback.ensure(wgPeer.Spec.PublicKey, remote)
+		if err != nil {
+			return nil, fmt.Errorf("starting udp2tcp: %w", err)
+		}
+		return []*net.UDPAddr{local}, nil
+	}
+	return pt.families.resolveAll(candidate)
+}
+
+// pruneTCPTransports stops the udp2tcp clients of peers which are gone or no longer use their TCP
+// candidate. The caller must hold the lock.
+func (pt *peerTracker) pruneTCPTransports() {
+	if pt.tcpFallback == nil {
+		return
+	}
+	keep := make(map[string]bool)
+	for name, wgPeer := range pt.listPeers() {
+		st, ok := pt.endpoints[name]
+		if ok && strings.HasPrefix(st.candidates[st.index], tcpCandidatePrefix) {
+			keep[wgPeer.Spec.PublicKey] = true
+		}
+	}
+	pt.tcpFallback.prune(keep)
+}
+
+// stopTCPTransports stops every udp2tcp client.
+func (pt *peerTracker) stopTCPTransports() {
+	pt.Lock()
+	defer pt.Unlock()
+	if pt.tcpFallback != nil {
+		pt.tcpFallback.prune(nil)
+	}
+}
+
+// tcpEndpoint returns the TCP endpoint published alongside the endpoint: its host with the TCP
+// transport port, or empty if the agent doesn't accept TCP.
+func (a *Agent) tcpEndpoint(endpoint string) string {
+	if a.tcpTransportPort == 0 || endpoint == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.tcpTransportPort))
+}
+
+// serveTCPTransport runs tcp2udp, forwarding TCP connections on the TCP transport port to the
+// WireGuard port, until the agent is closed.
+func (a *Agent) serveTCPTransport() error {
+	if a.tcpServer != nil && !a.tcpServer.Exited() {
+		// A retried start reuses the server of the failed attempt.
+		return nil
+	}
+	port, err := a.iface.GetListenPort()
+	if err != nil {
+		return fmt.Errorf("reading WireGuard listen port: %w", err)
+	}
+	listen := net.JoinHostPort("", strconv.Itoa(a.tcpTransportPort))
+	a.tcpServer, err = transport.Server(a.tcp2udpPath, listen, port)
+	if err != nil {
+		return fmt.Errorf("serving the TCP transport: %w", err)
+	}
+	a.ll.WithField("tcp_port", a.tcpTransportPort).Info("accepting WireGuard traffic over TCP")
+	return nil
+}
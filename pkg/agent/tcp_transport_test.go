@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeTransportProcess struct {
+	exited  bool
+	stopped bool
+}
+
+func (p *fakeTransportProcess) Exited() bool { return p.exited || p.stopped }
+
+func (p *fakeTransportProcess) Stop() error {
+	p.stopped = true
+	return nil
+}
+
+func TestTCPFallback(t *testing.T) {
+	const (
+		udp   = "203.0.113.1:51820"
+		tcp   = "203.0.113.1:443"
+		local = "127.0.0.1:40000"
+	)
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	wgPeer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "peer", Namespace: "ns", SelfLink: "/peer"},
+		Spec: wgk8s.WireGuardPeerSpec{
+			PublicKey:   key.PublicKey().String(),
+			Endpoint:    udp,
+			TCPEndpoint: tcp,
+		},
+	}
+	now := time.Unix(1000000, 0)
+	var procs []*fakeTransportProcess
+	transports := newTCPTransports(logrus.New(), "")
+	transports.start = func(path, remote string) (transportProcess, *net.UDPAddr, error) {
+		require.Equal(t, tcp, remote)
+		p := &fakeTransportProcess{}
+		procs = append(procs, p)
+		return p, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}, nil
+	}
+	pt := &peerTracker{
+		ll:          logrus.New(),
+		registry:    testRegistry(wgPeer),
+		now:         func() time.Time { return now },
+		tcpFallback: transports,
+	}
+	require.Equal(t, []string{udp, "tcp://" + tcp}, pt.endpointCandidates(wgPeer))
+
+	addr, err := pt.selectAddr(wgPeer)
+	require.NoError(t, err)
+	require.Equal(t, udp, addr.String(), "udp is tried first")
+	require.Empty(t, procs)
+
+	tx := int64(0)
+	stale := func() {
+		for i := 0; i < 4; i++ {
+			tx += 148
+			now = now.Add(15 * time.Second)
+			if configs := pt.failoverEndpoints([]wgtypes.Peer{{PublicKey: key.PublicKey(), TransmitBytes: tx}}); len(configs) > 0 {
+				addr = configs[0].Endpoint
+			}
+		}
+	}
+	stale()
+	require.Equal(t, local, addr.String(), "falls back to tcp")
+	require.Len(t, procs, 1)
+
+	// A crashed client is restarted when the endpoint is resolved again.
+	procs[0].exited = true
+	pt.endpoints[wgPeer.GetSelfLink()].addrs = nil
+	addr, err = pt.selectAddr(wgPeer)
+	require.NoError(t, err)
+	require.Equal(t, local, addr.String())
+	require.Len(t, procs, 2)
+
+	stale()
+	require.Equal(t, udp, addr.String(), "wraps around to udp")
+	require.True(t, procs[1].stopped, "the client is stopped once it's not used")
+	require.Empty(t, transports.clients)
+
+	pt.tcpFallback = nil
+	require.Equal(t, []string{udp}, pt.endpointCandidates(wgPeer), "tcp endpoints are ignored without fallback")
+}
+
+func TestTCPEndpoint(t *testing.T) {
+	a := &Agent{}
+	require.Empty(t, a.tcpEndpoint("vpn.example.com:51820"))
+	a.tcpTransportPort = 443
+	require.Equal(t, "vpn.example.com:443", a.tcpEndpoint("vpn.example.com:51820"))
+	require.Equal(t, "[2001:db8::1]:443", a.tcpEndpoint("[2001:db8::1]:51820"))
+	require.Empty(t, a.tcpEndpoint(""), "client-only")
+}
@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// topology decides which peers connect directly. The zero value is a full mesh.
+type topology struct {
+	// hubs selects the hubs of a hub-and-spoke topology. Hubs connect to every peer, while leaves
+	// only connect to hubs and reach other leaves through them. In a zoned topology, hubs selects
+	// the gateways of each zone.
+	hubs labels.Selector
+	// zoned fully meshes the peers within each zone, and carries traffic between zones through the
+	// zones' gateways.
+	zoned bool
+}
+
+// meshTopology returns the topology configured by the Mesh, which may be nil.
+func meshTopology(mesh *wgk8s.Mesh) (topology, error) {
+	if mesh == nil {
+		return topology{}, nil
+	}
+	switch mesh.Spec.Topology {
+	case "", wgk8s.TopologyFullMesh:
+		return topology{}, nil
+	case wgk8s.TopologyHubAndSpoke, wgk8s.TopologyZoned:
+		if mesh.Spec.HubSelector == nil {
+			return topology{}, fmt.Errorf("topology %s requires a hubSelector", mesh.Spec.Topology)
+		}
+		hubs, err := metav1.LabelSelectorAsSelector(mesh.Spec.HubSelector)
+		if err != nil {
+			return topology{}, fmt.Errorf("parsing hubSelector: %w", err)
+		}
+		return topology{hubs: hubs, zoned: mesh.Spec.Topology == wgk8s.TopologyZoned}, nil
+	default:
+		return topology{}, fmt.Errorf("unsupported topology %q", mesh.Spec.Topology)
+	}
+}
+
+func (t topology) equal(other topology) bool {
+	if t.zoned != other.zoned {
+		return false
+	}
+	if t.hubs == nil || other.hubs == nil {
+		return t.hubs == nil && other.hubs == nil
+	}
+	return t.hubs.String() == other.hubs.String()
+}
+
+// isHub returns true if the peer is a hub. In a full mesh, every peer is effectively a hub.
+func (t topology) isHub(wgPeer *wgk8s.WireGuardPeer) bool {
+	return t.hubs == nil || t.hubs.Matches(labels.Set(wgPeer.GetLabels()))
+}
+
+// plan returns the keys of the peers which the local peer connects to directly and, keyed by hub,
+// the keys of the leaves it reaches through each hub. Leaves connect directly to every peer while
+// there are no hubs, so the mesh keeps working until hubs are added.
+func (t topology) plan(local *wgk8s.WireGuardPeer, peers map[string]*wgk8s.WireGuardPeer) (map[string]struct{}, map[string][]string) {
+	if t.zoned {
+		return t.planZoned(local, peers)
+	}
+	direct := make(map[string]struct{}, len(peers))
+	var hubs []string
+	for key, p := range peers {
+		if t.isHub(p) {
+			hubs = append(hubs, key)
+		}
+	}
+	if t.isHub(local) || len(hubs) == 0 {
+		for key := range peers {
+			direct[key] = struct{}{}
+		}
+		return direct, nil
+	}
+	sort.Slice(hubs, func(i, j int) bool { return peers[hubs[i]].GetName() < peers[hubs[j]].GetName() })
+	via := make(map[string][]string)
+	for _, key := range hubs {
+		direct[key] = struct{}{}
+	}
+	for key, p := range peers {
+		if _, ok := direct[key]; ok {
+			continue
+		}
+		hub := hubs[pairHash(local.GetName(), p.GetName())%uint32(len(hubs))]
+		via[hub] = append(via[hub], key)
+	}
+	return direct, via
+}
+
+// planZoned plans a zoned topology. Peers connect directly within their zone, and gateways connect
+// directly to the other zones' gateways. Every peer has a home gateway in its zone, which carries
+// its traffic to and from other zones: non-gateways route all other zones through their home
+// gateway, and gateways route each foreign non-gateway through that peer's home gateway. Routing by
+// home gateway means each hop agrees on the previous one, which WireGuard requires to accept a
+// packet's source address.
+func (t topology) planZoned(local *wgk8s.WireGuardPeer, peers map[string]*wgk8s.WireGuardPeer) (map[string]struct{}, map[string][]string) {
+	// The local peer isn't in peers, so it's keyed by the empty string.
+	all := map[string]*wgk8s.WireGuardPeer{"": local}
+	for key, p := range peers {
+		all[key] = p
+	}
+	gateways := make(map[string][]string)
+	for key, p := range all {
+		if t.hubs.Matches(labels.Set(p.GetLabels())) {
+			gateways[peerZone(p)] = append(gateways[peerZone(p)], key)
+		}
+	}
+	for _, keys := range gateways {
+		sort.Slice(keys, func(i, j int) bool { return all[keys[i]].GetName() < all[keys[j]].GetName() })
+	}
+	// homeGateway returns the key of the peer's home gateway. Peers in a zone without gateways are
+	// their own.
+	homeGateway := func(key string) string {
+		p := all[key]
+		keys := gateways[peerZone(p)]
+		if len(keys) == 0 || t.hubs.Matches(labels.Set(p.GetLabels())) {
+			return key
+		}
+		return keys[nameHash(p.GetName())%uint32(len(keys))]
+	}
+
+	direct := make(map[string]struct{}, len(peers))
+	via := make(map[string][]string)
+	localZone := peerZone(local)
+	localHome := homeGateway("")
+	for key, p := range peers {
+		switch {
+		case peerZone(p) == localZone:
+			direct[key] = struct{}{}
+		case localHome != "":
+			// We're a non-gateway; everything foreign goes through our home gateway.
+			via[localHome] = append(via[localHome], key)
+		case homeGateway(key) == key:
+			direct[key] = struct{}{}
+		default:
+			home := homeGateway(key)
+			via[home] = append(via[home], key)
+		}
+	}
+	return direct, via
+}
+
+// peerZone returns the peer's region and zone as a single key.
+func peerZone(p *wgk8s.WireGuardPeer) string {
+	return p.Spec.Region + "/" + p.Spec.Zone
+}
+
+func nameHash(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+// pairHash hashes an unordered pair of peer names. Both leaves must route their traffic through the
+// same hub, since WireGuard only accepts packets from a source address routed to the sending peer.
+func pairHash(a, b string) uint32 {
+	if a > b {
+		a, b = b, a
+	}
+	h := fnv.New32a()
+	h.Write([]byte(a))
+	h.Write([]byte{0})
+	h.Write([]byte(b))
+	return h.Sum32()
+}
@@ -0,0 +1,259 @@
+package agent
+
+import (
+	"sort"
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func testPeer(name string, lbls map[string]string, ips ...string) *wgk8s.WireGuardPeer {
+	return &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "ns",
+			SelfLink:  "/" + name,
+			Labels:    lbls,
+		},
+		Spec: wgk8s.WireGuardPeerSpec{IPs: ips},
+	}
+}
+
+func TestTopologyPlan(t *testing.T) {
+	hub := map[string]string{"role": "hub"}
+	hubAndSpoke := topology{hubs: labels.SelectorFromSet(hub)}
+	tcs := []struct {
+		name         string
+		topology     topology
+		local        *wgk8s.WireGuardPeer
+		peers        []*wgk8s.WireGuardPeer
+		expectDirect []string
+		expectVia    int
+	}{
+		{
+			name:         "full mesh",
+			local:        testPeer("local", nil),
+			peers:        []*wgk8s.WireGuardPeer{testPeer("a", nil), testPeer("b", hub)},
+			expectDirect: []string{"/a", "/b"},
+		},
+		{
+			name:         "hub connects to everyone",
+			topology:     hubAndSpoke,
+			local:        testPeer("local", hub),
+			peers:        []*wgk8s.WireGuardPeer{testPeer("a", nil), testPeer("b", hub)},
+			expectDirect: []string{"/a", "/b"},
+		},
+		{
+			name:         "leaf connects to hubs",
+			topology:     hubAndSpoke,
+			local:        testPeer("local", nil),
+			peers:        []*wgk8s.WireGuardPeer{testPeer("a", nil), testPeer("b", nil), testPeer("h1", hub), testPeer("h2", hub)},
+			expectDirect: []string{"/h1", "/h2"},
+			expectVia:    2,
+		},
+		{
+			name:         "leaf without hubs",
+			topology:     hubAndSpoke,
+			local:        testPeer("local", nil),
+			peers:        []*wgk8s.WireGuardPeer{testPeer("a", nil), testPeer("b", nil)},
+			expectDirect: []string{"/a", "/b"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			peers := make(map[string]*wgk8s.WireGuardPeer)
+			for _, p := range tc.peers {
+				peers[p.GetSelfLink()] = p
+			}
+			direct, via := tc.topology.plan(tc.local, peers)
+			var got []string
+			for key := range direct {
+				got = append(got, key)
+			}
+			sort.Strings(got)
+			require.Equal(t, tc.expectDirect, got)
+			var routed int
+			for hub, leaves := range via {
+				require.Contains(t, direct, hub)
+				routed += len(leaves)
+			}
+			require.Equal(t, tc.expectVia, routed)
+		})
+	}
+}
+
+func TestTopologyPlanSymmetric(t *testing.T) {
+	// Each pair of leaves must agree on the hub between them.
+	hub := map[string]string{"role": "hub"}
+	tp := topology{hubs: labels.SelectorFromSet(hub)}
+	all := []*wgk8s.WireGuardPeer{testPeer("h1", hub), testPeer("h2", hub), testPeer("h3", hub)}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		all = append(all, testPeer(name, nil))
+	}
+	hubFor := make(map[[2]string]string)
+	for _, local := range all[3:] {
+		peers := make(map[string]*wgk8s.WireGuardPeer)
+		for _, p := range all {
+			if p != local {
+				peers[p.GetSelfLink()] = p
+			}
+		}
+		_, via := tp.plan(local, peers)
+		for hubKey, leaves := range via {
+			for _, leafKey := range leaves {
+				pair := [2]string{local.GetName(), peers[leafKey].GetName()}
+				sort.Strings(pair[:])
+				if existing, ok := hubFor[pair]; ok {
+					require.Equal(t, existing, hubKey, "pair %v", pair)
+				}
+				hubFor[pair] = hubKey
+			}
+		}
+	}
+	require.Len(t, hubFor, 10)
+}
+
+func TestMeshTopology(t *testing.T) {
+	got, err := meshTopology(nil)
+	require.NoError(t, err)
+	require.True(t, got.equal(topology{}))
+
+	mesh := &wgk8s.Mesh{Spec: wgk8s.MeshSpec{
+		Topology:    wgk8s.TopologyHubAndSpoke,
+		HubSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "hub"}},
+	}}
+	got, err = meshTopology(mesh)
+	require.NoError(t, err)
+	require.True(t, got.equal(topology{hubs: labels.SelectorFromSet(map[string]string{"role": "hub"})}))
+	require.False(t, got.equal(topology{}))
+
+	mesh.Spec.HubSelector = nil
+	_, err = meshTopology(mesh)
+	require.Error(t, err)
+}
+
+// requireRoutable simulates forwarding between every pair of peers using each peer's plan. At each
+// hop the packet must be routed to a directly connected peer, and the receiver must route the
+// source back to the sender or WireGuard would drop it.
+func requireRoutable(t *testing.T, tp topology, all []*wgk8s.WireGuardPeer) {
+	// routes[node][dest] is the peer node forwards dest's traffic to.
+	routes := make(map[string]map[string]string)
+	for _, local := range all {
+		peers := make(map[string]*wgk8s.WireGuardPeer)
+		for _, p := range all {
+			if p != local {
+				peers[p.GetName()] = p
+			}
+		}
+		direct, via := tp.plan(local, peers)
+		r := make(map[string]string)
+		for key := range direct {
+			r[key] = key
+		}
+		for hub, leaves := range via {
+			require.Contains(t, direct, hub)
+			for _, leaf := range leaves {
+				_, dup := r[leaf]
+				require.False(t, dup, "%s routes %s twice", local.GetName(), leaf)
+				r[leaf] = hub
+			}
+		}
+		require.Len(t, r, len(peers), "%s can't reach every peer", local.GetName())
+		routes[local.GetName()] = r
+	}
+	for _, src := range all {
+		for _, dst := range all {
+			if src == dst {
+				continue
+			}
+			node := src.GetName()
+			for hops := 0; node != dst.GetName(); hops++ {
+				require.Less(t, hops, len(all), "routing loop from %s to %s", src.GetName(), dst.GetName())
+				next := routes[node][dst.GetName()]
+				if next != src.GetName() {
+					require.Equal(t, node, routes[next][src.GetName()],
+						"%s would drop %s's packet from %s", next, src.GetName(), node)
+				}
+				node = next
+			}
+		}
+	}
+}
+
+func zonedPeer(name, zone string, gateway bool) *wgk8s.WireGuardPeer {
+	var lbls map[string]string
+	if gateway {
+		lbls = map[string]string{"role": "hub"}
+	}
+	p := testPeer(name, lbls)
+	p.Spec.Region = "r"
+	p.Spec.Zone = zone
+	return p
+}
+
+func TestTopologyRoutable(t *testing.T) {
+	hub := map[string]string{"role": "hub"}
+	hubs := labels.SelectorFromSet(hub)
+	tcs := []struct {
+		name     string
+		topology topology
+		peers    []*wgk8s.WireGuardPeer
+	}{
+		{
+			name:     "hub and spoke",
+			topology: topology{hubs: hubs},
+			peers: []*wgk8s.WireGuardPeer{
+				testPeer("h1", hub), testPeer("h2", hub),
+				testPeer("a", nil), testPeer("b", nil), testPeer("c", nil), testPeer("d", nil),
+			},
+		},
+		{
+			name:     "zoned",
+			topology: topology{hubs: hubs, zoned: true},
+			peers: []*wgk8s.WireGuardPeer{
+				zonedPeer("a-gw1", "a", true), zonedPeer("a-gw2", "a", true),
+				zonedPeer("a1", "a", false), zonedPeer("a2", "a", false), zonedPeer("a3", "a", false),
+				zonedPeer("b-gw1", "b", true),
+				zonedPeer("b1", "b", false), zonedPeer("b2", "b", false),
+				// Zone c has no gateways, so its peers act as their own.
+				zonedPeer("c1", "c", false), zonedPeer("c2", "c", false),
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			requireRoutable(t, tc.topology, tc.peers)
+		})
+	}
+}
+
+func TestTopologyPlanZoned(t *testing.T) {
+	tp := topology{hubs: labels.SelectorFromSet(map[string]string{"role": "hub"}), zoned: true}
+	peers := make(map[string]*wgk8s.WireGuardPeer)
+	for _, p := range []*wgk8s.WireGuardPeer{
+		zonedPeer("a-gw", "a", true), zonedPeer("a1", "a", false),
+		zonedPeer("b-gw", "b", true), zonedPeer("b1", "b", false), zonedPeer("b2", "b", false),
+	} {
+		peers[p.GetSelfLink()] = p
+	}
+
+	// Non-gateways connect within their zone only.
+	direct, via := tp.plan(zonedPeer("a2", "a", false), peers)
+	require.Len(t, direct, 2)
+	require.Contains(t, direct, "/a-gw")
+	require.Contains(t, direct, "/a1")
+	require.ElementsMatch(t, []string{"/b-gw", "/b1", "/b2"}, via["/a-gw"])
+
+	// Gateways also connect to other zones' gateways.
+	delete(peers, "/a-gw")
+	direct, via = tp.plan(zonedPeer("a-gw", "a", true), peers)
+	require.Len(t, direct, 2)
+	require.Contains(t, direct, "/a1")
+	require.Contains(t, direct, "/b-gw")
+	require.ElementsMatch(t, []string{"/b1", "/b2"}, via["/b-gw"])
+}
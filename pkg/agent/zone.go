@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Well-known node topology labels, which aren't in our version of k8s.io/api.
+const (
+	labelTopologyRegion = "topology.kubernetes.io/region"
+	labelTopologyZone   = "topology.kubernetes.io/zone"
+)
+
+// configureNodeZone populates the region and zone from the local Node's topology labels, unless they
+// were set explicitly.
+func (a *Agent) configureNodeZone() error {
+	if a.localCS == nil || a.kubeNode == "" || (a.region != "" && a.zone != "") {
+		return nil
+	}
+	node, err := a.localCS.CoreV1().Nodes().Get(a.kubeNode, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting node %q: %w", a.kubeNode, err)
+	}
+	region, zone := NodeZone(node.GetLabels())
+	if a.region == "" {
+		a.region = region
+	}
+	if a.zone == "" {
+		a.zone = zone
+	}
+	a.ll.WithField("region", a.region).WithField("zone", a.zone).Debugln("using node topology")
+	return nil
+}
+
+// NodeZone returns the region and zone from a node's labels, preferring the GA labels over the
+// deprecated beta labels.
+func NodeZone(nodeLabels map[string]string) (region, zone string) {
+	region = nodeLabels[labelTopologyRegion]
+	if region == "" {
+		region = nodeLabels[corev1.LabelZoneRegion]
+	}
+	zone = nodeLabels[labelTopologyZone]
+	if zone == "" {
+		zone = nodeLabels[corev1.LabelZoneFailureDomain]
+	}
+	return region, zone
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeZone(t *testing.T) {
+	tcs := []struct {
+		name         string
+		labels       map[string]string
+		expectRegion string
+		expectZone   string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "ga",
+			labels: map[string]string{
+				"topology.kubernetes.io/region":            "us-east-1",
+				"topology.kubernetes.io/zone":              "us-east-1a",
+				"failure-domain.beta.kubernetes.io/region": "old",
+				"failure-domain.beta.kubernetes.io/zone":   "old",
+			},
+			expectRegion: "us-east-1",
+			expectZone:   "us-east-1a",
+		},
+		{
+			name: "beta",
+			labels: map[string]string{
+				"failure-domain.beta.kubernetes.io/region": "us-east-1",
+				"failure-domain.beta.kubernetes.io/zone":   "us-east-1b",
+			},
+			expectRegion: "us-east-1",
+			expectZone:   "us-east-1b",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			region, zone := NodeZone(tc.labels)
+			require.Equal(t, tc.expectRegion, region)
+			require.Equal(t, tc.expectZone, zone)
+		})
+	}
+}
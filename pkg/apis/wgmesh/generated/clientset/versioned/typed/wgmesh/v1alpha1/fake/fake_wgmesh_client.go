@@ -45,6 +45,14 @@ func (c *FakeWgmeshV1alpha1) IPPools(namespace string) v1alpha1.IPPoolInterface
 	return &FakeIPPools{c, namespace}
 }
 
+func (c *FakeWgmeshV1alpha1) Meshes(namespace string) v1alpha1.MeshInterface {
+	return &FakeMeshes{c, namespace}
+}
+
+func (c *FakeWgmeshV1alpha1) WireGuardMeshPolicies(namespace string) v1alpha1.WireGuardMeshPolicyInterface {
+	return &FakeWireGuardMeshPolicies{c, namespace}
+}
+
 func (c *FakeWgmeshV1alpha1) WireGuardPeers(namespace string) v1alpha1.WireGuardPeerInterface {
 	return &FakeWireGuardPeers{c, namespace}
 }
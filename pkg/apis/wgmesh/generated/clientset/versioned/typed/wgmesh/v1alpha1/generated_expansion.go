@@ -31,4 +31,8 @@ type IPClaimExpansion interface{}
 
 type IPPoolExpansion interface{}
 
+type MeshExpansion interface{}
+
+type WireGuardMeshPolicyExpansion interface{}
+
 type WireGuardPeerExpansion interface{}
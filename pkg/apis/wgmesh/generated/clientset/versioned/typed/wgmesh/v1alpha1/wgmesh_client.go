@@ -37,6 +37,8 @@ type WgmeshV1alpha1Interface interface {
 	RESTClient() rest.Interface
 	IPClaimsGetter
 	IPPoolsGetter
+	MeshesGetter
+	WireGuardMeshPoliciesGetter
 	WireGuardPeersGetter
 }
 
@@ -53,6 +55,14 @@ func (c *WgmeshV1alpha1Client) IPPools(namespace string) IPPoolInterface {
 	return newIPPools(c, namespace)
 }
 
+func (c *WgmeshV1alpha1Client) Meshes(namespace string) MeshInterface {
+	return newMeshes(c, namespace)
+}
+
+func (c *WgmeshV1alpha1Client) WireGuardMeshPolicies(namespace string) WireGuardMeshPolicyInterface {
+	return newWireGuardMeshPolicies(c, namespace)
+}
+
 func (c *WgmeshV1alpha1Client) WireGuardPeers(namespace string) WireGuardPeerInterface {
 	return newWireGuardPeers(c, namespace)
 }
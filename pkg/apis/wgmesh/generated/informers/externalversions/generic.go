@@ -66,6 +66,10 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Wgmesh().V1alpha1().IPClaims().Informer()}, nil
 	case v1alpha1.SchemeGroupVersion.WithResource("ippools"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Wgmesh().V1alpha1().IPPools().Informer()}, nil
+	case v1alpha1.SchemeGroupVersion.WithResource("meshes"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Wgmesh().V1alpha1().Meshes().Informer()}, nil
+	case v1alpha1.SchemeGroupVersion.WithResource("wireguardmeshpolicies"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Wgmesh().V1alpha1().WireGuardMeshPolicies().Informer()}, nil
 	case v1alpha1.SchemeGroupVersion.WithResource("wireguardpeers"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Wgmesh().V1alpha1().WireGuardPeers().Informer()}, nil
 
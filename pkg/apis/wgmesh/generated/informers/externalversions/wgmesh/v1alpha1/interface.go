@@ -37,6 +37,10 @@ type Interface interface {
 	IPClaims() IPClaimInformer
 	// IPPools returns a IPPoolInformer.
 	IPPools() IPPoolInformer
+	// Meshes returns a MeshInformer.
+	Meshes() MeshInformer
+	// WireGuardMeshPolicies returns a WireGuardMeshPolicyInformer.
+	WireGuardMeshPolicies() WireGuardMeshPolicyInformer
 	// WireGuardPeers returns a WireGuardPeerInformer.
 	WireGuardPeers() WireGuardPeerInformer
 }
@@ -62,6 +66,16 @@ func (v *version) IPPools() IPPoolInformer {
 	return &iPPoolInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
 
+// Meshes returns a MeshInformer.
+func (v *version) Meshes() MeshInformer {
+	return &meshInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
+// WireGuardMeshPolicies returns a WireGuardMeshPolicyInformer.
+func (v *version) WireGuardMeshPolicies() WireGuardMeshPolicyInformer {
+	return &wireGuardMeshPolicyInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
+
 // WireGuardPeers returns a WireGuardPeerInformer.
 func (v *version) WireGuardPeers() WireGuardPeerInformer {
 	return &wireGuardPeerInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
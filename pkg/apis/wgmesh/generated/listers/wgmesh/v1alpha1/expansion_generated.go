@@ -43,6 +43,22 @@ type IPPoolListerExpansion interface{}
 // IPPoolNamespaceLister.
 type IPPoolNamespaceListerExpansion interface{}
 
+// MeshListerExpansion allows custom methods to be added to
+// MeshLister.
+type MeshListerExpansion interface{}
+
+// MeshNamespaceListerExpansion allows custom methods to be added to
+// MeshNamespaceLister.
+type MeshNamespaceListerExpansion interface{}
+
+// WireGuardMeshPolicyListerExpansion allows custom methods to be added to
+// WireGuardMeshPolicyLister.
+type WireGuardMeshPolicyListerExpansion interface{}
+
+// WireGuardMeshPolicyNamespaceListerExpansion allows custom methods to be added to
+// WireGuardMeshPolicyNamespaceLister.
+type WireGuardMeshPolicyNamespaceListerExpansion interface{}
+
 // WireGuardPeerListerExpansion allows custom methods to be added to
 // WireGuardPeerLister.
 type WireGuardPeerListerExpansion interface{}
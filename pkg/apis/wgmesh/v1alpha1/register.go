@@ -73,6 +73,10 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 		&IPPoolList{},
 		&IPClaim{},
 		&IPClaimList{},
+		&Mesh{},
+		&MeshList{},
+		&WireGuardMeshPolicy{},
+		&WireGuardMeshPolicyList{},
 	)
 	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
 
@@ -30,21 +30,115 @@ SOFTWARE.
 package v1alpha1
 
 import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	// ProtectedAnnotation marks a WireGuardPeer as protected. Agents will not remove a protected
+	// peer (or its routes) when the record is deleted unless explicitly told to allow it. This
+	// guards critical peers, like a site's main gateway, against accidental deletion.
+	ProtectedAnnotation = GroupName + "/protected"
+
+	// ProtectedFinalizer is added to protected WireGuardPeers by their owning agent. The apiserver
+	// will not finalize deletion of the record until the finalizer is removed, which the controller
+	// does once the ProtectedAnnotation is gone.
+	ProtectedFinalizer = GroupName + "/protected"
+
+	// IPPoolLabel is applied to IPClaims to identify the IPPool the address was claimed from.
+	IPPoolLabel = GroupName + "/ip-pool"
+
+	// NodeLabel is applied to WireGuardPeers maintained by the node operator, naming the
+	// Kubernetes Node the peer represents.
+	NodeLabel = GroupName + "/node"
+
+	// NodePublicKeyAnnotation is set on a Node by an operator-managed agent to publish its
+	// WireGuard public key.
+	NodePublicKeyAnnotation = GroupName + "/public-key"
+
+	// NodeListenPortAnnotation is set on a Node by an operator-managed agent to publish the port
+	// its WireGuard interface listens on.
+	NodeListenPortAnnotation = GroupName + "/listen-port"
+
+	// NodeMeshIPsAnnotation is set on a Node by its agent to list, comma separated, the addresses
+	// the node can be reached at over the mesh.
+	NodeMeshIPsAnnotation = GroupName + "/mesh-ips"
+
+	// ServiceExportAnnotation marks a Kubernetes Service, when set to "true", for export over the
+	// mesh by agents exporting services.
+	ServiceExportAnnotation = GroupName + "/export"
+
+	// TakenOverAnnotation is set on a WireGuardPeer by an agent which claimed the record from
+	// another holder of the same name, recording when. The previous holder's agent stops defending
+	// the record when it sees the annotation change.
+	TakenOverAnnotation = GroupName + "/taken-over"
+
+	// HostAnnotation is set on a WireGuardPeer by its agent to identify the host it runs on. Peers
+	// without an endpoint, like client-only peers, are told apart by it when two hosts share a name.
+	HostAnnotation = GroupName + "/host"
+)
+
 // WireGuardPeerSpec describes the info necessary to establish connectivity
 // with the peer.
 type WireGuardPeerSpec struct {
-	Endpoint     string   `json:"endpoint"`
+	// Endpoint is empty for client-only peers, which can't accept inbound connections. Other peers
+	// wait for them to initiate.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Endpoints lists additional endpoint candidates, in order of preference, which are tried
+	// before Endpoint. Ex. a LAN address lets peers on the same network avoid hairpinning
+	// through a public address.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// TCPEndpoint, if set, is a host:port where the peer accepts its WireGuard traffic carried over
+	// TCP by udp-over-tcp, for peers on networks which block UDP. Peers with TCP fallback try it
+	// after their UDP endpoint candidates.
+	TCPEndpoint  string   `json:"tcpEndpoint,omitempty"`
 	PublicKey    string   `json:"publicKey"`
 	PresharedKey string   `json:"presharedKey"`
 	IPs          []string `json:"ips,omitempty"`
 	Routes       []string `json:"routes,omitempty"`
+	// ClampMSSRoutes lists routes offered in Routes whose forwarded TCP connections should have
+	// their MSS clamped to the path MTU, by peers which install the routes with MSS clamping.
+	ClampMSSRoutes []string `json:"clampMSSRoutes,omitempty"`
+	// RoutePriority chooses between peers offering the same route. The highest priority peer which
+	// is completing handshakes gets the route; ties go to the lowest name.
+	RoutePriority int `json:"routePriority,omitempty"`
 	// KeepAliveSeconds is the frequency which keep-alive packets will be sent to
 	// maintain connectivity between peers.
 	// NOTE: For each set of peers we use the lower of the two peers.
 	KeepAliveSeconds int `json:"keepalive,omitempty"`
+	// Region and Zone locate the peer, ex. for the Zoned topology. Agents populate them from their
+	// Kubernetes node's topology labels unless they're set explicitly.
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+	// ReflectedRoutes are routes which this peer, as a gateway, re-advertises on behalf of the
+	// peers it connects to. Peers which don't learn a route from its origin route it through
+	// this peer.
+	ReflectedRoutes []ReflectedRoute `json:"reflectedRoutes,omitempty"`
+	// Services are Kubernetes Services exported through this peer. Their addresses are also
+	// offered in Routes.
+	Services []ExportedService `json:"services,omitempty"`
+}
+
+// ReflectedRoute is a route re-advertised by a gateway.
+type ReflectedRoute struct {
+	CIDR string `json:"cidr"`
+	// Path lists the peers the route was learned through, starting with its origin and ending
+	// with the gateway advertising it. Peers ignore routes whose path includes themselves, which
+	// prevents loops between gateways.
+	Path []string `json:"path"`
+}
+
+// ExportedService is a Kubernetes Service reachable over the mesh through the exporting peer.
+type ExportedService struct {
+	// Name is the service's DNS name within its cluster, ex. web.default.svc.cluster.local.
+	Name string   `json:"name"`
+	IPs  []string `json:"ips"`
 }
 
 // +genclient
@@ -57,7 +151,109 @@ type WireGuardPeer struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec WireGuardPeerSpec `json:"spec,omitempty"`
+	Spec   WireGuardPeerSpec   `json:"spec,omitempty"`
+	Status WireGuardPeerStatus `json:"status,omitempty"`
+}
+
+// WireGuardPeerStatus describes problems observed with the peer by the wgmesh controller, and
+// the other peers' addresses and health as observed by this peer's agent.
+type WireGuardPeerStatus struct {
+	Conditions []WireGuardPeerCondition `json:"conditions,omitempty"`
+	// ObservedEndpoints lists the source addresses which this peer is currently completing
+	// handshakes with. A NATed peer's observed address is its external mapping, which other
+	// peers try as an endpoint so that two NATed peers can hole punch.
+	ObservedEndpoints []ObservedEndpoint `json:"observedEndpoints,omitempty"`
+	// PeerHealth lists the peers which this peer connects to directly, sorted by name, with the
+	// health of each connection. Together, the peers' lists form the mesh's health matrix.
+	PeerHealth []PeerHealth `json:"peerHealth,omitempty"`
+}
+
+// ObservedEndpoint is the address a peer, identified by its public key, was seen at.
+type ObservedEndpoint struct {
+	PublicKey string `json:"publicKey"`
+	Endpoint  string `json:"endpoint"`
+}
+
+// PeerHealth is the health of the connection to a peer, as observed by this peer's agent.
+type PeerHealth struct {
+	Name string `json:"name"`
+	// Reachable is true while a handshake with the peer is recent enough that the session is live.
+	// Idle peers without a keepalive stop completing handshakes, so they aren't reachable, but they
+	// aren't stale either.
+	Reachable bool `json:"reachable"`
+	// Stale is true while traffic is sent to the peer without a handshake completing.
+	Stale bool `json:"stale,omitempty"`
+	// LastHandshakeTime is when the latest handshake with the peer completed, unset if none has.
+	LastHandshakeTime *metav1.Time `json:"lastHandshakeTime,omitempty"`
+	// QuarantinedSince is when the peer was removed from the device for never completing a
+	// handshake, unset unless it's quarantined.
+	QuarantinedSince *metav1.Time `json:"quarantinedSince,omitempty"`
+}
+
+// WireGuardPeerConditionType identifies a WireGuardPeerCondition.
+type WireGuardPeerConditionType string
+
+const (
+	// WireGuardPeerIPConflict is True when another peer publishes one of this peer's IPs. Routing
+	// to a duplicated address silently breaks for whichever peer is configured last.
+	WireGuardPeerIPConflict WireGuardPeerConditionType = "IPConflict"
+)
+
+// WireGuardPeerCondition describes the state of a WireGuardPeer at a point in time.
+type WireGuardPeerCondition struct {
+	Type               WireGuardPeerConditionType `json:"type"`
+	Status             corev1.ConditionStatus     `json:"status"`
+	LastTransitionTime metav1.Time                `json:"lastTransitionTime,omitempty"`
+	Reason             string                     `json:"reason,omitempty"`
+	Message            string                     `json:"message,omitempty"`
+}
+
+// GetCondition returns the condition of the specified type, or nil if it isn't set.
+func (p *WireGuardPeer) GetCondition(t WireGuardPeerConditionType) *WireGuardPeerCondition {
+	for i := range p.Status.Conditions {
+		if p.Status.Conditions[i].Type == t {
+			return &p.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds or updates the condition, returning true if it changed. The transition time is
+// only updated when the status changes.
+func (p *WireGuardPeer) SetCondition(c WireGuardPeerCondition) bool {
+	existing := p.GetCondition(c.Type)
+	if existing == nil {
+		p.Status.Conditions = append(p.Status.Conditions, c)
+		return true
+	}
+	if existing.Status == c.Status && existing.Reason == c.Reason && existing.Message == c.Message {
+		return false
+	}
+	if existing.Status == c.Status {
+		c.LastTransitionTime = existing.LastTransitionTime
+	}
+	*existing = c
+	return true
+}
+
+// IsProtected returns true if the peer has been annotated as protected.
+func (p *WireGuardPeer) IsProtected() bool {
+	v, ok := p.GetAnnotations()[ProtectedAnnotation]
+	return ok && v != "false"
+}
+
+// EndpointCandidates returns the peer's endpoints in order of preference, without duplicates.
+func (s *WireGuardPeerSpec) EndpointCandidates() []string {
+	var out []string
+	seen := make(map[string]struct{})
+	for _, e := range append(append([]string(nil), s.Endpoints...), s.Endpoint) {
+		if _, ok := seen[e]; ok || e == "" {
+			continue
+		}
+		seen[e] = struct{}{}
+		out = append(out, e)
+	}
+	return out
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -73,21 +269,40 @@ type WireGuardPeerList struct {
 // IPPoolSpec describes the IP pool
 type IPPoolSpec struct {
 	// IPRanges specifies a set of IP ranges available for allocation. If multiple ranges are
-	// offered, a client will select one total address at random from any listed range. If ranges
-	// overlap, IPs can be claimed by at most peer per IPPool, regardless of how many ranges they
-	// appear in.
+	// offered, a client will select one total address from any listed range, as determined by the
+	// Strategy. If ranges overlap, IPs can be claimed by at most peer per IPPool, regardless of how
+	// many ranges they appear in.
 	IPRanges []IPRange `json:"ipRanges"`
 
 	// Reserved lists addresses which should not be assigned.
 	Reserved []string `json:"reserved,omitempty"`
+
+	// ExcludeCIDRs lists subnets within the IPRanges which should not be assigned. Existing claims
+	// within excluded subnets are not revoked.
+	ExcludeCIDRs []string `json:"excludeCIDRs,omitempty"`
+
+	// Strategy controls how addresses are selected. Defaults to random.
+	Strategy IPAllocationStrategy `json:"strategy,omitempty"`
 }
 
+// IPAllocationStrategy describes how addresses are selected from an IPPool.
+type IPAllocationStrategy string
+
+const (
+	// IPAllocationRandom selects a random available address from a random range.
+	IPAllocationRandom IPAllocationStrategy = "random"
+	// IPAllocationSequential selects the lowest available address, trying ranges in the order
+	// they're listed.
+	IPAllocationSequential IPAllocationStrategy = "sequential"
+)
+
 // IPRange defines a range of IP address available for allocation.
 type IPRange struct {
 	CIDR string `json:"cidr"`
 	// Start defines the first address in the pool available for allocation. If omitted, the start
 	// address is assumed to be start of the subnet. Unless the mask is an IPv4 >= /31, the 0 address
-	// is reserved as the network address.
+	// is reserved as the network address. Similarly, the IPv6 Subnet-Router anycast address is
+	// reserved unless the mask is an IPv6 >= /127.
 	Start string `json:"start,omitempty"`
 	// Start defines the last address in the pool available for allocation. If omitted, the start
 	// address is assumed to be end of the subnet. Unless the mask is an IPv4 >= /31, the top address
@@ -105,7 +320,19 @@ type IPPool struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec IPPoolSpec `json:"spec,omitempty"`
+	Spec   IPPoolSpec   `json:"spec,omitempty"`
+	Status IPPoolStatus `json:"status,omitempty"`
+}
+
+// IPPoolStatus reports how much of the IPPool has been claimed. It is maintained by the controller.
+type IPPoolStatus struct {
+	// Capacity is the number of assignable addresses in the pool. It's a decimal string because
+	// IPv6 ranges routinely exceed an int64.
+	Capacity string `json:"capacity,omitempty"`
+	// Allocated is the number of IPClaims against the pool.
+	Allocated int64 `json:"allocated,omitempty"`
+	// Utilization is Allocated as a percentage of Capacity.
+	Utilization string `json:"utilization,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -133,7 +360,37 @@ type IPClaim struct {
 
 // IPClaimSpec describes the IP claim.
 type IPClaimSpec struct {
+	// IP is the claimed address, without a prefix length.
 	IP string `json:"ip"`
+	// Peer reserves the address for the named WireGuardPeer. Administrators can pre-create claims
+	// with Peer set (and no owner) to pin well-known addresses, ex. for gateways. The peer uses
+	// the address, but never releases the claim.
+	Peer string `json:"peer,omitempty"`
+	// LeaseExpires is when the claim lapses unless the owning agent renews it. Expired claims are
+	// garbage collected, after which the address may be claimed by another peer. Claims without a
+	// lease are held until their owner is deleted.
+	LeaseExpires *metav1.Time `json:"leaseExpires,omitempty"`
+}
+
+var claimIPRegexp = regexp.MustCompile(`[^a-f0-9]`)
+
+// IPClaimName builds the object name for a claim of the IP from the pool. Claim names are
+// deterministic so at most one claim can exist per address. IPv6 addresses are fully expanded so
+// the name never contains consecutive or trailing separators (ex. "fd00::").
+func IPClaimName(pool, ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		var groups []string
+		for i := 0; i < net.IPv6len; i += 2 {
+			groups = append(groups, fmt.Sprintf("%02x%02x", parsed[i], parsed[i+1]))
+		}
+		ip = strings.Join(groups, "-")
+	}
+	return fmt.Sprintf("%s-%s", pool, claimIPRegexp.ReplaceAllString(strings.ToLower(ip), "-"))
+}
+
+// LeaseExpired returns true if the claim has a lease which expired before now.
+func (c *IPClaim) LeaseExpired(now time.Time) bool {
+	return c.Spec.LeaseExpires != nil && c.Spec.LeaseExpires.Time.Before(now)
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -145,3 +402,144 @@ type IPClaimList struct {
 	metav1.ListMeta `json:"metadata,omitempty"`
 	Items           []IPClaim `json:"items"`
 }
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +resource:path=meshes
+
+// Mesh holds defaults for the WireGuardPeers in its namespace, so fleet-wide settings can be changed
+// without updating every agent. Settings passed explicitly to an agent take precedence.
+type Mesh struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec MeshSpec `json:"spec,omitempty"`
+}
+
+// MeshSpec describes the mesh-wide defaults.
+type MeshSpec struct {
+	// PeerSelector limits the Mesh to agents whose WireGuardPeer labels match. If omitted, the Mesh
+	// applies to every peer in the namespace. If several Meshes select a peer, the first by name is
+	// used.
+	PeerSelector *metav1.LabelSelector `json:"peerSelector,omitempty"`
+
+	// KeepAliveSeconds is the default persistent keepalive interval peers request.
+	KeepAliveSeconds int `json:"keepalive,omitempty"`
+
+	// MTU is the default MTU of agents' WireGuard interfaces.
+	MTU int `json:"mtu,omitempty"`
+
+	// IPClaimGCGracePeriod overrides how long the controller waits before deleting an unleased
+	// IPClaim whose WireGuardPeer is gone. Orphaned claims have no peer to select, so this applies
+	// to the whole namespace; if several Meshes set it, the longest is used.
+	IPClaimGCGracePeriod *metav1.Duration `json:"ipClaimGCGracePeriod,omitempty"`
+
+	// Topology decides which peers connect directly. Defaults to FullMesh.
+	Topology MeshTopology `json:"topology,omitempty"`
+
+	// HubSelector selects the hubs of a HubAndSpoke topology, or the gateways of a Zoned topology.
+	HubSelector *metav1.LabelSelector `json:"hubSelector,omitempty"`
+
+	// RevokedPublicKeys lists the public keys of decommissioned peers. Agents won't configure a
+	// peer using one of them, even if it's registered again. Like IPClaimGCGracePeriod, revocations
+	// apply to the whole namespace, whichever Mesh lists them.
+	RevokedPublicKeys []string `json:"revokedPublicKeys,omitempty"`
+
+	// AllowedEndpointCIDRs, if set, limits agents to peers whose published endpoints all fall within
+	// these CIDRs, ex. corporate ranges. Other peers aren't configured, and an event is recorded.
+	// Agents' --allowed-endpoint-cidrs takes precedence.
+	AllowedEndpointCIDRs []string `json:"allowedEndpointCIDRs,omitempty"`
+
+	// SharedWithNamespaces opts the peers of the Mesh's namespace in to meshing with the agents of
+	// the listed namespaces, which must also list this namespace in their --peer-namespaces.
+	// Otherwise peers only mesh within their namespace. Like RevokedPublicKeys, it applies to the
+	// whole namespace, whichever Mesh lists it.
+	SharedWithNamespaces []string `json:"sharedWithNamespaces,omitempty"`
+}
+
+// MeshTopology describes which peers in a Mesh connect directly.
+type MeshTopology string
+
+const (
+	// TopologyFullMesh connects every pair of peers directly.
+	TopologyFullMesh MeshTopology = "FullMesh"
+	// TopologyHubAndSpoke connects hubs to every peer, while leaves only connect to hubs and reach
+	// other leaves through them. Hubs must forward IP traffic between leaves.
+	TopologyHubAndSpoke MeshTopology = "HubAndSpoke"
+	// TopologyZoned fully meshes the peers within each zone, while traffic between zones is
+	// carried by each zone's gateways. Peers in a zone without gateways act as gateways
+	// themselves. Gateways must forward IP traffic.
+	TopologyZoned MeshTopology = "Zoned"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +resource:path=meshes
+
+// MeshList contains a list of Meshes.
+type MeshList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Mesh `json:"items"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +resource:path=wireguardmeshpolicies
+
+// WireGuardMeshPolicy limits which peers may reach the peers it selects over the mesh, and on which
+// ports, like a NetworkPolicy does for pods. Peers selected by no policy accept traffic from every
+// peer. Once any policy selects a peer, it only accepts traffic which one of them allows. Policies
+// are enforced by agents run with --enforce-mesh-policies.
+type WireGuardMeshPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec WireGuardMeshPolicySpec `json:"spec,omitempty"`
+}
+
+// WireGuardMeshPolicySpec describes the traffic allowed to the selected peers.
+type WireGuardMeshPolicySpec struct {
+	// PeerSelector selects the WireGuardPeers in the namespace the policy applies to. An empty
+	// selector selects every peer.
+	PeerSelector metav1.LabelSelector `json:"peerSelector"`
+
+	// Ingress lists the traffic the selected peers accept. If empty, they accept none.
+	Ingress []MeshPolicyIngressRule `json:"ingress,omitempty"`
+}
+
+// MeshPolicyIngressRule allows traffic from the peers matching From to the ports in Ports.
+type MeshPolicyIngressRule struct {
+	// From lists the peers allowed. If empty, every peer is.
+	From []MeshPolicyPeer `json:"from,omitempty"`
+
+	// Ports lists the allowed destination ports. If empty, every port and protocol is allowed.
+	Ports []MeshPolicyPort `json:"ports,omitempty"`
+}
+
+// MeshPolicyPeer selects peers allowed by an ingress rule.
+type MeshPolicyPeer struct {
+	// PeerSelector selects WireGuardPeers by label. An empty selector selects every peer.
+	PeerSelector metav1.LabelSelector `json:"peerSelector"`
+}
+
+// MeshPolicyPort is a destination port, or range of ports.
+type MeshPolicyPort struct {
+	// Protocol is TCP, UDP, or SCTP. Defaults to TCP.
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+
+	// Port is the destination port. If omitted, every port of the protocol is allowed.
+	Port int32 `json:"port,omitempty"`
+
+	// EndPort, if set, allows the range of ports from Port through EndPort.
+	EndPort int32 `json:"endPort,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +resource:path=wireguardmeshpolicies
+
+// WireGuardMeshPolicyList contains a list of WireGuardMeshPolicies.
+type WireGuardMeshPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WireGuardMeshPolicy `json:"items"`
+}
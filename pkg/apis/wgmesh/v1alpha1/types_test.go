@@ -0,0 +1,79 @@
+package v1alpha1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestIPClaimName(t *testing.T) {
+	tcs := []struct {
+		name   string
+		ip     string
+		expect string
+	}{
+		{
+			name:   "ipv4",
+			ip:     "10.0.0.1",
+			expect: "pool-10-0-0-1",
+		},
+		{
+			name:   "ipv6",
+			ip:     "fd00::",
+			expect: "pool-fd00-0000-0000-0000-0000-0000-0000-0000",
+		},
+		{
+			name:   "ipv6 uppercase",
+			ip:     "FD12:3456:789A::1",
+			expect: "pool-fd12-3456-789a-0000-0000-0000-0000-0001",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got := IPClaimName("pool", tc.ip)
+			require.Equal(t, tc.expect, got)
+			require.Empty(t, validation.IsDNS1123Subdomain(got))
+		})
+	}
+}
+
+func TestEndpointCandidates(t *testing.T) {
+	tcs := []struct {
+		name   string
+		spec   WireGuardPeerSpec
+		expect []string
+	}{
+		{
+			name:   "endpoint only",
+			spec:   WireGuardPeerSpec{Endpoint: "203.0.113.1:51820"},
+			expect: []string{"203.0.113.1:51820"},
+		},
+		{
+			name: "endpoints preferred",
+			spec: WireGuardPeerSpec{
+				Endpoint:  "203.0.113.1:51820",
+				Endpoints: []string{"192.168.1.10:51820", "[2001:db8::1]:51820"},
+			},
+			expect: []string{"192.168.1.10:51820", "[2001:db8::1]:51820", "203.0.113.1:51820"},
+		},
+		{
+			name: "duplicates removed",
+			spec: WireGuardPeerSpec{
+				Endpoint:  "203.0.113.1:51820",
+				Endpoints: []string{"192.168.1.10:51820", "203.0.113.1:51820", "192.168.1.10:51820"},
+			},
+			expect: []string{"192.168.1.10:51820", "203.0.113.1:51820"},
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, tc.spec.EndpointCandidates())
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Package audit records the changes an agent makes to the mesh in an append-only stream, so they
+// can be reviewed separately from its logs.
+package audit
+
+import (
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Record describes a change made to the mesh.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Actor is who made the change, ex. "agent/node-a".
+	Actor string `json:"actor"`
+	Host  string `json:"host,omitempty"`
+	// Action is what was done, ex. "peer.added" or "registry.update".
+	Action string `json:"action"`
+	// Object is what it was done to, ex. a peer's name, or a route's prefix.
+	Object string `json:"object"`
+	// Details describe the change, ex. "endpoint: 192.0.2.1:51820 -> 192.0.2.2:51820".
+	Details []string `json:"details,omitempty"`
+}
+
+// Sink stores records. Write must not block for long, since changes are recorded as they're made.
+type Sink interface {
+	Write(r Record) error
+	// Close stores any buffered records.
+	Close() error
+}
+
+// Open returns a sink for the destination: an http or https URL where records are posted, or the
+// path of a file where they're appended.
+func Open(dest string) (Sink, error) {
+	if u, err := url.Parse(dest); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return NewWebhook(dest, nil), nil
+	}
+	return OpenFile(dest)
+}
+
+// Log records changes made by an actor. A nil Log records nothing.
+type Log struct {
+	sink  Sink
+	actor string
+	host  string
+	now   func() time.Time
+	ll    logrus.FieldLogger
+}
+
+// New returns a Log recording changes made by the actor to the sink. Failures to store records are
+// logged to ll.
+func New(sink Sink, actor string, ll logrus.FieldLogger) *Log {
+	host, _ := os.Hostname()
+	return &Log{sink: sink, actor: actor, host: host, now: time.Now, ll: ll}
+}
+
+// Record records the action on the object.
+func (l *Log) Record(action, object string, details ...string) {
+	if l == nil {
+		return
+	}
+	r := Record{
+		Time:    l.now().UTC(),
+		Actor:   l.actor,
+		Host:    l.host,
+		Action:  action,
+		Object:  object,
+		Details: details,
+	}
+	if err := l.sink.Write(r); err != nil {
+		l.ll.WithError(err).WithField("action", action).Error("failed to write audit record")
+	}
+}
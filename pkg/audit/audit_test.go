@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var out []Record
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r Record
+		require.NoError(t, json.Unmarshal(s.Bytes(), &r))
+		out = append(out, r)
+	}
+	require.NoError(t, s.Err())
+	return out
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	now := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	for _, details := range [][]string{{"public key: a"}, nil} {
+		// Reopening appends.
+		sink, err := Open(path)
+		require.NoError(t, err)
+		l := New(sink, "agent/a", logrus.New())
+		l.now = func() time.Time { return now }
+		l.host = "host-a"
+		l.Record("peer.added", "b", details...)
+		require.NoError(t, sink.Close())
+	}
+
+	require.Equal(t, []Record{
+		{Time: now, Actor: "agent/a", Host: "host-a", Action: "peer.added", Object: "b", Details: []string{"public key: a"}},
+		{Time: now, Actor: "agent/a", Host: "host-a", Action: "peer.added", Object: "b"},
+	}, readRecords(t, path))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	var nilLog *Log
+	nilLog.Record("peer.added", "b")
+}
+
+func TestWebhook(t *testing.T) {
+	var lock sync.Mutex
+	var received []string
+	var failures int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		// Fail the first attempt, which should be retried.
+		if failures == 0 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var record Record
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&record))
+		received = append(received, record.Object)
+	}))
+	defer srv.Close()
+
+	sink, err := Open(srv.URL)
+	require.NoError(t, err)
+	w := sink.(*Webhook)
+	w.backoff = time.Millisecond
+	for _, o := range []string{"a", "b", "c"} {
+		require.NoError(t, w.Write(Record{Action: "peer.added", Object: o}))
+	}
+	require.NoError(t, w.Close())
+	require.Error(t, w.Write(Record{Action: "peer.added", Object: "d"}), "closed")
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, []string{"a", "b", "c"}, received, "records are posted in order")
+}
@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// File appends records to a file as JSON lines. Each record is synced to disk before Write
+// returns. The file is never truncated or rotated; that's left to the operator.
+type File struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+var _ Sink = (*File)(nil)
+
+// OpenFile opens the file at path for appending, creating it readable only by its owner if it
+// doesn't exist.
+func OpenFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	return &File{f: f}, nil
+}
+
+// Write appends the record.
+func (f *File) Write(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, err = f.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	if err = f.f.Sync(); err != nil {
+		return fmt.Errorf("syncing audit log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.f.Close()
+}
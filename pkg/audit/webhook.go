@@ -0,0 +1,150 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// webhookQueueSize is how many records may be waiting to be posted before further records are
+	// refused.
+	webhookQueueSize = 1000
+	// webhookMaxBackoff caps the delay between attempts to post a record.
+	webhookMaxBackoff = 30 * time.Second
+	// webhookCloseTimeout is how long Close waits for queued records to be posted.
+	webhookCloseTimeout = 10 * time.Second
+)
+
+var errWebhookQueueFull = errors.New("audit webhook queue is full; record dropped")
+
+// Webhook posts each record as JSON to a URL, in order. Records are posted in the background, and
+// retried until they're accepted, so the agent isn't slowed by the receiver; if it falls too far
+// behind, further records are refused.
+type Webhook struct {
+	// dropped counts records which were given up on while closing. It's first for 64-bit alignment.
+	dropped int64
+
+	url    string
+	client *http.Client
+
+	queue   chan Record
+	closing chan struct{}
+	done    chan struct{}
+
+	closeOnce sync.Once
+	// backoff is the initial delay between attempts.
+	backoff time.Duration
+}
+
+var _ Sink = (*Webhook)(nil)
+
+// NewWebhook returns a Sink which posts records to the URL.
+func NewWebhook(url string, client *http.Client) *Webhook {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	w := &Webhook{
+		url:     url,
+		client:  client,
+		queue:   make(chan Record, webhookQueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		backoff: time.Second,
+	}
+	go w.run()
+	return w
+}
+
+// Write queues the record to be posted.
+func (w *Webhook) Write(r Record) error {
+	select {
+	case <-w.closing:
+		return errors.New("audit webhook is closed")
+	default:
+	}
+	select {
+	case w.queue <- r:
+		return nil
+	default:
+		return errWebhookQueueFull
+	}
+}
+
+// Close waits for queued records to be posted. Each is attempted once more before it's given up
+// on, and Close gives up after a timeout.
+func (w *Webhook) Close() error {
+	w.closeOnce.Do(func() { close(w.closing) })
+	select {
+	case <-w.done:
+	case <-time.After(webhookCloseTimeout):
+		return fmt.Errorf("audit webhook: gave up posting %d queued records", len(w.queue))
+	}
+	if dropped := atomic.LoadInt64(&w.dropped); dropped > 0 {
+		return fmt.Errorf("audit webhook: failed to post %d records", dropped)
+	}
+	return nil
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+	for {
+		select {
+		case r := <-w.queue:
+			w.post(r)
+		case <-w.closing:
+			// Drain what was queued before closing.
+			for {
+				select {
+				case r := <-w.queue:
+					w.post(r)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// post sends the record, retrying with backoff until it's accepted, or until the webhook closes.
+func (w *Webhook) post(r Record) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		atomic.AddInt64(&w.dropped, 1)
+		return
+	}
+	backoff := w.backoff
+	for {
+		if err = w.send(body); err == nil {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-w.closing:
+			if err = w.send(body); err != nil {
+				atomic.AddInt64(&w.dropped, 1)
+			}
+			return
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func (w *Webhook) send(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+// Package bench measures throughput and loss between agents across the mesh.
+//
+// A test is controlled over a TCP connection to the server. The client sends its Options as a JSON
+// line. TCP tests then stream data over the same connection until the client closes its side. UDP
+// tests are sent as datagrams to the same port, tagged with a session ID assigned by the server,
+// until the client writes "done". Either way, the server replies with what it received.
+package bench
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultPort is where agents serve throughput tests, the iperf3 port.
+const DefaultPort = 5201
+
+// DefaultSize is the default UDP payload size; with IP, UDP, and WireGuard's overhead, it fits
+// common WireGuard MTUs.
+const DefaultSize = 1200
+
+// MaxDuration bounds the tests the server will run.
+const MaxDuration = 5 * time.Minute
+
+// udpHeaderLen is the length of the session ID and sequence number starting each datagram.
+const udpHeaderLen = 12
+
+// udpGrace is how long the server waits for datagrams still in flight once a UDP test is done.
+const udpGrace = 250 * time.Millisecond
+
+const tcpBufferSize = 128 * 1024
+
+// Options describe a test.
+type Options struct {
+	// Protocol is "tcp" or "udp".
+	Protocol string        `json:"protocol"`
+	Duration time.Duration `json:"duration"`
+	// Rate limits UDP tests, in bits per second. Zero sends as fast as possible.
+	Rate int64 `json:"rate,omitempty"`
+	// Size is the UDP payload size, DefaultSize if zero.
+	Size int `json:"size,omitempty"`
+}
+
+// Result is the outcome of a test.
+type Result struct {
+	Peer     string  `json:"peer,omitempty"`
+	Address  string  `json:"address"`
+	Protocol string  `json:"protocol"`
+	Seconds  float64 `json:"seconds"`
+
+	BytesSent       int64 `json:"bytesSent"`
+	BytesReceived   int64 `json:"bytesReceived"`
+	PacketsSent     int64 `json:"packetsSent,omitempty"`
+	PacketsReceived int64 `json:"packetsReceived,omitempty"`
+	// BitsPerSecond is the throughput seen by the server.
+	BitsPerSecond float64 `json:"bitsPerSecond"`
+	// Loss is the fraction of UDP datagrams which weren't received.
+	Loss float64 `json:"loss"`
+}
+
+// Validate checks the options, filling in defaults.
+func (o *Options) Validate() error {
+	switch o.Protocol {
+	case "":
+		o.Protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("unsupported protocol %q", o.Protocol)
+	}
+	if o.Duration <= 0 || o.Duration > MaxDuration {
+		return fmt.Errorf("duration must be positive and at most %s", MaxDuration)
+	}
+	if o.Size == 0 {
+		o.Size = DefaultSize
+	}
+	if o.Size < udpHeaderLen || o.Size > 65507 {
+		return fmt.Errorf("size must be between %d and 65507", udpHeaderLen)
+	}
+	if o.Rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	return nil
+}
+
+// session is the server's response to a test request.
+type session struct {
+	ID    uint32 `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// received is the server's report of what it received.
+type received struct {
+	Bytes   int64 `json:"bytes"`
+	Packets int64 `json:"packets"`
+}
+
+// Server answers tests from other agents.
+type Server struct {
+	ll    logrus.FieldLogger
+	allow func(local net.Addr) bool
+
+	tcp net.Listener
+	udp net.PacketConn
+
+	lock     sync.Mutex
+	next     uint32
+	sessions map[uint32]*received
+}
+
+// Listen opens a server on the TCP and UDP address. Only tests connecting to a local address
+// accepted by allow are served; unsolicited datagrams are ignored regardless.
+func Listen(addr string, allow func(local net.Addr) bool, ll logrus.FieldLogger) (*Server, error) {
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on tcp %s: %w", addr, err)
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return nil, fmt.Errorf("listening on udp %s: %w", addr, err)
+	}
+	return &Server{
+		ll:       ll,
+		allow:    allow,
+		tcp:      tcp,
+		udp:      udp,
+		next:     uint32(time.Now().UnixNano()),
+		sessions: make(map[uint32]*received),
+	}, nil
+}
+
+// Addr returns the server's TCP address.
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+// Serve answers tests until the context is canceled.
+func (s *Server) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.tcp.Close()
+		s.udp.Close()
+	}()
+	go s.receiveUDP()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if s.allow != nil && !s.allow(conn.LocalAddr()) {
+				s.ll.WithField("remote", conn.RemoteAddr().String()).Debugln("refusing bench test to a non-mesh address")
+				return
+			}
+			if err := s.serveTest(conn); err != nil {
+				s.ll.WithError(err).WithField("remote", conn.RemoteAddr().String()).Warnln("bench test failed")
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTest(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var o Options
+	line, err := r.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &o)
+	}
+	if err == nil {
+		err = o.Validate()
+	}
+	if err != nil {
+		json.NewEncoder(conn).Encode(session{Error: err.Error()})
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(o.Duration + 10*time.Second))
+	s.ll.WithFields(logrus.Fields{
+		"remote":   conn.RemoteAddr().String(),
+		"protocol": o.Protocol,
+		"duration": o.Duration,
+	}).Infoln("serving bench test")
+
+	var got received
+	if o.Protocol == "tcp" {
+		if err = json.NewEncoder(conn).Encode(session{}); err != nil {
+			return err
+		}
+		got.Bytes, err = io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return err
+		}
+	} else {
+		s.lock.Lock()
+		s.next++
+		id := s.next
+		s.sessions[id] = &received{}
+		s.lock.Unlock()
+		defer func() {
+			s.lock.Lock()
+			delete(s.sessions, id)
+			s.lock.Unlock()
+		}()
+		if err = json.NewEncoder(conn).Encode(session{ID: id}); err != nil {
+			return err
+		}
+		// Wait for the client to finish sending.
+		if _, err = r.ReadBytes('\n'); err != nil {
+			return err
+		}
+		time.Sleep(udpGrace)
+		s.lock.Lock()
+		got = *s.sessions[id]
+		s.lock.Unlock()
+	}
+	return json.NewEncoder(conn).Encode(got)
+}
+
+func (s *Server) receiveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < udpHeaderLen {
+			continue
+		}
+		s.lock.Lock()
+		if got, ok := s.sessions[binary.BigEndian.Uint32(buf)]; ok {
+			got.Bytes += int64(n)
+			got.Packets++
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Run runs a test against the server at addr.
+func Run(ctx context.Context, addr string, o Options) (*Result, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(o.Duration + 15*time.Second))
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Unblock reads and writes if the context is canceled.
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	if err = json.NewEncoder(conn).Encode(o); err != nil {
+		return nil, fmt.Errorf("sending test request: %w", err)
+	}
+	var sess session
+	line, err := r.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &sess)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading test response: %w", err)
+	}
+	if sess.Error != "" {
+		return nil, fmt.Errorf("server refused test: %s", sess.Error)
+	}
+
+	res := &Result{Address: addr, Protocol: o.Protocol}
+	start := time.Now()
+	if o.Protocol == "tcp" {
+		res.BytesSent, err = sendTCP(conn, o.Duration)
+	} else {
+		res.PacketsSent, res.BytesSent, err = sendUDP(ctx, addr, sess.ID, o)
+		if err == nil {
+			_, err = conn.Write([]byte("done\n"))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var got received
+	line, err = r.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &got)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading test result: %w", err)
+	}
+	elapsed := time.Since(start)
+	if o.Protocol == "udp" {
+		// Don't count the time waiting for stragglers.
+		elapsed -= udpGrace
+	}
+	res.Seconds = elapsed.Seconds()
+	res.BytesReceived = got.Bytes
+	res.PacketsReceived = got.Packets
+	res.BitsPerSecond = float64(got.Bytes*8) / elapsed.Seconds()
+	if res.PacketsSent > 0 {
+		res.Loss = 1 - float64(got.Packets)/float64(res.PacketsSent)
+		if res.Loss < 0 {
+			// Duplicated datagrams.
+			res.Loss = 0
+		}
+	}
+	return res, nil
+}
+
+func sendTCP(conn net.Conn, duration time.Duration) (int64, error) {
+	buf := make([]byte, tcpBufferSize)
+	var sent int64
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		n, err := conn.Write(buf)
+		sent += int64(n)
+		if err != nil {
+			return sent, fmt.Errorf("sending: %w", err)
+		}
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		return sent, tc.CloseWrite()
+	}
+	return sent, nil
+}
+
+func sendUDP(ctx context.Context, addr string, id uint32, o Options) (int64, int64, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	defer conn.Close()
+	buf := make([]byte, o.Size)
+	binary.BigEndian.PutUint32(buf, id)
+	var interval time.Duration
+	if o.Rate > 0 {
+		interval = time.Duration(float64(o.Size*8) / float64(o.Rate) * float64(time.Second))
+	}
+	var packets, sent int64
+	start := time.Now()
+	deadline := start.Add(o.Duration)
+	for now := start; now.Before(deadline); now = time.Now() {
+		if ctx.Err() != nil {
+			return packets, sent, ctx.Err()
+		}
+		if interval > 0 {
+			if next := start.Add(time.Duration(packets) * interval); next.After(now) {
+				time.Sleep(next.Sub(now))
+			}
+		}
+		binary.BigEndian.PutUint64(buf[4:], uint64(packets))
+		n, err := conn.Write(buf)
+		// Buffers fill when sending as fast as possible; the datagram is lost.
+		if err != nil && !errors.Is(err, syscall.ENOBUFS) {
+			return packets, sent, fmt.Errorf("sending: %w", err)
+		}
+		packets++
+		sent += int64(n)
+	}
+	return packets, sent, nil
+}
@@ -0,0 +1,82 @@
+package bench
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := Listen("127.0.0.1:0", nil, logrus.New())
+	require.NoError(t, err)
+	go s.Serve(ctx)
+	addr := s.Addr().String()
+
+	tcs := []struct {
+		name string
+		o    Options
+	}{
+		{name: "tcp", o: Options{Protocol: "tcp", Duration: 200 * time.Millisecond}},
+		{name: "udp", o: Options{Protocol: "udp", Duration: 200 * time.Millisecond, Rate: 10 * 1000 * 1000, Size: 500}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := Run(ctx, addr, tc.o)
+			require.NoError(t, err)
+			require.Equal(t, tc.o.Protocol, res.Protocol)
+			require.True(t, res.BytesSent > 0)
+			require.True(t, res.BytesReceived > 0)
+			require.True(t, res.BitsPerSecond > 0)
+			if tc.o.Protocol == "tcp" {
+				require.Equal(t, res.BytesSent, res.BytesReceived)
+				return
+			}
+			// 10Mbit/s of 500 byte datagrams for 200ms.
+			require.InDelta(t, 500, res.PacketsSent, 5)
+			require.True(t, res.PacketsReceived <= res.PacketsSent)
+			require.True(t, res.Loss < 0.5)
+		})
+	}
+}
+
+func TestRunRefused(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := Listen("127.0.0.1:0", func(net.Addr) bool { return false }, logrus.New())
+	require.NoError(t, err)
+	go s.Serve(ctx)
+	_, err = Run(ctx, s.Addr().String(), Options{Duration: time.Second})
+	require.Error(t, err)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tcs := []struct {
+		name string
+		o    Options
+		err  string
+	}{
+		{name: "defaults", o: Options{Duration: time.Second}},
+		{name: "protocol", o: Options{Protocol: "sctp", Duration: time.Second}, err: `unsupported protocol "sctp"`},
+		{name: "duration", o: Options{Protocol: "tcp"}, err: "duration must be positive and at most 5m0s"},
+		{name: "size", o: Options{Protocol: "udp", Duration: time.Second, Size: 4}, err: "size must be between 12 and 65507"},
+		{name: "rate", o: Options{Protocol: "udp", Duration: time.Second, Rate: -1}, err: "rate must not be negative"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.o.Validate()
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "tcp", tc.o.Protocol)
+			require.Equal(t, DefaultSize, tc.o.Size)
+		})
+	}
+}
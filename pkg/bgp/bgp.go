@@ -0,0 +1,282 @@
+// Package bgp runs GoBGP (https://github.com/osrg/gobgp) as a child process, advertising mesh
+// routes to upstream routers, and reporting the routes they advertise in turn.
+//
+// gobgpd is configured with the local AS, router ID, and neighbors. Routes are added to and
+// removed from its global RIB with the gobgp CLI, over its loopback API port.
+package bgp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultGoBGPDPath and DefaultGoBGPPath are looked up in PATH.
+	DefaultGoBGPDPath = "gobgpd"
+	DefaultGoBGPPath  = "gobgp"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+// ErrNotFound is returned when a GoBGP binary can't be found.
+var ErrNotFound = errors.New("gobgp binary not found")
+
+// Neighbor is an upstream router.
+type Neighbor struct {
+	Address string
+	ASN     uint32
+}
+
+// ParseNeighbor parses a neighbor of the form address=asn, ex. 10.0.0.1=65000.
+func ParseNeighbor(s string) (Neighbor, error) {
+	i := strings.LastIndex(s, "=")
+	if i == -1 {
+		return Neighbor{}, fmt.Errorf("neighbor %q: expected address=asn", s)
+	}
+	ip := net.ParseIP(s[:i])
+	if ip == nil {
+		return Neighbor{}, fmt.Errorf("neighbor %q: invalid address %q", s, s[:i])
+	}
+	asn, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil || asn == 0 {
+		return Neighbor{}, fmt.Errorf("neighbor %q: invalid asn %q", s, s[i+1:])
+	}
+	return Neighbor{Address: ip.String(), ASN: uint32(asn)}, nil
+}
+
+// Config configures the speaker.
+type Config struct {
+	ASN      uint32
+	RouterID string
+	// ListenPort is where sessions from neighbors are accepted. If zero, BGP's port is used; if
+	// negative, sessions are only initiated.
+	ListenPort int
+	Neighbors  []Neighbor
+	// GoBGPDPath and GoBGPPath locate the binaries, if they're not in PATH.
+	GoBGPDPath string
+	GoBGPPath  string
+}
+
+// toml returns gobgpd's configuration file.
+func (c Config) toml() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[global.config]\n  as = %d\n  router-id = %q\n", c.ASN, c.RouterID)
+	if c.ListenPort != 0 {
+		fmt.Fprintf(&b, "  port = %d\n", c.ListenPort)
+	}
+	for _, n := range c.Neighbors {
+		fmt.Fprintf(&b, "\n[[neighbors]]\n  [neighbors.config]\n    neighbor-address = %q\n    peer-as = %d\n", n.Address, n.ASN)
+	}
+	return b.Bytes()
+}
+
+// Speaker is a running gobgpd.
+type Speaker struct {
+	cmd        *exec.Cmd
+	exit       chan error
+	configPath string
+	// run runs the gobgp CLI against gobgpd's API, returning its output.
+	run func(args ...string) ([]byte, error)
+	// advertised holds the prefixes added to the RIB.
+	advertised map[string]bool
+}
+
+// Start starts gobgpd with the config.
+func Start(c Config) (*Speaker, error) {
+	if net.ParseIP(c.RouterID).To4() == nil {
+		return nil, fmt.Errorf("router id %q must be an IPv4 address", c.RouterID)
+	}
+	gobgpd, err := lookPath(c.GoBGPDPath, DefaultGoBGPDPath)
+	if err != nil {
+		return nil, err
+	}
+	gobgp, err := lookPath(c.GoBGPPath, DefaultGoBGPPath)
+	if err != nil {
+		return nil, err
+	}
+	apiPort, err := freeTCPPort()
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile("", "wgmesh-gobgpd-*.toml")
+	if err != nil {
+		return nil, fmt.Errorf("writing gobgpd config: %w", err)
+	}
+	_, err = f.Write(c.toml())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("writing gobgpd config: %w", err)
+	}
+	api := strconv.Itoa(apiPort)
+	cmd := exec.Command(gobgpd, "-f", f.Name(), "-t", "toml", "--api-hosts", "127.0.0.1:"+api, "--pprof-disable")
+	if err := cmd.Start(); err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("starting %s: %w", gobgpd, err)
+	}
+	s := &Speaker{
+		cmd:        cmd,
+		exit:       make(chan error, 1),
+		configPath: f.Name(),
+		run: func(args ...string) ([]byte, error) {
+			args = append([]string{"-u", "127.0.0.1", "-p", api}, args...)
+			return exec.Command(gobgp, args...).CombinedOutput()
+		},
+	}
+	go func() {
+		s.exit <- cmd.Wait()
+		close(s.exit)
+	}()
+	return s, nil
+}
+
+func lookPath(path, defaultPath string) (string, error) {
+	if path == "" {
+		path = defaultPath
+	}
+	qualifiedPath, err := exec.LookPath(path)
+	switch {
+	case err == nil:
+		return qualifiedPath, nil
+	case errors.Unwrap(err) == exec.ErrNotFound || os.IsNotExist(errors.Unwrap(err)):
+		return "", fmt.Errorf("finding %s binary: %w", path, ErrNotFound)
+	default:
+		return "", fmt.Errorf("finding %s binary %q: %w", defaultPath, path, err)
+	}
+}
+
+// family returns the gobgp address family of the prefix, which must be a CIDR.
+func family(prefix string) (string, error) {
+	ip, _, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", err
+	}
+	if ip.To4() != nil {
+		return "ipv4", nil
+	}
+	return "ipv6", nil
+}
+
+func (s *Speaker) gobgp(args ...string) ([]byte, error) {
+	out, err := s.run(args...)
+	if err != nil {
+		return nil, fmt.Errorf("running gobgp %s: %w: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// Advertise makes the advertised routes match the prefixes, which must be CIDRs.
+func (s *Speaker) Advertise(prefixes []string) error {
+	if s.advertised == nil {
+		s.advertised = make(map[string]bool)
+	}
+	want := make(map[string]bool, len(prefixes))
+	for _, p := range prefixes {
+		want[p] = true
+		if s.advertised[p] {
+			continue
+		}
+		f, err := family(p)
+		if err != nil {
+			return fmt.Errorf("advertising %q: %w", p, err)
+		}
+		if _, err := s.gobgp("global", "rib", "add", p, "-a", f); err != nil {
+			return err
+		}
+		s.advertised[p] = true
+	}
+	for p := range s.advertised {
+		if want[p] {
+			continue
+		}
+		f, _ := family(p)
+		if _, err := s.gobgp("global", "rib", "del", p, "-a", f); err != nil {
+			return err
+		}
+		delete(s.advertised, p)
+	}
+	return nil
+}
+
+// Learned returns the prefixes in the RIB which weren't advertised by us, sorted.
+func (s *Speaker) Learned() ([]string, error) {
+	var learned []string
+	for _, f := range []string{"ipv4", "ipv6"} {
+		out, err := s.gobgp("global", "rib", "-a", f, "-j")
+		if err != nil {
+			return nil, err
+		}
+		// The RIB is keyed by prefix; the paths aren't needed.
+		var rib map[string]json.RawMessage
+		if err := json.Unmarshal(out, &rib); err != nil {
+			return nil, fmt.Errorf("parsing %s rib: %w", f, err)
+		}
+		for p := range rib {
+			if _, n, err := net.ParseCIDR(p); err == nil && !s.advertised[n.String()] {
+				learned = append(learned, n.String())
+			}
+		}
+	}
+	sort.Strings(learned)
+	return learned, nil
+}
+
+// Exited returns true if gobgpd has exited.
+func (s *Speaker) Exited() bool {
+	select {
+	case <-s.exit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop signals gobgpd to exit, killing it if it hasn't within the shutdown timeout, and removes
+// its config. Its sessions close, withdrawing the advertised routes.
+func (s *Speaker) Stop() error {
+	defer os.Remove(s.configPath)
+	if s.Exited() {
+		return nil
+	}
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		if s.Exited() {
+			return nil
+		}
+		return fmt.Errorf("signaling %s: %w", s.cmd.Path, err)
+	}
+	t := time.NewTimer(shutdownTimeout)
+	defer t.Stop()
+	select {
+	case <-s.exit:
+		return nil
+	case <-t.C:
+	}
+	if err := s.cmd.Process.Kill(); err != nil && !s.Exited() {
+		return fmt.Errorf("killing %s: %w", s.cmd.Path, err)
+	}
+	<-s.exit
+	return nil
+}
+
+// freeTCPPort returns a loopback TCP port which is currently free.
+func freeTCPPort() (int, error) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("finding a free port: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,94 @@
+package bgp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNeighbor(t *testing.T) {
+	n, err := ParseNeighbor("10.0.0.1=65000")
+	require.NoError(t, err)
+	require.Equal(t, Neighbor{Address: "10.0.0.1", ASN: 65000}, n)
+	n, err = ParseNeighbor("fd00::1=4200000000")
+	require.NoError(t, err)
+	require.Equal(t, Neighbor{Address: "fd00::1", ASN: 4200000000}, n)
+	for _, s := range []string{"10.0.0.1", "router=65000", "10.0.0.1=0", "10.0.0.1=as65000"} {
+		_, err := ParseNeighbor(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestConfigTOML(t *testing.T) {
+	c := Config{
+		ASN:        65001,
+		RouterID:   "10.10.0.1",
+		ListenPort: -1,
+		Neighbors:  []Neighbor{{Address: "10.0.0.1", ASN: 65000}},
+	}
+	require.Equal(t, `[global.config]
+  as = 65001
+  router-id = "10.10.0.1"
+  port = -1
+
+[[neighbors]]
+  [neighbors.config]
+    neighbor-address = "10.0.0.1"
+    peer-as = 65000
+`, string(c.toml()))
+}
+
+func TestSpeaker(t *testing.T) {
+	var calls []string
+	rib := map[string]string{"ipv4": "{}", "ipv6": "{}"}
+	s := &Speaker{run: func(args ...string) ([]byte, error) {
+		calls = append(calls, strings.Join(args, " "))
+		if args[len(args)-1] == "-j" {
+			return []byte(rib[args[len(args)-2]]), nil
+		}
+		if args[3] == "192.0.2.0/24" {
+			return []byte("rpc error: code = Unavailable\n"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}}
+
+	require.NoError(t, s.Advertise([]string{"10.10.0.1/32", "fd00::/64"}))
+	require.ElementsMatch(t, []string{
+		"global rib add 10.10.0.1/32 -a ipv4",
+		"global rib add fd00::/64 -a ipv6",
+	}, calls)
+
+	calls = nil
+	require.NoError(t, s.Advertise([]string{"10.10.0.1/32", "10.20.0.0/16"}))
+	require.ElementsMatch(t, []string{
+		"global rib add 10.20.0.0/16 -a ipv4",
+		"global rib del fd00::/64 -a ipv6",
+	}, calls)
+
+	err := s.Advertise([]string{"192.0.2.0/24"})
+	require.EqualError(t, err, "running gobgp global rib add 192.0.2.0/24 -a ipv4: exit status 1: rpc error: code = Unavailable")
+
+	rib["ipv4"] = `{"10.10.0.1/32":[{"nlri":{"prefix":"10.10.0.1/32"}}],"172.16.0.0/12":[{"nlri":{"prefix":"172.16.0.0/12"}}]}`
+	rib["ipv6"] = `{"2001:db8::/32":[{"nlri":{"prefix":"2001:db8::/32"}}]}`
+	learned, err := s.Learned()
+	require.NoError(t, err)
+	require.Equal(t, []string{"172.16.0.0/12", "2001:db8::/32"}, learned, "our own routes aren't learned")
+}
+
+func TestStartNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{ASN: 65001, RouterID: "10.10.0.1", GoBGPDPath: filepath.Join(dir, "gobgpd")}
+	_, err = Start(c)
+	require.True(t, errors.Is(err, ErrNotFound), err)
+
+	c.RouterID = "fd00::1"
+	_, err = Start(c)
+	require.EqualError(t, err, `router id "fd00::1" must be an IPv4 address`)
+}
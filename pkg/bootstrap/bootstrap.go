@@ -0,0 +1,229 @@
+// Package bootstrap creates the registry resources a new mesh needs: the namespace, RBAC for
+// agents, and an initial IPPool.
+package bootstrap
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// Bootstrapper creates a registry's resources.
+type Bootstrapper struct {
+	options
+}
+
+// New returns a Bootstrapper configured by the options.
+func New(opts ...OptionFunc) (*Bootstrapper, error) {
+	b := &Bootstrapper{options: defaultOptions()}
+	for _, o := range opts {
+		if err := o(&b.options); err != nil {
+			return nil, err
+		}
+	}
+	if b.namespace == "" {
+		return nil, fmt.Errorf("a namespace is required")
+	}
+	return b, nil
+}
+
+// Namespace returns the registry namespace.
+func (b *Bootstrapper) Namespace() *corev1.Namespace {
+	return &corev1.Namespace{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+		ObjectMeta: metav1.ObjectMeta{Name: b.namespace},
+	}
+}
+
+// ServiceAccount returns the account agents in the registry cluster run as. Agents elsewhere can
+// use its token in their registry kubeconfig.
+func (b *Bootstrapper) ServiceAccount() *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{Name: b.agentName, Namespace: b.namespace},
+	}
+}
+
+// Role returns the permissions agents need in the registry namespace.
+func (b *Bootstrapper) Role() *rbacv1.Role {
+	return &rbacv1.Role{
+		TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+		ObjectMeta: metav1.ObjectMeta{Name: b.agentName, Namespace: b.namespace},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{wgk8s.GroupName},
+				Resources: []string{"wireguardpeers", "ipclaims"},
+				Verbs:     []string{"get", "list", "watch", "create", "update", "patch", "delete"},
+			},
+			{
+				APIGroups: []string{wgk8s.GroupName},
+				Resources: []string{"meshes", "wireguardmeshpolicies", "ippools"},
+				Verbs:     []string{"get", "list", "watch"},
+			},
+			{
+				// Agents record events, ex. when they take over a peer's name.
+				APIGroups: []string{""},
+				Resources: []string{"events"},
+				Verbs:     []string{"create", "patch"},
+			},
+		},
+	}
+}
+
+// RoleBinding grants the Role to the agents' ServiceAccount.
+func (b *Bootstrapper) RoleBinding() *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: b.agentName, Namespace: b.namespace},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     b.agentName,
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      b.agentName,
+			Namespace: b.namespace,
+		}},
+	}
+}
+
+// IPPool returns the initial IPPool, or nil if none was configured.
+func (b *Bootstrapper) IPPool() *wgk8s.IPPool {
+	if len(b.poolCIDRs) == 0 {
+		return nil
+	}
+	pool := &wgk8s.IPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: wgk8s.SchemeGroupVersion.String(), Kind: "IPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: b.poolName, Namespace: b.namespace},
+	}
+	for _, cidr := range b.poolCIDRs {
+		pool.Spec.IPRanges = append(pool.Spec.IPRanges, wgk8s.IPRange{CIDR: cidr})
+	}
+	return pool
+}
+
+// Objects returns each resource which Apply creates, in order.
+func (b *Bootstrapper) Objects() []runtime.Object {
+	out := []runtime.Object{b.Namespace(), b.ServiceAccount(), b.Role(), b.RoleBinding()}
+	if pool := b.IPPool(); pool != nil {
+		out = append(out, pool)
+	}
+	return out
+}
+
+// Manifest renders the resources as a multi-document YAML stream.
+func (b *Bootstrapper) Manifest() ([]byte, error) {
+	var buf bytes.Buffer
+	for i, o := range b.Objects() {
+		out, err := yaml.Marshal(o)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling %T: %w", o, err)
+		}
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(out)
+	}
+	return buf.Bytes(), nil
+}
+
+// Apply creates the resources. The Role and RoleBinding are updated if they exist, so upgrades pick
+// up new permissions; other existing resources, ex. an IPPool which has since been edited, are left
+// alone. The wgmesh CustomResourceDefinitions must already be established.
+func (b *Bootstrapper) Apply(kube kubernetes.Interface, wg wgmeshClientSet.Interface) error {
+	ll := b.ll.WithField("namespace", b.namespace)
+
+	_, err := kube.CoreV1().Namespaces().Create(b.Namespace())
+	if err := logCreated(ll, "Namespace", b.namespace, err); err != nil {
+		return err
+	}
+	_, err = kube.CoreV1().ServiceAccounts(b.namespace).Create(b.ServiceAccount())
+	if err := logCreated(ll, "ServiceAccount", b.agentName, err); err != nil {
+		return err
+	}
+
+	roles := kube.RbacV1().Roles(b.namespace)
+	role := b.Role()
+	_, err = roles.Create(role)
+	if k8sErrors.IsAlreadyExists(err) {
+		var existing *rbacv1.Role
+		existing, err = roles.Get(role.GetName(), metav1.GetOptions{})
+		if err == nil {
+			existing.Rules = role.Rules
+			_, err = roles.Update(existing)
+		}
+		if err != nil {
+			return fmt.Errorf("updating Role %q: %w", role.GetName(), err)
+		}
+		ll.WithField("name", role.GetName()).Info("updated Role")
+	} else if err := logCreated(ll, "Role", role.GetName(), err); err != nil {
+		return err
+	}
+
+	bindings := kube.RbacV1().RoleBindings(b.namespace)
+	binding := b.RoleBinding()
+	_, err = bindings.Create(binding)
+	if k8sErrors.IsAlreadyExists(err) {
+		var existing *rbacv1.RoleBinding
+		existing, err = bindings.Get(binding.GetName(), metav1.GetOptions{})
+		if err == nil && existing.RoleRef != binding.RoleRef {
+			// The roleRef is immutable.
+			err = fmt.Errorf("it references %s %q", existing.RoleRef.Kind, existing.RoleRef.Name)
+		}
+		if err == nil {
+			existing.Subjects = binding.Subjects
+			_, err = bindings.Update(existing)
+		}
+		if err != nil {
+			return fmt.Errorf("updating RoleBinding %q: %w", binding.GetName(), err)
+		}
+		ll.WithField("name", binding.GetName()).Info("updated RoleBinding")
+	} else if err := logCreated(ll, "RoleBinding", binding.GetName(), err); err != nil {
+		return err
+	}
+
+	if pool := b.IPPool(); pool != nil {
+		_, err = wg.WgmeshV1alpha1().IPPools(b.namespace).Create(pool)
+		if err := logCreated(ll, "IPPool", pool.GetName(), err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logCreated logs the result of creating a resource, and returns the error, if any, other than
+// AlreadyExists.
+func logCreated(ll log.FieldLogger, kind, name string, err error) error {
+	ll = ll.WithField("name", name)
+	switch {
+	case k8sErrors.IsAlreadyExists(err):
+		ll.Infof("%s already exists", kind)
+	case err != nil:
+		return fmt.Errorf("creating %s %q: %w", kind, name, err)
+	default:
+		ll.Infof("created %s", kind)
+	}
+	return nil
+}
+
+// validateCIDRs returns an error if any of the cidrs is invalid.
+func validateCIDRs(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package bootstrap
+
+import (
+	"testing"
+
+	wgfake "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestApply(t *testing.T) {
+	b, err := New(
+		WithLogger(logrus.New()),
+		WithNamespace("mesh"),
+		WithIPPool("default", []string{"10.0.0.0/24", "fd00::/64"}),
+	)
+	require.NoError(t, err)
+
+	// A Role from an older release is updated with the current rules.
+	kube := kubefake.NewSimpleClientset(&rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "wgmesh-agent", Namespace: "mesh"},
+	})
+	wg := wgfake.NewSimpleClientset()
+	require.NoError(t, b.Apply(kube, wg))
+	// Applying again is a no-op.
+	require.NoError(t, b.Apply(kube, wg))
+
+	_, err = kube.CoreV1().Namespaces().Get("mesh", metav1.GetOptions{})
+	require.NoError(t, err)
+	_, err = kube.CoreV1().ServiceAccounts("mesh").Get("wgmesh-agent", metav1.GetOptions{})
+	require.NoError(t, err)
+	role, err := kube.RbacV1().Roles("mesh").Get("wgmesh-agent", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, b.Role().Rules, role.Rules)
+	binding, err := kube.RbacV1().RoleBindings("mesh").Get("wgmesh-agent", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "wgmesh-agent", binding.Subjects[0].Name)
+	pool, err := wg.WgmeshV1alpha1().IPPools("mesh").Get("default", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, pool.Spec.IPRanges, 2)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New()
+	require.Error(t, err, "namespace is required")
+	_, err = New(WithNamespace("mesh"), WithIPPool("default", []string{"10.0.0.1"}))
+	require.Error(t, err)
+
+	b, err := New(WithNamespace("mesh"))
+	require.NoError(t, err)
+	require.Nil(t, b.IPPool())
+	require.Len(t, b.Objects(), 4)
+	manifest, err := b.Manifest()
+	require.NoError(t, err)
+	require.Contains(t, string(manifest), "kind: RoleBinding")
+}
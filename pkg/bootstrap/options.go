@@ -0,0 +1,64 @@
+package bootstrap
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+type options struct {
+	ll log.FieldLogger
+
+	namespace string
+	// agentName names the agents' ServiceAccount, Role, and RoleBinding.
+	agentName string
+	poolName  string
+	poolCIDRs []string
+}
+
+func defaultOptions() options {
+	return options{
+		ll:        log.New(),
+		agentName: "wgmesh-agent",
+		poolName:  "default",
+	}
+}
+
+// OptionFunc describes the function signature for methods which modify the bootstrap options.
+type OptionFunc func(*options) error
+
+// WithLogger sets a logger on the bootstrap options.
+func WithLogger(ll log.FieldLogger) OptionFunc {
+	return func(o *options) error {
+		o.ll = ll
+		return nil
+	}
+}
+
+// WithNamespace sets the registry namespace.
+func WithNamespace(namespace string) OptionFunc {
+	return func(o *options) error {
+		o.namespace = namespace
+		return nil
+	}
+}
+
+// WithAgentName sets the name of the agents' ServiceAccount, Role, and RoleBinding. Defaults to
+// wgmesh-agent.
+func WithAgentName(name string) OptionFunc {
+	return func(o *options) error {
+		o.agentName = name
+		return nil
+	}
+}
+
+// WithIPPool creates an initial IPPool with a range for each of the CIDRs. No pool is created if
+// cidrs is empty.
+func WithIPPool(name string, cidrs []string) OptionFunc {
+	return func(o *options) error {
+		if err := validateCIDRs(cidrs); err != nil {
+			return err
+		}
+		o.poolName = name
+		o.poolCIDRs = cidrs
+		return nil
+	}
+}
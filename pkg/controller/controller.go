@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgmeshScheme "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/scheme"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const controllerComponent = "wgmesh-controller"
+
+// Controller runs registry-wide maintenance tasks, like garbage collecting orphaned IPClaims.
+// Unlike the agent, these tasks should run in one place for the whole registry.
+type Controller struct {
+	options
+
+	regClientset wgmeshClientSet.Interface
+	regCS        kubernetes.Interface
+	localCS      kubernetes.Interface
+}
+
+// NewController creates a controller for the registry.
+func NewController(optionFuncs ...OptionFunc) (*Controller, error) {
+	c := &Controller{
+		options: defaultOptions(),
+	}
+	for _, f := range optionFuncs {
+		err := f(&c.options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.registryKubeClientConfig == nil && c.registry == nil {
+		return nil, fmt.Errorf("registry kubeconfig is required")
+	}
+	if c.registry != nil && (c.registryKubeClientConfig != nil || c.localKubeClientConfig != nil || c.leaderElection) {
+		return nil, fmt.Errorf("a registry only supports IPClaim garbage collection")
+	}
+	return c, nil
+}
+
+// Run executes the controller until the context is canceled.
+func (c *Controller) Run(ctx context.Context) error {
+	if c.registry != nil {
+		c.runPeriodic(ctx, "ipclaim-gc", c.gcInterval, newIPClaimGC(c.ll, registryStore{c.registry}, c.gcGracePeriod).collect)
+		<-ctx.Done()
+		return nil
+	}
+	c.ll.Debugf("building registry kubernetes clientset")
+	registryConfig, err := c.registryKubeClientConfig.ClientConfig()
+	if err != nil {
+		return fmt.Errorf("building restconfig from registry kubeconfig: %w", err)
+	}
+	c.regClientset, err = wgmeshClientSet.NewForConfig(registryConfig)
+	if err != nil {
+		return fmt.Errorf("building registry wgmesh clientset: %w", err)
+	}
+	c.regCS, err = kubernetes.NewForConfig(registryConfig)
+	if err != nil {
+		return fmt.Errorf("building registry kubernetes clientset: %w", err)
+	}
+	if c.localKubeClientConfig != nil {
+		localConfig, err := c.localKubeClientConfig.ClientConfig()
+		if err != nil {
+			return fmt.Errorf("building restconfig from local kubeconfig: %w", err)
+		}
+		c.localCS, err = kubernetes.NewForConfig(localConfig)
+		if err != nil {
+			return fmt.Errorf("building local clientset: %w", err)
+		}
+	}
+	broadcaster := record.NewBroadcaster()
+	sink := broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: c.regCS.CoreV1().Events(c.registryNamespace)})
+	defer sink.Stop()
+	recorder := broadcaster.NewRecorder(wgmeshScheme.Scheme, corev1.EventSource{Component: controllerComponent})
+
+	if c.leaderElection {
+		return c.runLeaderElected(ctx, recorder, func(ctx context.Context) {
+			c.runControllers(ctx, recorder)
+		})
+	}
+	c.runControllers(ctx, recorder)
+	return nil
+}
+
+// runControllers starts each controller, and blocks until the context is canceled.
+func (c *Controller) runControllers(ctx context.Context, recorder record.EventRecorder) {
+	c.runPeriodic(ctx, "ipclaim-gc", c.gcInterval, newIPClaimGC(c.ll, clientsetStore{c.regClientset, c.registryNamespace}, c.gcGracePeriod).collect)
+	c.runPeriodic(ctx, "protected-finalizer", c.gcInterval, newProtectedFinalizerRemover(c.ll, c.regClientset, c.registryNamespace).sync)
+	c.runPeriodic(ctx, "ip-conflict", c.conflictInterval, newIPConflictDetector(c.ll, c.regClientset, c.registryNamespace, recorder).detect)
+	c.runPeriodic(ctx, "ippool-status", c.poolStatusInterval, newIPPoolStatusUpdater(c.ll, c.regClientset, c.registryNamespace).update)
+	if c.localCS != nil {
+		operator := newNodePeerOperator(c.ll, c.localCS, c.regClientset, c.registryNamespace, c.nodeAddressTypes, c.nodeLabels)
+		c.runPeriodic(ctx, "node-peers", c.nodeSyncInterval, operator.sync)
+	}
+	<-ctx.Done()
+}
+
+// runPeriodic calls f every interval until the context is canceled, logging any errors.
+func (c *Controller) runPeriodic(ctx context.Context, name string, interval time.Duration, f func() error) {
+	ll := c.ll.WithField("controller", name)
+	ll.Infoln("starting")
+	go wait.Until(func() {
+		if err := f(); err != nil {
+			ll.WithError(err).Error("failed")
+		}
+	}, interval, ctx.Done())
+}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	reasonIPConflict   = "IPConflict"
+	reasonNoIPConflict = "NoIPConflict"
+)
+
+// ipConflictDetector flags WireGuardPeers which publish the same address as another peer. Each
+// conflicting peer gets an IPConflict condition and a warning Event naming the other peers.
+type ipConflictDetector struct {
+	ll        log.FieldLogger
+	clientset wgmeshClientSet.Interface
+	namespace string
+	recorder  record.EventRecorder
+	now       func() time.Time
+}
+
+func newIPConflictDetector(
+	ll log.FieldLogger,
+	clientset wgmeshClientSet.Interface,
+	namespace string,
+	recorder record.EventRecorder,
+) *ipConflictDetector {
+	return &ipConflictDetector{
+		ll:        ll.WithField("controller", "ip-conflict"),
+		clientset: clientset,
+		namespace: namespace,
+		recorder:  recorder,
+		now:       time.Now,
+	}
+}
+
+// detect runs a single conflict detection pass.
+func (d *ipConflictDetector) detect() error {
+	peers, err := d.clientset.WgmeshV1alpha1().WireGuardPeers(d.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing WireGuardPeers: %w", err)
+	}
+	conflicts := findIPConflicts(peers.Items)
+	for i := range peers.Items {
+		peer := &peers.Items[i]
+		ll := wglog.WithPeer(d.ll, peer)
+		cond := wgk8s.WireGuardPeerCondition{
+			Type:               wgk8s.WireGuardPeerIPConflict,
+			Status:             corev1.ConditionFalse,
+			LastTransitionTime: metav1.NewTime(d.now()),
+			Reason:             reasonNoIPConflict,
+		}
+		if msg, ok := conflicts[peer.GetName()]; ok {
+			cond.Status = corev1.ConditionTrue
+			cond.Reason = reasonIPConflict
+			cond.Message = msg
+		} else if peer.GetCondition(wgk8s.WireGuardPeerIPConflict) == nil {
+			continue // Don't add conditions to peers which have never conflicted.
+		}
+		previous := peer.GetCondition(wgk8s.WireGuardPeerIPConflict)
+		wasConflicted := previous != nil && previous.Status == corev1.ConditionTrue
+		if !peer.SetCondition(cond) {
+			continue
+		}
+		_, err := d.clientset.WgmeshV1alpha1().WireGuardPeers(d.namespace).Update(peer)
+		if err != nil {
+			ll.WithError(err).Error("failed to update IPConflict condition")
+			continue
+		}
+		switch {
+		case cond.Status == corev1.ConditionTrue:
+			ll.WithField("conflict", cond.Message).Warn("WireGuardPeer publishes conflicting IPs")
+			d.recorder.Event(peer, corev1.EventTypeWarning, reasonIPConflict, cond.Message)
+		case wasConflicted:
+			ll.Info("WireGuardPeer IP conflict resolved")
+			d.recorder.Event(peer, corev1.EventTypeNormal, reasonNoIPConflict, "IP conflict resolved")
+		}
+	}
+	return nil
+}
+
+// findIPConflicts returns a description of the conflicts for each peer publishing an address which
+// is also published by another peer, keyed by peer name. Addresses are compared without their
+// prefix length, so 10.0.0.1/24 and 10.0.0.1/32 conflict.
+func findIPConflicts(peers []wgk8s.WireGuardPeer) map[string]string {
+	owners := make(map[string][]string)
+	for _, p := range peers {
+		seen := make(map[string]struct{})
+		for _, ipStr := range p.Spec.IPs {
+			ip, _, err := net.ParseCIDR(ipStr)
+			if err != nil {
+				ip = net.ParseIP(ipStr)
+			}
+			if ip == nil {
+				continue // Malformed addresses are the agent's problem, not a conflict.
+			}
+			key := ip.String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			owners[key] = append(owners[key], p.GetName())
+		}
+	}
+
+	perPeer := make(map[string][]string)
+	for ip, names := range owners {
+		if len(names) < 2 {
+			continue
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var others []string
+			for _, other := range names {
+				if other != name {
+					others = append(others, other)
+				}
+			}
+			perPeer[name] = append(perPeer[name],
+				fmt.Sprintf("%s is also published by %s", ip, strings.Join(others, ", ")))
+		}
+	}
+	out := make(map[string]string, len(perPeer))
+	for name, msgs := range perPeer {
+		sort.Strings(msgs)
+		out[name] = strings.Join(msgs, "; ")
+	}
+	return out
+}
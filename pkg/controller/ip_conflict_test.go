@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func testPeer(name string, ips ...string) *wgk8s.WireGuardPeer {
+	return &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+		Spec:       wgk8s.WireGuardPeerSpec{IPs: ips},
+	}
+}
+
+func TestFindIPConflicts(t *testing.T) {
+	tcs := []struct {
+		name   string
+		peers  []*wgk8s.WireGuardPeer
+		expect map[string]string
+	}{
+		{
+			name: "no conflicts",
+			peers: []*wgk8s.WireGuardPeer{
+				testPeer("a", "10.0.0.1/24"),
+				testPeer("b", "10.0.0.2/24"),
+			},
+			expect: map[string]string{},
+		},
+		{
+			name: "different prefix lengths",
+			peers: []*wgk8s.WireGuardPeer{
+				testPeer("a", "10.0.0.1/24", "fd00::1/64"),
+				testPeer("b", "10.0.0.1/32"),
+				testPeer("c", "fd00:0::1/128", "10.0.0.1/24"),
+			},
+			expect: map[string]string{
+				"a": "10.0.0.1 is also published by b, c; fd00::1 is also published by c",
+				"b": "10.0.0.1 is also published by a, c",
+				"c": "10.0.0.1 is also published by a, b; fd00::1 is also published by a",
+			},
+		},
+		{
+			name: "repeated by the same peer",
+			peers: []*wgk8s.WireGuardPeer{
+				testPeer("a", "10.0.0.1/24", "10.0.0.1/32", "garbage"),
+			},
+			expect: map[string]string{},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var peers []wgk8s.WireGuardPeer
+			for _, p := range tc.peers {
+				peers = append(peers, *p)
+			}
+			require.Equal(t, tc.expect, findIPConflicts(peers))
+		})
+	}
+}
+
+func TestIPConflictDetector(t *testing.T) {
+	cs := fake.NewSimpleClientset(
+		testPeer("a", "10.0.0.1/24"),
+		testPeer("b", "10.0.0.1/24"),
+		testPeer("c", "10.0.0.3/24"),
+	)
+	recorder := record.NewFakeRecorder(10)
+	d := newIPConflictDetector(logrus.New(), cs, "ns", recorder)
+	peers := cs.WgmeshV1alpha1().WireGuardPeers("ns")
+
+	require.NoError(t, d.detect())
+	for _, name := range []string{"a", "b"} {
+		p, err := peers.Get(name, metav1.GetOptions{})
+		require.NoError(t, err)
+		cond := p.GetCondition(wgk8s.WireGuardPeerIPConflict)
+		require.NotNil(t, cond)
+		require.Equal(t, corev1.ConditionTrue, cond.Status)
+	}
+	c, err := peers.Get("c", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Nil(t, c.GetCondition(wgk8s.WireGuardPeerIPConflict))
+	require.Len(t, recorder.Events, 2)
+	require.Contains(t, <-recorder.Events, "Warning IPConflict 10.0.0.1 is also published by")
+	<-recorder.Events
+
+	// A second pass with no changes shouldn't emit more events.
+	require.NoError(t, d.detect())
+	require.Len(t, recorder.Events, 0)
+
+	// Resolve the conflict.
+	b, err := peers.Get("b", metav1.GetOptions{})
+	require.NoError(t, err)
+	b.Spec.IPs = []string{"10.0.0.2/24"}
+	_, err = peers.Update(b)
+	require.NoError(t, err)
+	require.NoError(t, d.detect())
+	for _, name := range []string{"a", "b"} {
+		p, err := peers.Get(name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, corev1.ConditionFalse, p.GetCondition(wgk8s.WireGuardPeerIPConflict).Status)
+	}
+	require.Len(t, recorder.Events, 2)
+	require.Equal(t, "Normal NoIPConflict IP conflict resolved", <-recorder.Events)
+}
@@ -0,0 +1,267 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	log "github.com/sirupsen/logrus"
+
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// gcStore is the registry the IPClaim GC collects from. Deletes fail with a Conflict if the
+// record's UID doesn't match.
+type gcStore interface {
+	listPeers() ([]wgk8s.WireGuardPeer, error)
+	listClaims() ([]wgk8s.IPClaim, error)
+	listMeshes() ([]wgk8s.Mesh, error)
+	deletePeer(name string, uid types.UID) error
+	deleteClaim(name string, uid types.UID) error
+}
+
+// clientsetStore is a gcStore for a namespace of a Kubernetes registry.
+type clientsetStore struct {
+	clientset wgmeshClientSet.Interface
+	namespace string
+}
+
+func (s clientsetStore) listPeers() ([]wgk8s.WireGuardPeer, error) {
+	peers, err := s.clientset.WgmeshV1alpha1().WireGuardPeers(s.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return peers.Items, nil
+}
+
+func (s clientsetStore) listClaims() ([]wgk8s.IPClaim, error) {
+	claims, err := s.clientset.WgmeshV1alpha1().IPClaims(s.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return claims.Items, nil
+}
+
+func (s clientsetStore) listMeshes() ([]wgk8s.Mesh, error) {
+	meshes, err := s.clientset.WgmeshV1alpha1().Meshes(s.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return meshes.Items, nil
+}
+
+func (s clientsetStore) deletePeer(name string, uid types.UID) error {
+	return s.clientset.WgmeshV1alpha1().WireGuardPeers(s.namespace).Delete(
+		name, metav1.NewPreconditionDeleteOptions(string(uid)))
+}
+
+func (s clientsetStore) deleteClaim(name string, uid types.UID) error {
+	return s.clientset.WgmeshV1alpha1().IPClaims(s.namespace).Delete(
+		name, metav1.NewPreconditionDeleteOptions(string(uid)))
+}
+
+// registryStore is a gcStore for a registry which stores its own IPClaims, ex. the in-memory
+// registry of `wgmesh server`.
+type registryStore struct {
+	registry registry.Registry
+}
+
+func (s registryStore) listPeers() ([]wgk8s.WireGuardPeer, error) {
+	o, err := s.registry.WatchPeers(nil, nil).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return o.(*wgk8s.WireGuardPeerList).Items, nil
+}
+
+func (s registryStore) listClaims() ([]wgk8s.IPClaim, error) {
+	return registry.ListClaims(s.registry)
+}
+
+func (s registryStore) listMeshes() ([]wgk8s.Mesh, error) {
+	o, err := s.registry.WatchMeshes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return o.(*wgk8s.MeshList).Items, nil
+}
+
+func (s registryStore) deletePeer(name string, uid types.UID) error {
+	return s.registry.Delete(name, uid)
+}
+
+func (s registryStore) deleteClaim(name string, uid types.UID) error {
+	return registry.DeleteClaim(s.registry, name, uid)
+}
+
+// ipClaimGC deletes IPClaims whose lease has expired, and unleased IPClaims whose owning
+// WireGuardPeer no longer exists. Unleased claims must remain orphaned for the grace period before
+// they're collected, so agents have a chance to re-adopt claims after their WireGuardPeer is
+// re-created. A Mesh in the namespace may override the grace period. A WireGuardPeer whose lease
+// expired is gone too, so it's deleted along with its claims, before its addresses are reused.
+type ipClaimGC struct {
+	ll    log.FieldLogger
+	store gcStore
+	grace time.Duration
+
+	// orphanedSince tracks when we first observed each claim as orphaned.
+	orphanedSince map[types.UID]time.Time
+	now           func() time.Time
+}
+
+func newIPClaimGC(ll log.FieldLogger, store gcStore, grace time.Duration) *ipClaimGC {
+	return &ipClaimGC{
+		ll:            ll.WithField("controller", "ipclaim-gc"),
+		store:         store,
+		grace:         grace,
+		orphanedSince: make(map[types.UID]time.Time),
+		now:           time.Now,
+	}
+}
+
+// collect runs a single garbage collection pass.
+func (g *ipClaimGC) collect() error {
+	peers, err := g.store.listPeers()
+	if err != nil {
+		return fmt.Errorf("listing WireGuardPeers: %w", err)
+	}
+	peerUIDs := make(map[string]types.UID, len(peers))
+	for _, p := range peers {
+		peerUIDs[p.GetName()] = p.GetUID()
+	}
+
+	claims, err := g.store.listClaims()
+	if err != nil {
+		return fmt.Errorf("listing IPClaims: %w", err)
+	}
+	grace := g.gracePeriod()
+	now := g.now()
+	seen := make(map[types.UID]struct{}, len(claims))
+	// expired are the WireGuardPeers whose leases expired, by name.
+	expired := make(map[string]types.UID)
+	for _, claim := range claims {
+		seen[claim.GetUID()] = struct{}{}
+		ll := g.ll.WithFields(log.Fields{
+			"k8s_namespace": claim.GetNamespace(),
+			"k8s_name":      claim.GetName(),
+			"ip":            claim.Spec.IP,
+		})
+		if claim.Spec.LeaseExpires != nil {
+			// Leased claims are renewed by a live owner, so the lease alone decides. A peer which
+			// is temporarily offline keeps its address until the lease lapses, even if its
+			// WireGuardPeer was deleted.
+			delete(g.orphanedSince, claim.GetUID())
+			if claim.LeaseExpired(now) {
+				ll.WithField("lease_expires", claim.Spec.LeaseExpires.String()).Info("deleting IPClaim with expired lease")
+				g.delete(ll, &claim)
+				if owner, ok := leaseOwner(&claim, peerUIDs); ok {
+					expired[owner] = peerUIDs[owner]
+				}
+			}
+			continue
+		}
+		reason := orphanReason(&claim, peerUIDs)
+		if reason == "" {
+			delete(g.orphanedSince, claim.GetUID())
+			continue
+		}
+		since, ok := g.orphanedSince[claim.GetUID()]
+		if !ok {
+			ll.WithField("reason", reason).Info("IPClaim is orphaned; will collect after grace period")
+			g.orphanedSince[claim.GetUID()] = now
+			since = now
+		}
+		if now.Sub(since) < grace {
+			continue
+		}
+		ll.WithField("reason", reason).Info("deleting orphaned IPClaim")
+		g.delete(ll, &claim)
+	}
+	for name, uid := range expired {
+		ll := g.ll.WithField("k8s_name", name)
+		ll.Info("deleting WireGuardPeer whose IPClaim lease expired")
+		err := g.store.deletePeer(name, uid)
+		if err != nil && !k8sErrors.IsNotFound(err) && !k8sErrors.IsConflict(err) {
+			ll.WithError(err).Error("failed to delete WireGuardPeer")
+		}
+	}
+	// Forget claims which were deleted by someone else.
+	for uid := range g.orphanedSince {
+		if _, ok := seen[uid]; !ok {
+			delete(g.orphanedSince, uid)
+		}
+	}
+	return nil
+}
+
+// gracePeriod returns the longest IPClaimGCGracePeriod set by a Mesh, or the configured grace
+// period if no Mesh sets one.
+func (g *ipClaimGC) gracePeriod() time.Duration {
+	meshes, err := g.store.listMeshes()
+	if err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			g.ll.WithError(err).Warn("failed to list Meshes; using the default grace period")
+		}
+		return g.grace
+	}
+	var grace *time.Duration
+	for _, m := range meshes {
+		if p := m.Spec.IPClaimGCGracePeriod; p != nil && (grace == nil || p.Duration > *grace) {
+			grace = &p.Duration
+		}
+	}
+	if grace == nil {
+		return g.grace
+	}
+	return *grace
+}
+
+// delete removes the claim, provided it hasn't been re-created since we listed it.
+func (g *ipClaimGC) delete(ll log.FieldLogger, claim *wgk8s.IPClaim) {
+	err := g.store.deleteClaim(claim.GetName(), claim.GetUID())
+	if err != nil && !k8sErrors.IsNotFound(err) && !k8sErrors.IsConflict(err) {
+		ll.WithError(err).Error("failed to delete IPClaim")
+		return
+	}
+	delete(g.orphanedSince, claim.GetUID())
+}
+
+// orphanReason returns a description of why the claim is orphaned, or an empty string if the claim
+// is owned by an existing WireGuardPeer. Claims without a WireGuardPeer owner were created by hand
+// (ex. as reservations) and are never considered orphaned.
+func orphanReason(claim *wgk8s.IPClaim, peerUIDs map[string]types.UID) string {
+	var reason string
+	for _, o := range claim.GetOwnerReferences() {
+		if o.Kind != "WireGuardPeer" || o.APIVersion != wgk8s.SchemeGroupVersion.String() {
+			continue
+		}
+		uid, ok := peerUIDs[o.Name]
+		switch {
+		case !ok:
+			reason = fmt.Sprintf("owner %q does not exist", o.Name)
+		case o.UID != "" && o.UID != uid:
+			reason = fmt.Sprintf("owner %q was re-created", o.Name)
+		default:
+			return ""
+		}
+	}
+	return reason
+}
+
+// leaseOwner returns the name of the existing WireGuardPeer which holds the leased claim. Owners
+// without a UID aren't matched, so a re-created peer isn't deleted for its predecessor's lease.
+func leaseOwner(claim *wgk8s.IPClaim, peerUIDs map[string]types.UID) (string, bool) {
+	for _, o := range claim.GetOwnerReferences() {
+		if o.Kind != "WireGuardPeer" || o.APIVersion != wgk8s.SchemeGroupVersion.String() {
+			continue
+		}
+		if uid, ok := peerUIDs[o.Name]; ok && o.UID != "" && o.UID == uid {
+			return o.Name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testClaim(name, uid string, owner *metav1.OwnerReference) *wgk8s.IPClaim {
+	c := &wgk8s.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      name,
+			UID:       types.UID(uid),
+		},
+		Spec: wgk8s.IPClaimSpec{IP: "10.0.0.1"},
+	}
+	if owner != nil {
+		c.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	return c
+}
+
+func peerOwner(name, uid string) *metav1.OwnerReference {
+	return &metav1.OwnerReference{
+		APIVersion: wgk8s.SchemeGroupVersion.String(),
+		Kind:       "WireGuardPeer",
+		Name:       name,
+		UID:        types.UID(uid),
+	}
+}
+
+func TestIPClaimGC(t *testing.T) {
+	cs := fake.NewSimpleClientset(
+		&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "alive", UID: "alive-uid"}},
+		&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "recreated", UID: "new-uid"}},
+		testClaim("owned", "1", peerOwner("alive", "alive-uid")),
+		testClaim("manual", "2", nil),
+		testClaim("gone", "3", peerOwner("gone", "gone-uid")),
+		testClaim("recreated", "4", peerOwner("recreated", "old-uid")),
+	)
+	now := time.Now()
+	g := newIPClaimGC(logrus.New(), clientsetStore{cs, "ns"}, time.Minute)
+	g.now = func() time.Time { return now }
+
+	remaining := func() []string {
+		claims, err := cs.WgmeshV1alpha1().IPClaims("ns").List(metav1.ListOptions{})
+		require.NoError(t, err)
+		var names []string
+		for _, c := range claims.Items {
+			names = append(names, c.Name)
+		}
+		return names
+	}
+
+	require.NoError(t, g.collect())
+	require.ElementsMatch(t, []string{"owned", "manual", "gone", "recreated"}, remaining(),
+		"nothing should be deleted within the grace period")
+
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, g.collect())
+	require.ElementsMatch(t, []string{"owned", "manual"}, remaining())
+	require.Empty(t, g.orphanedSince)
+}
+
+func TestIPClaimGCLeases(t *testing.T) {
+	now := time.Now()
+	leased := func(name, uid string, owner *metav1.OwnerReference, expires time.Time) *wgk8s.IPClaim {
+		c := testClaim(name, uid, owner)
+		e := metav1.NewTime(expires)
+		c.Spec.LeaseExpires = &e
+		return c
+	}
+	cs := fake.NewSimpleClientset(
+		&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "offline", UID: "offline-uid"}},
+		leased("expired", "1", peerOwner("offline", "offline-uid"), now.Add(-time.Second)),
+		leased("valid-owner-gone", "2", peerOwner("gone", "gone-uid"), now.Add(time.Minute)),
+	)
+	g := newIPClaimGC(logrus.New(), clientsetStore{cs, "ns"}, time.Hour)
+	g.now = func() time.Time { return now }
+
+	require.NoError(t, g.collect())
+	claims, err := cs.WgmeshV1alpha1().IPClaims("ns").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, claims.Items, 1)
+	require.Equal(t, "valid-owner-gone", claims.Items[0].Name,
+		"expired leases are collected immediately, even if the owner exists; valid leases are kept")
+	require.Empty(t, g.orphanedSince)
+	peers, err := cs.WgmeshV1alpha1().WireGuardPeers("ns").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Empty(t, peers.Items, "the owner of an expired lease should be collected")
+}
+
+func TestIPClaimGCRegistry(t *testing.T) {
+	now := time.Now()
+	expires := metav1.NewTime(now.Add(-time.Second))
+	renewed := metav1.NewTime(now.Add(time.Minute))
+	expired := testClaim("expired", "1", peerOwner("offline", "offline-uid"))
+	expired.Spec.LeaseExpires = &expires
+	valid := testClaim("valid", "2", peerOwner("online", "online-uid"))
+	valid.Spec.LeaseExpires = &renewed
+	r, err := registry.NewMemory("ns",
+		&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "offline", UID: "offline-uid"}},
+		&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "online", UID: "online-uid"}},
+		expired,
+		valid,
+	)
+	require.NoError(t, err)
+	g := newIPClaimGC(logrus.New(), registryStore{r}, time.Minute)
+	g.now = func() time.Time { return now }
+
+	require.NoError(t, g.collect())
+	claims, err := registry.ListClaims(r)
+	require.NoError(t, err)
+	require.Len(t, claims, 1)
+	require.Equal(t, "valid", claims[0].Name)
+	_, err = r.Get("offline")
+	require.True(t, k8sErrors.IsNotFound(err), "the owner of an expired lease should be collected")
+	_, err = r.Get("online")
+	require.NoError(t, err)
+}
+
+func TestIPClaimGCMeshGracePeriod(t *testing.T) {
+	grace := func(name string, d time.Duration) *wgk8s.Mesh {
+		return &wgk8s.Mesh{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+			Spec:       wgk8s.MeshSpec{IPClaimGCGracePeriod: &metav1.Duration{Duration: d}},
+		}
+	}
+	tcs := []struct {
+		name   string
+		meshes []*wgk8s.Mesh
+		expect time.Duration
+	}{
+		{
+			name:   "no meshes",
+			expect: time.Minute,
+		},
+		{
+			name:   "mesh without grace period",
+			meshes: []*wgk8s.Mesh{&wgk8s.Mesh{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "a"}}},
+			expect: time.Minute,
+		},
+		{
+			name:   "longest wins",
+			meshes: []*wgk8s.Mesh{grace("a", time.Second), grace("b", time.Hour)},
+			expect: time.Hour,
+		},
+		{
+			name:   "shorter than default",
+			meshes: []*wgk8s.Mesh{grace("a", time.Second)},
+			expect: time.Second,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// The fake's object tracker would guess the resource "meshs" for seeded objects, so
+			// create them through the client instead.
+			cs := fake.NewSimpleClientset()
+			for _, m := range tc.meshes {
+				_, err := cs.WgmeshV1alpha1().Meshes("ns").Create(m)
+				require.NoError(t, err)
+			}
+			g := newIPClaimGC(logrus.New(), clientsetStore{cs, "ns"}, time.Minute)
+			require.Equal(t, tc.expect, g.gracePeriod())
+		})
+	}
+}
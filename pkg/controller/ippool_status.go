@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ipPoolStatusUpdater reports the capacity and utilization of each IPPool in its status.
+type ipPoolStatusUpdater struct {
+	ll        log.FieldLogger
+	clientset wgmeshClientSet.Interface
+	namespace string
+}
+
+func newIPPoolStatusUpdater(ll log.FieldLogger, clientset wgmeshClientSet.Interface, namespace string) *ipPoolStatusUpdater {
+	return &ipPoolStatusUpdater{
+		ll:        ll.WithField("controller", "ippool-status"),
+		clientset: clientset,
+		namespace: namespace,
+	}
+}
+
+// update runs a single status pass.
+func (u *ipPoolStatusUpdater) update() error {
+	pools, err := u.clientset.WgmeshV1alpha1().IPPools(u.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing IPPools: %w", err)
+	}
+	claims, err := u.clientset.WgmeshV1alpha1().IPClaims(u.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing IPClaims: %w", err)
+	}
+	allocated := make(map[string]int64)
+	for _, c := range claims.Items {
+		allocated[c.GetLabels()[wgk8s.IPPoolLabel]]++
+	}
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		ll := u.ll.WithFields(log.Fields{
+			"k8s_namespace": pool.GetNamespace(),
+			"k8s_name":      pool.GetName(),
+		})
+		status, err := IPPoolStatus(&pool.Spec, allocated[pool.GetName()])
+		if err != nil {
+			ll.WithError(err).Warn("unable to calculate IPPool capacity")
+		}
+		if pool.Status == status {
+			continue
+		}
+		pool.Status = status
+		if _, err = u.clientset.WgmeshV1alpha1().IPPools(u.namespace).Update(pool); err != nil {
+			ll.WithError(err).Error("failed to update IPPool status")
+		}
+	}
+	return nil
+}
+
+// IPPoolStatus reports the capacity and utilization of a pool with the given number of claims. If
+// the capacity can't be calculated, only Allocated is set.
+func IPPoolStatus(spec *wgk8s.IPPoolSpec, allocated int64) (wgk8s.IPPoolStatus, error) {
+	status := wgk8s.IPPoolStatus{Allocated: allocated}
+	capacity, err := ipPoolCapacity(spec)
+	if err != nil {
+		return status, err
+	}
+	status.Capacity = capacity.String()
+	status.Utilization = utilization(allocated, capacity)
+	return status, nil
+}
+
+func utilization(allocated int64, capacity *big.Int) string {
+	if capacity.Sign() == 0 {
+		return ""
+	}
+	pct := new(big.Float).Quo(
+		new(big.Float).SetInt64(allocated*100),
+		new(big.Float).SetInt(capacity))
+	return pct.Text('f', 1) + "%"
+}
+
+// ipInterval is an inclusive range of addresses in their 16-byte form.
+type ipInterval struct {
+	start, end *big.Int
+}
+
+func (i ipInterval) size() *big.Int {
+	n := new(big.Int).Sub(i.end, i.start)
+	return n.Add(n, big.NewInt(1))
+}
+
+// ipPoolCapacity counts the addresses agents may assign from the pool, following the same rules as
+// the agent: implicit range bounds skip the network, broadcast, and Subnet-Router anycast addresses,
+// and excluded and reserved addresses are never assigned. Overlapping ranges are counted once.
+func ipPoolCapacity(spec *wgk8s.IPPoolSpec) (*big.Int, error) {
+	var ranges []ipInterval
+	for _, r := range spec.IPRanges {
+		_, cidr, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ipRanges.cidr %q", r.CIDR)
+		}
+		ones, bits := cidr.Mask.Size()
+		first, last := cidrBounds(cidr)
+		if bits == net.IPv4len*8 && ones < 31 {
+			first.Add(first, big.NewInt(1))
+			last.Sub(last, big.NewInt(1))
+		} else if bits == net.IPv6len*8 && ones < 127 {
+			first.Add(first, big.NewInt(1))
+		}
+		if r.Start != "" {
+			if first, err = parseBound(r.Start, cidr); err != nil {
+				return nil, fmt.Errorf("parsing ipRanges.start: %w", err)
+			}
+		}
+		if r.End != "" {
+			if last, err = parseBound(r.End, cidr); err != nil {
+				return nil, fmt.Errorf("parsing ipRanges.end: %w", err)
+			}
+		}
+		if first.Cmp(last) > 0 {
+			return nil, fmt.Errorf("ipRanges.start is after ipRanges.end in %q", r.CIDR)
+		}
+		ranges = append(ranges, ipInterval{start: first, end: last})
+	}
+	ranges = mergeIntervals(ranges)
+
+	var excluded []ipInterval
+	for _, c := range spec.ExcludeCIDRs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("parsing excludeCIDRs %q", c)
+		}
+		first, last := cidrBounds(cidr)
+		excluded = append(excluded, ipInterval{start: first, end: last})
+	}
+	excluded = mergeIntervals(excluded)
+
+	capacity := new(big.Int)
+	for _, r := range ranges {
+		capacity.Add(capacity, r.size())
+		for _, e := range excluded {
+			if overlap, ok := intersect(r, e); ok {
+				capacity.Sub(capacity, overlap.size())
+			}
+		}
+	}
+
+	seen := make(map[string]struct{})
+	for _, ipStr := range spec.Reserved {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, fmt.Errorf("parsing reserved ip %q", ipStr)
+		}
+		if _, ok := seen[ip.String()]; ok {
+			continue
+		}
+		seen[ip.String()] = struct{}{}
+		n := new(big.Int).SetBytes(ip.To16())
+		if contains(ranges, n) && !contains(excluded, n) {
+			capacity.Sub(capacity, big.NewInt(1))
+		}
+	}
+	return capacity, nil
+}
+
+func cidrBounds(cidr *net.IPNet) (first, last *big.Int) {
+	ip := cidr.IP.To16()
+	mask := cidr.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12:12], mask...)
+	}
+	lastIP := make(net.IP, net.IPv6len)
+	for i := range ip {
+		lastIP[i] = ip[i] | ^mask[i]
+	}
+	return new(big.Int).SetBytes(ip), new(big.Int).SetBytes(lastIP)
+}
+
+func parseBound(s string, cidr *net.IPNet) (*big.Int, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if !cidr.Contains(ip) {
+		return nil, fmt.Errorf("%q is not contained by cidr %q", s, cidr)
+	}
+	return new(big.Int).SetBytes(ip.To16()), nil
+}
+
+// mergeIntervals sorts the intervals and combines any which overlap or abut.
+func mergeIntervals(in []ipInterval) []ipInterval {
+	sort.Slice(in, func(i, j int) bool { return in[i].start.Cmp(in[j].start) < 0 })
+	var out []ipInterval
+	for _, i := range in {
+		if n := len(out); n > 0 {
+			next := new(big.Int).Add(out[n-1].end, big.NewInt(1))
+			if i.start.Cmp(next) <= 0 {
+				if i.end.Cmp(out[n-1].end) > 0 {
+					out[n-1].end = i.end
+				}
+				continue
+			}
+		}
+		out = append(out, i)
+	}
+	return out
+}
+
+func intersect(a, b ipInterval) (ipInterval, bool) {
+	start, end := a.start, a.end
+	if b.start.Cmp(start) > 0 {
+		start = b.start
+	}
+	if b.end.Cmp(end) < 0 {
+		end = b.end
+	}
+	return ipInterval{start: start, end: end}, start.Cmp(end) <= 0
+}
+
+func contains(intervals []ipInterval, n *big.Int) bool {
+	for _, i := range intervals {
+		if i.start.Cmp(n) <= 0 && n.Cmp(i.end) <= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIPPoolCapacity(t *testing.T) {
+	tcs := []struct {
+		name        string
+		spec        wgk8s.IPPoolSpec
+		expect      string
+		expectError string
+	}{
+		{
+			name:   "ipv4 default bounds",
+			spec:   wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/24"}}},
+			expect: "254",
+		},
+		{
+			name:   "ipv4 /31",
+			spec:   wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/31"}}},
+			expect: "2",
+		},
+		{
+			name:   "ipv6 default bounds",
+			spec:   wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "fd00::/64"}}},
+			expect: "18446744073709551615",
+		},
+		{
+			name: "explicit bounds",
+			spec: wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{
+				{CIDR: "10.0.0.0/24", Start: "10.0.0.10", End: "10.0.0.19"},
+			}},
+			expect: "10",
+		},
+		{
+			name: "overlapping ranges, exclusions and reservations",
+			spec: wgk8s.IPPoolSpec{
+				IPRanges: []wgk8s.IPRange{
+					{CIDR: "10.0.0.0/24", Start: "10.0.0.10", End: "10.0.0.19"},
+					{CIDR: "10.0.0.0/24", Start: "10.0.0.15", End: "10.0.0.24"},
+				},
+				ExcludeCIDRs: []string{"10.0.0.16/30", "10.0.0.16/31"},
+				// .12 is reserved twice, .17 is already excluded, and .100 isn't in a range.
+				Reserved: []string{"10.0.0.12", "10.0.0.12", "10.0.0.17", "10.0.0.100"},
+			},
+			expect: "10",
+		},
+		{
+			name:        "bad cidr",
+			spec:        wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0"}}},
+			expectError: `parsing ipRanges.cidr "10.0.0.0"`,
+		},
+		{
+			name: "start after end",
+			spec: wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{
+				{CIDR: "10.0.0.0/24", Start: "10.0.0.20", End: "10.0.0.10"},
+			}},
+			expectError: `ipRanges.start is after ipRanges.end in "10.0.0.0/24"`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			capacity, err := ipPoolCapacity(&tc.spec)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, capacity.String())
+		})
+	}
+}
+
+func TestIPPoolStatusUpdate(t *testing.T) {
+	claim := func(name, pool string) *wgk8s.IPClaim {
+		return &wgk8s.IPClaim{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      name,
+			Labels:    map[string]string{wgk8s.IPPoolLabel: pool},
+		}}
+	}
+	cs := fake.NewSimpleClientset(
+		&wgk8s.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "small"},
+			Spec:       wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/30"}}},
+		},
+		&wgk8s.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "broken"},
+			Spec:       wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "garbage"}}},
+		},
+		claim("a", "small"),
+		claim("b", "broken"),
+	)
+	u := newIPPoolStatusUpdater(logrus.New(), cs, "ns")
+	require.NoError(t, u.update())
+
+	small, err := cs.WgmeshV1alpha1().IPPools("ns").Get("small", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, wgk8s.IPPoolStatus{Capacity: "2", Allocated: 1, Utilization: "50.0%"}, small.Status)
+
+	broken, err := cs.WgmeshV1alpha1().IPPools("ns").Get("broken", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, wgk8s.IPPoolStatus{Allocated: 1}, broken.Status)
+}
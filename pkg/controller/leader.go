@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+// runLeaderElected calls run while we hold the controller Lease. The context passed to run is
+// canceled if we lose the Lease, and we return an error so the process restarts and rejoins the
+// election with a clean slate, rather than risk acting alongside the new leader.
+func (c *Controller) runLeaderElected(ctx context.Context, recorder record.EventRecorder, run func(ctx context.Context)) error {
+	identity := c.leaderIdentity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("determining leader election identity: %w", err)
+		}
+		identity = hostname
+	}
+	ll := c.ll.WithField("lease", c.leaderElectionID).WithField("identity", identity)
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{Namespace: c.registryNamespace, Name: c.leaderElectionID},
+			Client:    c.regCS.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity:      identity,
+				EventRecorder: recorder,
+			},
+		},
+		LeaseDuration:   c.leaseDuration,
+		RenewDeadline:   c.leaseRenewDeadline,
+		RetryPeriod:     c.leaseRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            c.leaderElectionID,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				ll.Infoln("acquired leadership; starting controllers")
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				ll.Infoln("stopped leading")
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					ll.WithField("leader", leader).Infoln("another replica is leading")
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("configuring leader election: %w", err)
+	}
+	ll.Infoln("waiting for leadership")
+	elector.Run(ctx)
+	if ctx.Err() == nil {
+		return fmt.Errorf("lost leadership of lease %q", c.leaderElectionID)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRunLeaderElected(t *testing.T) {
+	cs := kubefake.NewSimpleClientset()
+	newReplica := func(identity string) *Controller {
+		c := &Controller{options: defaultOptions(), regCS: cs}
+		c.ll = logrus.New()
+		c.registryNamespace = "ns"
+		require.NoError(t, WithLeaderElection("wgmesh-controller", identity)(&c.options))
+		require.NoError(t, WithLeaseTimings(3*time.Second, 2*time.Second, 100*time.Millisecond)(&c.options))
+		return c
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leading := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- newReplica("a").runLeaderElected(ctx, record.NewFakeRecorder(10), func(ctx context.Context) {
+			close(leading)
+			<-ctx.Done()
+		})
+	}()
+	select {
+	case <-leading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first replica never acquired leadership")
+	}
+
+	// A second replica must not run while the first holds the lease.
+	standbyCtx, standbyCancel := context.WithTimeout(context.Background(), time.Second)
+	defer standbyCancel()
+	err := newReplica("b").runLeaderElected(standbyCtx, record.NewFakeRecorder(10), func(ctx context.Context) {
+		t.Error("second replica acquired leadership while the first held it")
+	})
+	require.NoError(t, err)
+
+	lease, err := cs.CoordinationV1().Leases("ns").Get("wgmesh-controller", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "a", *lease.Spec.HolderIdentity)
+
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+
+	"github.com/jcodybaker/wgmesh/pkg/agent"
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// nodePeerOperator maintains a WireGuardPeer for each Node in the local cluster, so node agents
+// only need to program their interface. Agents announce their public key and listen port with
+// annotations on their Node; the operator derives the rest of the record from the Node: its
+// endpoint from the node's address, its addresses and routes from the podCIDRs, and its region and
+// zone from the topology labels. Records are deleted when their Node is.
+type nodePeerOperator struct {
+	ll           log.FieldLogger
+	localCS      kubernetes.Interface
+	clientset    wgmeshClientSet.Interface
+	namespace    string
+	addressTypes []corev1.NodeAddressType
+	// labelKeys are the Node labels copied to each WireGuardPeer, so peer selectors can match them.
+	labelKeys []string
+}
+
+func newNodePeerOperator(ll log.FieldLogger, localCS kubernetes.Interface, clientset wgmeshClientSet.Interface, namespace string, addressTypes []corev1.NodeAddressType, labelKeys []string) *nodePeerOperator {
+	return &nodePeerOperator{
+		ll:           ll.WithField("controller", "node-peers"),
+		localCS:      localCS,
+		clientset:    clientset,
+		namespace:    namespace,
+		addressTypes: addressTypes,
+		labelKeys:    labelKeys,
+	}
+}
+
+// sync runs a single reconciliation pass.
+func (o *nodePeerOperator) sync() error {
+	nodes, err := o.localCS.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing Nodes: %w", err)
+	}
+	peers := o.clientset.WgmeshV1alpha1().WireGuardPeers(o.namespace)
+	managedList, err := peers.List(metav1.ListOptions{LabelSelector: wgk8s.NodeLabel})
+	if err != nil {
+		return fmt.Errorf("listing WireGuardPeers: %w", err)
+	}
+	managed := make(map[string]*wgk8s.WireGuardPeer, len(managedList.Items))
+	for i := range managedList.Items {
+		managed[managedList.Items[i].GetName()] = &managedList.Items[i]
+	}
+
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		ll := o.ll.WithField("k8s_node", node.GetName())
+		existing := managed[node.GetName()]
+		delete(managed, node.GetName())
+		desired, err := nodePeer(node, o.addressTypes, o.labelKeys)
+		if err != nil {
+			ll.WithError(err).Warn("unable to build WireGuardPeer for node")
+			continue
+		}
+		if desired == nil {
+			// The node's agent hasn't announced itself yet. We keep any existing record, since
+			// the node may only have lost the annotations temporarily.
+			continue
+		}
+		if existing == nil {
+			ll.Info("creating WireGuardPeer for node")
+			_, err = peers.Create(desired)
+			if k8sErrors.IsAlreadyExists(err) {
+				ll.Warn("a WireGuardPeer not managed by the operator already has the node's name")
+				continue
+			}
+			if err != nil {
+				ll.WithError(err).Error("failed to create WireGuardPeer for node")
+			}
+			continue
+		}
+		if reflect.DeepEqual(existing.Spec, desired.Spec) && reflect.DeepEqual(existing.GetLabels(), desired.GetLabels()) {
+			continue
+		}
+		ll.Info("updating WireGuardPeer for node")
+		updated := existing.DeepCopy()
+		updated.Spec = desired.Spec
+		updated.SetLabels(desired.GetLabels())
+		_, err = peers.Update(updated)
+		if err != nil && !k8sErrors.IsConflict(err) {
+			ll.WithError(err).Error("failed to update WireGuardPeer for node")
+		}
+	}
+
+	// Whatever's left belongs to a node which no longer exists.
+	for name, p := range managed {
+		ll := o.ll.WithField("k8s_node", name)
+		ll.Info("deleting WireGuardPeer for removed node")
+		err = peers.Delete(name, metav1.NewPreconditionDeleteOptions(string(p.GetUID())))
+		if err != nil && !k8sErrors.IsNotFound(err) && !k8sErrors.IsConflict(err) {
+			ll.WithError(err).Error("failed to delete WireGuardPeer for removed node")
+		}
+	}
+	return nil
+}
+
+// nodePeer returns the WireGuardPeer describing the node, or nil if the node's agent hasn't
+// announced its public key.
+func nodePeer(node *corev1.Node, addressTypes []corev1.NodeAddressType, labelKeys []string) (*wgk8s.WireGuardPeer, error) {
+	annotations := node.GetAnnotations()
+	publicKey := annotations[wgk8s.NodePublicKeyAnnotation]
+	if publicKey == "" {
+		return nil, nil
+	}
+	port := annotations[wgk8s.NodeListenPortAnnotation]
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return nil, fmt.Errorf("invalid %s annotation %q", wgk8s.NodeListenPortAnnotation, port)
+	}
+	addr := agent.NodeAddress(node.Status.Addresses, addressTypes)
+	if addr == "" {
+		return nil, fmt.Errorf("node has no address of types %v", addressTypes)
+	}
+	ips, routes, err := agent.PodCIDRAddresses(agent.NodePodCIDRs(node))
+	if err != nil {
+		return nil, err
+	}
+	region, zone := agent.NodeZone(node.GetLabels())
+
+	labels := map[string]string{wgk8s.NodeLabel: node.GetName()}
+	for _, k := range labelKeys {
+		if v, ok := node.GetLabels()[k]; ok {
+			labels[k] = v
+		}
+	}
+	return &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   node.GetName(),
+			Labels: labels,
+		},
+		Spec: wgk8s.WireGuardPeerSpec{
+			PublicKey: publicKey,
+			Endpoint:  net.JoinHostPort(addr, port),
+			IPs:       ips,
+			Routes:    routes,
+			Region:    region,
+			Zone:      zone,
+		},
+	}, nil
+}
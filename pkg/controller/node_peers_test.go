@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+const testPublicKey = "DNwb5OP4HvwsgdZS0nZV2GFwzBK1zjPeTOvRqf9ITxg="
+
+func testNode(name string, annotated bool) *corev1.Node {
+	n := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"topology.kubernetes.io/region": "nyc",
+				"topology.kubernetes.io/zone":   "nyc1",
+				"role":                          "worker",
+			},
+		},
+		Spec: corev1.NodeSpec{PodCIDR: "10.244.1.0/24"},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "192.168.1.10"},
+				{Type: corev1.NodeExternalIP, Address: "203.0.113.10"},
+			},
+		},
+	}
+	if annotated {
+		n.Annotations = map[string]string{
+			wgk8s.NodePublicKeyAnnotation:  testPublicKey,
+			wgk8s.NodeListenPortAnnotation: "51820",
+		}
+	}
+	return n
+}
+
+func TestNodePeer(t *testing.T) {
+	addressTypes := []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP}
+
+	p, err := nodePeer(testNode("unannounced", false), addressTypes, nil)
+	require.NoError(t, err)
+	require.Nil(t, p)
+
+	p, err = nodePeer(testNode("node-a", true), addressTypes, []string{"role", "missing"})
+	require.NoError(t, err)
+	require.Equal(t, "node-a", p.GetName())
+	require.Equal(t, map[string]string{wgk8s.NodeLabel: "node-a", "role": "worker"}, p.GetLabels())
+	require.Equal(t, wgk8s.WireGuardPeerSpec{
+		PublicKey: testPublicKey,
+		Endpoint:  "203.0.113.10:51820",
+		IPs:       []string{"10.244.1.1/32"},
+		Routes:    []string{"10.244.1.0/24"},
+		Region:    "nyc",
+		Zone:      "nyc1",
+	}, p.Spec)
+
+	badPort := testNode("node-b", true)
+	badPort.Annotations[wgk8s.NodeListenPortAnnotation] = "0"
+	_, err = nodePeer(badPort, addressTypes, nil)
+	require.Error(t, err)
+
+	_, err = nodePeer(testNode("node-c", true), []corev1.NodeAddressType{corev1.NodeHostName}, nil)
+	require.Error(t, err)
+}
+
+func TestNodePeerOperator(t *testing.T) {
+	localCS := kubefake.NewSimpleClientset(
+		testNode("node-a", true),
+		testNode("node-b", false),
+		testNode("manual", true),
+	)
+	stale := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      "node-a",
+			Labels:    map[string]string{wgk8s.NodeLabel: "node-a"},
+		},
+		Spec: wgk8s.WireGuardPeerSpec{PublicKey: testPublicKey, Endpoint: "198.51.100.1:51820"},
+	}
+	removed := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      "removed",
+			Labels:    map[string]string{wgk8s.NodeLabel: "removed"},
+		},
+	}
+	manual := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "manual"},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: testPublicKey, Endpoint: "198.51.100.2:51820"},
+	}
+	cs := fake.NewSimpleClientset(stale, removed, manual)
+	o := newNodePeerOperator(logrus.New(), localCS, cs, "ns",
+		[]corev1.NodeAddressType{corev1.NodeExternalIP}, nil)
+	require.NoError(t, o.sync())
+
+	peers, err := cs.WgmeshV1alpha1().WireGuardPeers("ns").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	byName := make(map[string]wgk8s.WireGuardPeer)
+	for _, p := range peers.Items {
+		byName[p.GetName()] = p
+	}
+	require.Len(t, byName, 2, "the removed node's peer should be deleted")
+	require.Equal(t, "203.0.113.10:51820", byName["node-a"].Spec.Endpoint)
+	require.Equal(t, "198.51.100.2:51820", byName["manual"].Spec.Endpoint,
+		"peers not managed by the operator should be left alone")
+}
@@ -0,0 +1,209 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type options struct {
+	ll log.FieldLogger
+
+	registryKubeClientConfig clientcmd.ClientConfig
+	registryNamespace        string
+	localKubeClientConfig    clientcmd.ClientConfig
+	registry                 registry.Registry
+
+	gcInterval    time.Duration
+	gcGracePeriod time.Duration
+
+	conflictInterval   time.Duration
+	poolStatusInterval time.Duration
+
+	nodeSyncInterval time.Duration
+	nodeAddressTypes []corev1.NodeAddressType
+	nodeLabels       []string
+
+	leaderElection     bool
+	leaderElectionID   string
+	leaderIdentity     string
+	leaseDuration      time.Duration
+	leaseRenewDeadline time.Duration
+	leaseRetryPeriod   time.Duration
+}
+
+func defaultOptions() options {
+	return options{
+		ll:            log.New(),
+		gcInterval:    time.Minute,
+		gcGracePeriod: 5 * time.Minute,
+
+		conflictInterval:   30 * time.Second,
+		poolStatusInterval: 30 * time.Second,
+
+		nodeSyncInterval: 30 * time.Second,
+		nodeAddressTypes: []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP},
+
+		leaderElectionID:   controllerComponent,
+		leaseDuration:      15 * time.Second,
+		leaseRenewDeadline: 10 * time.Second,
+		leaseRetryPeriod:   2 * time.Second,
+	}
+}
+
+// OptionFunc describes the function signature for methods which modify the controller options.
+type OptionFunc func(*options) error
+
+// WithLogger sets a logger on the controller options.
+func WithLogger(ll log.FieldLogger) OptionFunc {
+	return func(o *options) error {
+		o.ll = ll
+		return nil
+	}
+}
+
+// WithRegistryKubeClientConfig sets the config for the wgmesh registry.
+func WithRegistryKubeClientConfig(config clientcmd.ClientConfig) OptionFunc {
+	return func(o *options) error {
+		o.registryKubeClientConfig = config
+		if o.registryNamespace != "" {
+			return nil
+		}
+		ns, _, err := config.Namespace()
+		if err != nil {
+			return fmt.Errorf("looking up namespace for registry kubeconfig: %w", err)
+		}
+		o.registryNamespace = ns
+		return nil
+	}
+}
+
+// WithRegistry collects IPClaims from a registry which stores them itself, ex. the in-memory
+// registry served by `wgmesh server`, rather than from Kubernetes. Only IPClaim garbage collection
+// is supported.
+func WithRegistry(r registry.Registry) OptionFunc {
+	return func(o *options) error {
+		o.registry = r
+		return nil
+	}
+}
+
+// WithRegistryNamespace sets the namespace for the registry.
+func WithRegistryNamespace(registryNamespace string) OptionFunc {
+	return func(o *options) error {
+		o.registryNamespace = registryNamespace
+		return nil
+	}
+}
+
+// WithGCInterval sets how often orphaned IPClaims are collected, and protected finalizers are
+// removed from unprotected WireGuardPeers.
+func WithGCInterval(interval time.Duration) OptionFunc {
+	return func(o *options) error {
+		o.gcInterval = interval
+		return nil
+	}
+}
+
+// WithGCGracePeriod sets how long an IPClaim must be orphaned before it is deleted. This gives
+// agents time to re-adopt claims after their WireGuardPeer is re-created.
+func WithGCGracePeriod(grace time.Duration) OptionFunc {
+	return func(o *options) error {
+		o.gcGracePeriod = grace
+		return nil
+	}
+}
+
+// WithConflictInterval sets how often WireGuardPeers are checked for conflicting IPs.
+func WithConflictInterval(interval time.Duration) OptionFunc {
+	return func(o *options) error {
+		o.conflictInterval = interval
+		return nil
+	}
+}
+
+// WithPoolStatusInterval sets how often IPPool capacity and utilization are reported.
+func WithPoolStatusInterval(interval time.Duration) OptionFunc {
+	return func(o *options) error {
+		o.poolStatusInterval = interval
+		return nil
+	}
+}
+
+// WithNodeOperator maintains a WireGuardPeer for each Node in the cluster described by config. Node
+// agents run with operator-managed mode and only program their interface.
+func WithNodeOperator(config clientcmd.ClientConfig) OptionFunc {
+	return func(o *options) error {
+		o.localKubeClientConfig = config
+		return nil
+	}
+}
+
+// WithNodeSyncInterval sets how often the node operator reconciles WireGuardPeers with Nodes.
+func WithNodeSyncInterval(interval time.Duration) OptionFunc {
+	return func(o *options) error {
+		o.nodeSyncInterval = interval
+		return nil
+	}
+}
+
+// WithNodeAddressTypes sets the node address types, in order of preference, which the node
+// operator publishes as each peer's endpoint.
+func WithNodeAddressTypes(addressTypes []string) OptionFunc {
+	return func(o *options) error {
+		if len(addressTypes) == 0 {
+			return fmt.Errorf("at least one node address type is required")
+		}
+		o.nodeAddressTypes = nil
+		for _, t := range addressTypes {
+			switch corev1.NodeAddressType(t) {
+			case corev1.NodeExternalIP, corev1.NodeInternalIP, corev1.NodeExternalDNS, corev1.NodeInternalDNS, corev1.NodeHostName:
+			default:
+				return fmt.Errorf("invalid node address type %q", t)
+			}
+			o.nodeAddressTypes = append(o.nodeAddressTypes, corev1.NodeAddressType(t))
+		}
+		return nil
+	}
+}
+
+// WithNodeLabels sets the Node labels which the node operator copies to each WireGuardPeer.
+func WithNodeLabels(keys []string) OptionFunc {
+	return func(o *options) error {
+		o.nodeLabels = keys
+		return nil
+	}
+}
+
+// WithLeaderElection only runs the controllers while holding the named Lease in the registry
+// namespace, so several replicas can be deployed for availability. The identity must be unique
+// among replicas; if empty, the hostname is used.
+func WithLeaderElection(leaseName, identity string) OptionFunc {
+	return func(o *options) error {
+		if leaseName == "" {
+			return fmt.Errorf("leader election requires a lease name")
+		}
+		o.leaderElection = true
+		o.leaderElectionID = leaseName
+		o.leaderIdentity = identity
+		return nil
+	}
+}
+
+// WithLeaseTimings sets how long a leader's Lease is valid, how long the leader retries renewing it
+// before giving up, and how often candidates try to acquire it.
+func WithLeaseTimings(duration, renewDeadline, retryPeriod time.Duration) OptionFunc {
+	return func(o *options) error {
+		if duration <= renewDeadline || renewDeadline <= retryPeriod || retryPeriod <= 0 {
+			return fmt.Errorf("lease duration must exceed the renew deadline, which must exceed the retry period")
+		}
+		o.leaseDuration = duration
+		o.leaseRenewDeadline = renewDeadline
+		o.leaseRetryPeriod = retryPeriod
+		return nil
+	}
+}
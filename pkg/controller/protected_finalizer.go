@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"fmt"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	log "github.com/sirupsen/logrus"
+
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// protectedFinalizerRemover drops the protected finalizer from WireGuardPeers which are no longer
+// annotated as protected. Agents add the finalizer, but an agent which is gone can't remove it, so
+// without this a deleted peer would stay Terminating after its protection was lifted.
+type protectedFinalizerRemover struct {
+	ll        log.FieldLogger
+	clientset wgmeshClientSet.Interface
+	namespace string
+}
+
+func newProtectedFinalizerRemover(
+	ll log.FieldLogger,
+	clientset wgmeshClientSet.Interface,
+	namespace string,
+) *protectedFinalizerRemover {
+	return &protectedFinalizerRemover{
+		ll:        ll.WithField("controller", "protected-finalizer"),
+		clientset: clientset,
+		namespace: namespace,
+	}
+}
+
+// sync runs a single pass over the WireGuardPeers.
+func (r *protectedFinalizerRemover) sync() error {
+	peers, err := r.clientset.WgmeshV1alpha1().WireGuardPeers(r.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing WireGuardPeers: %w", err)
+	}
+	for i := range peers.Items {
+		peer := &peers.Items[i]
+		if peer.IsProtected() || !removeProtectedFinalizer(peer) {
+			continue
+		}
+		ll := wglog.WithPeer(r.ll, peer)
+		_, err := r.clientset.WgmeshV1alpha1().WireGuardPeers(r.namespace).Update(peer)
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			ll.WithError(err).Error("failed to remove protected finalizer")
+			continue
+		}
+		ll.Info("removed protected finalizer from unprotected WireGuardPeer")
+	}
+	return nil
+}
+
+// removeProtectedFinalizer removes the protected finalizer, returning false if it wasn't present.
+func removeProtectedFinalizer(peer *wgk8s.WireGuardPeer) bool {
+	var finalizers []string
+	for _, f := range peer.GetFinalizers() {
+		if f != wgk8s.ProtectedFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	if len(finalizers) == len(peer.GetFinalizers()) {
+		return false
+	}
+	peer.SetFinalizers(finalizers)
+	return true
+}
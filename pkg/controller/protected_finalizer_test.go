@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProtectedFinalizerRemover(t *testing.T) {
+	protected := testPeer("protected")
+	protected.Annotations = map[string]string{wgk8s.ProtectedAnnotation: "true"}
+	protected.Finalizers = []string{wgk8s.ProtectedFinalizer}
+	unprotected := testPeer("unprotected")
+	unprotected.Annotations = map[string]string{wgk8s.ProtectedAnnotation: "false"}
+	unprotected.Finalizers = []string{"other", wgk8s.ProtectedFinalizer}
+	removed := testPeer("removed")
+	removed.Finalizers = []string{wgk8s.ProtectedFinalizer}
+
+	cs := fake.NewSimpleClientset(protected, unprotected, removed, testPeer("plain"))
+	r := newProtectedFinalizerRemover(logrus.New(), cs, "ns")
+	require.NoError(t, r.sync())
+
+	peers := cs.WgmeshV1alpha1().WireGuardPeers("ns")
+	expect := map[string][]string{
+		"protected":   {wgk8s.ProtectedFinalizer},
+		"unprotected": {"other"},
+		"removed":     nil,
+		"plain":       nil,
+	}
+	for name, finalizers := range expect {
+		p, err := peers.Get(name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, finalizers, p.GetFinalizers(), name)
+	}
+}
@@ -0,0 +1,261 @@
+// Package crds builds the CustomResourceDefinitions for the wgmesh API group from the Go types, so
+// the manifests applied to a registry can't drift from types.go.
+package crds
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	log "github.com/sirupsen/logrus"
+
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+// CRDResource is the apiextensions resource which CustomResourceDefinitions are served from.
+var CRDResource = schema.GroupVersionResource{
+	Group:    "apiextensions.k8s.io",
+	Version:  "v1beta1",
+	Resource: "customresourcedefinitions",
+}
+
+// Category groups the wgmesh resources, so `kubectl get wgmesh` lists all of them.
+const Category = "wgmesh"
+
+type resource struct {
+	obj runtime.Object
+	// plural defaults to the lowercase kind with an "s" appended.
+	plural     string
+	shortNames []string
+	columns    []interface{}
+}
+
+// resources lists each wgmesh kind served by the registry.
+var resources = []resource{
+	{
+		obj:        &wgk8s.WireGuardPeer{},
+		shortNames: []string{"wgpeer"},
+		columns: []interface{}{
+			column("Endpoint", "string", ".spec.endpoint"),
+			column("Public Key", "string", ".spec.publicKey"),
+			column("IPs", "string", ".spec.ips"),
+			ageColumn,
+		},
+	},
+	{
+		obj:        &wgk8s.IPPool{},
+		shortNames: []string{"wgpool"},
+		columns: []interface{}{
+			column("Allocated", "integer", ".status.allocated"),
+			column("Capacity", "string", ".status.capacity"),
+			column("Utilization", "string", ".status.utilization"),
+			ageColumn,
+		},
+	},
+	{
+		obj:        &wgk8s.IPClaim{},
+		shortNames: []string{"wgclaim"},
+		columns: []interface{}{
+			column("IP", "string", ".spec.ip"),
+			column("Pool", "string", ".metadata.labels."+strings.ReplaceAll(wgk8s.IPPoolLabel, ".", `\.`)),
+			column("Owner", "string", ".metadata.ownerReferences[0].name"),
+			column("Reserved For", "string", ".spec.peer"),
+			column("Lease Expires", "date", ".spec.leaseExpires"),
+			ageColumn,
+		},
+	},
+	{
+		// No short name; "wgmesh" is the category.
+		obj:    &wgk8s.Mesh{},
+		plural: "meshes",
+		columns: []interface{}{
+			column("Keepalive", "integer", ".spec.keepalive"),
+			column("MTU", "integer", ".spec.mtu"),
+			ageColumn,
+		},
+	},
+	{
+		obj:        &wgk8s.WireGuardMeshPolicy{},
+		plural:     "wireguardmeshpolicies",
+		shortNames: []string{"wgpolicy"},
+		columns: []interface{}{
+			ageColumn,
+		},
+	},
+}
+
+var ageColumn = column("Age", "date", ".metadata.creationTimestamp")
+
+func column(name, typ, path string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "type": typ, "JSONPath": path}
+}
+
+// validation is merged into the generated schemas.
+var validation = map[reflect.Type]fieldSchema{
+	reflect.TypeOf(wgk8s.WireGuardPeerSpec{}): {
+		// A base64 encoded 32 byte key.
+		"publicKey": {"pattern": "^[A-Za-z0-9+/]{42}[AEIMQUYcgkosw048]=$"},
+		"keepalive": {"minimum": int64(0), "maximum": int64(65535)},
+	},
+	reflect.TypeOf(wgk8s.ObservedEndpoint{}): {
+		"publicKey": {"pattern": "^[A-Za-z0-9+/]{42}[AEIMQUYcgkosw048]=$"},
+	},
+	reflect.TypeOf(wgk8s.MeshSpec{}): {
+		"keepalive": {"minimum": int64(0), "maximum": int64(65535)},
+		"mtu":       {"minimum": int64(576), "maximum": int64(65535)},
+		"topology": {"enum": []interface{}{
+			string(wgk8s.TopologyFullMesh),
+			string(wgk8s.TopologyHubAndSpoke),
+			string(wgk8s.TopologyZoned),
+		}},
+	},
+	reflect.TypeOf(wgk8s.MeshPolicyPort{}): {
+		"protocol": {"enum": []interface{}{"TCP", "UDP", "SCTP"}},
+		"port":     {"minimum": int64(1), "maximum": int64(65535)},
+		"endPort":  {"minimum": int64(1), "maximum": int64(65535)},
+	},
+	reflect.TypeOf(wgk8s.IPPoolSpec{}): {
+		"ipRanges": {"minItems": int64(1)},
+		"strategy": {"enum": []interface{}{
+			string(wgk8s.IPAllocationRandom),
+			string(wgk8s.IPAllocationSequential),
+		}},
+	},
+}
+
+// required lists the json names of required fields.
+var required = map[reflect.Type][]string{
+	reflect.TypeOf(wgk8s.WireGuardPeerSpec{}):       {"publicKey"},
+	reflect.TypeOf(wgk8s.WireGuardPeerCondition{}):  {"type", "status"},
+	reflect.TypeOf(wgk8s.ObservedEndpoint{}):        {"publicKey", "endpoint"},
+	reflect.TypeOf(wgk8s.ReflectedRoute{}):          {"cidr", "path"},
+	reflect.TypeOf(wgk8s.PeerHealth{}):              {"name", "reachable"},
+	reflect.TypeOf(wgk8s.IPPoolSpec{}):              {"ipRanges"},
+	reflect.TypeOf(wgk8s.IPRange{}):                 {"cidr"},
+	reflect.TypeOf(wgk8s.IPClaimSpec{}):             {"ip"},
+	reflect.TypeOf(wgk8s.WireGuardMeshPolicySpec{}): {"peerSelector"},
+}
+
+// Definitions returns the CustomResourceDefinitions for each wgmesh kind.
+func Definitions() []*unstructured.Unstructured {
+	out := make([]*unstructured.Unstructured, 0, len(resources))
+	for _, r := range resources {
+		out = append(out, r.definition())
+	}
+	return out
+}
+
+func (r resource) definition() *unstructured.Unstructured {
+	t := reflect.TypeOf(r.obj).Elem()
+	kind := t.Name()
+	singular := strings.ToLower(kind)
+	plural := r.plural
+	if plural == "" {
+		plural = singular + "s"
+	}
+	names := map[string]interface{}{
+		"kind":       kind,
+		"listKind":   kind + "List",
+		"plural":     plural,
+		"singular":   singular,
+		"categories": []interface{}{Category},
+	}
+	if len(r.shortNames) > 0 {
+		shortNames := make([]interface{}, 0, len(r.shortNames))
+		for _, s := range r.shortNames {
+			shortNames = append(shortNames, s)
+		}
+		names["shortNames"] = shortNames
+	}
+	crd := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": CRDResource.GroupVersion().String(),
+		"kind":       "CustomResourceDefinition",
+		"metadata": map[string]interface{}{
+			"name": plural + "." + wgk8s.GroupName,
+		},
+		"spec": map[string]interface{}{
+			"group":                    wgk8s.GroupName,
+			"version":                  wgk8s.GroupVersion,
+			"names":                    names,
+			"scope":                    "Namespaced",
+			"preserveUnknownFields":    false,
+			"additionalPrinterColumns": r.columns,
+			"validation": map[string]interface{}{
+				"openAPIV3Schema": schemaFor(t, validation, required),
+			},
+		},
+	}}
+	// Columns and validation are shared between calls; don't hand them out.
+	return crd.DeepCopy()
+}
+
+// Manifest renders the definitions as a multi-document YAML stream.
+func Manifest() ([]byte, error) {
+	var buf bytes.Buffer
+	for i, crd := range Definitions() {
+		b, err := yaml.Marshal(crd.Object)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling %s: %w", crd.GetName(), err)
+		}
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
+
+// Install creates each definition, or updates it if it already exists.
+func Install(ll log.FieldLogger, client dynamic.Interface) error {
+	crdClient := client.Resource(CRDResource)
+	for _, crd := range Definitions() {
+		ll := ll.WithField("crd", crd.GetName())
+		existing, err := crdClient.Get(crd.GetName(), metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			if _, err = crdClient.Create(crd, metav1.CreateOptions{}); err != nil {
+				return fmt.Errorf("creating CustomResourceDefinition %s: %w", crd.GetName(), err)
+			}
+			ll.Info("created CustomResourceDefinition")
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("getting CustomResourceDefinition %s: %w", crd.GetName(), err)
+		}
+		crd.SetResourceVersion(existing.GetResourceVersion())
+		if _, err = crdClient.Update(crd, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("updating CustomResourceDefinition %s: %w", crd.GetName(), err)
+		}
+		ll.Info("updated CustomResourceDefinition")
+	}
+	return nil
+}
+
+// Established reports whether the apiserver is serving each definition.
+func Established(client dynamic.Interface) (bool, error) {
+	for _, crd := range Definitions() {
+		existing, err := client.Resource(CRDResource).Get(crd.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("getting CustomResourceDefinition %s: %w", crd.GetName(), err)
+		}
+		conditions, _, _ := unstructured.NestedSlice(existing.Object, "status", "conditions")
+		established := false
+		for _, c := range conditions {
+			cond, ok := c.(map[string]interface{})
+			if ok && cond["type"] == "Established" && cond["status"] == "True" {
+				established = true
+			}
+		}
+		if !established {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,45 @@
+package crds
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func TestManifestMatchesCheckedIn(t *testing.T) {
+	manifest, err := Manifest()
+	require.NoError(t, err)
+	checkedIn, err := ioutil.ReadFile("../../k8s/crd.yaml")
+	require.NoError(t, err)
+	require.Equal(t, string(manifest), string(checkedIn), "k8s/crd.yaml is stale; run `make generate-crds`")
+}
+
+func TestInstall(t *testing.T) {
+	stale := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": CRDResource.GroupVersion().String(),
+		"kind":       "CustomResourceDefinition",
+		"metadata": map[string]interface{}{
+			"name":            "wireguardpeers.wgmesh.codybaker.com",
+			"resourceVersion": "7",
+		},
+		"spec": map[string]interface{}{"group": "stale"},
+	}}
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(), stale)
+	require.NoError(t, Install(logrus.New(), client))
+
+	established, err := Established(client)
+	require.NoError(t, err)
+	require.False(t, established)
+
+	for _, expect := range Definitions() {
+		crd, err := client.Resource(CRDResource).Get(expect.GetName(), metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, expect.Object["spec"], crd.Object["spec"])
+	}
+}
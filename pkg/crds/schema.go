@@ -0,0 +1,90 @@
+package crds
+
+import (
+	"reflect"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	timeType       = reflect.TypeOf(metav1.Time{})
+	durationType   = reflect.TypeOf(metav1.Duration{})
+	objectMetaType = reflect.TypeOf(metav1.ObjectMeta{})
+	typeMetaType   = reflect.TypeOf(metav1.TypeMeta{})
+)
+
+// fieldSchema holds validation which can't be derived from a field's Go type. It's keyed by the
+// field's json name and merged into the generated schema.
+type fieldSchema map[string]map[string]interface{}
+
+// schemaFor generates a structural OpenAPI v3 schema for t from its json tags. Values are restricted
+// to the types permitted in unstructured objects so the result can be deep-copied.
+func schemaFor(t reflect.Type, fields map[reflect.Type]fieldSchema, required map[reflect.Type][]string) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "string"}
+	case objectMetaType:
+		return map[string]interface{}{"type": "object"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), fields, required)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), fields, required)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), fields, required)}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		addProperties(props, t, fields, required)
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if req := required[t]; len(req) > 0 {
+			r := make([]interface{}, 0, len(req))
+			for _, name := range req {
+				r = append(r, name)
+			}
+			s["required"] = r
+		}
+		return s
+	}
+	panic("crds: unsupported type " + t.String())
+}
+
+func addProperties(props map[string]interface{}, t reflect.Type, fields map[reflect.Type]fieldSchema, required map[reflect.Type][]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			if f.Type == typeMetaType {
+				props["apiVersion"] = map[string]interface{}{"type": "string"}
+				props["kind"] = map[string]interface{}{"type": "string"}
+				continue
+			}
+			addProperties(props, f.Type, fields, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := schemaFor(f.Type, fields, required)
+		for k, v := range fields[t][name] {
+			s[k] = v
+		}
+		props[name] = s
+	}
+}
@@ -0,0 +1,64 @@
+package crds
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSchemaFor(t *testing.T) {
+	type inner struct {
+		Name  string `json:"name"`
+		Count int    `json:"count,omitempty"`
+	}
+	type embedded struct {
+		Flag bool `json:"flag"`
+	}
+	type outer struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata,omitempty"`
+		embedded          `json:",inline"`
+
+		Items   []inner           `json:"items"`
+		Labels  map[string]string `json:"labels,omitempty"`
+		When    *metav1.Time      `json:"when,omitempty"`
+		Data    []byte            `json:"data,omitempty"`
+		Ignored string            `json:"-"`
+		private string
+	}
+	fields := map[reflect.Type]fieldSchema{
+		reflect.TypeOf(inner{}): {"count": {"minimum": int64(1)}},
+	}
+	required := map[reflect.Type][]string{
+		reflect.TypeOf(inner{}): {"name"},
+	}
+	expect := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"apiVersion": map[string]interface{}{"type": "string"},
+			"kind":       map[string]interface{}{"type": "string"},
+			"metadata":   map[string]interface{}{"type": "object"},
+			"flag":       map[string]interface{}{"type": "boolean"},
+			"items": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"name":  map[string]interface{}{"type": "string"},
+						"count": map[string]interface{}{"type": "integer", "minimum": int64(1)},
+					},
+					"required": []interface{}{"name"},
+				},
+			},
+			"labels": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": map[string]interface{}{"type": "string"},
+			},
+			"when": map[string]interface{}{"type": "string", "format": "date-time"},
+			"data": map[string]interface{}{"type": "string", "format": "byte"},
+		},
+	}
+	require.Equal(t, expect, schemaFor(reflect.TypeOf(outer{}), fields, required))
+}
@@ -0,0 +1,7 @@
+// Package e2e runs meshes of wgmesh agents for end-to-end tests. Each agent runs in its own network
+// namespace, joined to the others by a bridge in an underlay namespace, against an in-memory
+// registry served and garbage collected in-process, so tests can churn, rekey, and crash peers and
+// check the data plane converges. It needs root and a WireGuard driver; the tests are built with the integration tag:
+//
+//	sudo go test -tags integration ./pkg/e2e
+package e2e
@@ -0,0 +1,108 @@
+// +build linux integration
+
+package e2e
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/stretchr/testify/require"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// convergeTimeout bounds how long the mesh has to converge after each change.
+const convergeTimeout = 2 * time.Minute
+
+func TestMesh(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("root is required to create network namespaces")
+	}
+	if err := DriverAvailable(); err != nil {
+		t.Skip(err)
+	}
+	h, err := New(WithBinary(os.Getenv("WGMESH_E2E_BINARY")))
+	require.NoError(t, err)
+	defer func() {
+		if t.Failed() {
+			dumpLogs(t, h)
+		}
+		require.NoError(t, h.Close())
+	}()
+	wait := func(msg string) {
+		ctx, cancel := context.WithTimeout(context.Background(), convergeTimeout)
+		defer cancel()
+		require.NoError(t, h.WaitForMesh(ctx), msg)
+	}
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		_, err := h.AddNode(name)
+		require.NoError(t, err)
+	}
+	wait("full mesh")
+
+	// Churn: a node joins, and another leaves and deregisters itself.
+	_, err = h.AddNode("e")
+	require.NoError(t, err)
+	_, err = h.AddNode("f", "--deregister-on-exit")
+	require.NoError(t, err)
+	wait("after nodes join")
+	require.NoError(t, h.RemoveNode("f"))
+	wait("after a node deregisters")
+	_, err = h.Registry().Get("f")
+	require.Error(t, err, "the node deregistered itself")
+
+	// Rekey: agents generate a new key each start.
+	b := h.Node("b")
+	before, err := b.Status(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, b.Restart())
+	wait("after rekey")
+	after, err := b.Status(context.Background())
+	require.NoError(t, err)
+	require.NotEqual(t, before.PublicKey, after.PublicKey)
+
+	// GC: a crashed node stops renewing its lease, so its record and IPClaim are collected, and its
+	// peers drop it.
+	c, err := h.Registry().Get("c")
+	require.NoError(t, err)
+	require.Len(t, ownedClaims(t, h, c), 1, "the node claimed its address")
+	require.NoError(t, h.Node("c").Kill())
+	require.Eventually(t, func() bool {
+		_, err := h.Registry().Get("c")
+		return k8sErrors.IsNotFound(err) && len(ownedClaims(t, h, c)) == 0
+	}, convergeTimeout, pollInterval, "a crashed node's WireGuardPeer and IPClaims are collected")
+	wait("after a crashed node is collected")
+}
+
+// ownedClaims returns the registry's IPClaims owned by the peer.
+func ownedClaims(t *testing.T, h *Harness, peer *wgk8s.WireGuardPeer) []wgk8s.IPClaim {
+	claims, err := registry.ListClaims(h.Registry())
+	require.NoError(t, err)
+	var out []wgk8s.IPClaim
+	for _, c := range claims {
+		for _, o := range c.GetOwnerReferences() {
+			if o.UID == peer.GetUID() {
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
+
+// dumpLogs logs the agents' logs, to debug a failed test.
+func dumpLogs(t *testing.T, h *Harness) {
+	logs, _ := filepath.Glob(filepath.Join(h.Dir(), "*.log"))
+	for _, path := range logs {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		t.Logf("==> %s <==\n%s", filepath.Base(path), b)
+	}
+}
@@ -0,0 +1,614 @@
+// +build linux
+
+package e2e
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/agent"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/controller"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/jcodybaker/wgmesh/pkg/server"
+	"github.com/vishvananda/netns"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// registryNamespace is the namespace of the records served to agents.
+	registryNamespace = "default"
+	// underlayBridge joins the nodes' namespaces in the underlay namespace.
+	underlayBridge = "br0"
+	// echoPort is where each node echoes TCP connections, to check the data plane.
+	echoPort = "7777"
+	// stopTimeout is how long agents have to exit after SIGTERM before they're killed.
+	stopTimeout = 15 * time.Second
+	// pollInterval is how often WaitForMesh checks the mesh.
+	pollInterval = 500 * time.Millisecond
+	// maxNodes is limited by the addresses of the underlay and mesh networks.
+	maxNodes = 200
+	// meshPool is the IPPool from which each node claims its mesh address.
+	meshPool = "e2e"
+	// ipLeaseDuration is the lease on the nodes' mesh addresses. Once a crashed node's lease expires,
+	// garbage collection deletes its WireGuardPeer and IPClaim.
+	ipLeaseDuration = 6 * time.Second
+	// gcInterval is how often the registry is garbage collected.
+	gcInterval = time.Second
+)
+
+// Harness runs agents, each in its own network namespace, against an in-memory registry. The
+// namespaces are joined by a bridge in an underlay namespace, where the registry is served and
+// garbage collected.
+type Harness struct {
+	options
+
+	// id prefixes the names of the harness's network namespaces.
+	id          string
+	tempDir     bool
+	tokenFile   string
+	underlay    string
+	registry    *registry.Memory
+	registryURL string
+	srv         *http.Server
+	stopGC      context.CancelFunc
+
+	lock    sync.Mutex
+	nodes   map[string]*Node
+	nextIdx int
+}
+
+// Node is an agent run by the harness, and its network namespace.
+type Node struct {
+	h *Harness
+
+	Name string
+	// Namespace is the name of the node's network namespace, ex. for `ip netns exec`.
+	Namespace string
+	// UnderlayIP is the node's address on the underlay bridge, published as its endpoint.
+	UnderlayIP net.IP
+	// MeshIP is the node's address on the mesh, leased from the harness's IPPool.
+	MeshIP net.IP
+
+	args []string
+	echo net.Listener
+
+	lock sync.Mutex
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// DriverAvailable returns an error unless agents have a WireGuard driver: the kernel module, or
+// wireguard-go or boringtun in PATH.
+func DriverAvailable() error {
+	for _, path := range []string{"wireguard-go", "boringtun"} {
+		if _, err := exec.LookPath(path); err == nil {
+			return nil
+		}
+	}
+	name := fmt.Sprintf("wgme2e%d-probe", os.Getpid())
+	if err := ip("netns", "add", name); err != nil {
+		return err
+	}
+	defer ip("netns", "del", name)
+	if err := ip("-n", name, "link", "add", "wg0", "type", "wireguard"); err != nil {
+		return fmt.Errorf("no WireGuard kernel module, wireguard-go, or boringtun: %w", err)
+	}
+	return nil
+}
+
+// New creates the underlay namespace and serves the registry in it. The harness must be closed to
+// remove its namespaces.
+func New(optionFuncs ...OptionFunc) (*Harness, error) {
+	h := &Harness{
+		options: defaultOptions(),
+		id:      fmt.Sprintf("wgme2e%d", os.Getpid()),
+		nodes:   make(map[string]*Node),
+	}
+	for _, f := range optionFuncs {
+		err := f(&h.options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := h.setup(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Harness) setup() error {
+	var err error
+	if h.dir == "" {
+		h.dir, err = ioutil.TempDir("", "wgmesh-e2e")
+		if err != nil {
+			return fmt.Errorf("creating harness directory: %w", err)
+		}
+		h.tempDir = true
+	}
+	if h.binary == "" {
+		h.binary = filepath.Join(h.dir, "wgmesh")
+		out, err := exec.Command("go", "build", "-o", h.binary, "github.com/jcodybaker/wgmesh/cmd/wgmesh").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("building wgmesh: %w: %s", err, out)
+		}
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("generating registry token: %w", err)
+	}
+	h.tokenFile = filepath.Join(h.dir, "token")
+	if err := ioutil.WriteFile(h.tokenFile, []byte(hex.EncodeToString(token)), 0600); err != nil {
+		return fmt.Errorf("writing registry token: %w", err)
+	}
+
+	h.underlay = h.id + "-underlay"
+	for _, args := range [][]string{
+		{"netns", "add", h.underlay},
+		{"-n", h.underlay, "link", "set", "lo", "up"},
+		{"-n", h.underlay, "link", "add", underlayBridge, "type", "bridge"},
+		{"-n", h.underlay, "addr", "add", "192.168.77.1/24", "dev", underlayBridge},
+		{"-n", h.underlay, "link", "set", underlayBridge, "up"},
+	} {
+		if err := ip(args...); err != nil {
+			return fmt.Errorf("creating underlay: %w", err)
+		}
+	}
+
+	h.registry, err = registry.NewMemory(registryNamespace, &wgk8s.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: meshPool},
+		Spec:       wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.77.0.0/24"}}},
+	})
+	if err != nil {
+		return fmt.Errorf("creating registry: %w", err)
+	}
+	c, err := controller.NewController(
+		controller.WithLogger(h.ll),
+		controller.WithRegistry(h.registry),
+		controller.WithRegistryNamespace(registryNamespace),
+		controller.WithGCInterval(gcInterval),
+	)
+	if err != nil {
+		return fmt.Errorf("creating controller: %w", err)
+	}
+	var ctx context.Context
+	ctx, h.stopGC = context.WithCancel(context.Background())
+	go c.Run(ctx)
+	s, err := server.NewServer(
+		server.WithLogger(h.ll),
+		server.WithRegistry(h.registry),
+		server.WithTokens([]string{hex.EncodeToString(token)}),
+	)
+	if err != nil {
+		return fmt.Errorf("creating registry server: %w", err)
+	}
+	var l net.Listener
+	err = inNetns(h.underlay, func() (err error) {
+		l, err = net.Listen("tcp", "192.168.77.1:0")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("listening for registry requests: %w", err)
+	}
+	h.registryURL = "http://" + l.Addr().String()
+	h.srv = &http.Server{Handler: s.Handler()}
+	go h.srv.Serve(l)
+	return nil
+}
+
+// Registry returns the registry served to the agents.
+func (h *Harness) Registry() *registry.Memory {
+	return h.registry
+}
+
+// Dir returns the directory holding the agents' logs, named <node>.log.
+func (h *Harness) Dir() string {
+	return h.dir
+}
+
+// AddNode creates a network namespace for the node, joined to the underlay, and starts its agent
+// with the args added to the harness's.
+func (h *Harness) AddNode(name string, args ...string) (*Node, error) {
+	h.lock.Lock()
+	if _, ok := h.nodes[name]; ok {
+		h.lock.Unlock()
+		return nil, fmt.Errorf("node %q already exists", name)
+	}
+	if h.nextIdx >= maxNodes {
+		h.lock.Unlock()
+		return nil, fmt.Errorf("at most %d nodes may be added", maxNodes)
+	}
+	idx := h.nextIdx
+	h.nextIdx++
+	n := &Node{
+		h:          h,
+		Name:       name,
+		Namespace:  h.id + "-" + name,
+		UnderlayIP: net.IPv4(192, 168, 77, byte(10+idx)),
+		MeshIP:     net.IPv4(10, 77, 0, byte(10+idx)),
+		args:       args,
+	}
+	h.nodes[name] = n
+	h.lock.Unlock()
+
+	veth := fmt.Sprintf("veth%d", idx)
+	for _, args := range [][]string{
+		{"netns", "add", n.Namespace},
+		{"-n", n.Namespace, "link", "set", "lo", "up"},
+		{"-n", h.underlay, "link", "add", veth, "type", "veth", "peer", "name", "eth0", "netns", n.Namespace},
+		{"-n", h.underlay, "link", "set", veth, "master", underlayBridge, "up"},
+		{"-n", n.Namespace, "addr", "add", n.UnderlayIP.String() + "/24", "dev", "eth0"},
+		{"-n", n.Namespace, "link", "set", "eth0", "up"},
+	} {
+		if err := ip(args...); err != nil {
+			h.RemoveNode(name)
+			return nil, fmt.Errorf("creating node %q: %w", name, err)
+		}
+	}
+	err := inNetns(n.Namespace, func() (err error) {
+		n.echo, err = net.Listen("tcp", ":"+echoPort)
+		return err
+	})
+	if err != nil {
+		h.RemoveNode(name)
+		return nil, fmt.Errorf("listening for echo connections on node %q: %w", name, err)
+	}
+	go serveEcho(n.echo)
+	if err := n.Start(); err != nil {
+		h.RemoveNode(name)
+		return nil, err
+	}
+	return n, nil
+}
+
+// Node returns the named node, or nil if there's none.
+func (h *Harness) Node(name string) *Node {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.nodes[name]
+}
+
+// Nodes returns the nodes, sorted by name.
+func (h *Harness) Nodes() []*Node {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	out := make([]*Node, 0, len(h.nodes))
+	for _, n := range h.nodes {
+		out = append(out, n)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// RemoveNode stops the node's agent, if it's running, and deletes its namespace. Its WireGuardPeer
+// is left in the registry unless the agent deregisters it.
+func (h *Harness) RemoveNode(name string) error {
+	h.lock.Lock()
+	n, ok := h.nodes[name]
+	delete(h.nodes, name)
+	h.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("no node %q", name)
+	}
+	return n.remove()
+}
+
+func (n *Node) remove() error {
+	var errs []error
+	if err := n.Stop(); err != nil {
+		errs = append(errs, err)
+	}
+	if n.echo != nil {
+		n.echo.Close()
+	}
+	if err := ip("netns", "del", n.Namespace); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("removing node %q: %v", n.Name, errs)
+	}
+	return nil
+}
+
+// WaitForMesh waits until every running node configures every other running node as a peer, and
+// reaches it over the mesh, or the context is done.
+func (h *Harness) WaitForMesh(ctx context.Context) error {
+	for {
+		err := h.checkMesh(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("mesh didn't converge: %w", err)
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func (h *Harness) checkMesh(ctx context.Context) error {
+	var running []*Node
+	for _, n := range h.Nodes() {
+		if n.Running() {
+			running = append(running, n)
+		}
+	}
+	for _, n := range running {
+		status, err := n.Status(ctx)
+		if err != nil {
+			return err
+		}
+		expected := []string{}
+		for _, o := range running {
+			if o != n {
+				expected = append(expected, o.Name)
+			}
+		}
+		if !reflect.DeepEqual(status.Peers, expected) {
+			return fmt.Errorf("node %q has peers %v, expected %v", n.Name, status.Peers, expected)
+		}
+		for _, o := range running {
+			if o == n {
+				continue
+			}
+			if err := n.Dial(ctx, o); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops the agents, deletes the namespaces, and stops serving and collecting the registry.
+func (h *Harness) Close() error {
+	var errs []error
+	for _, n := range h.Nodes() {
+		if err := h.RemoveNode(n.Name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if h.stopGC != nil {
+		h.stopGC()
+	}
+	if h.srv != nil {
+		h.srv.Close()
+	}
+	if h.underlay != "" {
+		if err := ip("netns", "del", h.underlay); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if h.tempDir {
+		if err := os.RemoveAll(h.dir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("closing harness: %v", errs)
+	}
+	return nil
+}
+
+// Start starts the node's agent. Agents don't keep a peer cache, so each start generates a new key.
+func (n *Node) Start() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.cmd != nil {
+		return fmt.Errorf("node %q is already running", n.Name)
+	}
+	h := n.h
+	args := []string{"netns", "exec", n.Namespace, h.binary, "agent",
+		"--name", n.Name,
+		"--static-ip", meshPool + "=" + n.MeshIP.String(),
+		"--ip-lease-duration", ipLeaseDuration.String(),
+		"--endpoint-addr", n.UnderlayIP.String(),
+		"--registry-server", h.registryURL,
+		"--registry-token-file", h.tokenFile,
+		"--registry-namespace", registryNamespace,
+		"--control-socket", n.controlSocket(),
+	}
+	args = append(args, h.agentArgs...)
+	args = append(args, n.args...)
+	logFile, err := os.OpenFile(filepath.Join(h.dir, n.Name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening node %q's log: %w", n.Name, err)
+	}
+	cmd := exec.Command("ip", args...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return fmt.Errorf("starting node %q's agent: %w", n.Name, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		logFile.Close()
+		h.ll.WithField("node", n.Name).WithError(err).Info("agent exited")
+		close(done)
+	}()
+	n.cmd, n.done = cmd, done
+	return nil
+}
+
+// Stop sends the node's agent SIGTERM, killing it if it hasn't exited within stopTimeout.
+func (n *Node) Stop() error {
+	return n.stop(syscall.SIGTERM)
+}
+
+// Kill kills the node's agent, as a crash would, so it can't deregister or clean up.
+func (n *Node) Kill() error {
+	return n.stop(syscall.SIGKILL)
+}
+
+func (n *Node) stop(sig os.Signal) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.cmd == nil {
+		return nil
+	}
+	select {
+	case <-n.done:
+		// It already exited.
+	default:
+		if err := n.cmd.Process.Signal(sig); err != nil {
+			return fmt.Errorf("signaling node %q's agent: %w", n.Name, err)
+		}
+	}
+	select {
+	case <-n.done:
+	case <-time.After(stopTimeout):
+		n.cmd.Process.Kill()
+		<-n.done
+	}
+	n.cmd, n.done = nil, nil
+	return nil
+}
+
+// Restart stops and starts the node's agent, which rekeys it.
+func (n *Node) Restart() error {
+	if err := n.Stop(); err != nil {
+		return err
+	}
+	return n.Start()
+}
+
+// Running returns true if the node's agent was started and hasn't exited.
+func (n *Node) Running() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.cmd == nil {
+		return false
+	}
+	select {
+	case <-n.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (n *Node) controlSocket() string {
+	return filepath.Join(n.h.dir, n.Name+".sock")
+}
+
+// Status returns the node's agent's status, from its control socket.
+func (n *Node) Status(ctx context.Context) (agent.Status, error) {
+	var status agent.Status
+	req, err := http.NewRequest(http.MethodGet, agent.ControlBaseURL+"/v1/status", nil)
+	if err != nil {
+		return status, err
+	}
+	resp, err := agent.NewControlClient(n.controlSocket()).Do(req.WithContext(ctx))
+	if err != nil {
+		return status, fmt.Errorf("reading node %q's status: %w", n.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("reading node %q's status: %s", n.Name, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("decoding node %q's status: %w", n.Name, err)
+	}
+	return status, nil
+}
+
+// Dial checks that the node reaches the other over the mesh, by echoing a line through a TCP
+// connection to the other's mesh address.
+func (n *Node) Dial(ctx context.Context, to *Node) error {
+	err := inNetns(n.Namespace, func() error {
+		d := net.Dialer{Timeout: time.Second}
+		c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(to.MeshIP.String(), echoPort))
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second))
+		if _, err := io.WriteString(c, n.Name+"\n"); err != nil {
+			return err
+		}
+		line, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != n.Name+"\n" {
+			return fmt.Errorf("echoed %q", line)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("node %q reaching %q at %s: %w", n.Name, to.Name, to.MeshIP, err)
+	}
+	return nil
+}
+
+// serveEcho echoes connections accepted from l until it's closed.
+func serveEcho(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			io.Copy(c, c)
+		}()
+	}
+}
+
+// inNetns calls f on a thread in the named network namespace. Sockets created by f stay in it.
+func inNetns(name string, f func() error) error {
+	runtime.LockOSThread()
+	ns, err := netns.GetFromName(name)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("opening network namespace %q: %w", name, err)
+	}
+	defer ns.Close()
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("opening current network namespace: %w", err)
+	}
+	defer orig.Close()
+	if err := netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("entering network namespace %q: %w", name, err)
+	}
+	ferr := f()
+	if err := netns.Set(orig); err != nil {
+		// Leave the thread locked, so it's discarded with the goroutine rather than reused in the
+		// wrong namespace.
+		return fmt.Errorf("leaving network namespace %q: %w", name, err)
+	}
+	runtime.UnlockOSThread()
+	return ferr
+}
+
+// ip runs the ip command with the args.
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %v: %w: %s", args, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package e2e
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+type options struct {
+	ll log.FieldLogger
+
+	// binary is the wgmesh binary agents run. If empty, it's built into the harness's directory.
+	binary string
+	// agentArgs are added to every agent's arguments.
+	agentArgs []string
+	// dir holds the token file, control sockets, and agent logs. If empty, a temporary directory is
+	// created and removed on Close.
+	dir string
+}
+
+func defaultOptions() options {
+	return options{
+		ll: log.New(),
+	}
+}
+
+// OptionFunc describes the function signature for methods which modify the harness options.
+type OptionFunc func(*options) error
+
+// WithLogger sets a logger on the harness options.
+func WithLogger(ll log.FieldLogger) OptionFunc {
+	return func(o *options) error {
+		o.ll = ll
+		return nil
+	}
+}
+
+// WithBinary sets the wgmesh binary agents run, rather than building it.
+func WithBinary(path string) OptionFunc {
+	return func(o *options) error {
+		o.binary = path
+		return nil
+	}
+}
+
+// WithAgentArgs adds arguments to every agent's command line, ex. to select a --driver.
+func WithAgentArgs(args ...string) OptionFunc {
+	return func(o *options) error {
+		o.agentArgs = append(o.agentArgs, args...)
+		return nil
+	}
+}
+
+// WithDir keeps the harness's files, including the agents' logs, in dir rather than a temporary
+// directory removed on Close.
+func WithDir(dir string) OptionFunc {
+	return func(o *options) error {
+		o.dir = dir
+		return nil
+	}
+}
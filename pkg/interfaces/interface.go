@@ -1,9 +1,22 @@
 package interfaces
 
 import (
+	"context"
 	"net"
 )
 
+// DefaultRouteProtocol identifies the routes installed by wgmesh. It's unassigned in iproute2's
+// rt_protos.
+const DefaultRouteProtocol = 99
+
+// RouteOptions describes how routes are installed.
+type RouteOptions struct {
+	// Metric is the routes' priority; lower wins. Zero uses the kernel default.
+	Metric int
+	// Protocol identifies the routes we manage, so other routes via the interface are left alone.
+	Protocol int
+}
+
 // Interface describes actions which can be performed against a network interface.
 type Interface interface {
 	// Close deletes the interface and stops any drivers from servicing it.
@@ -12,6 +25,12 @@ type Interface interface {
 	// EnsureIP adds an IP address to the specified interface if it does not already exist.
 	EnsureIP(ip *net.IPNet) error
 
+	// RemoveIP removes an IP address from the specified interface if it exists.
+	RemoveIP(ip *net.IPNet) error
+
+	// SetMTU sets the interface's MTU.
+	SetMTU(mtu int) error
+
 	// EnsureUp sets an interface into the UP state if it is not already UP. This begins
 	// communication over the WireGuard protocol w/ any listed peers.
 	EnsureUp() error
@@ -21,4 +40,12 @@ type Interface interface {
 
 	// GetIPs returns a list of IP addresses assigned to the specified interface.
 	GetIPs() ([]string, error)
+
+	// SyncRoutes makes the interface's routes with the options' protocol match routes, adding and
+	// removing routes as needed.
+	SyncRoutes(routes []net.IPNet, opts RouteOptions) error
+
+	// WatchRoutes calls removed with the destination of each route via the interface with the
+	// options' protocol which is deleted, until the context is canceled or the watch fails.
+	WatchRoutes(ctx context.Context, opts RouteOptions, removed func(dst net.IPNet)) error
 }
@@ -46,6 +46,27 @@ func (i *bsdInterface) EnsureIP(ip *net.IPNet) error {
 	return fmt.Errorf("WireGuardInterface.EnsureIP: %w", errUnimplemented)
 }
 
+// RemoveIP removes the specified IPNet from the interface, if it is assigned.
+func (i *bsdInterface) RemoveIP(ip *net.IPNet) error {
+	return fmt.Errorf("WireGuardInterface.RemoveIP: %w", errUnimplemented)
+}
+
+// SetMTU sets the MTU of the interface.
+func (i *bsdInterface) SetMTU(mtu int) error {
+	return fmt.Errorf("WireGuardInterface.SetMTU: %w", errUnimplemented)
+}
+
+// SyncRoutes makes the interface's routes with the options' protocol match routes.
+func (i *bsdInterface) SyncRoutes(routes []net.IPNet, opts RouteOptions) error {
+	return fmt.Errorf("WireGuardInterface.SyncRoutes: %w", errUnimplemented)
+}
+
+// WatchRoutes calls removed with the destination of each route with the options' protocol which is
+// deleted.
+func (i *bsdInterface) WatchRoutes(ctx context.Context, opts RouteOptions, removed func(dst net.IPNet)) error {
+	return fmt.Errorf("WireGuardInterface.WatchRoutes: %w", errUnimplemented)
+}
+
 func (i *bsdInterface) Close() error {
 	return fmt.Errorf("WireGuardInterface.Close: %w", errUnimplemented)
 }
@@ -13,7 +13,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 
 	"github.com/jcodybaker/wgmesh/pkg/log"
@@ -50,7 +49,7 @@ func waitForInterface(ctx context.Context, exit <-chan error, name string) (Inte
 	t := time.NewTimer(interfaceTimeout)
 	defer t.Stop()
 
-	ll := log.FromContext(ctx)
+	ll := log.Subsystem(log.FromContext(ctx), log.SubsystemInterfaces)
 
 	for {
 		select {
@@ -68,10 +67,8 @@ func waitForInterface(ctx context.Context, exit <-chan error, name string) (Inte
 					link: update.Link,
 				}, nil
 			}
-			ll.WithFields(logrus.Fields{
-				"interface.name":    attr.Name,
-				"interface.desired": name,
-			}).Debug("ignoring update about irrelevant interface")
+			log.WithInterface(ll, attr.Name).WithField("desired_interface", name).
+				Debug("ignoring update about irrelevant interface")
 			continue
 		case err := <-exit:
 			if err == nil {
@@ -98,8 +95,7 @@ func (i *linuxInterface) EnsureUp() error {
 
 // GetIPs returns a list of IP addresses currently active on the interface.
 func (i *linuxInterface) GetIPs() ([]string, error) {
-	// TODO - IPv6
-	addrs, err := netlink.AddrList(i.link, netlink.FAMILY_V4)
+	addrs, err := netlink.AddrList(i.link, netlink.FAMILY_ALL)
 	if err != nil {
 		return nil, fmt.Errorf("listing %q addresses: %w", i.name, err)
 	}
@@ -127,6 +123,133 @@ func (i *linuxInterface) EnsureIP(ip *net.IPNet) error {
 	return nil
 }
 
+// RemoveIP removes the specified IPNet from the interface, if it is assigned.
+func (i *linuxInterface) RemoveIP(ip *net.IPNet) error {
+	err := netlink.AddrDel(i.link, &netlink.Addr{IPNet: ip})
+	if err == syscall.EADDRNOTAVAIL {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("removing IP address %q: %w", ip.String(), err)
+	}
+	return nil
+}
+
+// SetMTU sets the MTU of the interface.
+func (i *linuxInterface) SetMTU(mtu int) error {
+	err := netlink.LinkSetMTU(i.link, mtu)
+	if err != nil {
+		return fmt.Errorf("setting link %q mtu to %d: %w", i.name, mtu, err)
+	}
+	return nil
+}
+
+// SyncRoutes makes the interface's routes with the options' protocol match routes, adding and
+// removing routes as needed.
+func (i *linuxInterface) SyncRoutes(routes []net.IPNet, opts RouteOptions) error {
+	index := i.link.Attrs().Index
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		LinkIndex: index,
+		Protocol:  opts.Protocol,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return fmt.Errorf("listing %q routes: %w", i.name, err)
+	}
+	installed := make(map[string]struct{}, len(existing))
+	for _, r := range existing {
+		if r.Dst != nil && r.Priority == routeMetric(r.Dst, opts.Metric) {
+			installed[r.Dst.String()] = struct{}{}
+		}
+	}
+	desired := make(map[string]struct{}, len(routes))
+	for idx := range routes {
+		dst := &routes[idx]
+		desired[dst.String()] = struct{}{}
+		if _, ok := installed[dst.String()]; ok {
+			continue
+		}
+		err = netlink.RouteReplace(&netlink.Route{
+			LinkIndex: index,
+			Dst:       dst,
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  opts.Protocol,
+			Priority:  opts.Metric,
+		})
+		if err != nil {
+			return fmt.Errorf("installing route %q: %w", dst.String(), err)
+		}
+	}
+	for idx := range existing {
+		r := &existing[idx]
+		if r.Dst != nil && r.Priority == routeMetric(r.Dst, opts.Metric) {
+			if _, ok := desired[r.Dst.String()]; ok {
+				continue
+			}
+		}
+		// The route is no longer desired, or has a stale metric.
+		err = netlink.RouteDel(r)
+		if err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("removing route %q: %w", r.Dst.String(), err)
+		}
+	}
+	return nil
+}
+
+// WatchRoutes calls removed with the destination of each route via the interface with the options'
+// protocol which is deleted, ex. by a network manager, until the context is canceled or the watch
+// fails.
+func (i *linuxInterface) WatchRoutes(ctx context.Context, opts RouteOptions, removed func(dst net.IPNet)) error {
+	updates := make(chan netlink.RouteUpdate) // netlink.RouteSubscribe... will close
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		// Unblock the subscription until it sees done.
+		go func() {
+			for range updates {
+			}
+		}()
+	}()
+	errs := make(chan error, 1)
+	err := netlink.RouteSubscribeWithOptions(updates, done, netlink.RouteSubscribeOptions{
+		ErrorCallback: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("initializing route subscription: %w", err)
+	}
+	index := i.link.Attrs().Index
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return fmt.Errorf("watching %q routes: %w", i.name, err)
+		case update, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("watching %q routes: subscription closed", i.name)
+			}
+			if update.Type != syscall.RTM_DELROUTE || update.LinkIndex != index ||
+				update.Protocol != opts.Protocol || update.Dst == nil {
+				continue
+			}
+			removed(*update.Dst)
+		}
+	}
+}
+
+// routeMetric returns the metric the kernel reports for a route installed with metric. IPv6
+// routes without a metric get 1024.
+func routeMetric(dst *net.IPNet, metric int) int {
+	if metric == 0 && dst.IP.To4() == nil {
+		return 1024
+	}
+	return metric
+}
+
 // Close removes the interface.
 func (i *linuxInterface) Close() error {
 	err := netlink.LinkDel(i.link)
@@ -294,6 +294,81 @@ func TestInterfaceEnsureIP(t *testing.T) {
 	}
 }
 
+func TestInterfaceRemoveIP(t *testing.T) {
+	tcs := []struct {
+		name  string
+		setup func(t *testing.T)
+	}{
+		{
+			name: "success",
+			setup: func(t *testing.T) {
+				out, err := exec.Command("ip", "addr", "add", "192.168.1.1/24", "dev", "dummy").CombinedOutput()
+				require.NoErrorf(t, err, string(out))
+			},
+		},
+		{
+			name: "already removed",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			testInNetworkNamespace(t, func() {
+				defer func() {
+					out, err := exec.Command("ip", "link", "delete", "dummy").CombinedOutput()
+					if err != nil && !strings.Contains(string(out), "Cannot find device") {
+						panic(fmt.Errorf("failed: ip link delete dummy: %w - %s", err, string(out)))
+					}
+				}()
+
+				out, err := exec.Command("ip", "link", "add", "dev", "dummy", "type", "dummy").CombinedOutput()
+				if err != nil {
+					panic(fmt.Errorf("failed: ip link add dev dummy type dummy: %w - %s", err, string(out)))
+				}
+				if tc.setup != nil {
+					tc.setup(t)
+				}
+
+				iface, err := newInterface("dummy")
+				require.NoError(t, err)
+				addr := net.IPNet{
+					IP:   net.IPv4(192, 168, 1, 1),
+					Mask: net.CIDRMask(24, 32),
+				}
+				err = iface.RemoveIP(&addr)
+				require.NoError(t, err)
+
+				out, err = exec.Command("ip", "addr", "show", "dummy").CombinedOutput()
+				require.NoError(t, err)
+				require.NotContains(t, string(out), "192.168.1.1/24")
+			})
+		})
+	}
+}
+
+func TestInterfaceSetMTU(t *testing.T) {
+	testInNetworkNamespace(t, func() {
+		defer func() {
+			out, err := exec.Command("ip", "link", "delete", "dummy").CombinedOutput()
+			if err != nil && !strings.Contains(string(out), "Cannot find device") {
+				panic(fmt.Errorf("failed: ip link delete dummy: %w - %s", err, string(out)))
+			}
+		}()
+
+		out, err := exec.Command("ip", "link", "add", "dev", "dummy", "type", "dummy").CombinedOutput()
+		if err != nil {
+			panic(fmt.Errorf("failed: ip link add dev dummy type dummy: %w - %s", err, string(out)))
+		}
+
+		iface, err := newInterface("dummy")
+		require.NoError(t, err)
+		require.NoError(t, iface.SetMTU(1280))
+
+		out, err = exec.Command("ip", "link", "show", "dummy").CombinedOutput()
+		require.NoError(t, err)
+		require.Contains(t, string(out), "mtu 1280")
+	})
+}
+
 func TestInterfaceGetIPs(t *testing.T) {
 	testInNetworkNamespace(t, func() {
 		defer func() {
@@ -373,3 +448,112 @@ func TestInterfaceClose(t *testing.T) {
 		})
 	}
 }
+
+func TestInterfaceSyncRoutes(t *testing.T) {
+	testInNetworkNamespace(t, func() {
+		defer func() {
+			out, err := exec.Command("ip", "link", "delete", "dummy").CombinedOutput()
+			if err != nil && !strings.Contains(string(out), "Cannot find device") {
+				panic(fmt.Errorf("failed: ip link delete dummy: %w - %s", err, string(out)))
+			}
+		}()
+
+		out, err := exec.Command("ip", "link", "add", "dev", "dummy", "type", "dummy").CombinedOutput()
+		if err != nil {
+			panic(fmt.Errorf("failed: ip link add dev dummy type dummy: %w - %s", err, string(out)))
+		}
+		out, err = exec.Command("ip", "link", "set", "dummy", "up").CombinedOutput()
+		if err != nil {
+			panic(fmt.Errorf("failed: ip link set dummy up: %w - %s", err, string(out)))
+		}
+		// Routes from other sources are left alone.
+		out, err = exec.Command("ip", "route", "add", "192.168.9.0/24", "dev", "dummy").CombinedOutput()
+		if err != nil {
+			panic(fmt.Errorf("failed: ip route add 192.168.9.0/24 dev dummy: %w - %s", err, string(out)))
+		}
+
+		iface, err := newInterface("dummy")
+		require.NoError(t, err)
+		prefix := func(s string) net.IPNet {
+			_, n, err := net.ParseCIDR(s)
+			require.NoError(t, err)
+			return *n
+		}
+		opts := RouteOptions{Protocol: DefaultRouteProtocol}
+		require.NoError(t, iface.SyncRoutes([]net.IPNet{prefix("10.0.0.1/32"), prefix("192.168.0.0/16"), prefix("fd00::/64")}, opts))
+		// Syncing again is a no-op.
+		require.NoError(t, iface.SyncRoutes([]net.IPNet{prefix("10.0.0.1/32"), prefix("192.168.0.0/16"), prefix("fd00::/64")}, opts))
+
+		out, err = exec.Command("ip", "route", "show", "dev", "dummy", "proto", "99").CombinedOutput()
+		require.NoError(t, err)
+		require.Contains(t, string(out), "10.0.0.1")
+		require.Contains(t, string(out), "192.168.0.0/16")
+
+		opts.Metric = 200
+		require.NoError(t, iface.SyncRoutes([]net.IPNet{prefix("192.168.0.0/16")}, opts))
+		out, err = exec.Command("ip", "route", "show", "dev", "dummy").CombinedOutput()
+		require.NoError(t, err)
+		require.NotContains(t, string(out), "10.0.0.1")
+		require.Contains(t, string(out), "192.168.0.0/16 proto 99 scope link metric 200")
+		require.Contains(t, string(out), "192.168.9.0/24")
+		out, err = exec.Command("ip", "-6", "route", "show", "dev", "dummy", "proto", "99").CombinedOutput()
+		require.NoError(t, err)
+		require.NotContains(t, string(out), "fd00::/64")
+	})
+}
+
+func TestInterfaceWatchRoutes(t *testing.T) {
+	testInNetworkNamespace(t, func() {
+		defer func() {
+			out, err := exec.Command("ip", "link", "delete", "dummy").CombinedOutput()
+			if err != nil && !strings.Contains(string(out), "Cannot find device") {
+				panic(fmt.Errorf("failed: ip link delete dummy: %w - %s", err, string(out)))
+			}
+		}()
+
+		out, err := exec.Command("ip", "link", "add", "dev", "dummy", "type", "dummy").CombinedOutput()
+		if err != nil {
+			panic(fmt.Errorf("failed: ip link add dev dummy type dummy: %w - %s", err, string(out)))
+		}
+		out, err = exec.Command("ip", "link", "set", "dummy", "up").CombinedOutput()
+		if err != nil {
+			panic(fmt.Errorf("failed: ip link set dummy up: %w - %s", err, string(out)))
+		}
+		out, err = exec.Command("ip", "route", "add", "192.168.9.0/24", "dev", "dummy").CombinedOutput()
+		if err != nil {
+			panic(fmt.Errorf("failed: ip route add 192.168.9.0/24 dev dummy: %w - %s", err, string(out)))
+		}
+
+		iface, err := newInterface("dummy")
+		require.NoError(t, err)
+		_, n, err := net.ParseCIDR("10.0.0.0/24")
+		require.NoError(t, err)
+		opts := RouteOptions{Protocol: DefaultRouteProtocol}
+		require.NoError(t, iface.SyncRoutes([]net.IPNet{*n}, opts))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		removed := make(chan string, 10)
+		watchErr := make(chan error, 1)
+		go func() {
+			watchErr <- iface.WatchRoutes(ctx, opts, func(dst net.IPNet) {
+				removed <- dst.String()
+			})
+		}()
+		require.Eventually(t, func() bool {
+			// Routes from other sources are ignored.
+			exec.Command("ip", "route", "del", "192.168.9.0/24", "dev", "dummy").Run()
+			exec.Command("ip", "route", "del", "10.0.0.0/24", "dev", "dummy").Run()
+			select {
+			case dst := <-removed:
+				require.Equal(t, "10.0.0.0/24", dst)
+				return true
+			case <-time.After(100 * time.Millisecond):
+				// The subscription may not have started; put the route back and retry.
+				require.NoError(t, iface.SyncRoutes([]net.IPNet{*n}, opts))
+				return false
+			}
+		}, 5*time.Second, 10*time.Millisecond)
+		cancel()
+		require.NoError(t, <-watchErr)
+	})
+}
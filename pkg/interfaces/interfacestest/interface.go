@@ -0,0 +1,297 @@
+// Package interfacestest provides fake interfaces.Interface and interfaces.WireGuardInterface
+// implementations, which keep their state in memory and record their calls, so logic which
+// configures interfaces can be tested without root or network namespaces.
+package interfacestest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+)
+
+var _ interfaces.Interface = (*Interface)(nil)
+
+// Call is a method call recorded by a fake.
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Interface is a fake interfaces.Interface. Its methods are safe for concurrent use, and its state
+// is read with its accessors.
+type Interface struct {
+	mu     sync.Mutex
+	name   string
+	ips    []net.IPNet
+	mtu    int
+	up     bool
+	closed bool
+	routes map[string]net.IPNet
+	// watchers are called with the routes deleted with DeleteRoute, by WatchRoutes.
+	watchers map[int]func(dst net.IPNet)
+	nextID   int
+	calls    []Call
+	errs     map[string]error
+	hooks    map[string]func(args ...interface{}) error
+}
+
+// NewInterface returns a fake interface with the name, which is down and has no addresses.
+func NewInterface(name string) *Interface {
+	return &Interface{
+		name:     name,
+		routes:   make(map[string]net.IPNet),
+		watchers: make(map[int]func(dst net.IPNet)),
+		errs:     make(map[string]error),
+		hooks:    make(map[string]func(args ...interface{}) error),
+	}
+}
+
+// FailWith makes calls to the method fail with err, without changing the interface's state, until
+// it's called again with a nil error.
+func (i *Interface) FailWith(method string, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err == nil {
+		delete(i.errs, method)
+		return
+	}
+	i.errs[method] = err
+}
+
+// OnCall calls fn with the arguments of each call to the method, before it's applied. If fn returns
+// an error, the call fails with it without changing the interface's state. A nil fn removes the
+// hook. fn is called with the interface's lock held, so it mustn't call the interface's methods.
+func (i *Interface) OnCall(method string, fn func(args ...interface{}) error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if fn == nil {
+		delete(i.hooks, method)
+		return
+	}
+	i.hooks[method] = fn
+}
+
+// Calls returns the calls made to the interface, in order.
+func (i *Interface) Calls() []Call {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]Call(nil), i.calls...)
+}
+
+// CallsTo returns the calls made to the method, in order.
+func (i *Interface) CallsTo(method string) []Call {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var out []Call
+	for _, c := range i.calls {
+		if c.Method == method {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// ResetCalls forgets the calls recorded so far.
+func (i *Interface) ResetCalls() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.calls = nil
+}
+
+// call records the call and returns the error it's scripted to fail with, if any. The caller must
+// hold the lock.
+func (i *Interface) call(method string, args ...interface{}) error {
+	i.calls = append(i.calls, Call{Method: method, Args: args})
+	if err := i.errs[method]; err != nil {
+		return err
+	}
+	if fn := i.hooks[method]; fn != nil {
+		return fn(args...)
+	}
+	return nil
+}
+
+// Close implements interfaces.Interface.
+func (i *Interface) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.call("Close"); err != nil {
+		return err
+	}
+	i.closed, i.up = true, false
+	return nil
+}
+
+// EnsureIP implements interfaces.Interface.
+func (i *Interface) EnsureIP(ip *net.IPNet) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.call("EnsureIP", ip); err != nil {
+		return err
+	}
+	for _, n := range i.ips {
+		if n.String() == ip.String() {
+			return nil
+		}
+	}
+	i.ips = append(i.ips, *ip)
+	return nil
+}
+
+// RemoveIP implements interfaces.Interface.
+func (i *Interface) RemoveIP(ip *net.IPNet) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.call("RemoveIP", ip); err != nil {
+		return err
+	}
+	for j, n := range i.ips {
+		if n.String() == ip.String() {
+			i.ips = append(i.ips[:j], i.ips[j+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// SetMTU implements interfaces.Interface.
+func (i *Interface) SetMTU(mtu int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.call("SetMTU", mtu); err != nil {
+		return err
+	}
+	i.mtu = mtu
+	return nil
+}
+
+// EnsureUp implements interfaces.Interface.
+func (i *Interface) EnsureUp() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.call("EnsureUp"); err != nil {
+		return err
+	}
+	if i.closed {
+		return fmt.Errorf("interface %q is closed", i.name)
+	}
+	i.up = true
+	return nil
+}
+
+// GetName implements interfaces.Interface.
+func (i *Interface) GetName() string {
+	return i.name
+}
+
+// GetIPs implements interfaces.Interface.
+func (i *Interface) GetIPs() ([]string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.call("GetIPs"); err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(i.ips))
+	for _, n := range i.ips {
+		out = append(out, n.String())
+	}
+	return out, nil
+}
+
+// SyncRoutes implements interfaces.Interface. Routes are kept regardless of the options' protocol.
+func (i *Interface) SyncRoutes(routes []net.IPNet, opts interfaces.RouteOptions) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.call("SyncRoutes", routes, opts); err != nil {
+		return err
+	}
+	i.routes = make(map[string]net.IPNet, len(routes))
+	for _, n := range routes {
+		i.routes[n.String()] = n
+	}
+	return nil
+}
+
+// WatchRoutes implements interfaces.Interface. removed is called with the routes deleted with
+// DeleteRoute until the context is canceled.
+func (i *Interface) WatchRoutes(ctx context.Context, opts interfaces.RouteOptions, removed func(dst net.IPNet)) error {
+	i.mu.Lock()
+	if err := i.call("WatchRoutes", opts); err != nil {
+		i.mu.Unlock()
+		return err
+	}
+	id := i.nextID
+	i.nextID++
+	i.watchers[id] = removed
+	i.mu.Unlock()
+
+	<-ctx.Done()
+	i.mu.Lock()
+	delete(i.watchers, id)
+	i.mu.Unlock()
+	return nil
+}
+
+// DeleteRoute deletes the route, as if by someone else, and reports it to WatchRoutes. It returns
+// false if there was no such route.
+func (i *Interface) DeleteRoute(dst net.IPNet) bool {
+	i.mu.Lock()
+	if _, ok := i.routes[dst.String()]; !ok {
+		i.mu.Unlock()
+		return false
+	}
+	delete(i.routes, dst.String())
+	watchers := make([]func(dst net.IPNet), 0, len(i.watchers))
+	for _, fn := range i.watchers {
+		watchers = append(watchers, fn)
+	}
+	i.mu.Unlock()
+	for _, fn := range watchers {
+		fn(dst)
+	}
+	return true
+}
+
+// IPs returns the interface's addresses.
+func (i *Interface) IPs() []net.IPNet {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]net.IPNet(nil), i.ips...)
+}
+
+// Routes returns the routes last synced, as prefix strings, sorted.
+func (i *Interface) Routes() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	out := make([]string, 0, len(i.routes))
+	for s := range i.routes {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// MTU returns the interface's MTU, or zero if it hasn't been set.
+func (i *Interface) MTU() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.mtu
+}
+
+// IsUp returns true if the interface is up.
+func (i *Interface) IsUp() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.up
+}
+
+// IsClosed returns true if the interface was closed.
+func (i *Interface) IsClosed() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.closed
+}
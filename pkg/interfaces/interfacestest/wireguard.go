@@ -0,0 +1,227 @@
+package interfacestest
+
+import (
+	"errors"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+)
+
+var _ interfaces.WireGuardInterface = (*WireGuardInterface)(nil)
+
+// DefaultListenPort is the port a fake WireGuard interface listens on until it's configured.
+const DefaultListenPort = 51820
+
+// WireGuardInterface is a fake interfaces.WireGuardInterface. It applies configs to its peers as
+// the kernel does: an allowed IP belongs to one peer at a time, so adding it to a peer removes it
+// from any other.
+type WireGuardInterface struct {
+	*Interface
+
+	privateKey   wgtypes.Key
+	listenPort   int
+	firewallMark int
+	// peers are the configured peers, in the order they were added.
+	peers []*wgtypes.Peer
+	byKey map[wgtypes.Key]*wgtypes.Peer
+	// owners are the keys of the peers each allowed IP belongs to.
+	owners map[string]wgtypes.Key
+}
+
+// NewWireGuardInterface returns a fake WireGuard interface with the name, which is down and has no
+// peers.
+func NewWireGuardInterface(name string) *WireGuardInterface {
+	return &WireGuardInterface{
+		Interface:  NewInterface(name),
+		listenPort: DefaultListenPort,
+		byKey:      make(map[wgtypes.Key]*wgtypes.Peer),
+		owners:     make(map[string]wgtypes.Key),
+	}
+}
+
+// ConfigureWireGuard implements interfaces.WireGuardInterface.
+func (w *WireGuardInterface) ConfigureWireGuard(cfg wgtypes.Config) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.call("ConfigureWireGuard", cfg); err != nil {
+		return err
+	}
+	if cfg.PrivateKey != nil {
+		w.privateKey = *cfg.PrivateKey
+	}
+	if cfg.ListenPort != nil {
+		w.listenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		w.firewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		w.peers = nil
+		w.byKey = make(map[wgtypes.Key]*wgtypes.Peer)
+		w.owners = make(map[string]wgtypes.Key)
+	}
+	for _, pc := range cfg.Peers {
+		w.configurePeer(pc)
+	}
+	return nil
+}
+
+// configurePeer applies the peer's config. The caller must hold the lock.
+func (w *WireGuardInterface) configurePeer(pc wgtypes.PeerConfig) {
+	p := w.byKey[pc.PublicKey]
+	if pc.Remove {
+		if p != nil {
+			w.releaseAllowedIPs(p)
+			delete(w.byKey, pc.PublicKey)
+			for i := range w.peers {
+				if w.peers[i] == p {
+					w.peers = append(w.peers[:i], w.peers[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+	if p == nil {
+		if pc.UpdateOnly {
+			return
+		}
+		p = &wgtypes.Peer{PublicKey: pc.PublicKey, ProtocolVersion: 1}
+		w.peers = append(w.peers, p)
+		w.byKey[pc.PublicKey] = p
+	}
+	if pc.PresharedKey != nil {
+		p.PresharedKey = *pc.PresharedKey
+	}
+	if pc.Endpoint != nil {
+		e := *pc.Endpoint
+		p.Endpoint = &e
+	}
+	if pc.PersistentKeepaliveInterval != nil {
+		p.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+	}
+	if pc.ReplaceAllowedIPs {
+		w.releaseAllowedIPs(p)
+		p.AllowedIPs = nil
+	}
+	for _, n := range pc.AllowedIPs {
+		s := n.String()
+		if owner, ok := w.owners[s]; ok {
+			if owner == pc.PublicKey {
+				continue
+			}
+			other := w.byKey[owner]
+			other.AllowedIPs = removeIPNet(other.AllowedIPs, s)
+		}
+		w.owners[s] = pc.PublicKey
+		p.AllowedIPs = append(p.AllowedIPs, n)
+	}
+}
+
+// releaseAllowedIPs forgets that the peer's allowed IPs belong to it. The caller must hold the lock.
+func (w *WireGuardInterface) releaseAllowedIPs(p *wgtypes.Peer) {
+	for _, n := range p.AllowedIPs {
+		delete(w.owners, n.String())
+	}
+}
+
+func removeIPNet(nets []net.IPNet, s string) []net.IPNet {
+	out := make([]net.IPNet, 0, len(nets))
+	for _, n := range nets {
+		if n.String() != s {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// GetListenPort implements interfaces.WireGuardInterface.
+func (w *WireGuardInterface) GetListenPort() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.call("GetListenPort"); err != nil {
+		return 0, err
+	}
+	if !w.up {
+		return 0, errors.New("interface must be up to read its listen port")
+	}
+	return w.listenPort, nil
+}
+
+// GetPeers implements interfaces.WireGuardInterface.
+func (w *WireGuardInterface) GetPeers() ([]wgtypes.Peer, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.call("GetPeers"); err != nil {
+		return nil, err
+	}
+	return w.copyPeers(), nil
+}
+
+// copyPeers returns copies of the peers. The caller must hold the lock.
+func (w *WireGuardInterface) copyPeers() []wgtypes.Peer {
+	out := make([]wgtypes.Peer, 0, len(w.peers))
+	for _, p := range w.peers {
+		out = append(out, copyPeer(p))
+	}
+	return out
+}
+
+func copyPeer(p *wgtypes.Peer) wgtypes.Peer {
+	c := *p
+	if p.Endpoint != nil {
+		e := *p.Endpoint
+		c.Endpoint = &e
+	}
+	c.AllowedIPs = append([]net.IPNet(nil), p.AllowedIPs...)
+	return c
+}
+
+// Peers returns the configured peers, in the order they were added, without recording a call.
+func (w *WireGuardInterface) Peers() []wgtypes.Peer {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.copyPeers()
+}
+
+// Peer returns the peer with the key, if it's configured.
+func (w *WireGuardInterface) Peer(key wgtypes.Key) (wgtypes.Peer, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.byKey[key]
+	if !ok {
+		return wgtypes.Peer{}, false
+	}
+	return copyPeer(p), true
+}
+
+// UpdatePeer calls fn to change the state of the peer with the key, ex. to complete a handshake,
+// count traffic, or roam its endpoint, as the device would. fn mustn't change the peer's key or
+// allowed IPs; configure those with ConfigureWireGuard. It returns false if the peer isn't
+// configured.
+func (w *WireGuardInterface) UpdatePeer(key wgtypes.Key, fn func(p *wgtypes.Peer)) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.byKey[key]
+	if !ok {
+		return false
+	}
+	fn(p)
+	return true
+}
+
+// PrivateKey returns the interface's private key, or the zero key if it hasn't been configured.
+func (w *WireGuardInterface) PrivateKey() wgtypes.Key {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.privateKey
+}
+
+// FirewallMark returns the interface's firewall mark, or zero if it hasn't been configured.
+func (w *WireGuardInterface) FirewallMark() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.firewallMark
+}
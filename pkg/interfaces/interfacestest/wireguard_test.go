@@ -0,0 +1,86 @@
+package interfacestest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+)
+
+func TestWireGuardInterface(t *testing.T) {
+	w := NewWireGuardInterface("wg0")
+	_, err := w.GetListenPort()
+	require.Error(t, err, "the interface must be up")
+	require.NoError(t, w.EnsureUp())
+	port, err := w.GetListenPort()
+	require.NoError(t, err)
+	require.Equal(t, DefaultListenPort, port)
+
+	keys := make([]wgtypes.Key, 2)
+	for i := range keys {
+		k, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		keys[i] = k.PublicKey()
+	}
+	prefix := func(s string) net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return *n
+	}
+	endpoint := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	require.NoError(t, w.ConfigureWireGuard(wgtypes.Config{Peers: []wgtypes.PeerConfig{
+		{PublicKey: keys[0], Endpoint: endpoint, AllowedIPs: []net.IPNet{prefix("10.0.0.1/32"), prefix("10.1.0.0/16")}},
+		{PublicKey: keys[1], UpdateOnly: true},
+	}}))
+	peers, err := w.GetPeers()
+	require.NoError(t, err)
+	require.Len(t, peers, 1, "update-only configs don't add peers")
+
+	require.NoError(t, w.ConfigureWireGuard(wgtypes.Config{Peers: []wgtypes.PeerConfig{
+		{PublicKey: keys[1], AllowedIPs: []net.IPNet{prefix("10.1.0.0/16")}},
+	}}))
+	p, ok := w.Peer(keys[0])
+	require.True(t, ok)
+	require.Equal(t, []net.IPNet{prefix("10.0.0.1/32")}, p.AllowedIPs, "allowed IPs move to the peer they're added to")
+	require.Equal(t, endpoint, p.Endpoint)
+
+	require.True(t, w.UpdatePeer(keys[0], func(p *wgtypes.Peer) { p.LastHandshakeTime = time.Unix(1600000000, 0) }))
+	p, _ = w.Peer(keys[0])
+	require.Equal(t, time.Unix(1600000000, 0), p.LastHandshakeTime)
+
+	w.FailWith("ConfigureWireGuard", errors.New("boom"))
+	require.EqualError(t, w.ConfigureWireGuard(wgtypes.Config{ReplacePeers: true}), "boom")
+	require.Len(t, w.Peers(), 2, "failed calls don't change the state")
+	w.FailWith("ConfigureWireGuard", nil)
+	require.NoError(t, w.ConfigureWireGuard(wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: keys[0], Remove: true}}}))
+	require.Len(t, w.Peers(), 1)
+	require.Len(t, w.CallsTo("ConfigureWireGuard"), 4)
+}
+
+func TestInterfaceRoutes(t *testing.T) {
+	i := NewInterface("wg0")
+	_, n, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+	require.NoError(t, i.SyncRoutes([]net.IPNet{*n}, interfaces.RouteOptions{Protocol: interfaces.DefaultRouteProtocol}))
+	require.Equal(t, []string{"10.0.0.0/24"}, i.Routes())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	removed := make(chan net.IPNet, 1)
+	done := make(chan error)
+	go func() {
+		done <- i.WatchRoutes(ctx, interfaces.RouteOptions{}, func(dst net.IPNet) { removed <- dst })
+	}()
+	require.Eventually(t, func() bool { return len(i.CallsTo("WatchRoutes")) == 1 }, time.Second, time.Millisecond)
+	require.True(t, i.DeleteRoute(*n))
+	require.Equal(t, *n, <-removed)
+	require.Empty(t, i.Routes())
+	require.False(t, i.DeleteRoute(*n))
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,21 @@
+package interfaces
+
+import (
+	"net"
+)
+
+// ProxyNeighbors answers ARP and NDP requests on a LAN interface for addresses reached through
+// another interface, ex. mesh addresses, so devices on the LAN can reach them without routes.
+type ProxyNeighbors interface {
+	// Sync makes the addresses answered for match ips, adding and removing entries as needed.
+	// Entries added by others are left alone.
+	Sync(ips []net.IP) error
+
+	// Close removes the entries added by Sync.
+	Close() error
+}
+
+// NewProxyNeighbors returns the proxy neighbors of the named interface.
+func NewProxyNeighbors(name string) (ProxyNeighbors, error) {
+	return newProxyNeighbors(name)
+}
@@ -0,0 +1,11 @@
+// +build darwin freebsd openbsd
+
+package interfaces
+
+import (
+	"fmt"
+)
+
+func newProxyNeighbors(name string) (ProxyNeighbors, error) {
+	return nil, fmt.Errorf("NewProxyNeighbors: %w", errUnimplemented)
+}
@@ -0,0 +1,87 @@
+// +build linux
+
+package interfaces
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+type linuxProxyNeighbors struct {
+	name string
+	link netlink.Link
+	// added holds the entries we added, keyed by address.
+	added map[string]net.IP
+	// ndp is true once proxy_ndp is enabled on the interface.
+	ndp bool
+}
+
+func newProxyNeighbors(name string) (ProxyNeighbors, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("finding interface %q: %w", name, err)
+	}
+	return &linuxProxyNeighbors{name: name, link: link, added: make(map[string]net.IP)}, nil
+}
+
+// Sync makes the proxy neighbor entries we added match ips. IPv4 addresses are answered by the
+// kernel's proxy ARP when the route to them is via another interface; IPv6 addresses require
+// proxy_ndp, which is enabled on the interface when the first is added.
+func (p *linuxProxyNeighbors) Sync(ips []net.IP) error {
+	index := p.link.Attrs().Index
+	desired := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		key := ip.String()
+		desired[key] = true
+		if _, ok := p.added[key]; ok {
+			continue
+		}
+		if ip.To4() == nil && !p.ndp {
+			path := filepath.Join("/proc/sys/net/ipv6/conf", p.name, "proxy_ndp")
+			if err := ioutil.WriteFile(path, []byte("1"), 0644); err != nil {
+				return fmt.Errorf("enabling proxy ndp on %q: %w", p.name, err)
+			}
+			p.ndp = true
+		}
+		err := netlink.NeighAdd(&netlink.Neigh{LinkIndex: index, Flags: netlink.NTF_PROXY, IP: ip})
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("adding proxy neighbor %s on %q: %w", key, p.name, err)
+		}
+		p.added[key] = ip
+	}
+	for key, ip := range p.added {
+		if desired[key] {
+			continue
+		}
+		if err := p.remove(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *linuxProxyNeighbors) remove(ip net.IP) error {
+	err := netlink.NeighDel(&netlink.Neigh{LinkIndex: p.link.Attrs().Index, Flags: netlink.NTF_PROXY, IP: ip})
+	if err != nil && err != syscall.ENOENT && err != syscall.ENODEV {
+		return fmt.Errorf("removing proxy neighbor %s on %q: %w", ip, p.name, err)
+	}
+	delete(p.added, ip.String())
+	return nil
+}
+
+// Close removes the proxy neighbor entries we added. proxy_ndp is left enabled, since others may
+// rely on it.
+func (p *linuxProxyNeighbors) Close() error {
+	for _, ip := range p.added {
+		if err := p.remove(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// +build linux
+
+package interfaces
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyNeighbors(t *testing.T) {
+	testInNetworkNamespace(t, func() {
+		defer func() {
+			out, err := exec.Command("ip", "link", "delete", "dummy").CombinedOutput()
+			if err != nil && !strings.Contains(string(out), "Cannot find device") {
+				panic(fmt.Errorf("failed: ip link delete dummy: %w - %s", err, string(out)))
+			}
+		}()
+
+		out, err := exec.Command("ip", "link", "add", "dev", "dummy", "type", "dummy").CombinedOutput()
+		if err != nil {
+			panic(fmt.Errorf("failed: ip link add dev dummy type dummy: %w - %s", err, string(out)))
+		}
+		// Entries added by others are left alone.
+		out, err = exec.Command("ip", "neigh", "add", "proxy", "192.168.9.1", "dev", "dummy").CombinedOutput()
+		if err != nil {
+			panic(fmt.Errorf("failed: ip neigh add proxy 192.168.9.1 dev dummy: %w - %s", err, string(out)))
+		}
+
+		p, err := NewProxyNeighbors("dummy")
+		require.NoError(t, err)
+		proxied := func() string {
+			out, err := exec.Command("ip", "neigh", "show", "proxy", "dev", "dummy").CombinedOutput()
+			require.NoError(t, err)
+			return string(out)
+		}
+
+		require.NoError(t, p.Sync([]net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}))
+		require.Contains(t, proxied(), "10.0.0.2")
+		require.Contains(t, proxied(), "fd00::2")
+		ndp, err := ioutil.ReadFile("/proc/sys/net/ipv6/conf/dummy/proxy_ndp")
+		require.NoError(t, err)
+		require.Equal(t, "1", strings.TrimSpace(string(ndp)))
+
+		require.NoError(t, p.Sync([]net.IP{net.ParseIP("10.0.0.3")}))
+		require.NotContains(t, proxied(), "10.0.0.2")
+		require.NotContains(t, proxied(), "fd00::2")
+		require.Contains(t, proxied(), "10.0.0.3")
+
+		require.NoError(t, p.Close())
+		require.NotContains(t, proxied(), "10.0.0.3")
+		require.Contains(t, proxied(), "192.168.9.1")
+	})
+}
@@ -63,6 +63,10 @@ type WireGuardInterface interface {
 	// GetListenPort returns the UDP port where the WireGuard driver is listening. The
 	// interface must be in the UP state.
 	GetListenPort() (int, error)
+
+	// GetPeers returns the peers configured on the interface, including their current
+	// endpoint, last handshake time, and transfer counters.
+	GetPeers() ([]wgtypes.Peer, error)
 }
 
 // WireGuardInterfaceOptions ...
@@ -77,6 +81,24 @@ type WireGuardInterfaceOptions struct {
 	BoringTunExtraArgs   string
 }
 
+// UserspaceDriverPath returns the path used to run a userspace driver, which is looked up in PATH
+// unless it's absolute.
+func (o *WireGuardInterfaceOptions) UserspaceDriverPath(driver WireGuardDriver) string {
+	switch driver {
+	case BoringTunDriver:
+		if o.BoringTunPath != "" {
+			return o.BoringTunPath
+		}
+		return defaultBoringTunPath
+	case WireGuardGoDriver:
+		if o.WireGuardGoPath != "" {
+			return o.WireGuardGoPath
+		}
+		return defaultWireGuardGoPath
+	}
+	return ""
+}
+
 type wgInterface struct {
 	wgClient *wgctrl.Client
 	Interface
@@ -87,7 +109,7 @@ var _ WireGuardInterface = &wgInterface{}
 type wgUserspaceInterface struct {
 	wgInterface
 	cmd        *exec.Cmd
-	driverExit chan error
+	driverExit <-chan error
 	closed     sync.Once
 }
 
@@ -256,6 +278,16 @@ func (w *wgInterface) GetListenPort() (int, error) {
 	return d.ListenPort, nil
 }
 
+// GetPeers returns the peers configured on the interface, including their current
+// endpoint, last handshake time, and transfer counters.
+func (w *wgInterface) GetPeers() ([]wgtypes.Peer, error) {
+	d, err := w.wgClient.Device(w.GetName())
+	if err != nil {
+		return nil, err
+	}
+	return d.Peers, nil
+}
+
 // ConfigureWireGuard configures WireGuard on the specified interface. See:
 // https://godoc.org/golang.zx2c4.com/wireguard/wgctrl#Client.ConfigureDevice
 func (w *wgInterface) ConfigureWireGuard(cfg wgtypes.Config) error {
@@ -268,10 +300,7 @@ func createWGBoringTunInterface(
 	options *WireGuardInterfaceOptions,
 	name string,
 ) (WireGuardInterface, error) {
-	path := options.BoringTunPath
-	if path == "" {
-		path = defaultBoringTunPath
-	}
+	path := options.UserspaceDriverPath(BoringTunDriver)
 	qualifiedPath, err := exec.LookPath(path)
 	switch {
 	case err == nil: // SUCCESS - fall past switch
@@ -302,10 +331,7 @@ func createWGWireGuardGoInterface(
 	options *WireGuardInterfaceOptions,
 	name string,
 ) (WireGuardInterface, error) {
-	path := options.WireGuardGoPath
-	if path == "" {
-		path = defaultWireGuardGoPath
-	}
+	path := options.UserspaceDriverPath(WireGuardGoDriver)
 	qualifiedPath, err := exec.LookPath(path)
 	switch {
 	case err == nil: // SUCCESS - fall past switch
@@ -345,7 +371,8 @@ func startWGUserspaceInterface(
 		return nil, fmt.Errorf("waiting for interface %q to be created: %w", name, err)
 	}
 	return &wgUserspaceInterface{
-		cmd: cmd,
+		cmd:        cmd,
+		driverExit: exit,
 		wgInterface: wgInterface{
 			Interface: iface,
 			wgClient:  wgClient,
@@ -412,6 +439,20 @@ func (w *wgUserspaceInterface) Close() error {
 	return nil
 }
 
+// KillUserspaceDriver abruptly kills the userspace driver process servicing the interface. It is
+// intended for testing resilience to driver crashes, and fails if the interface is not managed by a
+// userspace driver.
+func KillUserspaceDriver(iface WireGuardInterface) error {
+	w, ok := iface.(*wgUserspaceInterface)
+	if !ok {
+		return fmt.Errorf("interface %q is not managed by a userspace driver", iface.GetName())
+	}
+	if w.cmd == nil || w.cmd.Process == nil {
+		return errors.New("userspace driver cmd.Process not set")
+	}
+	return w.cmd.Process.Kill()
+}
+
 func cmdExit(cmd *exec.Cmd) <-chan error {
 	quit := make(chan error)
 	go func() {
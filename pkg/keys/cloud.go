@@ -0,0 +1,93 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// CloudProvider stores keys in a cloud secret manager, AWS Secrets Manager or GCP Secret Manager,
+// encrypted with a KMS key, using the provider's CLI, aws or gcloud, and its configured credentials.
+// Keys are passed to the CLI on stdin, so they don't appear in its arguments.
+type CloudProvider struct {
+	kind   string
+	kmsKey string
+	prefix string
+	// run runs the command with stdin, returning its output, or an error including its stderr.
+	run func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error)
+}
+
+var _ Provider = (*CloudProvider)(nil)
+
+// NewCloud returns a provider storing keys in the kind's secret manager, AWS or GCP, beneath
+// prefix, or DefaultPrefix if empty. Keys are encrypted with kmsKey, an AWS KMS key id or ARN, or a
+// GCP Cloud KMS key resource name, or the service's default key if empty.
+func NewCloud(kind, kmsKey, prefix string) (*CloudProvider, error) {
+	if kind != AWS && kind != GCP {
+		return nil, fmt.Errorf("unsupported cloud key provider %q", kind)
+	}
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return &CloudProvider{kind: kind, kmsKey: kmsKey, prefix: prefix, run: run}, nil
+}
+
+func run(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+	c := exec.CommandContext(ctx, cmd, args...)
+	c.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s %s: %w: %s", cmd, strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// PrivateKey reads the key from the secret manager, or creates the secret with a new one. Creating
+// an existing secret fails, so a key stored concurrently isn't replaced.
+func (c *CloudProvider) PrivateKey(ctx context.Context, name string) (wgtypes.Key, error) {
+	var getArgs, createArgs []string
+	var cmd, notFound, exists string
+	switch c.kind {
+	case AWS:
+		secret := c.prefix + "/" + name
+		cmd, notFound, exists = "aws", "ResourceNotFoundException", "ResourceExistsException"
+		getArgs = []string{"secretsmanager", "get-secret-value", "--secret-id", secret, "--query", "SecretString", "--output", "text"}
+		createArgs = []string{"secretsmanager", "create-secret", "--name", secret, "--secret-string", "file:///dev/stdin"}
+		if c.kmsKey != "" {
+			createArgs = append(createArgs, "--kms-key-id", c.kmsKey)
+		}
+	case GCP:
+		// Secret ids may not contain slashes.
+		secret := c.prefix + "-" + name
+		cmd, notFound, exists = "gcloud", "NOT_FOUND", "ALREADY_EXISTS"
+		getArgs = []string{"secrets", "versions", "access", "latest", "--secret", secret}
+		createArgs = []string{"secrets", "create", secret, "--data-file", "-", "--replication-policy", "automatic"}
+		if c.kmsKey != "" {
+			createArgs = append(createArgs, "--kms-key-name", c.kmsKey)
+		}
+	}
+	get := func() (string, bool, error) {
+		out, err := c.run(ctx, nil, cmd, getArgs...)
+		if err != nil && strings.Contains(err.Error(), notFound) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return string(bytes.TrimSpace(out)), true, nil
+	}
+	create := func(key string) (bool, error) {
+		_, err := c.run(ctx, []byte(key), cmd, createArgs...)
+		if err != nil && strings.Contains(err.Error(), exists) {
+			return true, nil
+		}
+		return false, err
+	}
+	return getOrCreate(get, create)
+}
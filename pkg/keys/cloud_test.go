@@ -0,0 +1,75 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloudProvider(t *testing.T) {
+	for _, tc := range []struct {
+		kind, get, create, notFound, exists string
+	}{{
+		kind:     AWS,
+		get:      "aws secretsmanager get-secret-value --secret-id wgmesh/peer1 --query SecretString --output text",
+		create:   "aws secretsmanager create-secret --name wgmesh/peer1 --secret-string file:///dev/stdin --kms-key-id alias/wgmesh",
+		notFound: "An error occurred (ResourceNotFoundException) when calling the GetSecretValue operation",
+		exists:   "An error occurred (ResourceExistsException) when calling the CreateSecret operation",
+	}, {
+		kind:     GCP,
+		get:      "gcloud secrets versions access latest --secret wgmesh-peer1",
+		create:   "gcloud secrets create wgmesh-peer1 --data-file - --replication-policy automatic --kms-key-name alias/wgmesh",
+		notFound: "ERROR: (gcloud.secrets.versions.access) NOT_FOUND: Secret [wgmesh-peer1] not found",
+		exists:   "ERROR: (gcloud.secrets.create) ALREADY_EXISTS: Secret [wgmesh-peer1] already exists",
+	}} {
+		t.Run(tc.kind, func(t *testing.T) {
+			var cmds []string
+			stored := ""
+			// raced stores a key from another agent as ours is created.
+			raced := ""
+			c, err := NewCloud(tc.kind, "alias/wgmesh", "")
+			require.NoError(t, err)
+			c.run = func(ctx context.Context, stdin []byte, cmd string, args ...string) ([]byte, error) {
+				line := cmd + " " + strings.Join(args, " ")
+				cmds = append(cmds, line)
+				switch line {
+				case tc.get:
+					if stored == "" {
+						return nil, errors.New(tc.notFound)
+					}
+					return []byte(stored + "\n"), nil
+				case tc.create:
+					if raced != "" {
+						stored = raced
+					}
+					if stored != "" {
+						return nil, errors.New(tc.exists)
+					}
+					stored = string(stdin)
+					return nil, nil
+				}
+				return nil, errors.New("unexpected command")
+			}
+			ctx := context.Background()
+
+			key, err := c.PrivateKey(ctx, "peer1")
+			require.NoError(t, err)
+			require.Equal(t, key.String(), stored)
+			require.Equal(t, []string{tc.get, tc.create}, cmds)
+			again, err := c.PrivateKey(ctx, "peer1")
+			require.NoError(t, err)
+			require.Equal(t, key, again, "the stored key is reused")
+
+			stored, raced = "", "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+			key, err = c.PrivateKey(ctx, "peer1")
+			require.NoError(t, err)
+			require.Equal(t, raced, key.String(), "a key stored concurrently is used")
+		})
+	}
+
+	_, err := NewCloud("azure", "", "")
+	require.EqualError(t, err, `unsupported cloud key provider "azure"`)
+}
@@ -0,0 +1,59 @@
+// Package keys stores WireGuard private keys in an external secret store, HashiCorp Vault or a
+// cloud secret manager encrypting them with a KMS key, so they're only ever held in memory and
+// loaded into the device, never written to disk or the registry.
+package keys
+
+import (
+	"context"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Supported providers.
+const (
+	Vault = "vault"
+	AWS   = "aws"
+	GCP   = "gcp"
+)
+
+// DefaultPrefix is where keys are stored by default, beneath the store's root.
+const DefaultPrefix = "wgmesh"
+
+// Provider holds peers' private keys.
+type Provider interface {
+	// PrivateKey returns the private key stored for the named peer, generating and storing one if
+	// there isn't one.
+	PrivateKey(ctx context.Context, name string) (wgtypes.Key, error)
+}
+
+// getOrCreate returns the key read by get, or if there isn't one, generates a key and stores it with
+// create. If another agent stores a key first, create reports exists and the stored key is read
+// again, so both use the same key.
+func getOrCreate(get func() (string, bool, error), create func(key string) (exists bool, err error)) (wgtypes.Key, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		s, found, err := get()
+		if err != nil {
+			return wgtypes.Key{}, err
+		}
+		if found {
+			key, err := wgtypes.ParseKey(s)
+			if err != nil {
+				return wgtypes.Key{}, fmt.Errorf("parsing stored private key: %w", err)
+			}
+			return key, nil
+		}
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return wgtypes.Key{}, fmt.Errorf("generating private key: %w", err)
+		}
+		exists, err := create(key.String())
+		if err != nil {
+			return wgtypes.Key{}, err
+		}
+		if !exists {
+			return key, nil
+		}
+	}
+	return wgtypes.Key{}, fmt.Errorf("storing private key: created concurrently, but not found")
+}
@@ -0,0 +1,141 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultVaultMount is the KV version 2 secrets engine keys are stored in by default.
+const DefaultVaultMount = "secret"
+
+// VaultProvider stores keys in a HashiCorp Vault KV version 2 secrets engine, as the privateKey
+// field of the secret at <mount>/<prefix>/<name>.
+type VaultProvider struct {
+	address string
+	token   string
+	mount   string
+	prefix  string
+	client  *http.Client
+}
+
+var _ Provider = (*VaultProvider)(nil)
+
+// NewVault returns a provider which stores keys in the KV version 2 engine at mount, or
+// DefaultVaultMount if empty, beneath prefix, or DefaultPrefix if empty, of the Vault server at
+// address, authenticating with the token. Nil uses http.DefaultClient.
+func NewVault(address, token, mount, prefix string, client *http.Client) *VaultProvider {
+	if mount == "" {
+		mount = DefaultVaultMount
+	}
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &VaultProvider{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		mount:   strings.Trim(mount, "/"),
+		prefix:  strings.Trim(prefix, "/"),
+		client:  client,
+	}
+}
+
+type vaultSecret struct {
+	Data struct {
+		Data struct {
+			PrivateKey string `json:"privateKey"`
+		} `json:"data"`
+	} `json:"data"`
+}
+
+type vaultWrite struct {
+	Options struct {
+		CAS int `json:"cas"`
+	} `json:"options"`
+	Data struct {
+		PrivateKey string `json:"privateKey"`
+	} `json:"data"`
+}
+
+// PrivateKey reads the key from Vault, or writes a new one with check-and-set, so it's only written
+// if the secret doesn't exist.
+func (v *VaultProvider) PrivateKey(ctx context.Context, name string) (wgtypes.Key, error) {
+	url := fmt.Sprintf("%s/v1/%s/data/%s", v.address, v.mount, path.Join(v.prefix, name))
+	get := func() (string, bool, error) {
+		secret := &vaultSecret{}
+		status, err := v.do(ctx, http.MethodGet, url, nil, secret)
+		if status == http.StatusNotFound {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if secret.Data.Data.PrivateKey == "" {
+			return "", false, fmt.Errorf("vault secret %s has no privateKey", url)
+		}
+		return secret.Data.Data.PrivateKey, true, nil
+	}
+	create := func(key string) (bool, error) {
+		w := &vaultWrite{}
+		w.Data.PrivateKey = key
+		status, err := v.do(ctx, http.MethodPost, url, w, nil)
+		if status == http.StatusBadRequest && err != nil && strings.Contains(err.Error(), "check-and-set") {
+			return true, nil
+		}
+		return false, err
+	}
+	return getOrCreate(get, create)
+}
+
+// do sends the request, decoding the response into out if it isn't nil. Failed requests return the
+// status with an error including Vault's errors.
+func (v *VaultProvider) do(ctx context.Context, method, url string, in, out interface{}) (int, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", v.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("vault %s %s: %w", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("vault %s %s: %w", method, url, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(b, &e)
+		return resp.StatusCode, fmt.Errorf("vault %s %s: %s: %s", method, url, resp.Status, strings.Join(e.Errors, "; "))
+	}
+	if out != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("vault %s %s: decoding response: %w", method, url, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
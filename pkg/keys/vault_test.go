@@ -0,0 +1,69 @@
+package keys
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultProvider(t *testing.T) {
+	// secrets holds the stored private keys, by path.
+	secrets := map[string]string{}
+	var writes int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			key, ok := secrets[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[]}`))
+				return
+			}
+			s := &vaultSecret{}
+			s.Data.Data.PrivateKey = key
+			json.NewEncoder(w).Encode(s)
+		case http.MethodPost:
+			writes++
+			in := &vaultWrite{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(in))
+			if _, ok := secrets[r.URL.Path]; ok && in.Options.CAS == 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+				return
+			}
+			secrets[r.URL.Path] = in.Data.PrivateKey
+			w.Write([]byte(`{"data":{"version":1}}`))
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	v := NewVault(srv.URL+"/", "s.token", "", "", nil)
+	key, err := v.PrivateKey(ctx, "peer1")
+	require.NoError(t, err)
+	require.Equal(t, key.String(), secrets["/v1/secret/data/wgmesh/peer1"])
+	again, err := v.PrivateKey(ctx, "peer1")
+	require.NoError(t, err)
+	require.Equal(t, key, again, "the stored key is reused")
+	require.Equal(t, 1, writes)
+
+	// A key stored by another agent between our read and write is used instead of ours.
+	secrets["/v1/kv/data/mesh/peer2"] = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	v = NewVault(srv.URL, "s.token", "kv", "/mesh/", nil)
+	key, err = v.PrivateKey(ctx, "peer2")
+	require.NoError(t, err)
+	require.Equal(t, "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=", key.String())
+
+	v = NewVault(srv.URL, "bogus", "", "", nil)
+	_, err = v.PrivateKey(ctx, "peer1")
+	require.EqualError(t, err, "vault GET "+srv.URL+"/v1/secret/data/wgmesh/peer1: 403 Forbidden: permission denied")
+}
@@ -0,0 +1,30 @@
+package log
+
+import (
+	"github.com/sirupsen/logrus"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+// Field names shared by every log line about a peer or interface, so logs can be aggregated across
+// a fleet.
+const (
+	FieldNamespace = "k8s_namespace"
+	FieldName      = "k8s_name"
+	FieldPublicKey = "public_key"
+	FieldInterface = "interface"
+)
+
+// WithPeer adds the peer's namespace, name, and public key to the logger's fields.
+func WithPeer(ll logrus.FieldLogger, peer *wgk8s.WireGuardPeer) logrus.FieldLogger {
+	return ll.WithFields(logrus.Fields{
+		FieldNamespace: peer.GetNamespace(),
+		FieldName:      peer.GetName(),
+		FieldPublicKey: peer.Spec.PublicKey,
+	})
+}
+
+// WithInterface adds the interface's name to the logger's fields.
+func WithInterface(ll logrus.FieldLogger, iface string) logrus.FieldLogger {
+	return ll.WithField(FieldInterface, iface)
+}
@@ -0,0 +1,25 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+)
+
+func TestWithPeer(t *testing.T) {
+	peer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "mesh", Name: "a"},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: "key"},
+	}
+	ll := WithInterface(WithPeer(logrus.New(), peer), "wg0")
+	require.Equal(t, logrus.Fields{
+		"k8s_namespace": "mesh",
+		"k8s_name":      "a",
+		"public_key":    "key",
+		"interface":     "wg0",
+	}, ll.(*logrus.Entry).Data)
+}
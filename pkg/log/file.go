@@ -0,0 +1,83 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// FileOptions configure a log file, and when it's rotated. Rotated files are kept alongside it,
+// named with the time they were rotated, ex. wgmesh-2020-01-02T15-04-05.000.log.
+type FileOptions struct {
+	Path string
+	// MaxSize is the size, in megabytes, at which the file is rotated.
+	MaxSize int
+	// MaxAge, if set, is how long the file is written to before it's rotated.
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files are kept, or 0 to keep them all.
+	MaxBackups int
+}
+
+// SetFile writes the standard logger's entries to the file, instead of stderr.
+func SetFile(o FileOptions) error {
+	if o.MaxSize <= 0 {
+		return fmt.Errorf("max size must be positive; got %d", o.MaxSize)
+	}
+	if o.MaxAge < 0 || o.MaxBackups < 0 {
+		return fmt.Errorf("max age and backups must not be negative")
+	}
+	// lumberjack opens the file on the first write; open it now to report problems up front.
+	f, err := os.OpenFile(o.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	logrus.SetOutput(newRotatingFile(o))
+	return nil
+}
+
+// rotatingFile is a log file which lumberjack rotates by size, and which is rotated by age on the
+// first write after it's reached maxAge.
+type rotatingFile struct {
+	*lumberjack.Logger
+	maxAge time.Duration
+	now    func() time.Time
+
+	lock sync.Mutex
+	// opened is when the current file was first written to.
+	opened time.Time
+}
+
+func newRotatingFile(o FileOptions) *rotatingFile {
+	return &rotatingFile{
+		Logger: &lumberjack.Logger{
+			Filename:   o.Path,
+			MaxSize:    o.MaxSize,
+			MaxBackups: o.MaxBackups,
+		},
+		maxAge: o.MaxAge,
+		now:    time.Now,
+	}
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.maxAge > 0 {
+		now := f.now()
+		switch {
+		case f.opened.IsZero():
+			f.opened = now
+		case now.Sub(f.opened) >= f.maxAge:
+			if err := f.Logger.Rotate(); err != nil {
+				return 0, err
+			}
+			f.opened = now
+		}
+	}
+	return f.Logger.Write(p)
+}
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgmesh-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wgmesh.log")
+
+	now := time.Unix(1000000, 0)
+	f := newRotatingFile(FileOptions{Path: path, MaxSize: 1, MaxAge: time.Hour, MaxBackups: 1})
+	f.now = func() time.Time { return now }
+	defer f.Close()
+	write := func(s string) {
+		_, err := f.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	backups := func() []string {
+		matches, err := filepath.Glob(filepath.Join(dir, "wgmesh-*.log"))
+		require.NoError(t, err)
+		return matches
+	}
+
+	write("first\n")
+	now = now.Add(59 * time.Minute)
+	write("second\n")
+	require.Empty(t, backups())
+
+	now = now.Add(time.Minute)
+	write("third\n")
+	require.Len(t, backups(), 1)
+	b, err := ioutil.ReadFile(backups()[0])
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\n", string(b))
+	b, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "third\n", string(b))
+}
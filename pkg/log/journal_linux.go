@@ -0,0 +1,68 @@
+// +build linux
+
+package log
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-systemd/journal"
+	"github.com/sirupsen/logrus"
+)
+
+// journalHook sends entries to journald, with their fields as journal fields.
+type journalHook struct{}
+
+func newJournalHook() (logrus.Hook, error) {
+	if !journal.Enabled() {
+		return nil, errors.New("journald socket not found")
+	}
+	return journalHook{}, nil
+}
+
+func (journalHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (journalHook) Fire(entry *logrus.Entry) error {
+	vars := map[string]string{"SYSLOG_IDENTIFIER": syslogTag}
+	for k, v := range entry.Data {
+		vars[journalField(k)] = fmt.Sprint(v)
+	}
+	return journal.Send(entry.Message, journalPriority(entry.Level), vars)
+}
+
+// journalField converts a logrus field name to a journal field name, which may only contain
+// uppercase letters, digits, and underscores, and may not start with an underscore. Ex. k8s_name
+// becomes K8S_NAME.
+func journalField(k string) string {
+	f := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, k)
+	f = strings.TrimLeft(f, "_")
+	if f == "" {
+		return "FIELD"
+	}
+	return f
+}
+
+func journalPriority(level logrus.Level) journal.Priority {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return journal.PriCrit
+	case logrus.ErrorLevel:
+		return journal.PriErr
+	case logrus.WarnLevel:
+		return journal.PriWarning
+	case logrus.InfoLevel:
+		return journal.PriInfo
+	}
+	return journal.PriDebug
+}
@@ -0,0 +1,21 @@
+// +build linux
+
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalField(t *testing.T) {
+	for in, expect := range map[string]string{
+		"k8s_name":          "K8S_NAME",
+		"error":             "ERROR",
+		"interface.desired": "INTERFACE_DESIRED",
+		"_private":          "PRIVATE",
+		"__":                "FIELD",
+	} {
+		require.Equal(t, expect, journalField(in), in)
+	}
+}
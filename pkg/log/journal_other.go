@@ -0,0 +1,13 @@
+// +build !linux
+
+package log
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newJournalHook() (logrus.Hook, error) {
+	return nil, errors.New("journald is only supported on linux")
+}
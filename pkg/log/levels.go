@@ -0,0 +1,127 @@
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Subsystems which can be logged at their own level.
+const (
+	SubsystemInterfaces  = "interfaces"
+	SubsystemPeerTracker = "peertracker"
+	SubsystemIPAM        = "ipam"
+	SubsystemRegistry    = "registry"
+)
+
+// Subsystems lists the subsystems which can be logged at their own level.
+var Subsystems = []string{SubsystemInterfaces, SubsystemIPAM, SubsystemPeerTracker, SubsystemRegistry}
+
+// Levels are the log level of each subsystem, and of everything else.
+type Levels struct {
+	Default    logrus.Level
+	Subsystems map[string]logrus.Level
+}
+
+// ParseLevels parses a comma separated list of subsystem=level pairs, ex.
+// "ipam=debug,default=info". A bare level sets the default. Unlisted subsystems log at the
+// default level, which is info unless set.
+func ParseLevels(s string) (Levels, error) {
+	levels := Levels{Default: logrus.InfoLevel, Subsystems: make(map[string]logrus.Level)}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, levelStr := "default", part
+		if i := strings.Index(part, "="); i >= 0 {
+			name, levelStr = part[:i], part[i+1:]
+		}
+		level, err := logrus.ParseLevel(levelStr)
+		if err != nil {
+			return Levels{}, err
+		}
+		if name == "default" {
+			levels.Default = level
+			continue
+		}
+		if !isSubsystem(name) {
+			return Levels{}, fmt.Errorf("unknown subsystem %q; valid: %s", name, strings.Join(Subsystems, ","))
+		}
+		levels.Subsystems[name] = level
+	}
+	return levels, nil
+}
+
+func isSubsystem(name string) bool {
+	for _, s := range Subsystems {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	levelsLock sync.Mutex
+	levels     map[string]logrus.Level
+	// subsystemLoggers are the loggers of subsystems with their own level, by base logger and
+	// subsystem.
+	subsystemLoggers map[subsystemKey]*logrus.Logger
+)
+
+type subsystemKey struct {
+	base      *logrus.Logger
+	subsystem string
+}
+
+// SetLevels sets the standard logger to the default level, and the level of loggers returned by
+// Subsystem.
+func SetLevels(l Levels) {
+	logrus.SetLevel(l.Default)
+	levelsLock.Lock()
+	defer levelsLock.Unlock()
+	levels = l.Subsystems
+	subsystemLoggers = nil
+}
+
+// Subsystem returns a logger for the subsystem, which logs at the subsystem's level if one is set.
+// The logger writes with ll's output, formatter, and hooks, as they are when it's created.
+func Subsystem(ll logrus.FieldLogger, subsystem string) logrus.FieldLogger {
+	var entry *logrus.Entry
+	switch l := ll.(type) {
+	case *logrus.Entry:
+		entry = l
+	case *logrus.Logger:
+		entry = logrus.NewEntry(l)
+	default:
+		return ll.WithField("subsystem", subsystem)
+	}
+	entry = entry.WithField("subsystem", subsystem)
+
+	levelsLock.Lock()
+	defer levelsLock.Unlock()
+	level, ok := levels[subsystem]
+	if !ok || level == entry.Logger.GetLevel() {
+		return entry
+	}
+	key := subsystemKey{base: entry.Logger, subsystem: subsystem}
+	logger, ok := subsystemLoggers[key]
+	if !ok {
+		logger = &logrus.Logger{
+			Out:          entry.Logger.Out,
+			Formatter:    entry.Logger.Formatter,
+			Hooks:        entry.Logger.Hooks,
+			ReportCaller: entry.Logger.ReportCaller,
+			ExitFunc:     entry.Logger.ExitFunc,
+			Level:        level,
+		}
+		if subsystemLoggers == nil {
+			subsystemLoggers = make(map[subsystemKey]*logrus.Logger)
+		}
+		subsystemLoggers[key] = logger
+	}
+	return logrus.NewEntry(logger).WithContext(entry.Context).WithFields(entry.Data)
+}
@@ -0,0 +1,77 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLevels(t *testing.T) {
+	tcs := []struct {
+		name        string
+		in          string
+		expect      Levels
+		expectError string
+	}{
+		{
+			name:   "empty",
+			expect: Levels{Default: logrus.InfoLevel, Subsystems: map[string]logrus.Level{}},
+		},
+		{
+			name:   "bare level",
+			in:     "debug",
+			expect: Levels{Default: logrus.DebugLevel, Subsystems: map[string]logrus.Level{}},
+		},
+		{
+			name: "subsystems",
+			in:   "ipam=debug, default=warn,peertracker=error",
+			expect: Levels{Default: logrus.WarnLevel, Subsystems: map[string]logrus.Level{
+				SubsystemIPAM:        logrus.DebugLevel,
+				SubsystemPeerTracker: logrus.ErrorLevel,
+			}},
+		},
+		{
+			name:        "unknown subsystem",
+			in:          "dns=debug",
+			expectError: `unknown subsystem "dns"; valid: interfaces,ipam,peertracker,registry`,
+		},
+		{
+			name:        "bad level",
+			in:          "ipam=loud",
+			expectError: `not a valid logrus Level: "loud"`,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			levels, err := ParseLevels(tc.in)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, levels)
+		})
+	}
+}
+
+func TestSubsystem(t *testing.T) {
+	defer SetLevels(Levels{Default: logrus.InfoLevel})
+	SetLevels(Levels{Subsystems: map[string]logrus.Level{SubsystemIPAM: logrus.DebugLevel}})
+
+	var buf bytes.Buffer
+	base := logrus.New()
+	base.Out = &buf
+	base.Formatter = &logrus.TextFormatter{DisableTimestamp: true}
+	ll := base.WithField("k8s_name", "a")
+
+	Subsystem(ll, SubsystemIPAM).Debug("claimed")
+	Subsystem(ll, SubsystemPeerTracker).Debug("dropped")
+	Subsystem(ll, SubsystemPeerTracker).Info("applied")
+	ll.Debug("dropped")
+	require.Equal(t,
+		"level=debug msg=claimed k8s_name=a subsystem=ipam\n"+
+			"level=info msg=applied k8s_name=a subsystem=peertracker\n",
+		buf.String())
+}
@@ -0,0 +1,81 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mattn/go-isatty"
+	"github.com/sirupsen/logrus"
+)
+
+// Outputs where the standard logger can write.
+const (
+	OutputStderr   = "stderr"
+	OutputStdout   = "stdout"
+	OutputSyslog   = "syslog"
+	OutputJournald = "journald"
+)
+
+// Outputs lists where the standard logger can write.
+var Outputs = []string{OutputStderr, OutputStdout, OutputSyslog, OutputJournald}
+
+// Formats of the standard logger's entries.
+const (
+	FormatAuto = "auto"
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Formats lists the formats of the standard logger's entries.
+var Formats = []string{FormatAuto, FormatJSON, FormatText}
+
+// syslogTag identifies our entries in syslog and the journal.
+const syslogTag = "wgmesh"
+
+// SetOutput sends the standard logger's entries to the output. Entries sent to syslog or journald
+// aren't also written to stderr.
+func SetOutput(output string) error {
+	var hook logrus.Hook
+	var err error
+	switch output {
+	case OutputStderr:
+		logrus.SetOutput(os.Stderr)
+		return nil
+	case OutputStdout:
+		logrus.SetOutput(os.Stdout)
+		return nil
+	case OutputSyslog:
+		hook, err = newSyslogHook()
+	case OutputJournald:
+		hook, err = newJournalHook()
+	default:
+		return fmt.Errorf("unsupported log output %q", output)
+	}
+	if err != nil {
+		return err
+	}
+	logrus.AddHook(hook)
+	logrus.SetOutput(ioutil.Discard)
+	return nil
+}
+
+// SetFormat sets the format of the standard logger's entries. Auto formats entries as text when
+// they're written to a terminal, and as JSON otherwise. Set the output first.
+func SetFormat(format string) error {
+	switch format {
+	case FormatAuto:
+		if f, ok := logrus.StandardLogger().Out.(*os.File); ok && isatty.IsTerminal(f.Fd()) {
+			logrus.SetFormatter(&logrus.TextFormatter{})
+		} else {
+			logrus.SetFormatter(&logrus.JSONFormatter{})
+		}
+	case FormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case FormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	default:
+		return fmt.Errorf("unsupported log format %q", format)
+	}
+	return nil
+}
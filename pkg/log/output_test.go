@@ -0,0 +1,26 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetFormat(t *testing.T) {
+	defer logrus.SetOutput(os.Stderr)
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	require.NoError(t, SetFormat(FormatAuto))
+	require.IsType(t, &logrus.JSONFormatter{}, logrus.StandardLogger().Formatter)
+	require.NoError(t, SetFormat(FormatText))
+	require.IsType(t, &logrus.TextFormatter{}, logrus.StandardLogger().Formatter)
+	require.NoError(t, SetFormat(FormatJSON))
+	require.IsType(t, &logrus.JSONFormatter{}, logrus.StandardLogger().Formatter)
+	require.EqualError(t, SetFormat("xml"), `unsupported log format "xml"`)
+	require.EqualError(t, SetOutput("kafka"), `unsupported log output "kafka"`)
+}
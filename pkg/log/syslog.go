@@ -0,0 +1,21 @@
+// +build !windows
+
+package log
+
+import (
+	"fmt"
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// newSyslogHook returns a hook which sends entries to the local syslog daemon, with the daemon
+// facility.
+func newSyslogHook() (logrus.Hook, error) {
+	hook, err := lsyslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+	return hook, nil
+}
@@ -0,0 +1,13 @@
+// +build windows
+
+package log
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newSyslogHook() (logrus.Hook, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
@@ -0,0 +1,94 @@
+package preflight
+
+import (
+	"fmt"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	authorizationClient "k8s.io/client-go/kubernetes/typed/authorization/v1"
+)
+
+// Permission is a verb on a resource which must be allowed.
+type Permission struct {
+	Group       string
+	Resource    string
+	Subresource string
+	Verb        string
+	Namespace   string
+	Name        string
+}
+
+// String describes the permission like `kubectl auth can-i`'s arguments.
+func (p Permission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	if p.Name != "" {
+		resource += "/" + p.Name
+	}
+	if p.Subresource != "" {
+		resource += " --subresource=" + p.Subresource
+	}
+	if p.Namespace != "" {
+		resource += " -n " + p.Namespace
+	}
+	return p.Verb + " " + resource
+}
+
+// RegistryPermissions returns the permissions an agent needs in a Kubernetes registry's namespace.
+func RegistryPermissions(namespace string) []Permission {
+	var out []Permission
+	add := func(resource string, verbs ...string) {
+		for _, verb := range verbs {
+			out = append(out, Permission{
+				Group:     wgk8s.GroupName,
+				Resource:  resource,
+				Verb:      verb,
+				Namespace: namespace,
+			})
+		}
+	}
+	add("wireguardpeers", "get", "list", "watch", "create", "update", "delete")
+	add("meshes", "list", "watch")
+	add("wireguardmeshpolicies", "list", "watch")
+	add("ippools", "get")
+	add("ipclaims", "get", "list", "create", "update", "delete")
+	return out
+}
+
+// NodePermissions returns the permissions an agent needs on its --kube-node in the local cluster.
+func NodePermissions(node string) []Permission {
+	return []Permission{
+		{Resource: "nodes", Verb: "get", Name: node},
+		{Resource: "nodes", Verb: "patch", Name: node},
+		{Resource: "nodes", Subresource: "status", Verb: "patch", Name: node},
+	}
+}
+
+// CheckPermissions asks the API server whether the client's user is allowed each permission,
+// returning those which are denied.
+func CheckPermissions(reviews authorizationClient.SelfSubjectAccessReviewInterface, perms []Permission) ([]Permission, error) {
+	var denied []Permission
+	for _, p := range perms {
+		review, err := reviews.Create(&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   p.Namespace,
+					Verb:        p.Verb,
+					Group:       p.Group,
+					Resource:    p.Resource,
+					Subresource: p.Subresource,
+					Name:        p.Name,
+				},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reviewing access to %q: %w", p, err)
+		}
+		if !review.Status.Allowed {
+			denied = append(denied, p)
+		}
+	}
+	return denied, nil
+}
@@ -0,0 +1,190 @@
+// Package preflight checks whether a host and its clusters can run an agent, and explains how to
+// fix what's missing.
+package preflight
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/jcodybaker/wgmesh/pkg/interfaces"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	Pass Status = "PASS"
+	Warn Status = "WARN"
+	Fail Status = "FAIL"
+	Skip Status = "SKIP"
+)
+
+// Result describes the outcome of a check. Fix suggests how to resolve a warning or failure.
+type Result struct {
+	Check   string
+	Status  Status
+	Message string
+	Fix     string
+}
+
+// capNetAdmin is the bit of CAP_NET_ADMIN in the capability sets of /proc/<pid>/status.
+const capNetAdmin = 12
+
+var (
+	procStatusPath = "/proc/self/status"
+	sysModulePath  = "/sys/module/wireguard"
+)
+
+// Drivers checks that the configured WireGuard driver, or with auto-selection any driver, is
+// available.
+func Drivers(options *interfaces.WireGuardInterfaceOptions) []Result {
+	kernel := kernelModule()
+	boringtun := userspaceDriver(options, interfaces.BoringTunDriver)
+	wireguardGo := userspaceDriver(options, interfaces.WireGuardGoDriver)
+	switch options.Driver {
+	case interfaces.KernelDriver:
+		return []Result{kernel}
+	case interfaces.BoringTunDriver:
+		return []Result{boringtun}
+	case interfaces.WireGuardGoDriver:
+		return []Result{wireguardGo}
+	case interfaces.ExistingInterface:
+		return []Result{{
+			Check:   "driver",
+			Status:  Skip,
+			Message: "using an existing interface",
+		}}
+	}
+	// Auto-selection only needs one of them.
+	results := []Result{kernel, boringtun, wireguardGo}
+	if kernel.Status == Pass || boringtun.Status == Pass || wireguardGo.Status == Pass {
+		for i := range results {
+			if results[i].Status == Fail {
+				results[i].Status = Skip
+				results[i].Fix = ""
+			}
+		}
+	}
+	return results
+}
+
+func kernelModule() Result {
+	r := Result{Check: "kernel module"}
+	if runtime.GOOS != "linux" {
+		r.Status = Skip
+		r.Message = "WireGuard kernel module is only supported on Linux"
+		return r
+	}
+	if _, err := os.Stat(sysModulePath); err == nil {
+		r.Status = Pass
+		r.Message = "wireguard module is loaded"
+		return r
+	}
+	// Creating a wireguard link loads the module on demand.
+	if modprobe, err := exec.LookPath("modprobe"); err == nil {
+		if exec.Command(modprobe, "--dry-run", "--quiet", "wireguard").Run() == nil {
+			r.Status = Pass
+			r.Message = "wireguard module is available"
+			return r
+		}
+	}
+	r.Status = Fail
+	r.Message = "wireguard module is not loaded or available"
+	r.Fix = "install the WireGuard kernel module (Linux 5.6+ includes it), or a userspace driver"
+	return r
+}
+
+func userspaceDriver(options *interfaces.WireGuardInterfaceOptions, driver interfaces.WireGuardDriver) Result {
+	r := Result{Check: string(driver)}
+	path := options.UserspaceDriverPath(driver)
+	qualified, err := exec.LookPath(path)
+	if err != nil {
+		r.Status = Fail
+		r.Message = fmt.Sprintf("%q not found: %v", path, err)
+		r.Fix = fmt.Sprintf("install %s in PATH, or pass --%s-path", driver, driver)
+		return r
+	}
+	r.Status = Pass
+	r.Message = fmt.Sprintf("found %s", qualified)
+	return r
+}
+
+// NetAdmin checks that the process has CAP_NET_ADMIN, which is required to create and configure
+// interfaces and routes.
+func NetAdmin() Result {
+	r := Result{Check: "NET_ADMIN"}
+	if runtime.GOOS != "linux" {
+		r.Status = Skip
+		r.Message = "capabilities are only checked on Linux"
+		return r
+	}
+	ok, err := hasCapability(procStatusPath, capNetAdmin)
+	switch {
+	case err != nil:
+		r.Status = Warn
+		r.Message = fmt.Sprintf("reading capabilities: %v", err)
+	case ok:
+		r.Status = Pass
+		r.Message = "process has CAP_NET_ADMIN"
+	default:
+		r.Status = Fail
+		r.Message = "process lacks CAP_NET_ADMIN"
+		r.Fix = "run as root, or grant NET_ADMIN, ex. securityContext.capabilities.add in a pod spec"
+	}
+	return r
+}
+
+// hasCapability reports whether the effective capability set in a /proc status file includes
+// the capability.
+func hasCapability(statusPath string, capability uint) (bool, error) {
+	f, err := os.Open(statusPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "CapEff:" {
+			continue
+		}
+		caps, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return false, fmt.Errorf("parsing CapEff %q: %w", fields[1], err)
+		}
+		return caps&(1<<capability) != 0, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("no CapEff in %s", statusPath)
+}
+
+// UDPPort checks that the WireGuard port can be bound. A port of 0 is chosen at random and always
+// passes. Whether peers can reach the port through firewalls and NAT can only be tested from
+// outside the host.
+func UDPPort(port int) Result {
+	r := Result{Check: "UDP port"}
+	if port == 0 {
+		r.Status = Pass
+		r.Message = "a random port will be used; publish it with --endpoint-addr or rely on NAT traversal"
+		return r
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		r.Status = Fail
+		r.Message = fmt.Sprintf("binding UDP port %d: %v", port, err)
+		r.Fix = "stop whatever is using the port, or choose another with --port"
+		return r
+	}
+	conn.Close()
+	r.Status = Pass
+	r.Message = fmt.Sprintf("UDP port %d is free; make sure firewalls allow it inbound", port)
+	return r
+}
@@ -0,0 +1,82 @@
+package preflight
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestHasCapability(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tcs := []struct {
+		name      string
+		status    string
+		expect    bool
+		expectErr bool
+	}{
+		{
+			name:   "root",
+			status: "Name:\tcat\nCapInh:\t0000000000000000\nCapEff:\t000001ffffffffff\n",
+			expect: true,
+		},
+		{
+			name:   "net admin only",
+			status: "CapEff:\t0000000000001000\n",
+			expect: true,
+		},
+		{
+			name:   "unprivileged",
+			status: "CapEff:\t0000000000000000\n",
+		},
+		{
+			name:      "missing",
+			status:    "Name:\tcat\n",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name)
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.status), 0600))
+			ok, err := hasCapability(path, capNetAdmin)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, ok)
+		})
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	cs := kubefake.NewSimpleClientset()
+	cs.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = attrs.Verb != "delete" && attrs.Subresource == ""
+		return true, review, nil
+	})
+	perms := append(RegistryPermissions("ns"), NodePermissions("node-a")...)
+	denied, err := CheckPermissions(cs.AuthorizationV1().SelfSubjectAccessReviews(), perms)
+	require.NoError(t, err)
+	var got []string
+	for _, p := range denied {
+		got = append(got, p.String())
+	}
+	require.Equal(t, []string{
+		"delete wireguardpeers.wgmesh.codybaker.com -n ns",
+		"delete ipclaims.wgmesh.codybaker.com -n ns",
+		"patch nodes/node-a --subresource=status",
+	}, got)
+}
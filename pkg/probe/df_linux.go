@@ -0,0 +1,29 @@
+// +build linux
+
+package probe
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment has the kernel set the don't fragment bit on the conn's packets, and report
+// packets too large for the path, rather than fragmenting them.
+func setDontFragment(c *net.UDPConn, v4 bool) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if v4 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
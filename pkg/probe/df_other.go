@@ -0,0 +1,13 @@
+// +build !linux
+
+package probe
+
+import (
+	"errors"
+	"net"
+)
+
+// setDontFragment isn't supported on this platform, so MTU probes would be fragmented by the host.
+func setDontFragment(c *net.UDPConn, v4 bool) error {
+	return errors.New("path MTU probes are only supported on linux")
+}
@@ -0,0 +1,81 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// echoMagic starts every UDP probe, so the echo server ignores, rather than reflects, other traffic.
+var echoMagic = []byte("wgmesh-probe")
+
+// echoLen is the length of a UDP probe: the magic and a sequence number.
+var echoLen = len(echoMagic) + 8
+
+var udpSeq uint64
+
+// UDP sends a probe to the echo server at ip and port, and returns the round trip time of its echo.
+// Unlike Ping, it needs no privileges, and works where ICMP is filtered, but the peer must be
+// running an echo server.
+func UDP(ctx context.Context, ip net.IP, port int) (time.Duration, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return 0, fmt.Errorf("dialing %s: %w", ip, err)
+	}
+	defer c.Close()
+	if err = c.SetDeadline(deadline(ctx)); err != nil {
+		return 0, err
+	}
+	msg := make([]byte, echoLen)
+	copy(msg, echoMagic)
+	binary.BigEndian.PutUint64(msg[len(echoMagic):], atomic.AddUint64(&udpSeq, 1))
+
+	start := time.Now()
+	if _, err = c.Write(msg); err != nil {
+		return 0, fmt.Errorf("sending probe: %w", err)
+	}
+	buf := make([]byte, echoLen+1)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			if isTimeout(err) {
+				return 0, fmt.Errorf("no echo from %s", ip)
+			}
+			// ex. ECONNREFUSED, when the peer isn't running an echo server.
+			return 0, fmt.Errorf("reading echo: %w", err)
+		}
+		if n == echoLen && bytes.Equal(buf[:n], msg) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// ServeEcho echoes UDP probes received on the conn until the context is canceled. Each reply is
+// the size of the probe, so the server can't amplify spoofed traffic. Probes may be padded, ex. by
+// MTU, up to the largest UDP datagram.
+func ServeEcho(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if n < echoLen || !bytes.HasPrefix(buf, echoMagic) {
+			continue
+		}
+		conn.WriteTo(buf[:n], from)
+	}
+}
@@ -0,0 +1,114 @@
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// mtuAttemptTimeout bounds each attempt to probe a packet size. A size is given two attempts, so
+// a single lost packet doesn't lower the MTU.
+const mtuAttemptTimeout = 500 * time.Millisecond
+
+// MTU measures the largest IP packet, between min and max bytes, which reaches the echo server at
+// ip and port and is echoed back, by binary search with UDP probes padded to each size. Probes
+// aren't fragmented by the host, so through a WireGuard tunnel, sizes above the interface MTU fail
+// locally, and those whose encapsulated packets are dropped on the path, ex. fragments filtered by
+// a firewall, go unanswered. It fails if a probe of min bytes isn't echoed.
+func MTU(ctx context.Context, ip net.IP, port, min, max int) (int, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return 0, fmt.Errorf("dialing %s: %w", ip, err)
+	}
+	defer c.Close()
+	if err = setDontFragment(c.(*net.UDPConn), ip.To4() != nil); err != nil {
+		return 0, fmt.Errorf("disabling fragmentation: %w", err)
+	}
+	headers := 20 + 8
+	if ip.To4() == nil {
+		headers = 40 + 8
+	}
+	if min < headers+echoLen {
+		min = headers + echoLen
+	}
+
+	echoed := func(size int) (bool, error) {
+		for i := 0; i < 2; i++ {
+			ok, err := echoSized(ctx, c, size-headers)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	ok, err := echoed(max)
+	if err != nil || ok {
+		return max, err
+	}
+	ok, err = echoed(min)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("no echo of a %d byte probe from %s", min, ip)
+	}
+	// min is echoed and max isn't.
+	for max-min > 1 {
+		size := min + (max-min)/2
+		ok, err := echoed(size)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			min = size
+		} else {
+			max = size
+		}
+	}
+	return min, nil
+}
+
+// echoSized sends a probe with a UDP payload of n bytes and returns true if it's echoed. Probes too
+// large to send without fragmentation aren't echoed.
+func echoSized(ctx context.Context, c net.Conn, n int) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	d := time.Now().Add(mtuAttemptTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		d = ctxDeadline
+	}
+	if err := c.SetDeadline(d); err != nil {
+		return false, err
+	}
+	msg := make([]byte, n)
+	copy(msg, echoMagic)
+	binary.BigEndian.PutUint64(msg[len(echoMagic):], atomic.AddUint64(&udpSeq, 1))
+	if _, err := c.Write(msg); err != nil {
+		if errors.Is(err, syscall.EMSGSIZE) {
+			return false, nil
+		}
+		return false, fmt.Errorf("sending probe: %w", err)
+	}
+	buf := make([]byte, n+1)
+	for {
+		read, err := c.Read(buf)
+		if err != nil {
+			if isTimeout(err) || errors.Is(err, syscall.EMSGSIZE) {
+				// A "fragmentation needed" error for an earlier probe may be reported on read.
+				return false, nil
+			}
+			return false, fmt.Errorf("reading echo: %w", err)
+		}
+		if read == n && string(buf[:read]) == string(msg) {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package probe measures whether peers' mesh addresses are reachable through the tunnel.
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// DefaultTimeout bounds probes whose context has no deadline.
+const DefaultTimeout = 2 * time.Second
+
+// StaleHandshake is the age after which WireGuard sessions expire (REJECT_AFTER_TIME); a peer
+// without a newer handshake has no session.
+const StaleHandshake = 180 * time.Second
+
+// discardPort receives the packets which nudge WireGuard into a handshake. Whether the peer
+// answers doesn't matter.
+const discardPort = 9
+
+var echoSeq uint32
+
+// Ping sends an ICMP echo request to ip and returns the round trip time of its reply. It uses
+// unprivileged ping sockets where the host allows them (net.ipv4.ping_group_range), and raw sockets
+// otherwise, which need CAP_NET_RAW.
+func Ping(ctx context.Context, ip net.IP) (time.Duration, error) {
+	v4 := ip.To4() != nil
+	c, privileged, err := listen(v4)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if err = c.SetDeadline(deadline(ctx)); err != nil {
+		return 0, err
+	}
+
+	id, seq := os.Getpid()&0xffff, int(atomic.AddUint32(&echoSeq, 1)&0xffff)
+	var echoType, replyType icmp.Type = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	proto := 58 // ipv6-icmp
+	if v4 {
+		echoType, replyType, proto = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply, 1
+	}
+	msg := icmp.Message{Type: echoType, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("wgmesh")}}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if privileged {
+		dst = &net.IPAddr{IP: ip}
+	}
+
+	start := time.Now()
+	if _, err = c.WriteTo(b, dst); err != nil {
+		return 0, fmt.Errorf("sending echo request: %w", err)
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			if isTimeout(err) {
+				return 0, fmt.Errorf("no reply from %s", ip)
+			}
+			return 0, fmt.Errorf("reading echo reply: %w", err)
+		}
+		rtt := time.Since(start)
+		if !addrIP(from).Equal(ip) {
+			continue
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		// The kernel assigns the ID of unprivileged ping sockets, and only delivers their replies.
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq && (!privileged || echo.ID == id) {
+			return rtt, nil
+		}
+	}
+}
+
+// listen opens an unprivileged ping socket, or a raw socket if ping sockets aren't permitted.
+func listen(v4 bool) (*icmp.PacketConn, bool, error) {
+	network, raw, addr := "udp6", "ip6:ipv6-icmp", "::"
+	if v4 {
+		network, raw, addr = "udp4", "ip4:icmp", "0.0.0.0"
+	}
+	if c, err := icmp.ListenPacket(network, addr); err == nil {
+		return c, false, nil
+	}
+	c, err := icmp.ListenPacket(raw, addr)
+	if err != nil {
+		return nil, false, fmt.Errorf("opening ICMP socket: %w", err)
+	}
+	return c, true, nil
+}
+
+// Handshake probes a peer directly connected over WireGuard. If the peer has no current session, a
+// packet sent to ip, its mesh address, has WireGuard initiate a handshake. lastHandshake reports the
+// peer's latest handshake, as read from the device, and is polled until it's current. Handshake
+// returns the time of the current handshake, and how long the new handshake took, which is zero if
+// the session was already established.
+func Handshake(ctx context.Context, ip net.IP, lastHandshake func() (time.Time, error)) (time.Time, time.Duration, error) {
+	start := time.Now()
+	last, err := lastHandshake()
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if start.Sub(last) < StaleHandshake {
+		return last, 0, nil
+	}
+
+	c, err := net.Dial("udp", net.JoinHostPort(ip.String(), fmt.Sprint(discardPort)))
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("sending to %s: %w", ip, err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("wgmesh")); err != nil {
+		return time.Time{}, 0, fmt.Errorf("sending to %s: %w", ip, err)
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, deadline(ctx))
+	defer cancel()
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if last.IsZero() {
+				return time.Time{}, 0, errors.New("no handshake")
+			}
+			return last, 0, fmt.Errorf("no handshake since %s", last.Format(time.RFC3339))
+		case <-t.C:
+		}
+		handshake, err := lastHandshake()
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		if handshake.After(last) && time.Since(handshake) < StaleHandshake {
+			took := handshake.Sub(start)
+			if took < 0 {
+				// The device's clock is coarser than ours.
+				took = 0
+			}
+			return handshake, took, nil
+		}
+	}
+}
+
+func deadline(ctx context.Context) time.Time {
+	if d, ok := ctx.Deadline(); ok {
+		return d
+	}
+	return time.Now().Add(DefaultTimeout)
+}
+
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
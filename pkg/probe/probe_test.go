@@ -0,0 +1,132 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPing(t *testing.T) {
+	c, _, err := listen(true)
+	if err != nil {
+		t.Skipf("ICMP sockets unavailable: %v", err)
+	}
+	c.Close()
+	rtt, err := Ping(context.Background(), net.ParseIP("127.0.0.1"))
+	require.NoError(t, err)
+	require.True(t, rtt > 0)
+}
+
+func TestHandshake(t *testing.T) {
+	loopback := net.ParseIP("127.0.0.1")
+	t.Run("current session", func(t *testing.T) {
+		last := time.Now().Add(-time.Minute)
+		handshake, took, err := Handshake(context.Background(), loopback, func() (time.Time, error) {
+			return last, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, last, handshake)
+		require.Zero(t, took)
+	})
+	t.Run("new handshake", func(t *testing.T) {
+		var mu sync.Mutex
+		last := time.Now().Add(-time.Hour)
+		calls := 0
+		handshake, _, err := Handshake(context.Background(), loopback, func() (time.Time, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if calls == 3 {
+				last = time.Now()
+			}
+			return last, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, last, handshake)
+	})
+	t.Run("no handshake", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, _, err := Handshake(ctx, loopback, func() (time.Time, error) {
+			return time.Time{}, nil
+		})
+		require.EqualError(t, err, "no handshake")
+	})
+}
+
+func TestUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ServeEcho(ctx, conn) }()
+
+	loopback := net.ParseIP("127.0.0.1")
+	rtt, err := UDP(context.Background(), loopback, conn.LocalAddr().(*net.UDPAddr).Port)
+	require.NoError(t, err)
+	require.True(t, rtt > 0)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	// Nothing is listening now.
+	tctx, tcancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer tcancel()
+	_, err = UDP(tctx, loopback, conn.LocalAddr().(*net.UDPAddr).Port)
+	require.Error(t, err)
+}
+
+func TestMTU(t *testing.T) {
+	if c, err := net.ListenUDP("udp", nil); err == nil {
+		err = setDontFragment(c, true)
+		c.Close()
+		if err != nil {
+			t.Skipf("unable to disable fragmentation: %v", err)
+		}
+	}
+	loopback := net.ParseIP("127.0.0.1")
+	t.Run("path fits", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go ServeEcho(ctx, conn)
+
+		mtu, err := MTU(context.Background(), loopback, conn.LocalAddr().(*net.UDPAddr).Port, 576, 1420)
+		require.NoError(t, err)
+		require.Equal(t, 1420, mtu)
+	})
+	t.Run("large packets dropped", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer conn.Close()
+		go func() {
+			buf := make([]byte, 65535)
+			for {
+				n, from, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				// Drop IP packets over 1380 bytes.
+				if n+28 <= 1380 {
+					conn.WriteTo(buf[:n], from)
+				}
+			}
+		}()
+		mtu, err := MTU(context.Background(), loopback, conn.LocalAddr().(*net.UDPAddr).Port, 576, 1420)
+		require.NoError(t, err)
+		require.Equal(t, 1380, mtu)
+	})
+	t.Run("no echo server", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+		_, err = MTU(context.Background(), loopback, port, 576, 1420)
+		require.Error(t, err)
+	})
+}
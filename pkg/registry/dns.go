@@ -0,0 +1,354 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	log "github.com/sirupsen/logrus"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// DNSService and DNSProto name the SRV records which list a zone's peers, ex.
+	// _wgmesh._udp.example.com.
+	DNSService = "wgmesh"
+	DNSProto   = "udp"
+
+	// TXT record keys published on each peer's SRV target.
+	dnsPublicKey = "wgmesh-pk"
+	dnsIPs       = "wgmesh-ips"
+	dnsRoutes    = "wgmesh-routes"
+)
+
+// dnsResolver looks up the records describing peers. It's satisfied by *net.Resolver.
+type dnsResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DNS is a Registry which discovers peers from records in a DNS zone, for meshes whose only shared
+// infrastructure is DNS. Each peer is an SRV record at _wgmesh._udp.<zone> whose target and port
+// are its endpoint; TXT records on the target carry its public key, addresses, and routes. A port
+// of 0 marks a client-only peer.
+//
+// The zone is read-only. Records registered through the Registry, ex. the local peer, are kept in
+// memory and shadow the zone's records with the same name or public key. They must be published in
+// the zone out of band, so the records to publish are logged when they change. Meshes aren't
+// published in DNS, and no IPPools are available.
+type DNS struct {
+	ll       log.FieldLogger
+	store    *Memory
+	zone     string
+	resolver dnsResolver
+
+	lock sync.Mutex
+	// local names the records registered through the Registry rather than read from the zone,
+	// with the DNS records last logged for publishing them.
+	local map[string][]string
+}
+
+var _ Registry = (*DNS)(nil)
+
+// NewDNS returns a Registry for the namespace whose peers are read from the zone. Call Sync to read
+// the zone, and Run to keep following it.
+func NewDNS(zone, namespace string, ll log.FieldLogger) (*DNS, error) {
+	store, err := NewMemory(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &DNS{
+		ll:       ll.WithField("zone", zone),
+		store:    store,
+		zone:     strings.TrimSuffix(zone, "."),
+		resolver: net.DefaultResolver,
+		local:    make(map[string][]string),
+	}, nil
+}
+
+// Register stores a WireGuardPeer record locally, returning it as stored.
+func (d *DNS) Register(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// A record read from the zone is replaced by the registered one.
+	if _, ok := d.local[peer.GetName()]; !ok {
+		err := d.store.Delete(peer.GetName(), "")
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	created, err := d.store.Register(peer)
+	if err != nil {
+		return nil, err
+	}
+	d.local[peer.GetName()] = nil
+	d.logRecords(created)
+	return created, nil
+}
+
+// Get returns the named WireGuardPeer.
+func (d *DNS) Get(name string) (*wgk8s.WireGuardPeer, error) {
+	return d.store.Get(name)
+}
+
+// Update replaces a WireGuardPeer, including its status.
+func (d *DNS) Update(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	updated, err := d.store.Update(peer)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := d.local[updated.GetName()]; ok {
+		d.logRecords(updated)
+	}
+	return updated, nil
+}
+
+// logRecords logs the records which publish a local peer, if they've changed. The lock must be
+// held.
+func (d *DNS) logRecords(peer *wgk8s.WireGuardPeer) {
+	ll := wglog.WithPeer(d.ll, peer)
+	records, err := DNSRecords(d.zone, peer)
+	if err != nil {
+		ll.WithError(err).Warn("local peer can't be published in DNS")
+		return
+	}
+	if reflect.DeepEqual(records, d.local[peer.GetName()]) {
+		return
+	}
+	d.local[peer.GetName()] = records
+	ll.Infof("publish these records so other peers can find this one:\n%s", strings.Join(records, "\n"))
+}
+
+// Delete removes the named WireGuardPeer if its UID matches. Records read from the zone reappear
+// at the next sync.
+func (d *DNS) Delete(name string, uid types.UID) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.store.Delete(name, uid)
+	if err != nil {
+		return err
+	}
+	delete(d.local, name)
+	return nil
+}
+
+// WatchPeers lists and watches WireGuardPeers. Nil selectors match everything.
+func (d *DNS) WatchPeers(labelSelector labels.Selector, fieldSelector fields.Selector) cache.ListerWatcher {
+	return d.store.WatchPeers(labelSelector, fieldSelector)
+}
+
+// WatchMeshes lists and watches Meshes, of which there are none.
+func (d *DNS) WatchMeshes() cache.ListerWatcher {
+	return d.store.WatchMeshes()
+}
+
+// WatchPolicies lists and watches WireGuardMeshPolicies, of which there are none.
+func (d *DNS) WatchPolicies() cache.ListerWatcher {
+	return d.store.WatchPolicies()
+}
+
+// IPAM returns an allocator with no IPPools; peers in DNS meshes must use static addresses.
+func (d *DNS) IPAM(leaseDuration time.Duration) IPAM {
+	return d.store.IPAM(leaseDuration)
+}
+
+// Run syncs the zone every interval until the context is canceled.
+func (d *DNS) Run(ctx context.Context, interval time.Duration) {
+	wait.Until(func() {
+		err := d.Sync(ctx)
+		if err != nil {
+			d.ll.WithError(err).Error("failed to sync peers from DNS")
+		}
+	}, interval, ctx.Done())
+}
+
+// Sync reconciles the stored peers with those published in the zone. If the zone can't be read,
+// stored peers are left alone. Peers with invalid records are skipped and reported.
+func (d *DNS) Sync(ctx context.Context) error {
+	peers, invalid, err := d.lookupPeers(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	list, err := d.store.WatchPeers(nil, nil).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, current := range list.(*wgk8s.WireGuardPeerList).Items {
+		if _, ok := d.local[current.GetName()]; !ok {
+			continue
+		}
+		for name, peer := range peers {
+			if name == current.GetName() || peer.Spec.PublicKey == current.Spec.PublicKey {
+				delete(peers, name)
+			}
+		}
+	}
+	for _, current := range list.(*wgk8s.WireGuardPeerList).Items {
+		name := current.GetName()
+		if _, ok := d.local[name]; ok {
+			continue
+		}
+		desired, ok := peers[name]
+		if !ok {
+			err = d.store.Delete(name, current.GetUID())
+			if err != nil && !k8sErrors.IsNotFound(err) {
+				return err
+			}
+			continue
+		}
+		delete(peers, name)
+		if reflect.DeepEqual(current.Spec, desired.Spec) {
+			continue
+		}
+		current.Spec = desired.Spec
+		_, err = d.store.Update(&current)
+		if err != nil {
+			return err
+		}
+	}
+	for _, peer := range peers {
+		_, err = d.store.Register(peer)
+		if err != nil {
+			return err
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("skipped invalid peers: %s", strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+// lookupPeers reads the peers published in the zone, keyed by name, and describes those whose
+// records are invalid.
+func (d *DNS) lookupPeers(ctx context.Context) (map[string]*wgk8s.WireGuardPeer, []string, error) {
+	_, srvs, err := d.resolver.LookupSRV(ctx, DNSService, DNSProto, d.zone)
+	if isDNSNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("looking up peers: %w", err)
+	}
+	peers := make(map[string]*wgk8s.WireGuardPeer, len(srvs))
+	var invalid []string
+	for _, srv := range srvs {
+		host := strings.ToLower(strings.TrimSuffix(srv.Target, "."))
+		if host == "" {
+			// A target of "." means the service is unavailable.
+			continue
+		}
+		txt, err := d.resolver.LookupTXT(ctx, host)
+		if isDNSNotFound(err) {
+			invalid = append(invalid, fmt.Sprintf("%s: no TXT records", host))
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("looking up %q: %w", host, err)
+		}
+		spec, err := dnsPeerSpec(txt)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %v", host, err))
+			continue
+		}
+		if srv.Port != 0 {
+			spec.Endpoint = net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+		}
+		peers[host] = &wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: host},
+			Spec:       spec,
+		}
+	}
+	return peers, invalid, nil
+}
+
+// dnsPeerSpec parses a peer's TXT records. Each record holds whitespace separated key=value pairs,
+// and lists are comma separated. Unrelated records are ignored.
+func dnsPeerSpec(txt []string) (wgk8s.WireGuardPeerSpec, error) {
+	var spec wgk8s.WireGuardPeerSpec
+	for _, record := range txt {
+		for _, field := range strings.Fields(record) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case dnsPublicKey:
+				spec.PublicKey = kv[1]
+			case dnsIPs:
+				spec.IPs = append(spec.IPs, splitList(kv[1])...)
+			case dnsRoutes:
+				spec.Routes = append(spec.Routes, splitList(kv[1])...)
+			}
+		}
+	}
+	if spec.PublicKey == "" {
+		return spec, fmt.Errorf("no %s", dnsPublicKey)
+	}
+	return spec, nil
+}
+
+// DNSRecords returns the zone file records which publish the peer in the zone. Records are
+// attached to the host name of the peer's endpoint or, if it has none or it's an IP address, to the
+// peer's name, which must then be a fully qualified host name.
+func DNSRecords(zone string, peer *wgk8s.WireGuardPeer) ([]string, error) {
+	host := peer.GetName()
+	var port int
+	if peer.Spec.Endpoint != "" {
+		h, p, err := net.SplitHostPort(peer.Spec.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %w", peer.Spec.Endpoint, err)
+		}
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint port %q: %w", p, err)
+		}
+		if net.ParseIP(h) == nil {
+			host = h
+		}
+	}
+	host = strings.TrimSuffix(host, ".")
+	out := []string{
+		fmt.Sprintf("_%s._%s.%s. IN SRV 0 0 %d %s.", DNSService, DNSProto, strings.TrimSuffix(zone, "."), port, host),
+		fmt.Sprintf("%s. IN TXT \"%s=%s\"", host, dnsPublicKey, peer.Spec.PublicKey),
+	}
+	if len(peer.Spec.IPs) > 0 {
+		out = append(out, fmt.Sprintf("%s. IN TXT \"%s=%s\"", host, dnsIPs, strings.Join(peer.Spec.IPs, ",")))
+	}
+	if len(peer.Spec.Routes) > 0 {
+		out = append(out, fmt.Sprintf("%s. IN TXT \"%s=%s\"", host, dnsRoutes, strings.Join(peer.Spec.Routes, ",")))
+	}
+	return out, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeResolver struct {
+	err error
+	srv []*net.SRV
+	txt map[string][]string
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	if service != DNSService || proto != DNSProto || name != "example.com" {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return "", r.srv, nil
+}
+
+func (r *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	txt, ok := r.txt[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txt, nil
+}
+
+func listPeers(t *testing.T, r Registry) map[string]wgk8s.WireGuardPeerSpec {
+	list, err := r.WatchPeers(nil, nil).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	out := make(map[string]wgk8s.WireGuardPeerSpec)
+	for _, p := range list.(*wgk8s.WireGuardPeerList).Items {
+		out[p.GetName()] = p.Spec
+	}
+	return out
+}
+
+func TestDNS(t *testing.T) {
+	resolver := &fakeResolver{
+		srv: []*net.SRV{
+			{Target: "a.example.com.", Port: 51820},
+			{Target: "client.example.com.", Port: 0},
+			{Target: "invalid.example.com.", Port: 51820},
+			{Target: "local.example.com.", Port: 51820},
+		},
+		txt: map[string][]string{
+			"a.example.com":       {"wgmesh-pk=pk-a wgmesh-ips=10.0.0.1/32", "wgmesh-routes=192.168.0.0/24,192.168.1.0/24", "v=spf1 -all"},
+			"client.example.com":  {"wgmesh-pk=pk-client", "wgmesh-ips=10.0.0.2/32"},
+			"invalid.example.com": {"wgmesh-ips=10.0.0.3/32"},
+			"local.example.com":   {"wgmesh-pk=pk-local"},
+		},
+	}
+	d, err := NewDNS("example.com.", "ns", logrus.New())
+	require.NoError(t, err)
+	d.resolver = resolver
+
+	// The local peer shadows its record in the zone.
+	local, err := d.Register(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "local"},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: "pk-local", Endpoint: "local.example.com:51820"},
+	})
+	require.NoError(t, err)
+
+	err = d.Sync(context.Background())
+	require.Error(t, err, "invalid peers are reported")
+	require.Contains(t, err.Error(), "invalid.example.com")
+	require.Equal(t, map[string]wgk8s.WireGuardPeerSpec{
+		"a.example.com": {
+			Endpoint:  "a.example.com:51820",
+			PublicKey: "pk-a",
+			IPs:       []string{"10.0.0.1/32"},
+			Routes:    []string{"192.168.0.0/24", "192.168.1.0/24"},
+		},
+		"client.example.com": {PublicKey: "pk-client", IPs: []string{"10.0.0.2/32"}},
+		"local":              local.Spec,
+	}, listPeers(t, d))
+
+	// Changes in the zone are reconciled.
+	resolver.srv = resolver.srv[:1]
+	resolver.txt["a.example.com"] = []string{"wgmesh-pk=pk-a2"}
+	require.NoError(t, d.Sync(context.Background()))
+	require.Equal(t, map[string]wgk8s.WireGuardPeerSpec{
+		"a.example.com": {Endpoint: "a.example.com:51820", PublicKey: "pk-a2"},
+		"local":         local.Spec,
+	}, listPeers(t, d))
+
+	// Peers are left alone if the zone can't be read.
+	resolver.err = &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}
+	require.Error(t, d.Sync(context.Background()))
+	require.Len(t, listPeers(t, d), 2)
+}
+
+func TestDNSRecords(t *testing.T) {
+	records, err := DNSRecords("example.com.", &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "a"},
+		Spec: wgk8s.WireGuardPeerSpec{
+			Endpoint:  "a.example.com:51820",
+			PublicKey: "pk-a",
+			IPs:       []string{"10.0.0.1/32"},
+			Routes:    []string{"192.168.0.0/24"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		`_wgmesh._udp.example.com. IN SRV 0 0 51820 a.example.com.`,
+		`a.example.com. IN TXT "wgmesh-pk=pk-a"`,
+		`a.example.com. IN TXT "wgmesh-ips=10.0.0.1/32"`,
+		`a.example.com. IN TXT "wgmesh-routes=192.168.0.0/24"`,
+	}, records)
+
+	// Records parse back into the same spec.
+	spec, err := dnsPeerSpec([]string{"wgmesh-pk=pk-a", "wgmesh-ips=10.0.0.1/32", "wgmesh-routes=192.168.0.0/24"})
+	require.NoError(t, err)
+	require.Equal(t, wgk8s.WireGuardPeerSpec{
+		PublicKey: "pk-a",
+		IPs:       []string{"10.0.0.1/32"},
+		Routes:    []string{"192.168.0.0/24"},
+	}, spec)
+}
@@ -0,0 +1,264 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	log "github.com/sirupsen/logrus"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8sYAML "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+// ReadManifests reads wgmesh objects from a file of YAML documents.
+func ReadManifests(path string) ([]runtime.Object, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []runtime.Object
+	reader := k8sYAML.NewYAMLReader(bufio.NewReader(bytes.NewReader(b)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var meta metav1.TypeMeta
+		if err := yaml.Unmarshal(doc, &meta); err != nil {
+			return nil, err
+		}
+		var obj runtime.Object
+		switch meta.Kind {
+		case "":
+			// Empty document.
+			continue
+		case "Mesh":
+			obj = &wgk8s.Mesh{}
+		case "IPPool":
+			obj = &wgk8s.IPPool{}
+		case "IPClaim":
+			obj = &wgk8s.IPClaim{}
+		case "WireGuardPeer":
+			obj = &wgk8s.WireGuardPeer{}
+		case "WireGuardMeshPolicy":
+			obj = &wgk8s.WireGuardMeshPolicy{}
+		default:
+			return nil, fmt.Errorf("unsupported kind %q", meta.Kind)
+		}
+		if err := yaml.UnmarshalStrict(doc, obj); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", meta.Kind, err)
+		}
+		out = append(out, obj)
+	}
+}
+
+// File is a Registry whose WireGuardPeers, Meshes, and WireGuardMeshPolicies are read from a file
+// of YAML documents, for running the agent standalone, without a Kubernetes cluster or registry
+// server.
+//
+// The file is read-only. Records registered through the Registry, ex. the local peer, are kept in
+// memory and shadow the file's records with the same name. No IPPools are available.
+type File struct {
+	ll    log.FieldLogger
+	store *Memory
+	path  string
+
+	lock sync.Mutex
+	// local names the records registered through the Registry rather than read from the file.
+	local map[string]bool
+}
+
+var _ Registry = (*File)(nil)
+
+// NewFile returns a Registry for the namespace whose peers and Meshes are read from the file at
+// path. Call Sync to read the file, and Run to keep following it.
+func NewFile(path, namespace string, ll log.FieldLogger) (*File, error) {
+	store, err := NewMemory(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		ll:    ll.WithField("path", path),
+		store: store,
+		path:  path,
+		local: make(map[string]bool),
+	}, nil
+}
+
+// Register stores a WireGuardPeer record locally, returning it as stored.
+func (f *File) Register(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// A record read from the file is replaced by the registered one.
+	if !f.local[peer.GetName()] {
+		err := f.store.Delete(peer.GetName(), "")
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	created, err := f.store.Register(peer)
+	if err != nil {
+		return nil, err
+	}
+	f.local[peer.GetName()] = true
+	return created, nil
+}
+
+// Get returns the named WireGuardPeer.
+func (f *File) Get(name string) (*wgk8s.WireGuardPeer, error) {
+	return f.store.Get(name)
+}
+
+// Update replaces a WireGuardPeer, including its status.
+func (f *File) Update(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	return f.store.Update(peer)
+}
+
+// Delete removes the named WireGuardPeer if its UID matches. Records read from the file reappear
+// at the next sync.
+func (f *File) Delete(name string, uid types.UID) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.store.Delete(name, uid)
+	if err != nil {
+		return err
+	}
+	delete(f.local, name)
+	return nil
+}
+
+// WatchPeers lists and watches WireGuardPeers. Nil selectors match everything.
+func (f *File) WatchPeers(labelSelector labels.Selector, fieldSelector fields.Selector) cache.ListerWatcher {
+	return f.store.WatchPeers(labelSelector, fieldSelector)
+}
+
+// WatchMeshes lists and watches Meshes.
+func (f *File) WatchMeshes() cache.ListerWatcher {
+	return f.store.WatchMeshes()
+}
+
+// WatchPolicies lists and watches WireGuardMeshPolicies.
+func (f *File) WatchPolicies() cache.ListerWatcher {
+	return f.store.WatchPolicies()
+}
+
+// IPAM returns an allocator with no IPPools; standalone peers must use static addresses.
+func (f *File) IPAM(leaseDuration time.Duration) IPAM {
+	return f.store.IPAM(leaseDuration)
+}
+
+// Run syncs the file every interval until the context is canceled.
+func (f *File) Run(ctx context.Context, interval time.Duration) {
+	wait.Until(func() {
+		err := f.Sync()
+		if err != nil {
+			f.ll.WithError(err).Error("failed to sync peers from file")
+		}
+	}, interval, ctx.Done())
+}
+
+// Sync reconciles the stored peers, Meshes, and WireGuardMeshPolicies with those in the file. If the file can't be read or
+// parsed, stored records are left alone. Objects of other kinds are ignored.
+func (f *File) Sync() error {
+	objs, err := ReadManifests(f.path)
+	if err != nil {
+		return fmt.Errorf("reading %q: %w", f.path, err)
+	}
+	peers := make(map[string]memoryObject)
+	meshes := make(map[string]memoryObject)
+	policies := make(map[string]memoryObject)
+	for _, o := range objs {
+		switch o := o.(type) {
+		case *wgk8s.WireGuardPeer:
+			peers[o.GetName()] = o
+		case *wgk8s.Mesh:
+			meshes[o.GetName()] = o
+		case *wgk8s.WireGuardMeshPolicy:
+			policies[o.GetName()] = o
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for name := range f.local {
+		delete(peers, name)
+	}
+	if err = f.syncResource(peersResource, peers); err != nil {
+		return err
+	}
+	if err = f.syncResource(meshesResource, meshes); err != nil {
+		return err
+	}
+	return f.syncResource(policiesResource, policies)
+}
+
+// syncResource creates, updates, and deletes the resource's stored records to match the desired
+// ones, keyed by name, leaving local records alone. The lock must be held.
+func (f *File) syncResource(resource schema.GroupResource, desired map[string]memoryObject) error {
+	current, _ := f.store.list(resource, nil, nil)
+	for _, o := range current {
+		name := o.GetName()
+		if resource == peersResource && f.local[name] {
+			continue
+		}
+		d, ok := desired[name]
+		if !ok {
+			err := f.store.delete(resource, name, o.GetUID())
+			if err != nil && !k8sErrors.IsNotFound(err) {
+				return err
+			}
+			continue
+		}
+		delete(desired, name)
+		if fileRecordEqual(o, d) {
+			continue
+		}
+		d.SetResourceVersion("")
+		if _, err := f.store.update(resource, d); err != nil {
+			return err
+		}
+	}
+	for _, d := range desired {
+		if _, err := f.store.create(resource, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileRecordEqual returns true if the stored record has the file record's labels, annotations, and
+// spec.
+func fileRecordEqual(stored, read memoryObject) bool {
+	if !reflect.DeepEqual(stored.GetLabels(), read.GetLabels()) ||
+		!reflect.DeepEqual(stored.GetAnnotations(), read.GetAnnotations()) {
+		return false
+	}
+	switch s := stored.(type) {
+	case *wgk8s.WireGuardPeer:
+		return reflect.DeepEqual(s.Spec, read.(*wgk8s.WireGuardPeer).Spec)
+	case *wgk8s.Mesh:
+		return reflect.DeepEqual(s.Spec, read.(*wgk8s.Mesh).Spec)
+	case *wgk8s.WireGuardMeshPolicy:
+		return reflect.DeepEqual(s.Spec, read.(*wgk8s.WireGuardMeshPolicy).Spec)
+	}
+	return false
+}
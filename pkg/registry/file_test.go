@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peers-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.yaml")
+	f, err := NewFile(path, "ns", logrus.New())
+	require.NoError(t, err)
+	write := func(s string) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(s), 0600))
+	}
+	names := func() []string {
+		list, err := f.WatchPeers(nil, nil).List(metav1.ListOptions{})
+		require.NoError(t, err)
+		var out []string
+		for _, p := range list.(*wgk8s.WireGuardPeerList).Items {
+			out = append(out, p.GetName()+"="+p.Spec.Endpoint)
+		}
+		return out
+	}
+
+	require.Error(t, f.Sync(), "no file yet")
+
+	write(`
+apiVersion: wgmesh.codybaker.com/v1alpha1
+kind: WireGuardPeer
+metadata:
+  name: a
+spec:
+  endpoint: a.example.com:51820
+---
+apiVersion: wgmesh.codybaker.com/v1alpha1
+kind: WireGuardPeer
+metadata:
+  name: local
+spec:
+  endpoint: stale.example.com:51820
+---
+apiVersion: wgmesh.codybaker.com/v1alpha1
+kind: Mesh
+metadata:
+  name: default
+---
+apiVersion: wgmesh.codybaker.com/v1alpha1
+kind: WireGuardMeshPolicy
+metadata:
+  name: db
+spec:
+  peerSelector:
+    matchLabels:
+      app: db
+  ingress:
+  - ports:
+    - port: 5432
+`)
+	require.NoError(t, f.Sync())
+	require.ElementsMatch(t, []string{"a=a.example.com:51820", "local=stale.example.com:51820"}, names())
+	a, err := f.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, "ns", a.GetNamespace())
+	meshes, err := f.WatchMeshes().List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, meshes.(*wgk8s.MeshList).Items, 1)
+	policies, err := f.WatchPolicies().List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, policies.(*wgk8s.WireGuardMeshPolicyList).Items, 1)
+	require.Equal(t, int32(5432), policies.(*wgk8s.WireGuardMeshPolicyList).Items[0].Spec.Ingress[0].Ports[0].Port)
+
+	// The registered record replaces the file's.
+	_, err = f.Register(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "local"},
+		Spec:       wgk8s.WireGuardPeerSpec{Endpoint: "local.example.com:51820"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	require.ElementsMatch(t, []string{"a=a.example.com:51820", "local=local.example.com:51820"}, names())
+
+	write(`
+apiVersion: wgmesh.codybaker.com/v1alpha1
+kind: WireGuardPeer
+metadata:
+  name: b
+spec:
+  endpoint: b.example.com:51820
+`)
+	require.NoError(t, f.Sync())
+	require.ElementsMatch(t, []string{"b=b.example.com:51820", "local=local.example.com:51820"}, names())
+	meshes, err = f.WatchMeshes().List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Empty(t, meshes.(*wgk8s.MeshList).Items)
+	policies, err = f.WatchPolicies().List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Empty(t, policies.(*wgk8s.WireGuardMeshPolicyList).Items)
+
+	// Unchanged records keep their versions, so watchers see no update.
+	b, err := f.Get("b")
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	b2, err := f.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, b.GetResourceVersion(), b2.GetResourceVersion())
+
+	write("kind: Bogus\n")
+	require.Error(t, f.Sync())
+	require.ElementsMatch(t, []string{"b=b.example.com:51820", "local=local.example.com:51820"}, names(), "a bad file leaves the records alone")
+}
@@ -0,0 +1,347 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Paths served by `wgmesh server`. Peers are addressed by name beneath PeersPath. Lists accept
+// labelSelector, fieldSelector, resourceVersion, and watch query parameters; watches stream
+// newline-delimited WatchEvents.
+const (
+	PeersPath       = "/v1/peers"
+	MeshesPath      = "/v1/meshes"
+	PoliciesPath    = "/v1/meshpolicies"
+	ClaimIPsPath    = "/v1/ipam/claim"
+	ReleaseIPsPath  = "/v1/ipam/release"
+	RenewLeasesPath = "/v1/ipam/renew"
+)
+
+// IPAMRequest is the body of requests to the IPAM paths.
+type IPAMRequest struct {
+	Pool          string                `json:"pool"`
+	Owner         metav1.OwnerReference `json:"owner"`
+	Counts        map[IPFamily]int      `json:"counts,omitempty"`
+	Static        []string              `json:"static,omitempty"`
+	Addrs         []string              `json:"addrs,omitempty"`
+	LeaseDuration metav1.Duration       `json:"leaseDuration,omitempty"`
+}
+
+// IPAMResponse is the body of responses from the IPAM paths. IPs are claimed addresses for
+// ClaimIPsPath, and lost addresses for RenewLeasesPath.
+type IPAMResponse struct {
+	IPs []string `json:"ips,omitempty"`
+}
+
+// WatchEvent is a change streamed by a watch. Errors carry a metav1.Status as their object.
+type WatchEvent struct {
+	Type   watch.EventType `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// HTTP is a Registry backed by a `wgmesh server`.
+type HTTP struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+var _ Registry = (*HTTP)(nil)
+
+// NewHTTP returns a Registry which uses the server at baseURL, authenticating with the bearer
+// token. The client must not set a Timeout, as watches are long-lived; nil uses
+// http.DefaultClient.
+func NewHTTP(baseURL, token string, client *http.Client) *HTTP {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTP{url: strings.TrimSuffix(baseURL, "/"), token: token, client: client}
+}
+
+// URL returns the server's base URL.
+func (h *HTTP) URL() string {
+	return h.url
+}
+
+// Register creates a WireGuardPeer record, returning it as stored.
+func (h *HTTP) Register(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	out := &wgk8s.WireGuardPeer{}
+	if err := h.do(http.MethodPost, PeersPath, nil, peer, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Get returns the named WireGuardPeer.
+func (h *HTTP) Get(name string) (*wgk8s.WireGuardPeer, error) {
+	out := &wgk8s.WireGuardPeer{}
+	if err := h.do(http.MethodGet, peerPath(name), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Update replaces a WireGuardPeer, including its status.
+func (h *HTTP) Update(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	out := &wgk8s.WireGuardPeer{}
+	if err := h.do(http.MethodPut, peerPath(peer.GetName()), nil, peer, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Delete removes the named WireGuardPeer if its UID matches.
+func (h *HTTP) Delete(name string, uid types.UID) error {
+	return h.do(http.MethodDelete, peerPath(name), url.Values{"uid": {string(uid)}}, nil, nil)
+}
+
+// WatchPeers lists and watches WireGuardPeers. Nil selectors match everything.
+func (h *HTTP) WatchPeers(labelSelector labels.Selector, fieldSelector fields.Selector) cache.ListerWatcher {
+	query := url.Values{}
+	if labelSelector != nil {
+		query.Set("labelSelector", labelSelector.String())
+	}
+	if fieldSelector != nil {
+		query.Set("fieldSelector", fieldSelector.String())
+	}
+	return h.listWatch(PeersPath, query,
+		func() runtime.Object { return &wgk8s.WireGuardPeerList{} },
+		func() runtime.Object { return &wgk8s.WireGuardPeer{} })
+}
+
+// WatchMeshes lists and watches Meshes.
+func (h *HTTP) WatchMeshes() cache.ListerWatcher {
+	return h.listWatch(MeshesPath, url.Values{},
+		func() runtime.Object { return &wgk8s.MeshList{} },
+		func() runtime.Object { return &wgk8s.Mesh{} })
+}
+
+// WatchPolicies lists and watches WireGuardMeshPolicies.
+func (h *HTTP) WatchPolicies() cache.ListerWatcher {
+	return h.listWatch(PoliciesPath, url.Values{},
+		func() runtime.Object { return &wgk8s.WireGuardMeshPolicyList{} },
+		func() runtime.Object { return &wgk8s.WireGuardMeshPolicy{} })
+}
+
+// IPAM returns an allocator which claims addresses through the server.
+func (h *HTTP) IPAM(leaseDuration time.Duration) IPAM {
+	return &httpIPAM{h: h, leaseDuration: leaseDuration}
+}
+
+func peerPath(name string) string {
+	return PeersPath + "/" + url.PathEscape(name)
+}
+
+func (h *HTTP) listWatch(path string, query url.Values, newList, newObject func() runtime.Object) cache.ListerWatcher {
+	withOptions := func(options metav1.ListOptions) url.Values {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		if options.ResourceVersion != "" {
+			q.Set("resourceVersion", options.ResourceVersion)
+		}
+		if options.TimeoutSeconds != nil {
+			q.Set("timeoutSeconds", strconv.FormatInt(*options.TimeoutSeconds, 10))
+		}
+		return q
+	}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			out := newList()
+			return out, h.do(http.MethodGet, path, withOptions(options), nil, out)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			q := withOptions(options)
+			q.Set("watch", "true")
+			resp, err := h.request(http.MethodGet, path, q, nil)
+			if err != nil {
+				return nil, err
+			}
+			return watch.NewStreamWatcher(&watchDecoder{
+				body:      resp.Body,
+				decoder:   json.NewDecoder(resp.Body),
+				newObject: newObject,
+			}, nil), nil
+		},
+	}
+}
+
+// do sends a request with an optional JSON body, and decodes a JSON response into out.
+func (h *HTTP) do(method, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	resp, err := h.request(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// request sends a request, returning an error if the response wasn't successful. Server errors
+// are returned as *k8sErrors.StatusError so they may be classified.
+func (h *HTTP) request(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := h.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var status metav1.Status
+	if json.Unmarshal(b, &status) != nil || status.Code == 0 {
+		status = metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    int32(resp.StatusCode),
+			Reason:  metav1.StatusReasonUnknown,
+			Message: fmt.Sprintf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(b))),
+		}
+	}
+	// Retry-After, ex. from a throttling proxy, is passed on so callers may back off accordingly.
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 && status.Details == nil {
+		status.Details = &metav1.StatusDetails{RetryAfterSeconds: int32(seconds)}
+	}
+	return nil, &k8sErrors.StatusError{ErrStatus: status}
+}
+
+// watchDecoder decodes WatchEvents streamed by the server.
+type watchDecoder struct {
+	body      io.Closer
+	decoder   *json.Decoder
+	newObject func() runtime.Object
+}
+
+func (d *watchDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var e WatchEvent
+	if err := d.decoder.Decode(&e); err != nil {
+		return "", nil, err
+	}
+	var obj runtime.Object
+	if e.Type == watch.Error {
+		obj = &metav1.Status{}
+	} else {
+		obj = d.newObject()
+	}
+	if err := json.Unmarshal(e.Object, obj); err != nil {
+		return "", nil, fmt.Errorf("decoding %s event: %w", e.Type, err)
+	}
+	return e.Type, obj, nil
+}
+
+func (d *watchDecoder) Close() {
+	d.body.Close()
+}
+
+// httpIPAM claims addresses through a `wgmesh server`.
+type httpIPAM struct {
+	h             *HTTP
+	leaseDuration time.Duration
+}
+
+func (r *httpIPAM) ClaimIPs(pool string, owner *metav1.OwnerReference, counts map[IPFamily]int, static []net.IP) ([]*net.IPNet, error) {
+	req := r.request(pool, owner)
+	req.Counts = counts
+	for _, ip := range static {
+		req.Static = append(req.Static, ip.String())
+	}
+	var resp IPAMResponse
+	err := r.h.do(http.MethodPost, ClaimIPsPath, nil, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAddrs(resp.IPs)
+}
+
+func (r *httpIPAM) ReleaseIPs(pool string, owner *metav1.OwnerReference) error {
+	return r.h.do(http.MethodPost, ReleaseIPsPath, nil, r.request(pool, owner), nil)
+}
+
+func (r *httpIPAM) RenewLeases(pool string, owner *metav1.OwnerReference, addrs []*net.IPNet) ([]*net.IPNet, error) {
+	req := r.request(pool, owner)
+	req.Addrs = FormatAddrs(addrs)
+	var resp IPAMResponse
+	err := r.h.do(http.MethodPost, RenewLeasesPath, nil, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAddrs(resp.IPs)
+}
+
+func (r *httpIPAM) request(pool string, owner *metav1.OwnerReference) *IPAMRequest {
+	return &IPAMRequest{
+		Pool:          pool,
+		Owner:         *owner,
+		LeaseDuration: metav1.Duration{Duration: r.leaseDuration},
+	}
+}
+
+// FormatAddrs formats addresses in CIDR notation, ex. 10.0.0.1/24.
+func FormatAddrs(addrs []*net.IPNet) []string {
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, addr.String())
+	}
+	return out
+}
+
+// ParseAddrs parses addresses in CIDR notation, preserving the host portion of the address.
+func ParseAddrs(addrs []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(addrs))
+	for _, a := range addrs {
+		ip, cidr, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, err
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		cidr.IP = ip
+		out = append(out, cidr)
+	}
+	return out, nil
+}
@@ -0,0 +1,869 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"sort"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var errNoAvailableIPAddresses = errors.New("no available IP addresses")
+
+// IPFamily restricts which address families are claimed from an IPPool.
+type IPFamily string
+
+const (
+	// IPFamilyAny claims addresses from any range in the pool.
+	IPFamilyAny IPFamily = "any"
+	// IPFamilyIPv4 claims addresses only from IPv4 ranges in the pool.
+	IPFamilyIPv4 IPFamily = "ipv4"
+	// IPFamilyIPv6 claims addresses only from IPv6 ranges in the pool.
+	IPFamilyIPv6 IPFamily = "ipv6"
+)
+
+// IPFamilyFromString returns a valid IPFamily, or a descriptive error if the family is invalid.
+func IPFamilyFromString(family string) (IPFamily, error) {
+	switch IPFamily(family) {
+	case IPFamilyAny, IPFamilyIPv4, IPFamilyIPv6:
+		return IPFamily(family), nil
+	default:
+		return "", fmt.Errorf("unknown ip family %q", family)
+	}
+}
+
+// contains returns true if the address is a member of the family.
+func (f IPFamily) contains(ip net.IP) bool {
+	switch f {
+	case IPFamilyIPv4:
+		return ip.To4() != nil
+	case IPFamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+const (
+	// maxClaimConflicts limits how many times we'll retry after losing a race for an address.
+	maxClaimConflicts = 16
+	// maxLinearScan is the largest range we'll exhaustively scan for an available address.
+	maxLinearScan = 1 << 16
+	// maxRandomProbes limits how many random addresses we'll try in ranges too large to scan.
+	maxRandomProbes = 1024
+)
+
+// claimStore persists the IPPools and IPClaims of a single namespace for claimIPAM.
+type claimStore interface {
+	getPool(name string) (*wgk8s.IPPool, error)
+	listClaims(selector labels.Selector) ([]wgk8s.IPClaim, error)
+	getClaim(name string) (*wgk8s.IPClaim, error)
+	createClaim(claim *wgk8s.IPClaim) (*wgk8s.IPClaim, error)
+	updateClaim(claim *wgk8s.IPClaim) (*wgk8s.IPClaim, error)
+	// deleteClaim deletes the named claim if its UID matches.
+	deleteClaim(name string, uid types.UID) error
+}
+
+// ListClaims returns the registry's IPClaims, ex. to garbage collect them. Only registries which
+// store claims themselves support it; the HTTP registry leaves claims to its server.
+func ListClaims(r Registry) ([]wgk8s.IPClaim, error) {
+	store, ok := r.(claimStore)
+	if !ok {
+		return nil, fmt.Errorf("%T registry doesn't store IPClaims", r)
+	}
+	return store.listClaims(labels.Everything())
+}
+
+// DeleteClaim deletes the registry's named IPClaim if its UID matches. Like ListClaims, only
+// registries which store claims themselves support it.
+func DeleteClaim(r Registry, name string, uid types.UID) error {
+	store, ok := r.(claimStore)
+	if !ok {
+		return fmt.Errorf("%T registry doesn't store IPClaims", r)
+	}
+	return store.deleteClaim(name, uid)
+}
+
+// claimIPAM claims addresses from IPPools by creating IPClaims in a claimStore.
+type claimIPAM struct {
+	namespace string
+	store     claimStore
+	claims    []wgk8s.IPClaim
+	// leaseDuration, if non-zero, sets an expiry on claims which must be renewed by RenewLeases.
+	leaseDuration time.Duration
+}
+
+type ipPool struct {
+	// name is currently just used for error messages.
+	name     string
+	inUse    map[string]struct{}
+	ranges   []*ipRange
+	excluded []*net.IPNet
+	strategy wgk8s.IPAllocationStrategy
+}
+
+type ipRange struct {
+	cidr  net.IPNet
+	start net.IP
+	end   net.IP
+}
+
+// ClaimIPs ensures the owner holds counts[family] addresses of each requested family from the
+// pool, plus each of the static addresses. Existing claims held by the owner are reused, and any in
+// excess of the requested counts (including claims of families which weren't requested) are
+// released. Claims which an administrator created for the owner (see IPClaimSpec.Peer) count
+// toward the request, but are always included and never released. IPFamilyAny may not be combined
+// with other families.
+func (r *claimIPAM) ClaimIPs(
+	poolName string,
+	owner *metav1.OwnerReference,
+	counts map[IPFamily]int,
+	static []net.IP,
+) ([]*net.IPNet, error) {
+	namespace := r.namespace
+	if _, ok := counts[IPFamilyAny]; ok && len(counts) > 1 {
+		return nil, fmt.Errorf("ip family %q may not be combined with other families", IPFamilyAny)
+	}
+	remaining := make(map[IPFamily]int, len(counts))
+	for family, count := range counts {
+		remaining[family] = count
+	}
+	wantStatic := make(map[string]net.IP, len(static))
+	for _, ip := range static {
+		wantStatic[ip.String()] = ip
+	}
+
+	var claimIPs []*net.IPNet
+	pool, ourClaims, err := r.loadPool(namespace, poolName, owner)
+	if err != nil {
+		return nil, fmt.Errorf("loading pool %s:%s: %w", namespace, poolName, err)
+	}
+	// Reserved addresses satisfy the request before dynamically allocated ones.
+	sort.SliceStable(ourClaims, func(i, j int) bool {
+		return isReservedFor(&ourClaims[i], owner) && !isReservedFor(&ourClaims[j], owner)
+	})
+	for _, claim := range ourClaims {
+		ip := net.ParseIP(claim.Spec.IP)
+		if ip == nil {
+			// If everything is working correctly, the only way this could happen is a user created
+			// claim.  This probably needs to be deleted, but we'll let the user do that.
+			return nil, fmt.Errorf("invalid claim %q for pool %s:%s: ip %q", claim.Name, namespace, poolName, claim.Spec.IP)
+		}
+		addr := pool.ipNetFor(ip)
+		if addr == nil {
+			return nil, fmt.Errorf("claim %q for pool %s:%s: ip %q is not in any range",
+				claim.Name, namespace, poolName, claim.Spec.IP)
+		}
+		family := requestedFamily(ip, remaining)
+		if isReservedFor(&claim, owner) {
+			if _, ok := wantStatic[ip.String()]; ok {
+				delete(wantStatic, ip.String())
+			} else if remaining[family] > 0 {
+				remaining[family]--
+			}
+			claimIPs = append(claimIPs, addr)
+			continue
+		}
+		_, isStatic := wantStatic[ip.String()]
+		if isStatic || remaining[family] > 0 {
+			err := r.adoptClaim(&claim, owner)
+			if err != nil {
+				return nil, fmt.Errorf("adopting claim %q for pool %s:%s: %w", claim.Name, namespace, poolName, err)
+			}
+			claimIPs = append(claimIPs, addr)
+			if isStatic {
+				delete(wantStatic, ip.String())
+			} else {
+				remaining[family]--
+			}
+		} else {
+			// We don't need this claim, release it.
+			err := r.store.deleteClaim(claim.Name, claim.UID)
+			if err != nil && !k8sErrors.IsNotFound(err) {
+				return nil, fmt.Errorf("releasing claim %q: %w", claim.Name, err)
+			}
+		}
+	}
+
+	for _, ip := range static {
+		if _, ok := wantStatic[ip.String()]; !ok {
+			continue // already held
+		}
+		addr, err := r.claimStaticIP(namespace, poolName, owner, pool, ip)
+		if err != nil {
+			return claimIPs, err
+		}
+		claimIPs = append(claimIPs, addr)
+	}
+
+	for _, family := range []IPFamily{IPFamilyAny, IPFamilyIPv4, IPFamilyIPv6} {
+		if remaining[family] == 0 {
+			continue
+		}
+		// The family pool shares inUse with the pool, so addresses claimed for one family are
+		// never offered to another.
+		familyPool := *pool
+		familyPool.restrictFamily(family)
+		addrs, err := r.claimNewIPs(namespace, poolName, owner, &familyPool, remaining[family])
+		claimIPs = append(claimIPs, addrs...)
+		if err != nil {
+			return claimIPs, err
+		}
+	}
+	return claimIPs, nil
+}
+
+// claimStaticIP claims a specific address from the pool. The address must fall within one of the
+// pool's ranges and outside its excluded CIDRs. Addresses listed in the pool's Reserved list may be
+// claimed statically; they're only withheld from dynamic allocation.
+func (r *claimIPAM) claimStaticIP(
+	namespace, poolName string,
+	owner *metav1.OwnerReference,
+	pool *ipPool,
+	ip net.IP,
+) (*net.IPNet, error) {
+	addr := pool.ipNetFor(ip)
+	if addr == nil || !pool.inRange(ip) {
+		return nil, fmt.Errorf("static ip %q is not in any range of pool %s:%s", ip, namespace, poolName)
+	}
+	if pool.excludedThrough(ip) != nil {
+		return nil, fmt.Errorf("static ip %q is excluded from pool %s:%s", ip, namespace, poolName)
+	}
+	name := wgk8s.IPClaimName(poolName, ip.String())
+	claim := newIPClaim(namespace, poolName, ip, owner)
+	claim.Spec.LeaseExpires = r.lease()
+	_, err := r.store.createClaim(claim)
+	if k8sErrors.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("static ip %q in pool %s:%s is already claimed by another peer", ip, namespace, poolName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating claim %q in pool %s:%s: %w", name, namespace, poolName, err)
+	}
+	pool.inUse[ip.String()] = struct{}{}
+	return addr, nil
+}
+
+// requestedFamily returns the requested family which contains the ip, or an empty family if the
+// ip's family wasn't requested.
+func requestedFamily(ip net.IP, counts map[IPFamily]int) IPFamily {
+	for family := range counts {
+		if family.contains(ip) {
+			return family
+		}
+	}
+	return ""
+}
+
+// claimNewIPs creates count new claims for available addresses in the pool.
+func (r *claimIPAM) claimNewIPs(
+	namespace, poolName string,
+	owner *metav1.OwnerReference,
+	pool *ipPool,
+	count int,
+) ([]*net.IPNet, error) {
+	var claimIPs []*net.IPNet
+	conflicts := 0
+	for count > 0 {
+		addr, err := pool.findAddress()
+		if err != nil {
+			return claimIPs, fmt.Errorf("finding address in pool %s:%s: %w", namespace, poolName, err)
+		}
+		// Whether we win or lose the claim, the address is no longer available to us.
+		pool.inUse[addr.IP.String()] = struct{}{}
+		name := wgk8s.IPClaimName(poolName, addr.IP.String())
+		claim := newIPClaim(namespace, poolName, addr.IP, owner)
+		claim.Spec.LeaseExpires = r.lease()
+		_, err = r.store.createClaim(claim)
+		if err != nil {
+			if k8sErrors.IsAlreadyExists(err) || k8sErrors.IsConflict(err) {
+				// Another peer claimed the address after we loaded the pool; try another.
+				conflicts++
+				if conflicts >= maxClaimConflicts {
+					return claimIPs, fmt.Errorf("claiming address in pool %s:%s: gave up after %d conflicts",
+						namespace, poolName, conflicts)
+				}
+				continue
+			}
+			return claimIPs, fmt.Errorf("creating claim %q in pool %s:%s: %w", name, namespace, poolName, err)
+		}
+		count--
+		claimIPs = append(claimIPs, addr)
+	}
+
+	return claimIPs, nil
+}
+
+// ReleaseIPs deletes all claims held by the owner in the pool. If poolName is empty, claims are
+// released from every pool in the namespace. Deletes are conditional on the claim's UID so we never
+// release a claim which was re-created by someone else.
+func (r *claimIPAM) ReleaseIPs(poolName string, owner *metav1.OwnerReference) error {
+	selector := labels.Everything()
+	if poolName != "" {
+		selector = labels.SelectorFromSet(labels.Set{wgk8s.IPPoolLabel: poolName})
+	}
+	claims, err := r.store.listClaims(selector)
+	if err != nil {
+		return fmt.Errorf("listing claims: %w", err)
+	}
+	for _, claim := range claims {
+		owned := false
+		for _, o := range claim.GetOwnerReferences() {
+			owned = owned || isOwner(o, owner)
+		}
+		if !owned {
+			continue
+		}
+		err := r.store.deleteClaim(claim.Name, claim.UID)
+		if err != nil && !k8sErrors.IsNotFound(err) && !k8sErrors.IsConflict(err) {
+			return fmt.Errorf("releasing claim %q: %w", claim.Name, err)
+		}
+	}
+	return nil
+}
+
+// newIPClaim builds an IPClaim for the address, labeled with its pool and owned by the owner.
+func newIPClaim(namespace, poolName string, ip net.IP, owner *metav1.OwnerReference) *wgk8s.IPClaim {
+	return &wgk8s.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      wgk8s.IPClaimName(poolName, ip.String()),
+			Namespace: namespace,
+			Labels: map[string]string{
+				wgk8s.IPPoolLabel: poolName,
+			},
+			OwnerReferences: []metav1.OwnerReference{*owner},
+		},
+		Spec: wgk8s.IPClaimSpec{
+			IP: ip.String(),
+		},
+	}
+}
+
+// adoptClaim ensures an existing claim references the current incarnation of the owner, and renews
+// its lease. If the owner was re-created its UID changes, and the garbage collector would otherwise
+// delete the claim.
+func (r *claimIPAM) adoptClaim(claim *wgk8s.IPClaim, owner *metav1.OwnerReference) error {
+	claim = claim.DeepCopy()
+	refs := claim.GetOwnerReferences()
+	changed := false
+	for i := range refs {
+		if isOwner(refs[i], owner) && refs[i].UID != owner.UID {
+			refs[i].UID = owner.UID
+			changed = true
+		}
+	}
+	if lease := r.lease(); lease != nil || claim.Spec.LeaseExpires != nil {
+		// Leases may have been disabled since the claim was created; clear the stale expiry.
+		claim.Spec.LeaseExpires = lease
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	claim.SetOwnerReferences(refs)
+	_, err := r.store.updateClaim(claim)
+	return err
+}
+
+// lease returns the expiry for a claim created or renewed now, or nil if leases are disabled.
+func (r *claimIPAM) lease() *metav1.Time {
+	if r.leaseDuration <= 0 {
+		return nil
+	}
+	expires := metav1.NewTime(time.Now().Add(r.leaseDuration))
+	return &expires
+}
+
+// RenewLeases extends the lease on the owner's claims for each of the addresses in the pool. It
+// returns the addresses whose claims were lost, ex. because the lease expired and the claim was
+// collected, possibly to be claimed by another peer. The registry is authoritative; once a claim
+// is lost the owner must stop using the address.
+func (r *claimIPAM) RenewLeases(
+	poolName string,
+	owner *metav1.OwnerReference,
+	addrs []*net.IPNet,
+) ([]*net.IPNet, error) {
+	var lost []*net.IPNet
+	for _, addr := range addrs {
+		name := wgk8s.IPClaimName(poolName, addr.IP.String())
+		claim, err := r.store.getClaim(name)
+		if k8sErrors.IsNotFound(err) {
+			lost = append(lost, addr)
+			continue
+		}
+		if err != nil {
+			return lost, fmt.Errorf("getting claim %q: %w", name, err)
+		}
+		if isReservedFor(claim, owner) {
+			continue // Reserved claims are held by the administrator, not leased.
+		}
+		owned := false
+		for _, o := range claim.GetOwnerReferences() {
+			owned = owned || isOwner(o, owner)
+		}
+		if !owned {
+			lost = append(lost, addr)
+			continue
+		}
+		err = r.adoptClaim(claim, owner)
+		if err != nil {
+			return lost, fmt.Errorf("renewing claim %q: %w", name, err)
+		}
+	}
+	return lost, nil
+}
+
+// isReservedFor returns true if an administrator created the claim for the owner. Reserved claims
+// aren't owned by the peer, so they survive the peer's deregistration.
+func isReservedFor(claim *wgk8s.IPClaim, owner *metav1.OwnerReference) bool {
+	if claim.Spec.Peer == "" || claim.Spec.Peer != owner.Name {
+		return false
+	}
+	for _, o := range claim.GetOwnerReferences() {
+		if o.Kind == "WireGuardPeer" {
+			return false
+		}
+	}
+	return true
+}
+
+// isOwner returns true if the reference identifies the owner, regardless of UID.
+func isOwner(ref metav1.OwnerReference, owner *metav1.OwnerReference) bool {
+	return ref.Name == owner.Name && ref.APIVersion == owner.APIVersion && ref.Kind == owner.Kind
+}
+
+func (r *claimIPAM) loadPool(namespace, poolName string, owner *metav1.OwnerReference) (*ipPool, []wgk8s.IPClaim, error) {
+	pool := &ipPool{
+		name:  fmt.Sprintf("%s:%s", namespace, poolName),
+		inUse: make(map[string]struct{}),
+	}
+
+	poolRecord, err := r.store.getPool(poolName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting pool: %w", err)
+	}
+
+	var rangeIndexes []int
+	switch poolRecord.Spec.Strategy {
+	case "", wgk8s.IPAllocationRandom:
+		pool.strategy = wgk8s.IPAllocationRandom
+		// Shuffle the order of ranges so we start with a random one and can visit all if needed.
+		rangeIndexes, err = randPerm(len(poolRecord.Spec.IPRanges))
+		if err != nil {
+			return nil, nil, fmt.Errorf("shuffling ip ranges: %w", err)
+		}
+	case wgk8s.IPAllocationSequential:
+		pool.strategy = wgk8s.IPAllocationSequential
+		for i := range poolRecord.Spec.IPRanges {
+			rangeIndexes = append(rangeIndexes, i)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown allocation strategy %q", poolRecord.Spec.Strategy)
+	}
+	for _, i := range rangeIndexes {
+		ipr := poolRecord.Spec.IPRanges[i]
+		_, cidr, err := net.ParseCIDR(ipr.CIDR)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing ipRanges.cidr %q", ipr.CIDR)
+		}
+		var start, end net.IP
+		if ipr.Start != "" {
+			start = net.ParseIP(ipr.Start)
+			if start == nil {
+				return nil, nil, fmt.Errorf("parsing ipRanges.start %q", ipr.Start)
+			}
+			if !cidr.Contains(start) {
+				return nil, nil, fmt.Errorf("ipRanges.start %q was not contained by cidr %q",
+					ipr.Start, cidr.String())
+			}
+		} else {
+			start, err = DefaultRangeStart(cidr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("calculating default start address: %w", err)
+			}
+		}
+		if ipr.End != "" {
+			end = net.ParseIP(ipr.End)
+			if end == nil {
+				return nil, nil, fmt.Errorf("parsing ipRanges.end %q", ipr.End)
+			}
+			if !cidr.Contains(end) {
+				return nil, nil, fmt.Errorf("ipRanges.end %q was not contained by cidr %q",
+					ipr.End, cidr.String())
+			}
+		} else {
+			end, err = defaultRangeEnd(cidr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("calculating default end address: %w", err)
+			}
+		}
+		if after, err := ipGreater(false, start, end); err != nil || after {
+			return nil, nil, fmt.Errorf("ipRanges.start %q is after ipRanges.end %q", start.String(), end.String())
+		}
+		pool.ranges = append(pool.ranges, &ipRange{
+			cidr:  *cidr,
+			start: start,
+			end:   end,
+		})
+	}
+
+	for _, ip := range poolRecord.Spec.Reserved {
+		// These are user provided, parse them and then serialize them in canonical format.
+		reserved := net.ParseIP(ip)
+		if reserved == nil {
+			return nil, nil, fmt.Errorf("parsing reserved ip %q", ip)
+		}
+		pool.inUse[reserved.String()] = struct{}{}
+	}
+
+	for _, c := range poolRecord.Spec.ExcludeCIDRs {
+		_, excluded, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing excludeCIDRs %q", c)
+		}
+		excluded, err = CanonicalIPInCIDR(excluded)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing excludeCIDRs %q: %w", c, err)
+		}
+		pool.excluded = append(pool.excluded, excluded)
+	}
+
+	claims, err := r.store.listClaims(labels.SelectorFromSet(labels.Set{wgk8s.IPPoolLabel: poolName}))
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing claims: %w", err)
+	}
+
+	var ourClaims []wgk8s.IPClaim
+
+	for _, claim := range claims {
+		// These are user provided, parse them and then serialize them in canonical format.
+		reserved := net.ParseIP(claim.Spec.IP)
+		if reserved == nil {
+			return nil, nil, fmt.Errorf(`parsing claim "%s:%s" - ip %q`,
+				namespace, claim.GetName(), claim.Spec.IP)
+		}
+		if isReservedFor(&claim, owner) {
+			ourClaims = append(ourClaims, claim)
+		} else {
+			for _, o := range claim.GetOwnerReferences() {
+				if isOwner(o, owner) {
+					ourClaims = append(ourClaims, claim)
+					break
+				}
+			}
+		}
+		pool.inUse[reserved.String()] = struct{}{}
+	}
+
+	return pool, ourClaims, nil
+}
+
+// restrictFamily removes any ranges which aren't members of the family.
+func (p *ipPool) restrictFamily(family IPFamily) {
+	var ranges []*ipRange
+	for _, r := range p.ranges {
+		if family.contains(r.cidr.IP) {
+			ranges = append(ranges, r)
+		}
+	}
+	p.ranges = ranges
+}
+
+// ipNetFor returns the address with the mask of the first range containing it, or nil if no range
+// contains the address.
+func (p *ipPool) ipNetFor(ip net.IP) *net.IPNet {
+	for _, r := range p.ranges {
+		if r.cidr.Contains(ip) {
+			addr := &net.IPNet{IP: ip, Mask: r.cidr.Mask}
+			if canonical, err := CanonicalIPInCIDR(addr); err == nil {
+				return canonical
+			}
+			return addr
+		}
+	}
+	return nil
+}
+
+// findAddress finds an available IP in the provided CIDR.
+func (p *ipPool) findAddress() (*net.IPNet, error) {
+	for _, r := range p.ranges {
+		find := r.findAddress
+		if p.strategy == wgk8s.IPAllocationSequential {
+			find = r.findLowestAddress
+		}
+		addr, err := find(p)
+		if err == errNoAvailableIPAddresses {
+			continue // next range
+		}
+		if err != nil {
+			return nil, err
+		}
+		return addr, nil
+	}
+	return nil, errNoAvailableIPAddresses
+}
+
+// inRange returns true if the address falls between the start and end of any range.
+func (p *ipPool) inRange(ip net.IP) bool {
+	for _, r := range p.ranges {
+		after, err := ipGreater(true, ip, r.start)
+		if err != nil || !after {
+			continue
+		}
+		before, err := ipLess(true, ip, r.end)
+		if err == nil && before {
+			return true
+		}
+	}
+	return false
+}
+
+// available returns true if the address is neither in use nor excluded.
+func (p *ipPool) available(ip net.IP) bool {
+	if _, ok := p.inUse[ip.String()]; ok {
+		return false
+	}
+	return p.excludedThrough(ip) == nil
+}
+
+// excludedThrough returns the last address of the excluded CIDR containing ip, or nil if the
+// address isn't excluded.
+func (p *ipPool) excludedThrough(ip net.IP) net.IP {
+	for _, ex := range p.excluded {
+		if ex.Contains(ip) {
+			last, _ := byteSliceOr(byteSliceNot([]byte(ex.Mask)), ex.IP)
+			return last
+		}
+	}
+	return nil
+}
+
+// findAddress selects a random available address between the range's start and end. Small ranges
+// are scanned exhaustively, starting at a random offset. Large ranges (ex. an IPv6 /64) can't be
+// scanned, so we probe random addresses; in a sparsely claimed range nearly every probe succeeds.
+func (r *ipRange) findAddress(p *ipPool) (*net.IPNet, error) {
+	cidr, err := CanonicalIPInCIDR(&r.cidr)
+	if err != nil {
+		return nil, err
+	}
+	start, end := sameLen(r.start, cidr.IP), sameLen(r.end, cidr.IP)
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("range %s has start/end of a different address family", cidr.String())
+	}
+	startInt, endInt := new(big.Int).SetBytes(start), new(big.Int).SetBytes(end)
+	if startInt.Cmp(endInt) > 0 {
+		return nil, errNoAvailableIPAddresses
+	}
+	size := new(big.Int).Sub(endInt, startInt)
+	size.Add(size, big.NewInt(1))
+
+	if size.Cmp(big.NewInt(maxLinearScan)) <= 0 {
+		n := size.Int64()
+		offset, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return nil, fmt.Errorf("selecting random ip: %w", err)
+		}
+		for i := int64(0); i < n; i++ {
+			candidate := new(big.Int).SetInt64((offset.Int64() + i) % n)
+			ip := bigToIP(candidate.Add(candidate, startInt), len(start))
+			if p.available(ip) {
+				return &net.IPNet{IP: ip, Mask: cidr.Mask}, nil
+			}
+		}
+		return nil, errNoAvailableIPAddresses
+	}
+
+	for i := 0; i < maxRandomProbes; i++ {
+		offset, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return nil, fmt.Errorf("selecting random ip: %w", err)
+		}
+		ip := bigToIP(offset.Add(offset, startInt), len(start))
+		if p.available(ip) {
+			return &net.IPNet{IP: ip, Mask: cidr.Mask}, nil
+		}
+	}
+	return nil, errNoAvailableIPAddresses
+}
+
+// findLowestAddress selects the lowest available address between the range's start and end. At
+// most len(inUse)+1 addresses are visited (excluded CIDRs are skipped in one step), so this is safe
+// for ranges of any size.
+func (r *ipRange) findLowestAddress(p *ipPool) (*net.IPNet, error) {
+	cidr, err := CanonicalIPInCIDR(&r.cidr)
+	if err != nil {
+		return nil, err
+	}
+	start, end := sameLen(r.start, cidr.IP), sameLen(r.end, cidr.IP)
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("range %s has start/end of a different address family", cidr.String())
+	}
+	one, endInt := big.NewInt(1), new(big.Int).SetBytes(end)
+	for candidate := new(big.Int).SetBytes(start); candidate.Cmp(endInt) <= 0; candidate.Add(candidate, one) {
+		ip := bigToIP(candidate, len(start))
+		if last := p.excludedThrough(ip); last != nil {
+			// Skip the remainder of the excluded CIDR.
+			candidate.SetBytes(sameLen(last, start))
+			continue
+		}
+		if _, ok := p.inUse[ip.String()]; !ok {
+			return &net.IPNet{IP: ip, Mask: cidr.Mask}, nil
+		}
+	}
+	return nil, errNoAvailableIPAddresses
+}
+
+// sameLen returns the IP encoded with the same length as ref (4 bytes for IPv4, 16 for IPv6), or
+// nil if it can't be represented that way.
+func sameLen(ip, ref net.IP) net.IP {
+	if len(ref) == net.IPv4len {
+		return ip.To4()
+	}
+	if ip.To4() != nil {
+		return nil // IPv4 address in an IPv6 range.
+	}
+	return ip.To16()
+}
+
+// bigToIP converts the integer into a big-endian IP address of the specified length.
+func bigToIP(i *big.Int, length int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, length)
+	copy(ip[length-len(b):], b)
+	return ip
+}
+
+// CanonicalIPInCIDR return the provided CIDR as a 4-byte net.IP for IPv4 addresses (including
+// those originally specified in IPv6 CIDR format), or a 16-byte net.IP for IPv6. CanonicalIPInCIDR
+// assumes the IP property has the masked portion zeroed (as net.ParseCIDR() does).
+func CanonicalIPInCIDR(in *net.IPNet) (*net.IPNet, error) {
+	bits, size := in.Mask.Size()
+	var out net.IPNet
+	out.Mask = in.Mask
+	switch size {
+	case net.IPv4len * 8: // IPv4
+		out.IP = in.IP.To4()
+		if out.IP == nil {
+			return nil, fmt.Errorf(
+				"net.IPNet (%q) had IPv4 mask w/ non-IPv4 network",
+				in.String(),
+			)
+		}
+	case net.IPv6len * 8: // IPv6
+		out.IP = in.IP.To4()
+		if out.IP != nil { // IPv6 encoded IPv4
+			if bits < 96 {
+				return nil, fmt.Errorf("IPv6 CIDR includes both v4 and v6 space: %q", in.String())
+			}
+			out.Mask = net.CIDRMask(bits-96, net.IPv4len*8)
+			return &out, nil
+		}
+		out.IP = in.IP.To16()
+		if out.IP == nil {
+			return nil, fmt.Errorf("invalid network address: %q", in.IP.String())
+		}
+	default:
+		return nil, fmt.Errorf("invalid mask: %s", in.Mask.String())
+	}
+	return &out, nil
+}
+
+func byteSliceOr(a, b []byte) ([]byte, error) {
+	if len(a) != len(b) {
+		return nil, fmt.Errorf("bitwise OR called w/ different lengths: len(a)=%d len(b)=%d", len(a), len(b))
+	}
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] | b[i]
+	}
+	return out, nil
+}
+
+func byteSliceNot(a []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = ^a[i]
+	}
+	return out
+}
+
+// ipGreater returns true if a > b and if orEqual==true, true if equal.
+func ipGreater(orEqual bool, a, b net.IP) (bool, error) {
+	if len(a) != len(b) {
+		a = a.To16()
+		b = b.To16()
+	}
+	if len(a) != len(b) {
+		return false, fmt.Errorf("unable to compare addresses of different bit length: len(a)=%d len(b)=%d", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] == b[i] {
+			continue
+		}
+		return a[i] > b[i], nil
+	}
+	return orEqual, nil
+}
+
+func ipLess(orEqual bool, a, b net.IP) (bool, error) {
+	return ipGreater(orEqual, b, a)
+}
+
+func defaultRangeEnd(cidr *net.IPNet) (net.IP, error) {
+	cidr, err := CanonicalIPInCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	maskOnes, maskBits := cidr.Mask.Size()
+	notMask := byteSliceNot([]byte(cidr.Mask))
+	out, err := byteSliceOr(notMask, cidr.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	if maskBits == (net.IPv4len*8) && maskOnes < 31 {
+		// We implicitly reserve the broadcast address for IPv4 subnets larger /31's
+		out[len(out)-1]--
+	}
+	return out, nil
+}
+
+// DefaultRangeStart returns the first usable address in the CIDR, skipping the network address.
+func DefaultRangeStart(cidr *net.IPNet) (net.IP, error) {
+	cidr, err := CanonicalIPInCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	maskOnes, maskBits := cidr.Mask.Size()
+	start := make(net.IP, len(cidr.IP))
+	copy(start, cidr.IP)
+	switch {
+	case maskBits == (net.IPv4len*8) && maskOnes < 31:
+		// We implicitly reserve the network address for IPv4 subnets larger /31's
+		start[len(start)-1]++
+	case maskBits == (net.IPv6len*8) && maskOnes < 127:
+		// Similarly, reserve the IPv6 Subnet-Router anycast address (RFC 4291 2.6.1).
+		start[len(start)-1]++
+	}
+	return start, nil
+}
+
+func randPerm(n int) ([]int, error) {
+	seedB := make([]byte, 8)
+	_, err := rand.Read(seedB)
+	if err != nil {
+		return nil, err
+	}
+	seed, _ := binary.Varint(seedB)
+	mrand := mathrand.New(mathrand.NewSource(seed))
+	return mrand.Perm(n), nil
+}
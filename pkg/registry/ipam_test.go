@@ -0,0 +1,1104 @@
+package registry
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalIPInCIDR(t *testing.T) {
+	tcs := []struct {
+		name        string
+		cidr        string
+		expectBytes int
+		expectMask  net.IPMask
+	}{
+		{
+			name:        "ipv4",
+			cidr:        "192.168.1.0/28",
+			expectBytes: net.IPv4len,
+			expectMask:  net.CIDRMask(28, 32),
+		},
+		{
+			name:        "ipv6",
+			cidr:        "fe80::/10",
+			expectBytes: net.IPv6len,
+			expectMask:  net.CIDRMask(10, 128),
+		},
+		{
+			name:        "ipv6 encoded ipv4",
+			cidr:        "::ffff:c0a8:100/124", // 192.168.1.0/28
+			expectBytes: net.IPv4len,
+			expectMask:  net.CIDRMask(28, 32),
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, cidr, err := net.ParseCIDR(tc.cidr)
+			require.NoError(t, err)
+			out, err := CanonicalIPInCIDR(cidr)
+			require.NoError(t, err)
+			require.NotNil(t, out)
+			outOnes, outBits := out.Mask.Size()
+			expectOnes, expectBits := tc.expectMask.Size()
+			require.Equal(t, expectOnes, outOnes)
+			require.Equal(t, expectBits, outBits)
+			require.Equal(t, tc.expectBytes, len(out.IP))
+		})
+	}
+}
+
+func TestDefaultRangeEnd(t *testing.T) {
+	tcs := []struct {
+		name      string
+		cidr      string
+		expectEnd net.IP
+	}{
+		{
+			name:      "IPv4 /25",
+			cidr:      "192.168.1.0/25",
+			expectEnd: net.ParseIP("192.168.1.126"),
+		},
+		{
+			name:      "IPv4 /31",
+			cidr:      "10.0.0.0/31",
+			expectEnd: net.ParseIP("10.0.0.1"),
+		},
+		{
+			name:      "IPv6 /31",
+			cidr:      "fe80::/10",
+			expectEnd: net.ParseIP("febf:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+		},
+		{
+			name:      "IPv6 encoded IPv4",
+			cidr:      "::ffff:c0a8:100/121", // 192.168.1.0/25
+			expectEnd: net.ParseIP("192.168.1.126"),
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, cidr, err := net.ParseCIDR(tc.cidr)
+			require.NoError(t, err)
+			end, err := defaultRangeEnd(cidr)
+			require.NoError(t, err)
+			require.Truef(t, tc.expectEnd.Equal(end), "expected(%s) != actual(%s)", tc.expectEnd.String(), end.String())
+		})
+	}
+}
+
+func TestDefaultRangeStart(t *testing.T) {
+	tcs := []struct {
+		name        string
+		cidr        string
+		expectStart net.IP
+	}{
+		{
+			name:        "IPv4 /25",
+			cidr:        "192.168.1.0/25",
+			expectStart: net.ParseIP("192.168.1.1"),
+		},
+		{
+			name:        "IPv4 /31",
+			cidr:        "10.0.0.0/31",
+			expectStart: net.ParseIP("10.0.0.0"),
+		},
+		{
+			name:        "IPv6 /10",
+			cidr:        "fe80::/10",
+			expectStart: net.ParseIP("fe80::1"),
+		},
+		{
+			name:        "IPv6 /127",
+			cidr:        "fd00::/127",
+			expectStart: net.ParseIP("fd00::"),
+		},
+		{
+			name:        "IPv6 encoded IPv4",
+			cidr:        "::ffff:c0a8:100/121", // 192.168.1.0/25
+			expectStart: net.ParseIP("192.168.1.1"),
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, cidr, err := net.ParseCIDR(tc.cidr)
+			require.NoError(t, err)
+			end, err := DefaultRangeStart(cidr)
+			require.NoError(t, err)
+			require.Truef(t, tc.expectStart.Equal(end), "expected(%s) != actual(%s)", tc.expectStart.String(), end.String())
+		})
+	}
+}
+
+func TestIPPoolFindAddress(t *testing.T) {
+	tcs := []struct {
+		name        string
+		pool        *ipPool
+		expectError string
+		expectIPs   []string
+		expectMask  net.IPMask
+	}{
+		{
+			name: "success",
+			pool: &ipPool{
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(30, 32),
+						},
+						start: net.ParseIP("10.0.0.1"),
+						end:   net.ParseIP("10.0.0.2"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"10.0.0.2": struct{}{},
+				},
+			},
+			expectIPs:  []string{"10.0.0.1"},
+			expectMask: net.CIDRMask(30, 32),
+		},
+		{
+			name: "slash-thirty-one",
+			pool: &ipPool{
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(31, 32),
+						},
+						start: net.ParseIP("10.0.0.0"),
+						end:   net.ParseIP("10.0.0.1"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"10.0.0.1": struct{}{},
+				},
+			},
+			expectIPs:  []string{"10.0.0.0"},
+			expectMask: net.CIDRMask(31, 32),
+		},
+		{
+			name: "multiple-ranges",
+			pool: &ipPool{
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(31, 32),
+						},
+						start: net.ParseIP("10.0.0.0"),
+						end:   net.ParseIP("10.0.0.1"),
+					},
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.1.0"),
+							Mask: net.CIDRMask(31, 32),
+						},
+						start: net.ParseIP("10.0.1.0"),
+						end:   net.ParseIP("10.0.1.1"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"10.0.0.0": struct{}{},
+					"10.0.0.1": struct{}{},
+					"10.0.1.1": struct{}{},
+				},
+			},
+			expectIPs:  []string{"10.0.1.0"},
+			expectMask: net.CIDRMask(31, 32),
+		},
+		{
+			name: "ipv6 ula /48",
+			pool: &ipPool{
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("fd12:3456:789a::"),
+							Mask: net.CIDRMask(48, 128),
+						},
+						start: net.ParseIP("fd12:3456:789a::1"),
+						end:   net.ParseIP("fd12:3456:789a:ffff:ffff:ffff:ffff:ffff"),
+					},
+				},
+				inUse: map[string]struct{}{},
+			},
+			expectMask: net.CIDRMask(48, 128),
+		},
+		{
+			name: "ipv6 small range",
+			pool: &ipPool{
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("fd00::"),
+							Mask: net.CIDRMask(120, 128),
+						},
+						start: net.ParseIP("fd00::1"),
+						end:   net.ParseIP("fd00::3"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"fd00::1": struct{}{},
+					"fd00::3": struct{}{},
+				},
+			},
+			expectIPs:  []string{"fd00::2"},
+			expectMask: net.CIDRMask(120, 128),
+		},
+		{
+			name: "within start and end",
+			pool: &ipPool{
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(29, 32),
+						},
+						start: net.ParseIP("10.0.0.2"),
+						end:   net.ParseIP("10.0.0.5"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"10.0.0.2": struct{}{},
+					"10.0.0.3": struct{}{},
+					"10.0.0.5": struct{}{},
+				},
+			},
+			expectIPs:  []string{"10.0.0.4"},
+			expectMask: net.CIDRMask(29, 32),
+		},
+		{
+			name: "no addr available",
+			pool: &ipPool{
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(31, 32),
+						},
+						start: net.ParseIP("10.0.0.0"),
+						end:   net.ParseIP("10.0.0.1"),
+					},
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.1.0"),
+							Mask: net.CIDRMask(31, 32),
+						},
+						start: net.ParseIP("10.0.1.0"),
+						end:   net.ParseIP("10.0.1.1"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"10.0.0.0": struct{}{},
+					"10.0.0.1": struct{}{},
+					"10.0.1.0": struct{}{},
+					"10.0.1.1": struct{}{},
+				},
+			},
+			expectError: errNoAvailableIPAddresses.Error(),
+		},
+		{
+			name: "sequential",
+			pool: &ipPool{
+				strategy: wgk8s.IPAllocationSequential,
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(24, 32),
+						},
+						start: net.ParseIP("10.0.0.1"),
+						end:   net.ParseIP("10.0.0.254"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"10.0.0.1": struct{}{},
+					"10.0.0.2": struct{}{},
+					"10.0.0.4": struct{}{},
+				},
+			},
+			expectIPs:  []string{"10.0.0.3"},
+			expectMask: net.CIDRMask(24, 32),
+		},
+		{
+			name: "sequential-multiple-ranges",
+			pool: &ipPool{
+				strategy: wgk8s.IPAllocationSequential,
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.1.0"),
+							Mask: net.CIDRMask(31, 32),
+						},
+						start: net.ParseIP("10.0.1.0"),
+						end:   net.ParseIP("10.0.1.1"),
+					},
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(24, 32),
+						},
+						start: net.ParseIP("10.0.0.1"),
+						end:   net.ParseIP("10.0.0.254"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"10.0.1.0": struct{}{},
+					"10.0.1.1": struct{}{},
+				},
+			},
+			expectIPs:  []string{"10.0.0.1"},
+			expectMask: net.CIDRMask(24, 32),
+		},
+		{
+			name: "sequential-ipv6-slash-sixty-four",
+			pool: &ipPool{
+				strategy: wgk8s.IPAllocationSequential,
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("fd00::"),
+							Mask: net.CIDRMask(64, 128),
+						},
+						start: net.ParseIP("fd00::1"),
+						end:   net.ParseIP("fd00::ffff:ffff:ffff:ffff"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"fd00::1": struct{}{},
+				},
+			},
+			expectIPs:  []string{"fd00::2"},
+			expectMask: net.CIDRMask(64, 128),
+		},
+		{
+			name: "sequential-carry",
+			pool: &ipPool{
+				strategy: wgk8s.IPAllocationSequential,
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(16, 32),
+						},
+						start: net.ParseIP("10.0.0.254"),
+						end:   net.ParseIP("10.0.1.1"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"10.0.0.254": struct{}{},
+					"10.0.0.255": struct{}{},
+				},
+			},
+			expectIPs:  []string{"10.0.1.0"},
+			expectMask: net.CIDRMask(16, 32),
+		},
+		{
+			name: "sequential-ipv6-carry",
+			pool: &ipPool{
+				strategy: wgk8s.IPAllocationSequential,
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("fd00::"),
+							Mask: net.CIDRMask(64, 128),
+						},
+						start: net.ParseIP("fd00::fffe"),
+						end:   net.ParseIP("fd00::1:1"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"fd00::fffe": struct{}{},
+					"fd00::ffff": struct{}{},
+				},
+			},
+			expectIPs:  []string{"fd00::1:0"},
+			expectMask: net.CIDRMask(64, 128),
+		},
+		{
+			name: "random-carry",
+			pool: &ipPool{
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(16, 32),
+						},
+						start: net.ParseIP("10.0.0.254"),
+						end:   net.ParseIP("10.0.1.1"),
+					},
+				},
+				inUse: map[string]struct{}{
+					"10.0.0.254": struct{}{},
+					"10.0.0.255": struct{}{},
+					"10.0.1.1":   struct{}{},
+				},
+			},
+			expectIPs:  []string{"10.0.1.0"},
+			expectMask: net.CIDRMask(16, 32),
+		},
+		{
+			name: "excluded-cidr",
+			pool: &ipPool{
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(29, 32),
+						},
+						start: net.ParseIP("10.0.0.1"),
+						end:   net.ParseIP("10.0.0.6"),
+					},
+				},
+				excluded: []*net.IPNet{
+					{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.CIDRMask(30, 32)},
+				},
+				inUse: map[string]struct{}{
+					"10.0.0.4": struct{}{},
+					"10.0.0.6": struct{}{},
+				},
+			},
+			expectIPs:  []string{"10.0.0.5"},
+			expectMask: net.CIDRMask(29, 32),
+		},
+		{
+			name: "sequential-excluded-cidr",
+			pool: &ipPool{
+				strategy: wgk8s.IPAllocationSequential,
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("fd00::"),
+							Mask: net.CIDRMask(64, 128),
+						},
+						start: net.ParseIP("fd00::1"),
+						end:   net.ParseIP("fd00::ffff:ffff:ffff:ffff"),
+					},
+				},
+				excluded: []*net.IPNet{
+					{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(96, 128)},
+				},
+				inUse: map[string]struct{}{
+					"fd00::1:0:0": struct{}{},
+				},
+			},
+			expectIPs:  []string{"fd00::1:0:1"},
+			expectMask: net.CIDRMask(64, 128),
+		},
+		{
+			name: "fully-excluded",
+			pool: &ipPool{
+				strategy: wgk8s.IPAllocationSequential,
+				ranges: []*ipRange{
+					{
+						cidr: net.IPNet{
+							IP:   net.ParseIP("10.0.0.0"),
+							Mask: net.CIDRMask(30, 32),
+						},
+						start: net.ParseIP("10.0.0.1"),
+						end:   net.ParseIP("10.0.0.2"),
+					},
+				},
+				excluded: []*net.IPNet{
+					{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.CIDRMask(24, 32)},
+				},
+				inUse: map[string]struct{}{},
+			},
+			expectError: errNoAvailableIPAddresses.Error(),
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.pool.findAddress()
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			if tc.expectIPs != nil {
+				require.Contains(t, tc.expectIPs, got.IP.String())
+			}
+			for _, r := range tc.pool.ranges {
+				if r.cidr.Contains(got.IP) {
+					inRange, err := ipGreater(true, got.IP, r.start)
+					require.NoError(t, err)
+					require.True(t, inRange, "address before range start")
+					inRange, err = ipLess(true, got.IP, r.end)
+					require.NoError(t, err)
+					require.True(t, inRange, "address after range end")
+				}
+			}
+			require.Equal(t, tc.expectMask, got.Mask)
+		})
+	}
+}
+
+func TestIPPoolFindAddressExhaustsRange(t *testing.T) {
+	// Allocate every address in a default range: the network, broadcast, and IPv6 subnet-router
+	// anycast addresses must be skipped, and random scans must wrap around at the range end.
+	tcs := []struct {
+		name      string
+		cidr      string
+		expectIPs []string
+	}{
+		{
+			name:      "ipv4 /29",
+			cidr:      "10.0.0.8/29",
+			expectIPs: []string{"10.0.0.9", "10.0.0.10", "10.0.0.11", "10.0.0.12", "10.0.0.13", "10.0.0.14"},
+		},
+		{
+			name:      "ipv4 /31",
+			cidr:      "10.0.0.0/31",
+			expectIPs: []string{"10.0.0.0", "10.0.0.1"},
+		},
+		{
+			name:      "ipv4 /32",
+			cidr:      "10.0.0.1/32",
+			expectIPs: []string{"10.0.0.1"},
+		},
+		{
+			name:      "ipv6 /125",
+			cidr:      "fd00::8/125",
+			expectIPs: []string{"fd00::9", "fd00::a", "fd00::b", "fd00::c", "fd00::d", "fd00::e", "fd00::f"},
+		},
+		{
+			name:      "ipv6 /127",
+			cidr:      "fd00::/127",
+			expectIPs: []string{"fd00::", "fd00::1"},
+		},
+	}
+	for _, tc := range tcs {
+		for _, strategy := range []wgk8s.IPAllocationStrategy{wgk8s.IPAllocationRandom, wgk8s.IPAllocationSequential} {
+			tc, strategy := tc, strategy
+			t.Run(tc.name+" "+string(strategy), func(t *testing.T) {
+				_, cidr, err := net.ParseCIDR(tc.cidr)
+				require.NoError(t, err)
+				start, err := DefaultRangeStart(cidr)
+				require.NoError(t, err)
+				end, err := defaultRangeEnd(cidr)
+				require.NoError(t, err)
+				pool := &ipPool{
+					strategy: strategy,
+					ranges:   []*ipRange{{cidr: *cidr, start: start, end: end}},
+					inUse:    map[string]struct{}{},
+				}
+				var got []string
+				for range tc.expectIPs {
+					addr, err := pool.findAddress()
+					require.NoError(t, err)
+					got = append(got, addr.IP.String())
+					pool.inUse[addr.IP.String()] = struct{}{}
+				}
+				require.ElementsMatch(t, tc.expectIPs, got)
+				if strategy == wgk8s.IPAllocationSequential {
+					require.Equal(t, tc.expectIPs, got)
+				}
+				_, err = pool.findAddress()
+				require.EqualError(t, err, errNoAvailableIPAddresses.Error())
+			})
+		}
+	}
+}
+
+func TestRegistryIPAMLoadPool(t *testing.T) {
+	tcs := []struct {
+		name         string
+		k8sippool    *wgk8s.IPPool
+		claims       []string
+		expectName   string
+		expectInUse  []string
+		expectRanges []*ipRange
+		expectExcl   []string
+		expectError  string
+	}{
+		{
+			name: "success",
+			k8sippool: &wgk8s.IPPool{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name"},
+				Spec: wgk8s.IPPoolSpec{
+					Reserved: []string{"192.168.1.1"},
+					IPRanges: []wgk8s.IPRange{
+						{
+							CIDR: "192.168.1.0/24",
+						},
+					},
+				},
+			},
+			claims:      []string{"192.168.1.2"},
+			expectName:  "ns:name",
+			expectInUse: []string{"192.168.1.1", "192.168.1.2"},
+			expectRanges: []*ipRange{
+				&ipRange{
+					cidr: net.IPNet{
+						Mask: net.CIDRMask(24, 32),
+						IP:   net.ParseIP("192.168.1.0").To4(),
+					},
+					start: net.ParseIP("192.168.1.1").To4(),
+					end:   net.ParseIP("192.168.1.254").To4(),
+				},
+			},
+		},
+		{
+			name: "multiple ranges",
+			k8sippool: &wgk8s.IPPool{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name"},
+				Spec: wgk8s.IPPoolSpec{
+					Reserved: []string{"192.168.1.1"},
+					IPRanges: []wgk8s.IPRange{
+						{
+							CIDR: "192.168.1.0/24",
+						},
+						{
+							CIDR:  "10.1.2.64/28",
+							Start: "10.1.2.66",
+							End:   "10.1.2.75",
+						},
+					},
+				},
+			},
+			claims:      []string{"192.168.1.2"},
+			expectName:  "ns:name",
+			expectInUse: []string{"192.168.1.1", "192.168.1.2"},
+			expectRanges: []*ipRange{
+				&ipRange{
+					cidr: net.IPNet{
+						Mask: net.CIDRMask(24, 32),
+						IP:   net.ParseIP("192.168.1.0").To4(),
+					},
+					start: net.ParseIP("192.168.1.1").To4(),
+					end:   net.ParseIP("192.168.1.254").To4(),
+				},
+				&ipRange{
+					cidr: net.IPNet{
+						Mask: net.CIDRMask(28, 32),
+						IP:   net.ParseIP("10.1.2.64").To4(),
+					},
+					start: net.ParseIP("10.1.2.66"),
+					end:   net.ParseIP("10.1.2.75"),
+				},
+			},
+		},
+		{
+			name: "exclude cidrs",
+			k8sippool: &wgk8s.IPPool{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name"},
+				Spec: wgk8s.IPPoolSpec{
+					ExcludeCIDRs: []string{"192.168.1.32/27", "::ffff:192.168.1.128/121"},
+					IPRanges: []wgk8s.IPRange{
+						{
+							CIDR: "192.168.1.0/24",
+						},
+					},
+				},
+			},
+			expectName:  "ns:name",
+			expectInUse: []string{},
+			expectRanges: []*ipRange{
+				&ipRange{
+					cidr: net.IPNet{
+						Mask: net.CIDRMask(24, 32),
+						IP:   net.ParseIP("192.168.1.0").To4(),
+					},
+					start: net.ParseIP("192.168.1.1").To4(),
+					end:   net.ParseIP("192.168.1.254").To4(),
+				},
+			},
+			expectExcl: []string{"192.168.1.32/27", "192.168.1.128/25"},
+		},
+		{
+			name: "invalid exclude cidr",
+			k8sippool: &wgk8s.IPPool{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name"},
+				Spec: wgk8s.IPPoolSpec{
+					ExcludeCIDRs: []string{"192.168.1.32"},
+					IPRanges: []wgk8s.IPRange{
+						{
+							CIDR: "192.168.1.0/24",
+						},
+					},
+				},
+			},
+			expectError: `parsing excludeCIDRs "192.168.1.32"`,
+		},
+		{
+			name: "start out of range",
+			k8sippool: &wgk8s.IPPool{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name"},
+				Spec: wgk8s.IPPoolSpec{
+					IPRanges: []wgk8s.IPRange{
+						{
+							CIDR:  "192.168.1.0/24",
+							Start: "192.168.5.1",
+						},
+					},
+				},
+			},
+			expectError: `ipRanges.start "192.168.5.1" was not contained by cidr "192.168.1.0/24"`,
+		},
+		{
+			name: "end out of range",
+			k8sippool: &wgk8s.IPPool{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name"},
+				Spec: wgk8s.IPPoolSpec{
+					IPRanges: []wgk8s.IPRange{
+						{
+							CIDR: "192.168.1.0/24",
+							End:  "192.168.5.1",
+						},
+					},
+				},
+			},
+			expectError: `ipRanges.end "192.168.5.1" was not contained by cidr "192.168.1.0/24"`,
+		},
+		{
+			name: "unknown strategy",
+			k8sippool: &wgk8s.IPPool{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "name"},
+				Spec: wgk8s.IPPoolSpec{
+					Strategy: "bogus",
+					IPRanges: []wgk8s.IPRange{
+						{
+							CIDR: "192.168.1.0/24",
+						},
+					},
+				},
+			},
+			expectError: `unknown allocation strategy "bogus"`,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cs := fake.NewSimpleClientset()
+			r := &claimIPAM{
+				namespace: "ns",
+				store:     NewKubernetes(cs, "ns"),
+			}
+
+			_, err := cs.WgmeshV1alpha1().IPPools(tc.k8sippool.GetNamespace()).Create(tc.k8sippool)
+			require.NoError(t, err)
+			for _, claim := range tc.claims {
+				_, err = cs.WgmeshV1alpha1().IPClaims(tc.k8sippool.GetNamespace()).Create(&wgk8s.IPClaim{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "ns",
+						Name:      wgk8s.IPClaimName(tc.k8sippool.Name, claim),
+						Labels:    map[string]string{wgk8s.IPPoolLabel: tc.k8sippool.Name},
+					},
+					Spec: wgk8s.IPClaimSpec{IP: claim},
+				})
+				require.NoError(t, err)
+			}
+			ipPool, _, err := r.loadPool(tc.k8sippool.GetNamespace(), tc.k8sippool.GetName(), &metav1.OwnerReference{})
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectName, ipPool.name)
+			expectInUse := make(map[string]struct{}, len(tc.expectInUse))
+			for _, inUse := range tc.expectInUse {
+				expectInUse[inUse] = struct{}{}
+			}
+			require.Equal(t, expectInUse, ipPool.inUse)
+			require.ElementsMatch(t, tc.expectRanges, ipPool.ranges)
+			var excluded []string
+			for _, ex := range ipPool.excluded {
+				excluded = append(excluded, ex.String())
+			}
+			require.Equal(t, tc.expectExcl, excluded)
+		})
+	}
+}
+
+func TestIPPoolRestrictFamily(t *testing.T) {
+	v4 := &ipRange{cidr: net.IPNet{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.CIDRMask(24, 32)}}
+	v6 := &ipRange{cidr: net.IPNet{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(64, 128)}}
+	tcs := []struct {
+		name         string
+		family       IPFamily
+		expectRanges []*ipRange
+	}{
+		{
+			name:         "any",
+			family:       IPFamilyAny,
+			expectRanges: []*ipRange{v4, v6},
+		},
+		{
+			name:         "ipv4",
+			family:       IPFamilyIPv4,
+			expectRanges: []*ipRange{v4},
+		},
+		{
+			name:         "ipv6",
+			family:       IPFamilyIPv6,
+			expectRanges: []*ipRange{v6},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			pool := &ipPool{ranges: []*ipRange{v4, v6}}
+			pool.restrictFamily(tc.family)
+			require.Equal(t, tc.expectRanges, pool.ranges)
+		})
+	}
+}
+
+func TestRegistryIPAMClaimIPs(t *testing.T) {
+	owner := &metav1.OwnerReference{
+		APIVersion: wgk8s.SchemeGroupVersion.String(),
+		Kind:       "WireGuardPeer",
+		Name:       "peer",
+		UID:        "uid-1",
+	}
+	cs := fake.NewSimpleClientset()
+	r := &claimIPAM{
+		namespace: "ns",
+		store:     NewKubernetes(cs, "ns"),
+	}
+	_, err := cs.WgmeshV1alpha1().IPPools("ns").Create(&wgk8s.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec: wgk8s.IPPoolSpec{
+			IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/29"}},
+		},
+	})
+	require.NoError(t, err)
+	// Another peer holds a claim in the pool.
+	_, err = cs.WgmeshV1alpha1().IPClaims("ns").Create(
+		newIPClaim("ns", "pool", net.ParseIP("10.0.0.1"), &metav1.OwnerReference{Name: "other"}))
+	require.NoError(t, err)
+
+	claimed, err := r.ClaimIPs("pool", owner, map[IPFamily]int{IPFamilyAny: 2}, nil)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	for _, addr := range claimed {
+		require.NotEqual(t, "10.0.0.1", addr.IP.String())
+		require.Equal(t, net.CIDRMask(29, 32), addr.Mask)
+		claim, err := cs.WgmeshV1alpha1().IPClaims("ns").Get(wgk8s.IPClaimName("pool", addr.IP.String()), metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, addr.IP.String(), claim.Spec.IP)
+		require.Equal(t, "pool", claim.Labels[wgk8s.IPPoolLabel])
+		require.Equal(t, []metav1.OwnerReference{*owner}, claim.OwnerReferences)
+	}
+
+	// The owner is re-created with a new UID and only needs one address.
+	owner.UID = "uid-2"
+	reclaimed, err := r.ClaimIPs("pool", owner, map[IPFamily]int{IPFamilyAny: 1}, nil)
+	require.NoError(t, err)
+	require.Len(t, reclaimed, 1)
+	claims, err := cs.WgmeshV1alpha1().IPClaims("ns").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, claims.Items, 2)
+	for _, claim := range claims.Items {
+		if claim.Spec.IP == "10.0.0.1" {
+			continue
+		}
+		require.Equal(t, reclaimed[0].IP.String(), claim.Spec.IP)
+		require.Equal(t, owner.UID, claim.OwnerReferences[0].UID)
+	}
+}
+
+func TestRegistryIPAMClaimIPsIPv6(t *testing.T) {
+	owner := &metav1.OwnerReference{Name: "peer", UID: "uid"}
+	cs := fake.NewSimpleClientset()
+	r := &claimIPAM{
+		namespace: "ns",
+		store:     NewKubernetes(cs, "ns"),
+	}
+	_, err := cs.WgmeshV1alpha1().IPPools("ns").Create(&wgk8s.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec: wgk8s.IPPoolSpec{
+			IPRanges: []wgk8s.IPRange{
+				{CIDR: "10.0.0.0/24"},
+				{CIDR: "fd12:3456:789a::/48"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	claimed, err := r.ClaimIPs("pool", owner, map[IPFamily]int{IPFamilyIPv6: 2}, nil)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	_, ula, _ := net.ParseCIDR("fd12:3456:789a::/48")
+	for _, addr := range claimed {
+		require.True(t, ula.Contains(addr.IP))
+		require.Equal(t, net.CIDRMask(48, 128), addr.Mask)
+	}
+	v6Claimed := claimed
+
+	// Dual-stack: the IPv6 claims are reused and an IPv4 address is added.
+	claimed, err = r.ClaimIPs("pool", owner, map[IPFamily]int{IPFamilyIPv4: 1, IPFamilyIPv6: 2}, nil)
+	require.NoError(t, err)
+	require.Len(t, claimed, 3)
+	require.Subset(t, claimed, v6Claimed)
+	claims, err := cs.WgmeshV1alpha1().IPClaims("ns").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, claims.Items, 3)
+
+	// Families which are no longer requested are released.
+	claimed, err = r.ClaimIPs("pool", owner, map[IPFamily]int{IPFamilyIPv4: 1}, nil)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.NotNil(t, claimed[0].IP.To4())
+	claims, err = cs.WgmeshV1alpha1().IPClaims("ns").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, claims.Items, 1)
+
+	_, err = r.ClaimIPs("pool", owner, map[IPFamily]int{IPFamilyAny: 1, IPFamilyIPv4: 1}, nil)
+	require.EqualError(t, err, `ip family "any" may not be combined with other families`)
+}
+
+func TestRegistryIPAMReleaseIPs(t *testing.T) {
+	owner := &metav1.OwnerReference{Name: "peer", UID: "uid"}
+	other := &metav1.OwnerReference{Name: "other", UID: "other-uid"}
+	cs := fake.NewSimpleClientset()
+	r := &claimIPAM{
+		namespace: "ns",
+		store:     NewKubernetes(cs, "ns"),
+	}
+	for _, claim := range []*wgk8s.IPClaim{
+		newIPClaim("ns", "a", net.ParseIP("10.0.0.1"), owner),
+		newIPClaim("ns", "b", net.ParseIP("fd00::1"), owner),
+		newIPClaim("ns", "a", net.ParseIP("10.0.0.2"), other),
+	} {
+		_, err := cs.WgmeshV1alpha1().IPClaims("ns").Create(claim)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, r.ReleaseIPs("a", owner))
+	claims, err := cs.WgmeshV1alpha1().IPClaims("ns").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, claims.Items, 2)
+
+	require.NoError(t, r.ReleaseIPs("", owner))
+	claims, err = cs.WgmeshV1alpha1().IPClaims("ns").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, claims.Items, 1)
+	require.Equal(t, "10.0.0.2", claims.Items[0].Spec.IP)
+}
+
+func TestRegistryIPAMClaimIPsStatic(t *testing.T) {
+	owner := &metav1.OwnerReference{
+		APIVersion: wgk8s.SchemeGroupVersion.String(),
+		Kind:       "WireGuardPeer",
+		Name:       "peer",
+		UID:        "uid",
+	}
+	cs := fake.NewSimpleClientset()
+	r := &claimIPAM{
+		namespace: "ns",
+		store:     NewKubernetes(cs, "ns"),
+	}
+	_, err := cs.WgmeshV1alpha1().IPPools("ns").Create(&wgk8s.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec: wgk8s.IPPoolSpec{
+			IPRanges:     []wgk8s.IPRange{{CIDR: "10.0.0.0/24", Start: "10.0.0.10"}},
+			Reserved:     []string{"10.0.0.20"},
+			ExcludeCIDRs: []string{"10.0.0.128/25"},
+		},
+	})
+	require.NoError(t, err)
+	// An administrator pre-created a claim for the peer, and another peer holds 10.0.0.30.
+	reserved := newIPClaim("ns", "pool", net.ParseIP("10.0.0.11"), owner)
+	reserved.OwnerReferences = nil
+	reserved.Spec.Peer = "peer"
+	_, err = cs.WgmeshV1alpha1().IPClaims("ns").Create(reserved)
+	require.NoError(t, err)
+	_, err = cs.WgmeshV1alpha1().IPClaims("ns").Create(
+		newIPClaim("ns", "pool", net.ParseIP("10.0.0.30"), &metav1.OwnerReference{Name: "other"}))
+	require.NoError(t, err)
+
+	claimed, err := r.ClaimIPs("pool", owner, map[IPFamily]int{IPFamilyAny: 1}, []net.IP{net.ParseIP("10.0.0.20")})
+	require.NoError(t, err)
+	var got []string
+	for _, addr := range claimed {
+		got = append(got, addr.IP.String())
+	}
+	require.ElementsMatch(t, []string{"10.0.0.11", "10.0.0.20"}, got,
+		"the reserved claim should satisfy the dynamic count")
+
+	// Static claims are reused.
+	claimed, err = r.ClaimIPs("pool", owner, nil, []net.IP{net.ParseIP("10.0.0.20")})
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+
+	// Reserved claims survive release.
+	require.NoError(t, r.ReleaseIPs("pool", owner))
+	_, err = cs.WgmeshV1alpha1().IPClaims("ns").Get(reserved.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	tcs := []struct {
+		ip          string
+		expectError string
+	}{
+		{ip: "10.0.0.30", expectError: `static ip "10.0.0.30" in pool ns:pool is already claimed by another peer`},
+		{ip: "10.0.0.5", expectError: `static ip "10.0.0.5" is not in any range of pool ns:pool`},
+		{ip: "10.0.1.5", expectError: `static ip "10.0.1.5" is not in any range of pool ns:pool`},
+		{ip: "10.0.0.200", expectError: `static ip "10.0.0.200" is excluded from pool ns:pool`},
+	}
+	for _, tc := range tcs {
+		_, err = r.ClaimIPs("pool", owner, nil, []net.IP{net.ParseIP(tc.ip)})
+		require.EqualError(t, err, tc.expectError)
+	}
+}
+
+func TestRegistryIPAMRenewLeases(t *testing.T) {
+	owner := &metav1.OwnerReference{
+		APIVersion: wgk8s.SchemeGroupVersion.String(),
+		Kind:       "WireGuardPeer",
+		Name:       "peer",
+		UID:        "uid",
+	}
+	cs := fake.NewSimpleClientset()
+	r := &claimIPAM{
+		namespace:     "ns",
+		store:         NewKubernetes(cs, "ns"),
+		leaseDuration: time.Minute,
+	}
+	_, err := cs.WgmeshV1alpha1().IPPools("ns").Create(&wgk8s.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pool"},
+		Spec: wgk8s.IPPoolSpec{
+			IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/29"}},
+		},
+	})
+	require.NoError(t, err)
+
+	claimed, err := r.ClaimIPs("pool", owner, map[IPFamily]int{IPFamilyAny: 2}, nil)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	claims := cs.WgmeshV1alpha1().IPClaims("ns")
+	kept, err := claims.Get(wgk8s.IPClaimName("pool", claimed[0].IP.String()), metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, kept.Spec.LeaseExpires)
+	require.True(t, kept.Spec.LeaseExpires.After(time.Now()))
+
+	// Our lease lapsed; the claim was collected and taken by another peer.
+	stolen := wgk8s.IPClaimName("pool", claimed[1].IP.String())
+	require.NoError(t, claims.Delete(stolen, nil))
+	_, err = claims.Create(newIPClaim("ns", "pool", claimed[1].IP, &metav1.OwnerReference{Name: "other"}))
+	require.NoError(t, err)
+	// Make the remaining lease stale so we can observe the renewal.
+	kept.Spec.LeaseExpires = &metav1.Time{Time: time.Now().Add(-time.Second)}
+	_, err = claims.Update(kept)
+	require.NoError(t, err)
+
+	lost, err := r.RenewLeases("pool", owner, claimed)
+	require.NoError(t, err)
+	require.Equal(t, []*net.IPNet{claimed[1]}, lost)
+	kept, err = claims.Get(kept.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.False(t, kept.LeaseExpired(time.Now()))
+	other, err := claims.Get(stolen, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "other", other.OwnerReferences[0].Name, "the registry's holder keeps the claim")
+}
@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"time"
+
+	wgmeshCS "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Kubernetes is a Registry backed by the wgmesh custom resources in a Kubernetes namespace.
+type Kubernetes struct {
+	clientset wgmeshCS.Interface
+	namespace string
+}
+
+var (
+	_ Registry   = (*Kubernetes)(nil)
+	_ claimStore = (*Kubernetes)(nil)
+)
+
+// NewKubernetes returns a Registry which stores records as custom resources in the namespace.
+func NewKubernetes(clientset wgmeshCS.Interface, namespace string) *Kubernetes {
+	return &Kubernetes{clientset: clientset, namespace: namespace}
+}
+
+// Register creates a WireGuardPeer record, returning it as stored.
+func (k *Kubernetes) Register(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	return k.clientset.WgmeshV1alpha1().WireGuardPeers(k.namespace).Create(peer)
+}
+
+// Get returns the named WireGuardPeer.
+func (k *Kubernetes) Get(name string) (*wgk8s.WireGuardPeer, error) {
+	return k.clientset.WgmeshV1alpha1().WireGuardPeers(k.namespace).Get(name, metav1.GetOptions{})
+}
+
+// Update replaces a WireGuardPeer, including its status.
+func (k *Kubernetes) Update(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	return k.clientset.WgmeshV1alpha1().WireGuardPeers(k.namespace).Update(peer)
+}
+
+// Delete removes the named WireGuardPeer if its UID matches.
+func (k *Kubernetes) Delete(name string, uid types.UID) error {
+	return k.clientset.WgmeshV1alpha1().WireGuardPeers(k.namespace).Delete(
+		name, metav1.NewPreconditionDeleteOptions(string(uid)))
+}
+
+// WatchPeers lists and watches WireGuardPeers. Nil selectors match everything.
+func (k *Kubernetes) WatchPeers(labelSelector labels.Selector, fieldSelector fields.Selector) cache.ListerWatcher {
+	peers := k.clientset.WgmeshV1alpha1().WireGuardPeers(k.namespace)
+	withSelectors := func(options *metav1.ListOptions) {
+		if labelSelector != nil {
+			options.LabelSelector = labelSelector.String()
+		}
+		if fieldSelector != nil {
+			options.FieldSelector = fieldSelector.String()
+		}
+	}
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			withSelectors(&options)
+			return peers.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			withSelectors(&options)
+			return peers.Watch(options)
+		},
+	}
+}
+
+// WatchMeshes lists and watches Meshes.
+func (k *Kubernetes) WatchMeshes() cache.ListerWatcher {
+	meshes := k.clientset.WgmeshV1alpha1().Meshes(k.namespace)
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return meshes.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return meshes.Watch(options)
+		},
+	}
+}
+
+// WatchPolicies lists and watches WireGuardMeshPolicies.
+func (k *Kubernetes) WatchPolicies() cache.ListerWatcher {
+	policies := k.clientset.WgmeshV1alpha1().WireGuardMeshPolicies(k.namespace)
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return policies.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return policies.Watch(options)
+		},
+	}
+}
+
+// IPAM returns an allocator which claims addresses by creating IPClaims.
+func (k *Kubernetes) IPAM(leaseDuration time.Duration) IPAM {
+	return &claimIPAM{
+		namespace:     k.namespace,
+		store:         k,
+		leaseDuration: leaseDuration,
+	}
+}
+
+func (k *Kubernetes) getPool(name string) (*wgk8s.IPPool, error) {
+	return k.clientset.WgmeshV1alpha1().IPPools(k.namespace).Get(name, metav1.GetOptions{})
+}
+
+func (k *Kubernetes) listClaims(selector labels.Selector) ([]wgk8s.IPClaim, error) {
+	claims, err := k.clientset.
+		WgmeshV1alpha1().
+		IPClaims(k.namespace).
+		List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	return claims.Items, nil
+}
+
+func (k *Kubernetes) getClaim(name string) (*wgk8s.IPClaim, error) {
+	return k.clientset.WgmeshV1alpha1().IPClaims(k.namespace).Get(name, metav1.GetOptions{})
+}
+
+func (k *Kubernetes) createClaim(claim *wgk8s.IPClaim) (*wgk8s.IPClaim, error) {
+	return k.clientset.WgmeshV1alpha1().IPClaims(k.namespace).Create(claim)
+}
+
+func (k *Kubernetes) updateClaim(claim *wgk8s.IPClaim) (*wgk8s.IPClaim, error) {
+	return k.clientset.WgmeshV1alpha1().IPClaims(k.namespace).Update(claim)
+}
+
+func (k *Kubernetes) deleteClaim(name string, uid types.UID) error {
+	return k.clientset.WgmeshV1alpha1().IPClaims(k.namespace).Delete(
+		name, metav1.NewPreconditionDeleteOptions(string(uid)))
+}
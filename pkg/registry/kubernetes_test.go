@@ -0,0 +1,47 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/stretchr/testify/require"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestKubernetes(t *testing.T) {
+	r := NewKubernetes(fake.NewSimpleClientset(), "ns")
+	peer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "a", UID: "uid-a", Labels: map[string]string{"role": "gateway"}},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: "key-a"},
+	}
+	_, err := r.Register(peer)
+	require.NoError(t, err)
+	_, err = r.Register(peer)
+	require.True(t, k8sErrors.IsAlreadyExists(err))
+	_, err = r.Register(&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "b"}})
+	require.NoError(t, err)
+
+	got, err := r.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, "ns", got.GetNamespace())
+	got.Status.ObservedEndpoints = []wgk8s.ObservedEndpoint{{PublicKey: "key-b", Endpoint: "192.0.2.1:51820"}}
+	_, err = r.Update(got)
+	require.NoError(t, err)
+	got, err = r.Get("a")
+	require.NoError(t, err)
+	require.Len(t, got.Status.ObservedEndpoints, 1)
+
+	list, err := r.WatchPeers(labels.SelectorFromSet(labels.Set{"role": "gateway"}), nil).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, list.(*wgk8s.WireGuardPeerList).Items, 1)
+	list, err = r.WatchPeers(nil, nil).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, list.(*wgk8s.WireGuardPeerList).Items, 2)
+
+	require.NoError(t, r.Delete("a", "uid-a"))
+	_, err = r.Get("a")
+	require.True(t, k8sErrors.IsNotFound(err))
+}
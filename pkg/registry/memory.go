@@ -0,0 +1,465 @@
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// memoryEventHistory is how many recent changes are kept so watches can resume from a
+	// resourceVersion. Older watchers must relist.
+	memoryEventHistory = 1024
+	// memoryWatchBuffer is how many events may be queued for a slow watcher before it is closed.
+	memoryWatchBuffer = 128
+)
+
+var (
+	peersResource    = schema.GroupResource{Group: wgk8s.GroupName, Resource: "wireguardpeers"}
+	meshesResource   = schema.GroupResource{Group: wgk8s.GroupName, Resource: "meshes"}
+	policiesResource = schema.GroupResource{Group: wgk8s.GroupName, Resource: "wireguardmeshpolicies"}
+	poolsResource    = schema.GroupResource{Group: wgk8s.GroupName, Resource: "ippools"}
+	claimsResource   = schema.GroupResource{Group: wgk8s.GroupName, Resource: "ipclaims"}
+)
+
+// memoryObject is a record kept by the Memory registry.
+type memoryObject interface {
+	metav1.Object
+	runtime.Object
+}
+
+// memoryEvent is a change to a record, kept so watches can resume.
+type memoryEvent struct {
+	resource schema.GroupResource
+	version  uint64
+	typ      watch.EventType
+	old      memoryObject
+	obj      memoryObject
+}
+
+// Memory is a Registry which keeps records in memory, for meshes without a Kubernetes cluster to
+// store them in. Records are lost on restart; agents re-register when their local peer guard sees
+// the record vanish. Finalizers are not enforced.
+type Memory struct {
+	sync.Mutex
+
+	namespace string
+	version   uint64
+	records   map[schema.GroupResource]map[string]memoryObject
+	events    []memoryEvent
+	watchers  map[*memoryWatcher]struct{}
+}
+
+var (
+	_ Registry   = (*Memory)(nil)
+	_ claimStore = (*Memory)(nil)
+)
+
+// NewMemory returns an empty in-memory Registry for the namespace, seeded with the provided
+// WireGuardPeers, Meshes, WireGuardMeshPolicies, IPPools, and IPClaims.
+func NewMemory(namespace string, seed ...runtime.Object) (*Memory, error) {
+	m := &Memory{
+		namespace: namespace,
+		records: map[schema.GroupResource]map[string]memoryObject{
+			peersResource:    make(map[string]memoryObject),
+			meshesResource:   make(map[string]memoryObject),
+			policiesResource: make(map[string]memoryObject),
+			poolsResource:    make(map[string]memoryObject),
+			claimsResource:   make(map[string]memoryObject),
+		},
+		watchers: make(map[*memoryWatcher]struct{}),
+	}
+	for _, o := range seed {
+		var err error
+		switch o := o.(type) {
+		case *wgk8s.WireGuardPeer:
+			_, err = m.create(peersResource, o.DeepCopy())
+		case *wgk8s.Mesh:
+			_, err = m.create(meshesResource, o.DeepCopy())
+		case *wgk8s.WireGuardMeshPolicy:
+			_, err = m.create(policiesResource, o.DeepCopy())
+		case *wgk8s.IPPool:
+			_, err = m.create(poolsResource, o.DeepCopy())
+		case *wgk8s.IPClaim:
+			_, err = m.create(claimsResource, o.DeepCopy())
+		default:
+			err = fmt.Errorf("unsupported seed object %T", o)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Register creates a WireGuardPeer record, returning it as stored.
+func (m *Memory) Register(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	o, err := m.create(peersResource, peer.DeepCopy())
+	if err != nil {
+		return nil, err
+	}
+	return o.(*wgk8s.WireGuardPeer), nil
+}
+
+// Get returns the named WireGuardPeer.
+func (m *Memory) Get(name string) (*wgk8s.WireGuardPeer, error) {
+	o, err := m.get(peersResource, name)
+	if err != nil {
+		return nil, err
+	}
+	return o.(*wgk8s.WireGuardPeer), nil
+}
+
+// Update replaces a WireGuardPeer, including its status.
+func (m *Memory) Update(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error) {
+	o, err := m.update(peersResource, peer.DeepCopy())
+	if err != nil {
+		return nil, err
+	}
+	return o.(*wgk8s.WireGuardPeer), nil
+}
+
+// Delete removes the named WireGuardPeer if its UID matches.
+func (m *Memory) Delete(name string, uid types.UID) error {
+	return m.delete(peersResource, name, uid)
+}
+
+// WatchPeers lists and watches WireGuardPeers. Nil selectors match everything.
+func (m *Memory) WatchPeers(labelSelector labels.Selector, fieldSelector fields.Selector) cache.ListerWatcher {
+	return &memoryListWatch{m: m, resource: peersResource, labels: labelSelector, fields: fieldSelector}
+}
+
+// WatchMeshes lists and watches Meshes.
+func (m *Memory) WatchMeshes() cache.ListerWatcher {
+	return &memoryListWatch{m: m, resource: meshesResource}
+}
+
+// WatchPolicies lists and watches WireGuardMeshPolicies.
+func (m *Memory) WatchPolicies() cache.ListerWatcher {
+	return &memoryListWatch{m: m, resource: policiesResource}
+}
+
+// IPAM returns an allocator which claims addresses by creating IPClaims.
+func (m *Memory) IPAM(leaseDuration time.Duration) IPAM {
+	return &claimIPAM{
+		namespace:     m.namespace,
+		store:         m,
+		leaseDuration: leaseDuration,
+	}
+}
+
+func (m *Memory) getPool(name string) (*wgk8s.IPPool, error) {
+	o, err := m.get(poolsResource, name)
+	if err != nil {
+		return nil, err
+	}
+	return o.(*wgk8s.IPPool), nil
+}
+
+func (m *Memory) listClaims(selector labels.Selector) ([]wgk8s.IPClaim, error) {
+	list, _ := m.list(claimsResource, selector, nil)
+	claims := make([]wgk8s.IPClaim, 0, len(list))
+	for _, o := range list {
+		claims = append(claims, *o.(*wgk8s.IPClaim))
+	}
+	return claims, nil
+}
+
+func (m *Memory) getClaim(name string) (*wgk8s.IPClaim, error) {
+	o, err := m.get(claimsResource, name)
+	if err != nil {
+		return nil, err
+	}
+	return o.(*wgk8s.IPClaim), nil
+}
+
+func (m *Memory) createClaim(claim *wgk8s.IPClaim) (*wgk8s.IPClaim, error) {
+	o, err := m.create(claimsResource, claim.DeepCopy())
+	if err != nil {
+		return nil, err
+	}
+	return o.(*wgk8s.IPClaim), nil
+}
+
+func (m *Memory) updateClaim(claim *wgk8s.IPClaim) (*wgk8s.IPClaim, error) {
+	o, err := m.update(claimsResource, claim.DeepCopy())
+	if err != nil {
+		return nil, err
+	}
+	return o.(*wgk8s.IPClaim), nil
+}
+
+func (m *Memory) deleteClaim(name string, uid types.UID) error {
+	return m.delete(claimsResource, name, uid)
+}
+
+// create stores a new record, which the caller must not retain, and returns a copy.
+func (m *Memory) create(resource schema.GroupResource, o memoryObject) (memoryObject, error) {
+	m.Lock()
+	defer m.Unlock()
+	name := o.GetName()
+	if name == "" {
+		return nil, k8sErrors.NewBadRequest("name is required")
+	}
+	if _, ok := m.records[resource][name]; ok {
+		return nil, k8sErrors.NewAlreadyExists(resource, name)
+	}
+	o.SetNamespace(m.namespace)
+	o.SetSelfLink(m.selfLink(resource, name))
+	if o.GetUID() == "" {
+		o.SetUID(uuid.NewUUID())
+	}
+	o.SetCreationTimestamp(metav1.Now())
+	m.record(resource, watch.Added, nil, o)
+	return o.DeepCopyObject().(memoryObject), nil
+}
+
+// selfLink returns the path the Kubernetes API would serve the record at. Agents key peers by it.
+func (m *Memory) selfLink(resource schema.GroupResource, name string) string {
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s/%s",
+		resource.Group, wgk8s.SchemeGroupVersion.Version, m.namespace, resource.Resource, name)
+}
+
+func (m *Memory) get(resource schema.GroupResource, name string) (memoryObject, error) {
+	m.Lock()
+	defer m.Unlock()
+	o, ok := m.records[resource][name]
+	if !ok {
+		return nil, k8sErrors.NewNotFound(resource, name)
+	}
+	return o.DeepCopyObject().(memoryObject), nil
+}
+
+// update replaces a record, which the caller must not retain, and returns a copy. As with the
+// Kubernetes API, the update fails with a Conflict if a resourceVersion is given and is stale.
+func (m *Memory) update(resource schema.GroupResource, o memoryObject) (memoryObject, error) {
+	m.Lock()
+	defer m.Unlock()
+	name := o.GetName()
+	old, ok := m.records[resource][name]
+	if !ok {
+		return nil, k8sErrors.NewNotFound(resource, name)
+	}
+	if rv := o.GetResourceVersion(); rv != "" && rv != old.GetResourceVersion() {
+		return nil, k8sErrors.NewConflict(resource, name,
+			fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	o.SetNamespace(m.namespace)
+	o.SetSelfLink(old.GetSelfLink())
+	o.SetUID(old.GetUID())
+	o.SetCreationTimestamp(old.GetCreationTimestamp())
+	m.record(resource, watch.Modified, old, o)
+	return o.DeepCopyObject().(memoryObject), nil
+}
+
+func (m *Memory) delete(resource schema.GroupResource, name string, uid types.UID) error {
+	m.Lock()
+	defer m.Unlock()
+	old, ok := m.records[resource][name]
+	if !ok {
+		return k8sErrors.NewNotFound(resource, name)
+	}
+	if uid != "" && uid != old.GetUID() {
+		return k8sErrors.NewConflict(resource, name,
+			fmt.Errorf("precondition failed: UID in precondition: %s, UID in object meta: %s", uid, old.GetUID()))
+	}
+	m.record(resource, watch.Deleted, old, old)
+	return nil
+}
+
+// record applies a change, assigning it the next resourceVersion, and notifies watchers. The lock
+// must be held.
+func (m *Memory) record(resource schema.GroupResource, typ watch.EventType, old, o memoryObject) {
+	m.version++
+	if typ == watch.Deleted {
+		delete(m.records[resource], o.GetName())
+		o = o.DeepCopyObject().(memoryObject)
+	} else {
+		m.records[resource][o.GetName()] = o
+	}
+	o.SetResourceVersion(strconv.FormatUint(m.version, 10))
+	e := memoryEvent{resource: resource, version: m.version, typ: typ, old: old, obj: o}
+	m.events = append(m.events, e)
+	if len(m.events) > memoryEventHistory {
+		m.events = m.events[len(m.events)-memoryEventHistory:]
+	}
+	for w := range m.watchers {
+		if !w.send(e) {
+			// The watcher fell behind; close it so it relists.
+			delete(m.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+// list returns copies of the matching records, and the resourceVersion they're current as of.
+func (m *Memory) list(resource schema.GroupResource, labelSelector labels.Selector, fieldSelector fields.Selector) ([]memoryObject, string) {
+	m.Lock()
+	defer m.Unlock()
+	var out []memoryObject
+	for _, o := range m.records[resource] {
+		if matches(o, labelSelector, fieldSelector) {
+			out = append(out, o.DeepCopyObject().(memoryObject))
+		}
+	}
+	return out, strconv.FormatUint(m.version, 10)
+}
+
+// watch returns a watch of the resource's changes after resourceVersion. An empty or zero
+// resourceVersion watches from now. Versions which are no longer in the history return a Gone
+// error, and the caller should relist.
+func (m *Memory) watch(
+	resource schema.GroupResource,
+	labelSelector labels.Selector,
+	fieldSelector fields.Selector,
+	resourceVersion string,
+) (watch.Interface, error) {
+	m.Lock()
+	defer m.Unlock()
+	from := m.version
+	if resourceVersion != "" && resourceVersion != "0" {
+		v, err := strconv.ParseUint(resourceVersion, 10, 64)
+		if err != nil {
+			return nil, k8sErrors.NewBadRequest(fmt.Sprintf("invalid resourceVersion %q", resourceVersion))
+		}
+		oldest := m.version
+		if len(m.events) > 0 {
+			oldest = m.events[0].version - 1
+		}
+		if v < oldest || v > m.version {
+			return nil, k8sErrors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", v, oldest))
+		}
+		from = v
+	}
+	w := &memoryWatcher{
+		m:        m,
+		resource: resource,
+		labels:   labelSelector,
+		fields:   fieldSelector,
+		ch:       make(chan watch.Event, memoryWatchBuffer+len(m.events)),
+	}
+	for _, e := range m.events {
+		if e.version > from {
+			w.send(e)
+		}
+	}
+	m.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// matches returns true if the object matches both selectors. Nil selectors match everything.
+func matches(o memoryObject, labelSelector labels.Selector, fieldSelector fields.Selector) bool {
+	if labelSelector != nil && !labelSelector.Matches(labels.Set(o.GetLabels())) {
+		return false
+	}
+	if fieldSelector != nil && !fieldSelector.Matches(fields.Set{
+		"metadata.name":      o.GetName(),
+		"metadata.namespace": o.GetNamespace(),
+	}) {
+		return false
+	}
+	return true
+}
+
+// memoryListWatch is a cache.ListerWatcher for a Memory registry resource.
+type memoryListWatch struct {
+	m        *Memory
+	resource schema.GroupResource
+	labels   labels.Selector
+	fields   fields.Selector
+}
+
+func (lw *memoryListWatch) List(options metav1.ListOptions) (runtime.Object, error) {
+	objs, rv := lw.m.list(lw.resource, lw.labels, lw.fields)
+	switch lw.resource {
+	case peersResource:
+		list := &wgk8s.WireGuardPeerList{ListMeta: metav1.ListMeta{ResourceVersion: rv}}
+		for _, o := range objs {
+			list.Items = append(list.Items, *o.(*wgk8s.WireGuardPeer))
+		}
+		return list, nil
+	case meshesResource:
+		list := &wgk8s.MeshList{ListMeta: metav1.ListMeta{ResourceVersion: rv}}
+		for _, o := range objs {
+			list.Items = append(list.Items, *o.(*wgk8s.Mesh))
+		}
+		return list, nil
+	case policiesResource:
+		list := &wgk8s.WireGuardMeshPolicyList{ListMeta: metav1.ListMeta{ResourceVersion: rv}}
+		for _, o := range objs {
+			list.Items = append(list.Items, *o.(*wgk8s.WireGuardMeshPolicy))
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("listing %s is not supported", lw.resource)
+}
+
+func (lw *memoryListWatch) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	return lw.m.watch(lw.resource, lw.labels, lw.fields, options.ResourceVersion)
+}
+
+// memoryWatcher delivers a Memory registry's changes to a watch client.
+type memoryWatcher struct {
+	m        *Memory
+	resource schema.GroupResource
+	labels   labels.Selector
+	fields   fields.Selector
+	ch       chan watch.Event
+}
+
+// send queues the event if it's relevant to the watcher, returning false if the watcher's buffer
+// is full. Changes which move a record into or out of the selection are delivered as adds and
+// deletes. The registry lock must be held.
+func (w *memoryWatcher) send(e memoryEvent) bool {
+	if e.resource != w.resource {
+		return true
+	}
+	typ := e.typ
+	now := matches(e.obj, w.labels, w.fields)
+	if typ == watch.Modified {
+		was := matches(e.old, w.labels, w.fields)
+		switch {
+		case was && !now:
+			typ, now = watch.Deleted, true
+		case !was && now:
+			typ = watch.Added
+		}
+	}
+	if !now {
+		return true
+	}
+	select {
+	case w.ch <- watch.Event{Type: typ, Object: e.obj.DeepCopyObject()}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop stops the watch and closes its result channel.
+func (w *memoryWatcher) Stop() {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if _, ok := w.m.watchers[w]; ok {
+		delete(w.m.watchers, w)
+		close(w.ch)
+	}
+}
+
+// ResultChan returns the channel of watch events.
+func (w *memoryWatcher) ResultChan() <-chan watch.Event {
+	return w.ch
+}
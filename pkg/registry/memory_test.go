@@ -0,0 +1,74 @@
+package registry
+
+import (
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/stretchr/testify/require"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestMemoryWatch(t *testing.T) {
+	m, err := NewMemory("ns", &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: map[string]string{"role": "gateway"}},
+	})
+	require.NoError(t, err)
+	lw := m.WatchPeers(labels.SelectorFromSet(labels.Set{"role": "gateway"}), nil)
+	list, err := lw.List(metav1.ListOptions{})
+	require.NoError(t, err)
+	peers := list.(*wgk8s.WireGuardPeerList)
+	require.Len(t, peers.Items, 1)
+
+	// Changes made between the list and the watch are replayed from the list's version.
+	a := peers.Items[0].DeepCopy()
+	a.SetLabels(nil)
+	_, err = m.Update(a)
+	require.NoError(t, err)
+	_, err = m.Register(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "b", Labels: map[string]string{"role": "gateway"}},
+	})
+	require.NoError(t, err)
+	_, err = m.Register(&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "c"}})
+	require.NoError(t, err)
+
+	w, err := lw.Watch(metav1.ListOptions{ResourceVersion: peers.ResourceVersion})
+	require.NoError(t, err)
+	defer w.Stop()
+	// a no longer matches the selector, so it's delivered as a delete.
+	e := <-w.ResultChan()
+	require.Equal(t, watch.Deleted, e.Type)
+	require.Equal(t, "a", e.Object.(*wgk8s.WireGuardPeer).GetName())
+	e = <-w.ResultChan()
+	require.Equal(t, watch.Added, e.Type)
+	require.Equal(t, "b", e.Object.(*wgk8s.WireGuardPeer).GetName())
+
+	require.NoError(t, m.Delete("b", ""))
+	e = <-w.ResultChan()
+	require.Equal(t, watch.Deleted, e.Type)
+	require.Equal(t, "b", e.Object.(*wgk8s.WireGuardPeer).GetName())
+
+	// Versions from another instance, ex. before a restart, must relist.
+	_, err = lw.Watch(metav1.ListOptions{ResourceVersion: "1000"})
+	require.True(t, k8sErrors.IsResourceExpired(err), "got %v", err)
+}
+
+func TestMemoryUpdateConflict(t *testing.T) {
+	m, err := NewMemory("ns")
+	require.NoError(t, err)
+	created, err := m.Register(&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "a"}})
+	require.NoError(t, err)
+	require.Equal(t, "ns", created.GetNamespace())
+	require.NotEmpty(t, created.GetUID())
+	require.Equal(t, "/apis/wgmesh.codybaker.com/v1alpha1/namespaces/ns/wireguardpeers/a", created.GetSelfLink())
+
+	updated, err := m.Update(created)
+	require.NoError(t, err)
+	require.NotEqual(t, created.GetResourceVersion(), updated.GetResourceVersion())
+	_, err = m.Update(created)
+	require.True(t, k8sErrors.IsConflict(err), "got %v", err)
+	_, err = m.Update(&wgk8s.WireGuardPeer{ObjectMeta: metav1.ObjectMeta{Name: "missing"}})
+	require.True(t, k8sErrors.IsNotFound(err), "got %v", err)
+}
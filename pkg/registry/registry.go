@@ -0,0 +1,50 @@
+// Package registry stores the records peers use to find each other: WireGuardPeers, Meshes, and
+// the IPClaims which allocate addresses from IPPools.
+package registry
+
+import (
+	"net"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Registry is a backend which stores the records of a single mesh namespace. Errors are classified
+// with k8s.io/apimachinery/pkg/api/errors, so callers can test for NotFound, AlreadyExists, and
+// Conflict regardless of the backend.
+type Registry interface {
+	// Register creates a WireGuardPeer record, returning it as stored.
+	Register(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error)
+	// Get returns the named WireGuardPeer.
+	Get(name string) (*wgk8s.WireGuardPeer, error)
+	// Update replaces a WireGuardPeer, including its status. It fails with a Conflict if the record
+	// changed since it was read.
+	Update(peer *wgk8s.WireGuardPeer) (*wgk8s.WireGuardPeer, error)
+	// Delete removes the named WireGuardPeer if its UID matches.
+	Delete(name string, uid types.UID) error
+	// WatchPeers lists and watches WireGuardPeers. Nil selectors match everything.
+	WatchPeers(labelSelector labels.Selector, fieldSelector fields.Selector) cache.ListerWatcher
+	// WatchMeshes lists and watches Meshes.
+	WatchMeshes() cache.ListerWatcher
+	// WatchPolicies lists and watches WireGuardMeshPolicies.
+	WatchPolicies() cache.ListerWatcher
+	// IPAM returns an allocator for addresses in the registry's IPPools. If leaseDuration is
+	// non-zero, claims expire unless renewed.
+	IPAM(leaseDuration time.Duration) IPAM
+}
+
+// IPAM claims addresses from IPPools on behalf of an owner.
+type IPAM interface {
+	// ClaimIPs ensures the owner holds counts[family] addresses of each requested family from the
+	// pool, plus each of the static addresses, returning the addresses held.
+	ClaimIPs(pool string, owner *metav1.OwnerReference, counts map[IPFamily]int, static []net.IP) ([]*net.IPNet, error)
+	// ReleaseIPs releases the owner's claims in the pool, or in every pool if pool is empty.
+	ReleaseIPs(pool string, owner *metav1.OwnerReference) error
+	// RenewLeases extends the owner's claims on addrs, returning those which were lost.
+	RenewLeases(pool string, owner *metav1.OwnerReference, addrs []*net.IPNet) ([]*net.IPNet, error)
+}
@@ -0,0 +1,96 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// queueSize is how many reports may be waiting to be sent before further reports are dropped.
+const queueSize = 100
+
+// HTTP posts each report as JSON to a URL, ex. an error tracking service's ingestion endpoint, or a
+// relay to one. Reports are sent in the background; those arriving faster than they can be sent are
+// dropped, rather than slowing the caller.
+type HTTP struct {
+	url    string
+	client *http.Client
+	host   string
+
+	queue   chan Report
+	pending sync.WaitGroup
+}
+
+var _ Reporter = (*HTTP)(nil)
+
+// NewHTTP returns a Reporter which posts reports to the URL. Reports are labeled with the hostname.
+func NewHTTP(url string, client *http.Client) *HTTP {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	host, _ := os.Hostname()
+	h := &HTTP{
+		url:    url,
+		client: client,
+		host:   host,
+		queue:  make(chan Report, queueSize),
+	}
+	go h.run()
+	return h
+}
+
+// Report queues the report to be sent, or drops it if the queue is full.
+func (h *HTTP) Report(r Report) {
+	if r.Host == "" {
+		r.Host = h.host
+	}
+	h.pending.Add(1)
+	select {
+	case h.queue <- r:
+	default:
+		h.pending.Done()
+	}
+}
+
+// Flush waits up to the timeout for queued reports to be sent.
+func (h *HTTP) Flush(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		h.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+func (h *HTTP) run() {
+	for r := range h.queue {
+		if err := h.send(r); err != nil {
+			// Not logged, since errors are reported; that could loop.
+			fmt.Fprintf(os.Stderr, "failed to send error report: %v\n", err)
+		}
+		h.pending.Done()
+	}
+}
+
+func (h *HTTP) send(r Report) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
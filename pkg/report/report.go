@@ -0,0 +1,140 @@
+// Package report forwards unexpected errors and panics to an error reporting service, so that
+// operators of a large fleet of agents needn't search their logs for them.
+package report
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// Report describes an unexpected error or panic.
+type Report struct {
+	Time    time.Time         `json:"time"`
+	Host    string            `json:"host,omitempty"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Error   string            `json:"error,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	// Stack is the stack of the panicking goroutine.
+	Stack string `json:"stack,omitempty"`
+}
+
+// Reporter forwards reports, ex. to an error tracking service. Report must not block.
+type Reporter interface {
+	Report(r Report)
+	// Flush waits up to the timeout for pending reports to be delivered.
+	Flush(timeout time.Duration)
+}
+
+// flushTimeout is how long we wait for pending reports to be delivered before crashing.
+const flushTimeout = 5 * time.Second
+
+// repeatInterval is how long repeats of a logged error are suppressed, so an error which recurs
+// each time a loop runs isn't reported from every agent every few seconds.
+const repeatInterval = 10 * time.Minute
+
+var (
+	installedLock sync.Mutex
+	installed     Reporter
+)
+
+// Install reports the errors logged by the standard logger, and panics in goroutines which handle
+// crashes with Kubernetes' runtime.HandleCrash, including every wait.Until loop and informer.
+// Panics on the main goroutine are reported by deferring Recover.
+func Install(r Reporter) {
+	installedLock.Lock()
+	installed = r
+	installedLock.Unlock()
+	logrus.AddHook(&hook{reporter: r, now: time.Now, reported: make(map[string]time.Time)})
+	logrus.RegisterExitHandler(func() { r.Flush(flushTimeout) })
+	utilruntime.PanicHandlers = append(utilruntime.PanicHandlers, func(p interface{}) {
+		r.Report(panicReport(p))
+		r.Flush(flushTimeout)
+	})
+}
+
+// Recover reports a panic to the installed Reporter, then continues panicking. It must be deferred
+// directly, ex. defer report.Recover().
+func Recover() {
+	p := recover()
+	if p == nil {
+		return
+	}
+	installedLock.Lock()
+	r := installed
+	installedLock.Unlock()
+	if r != nil {
+		r.Report(panicReport(p))
+		r.Flush(flushTimeout)
+	}
+	panic(p)
+}
+
+func panicReport(p interface{}) Report {
+	return Report{
+		Time:    time.Now(),
+		Level:   logrus.PanicLevel.String(),
+		Message: fmt.Sprintf("panic: %v", p),
+		Stack:   string(debug.Stack()),
+	}
+}
+
+// hook reports entries logged at error level or above.
+type hook struct {
+	reporter Reporter
+	now      func() time.Time
+
+	lock sync.Mutex
+	// reported holds when each message and error was last reported.
+	reported map[string]time.Time
+}
+
+func (h *hook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (h *hook) Fire(entry *logrus.Entry) error {
+	r := Report{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	}
+	for k, v := range entry.Data {
+		if err, ok := v.(error); ok && k == logrus.ErrorKey {
+			r.Error = err.Error()
+			continue
+		}
+		if r.Fields == nil {
+			r.Fields = make(map[string]string, len(entry.Data))
+		}
+		r.Fields[k] = fmt.Sprint(v)
+	}
+	if entry.Level == logrus.ErrorLevel && h.repeated(r.Message+"\x00"+r.Error) {
+		return nil
+	}
+	h.reporter.Report(r)
+	return nil
+}
+
+// repeated returns true if the key was reported within the repeat interval, and otherwise records
+// that it's being reported.
+func (h *hook) repeated(key string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := h.now()
+	if last, ok := h.reported[key]; ok && now.Sub(last) < repeatInterval {
+		return true
+	}
+	for k, last := range h.reported {
+		if now.Sub(last) >= repeatInterval {
+			delete(h.reported, k)
+		}
+	}
+	h.reported[key] = now
+	return false
+}
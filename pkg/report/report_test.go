@@ -0,0 +1,82 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeReporter struct {
+	sync.Mutex
+	reports []Report
+}
+
+func (f *fakeReporter) Report(r Report) {
+	f.Lock()
+	defer f.Unlock()
+	f.reports = append(f.reports, r)
+}
+
+func (f *fakeReporter) Flush(time.Duration) {}
+
+func TestHook(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	f := &fakeReporter{}
+	ll := logrus.New()
+	ll.Out = ioutil.Discard
+	ll.AddHook(&hook{reporter: f, now: func() time.Time { return now }, reported: make(map[string]time.Time)})
+
+	failed := ll.WithError(errors.New("connection refused")).WithField("k8s_name", "a")
+	failed.Error("failed to publish observed endpoints")
+	ll.Warn("not reported")
+	// Repeats are suppressed for the repeat interval.
+	now = now.Add(repeatInterval - time.Second)
+	failed.Error("failed to publish observed endpoints")
+	ll.Error("another error")
+	now = now.Add(time.Second)
+	failed.Error("failed to publish observed endpoints")
+
+	require.Len(t, f.reports, 3)
+	require.Equal(t, Report{
+		Time:    f.reports[0].Time,
+		Level:   "error",
+		Message: "failed to publish observed endpoints",
+		Error:   "connection refused",
+		Fields:  map[string]string{"k8s_name": "a"},
+	}, f.reports[0])
+	require.Equal(t, "another error", f.reports[1].Message)
+	require.Equal(t, f.reports[0].Message, f.reports[2].Message)
+}
+
+func TestHTTP(t *testing.T) {
+	var lock sync.Mutex
+	var received []Report
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report Report
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&report))
+		lock.Lock()
+		received = append(received, report)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	h := NewHTTP(srv.URL, nil)
+	h.host = "node-a"
+	h.Report(Report{Level: "error", Message: "first"})
+	h.Report(Report{Level: "panic", Message: "second", Host: "other"})
+	h.Flush(5 * time.Second)
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, []Report{
+		{Level: "error", Message: "first", Host: "node-a"},
+		{Level: "panic", Message: "second", Host: "other"},
+	}, received)
+}
@@ -0,0 +1,211 @@
+// Package routingd exports mesh routes to a routing daemon already running on the host, BIRD or
+// FRR, as static routes via the WireGuard interface, which the daemon can redistribute to its
+// protocols.
+package routingd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Supported daemons.
+const (
+	BIRD = "bird"
+	FRR  = "frr"
+)
+
+// DefaultBIRDConfig is where BIRD's routes are written by default; include it from bird.conf.
+const DefaultBIRDConfig = "/etc/bird/wgmesh.conf"
+
+// Daemon holds the mesh routes in a routing daemon.
+type Daemon interface {
+	// Sync makes the daemon's mesh routes match the routes, which must be CIDRs.
+	Sync(routes []string) error
+	// Remove withdraws the mesh routes.
+	Remove() error
+}
+
+// New returns the daemon of the kind, holding routes via the interface. birdConfig is where BIRD's
+// routes are written, or DefaultBIRDConfig if empty.
+func New(kind, iface, birdConfig string) (Daemon, error) {
+	run := func(cmd string, args ...string) ([]byte, error) {
+		return exec.Command(cmd, args...).CombinedOutput()
+	}
+	switch kind {
+	case BIRD:
+		if birdConfig == "" {
+			birdConfig = DefaultBIRDConfig
+		}
+		return &bird{iface: iface, path: birdConfig, run: run}, nil
+	case FRR:
+		return &frr{iface: iface, run: run}, nil
+	default:
+		return nil, fmt.Errorf("unsupported routing daemon %q", kind)
+	}
+}
+
+func command(run func(cmd string, args ...string) ([]byte, error), cmd string, args ...string) error {
+	out, err := run(cmd, args...)
+	if err != nil {
+		return fmt.Errorf("running %s %s: %w: %s", cmd, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// split returns the routes by family, sorted.
+func split(routes []string) (v4, v6 []string, err error) {
+	for _, r := range routes {
+		ip, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("exporting route %q: %w", r, err)
+		}
+		if ip.To4() != nil {
+			v4 = append(v4, n.String())
+		} else {
+			v6 = append(v6, n.String())
+		}
+	}
+	sort.Strings(v4)
+	sort.Strings(v6)
+	return v4, v6, nil
+}
+
+// bird writes the routes to a config file as static protocols, wgmesh4 and wgmesh6, and asks BIRD
+// to reload it.
+type bird struct {
+	iface string
+	path  string
+	run   func(cmd string, args ...string) ([]byte, error)
+	// written is the config last written, or nil.
+	written []byte
+}
+
+func (b *bird) config(v4, v6 []string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by wgmesh; routes reached through %s.\n", b.iface)
+	for _, p := range []struct {
+		name, channel string
+		routes        []string
+	}{{"wgmesh4", "ipv4", v4}, {"wgmesh6", "ipv6", v6}} {
+		fmt.Fprintf(&buf, "protocol static %s {\n\t%s;\n", p.name, p.channel)
+		for _, r := range p.routes {
+			fmt.Fprintf(&buf, "\troute %s via %q;\n", r, b.iface)
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.Bytes()
+}
+
+func (b *bird) Sync(routes []string) error {
+	v4, v6, err := split(routes)
+	if err != nil {
+		return err
+	}
+	return b.write(b.config(v4, v6))
+}
+
+// Remove leaves the protocols empty, rather than removing the file, so bird.conf's include of it
+// still resolves.
+func (b *bird) Remove() error {
+	if b.written == nil {
+		return nil
+	}
+	return b.write(b.config(nil, nil))
+}
+
+func (b *bird) write(config []byte) error {
+	if bytes.Equal(config, b.written) {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), "."+filepath.Base(b.path))
+	if err != nil {
+		return fmt.Errorf("writing bird config: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(config)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), b.path)
+	}
+	if err != nil {
+		return fmt.Errorf("writing bird config: %w", err)
+	}
+	if err := command(b.run, "birdc", "configure"); err != nil {
+		return err
+	}
+	b.written = config
+	return nil
+}
+
+// frr adds and removes static routes in FRR's running config with vtysh.
+type frr struct {
+	iface string
+	run   func(cmd string, args ...string) ([]byte, error)
+	// installed holds the routes currently in the running config.
+	installed map[string]bool
+}
+
+func (f *frr) Sync(routes []string) error {
+	v4, v6, err := split(routes)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]bool, len(routes))
+	var commands []string
+	for _, r := range append(v4, v6...) {
+		want[r] = true
+		if !f.installed[r] {
+			commands = append(commands, f.route(r))
+		}
+	}
+	var removed []string
+	for r := range f.installed {
+		if !want[r] {
+			removed = append(removed, r)
+		}
+	}
+	sort.Strings(removed)
+	for _, r := range removed {
+		commands = append(commands, "no "+f.route(r))
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	if err := f.vtysh(commands); err != nil {
+		return err
+	}
+	f.installed = want
+	return nil
+}
+
+func (f *frr) Remove() error {
+	return f.Sync(nil)
+}
+
+// route returns the static route command for the route, which must be a normalized CIDR.
+func (f *frr) route(r string) string {
+	if strings.Contains(r, ":") {
+		return fmt.Sprintf("ipv6 route %s %s", r, f.iface)
+	}
+	return fmt.Sprintf("ip route %s %s", r, f.iface)
+}
+
+func (f *frr) vtysh(commands []string) error {
+	args := []string{"-c", "configure terminal"}
+	for _, c := range commands {
+		args = append(args, "-c", c)
+	}
+	return command(f.run, "vtysh", args...)
+}
@@ -0,0 +1,95 @@
+package routingd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBIRD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routingd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wgmesh.conf")
+	var calls []string
+	fail := false
+	b := &bird{iface: "wg0", path: path, run: func(cmd string, args ...string) ([]byte, error) {
+		calls = append(calls, cmd+" "+strings.Join(args, " "))
+		if fail {
+			return []byte("syntax error\n"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}}
+	read := func() string {
+		config, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		return string(config)
+	}
+
+	require.NoError(t, b.Remove(), "nothing to remove before the first sync")
+	require.NoError(t, b.Sync([]string{"10.10.0.3/32", "fd00::2/128", "10.10.0.2/32"}))
+	require.Equal(t, `# Generated by wgmesh; routes reached through wg0.
+protocol static wgmesh4 {
+	ipv4;
+	route 10.10.0.2/32 via "wg0";
+	route 10.10.0.3/32 via "wg0";
+}
+protocol static wgmesh6 {
+	ipv6;
+	route fd00::2/128 via "wg0";
+}
+`, read())
+	require.Equal(t, []string{"birdc configure"}, calls)
+
+	require.NoError(t, b.Sync([]string{"10.10.0.2/32", "10.10.0.3/32", "fd00::2/128"}))
+	require.Len(t, calls, 1, "unchanged routes don't reload bird")
+
+	fail = true
+	require.EqualError(t, b.Sync(nil), "running birdc configure: exit status 1: syntax error")
+	fail = false
+	require.NoError(t, b.Remove())
+	require.Equal(t, `# Generated by wgmesh; routes reached through wg0.
+protocol static wgmesh4 {
+	ipv4;
+}
+protocol static wgmesh6 {
+	ipv6;
+}
+`, read())
+	require.Len(t, calls, 3)
+}
+
+func TestFRR(t *testing.T) {
+	var calls []string
+	f := &frr{iface: "wg0", run: func(cmd string, args ...string) ([]byte, error) {
+		calls = append(calls, cmd+" "+strings.Join(args, " "))
+		return nil, nil
+	}}
+
+	require.NoError(t, f.Sync([]string{"10.10.0.2/32", "fd00::2/128"}))
+	require.NoError(t, f.Sync([]string{"10.10.0.2/32", "10.10.0.3/32"}))
+	require.NoError(t, f.Sync([]string{"10.10.0.2/32", "10.10.0.3/32"}))
+	require.NoError(t, f.Remove())
+	require.Equal(t, []string{
+		`vtysh -c configure terminal -c ip route 10.10.0.2/32 wg0 -c ipv6 route fd00::2/128 wg0`,
+		`vtysh -c configure terminal -c ip route 10.10.0.3/32 wg0 -c no ipv6 route fd00::2/128 wg0`,
+		`vtysh -c configure terminal -c no ip route 10.10.0.2/32 wg0 -c no ip route 10.10.0.3/32 wg0`,
+	}, calls)
+
+	require.Error(t, f.Sync([]string{"10.10.0.2"}))
+}
+
+func TestNew(t *testing.T) {
+	d, err := New(BIRD, "wg0", "")
+	require.NoError(t, err)
+	require.Equal(t, DefaultBIRDConfig, d.(*bird).path)
+	_, err = New(FRR, "wg0", "")
+	require.NoError(t, err)
+	_, err = New("quagga", "wg0", "")
+	require.EqualError(t, err, `unsupported routing daemon "quagga"`)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// authReloadInterval is how often the auth file is checked for changes.
+const authReloadInterval = 10 * time.Second
+
+// Identity is a client of the server, authenticated by a bearer token or a verified TLS client
+// certificate, and what it may change. Every identity may read the registry, since agents watch
+// every peer.
+type Identity struct {
+	Name string `json:"name"`
+	// Tokens are bearer tokens which authenticate as the identity. List the old and new tokens
+	// while rotating one.
+	Tokens []string `json:"tokens,omitempty"`
+	// CommonNames are the subject common names of client certificates, signed by the server's
+	// client CA, which authenticate as the identity.
+	CommonNames []string `json:"commonNames,omitempty"`
+	// Admin grants full access.
+	Admin bool `json:"admin,omitempty"`
+	// Peers are patterns, as in path.Match, of the WireGuardPeer names the identity may register,
+	// update, and delete, and claim addresses for.
+	Peers []string `json:"peers,omitempty"`
+	// Pools are patterns of the IPPools the identity may claim addresses from.
+	Pools []string `json:"pools,omitempty"`
+}
+
+// Policy lists the identities accepted by the server.
+type Policy struct {
+	Identities []Identity `json:"identities"`
+}
+
+// ReadPolicy reads a Policy from a YAML file.
+func ReadPolicy(file string) (*Policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(b, p); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", file, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("%q: %w", file, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, id := range p.Identities {
+		if id.Name == "" {
+			return fmt.Errorf("identities must have a name")
+		}
+		if names[id.Name] {
+			return fmt.Errorf("identity %q is listed twice", id.Name)
+		}
+		names[id.Name] = true
+		if len(id.Tokens) == 0 && len(id.CommonNames) == 0 {
+			return fmt.Errorf("identity %q has no tokens or commonNames", id.Name)
+		}
+		for _, t := range id.Tokens {
+			if t == "" {
+				return fmt.Errorf("identity %q: tokens may not be empty", id.Name)
+			}
+			if tokens[t] {
+				return fmt.Errorf("identity %q: token is shared with another identity", id.Name)
+			}
+			tokens[t] = true
+		}
+		for _, pattern := range append(append([]string(nil), id.Peers...), id.Pools...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("identity %q: pattern %q: %w", id.Name, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// authenticate returns the identity the request authenticates as, or nil. Tokens are checked
+// before client certificates.
+func (p *Policy) authenticate(r *http.Request) *Identity {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		got := []byte(strings.TrimPrefix(auth, "Bearer "))
+		var match *Identity
+		for i := range p.Identities {
+			for _, t := range p.Identities[i].Tokens {
+				// Check every token so timing doesn't reveal which matched.
+				if subtle.ConstantTimeCompare(got, []byte(t)) == 1 {
+					match = &p.Identities[i]
+				}
+			}
+		}
+		return match
+	}
+	// Only certificates verified against the client CA have chains.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for i := range p.Identities {
+		for _, name := range p.Identities[i].CommonNames {
+			if name == cn {
+				return &p.Identities[i]
+			}
+		}
+	}
+	return nil
+}
+
+// mayChangePeer returns true if the identity may change the named peer.
+func (id *Identity) mayChangePeer(name string) bool {
+	return id.Admin || matchAny(id.Peers, name)
+}
+
+// mayClaimFrom returns true if the identity may claim addresses from the named pool.
+func (id *Identity) mayClaimFrom(pool string) bool {
+	return id.Admin || matchAny(id.Pools, pool)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// forbidden returns the error for an identity changing a resource it may not.
+func forbidden(id *Identity, resource, name string) error {
+	return k8sErrors.NewForbidden(schema.GroupResource{Group: wgk8s.GroupName, Resource: resource}, name,
+		fmt.Errorf("identity %q may not change it", id.Name))
+}
+
+// policy returns the current policy.
+func (s *Server) policy() *Policy {
+	s.policyLock.Lock()
+	defer s.policyLock.Unlock()
+	return s.currentPolicy
+}
+
+// loadPolicy builds the policy from the tokens and the auth file, if it changed since it was last
+// read. If the file is invalid, the current policy is kept.
+func (s *Server) loadPolicy() error {
+	p := &Policy{}
+	if len(s.tokens) > 0 {
+		p.Identities = append(p.Identities, Identity{Name: tokensIdentity, Tokens: s.tokens, Admin: true})
+	}
+	if s.authFile != "" {
+		info, err := os.Stat(s.authFile)
+		if err != nil {
+			return fmt.Errorf("reading auth file: %w", err)
+		}
+		if s.currentPolicy != nil && info.ModTime().Equal(s.authModTime) {
+			return nil
+		}
+		file, err := ReadPolicy(s.authFile)
+		if err != nil {
+			return fmt.Errorf("reading auth file: %w", err)
+		}
+		p.Identities = append(p.Identities, file.Identities...)
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("reading auth file: %w", err)
+		}
+		s.authModTime = info.ModTime()
+	}
+	s.policyLock.Lock()
+	reload := s.currentPolicy != nil
+	s.currentPolicy = p
+	s.policyLock.Unlock()
+	if reload {
+		s.ll.WithField("identities", len(p.Identities)).Infoln("reloaded auth file")
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "auth.yaml")
+	for _, tc := range []struct {
+		name, yaml, expectError string
+	}{{
+		name: "valid",
+		yaml: `
+identities:
+- name: edge
+  tokens: [edge-token]
+  commonNames: [edge.example.com]
+  peers: ["edge-*"]
+  pools: [edge]
+- name: admin
+  tokens: [admin-token]
+  admin: true
+`,
+	}, {
+		name:        "unknown field",
+		yaml:        "identities:\n- name: edge\n  token: edge-token\n",
+		expectError: `error unmarshaling JSON: while decoding JSON: json: unknown field "token"`,
+	}, {
+		name:        "no credentials",
+		yaml:        "identities:\n- name: edge\n  peers: [edge]\n",
+		expectError: `identity "edge" has no tokens or commonNames`,
+	}, {
+		name:        "duplicate",
+		yaml:        "identities:\n- name: edge\n  tokens: [a]\n- name: edge\n  tokens: [b]\n",
+		expectError: `identity "edge" is listed twice`,
+	}, {
+		name:        "shared token",
+		yaml:        "identities:\n- name: a\n  tokens: [t]\n- name: b\n  tokens: [t]\n",
+		expectError: `identity "b": token is shared with another identity`,
+	}, {
+		name:        "bad pattern",
+		yaml:        "identities:\n- name: a\n  tokens: [t]\n  peers: [\"[\"]\n",
+		expectError: `identity "a": pattern "[": syntax error in pattern`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, ioutil.WriteFile(file, []byte(tc.yaml), 0600))
+			p, err := ReadPolicy(file)
+			if tc.expectError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, p.Identities, 2)
+		})
+	}
+}
+
+func TestServerAuthorization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "auth.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+identities:
+- name: edge
+  tokens: [edge-token]
+  peers: ["edge-*"]
+  pools: [edge]
+`), 0600))
+
+	store, err := registry.NewMemory("mesh",
+		&wgk8s.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "edge"},
+			Spec:       wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/29"}}},
+		},
+		&wgk8s.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "core"},
+			Spec:       wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.1.0.0/29"}}},
+		})
+	require.NoError(t, err)
+	s, err := NewServer(WithLogger(logrus.New()), WithRegistry(store), WithTokens([]string{"admin-token"}), WithAuthFile(file))
+	require.NoError(t, err)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	edge := registry.NewHTTP(ts.URL, "edge-token", nil)
+	admin := registry.NewHTTP(ts.URL, "admin-token", nil)
+
+	peer := func(name string) *wgk8s.WireGuardPeer {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.NoError(t, err)
+		return &wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       wgk8s.WireGuardPeerSpec{PublicKey: key.PublicKey().String(), Endpoint: "192.0.2.1:51820"},
+		}
+	}
+	edge1, err := edge.Register(peer("edge-1"))
+	require.NoError(t, err)
+	_, err = edge.Register(peer("core-1"))
+	require.True(t, k8sErrors.IsForbidden(err), "got %v", err)
+	core1, err := admin.Register(peer("core-1"))
+	require.NoError(t, err)
+
+	_, err = edge.Get("core-1")
+	require.NoError(t, err, "every identity may read")
+	_, err = edge.Update(core1)
+	require.True(t, k8sErrors.IsForbidden(err), "got %v", err)
+	require.True(t, k8sErrors.IsForbidden(edge.Delete("core-1", core1.GetUID())))
+
+	owner := &metav1.OwnerReference{Kind: "WireGuardPeer", Name: "edge-1", UID: edge1.GetUID()}
+	ipam := edge.IPAM(time.Minute)
+	_, err = ipam.ClaimIPs("edge", owner, map[registry.IPFamily]int{registry.IPFamilyAny: 1}, nil)
+	require.NoError(t, err)
+	_, err = ipam.ClaimIPs("core", owner, map[registry.IPFamily]int{registry.IPFamilyAny: 1}, nil)
+	require.True(t, k8sErrors.IsForbidden(err), "got %v", err)
+	coreOwner := &metav1.OwnerReference{Kind: "WireGuardPeer", Name: "core-1", UID: core1.GetUID()}
+	require.True(t, k8sErrors.IsForbidden(ipam.ReleaseIPs("", coreOwner)))
+	require.NoError(t, ipam.ReleaseIPs("", owner))
+
+	// Rotating the token: the new one is accepted once the file is reloaded.
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+identities:
+- name: edge
+  tokens: [edge-token-2]
+  peers: ["edge-*"]
+`), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, later, later))
+	require.NoError(t, s.loadPolicy())
+	_, err = edge.Get("edge-1")
+	require.True(t, k8sErrors.IsUnauthorized(err), "got %v", err)
+	_, err = registry.NewHTTP(ts.URL, "edge-token-2", nil).Get("edge-1")
+	require.NoError(t, err)
+
+	// An invalid file keeps the current identities.
+	require.NoError(t, ioutil.WriteFile(file, []byte("identities: [{name: edge}]"), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, later, later))
+	require.Error(t, s.loadPolicy())
+	_, err = registry.NewHTTP(ts.URL, "edge-token-2", nil).Get("edge-1")
+	require.NoError(t, err)
+}
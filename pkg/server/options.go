@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	log "github.com/sirupsen/logrus"
+)
+
+type options struct {
+	ll log.FieldLogger
+
+	listenAddr string
+	certFile   string
+	keyFile    string
+	tokens     []string
+	// authFile, if set, is a Policy of the identities accepted, reloaded when it changes.
+	authFile string
+	// clientCAFile, if set, verifies client certificates, which authenticate identities by their
+	// common name.
+	clientCAFile string
+	registry     registry.Registry
+}
+
+func defaultOptions() options {
+	return options{
+		ll:         log.New(),
+		listenAddr: ":8443",
+	}
+}
+
+// OptionFunc describes the function signature for methods which modify the server options.
+type OptionFunc func(*options) error
+
+// WithLogger sets a logger on the server options.
+func WithLogger(ll log.FieldLogger) OptionFunc {
+	return func(o *options) error {
+		o.ll = ll
+		return nil
+	}
+}
+
+// WithListenAddr sets the address where the server listens for requests.
+func WithListenAddr(addr string) OptionFunc {
+	return func(o *options) error {
+		o.listenAddr = addr
+		return nil
+	}
+}
+
+// WithTLSFiles sets the certificate and key served by the server. Without them, the server speaks
+// plain HTTP and tokens are sent in the clear.
+func WithTLSFiles(certFile, keyFile string) OptionFunc {
+	return func(o *options) error {
+		o.certFile = certFile
+		o.keyFile = keyFile
+		return nil
+	}
+}
+
+// WithTokens sets bearer tokens accepted from clients, alongside the auth file's identities. Every
+// token grants full access.
+func WithTokens(tokens []string) OptionFunc {
+	return func(o *options) error {
+		for _, t := range tokens {
+			if t == "" {
+				return fmt.Errorf("tokens may not be empty")
+			}
+		}
+		o.tokens = tokens
+		return nil
+	}
+}
+
+// WithAuthFile sets a YAML Policy file of the identities accepted from clients, and which peers and
+// pools each may change. The file is reloaded when it changes, so tokens can be rotated.
+func WithAuthFile(path string) OptionFunc {
+	return func(o *options) error {
+		o.authFile = path
+		return nil
+	}
+}
+
+// WithClientCAFile sets PEM certificates which verify client certificates. Clients presenting a
+// verified certificate authenticate as the identity listing its common name. The file is reloaded
+// when it changes. It requires TLS.
+func WithClientCAFile(path string) OptionFunc {
+	return func(o *options) error {
+		o.clientCAFile = path
+		return nil
+	}
+}
+
+// WithRegistry sets the store which holds the served records.
+func WithRegistry(r registry.Registry) OptionFunc {
+	return func(o *options) error {
+		o.registry = r
+		return nil
+	}
+}
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/jcodybaker/wgmesh/pkg/webhook"
+	log "github.com/sirupsen/logrus"
+
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	shutdownTimeout = 5 * time.Second
+	maxRequestBytes = 1 << 20
+	// tokensIdentity names the identity of the tokens set with WithTokens.
+	tokensIdentity = "tokens"
+)
+
+// Server exposes a Registry over HTTP, so agents without Kubernetes credentials can register and
+// discover peers. Clients use registry.NewHTTP.
+type Server struct {
+	options
+
+	// policyLock guards the policy, which is replaced as the auth file changes.
+	policyLock    sync.Mutex
+	currentPolicy *Policy
+	authModTime   time.Time
+}
+
+type identityKey struct{}
+
+// NewServer creates a registry server.
+func NewServer(optionFuncs ...OptionFunc) (*Server, error) {
+	s := &Server{
+		options: defaultOptions(),
+	}
+	for _, f := range optionFuncs {
+		err := f(&s.options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.registry == nil {
+		return nil, fmt.Errorf("a registry backend is required")
+	}
+	if len(s.tokens) == 0 && s.authFile == "" {
+		return nil, fmt.Errorf("tokens or an auth file are required")
+	}
+	if s.clientCAFile != "" && s.certFile == "" {
+		return nil, fmt.Errorf("a client CA requires TLS")
+	}
+	if err := s.loadPolicy(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run serves requests until the context is canceled.
+func (s *Server) Run(ctx context.Context) error {
+	srv := &http.Server{Addr: s.listenAddr, Handler: s.Handler()}
+	if s.certFile != "" {
+		config, err := s.tlsConfig()
+		if err != nil {
+			return fmt.Errorf("serving registry: %w", err)
+		}
+		srv.TLSConfig = config
+	}
+	if s.authFile != "" {
+		go wait.Until(func() {
+			if err := s.loadPolicy(); err != nil {
+				s.ll.WithError(err).Errorln("failed to reload auth file; keeping the current identities")
+			}
+		}, authReloadInterval, ctx.Done())
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		ll := s.ll.WithField("listen_addr", s.listenAddr)
+		if s.certFile == "" {
+			ll.Warnln("serving registry without TLS; tokens are sent in the clear")
+			errCh <- srv.ListenAndServe()
+			return
+		}
+		ll.Infoln("serving registry")
+		// The key pair is served by the TLS config, which reloads it as it changes.
+		errCh <- srv.ListenAndServeTLS("", "")
+	}()
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("serving registry: %w", err)
+	case <-ctx.Done():
+	}
+	sCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(sCtx)
+}
+
+// Handler returns the server's authenticated HTTP handler.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(registry.PeersPath, s.handlePeers)
+	mux.HandleFunc(registry.PeersPath+"/", s.handlePeer)
+	mux.HandleFunc(registry.MeshesPath, s.handleMeshes)
+	mux.HandleFunc(registry.PoliciesPath, s.handlePolicies)
+	mux.HandleFunc(registry.ClaimIPsPath, s.handleIPAM)
+	mux.HandleFunc(registry.ReleaseIPsPath, s.handleIPAM)
+	mux.HandleFunc(registry.RenewLeasesPath, s.handleIPAM)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := s.policy().authenticate(r)
+		if id == nil {
+			s.ll.WithField("remote_addr", r.RemoteAddr).Warnln("rejecting unauthenticated request")
+			writeError(w, k8sErrors.NewUnauthorized("a valid bearer token or client certificate is required"))
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// identity returns the identity the request authenticated as.
+func identity(r *http.Request) *Identity {
+	return r.Context().Value(identityKey{}).(*Identity)
+}
+
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		labelSelector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			writeError(w, k8sErrors.NewBadRequest(fmt.Sprintf("invalid labelSelector: %v", err)))
+			return
+		}
+		fieldSelector, err := fields.ParseSelector(r.URL.Query().Get("fieldSelector"))
+		if err != nil {
+			writeError(w, k8sErrors.NewBadRequest(fmt.Sprintf("invalid fieldSelector: %v", err)))
+			return
+		}
+		s.listOrWatch(w, r, s.registry.WatchPeers(labelSelector, fieldSelector))
+	case http.MethodPost:
+		var peer wgk8s.WireGuardPeer
+		if !decode(w, r, &peer) || !validPeer(w, &peer) {
+			return
+		}
+		id := identity(r)
+		if !id.mayChangePeer(peer.GetName()) {
+			writeError(w, forbidden(id, "wireguardpeers", peer.GetName()))
+			return
+		}
+		wglog.WithPeer(s.ll, &peer).WithField("identity", id.Name).Infoln("registering peer")
+		created, err := s.registry.Register(&peer)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, created)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handlePeer(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, registry.PeersPath+"/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	id := identity(r)
+	ll := s.ll.WithFields(log.Fields{"k8s_name": name, "identity": id.Name})
+	if r.Method != http.MethodGet && !id.mayChangePeer(name) {
+		writeError(w, forbidden(id, "wireguardpeers", name))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		peer, err := s.registry.Get(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, peer)
+	case http.MethodPut:
+		var peer wgk8s.WireGuardPeer
+		if !decode(w, r, &peer) || !validPeer(w, &peer) {
+			return
+		}
+		if peer.GetName() != name {
+			writeError(w, k8sErrors.NewBadRequest("the name of the object does not match the name in the URL"))
+			return
+		}
+		ll.Debugln("updating peer")
+		updated, err := s.registry.Update(&peer)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		ll.Infoln("deleting peer")
+		err := s.registry.Delete(name, types.UID(r.URL.Query().Get("uid")))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleMeshes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.listOrWatch(w, r, s.registry.WatchMeshes())
+}
+
+func (s *Server) handlePolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.listOrWatch(w, r, s.registry.WatchPolicies())
+}
+
+func (s *Server) handleIPAM(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req registry.IPAMRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	id := identity(r)
+	ll := s.ll.WithFields(log.Fields{"ip_pool": req.Pool, "owner": req.Owner.Name, "identity": id.Name})
+	// Claims are owned by peers, so an identity may only manage the claims of peers it may change.
+	// Releasing without a pool releases the owner's claims from every pool.
+	if !id.mayChangePeer(req.Owner.Name) {
+		writeError(w, forbidden(id, "wireguardpeers", req.Owner.Name))
+		return
+	}
+	if r.URL.Path != registry.ReleaseIPsPath && !id.mayClaimFrom(req.Pool) {
+		writeError(w, forbidden(id, "ipclaims", req.Pool))
+		return
+	}
+	ipam := s.registry.IPAM(req.LeaseDuration.Duration)
+	var addrs []*net.IPNet
+	var err error
+	switch r.URL.Path {
+	case registry.ClaimIPsPath:
+		var static []net.IP
+		for _, addr := range req.Static {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				writeError(w, k8sErrors.NewBadRequest(fmt.Sprintf("invalid static ip %q", addr)))
+				return
+			}
+			static = append(static, ip)
+		}
+		ll.Infoln("claiming addresses")
+		addrs, err = ipam.ClaimIPs(req.Pool, &req.Owner, req.Counts, static)
+	case registry.ReleaseIPsPath:
+		ll.Infoln("releasing addresses")
+		err = ipam.ReleaseIPs(req.Pool, &req.Owner)
+	case registry.RenewLeasesPath:
+		addrs, err = registry.ParseAddrs(req.Addrs)
+		if err != nil {
+			writeError(w, k8sErrors.NewBadRequest(fmt.Sprintf("invalid addrs: %v", err)))
+			return
+		}
+		ll.Debugln("renewing leases")
+		addrs, err = ipam.RenewLeases(req.Pool, &req.Owner, addrs)
+	}
+	if err != nil {
+		ll.WithError(err).Warnln("ipam request failed")
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &registry.IPAMResponse{IPs: registry.FormatAddrs(addrs)})
+}
+
+// listOrWatch lists the records, or streams changes to them if the watch parameter is set.
+func (s *Server) listOrWatch(w http.ResponseWriter, r *http.Request, lw cache.ListerWatcher) {
+	query := r.URL.Query()
+	options := metav1.ListOptions{ResourceVersion: query.Get("resourceVersion")}
+	if query.Get("watch") != "true" {
+		list, err := lw.List(options)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	var timeout <-chan time.Time
+	if t := query.Get("timeoutSeconds"); t != "" {
+		seconds, err := strconv.ParseInt(t, 10, 64)
+		if err != nil || seconds < 0 {
+			writeError(w, k8sErrors.NewBadRequest(fmt.Sprintf("invalid timeoutSeconds %q", t)))
+			return
+		}
+		options.TimeoutSeconds = &seconds
+		timeout = time.After(time.Duration(seconds) * time.Second)
+	}
+	watcher, err := lw.Watch(options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer watcher.Stop()
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			return
+		case e, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			obj, err := json.Marshal(e.Object)
+			if err != nil {
+				s.ll.WithError(err).Error("failed to encode watch event")
+				return
+			}
+			if err := enc.Encode(&registry.WatchEvent{Type: e.Type, Object: obj}); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if e.Type == watch.Error {
+				return
+			}
+		}
+	}
+}
+
+// validPeer validates the peer as the admission webhook would, writing an error if it's invalid.
+func validPeer(w http.ResponseWriter, peer *wgk8s.WireGuardPeer) bool {
+	errs := webhook.ValidateWireGuardPeer(peer)
+	if len(errs) == 0 {
+		return true
+	}
+	writeError(w, k8sErrors.NewInvalid(
+		schema.GroupKind{Group: wgk8s.GroupName, Kind: "WireGuardPeer"}, peer.GetName(), errs))
+	return false
+}
+
+// decode reads a JSON request body into v, writing an error if it's invalid.
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		writeError(w, k8sErrors.NewBadRequest(fmt.Sprintf("invalid request body: %v", err)))
+		return false
+	}
+	return true
+}
+
+// writeError writes err as a metav1.Status, which clients convert back to an API error. Wrapped
+// API errors keep their classification.
+func writeError(w http.ResponseWriter, err error) {
+	var apiStatus k8sErrors.APIStatus
+	if !errors.As(err, &apiStatus) {
+		apiStatus = k8sErrors.NewInternalError(err)
+	}
+	status := apiStatus.Status()
+	status.Message = err.Error()
+	if status.Code == 0 {
+		status.Code = http.StatusInternalServerError
+	}
+	writeJSON(w, int(status.Code), &status)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestServer(t *testing.T) {
+	store, err := registry.NewMemory("mesh", &wgk8s.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec:       wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/29"}}},
+	})
+	require.NoError(t, err)
+	s, err := NewServer(WithLogger(logrus.New()), WithRegistry(store), WithTokens([]string{"secret"}))
+	require.NoError(t, err)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	client := registry.NewHTTP(ts.URL, "secret", nil)
+
+	_, err = registry.NewHTTP(ts.URL, "wrong", nil).Get("a")
+	require.True(t, k8sErrors.IsUnauthorized(err), "got %v", err)
+
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	peer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: map[string]string{"role": "gateway"}},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: key.PublicKey().String(), Endpoint: "192.0.2.1:51820"},
+	}
+
+	// Watches stream changes made after they start.
+	watcher, err := client.WatchPeers(labels.SelectorFromSet(labels.Set{"role": "gateway"}), nil).
+		Watch(metav1.ListOptions{})
+	require.NoError(t, err)
+	defer watcher.Stop()
+
+	created, err := client.Register(peer)
+	require.NoError(t, err)
+	require.NotEmpty(t, created.GetUID())
+	require.Equal(t, "mesh", created.GetNamespace())
+	_, err = client.Register(peer)
+	require.True(t, k8sErrors.IsAlreadyExists(err), "got %v", err)
+
+	select {
+	case e := <-watcher.ResultChan():
+		require.Equal(t, watch.Added, e.Type)
+		require.Equal(t, created.GetUID(), e.Object.(*wgk8s.WireGuardPeer).GetUID())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no watch event for registered peer")
+	}
+
+	invalid := created.DeepCopy()
+	invalid.Spec.PublicKey = "nope"
+	_, err = client.Update(invalid)
+	require.True(t, k8sErrors.IsInvalid(err), "got %v", err)
+
+	updated := created.DeepCopy()
+	updated.Spec.Endpoint = "192.0.2.2:51820"
+	_, err = client.Update(updated)
+	require.NoError(t, err)
+	// The record changed since `created` was read.
+	_, err = client.Update(created)
+	require.True(t, k8sErrors.IsConflict(err), "got %v", err)
+
+	list, err := client.WatchPeers(nil, nil).List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, list.(*wgk8s.WireGuardPeerList).Items, 1)
+
+	owner := &metav1.OwnerReference{Kind: "WireGuardPeer", Name: "a", UID: created.GetUID()}
+	ipam := client.IPAM(time.Minute)
+	claimed, err := ipam.ClaimIPs("pool", owner, map[registry.IPFamily]int{registry.IPFamilyAny: 2}, nil)
+	require.NoError(t, err)
+	require.Len(t, claimed, 2)
+	lost, err := ipam.RenewLeases("pool", owner, claimed)
+	require.NoError(t, err)
+	require.Empty(t, lost)
+	require.NoError(t, ipam.ReleaseIPs("", owner))
+	lost, err = ipam.RenewLeases("pool", owner, claimed)
+	require.NoError(t, err)
+	require.Len(t, lost, 2)
+	_, err = ipam.ClaimIPs("missing", owner, map[registry.IPFamily]int{registry.IPFamilyAny: 1}, nil)
+	require.True(t, k8sErrors.IsNotFound(err), "got %v", err)
+
+	require.True(t, k8sErrors.IsConflict(client.Delete("a", "other-uid")))
+	require.NoError(t, client.Delete("a", created.GetUID()))
+	_, err = client.Get("a")
+	require.True(t, k8sErrors.IsNotFound(err), "got %v", err)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyPairReloader serves a certificate and key from files, reading them again once either changes,
+// so they can be rotated without a restart.
+type KeyPairReloader struct {
+	certFile, keyFile string
+
+	lock     sync.Mutex
+	modTimes [2]time.Time
+	cert     *tls.Certificate
+}
+
+// NewKeyPairReloader returns a reloader for the PEM certificate and key files, failing if they can't
+// be loaded.
+func NewKeyPairReloader(certFile, keyFile string) (*KeyPairReloader, error) {
+	r := &KeyPairReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load returns the key pair, reading it again if the files changed. If they can't be read, ex.
+// mid-rotation, the last key pair is used.
+func (r *KeyPairReloader) load() (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	modTimes, err := modTimes(r.certFile, r.keyFile)
+	if err == nil && r.cert != nil && modTimes == r.modTimes {
+		return r.cert, nil
+	}
+	var cert tls.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	}
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("loading key pair: %w", err)
+	}
+	r.cert, r.modTimes = &cert, modTimes
+	return r.cert, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *KeyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *KeyPairReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+// caReloader holds a pool of CA certificates from a file, reading it again once it changes.
+type caReloader struct {
+	file string
+
+	lock    sync.Mutex
+	modTime time.Time
+	pool    *x509.CertPool
+}
+
+// load returns the pool, reading it again if the file changed. If it can't be read, the last pool
+// is used.
+func (r *caReloader) load() (*x509.CertPool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	modTimes, err := modTimes(r.file)
+	if err == nil && r.pool != nil && modTimes[0] == r.modTime {
+		return r.pool, nil
+	}
+	var pem []byte
+	if err == nil {
+		pem, err = ioutil.ReadFile(r.file)
+	}
+	pool := x509.NewCertPool()
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		err = fmt.Errorf("no certificates found in %q", r.file)
+	}
+	if err != nil {
+		if r.pool != nil {
+			return r.pool, nil
+		}
+		return nil, fmt.Errorf("loading client CA: %w", err)
+	}
+	r.pool, r.modTime = pool, modTimes[0]
+	return r.pool, nil
+}
+
+func modTimes(files ...string) ([2]time.Time, error) {
+	var out [2]time.Time
+	for i, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return out, err
+		}
+		out[i] = info.ModTime()
+	}
+	return out, nil
+}
+
+// tlsConfig returns the server's TLS config, which serves the current key pair, and with a client
+// CA, verifies the client certificates presented against the current CA. Clients may authenticate
+// with a token instead, so certificates aren't required.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	keyPair, err := NewKeyPairReloader(s.certFile, s.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: keyPair.GetCertificate}
+	if s.clientCAFile == "" {
+		return config, nil
+	}
+	ca := &caReloader{file: s.clientCAFile}
+	if _, err := ca.load(); err != nil {
+		return nil, err
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := ca.load()
+		if err != nil {
+			return nil, err
+		}
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		return c, nil
+	}
+	return config, nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// testCert writes a certificate for cn, signed by parent, or self-signed if nil, and its key to
+// dir, returning their paths with the parsed certificate and key.
+func testCert(t *testing.T, dir, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile, cert, key
+}
+
+func TestServerClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile, _, ca, caKey := testCert(t, dir, "ca", nil, nil)
+	serverCert, serverKey, _, _ := testCert(t, dir, "server", ca, caKey)
+	edgeCert, edgeKey, _, _ := testCert(t, dir, "edge.example.com", ca, caKey)
+	otherCert, otherKey, _, _ := testCert(t, dir, "other.example.com", ca, caKey)
+	authFile := filepath.Join(dir, "auth.yaml")
+	require.NoError(t, ioutil.WriteFile(authFile, []byte(`
+identities:
+- name: edge
+  commonNames: [edge.example.com]
+  peers: ["edge-*"]
+`), 0600))
+
+	store, err := registry.NewMemory("mesh")
+	require.NoError(t, err)
+	s, err := NewServer(WithLogger(logrus.New()), WithRegistry(store), WithAuthFile(authFile),
+		WithTLSFiles(serverCert, serverKey), WithClientCAFile(caFile))
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.TLS, err = s.tlsConfig()
+	require.NoError(t, err)
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := func(certFile, keyFile string) *registry.HTTP {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+		config := &tls.Config{RootCAs: pool}
+		if certFile != "" {
+			keyPair, err := NewKeyPairReloader(certFile, keyFile)
+			require.NoError(t, err)
+			config.GetClientCertificate = keyPair.GetClientCertificate
+		}
+		return registry.NewHTTP(ts.URL, "", &http.Client{Transport: &http.Transport{TLSClientConfig: config}})
+	}
+	_, err = client(edgeCert, edgeKey).Get("edge-1")
+	require.True(t, k8sErrors.IsNotFound(err), "authenticated; got %v", err)
+	_, err = client(otherCert, otherKey).Get("edge-1")
+	require.True(t, k8sErrors.IsUnauthorized(err), "no identity lists the common name; got %v", err)
+	_, err = client("", "").Get("edge-1")
+	require.True(t, k8sErrors.IsUnauthorized(err), "got %v", err)
+
+	// A certificate from another CA isn't verified.
+	otherDir := filepath.Join(dir, "other")
+	require.NoError(t, os.Mkdir(otherDir, 0700))
+	_, _, otherCA, otherCAKey := testCert(t, otherDir, "ca", nil, nil)
+	forgedCert, forgedKey, _, _ := testCert(t, otherDir, "edge.example.com", otherCA, otherCAKey)
+	_, err = client(forgedCert, forgedKey).Get("edge-1")
+	require.Error(t, err)
+	require.False(t, k8sErrors.IsNotFound(err), "got %v", err)
+}
+
+func TestKeyPairReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, first, _ := testCert(t, dir, "server", nil, nil)
+	r, err := NewKeyPairReloader(certFile, keyFile)
+	require.NoError(t, err)
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, first.Raw, cert.Certificate[0])
+
+	_, _, second, _ := testCert(t, dir, "server", nil, nil)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, second.Raw, cert.Certificate[0], "the rotated key pair is served")
+
+	require.NoError(t, os.Remove(keyFile))
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, second.Raw, cert.Certificate[0], "an unreadable key pair keeps the last")
+
+	_, err = NewKeyPairReloader(certFile, keyFile)
+	require.Error(t, err)
+}
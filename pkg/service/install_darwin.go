@@ -0,0 +1,42 @@
+// +build darwin
+
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// Unit renders the service's launchd plist.
+func Unit(c Config) string {
+	return LaunchdPlist(c)
+}
+
+// UnitPath returns where the named service's launchd plist is installed.
+func UnitPath(name string) string {
+	return LaunchdPlistPath(name)
+}
+
+// Install writes the service's launchd plist, which launchd runs at boot. An existing plist is
+// replaced, and unloaded if it's running.
+func Install(c Config) error {
+	path := LaunchdPlistPath(c.Name)
+	// Unloading fails if the daemon isn't loaded, which is fine.
+	exec.Command("launchctl", "unload", path).Run()
+	if err := ioutil.WriteFile(path, []byte(LaunchdPlist(c)), 0644); err != nil {
+		return fmt.Errorf("writing plist: %w", err)
+	}
+	return nil
+}
+
+// Start loads the named service's plist, starting it.
+func Start(name string) error {
+	args := []string{"load", "-w", LaunchdPlistPath(name)}
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
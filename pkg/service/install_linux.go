@@ -0,0 +1,45 @@
+// +build linux
+
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// Unit renders the service's systemd unit.
+func Unit(c Config) string {
+	return SystemdUnit(c)
+}
+
+// UnitPath returns where the named service's systemd unit is installed.
+func UnitPath(name string) string {
+	return SystemdUnitPath(name)
+}
+
+// Install writes the service's systemd unit and enables it to start at boot. An existing unit is
+// replaced.
+func Install(c Config) error {
+	if err := ioutil.WriteFile(SystemdUnitPath(c.Name), []byte(SystemdUnit(c)), 0644); err != nil {
+		return fmt.Errorf("writing unit: %w", err)
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", c.Name+".service")
+}
+
+// Start starts, or restarts, the named service.
+func Start(name string) error {
+	return systemctl("restart", name+".service")
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
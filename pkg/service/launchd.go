@@ -0,0 +1,57 @@
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+)
+
+// LaunchdLabel returns the launchd label of the named service.
+func LaunchdLabel(name string) string {
+	return "com.codybaker." + name
+}
+
+// LaunchdPlistPath returns where the named service's launchd plist is installed.
+func LaunchdPlistPath(name string) string {
+	return "/Library/LaunchDaemons/" + LaunchdLabel(name) + ".plist"
+}
+
+// LaunchdPlist renders a launchd daemon plist which runs the service at boot, restarting it if it
+// fails. Its output is logged to /var/log/<name>.log.
+func LaunchdPlist(c Config) string {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>` + xmlEscape(LaunchdLabel(c.Name)) + `</string>
+	<key>ProgramArguments</key>
+	<array>
+`)
+	for _, a := range append([]string{c.Executable}, c.Args...) {
+		b.WriteString("\t\t<string>" + xmlEscape(a) + "</string>\n")
+	}
+	logPath := xmlEscape("/var/log/" + c.Name + ".log")
+	b.WriteString(`	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>` + logPath + `</string>
+	<key>StandardErrorPath</key>
+	<string>` + logPath + `</string>
+</dict>
+</plist>
+`)
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
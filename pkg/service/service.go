@@ -0,0 +1,16 @@
+// Package service runs the agent as a system service, managed by the host's service manager.
+package service
+
+// DefaultName is the name the agent's service is installed under.
+const DefaultName = "wgmesh"
+
+// Config describes an installed service.
+type Config struct {
+	// Name identifies the service to the service manager.
+	Name        string
+	DisplayName string
+	Description string
+	// Executable is the absolute path of the wgmesh binary, which is run with Args.
+	Executable string
+	Args       []string
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemdUnit(t *testing.T) {
+	unit := SystemdUnit(Config{
+		Name:        "wgmesh",
+		Description: "wgmesh agent",
+		Executable:  "/usr/local/bin/wgmesh",
+		Args:        []string{"agent", "--labels", "site=a, role=b", "--registry-token-file", "/etc/wgmesh/$token%"},
+	})
+	require.Contains(t, unit, "Description=wgmesh agent\n")
+	require.Contains(t, unit,
+		`ExecStart=/usr/local/bin/wgmesh agent --labels "site=a, role=b" --registry-token-file /etc/wgmesh/$$token%%`+"\n")
+	require.Contains(t, unit, "Restart=on-failure\n")
+}
+
+func TestSystemdQuote(t *testing.T) {
+	tcs := map[string]string{
+		"plain":     "plain",
+		"":          `""`,
+		"a b":       `"a b"`,
+		`say "hi"`:  `"say \"hi\""`,
+		`C:\path`:   `"C:\\path"`,
+		"100%":      "100%%",
+		"$HOME/x y": `"$$HOME/x y"`,
+	}
+	for in, expect := range tcs {
+		require.Equal(t, expect, systemdQuote(in), in)
+	}
+}
+
+func TestLaunchdPlist(t *testing.T) {
+	plist := LaunchdPlist(Config{
+		Name:       "wgmesh",
+		Executable: "/usr/local/bin/wgmesh",
+		Args:       []string{"agent", "--labels", "a=<b>&c"},
+	})
+	require.Contains(t, plist, "<string>com.codybaker.wgmesh</string>")
+	require.Contains(t, plist, "\t\t<string>/usr/local/bin/wgmesh</string>\n\t\t<string>agent</string>\n")
+	require.Contains(t, plist, "<string>a=&lt;b&gt;&amp;c</string>")
+	require.Contains(t, plist, "<string>/var/log/wgmesh.log</string>")
+	require.Equal(t, "/Library/LaunchDaemons/com.codybaker.wgmesh.plist", LaunchdPlistPath("wgmesh"))
+}
@@ -0,0 +1,247 @@
+// +build windows
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// restartDelays are how long the service control manager waits before restarting the agent after
+// its first, second, and later failures.
+var restartDelays = []time.Duration{5 * time.Second, 30 * time.Second, time.Minute}
+
+// failureResetPeriod is how long, in seconds, the agent must run before its failure count resets.
+const failureResetPeriod = 24 * 60 * 60
+
+// eventID is reported with every event logged by the agent.
+const eventID = 1
+
+// failureActionsFlag mirrors SERVICE_FAILURE_ACTIONS_FLAG, which x/sys doesn't define.
+type failureActionsFlag struct {
+	failureActionsOnNonCrashFailures int32
+}
+
+// Install creates an automatically started service, restarted by the service control manager if it
+// fails, and registers it as an event log source.
+func Install(c Config) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(c.Name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %q already exists", c.Name)
+	}
+	s, err := m.CreateService(c.Name, c.Executable, mgr.Config{
+		DisplayName: c.DisplayName,
+		Description: c.Description,
+		StartType:   mgr.StartAutomatic,
+	}, c.Args...)
+	if err != nil {
+		return fmt.Errorf("creating service %q: %w", c.Name, err)
+	}
+	defer s.Close()
+	var actions []mgr.RecoveryAction
+	for _, d := range restartDelays {
+		actions = append(actions, mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: d})
+	}
+	if err = s.SetRecoveryActions(actions, failureResetPeriod); err != nil {
+		s.Delete()
+		return fmt.Errorf("setting recovery actions: %w", err)
+	}
+	// The agent reports errors by stopping with an exit code, rather than crashing; restart on
+	// those too.
+	flag := failureActionsFlag{failureActionsOnNonCrashFailures: 1}
+	err = windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_FAILURE_ACTIONS_FLAG, (*byte)(unsafe.Pointer(&flag)))
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("enabling recovery on errors: %w", err)
+	}
+	err = eventlog.InstallAsEventCreate(c.Name, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("registering event log source: %w", err)
+	}
+	return nil
+}
+
+// Uninstall stops and deletes the named service, and removes its event log source.
+func Uninstall(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("opening service %q: %w", name, err)
+	}
+	defer s.Close()
+	if err = stop(s); err != nil {
+		return err
+	}
+	if err = s.Delete(); err != nil {
+		return fmt.Errorf("deleting service %q: %w", name, err)
+	}
+	if err = eventlog.Remove(name); err != nil {
+		return fmt.Errorf("removing event log source: %w", err)
+	}
+	return nil
+}
+
+// Start starts the named service.
+func Start(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("opening service %q: %w", name, err)
+	}
+	defer s.Close()
+	if err = s.Start(); err != nil {
+		return fmt.Errorf("starting service %q: %w", name, err)
+	}
+	return nil
+}
+
+// Stop stops the named service, waiting for it to exit.
+func Stop(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("opening service %q: %w", name, err)
+	}
+	defer s.Close()
+	return stop(s)
+}
+
+// stop stops the service if it's running, waiting up to a minute for it to exit.
+func stop(s *mgr.Service) error {
+	status, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("querying service: %w", err)
+	}
+	if status.State == svc.Stopped {
+		return nil
+	}
+	if status.State != svc.StopPending {
+		if status, err = s.Control(svc.Stop); err != nil {
+			return fmt.Errorf("stopping service: %w", err)
+		}
+	}
+	deadline := time.Now().Add(time.Minute)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for service to stop")
+		}
+		time.Sleep(500 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return fmt.Errorf("querying service: %w", err)
+		}
+	}
+	return nil
+}
+
+// Run runs fn as the named service, canceling its context when the service control manager stops
+// the service. It blocks until fn returns. If fn fails, the service stops with an error so its
+// recovery actions restart it.
+func Run(name string, fn func(ctx context.Context) error) error {
+	h := &handler{run: fn}
+	if err := svc.Run(name, h); err != nil {
+		return err
+	}
+	return h.err
+}
+
+type handler struct {
+	run func(ctx context.Context) error
+	err error
+}
+
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.run(ctx)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	stopping := false
+	for {
+		select {
+		case err := <-done:
+			if err != nil && !stopping {
+				h.err = err
+				return true, 1
+			}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				stopping = true
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+// EventLogHook writes log entries to the Windows event log under a service's source.
+type EventLogHook struct {
+	log *eventlog.Log
+}
+
+// NewEventLogHook opens the event log source registered by Install.
+func NewEventLogHook(name string) (*EventLogHook, error) {
+	l, err := eventlog.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("opening event log: %w", err)
+	}
+	return &EventLogHook{log: l}, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *EventLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *EventLogHook) Fire(entry *logrus.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return h.log.Error(eventID, msg)
+	case logrus.WarnLevel:
+		return h.log.Warning(eventID, msg)
+	default:
+		return h.log.Info(eventID, msg)
+	}
+}
+
+// Close closes the event log.
+func (h *EventLogHook) Close() error {
+	return h.log.Close()
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SystemdUnitPath returns where the named service's systemd unit is installed.
+func SystemdUnitPath(name string) string {
+	return "/etc/systemd/system/" + name + ".service"
+}
+
+// SystemdUnit renders a systemd unit which runs the service once the network is online, restarting
+// it if it fails.
+func SystemdUnit(c Config) string {
+	args := []string{systemdQuote(c.Executable)}
+	for _, a := range c.Args {
+		args = append(args, systemdQuote(a))
+	}
+	return fmt.Sprintf(`[Unit]
+Description=%s
+Documentation=https://github.com/jcodybaker/wgmesh
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+RestartSec=5s
+
+[Install]
+WantedBy=multi-user.target
+`, c.Description, strings.Join(args, " "))
+}
+
+// systemdQuote quotes an ExecStart argument if needed, and escapes systemd's specifiers and
+// variable expansion.
+func systemdQuote(s string) string {
+	s = strings.NewReplacer("%", "%%", "$", "$$").Replace(s)
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,132 @@
+// Package transport runs udp-over-tcp (https://github.com/mullvad/udp-over-tcp) as child processes,
+// carrying WireGuard's UDP traffic over TCP for peers on networks which block UDP.
+//
+// A peer accepting TCP runs tcp2udp, which forwards each TCP connection's datagrams to the local
+// WireGuard port. A peer falling back to TCP runs udp2tcp for each such peer, listening on a
+// loopback UDP port which is configured as the peer's WireGuard endpoint, and forwarding its
+// datagrams over a TCP connection to the peer's tcp2udp.
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultUDP2TCPPath and DefaultTCP2UDPPath are looked up in PATH.
+	DefaultUDP2TCPPath = "udp2tcp"
+	DefaultTCP2UDPPath = "tcp2udp"
+
+	shutdownTimeout = 5 * time.Second
+)
+
+// ErrNotFound is returned when the wrapper binary can't be found.
+var ErrNotFound = errors.New("udp-over-tcp binary not found")
+
+// Process is a running udp2tcp or tcp2udp.
+type Process struct {
+	cmd  *exec.Cmd
+	exit chan error
+}
+
+// Server starts tcp2udp, accepting TCP connections on listen, ex. ":443", and forwarding their
+// datagrams to the WireGuard port on the loopback address.
+func Server(path, listen string, wireGuardPort int) (*Process, error) {
+	return start(path, DefaultTCP2UDPPath,
+		"--tcp-listen", listen,
+		"--udp-forward", net.JoinHostPort("127.0.0.1", strconv.Itoa(wireGuardPort)))
+}
+
+// Client starts udp2tcp, forwarding datagrams sent to the returned loopback address over TCP to the
+// remote tcp2udp, at host:port.
+func Client(path, remote string) (*Process, *net.UDPAddr, error) {
+	local, err := freeUDPPort()
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := start(path, DefaultUDP2TCPPath,
+		"--udp-listen", local.String(),
+		"--tcp-forward", remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, local, nil
+}
+
+func start(path, defaultPath string, args ...string) (*Process, error) {
+	if path == "" {
+		path = defaultPath
+	}
+	qualifiedPath, err := exec.LookPath(path)
+	switch {
+	case err == nil:
+	case errors.Unwrap(err) == exec.ErrNotFound || os.IsNotExist(errors.Unwrap(err)):
+		return nil, fmt.Errorf("finding %s binary: %w", path, ErrNotFound)
+	default:
+		return nil, fmt.Errorf("finding %s binary %q: %w", defaultPath, path, err)
+	}
+	return startCmd(exec.Command(qualifiedPath, args...))
+}
+
+func startCmd(cmd *exec.Cmd) (*Process, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %w", cmd.Path, err)
+	}
+	p := &Process{cmd: cmd, exit: make(chan error, 1)}
+	go func() {
+		p.exit <- cmd.Wait()
+		close(p.exit)
+	}()
+	return p, nil
+}
+
+// Exited returns true if the process has exited.
+func (p *Process) Exited() bool {
+	select {
+	case <-p.exit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop signals the process to exit, killing it if it hasn't within the shutdown timeout.
+func (p *Process) Stop() error {
+	if p.Exited() {
+		return nil
+	}
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		if p.Exited() {
+			return nil
+		}
+		return fmt.Errorf("signaling %s: %w", p.cmd.Path, err)
+	}
+	t := time.NewTimer(shutdownTimeout)
+	defer t.Stop()
+	select {
+	case <-p.exit:
+		return nil
+	case <-t.C:
+	}
+	if err := p.cmd.Process.Kill(); err != nil && !p.Exited() {
+		return fmt.Errorf("killing %s: %w", p.cmd.Path, err)
+	}
+	<-p.exit
+	return nil
+}
+
+// freeUDPPort returns a loopback address with a UDP port which is currently free.
+func freeUDPPort() (*net.UDPAddr, error) {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, fmt.Errorf("finding a free port: %w", err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr), nil
+}
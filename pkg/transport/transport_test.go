@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	args := filepath.Join(dir, "args")
+	path := filepath.Join(dir, "udp2tcp")
+	script := "#!/bin/sh\necho \"$@\" > " + args + "\nexec sleep 60\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(script), 0700))
+
+	p, local, err := Client(path, "vpn.example.com:443")
+	require.NoError(t, err)
+	require.True(t, local.IP.IsLoopback())
+	require.NotZero(t, local.Port)
+	require.Eventually(t, func() bool {
+		b, err := ioutil.ReadFile(args)
+		return err == nil && strings.TrimSpace(string(b)) ==
+			"--udp-listen "+local.String()+" --tcp-forward vpn.example.com:443"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.False(t, p.Exited())
+	require.NoError(t, p.Stop())
+	require.True(t, p.Exited())
+	require.NoError(t, p.Stop(), "stopping twice is harmless")
+
+	_, _, err = Client(filepath.Join(dir, "missing"), "vpn.example.com:443")
+	require.True(t, errors.Is(err, ErrNotFound), err)
+}
+
+func TestProcessExit(t *testing.T) {
+	p, err := startCmd(exec.Command("true"))
+	require.NoError(t, err)
+	require.Eventually(t, p.Exited, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, p.Stop())
+}
@@ -0,0 +1,90 @@
+package webhook
+
+import (
+	"fmt"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Objects are a set of registry objects to validate together, ex. a directory of manifests.
+type Objects struct {
+	Meshes   []wgk8s.Mesh
+	Policies []wgk8s.WireGuardMeshPolicy
+	IPPools  []wgk8s.IPPool
+	IPClaims []wgk8s.IPClaim
+	Peers    []wgk8s.WireGuardPeer
+}
+
+// ObjectError is a problem with one of the Objects.
+type ObjectError struct {
+	Kind string
+	Name string
+	Err  *field.Error
+}
+
+func (e ObjectError) Error() string {
+	return fmt.Sprintf("%s %q: %v", e.Kind, e.Name, e.Err)
+}
+
+// ValidateObjects checks each object as the webhook would, and checks the objects against each
+// other: names must be unique, peers must not conflict as checked by ValidateWireGuardPeerConflicts,
+// IPPools must not overlap, and IPClaims must belong to one of the IPPools, if any are given.
+func ValidateObjects(o Objects) []ObjectError {
+	var out []ObjectError
+	add := func(kind, name string, errs field.ErrorList) {
+		for _, err := range errs {
+			out = append(out, ObjectError{Kind: kind, Name: name, Err: err})
+		}
+	}
+	names := make(map[string]map[string]bool)
+	unique := func(kind, name string) {
+		if names[kind] == nil {
+			names[kind] = make(map[string]bool)
+		}
+		if names[kind][name] {
+			add(kind, name, field.ErrorList{field.Duplicate(field.NewPath("metadata", "name"), name)})
+		}
+		names[kind][name] = true
+	}
+
+	for i := range o.Meshes {
+		m := &o.Meshes[i]
+		unique("Mesh", m.GetName())
+		add("Mesh", m.GetName(), ValidateMesh(m))
+	}
+	for i := range o.Policies {
+		p := &o.Policies[i]
+		unique("WireGuardMeshPolicy", p.GetName())
+		add("WireGuardMeshPolicy", p.GetName(), ValidateWireGuardMeshPolicy(p))
+	}
+	pools := make(map[string]bool)
+	for i := range o.IPPools {
+		p := &o.IPPools[i]
+		unique("IPPool", p.GetName())
+		pools[p.GetName()] = true
+		add("IPPool", p.GetName(), ValidateIPPool(p))
+		// Only report each overlapping pair once, against the pool listed first.
+		add("IPPool", p.GetName(), ValidateIPPoolOverlap(p, o.IPPools[i+1:]))
+	}
+	for i := range o.IPClaims {
+		c := &o.IPClaims[i]
+		unique("IPClaim", c.GetName())
+		add("IPClaim", c.GetName(), ValidateIPClaim(c))
+		pool := c.GetLabels()[wgk8s.IPPoolLabel]
+		if len(pools) > 0 && pool != "" && !pools[pool] {
+			add("IPClaim", c.GetName(), field.ErrorList{field.NotFound(
+				field.NewPath("metadata", "labels").Key(wgk8s.IPPoolLabel), pool)})
+		}
+	}
+
+	for i := range o.Peers {
+		p := &o.Peers[i]
+		unique("WireGuardPeer", p.GetName())
+		add("WireGuardPeer", p.GetName(), ValidateWireGuardPeer(p))
+		// Only report each conflicting pair once, against the peer listed second.
+		add("WireGuardPeer", p.GetName(), ValidateWireGuardPeerConflicts(p, o.Peers[:i]))
+	}
+	return out
+}
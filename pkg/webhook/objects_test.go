@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"testing"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateObjects(t *testing.T) {
+	const otherKey = "cGd1Ga4vdjb7a+e4prmvqgnPTWl2XLdJp6Ybgq4RBWk="
+	peer := func(name, key string, ips ...string) wgk8s.WireGuardPeer {
+		return wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       wgk8s.WireGuardPeerSpec{PublicKey: key, Endpoint: "192.0.2.1:51820", IPs: ips},
+		}
+	}
+	routed := func(p wgk8s.WireGuardPeer, routes ...string) wgk8s.WireGuardPeer {
+		p.Spec.Routes = routes
+		return p
+	}
+	pool := func(name, cidr string) wgk8s.IPPool {
+		return wgk8s.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: cidr}}},
+		}
+	}
+	claim := wgk8s.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   wgk8s.IPClaimName("missing", "10.9.0.1"),
+			Labels: map[string]string{wgk8s.IPPoolLabel: "missing"},
+		},
+		Spec: wgk8s.IPClaimSpec{IP: "10.9.0.1"},
+	}
+
+	tcs := []struct {
+		name   string
+		o      Objects
+		expect []string
+	}{
+		{
+			name: "valid",
+			o: Objects{
+				IPPools: []wgk8s.IPPool{pool("a", "10.0.0.0/24"), pool("b", "10.1.0.0/24")},
+				Peers:   []wgk8s.WireGuardPeer{peer("a", testKey, "10.0.0.1/32"), peer("b", otherKey, "10.0.0.2/32")},
+			},
+		},
+		{
+			name: "per-object errors",
+			o:    Objects{Peers: []wgk8s.WireGuardPeer{peer("a", "nope", "10.0.0.1")}},
+			expect: []string{
+				`WireGuardPeer "a": spec.publicKey: Invalid value: "nope": wgtypes: incorrect key size: 3`,
+				`WireGuardPeer "a": spec.ips[0]: Invalid value: "10.0.0.1": must be an address with a prefix length`,
+			},
+		},
+		{
+			name: "duplicate names",
+			o:    Objects{Peers: []wgk8s.WireGuardPeer{peer("a", testKey), peer("a", otherKey)}},
+			expect: []string{
+				`WireGuardPeer "a": metadata.name: Duplicate value: "a"`,
+			},
+		},
+		{
+			name: "shared key and address",
+			o: Objects{Peers: []wgk8s.WireGuardPeer{
+				peer("a", testKey, "10.0.0.1/32"),
+				peer("b", testKey, "10.0.0.1/24"),
+			}},
+			expect: []string{
+				`WireGuardPeer "b": spec.publicKey: Invalid value: "` + testKey + `": is also used by WireGuardPeer "a"`,
+				`WireGuardPeer "b": spec.ips[0]: Invalid value: "10.0.0.1/24": is also published by WireGuardPeer "a"`,
+			},
+		},
+		{
+			name: "overlapping routes",
+			o: Objects{Peers: []wgk8s.WireGuardPeer{
+				routed(peer("a", testKey), "10.1.0.0/16"),
+				routed(peer("b", otherKey), "10.1.2.0/24"),
+			}},
+		},
+		{
+			name: "overlapping pools",
+			o:    Objects{IPPools: []wgk8s.IPPool{pool("a", "10.0.0.0/16"), pool("b", "10.0.1.0/24")}},
+			expect: []string{
+				`IPPool "a": spec.ipRanges[0]: Invalid value: "10.0.0.0/16": overlaps IPPool "b" range 10.0.1.0/24`,
+			},
+		},
+		{
+			name: "claim from unknown pool",
+			o: Objects{
+				IPPools:  []wgk8s.IPPool{pool("a", "10.0.0.0/24")},
+				IPClaims: []wgk8s.IPClaim{claim},
+			},
+			expect: []string{
+				`IPClaim "missing-10-9-0-1": metadata.labels[wgmesh.codybaker.com/ip-pool]: Not found: "missing"`,
+			},
+		},
+		{
+			name: "claims without pools",
+			o:    Objects{IPClaims: []wgk8s.IPClaim{claim}},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, err := range ValidateObjects(tc.o) {
+				got = append(got, err.Error())
+			}
+			require.Equal(t, tc.expect, got)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type options struct {
+	ll log.FieldLogger
+
+	listenAddr string
+	certFile   string
+	keyFile    string
+
+	registryKubeClientConfig clientcmd.ClientConfig
+}
+
+func defaultOptions() options {
+	return options{
+		ll:         log.New(),
+		listenAddr: ":8443",
+	}
+}
+
+// OptionFunc describes the function signature for methods which modify the webhook options.
+type OptionFunc func(*options) error
+
+// WithLogger sets a logger on the webhook options.
+func WithLogger(ll log.FieldLogger) OptionFunc {
+	return func(o *options) error {
+		o.ll = ll
+		return nil
+	}
+}
+
+// WithListenAddr sets the address where the webhook listens for HTTPS requests.
+func WithListenAddr(addr string) OptionFunc {
+	return func(o *options) error {
+		o.listenAddr = addr
+		return nil
+	}
+}
+
+// WithTLSFiles sets the certificate and key served by the webhook. The apiserver only calls
+// webhooks over HTTPS.
+func WithTLSFiles(certFile, keyFile string) OptionFunc {
+	return func(o *options) error {
+		o.certFile = certFile
+		o.keyFile = keyFile
+		return nil
+	}
+}
+
+// WithRegistryKubeClientConfig sets the config for the registry whose WireGuardPeers are watched, so
+// WireGuardPeers are also checked for conflicts with the other peers in their namespace. Without it,
+// each object is validated on its own.
+func WithRegistryKubeClientConfig(config clientcmd.ClientConfig) OptionFunc {
+	return func(o *options) error {
+		o.registryKubeClientConfig = config
+		return nil
+	}
+}
@@ -0,0 +1,214 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	wgmeshClientSet "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned"
+	wgInformers "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/informers/externalversions/wgmesh/v1alpha1"
+	wgListers "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/listers/wgmesh/v1alpha1"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	log "github.com/sirupsen/logrus"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ValidatePath is the URL path where AdmissionReviews are accepted.
+	ValidatePath = "/validate"
+
+	shutdownTimeout = 5 * time.Second
+	maxRequestBytes = 1 << 20
+)
+
+// Server is a validating admission webhook for wgmesh resources.
+type Server struct {
+	options
+
+	// peers lists the registry's WireGuardPeers when conflicts are checked; nil otherwise.
+	peers wgListers.WireGuardPeerLister
+}
+
+// NewServer creates a webhook server.
+func NewServer(optionFuncs ...OptionFunc) (*Server, error) {
+	s := &Server{
+		options: defaultOptions(),
+	}
+	for _, f := range optionFuncs {
+		err := f(&s.options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.certFile == "" || s.keyFile == "" {
+		return nil, fmt.Errorf("tls certificate and key are required")
+	}
+	return s, nil
+}
+
+// Run serves admission requests until the context is canceled.
+func (s *Server) Run(ctx context.Context) error {
+	if s.registryKubeClientConfig != nil {
+		if err := s.watchPeers(ctx); err != nil {
+			return err
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(ValidatePath, s.handleValidate)
+	srv := &http.Server{Addr: s.listenAddr, Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() {
+		s.ll.WithField("listen_addr", s.listenAddr).Infoln("serving admission webhook")
+		errCh <- srv.ListenAndServeTLS(s.certFile, s.keyFile)
+	}()
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("serving webhook: %w", err)
+	case <-ctx.Done():
+	}
+	sCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(sCtx)
+}
+
+// watchPeers caches the registry's WireGuardPeers, in every namespace, for conflict checks.
+func (s *Server) watchPeers(ctx context.Context) error {
+	config, err := s.registryKubeClientConfig.ClientConfig()
+	if err != nil {
+		return fmt.Errorf("building restconfig from registry kubeconfig: %w", err)
+	}
+	clientset, err := wgmeshClientSet.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("building registry wgmesh clientset: %w", err)
+	}
+	informer := wgInformers.NewWireGuardPeerInformer(clientset, metav1.NamespaceAll, 0,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	go informer.Run(ctx.Done())
+	s.ll.Debug("waiting for WireGuardPeer cache to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("syncing WireGuardPeer cache: %w", ctx.Err())
+	}
+	s.peers = wgListers.NewWireGuardPeerLister(informer.GetIndexer())
+	return nil
+}
+
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var review admissionv1beta1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+	review.Response = s.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+// review validates the object in the request.
+func (s *Server) review(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	ll := s.ll.WithFields(log.Fields{
+		"kind":          req.Kind.Kind,
+		"k8s_namespace": req.Namespace,
+		"k8s_name":      req.Name,
+		"operation":     req.Operation,
+	})
+	if req.Operation != admissionv1beta1.Create && req.Operation != admissionv1beta1.Update {
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	errs, err := s.validateRaw(req.Namespace, req.Kind.Kind, req.Object.Raw)
+	if err != nil {
+		ll.WithError(err).Warn("failed to decode object")
+		return deny(metav1.StatusReasonBadRequest, err.Error())
+	}
+	if len(errs) > 0 {
+		ll.WithField("errors", errs.ToAggregate().Error()).Info("rejecting invalid object")
+		return deny(metav1.StatusReasonInvalid, errs.ToAggregate().Error())
+	}
+	return &admissionv1beta1.AdmissionResponse{Allowed: true}
+}
+
+// validateRaw decodes and validates a wgmesh object of the specified kind, created or updated in
+// the namespace.
+func (s *Server) validateRaw(namespace, kind string, raw []byte) (field.ErrorList, error) {
+	switch kind {
+	case "WireGuardPeer":
+		var peer wgk8s.WireGuardPeer
+		if err := json.Unmarshal(raw, &peer); err != nil {
+			return nil, fmt.Errorf("decoding WireGuardPeer: %w", err)
+		}
+		errs := ValidateWireGuardPeer(&peer)
+		if s.peers == nil {
+			return errs, nil
+		}
+		existing, err := s.peers.WireGuardPeers(namespace).List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("listing WireGuardPeers: %w", err)
+		}
+		others := make([]wgk8s.WireGuardPeer, 0, len(existing))
+		for _, p := range existing {
+			others = append(others, *p)
+		}
+		return append(errs, ValidateWireGuardPeerConflicts(&peer, others)...), nil
+	case "IPPool":
+		var pool wgk8s.IPPool
+		if err := json.Unmarshal(raw, &pool); err != nil {
+			return nil, fmt.Errorf("decoding IPPool: %w", err)
+		}
+		return ValidateIPPool(&pool), nil
+	case "IPClaim":
+		var claim wgk8s.IPClaim
+		if err := json.Unmarshal(raw, &claim); err != nil {
+			return nil, fmt.Errorf("decoding IPClaim: %w", err)
+		}
+		return ValidateIPClaim(&claim), nil
+	case "Mesh":
+		var mesh wgk8s.Mesh
+		if err := json.Unmarshal(raw, &mesh); err != nil {
+			return nil, fmt.Errorf("decoding Mesh: %w", err)
+		}
+		return ValidateMesh(&mesh), nil
+	case "WireGuardMeshPolicy":
+		var policy wgk8s.WireGuardMeshPolicy
+		if err := json.Unmarshal(raw, &policy); err != nil {
+			return nil, fmt.Errorf("decoding WireGuardMeshPolicy: %w", err)
+		}
+		return ValidateWireGuardMeshPolicy(&policy), nil
+	default:
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+}
+
+func deny(reason metav1.StatusReason, message string) *admissionv1beta1.AdmissionResponse {
+	code := int32(http.StatusUnprocessableEntity)
+	if reason == metav1.StatusReasonBadRequest {
+		code = http.StatusBadRequest
+	}
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  reason,
+			Message: message,
+			Code:    code,
+		},
+	}
+}
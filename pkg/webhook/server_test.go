@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	wgListers "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/listers/wgmesh/v1alpha1"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestHandleValidate(t *testing.T) {
+	s, err := NewServer(WithLogger(logrus.New()), WithTLSFiles("cert", "key"))
+	require.NoError(t, err)
+
+	peer := func(key string) []byte {
+		b, err := json.Marshal(&wgk8s.WireGuardPeer{
+			Spec: wgk8s.WireGuardPeerSpec{PublicKey: key, Endpoint: "192.0.2.1:51820"},
+		})
+		require.NoError(t, err)
+		return b
+	}
+	tcs := []struct {
+		name          string
+		kind          string
+		operation     admissionv1beta1.Operation
+		object        []byte
+		expectAllowed bool
+		expectCode    int32
+	}{
+		{
+			name:          "valid create",
+			kind:          "WireGuardPeer",
+			operation:     admissionv1beta1.Create,
+			object:        peer(testKey),
+			expectAllowed: true,
+		},
+		{
+			name:       "invalid update",
+			kind:       "WireGuardPeer",
+			operation:  admissionv1beta1.Update,
+			object:     peer("nope"),
+			expectCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:          "delete",
+			kind:          "IPPool",
+			operation:     admissionv1beta1.Delete,
+			expectAllowed: true,
+		},
+		{
+			name:       "unsupported kind",
+			kind:       "Pod",
+			operation:  admissionv1beta1.Create,
+			object:     []byte("{}"),
+			expectCode: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(&admissionv1beta1.AdmissionReview{
+				Request: &admissionv1beta1.AdmissionRequest{
+					UID:       "abc",
+					Kind:      metav1.GroupVersionKind{Group: wgk8s.GroupName, Version: "v1alpha1", Kind: tc.kind},
+					Operation: tc.operation,
+					Object:    runtime.RawExtension{Raw: tc.object},
+				},
+			})
+			require.NoError(t, err)
+			rec := httptest.NewRecorder()
+			s.handleValidate(rec, httptest.NewRequest(http.MethodPost, ValidatePath, bytes.NewReader(body)))
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			var review admissionv1beta1.AdmissionReview
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &review))
+			require.NotNil(t, review.Response)
+			require.EqualValues(t, "abc", review.Response.UID)
+			require.Equal(t, tc.expectAllowed, review.Response.Allowed)
+			if !tc.expectAllowed {
+				require.Equal(t, tc.expectCode, review.Response.Result.Code)
+			}
+		})
+	}
+}
+
+func TestReviewConflicts(t *testing.T) {
+	s, err := NewServer(WithLogger(logrus.New()), WithTLSFiles("cert", "key"))
+	require.NoError(t, err)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	require.NoError(t, indexer.Add(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "a"},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: testKey, IPs: []string{"10.0.0.1/32"}},
+	}))
+
+	review := func(namespace, name string) *admissionv1beta1.AdmissionResponse {
+		raw, err := json.Marshal(&wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       wgk8s.WireGuardPeerSpec{PublicKey: testKey, IPs: []string{"10.0.0.1/32"}},
+		})
+		require.NoError(t, err)
+		return s.review(&admissionv1beta1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Group: wgk8s.GroupName, Version: "v1alpha1", Kind: "WireGuardPeer"},
+			Namespace: namespace,
+			Name:      name,
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		})
+	}
+	require.True(t, review("ns", "b").Allowed, "conflicts aren't checked without the registry's peers")
+
+	s.peers = wgListers.NewWireGuardPeerLister(indexer)
+	resp := review("ns", "b")
+	require.False(t, resp.Allowed)
+	require.Equal(t, int32(http.StatusUnprocessableEntity), resp.Result.Code)
+	require.Contains(t, resp.Result.Message, `spec.publicKey: Invalid value: "`+testKey+`": is also used by WireGuardPeer "a"`)
+	require.Contains(t, resp.Result.Message, `spec.ips[0]: Invalid value: "10.0.0.1/32": is also published by WireGuardPeer "a"`)
+
+	require.True(t, review("ns", "a").Allowed, "an update isn't checked against itself")
+	require.True(t, review("other", "b").Allowed, "peers in other namespaces don't conflict")
+}
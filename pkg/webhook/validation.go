@@ -0,0 +1,395 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ValidateWireGuardPeer checks that a WireGuardPeer can be applied by agents.
+func ValidateWireGuardPeer(peer *wgk8s.WireGuardPeer) field.ErrorList {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+	if _, err := wgtypes.ParseKey(peer.Spec.PublicKey); err != nil {
+		errs = append(errs, field.Invalid(spec.Child("publicKey"), peer.Spec.PublicKey, err.Error()))
+	}
+	if peer.Spec.PresharedKey != "" {
+		if _, err := wgtypes.ParseKey(peer.Spec.PresharedKey); err != nil {
+			// Don't echo the secret back.
+			errs = append(errs, field.Invalid(spec.Child("presharedKey"), "", err.Error()))
+		}
+	}
+	if peer.Spec.Endpoint != "" {
+		errs = append(errs, validateEndpoint(spec.Child("endpoint"), peer.Spec.Endpoint)...)
+	}
+	for i, endpoint := range peer.Spec.Endpoints {
+		errs = append(errs, validateEndpoint(spec.Child("endpoints").Index(i), endpoint)...)
+	}
+	if peer.Spec.TCPEndpoint != "" {
+		errs = append(errs, validateEndpoint(spec.Child("tcpEndpoint"), peer.Spec.TCPEndpoint)...)
+	}
+	for i, ip := range peer.Spec.IPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("ips").Index(i), ip, "must be an address with a prefix length"))
+		}
+	}
+	for i, route := range peer.Spec.Routes {
+		if _, _, err := net.ParseCIDR(route); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("routes").Index(i), route, "must be a CIDR"))
+		}
+	}
+	offered := make(map[string]bool, len(peer.Spec.Routes))
+	for _, route := range peer.Spec.Routes {
+		offered[route] = true
+	}
+	for i, route := range peer.Spec.ClampMSSRoutes {
+		if !offered[route] {
+			errs = append(errs, field.Invalid(spec.Child("clampMSSRoutes").Index(i), route, "must be one of the offered routes"))
+		}
+	}
+	for i, r := range peer.Spec.ReflectedRoutes {
+		path := spec.Child("reflectedRoutes").Index(i)
+		if _, _, err := net.ParseCIDR(r.CIDR); err != nil {
+			errs = append(errs, field.Invalid(path.Child("cidr"), r.CIDR, "must be a CIDR"))
+		}
+		if len(r.Path) == 0 {
+			errs = append(errs, field.Required(path.Child("path"), "must name the route's origin"))
+		}
+	}
+	for i, svc := range peer.Spec.Services {
+		path := spec.Child("services").Index(i)
+		for _, msg := range validation.IsDNS1123Subdomain(svc.Name) {
+			errs = append(errs, field.Invalid(path.Child("name"), svc.Name, msg))
+		}
+		for j, ip := range svc.IPs {
+			if net.ParseIP(ip) == nil {
+				errs = append(errs, field.Invalid(path.Child("ips").Index(j), ip, "must be an IP address"))
+			}
+		}
+	}
+	if peer.Spec.KeepAliveSeconds < 0 || peer.Spec.KeepAliveSeconds > 0xffff {
+		errs = append(errs, field.Invalid(spec.Child("keepalive"), peer.Spec.KeepAliveSeconds, "must be between 0 and 65535"))
+	}
+	observedPath := field.NewPath("status", "observedEndpoints")
+	for i, o := range peer.Status.ObservedEndpoints {
+		path := observedPath.Index(i)
+		if _, err := wgtypes.ParseKey(o.PublicKey); err != nil {
+			errs = append(errs, field.Invalid(path.Child("publicKey"), o.PublicKey, err.Error()))
+		}
+		errs = append(errs, validateEndpoint(path.Child("endpoint"), o.Endpoint)...)
+	}
+	healthPath := field.NewPath("status", "peerHealth")
+	for i, h := range peer.Status.PeerHealth {
+		if h.Name == "" {
+			errs = append(errs, field.Required(healthPath.Index(i).Child("name"), ""))
+		}
+	}
+	return errs
+}
+
+// ValidateWireGuardPeerConflicts checks the peer against the other peers of its mesh: it must not
+// reuse another peer's public key or publish another peer's address. Routes may overlap another
+// peer's: agents send the route to the peer with the highest routePriority, or with equal
+// priorities, spread it across them with ECMP or fail over between them. Other peers with the same
+// name are skipped, so an update isn't checked against itself. Invalid keys and addresses are left
+// to ValidateWireGuardPeer.
+func ValidateWireGuardPeerConflicts(peer *wgk8s.WireGuardPeer, others []wgk8s.WireGuardPeer) field.ErrorList {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+	for _, other := range others {
+		if other.GetName() == peer.GetName() {
+			continue
+		}
+		if peer.Spec.PublicKey != "" && peer.Spec.PublicKey == other.Spec.PublicKey {
+			errs = append(errs, field.Invalid(spec.Child("publicKey"), peer.Spec.PublicKey,
+				fmt.Sprintf("is also used by WireGuardPeer %q", other.GetName())))
+		}
+		published := make(map[string]bool, len(other.Spec.IPs))
+		for _, ipStr := range other.Spec.IPs {
+			if ip, _, err := net.ParseCIDR(ipStr); err == nil {
+				published[ip.String()] = true
+			}
+		}
+		for i, ipStr := range peer.Spec.IPs {
+			if ip, _, err := net.ParseCIDR(ipStr); err == nil && published[ip.String()] {
+				errs = append(errs, field.Invalid(spec.Child("ips").Index(i), ipStr,
+					fmt.Sprintf("is also published by WireGuardPeer %q", other.GetName())))
+			}
+		}
+	}
+	return errs
+}
+
+func validateEndpoint(path *field.Path, endpoint string) field.ErrorList {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, endpoint, "must be of the form host:port")}
+	}
+	var errs field.ErrorList
+	if host == "" {
+		errs = append(errs, field.Invalid(path, endpoint, "host must not be empty"))
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		errs = append(errs, field.Invalid(path, endpoint, "port must be between 1 and 65535"))
+	}
+	return errs
+}
+
+// ValidateIPPool checks that addresses can be allocated from an IPPool.
+func ValidateIPPool(pool *wgk8s.IPPool) field.ErrorList {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+	rangesPath := spec.Child("ipRanges")
+	if len(pool.Spec.IPRanges) == 0 {
+		errs = append(errs, field.Required(rangesPath, "at least one range is required"))
+	}
+	type bounds struct {
+		path       *field.Path
+		start, end net.IP
+	}
+	var valid []bounds
+	for i, r := range pool.Spec.IPRanges {
+		path := rangesPath.Index(i)
+		_, cidr, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			errs = append(errs, field.Invalid(path.Child("cidr"), r.CIDR, "must be a CIDR"))
+			continue
+		}
+		start, startErrs := rangeBound(path.Child("start"), r.Start, cidr, firstIP(cidr))
+		end, endErrs := rangeBound(path.Child("end"), r.End, cidr, lastIP(cidr))
+		errs = append(append(errs, startErrs...), endErrs...)
+		if start == nil || end == nil {
+			continue
+		}
+		if bytes.Compare(start, end) > 0 {
+			errs = append(errs, field.Invalid(path.Child("start"), r.Start, "must not be after end"))
+			continue
+		}
+		for _, other := range valid {
+			if len(other.start) == len(start) &&
+				bytes.Compare(start, other.end) <= 0 && bytes.Compare(other.start, end) <= 0 {
+				errs = append(errs, field.Invalid(path, r.CIDR, fmt.Sprintf("overlaps %s", other.path)))
+			}
+		}
+		valid = append(valid, bounds{path: path, start: start, end: end})
+	}
+	for i, ip := range pool.Spec.Reserved {
+		if net.ParseIP(ip) == nil {
+			errs = append(errs, field.Invalid(spec.Child("reserved").Index(i), ip, "must be an IP address"))
+		}
+	}
+	for i, c := range pool.Spec.ExcludeCIDRs {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("excludeCIDRs").Index(i), c, "must be a CIDR"))
+		}
+	}
+	switch pool.Spec.Strategy {
+	case "", wgk8s.IPAllocationRandom, wgk8s.IPAllocationSequential:
+	default:
+		errs = append(errs, field.NotSupported(spec.Child("strategy"), pool.Spec.Strategy,
+			[]string{string(wgk8s.IPAllocationRandom), string(wgk8s.IPAllocationSequential)}))
+	}
+	return errs
+}
+
+// ValidateIPPoolOverlap checks that none of the pool's ranges overlap the ranges of the other pools,
+// so no address can be claimed twice. Invalid ranges are left to ValidateIPPool.
+func ValidateIPPoolOverlap(pool *wgk8s.IPPool, others []wgk8s.IPPool) field.ErrorList {
+	var errs field.ErrorList
+	rangesPath := field.NewPath("spec", "ipRanges")
+	for i, r := range pool.Spec.IPRanges {
+		start, end, ok := ipRangeBounds(r)
+		if !ok {
+			continue
+		}
+		for _, other := range others {
+			if other.GetName() == pool.GetName() {
+				continue
+			}
+			for _, o := range other.Spec.IPRanges {
+				oStart, oEnd, ok := ipRangeBounds(o)
+				if ok && len(oStart) == len(start) &&
+					bytes.Compare(start, oEnd) <= 0 && bytes.Compare(oStart, end) <= 0 {
+					errs = append(errs, field.Invalid(rangesPath.Index(i), r.CIDR,
+						fmt.Sprintf("overlaps IPPool %q range %s", other.GetName(), o.CIDR)))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// ipRangeBounds returns the first and last addresses of a valid range.
+func ipRangeBounds(r wgk8s.IPRange) (net.IP, net.IP, bool) {
+	_, cidr, err := net.ParseCIDR(r.CIDR)
+	if err != nil {
+		return nil, nil, false
+	}
+	start, startErrs := rangeBound(nil, r.Start, cidr, firstIP(cidr))
+	end, endErrs := rangeBound(nil, r.End, cidr, lastIP(cidr))
+	if len(startErrs) > 0 || len(endErrs) > 0 || bytes.Compare(start, end) > 0 {
+		return nil, nil, false
+	}
+	return start, end, true
+}
+
+// rangeBound parses an optional start or end address, which must be within the CIDR. The returned
+// address is normalized to the CIDR's length so bounds can be compared bytewise.
+func rangeBound(path *field.Path, value string, cidr *net.IPNet, def net.IP) (net.IP, field.ErrorList) {
+	if value == "" {
+		return def, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, field.ErrorList{field.Invalid(path, value, "must be an IP address")}
+	}
+	if !cidr.Contains(ip) {
+		return nil, field.ErrorList{field.Invalid(path, value, fmt.Sprintf("must be within cidr %s", cidr))}
+	}
+	if len(cidr.IP) == net.IPv4len {
+		return ip.To4(), nil
+	}
+	return ip.To16(), nil
+}
+
+func firstIP(cidr *net.IPNet) net.IP {
+	return cidr.IP.Mask(cidr.Mask)
+}
+
+func lastIP(cidr *net.IPNet) net.IP {
+	ip := make(net.IP, len(cidr.IP))
+	for i := range cidr.IP {
+		ip[i] = cidr.IP[i] | ^cidr.Mask[i]
+	}
+	return ip
+}
+
+// ValidateIPClaim checks that an IPClaim is discoverable by agents. Claims must be labeled with
+// their pool and named for their address, so that at most one claim exists per address.
+func ValidateIPClaim(claim *wgk8s.IPClaim) field.ErrorList {
+	var errs field.ErrorList
+	ipPath := field.NewPath("spec", "ip")
+	ip := net.ParseIP(claim.Spec.IP)
+	if ip == nil {
+		errs = append(errs, field.Invalid(ipPath, claim.Spec.IP, "must be an IP address without a prefix length"))
+	}
+	pool := claim.GetLabels()[wgk8s.IPPoolLabel]
+	if pool == "" {
+		errs = append(errs, field.Required(field.NewPath("metadata", "labels").Key(wgk8s.IPPoolLabel), "must name the claim's IPPool"))
+	}
+	if ip != nil && pool != "" {
+		if expect := wgk8s.IPClaimName(pool, ip.String()); claim.GetName() != expect {
+			errs = append(errs, field.Invalid(field.NewPath("metadata", "name"), claim.GetName(),
+				fmt.Sprintf("must be %q", expect)))
+		}
+	}
+	return errs
+}
+
+// ValidateMesh checks that a Mesh's settings can be applied by agents.
+func ValidateMesh(mesh *wgk8s.Mesh) field.ErrorList {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+	if mesh.Spec.PeerSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(mesh.Spec.PeerSelector); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("peerSelector"), mesh.Spec.PeerSelector, err.Error()))
+		}
+	}
+	if mesh.Spec.KeepAliveSeconds < 0 || mesh.Spec.KeepAliveSeconds > 0xffff {
+		errs = append(errs, field.Invalid(spec.Child("keepalive"), mesh.Spec.KeepAliveSeconds, "must be between 0 and 65535"))
+	}
+	if mesh.Spec.MTU != 0 && (mesh.Spec.MTU < 576 || mesh.Spec.MTU > 0xffff) {
+		errs = append(errs, field.Invalid(spec.Child("mtu"), mesh.Spec.MTU, "must be between 576 and 65535"))
+	}
+	if p := mesh.Spec.IPClaimGCGracePeriod; p != nil && p.Duration < 0 {
+		errs = append(errs, field.Invalid(spec.Child("ipClaimGCGracePeriod"), p.Duration.String(), "must not be negative"))
+	}
+	switch mesh.Spec.Topology {
+	case "", wgk8s.TopologyFullMesh:
+	case wgk8s.TopologyHubAndSpoke, wgk8s.TopologyZoned:
+		if mesh.Spec.HubSelector == nil {
+			errs = append(errs, field.Required(spec.Child("hubSelector"),
+				fmt.Sprintf("required by the %s topology", mesh.Spec.Topology)))
+		}
+	default:
+		errs = append(errs, field.NotSupported(spec.Child("topology"), mesh.Spec.Topology,
+			[]string{string(wgk8s.TopologyFullMesh), string(wgk8s.TopologyHubAndSpoke), string(wgk8s.TopologyZoned)}))
+	}
+	if mesh.Spec.HubSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(mesh.Spec.HubSelector); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("hubSelector"), mesh.Spec.HubSelector, err.Error()))
+		}
+	}
+	for i, key := range mesh.Spec.RevokedPublicKeys {
+		if _, err := wgtypes.ParseKey(key); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("revokedPublicKeys").Index(i), key, err.Error()))
+		}
+	}
+	for i, cidr := range mesh.Spec.AllowedEndpointCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("allowedEndpointCIDRs").Index(i), cidr, err.Error()))
+		}
+	}
+	shared := make(map[string]bool)
+	for i, ns := range mesh.Spec.SharedWithNamespaces {
+		path := spec.Child("sharedWithNamespaces").Index(i)
+		for _, msg := range validation.IsDNS1123Label(ns) {
+			errs = append(errs, field.Invalid(path, ns, msg))
+		}
+		if ns == mesh.GetNamespace() {
+			errs = append(errs, field.Invalid(path, ns, "peers always mesh within their own namespace"))
+		}
+		if shared[ns] {
+			errs = append(errs, field.Duplicate(path, ns))
+		}
+		shared[ns] = true
+	}
+	return errs
+}
+
+// ValidateWireGuardMeshPolicy checks that a WireGuardMeshPolicy's selectors parse and its ports are
+// valid.
+func ValidateWireGuardMeshPolicy(policy *wgk8s.WireGuardMeshPolicy) field.ErrorList {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+	if _, err := metav1.LabelSelectorAsSelector(&policy.Spec.PeerSelector); err != nil {
+		errs = append(errs, field.Invalid(spec.Child("peerSelector"), policy.Spec.PeerSelector, err.Error()))
+	}
+	for i, rule := range policy.Spec.Ingress {
+		path := spec.Child("ingress").Index(i)
+		for j, from := range rule.From {
+			if _, err := metav1.LabelSelectorAsSelector(&from.PeerSelector); err != nil {
+				errs = append(errs, field.Invalid(path.Child("from").Index(j).Child("peerSelector"), from.PeerSelector, err.Error()))
+			}
+		}
+		for j, port := range rule.Ports {
+			path := path.Child("ports").Index(j)
+			switch port.Protocol {
+			case "", corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP:
+			default:
+				errs = append(errs, field.NotSupported(path.Child("protocol"), port.Protocol,
+					[]string{string(corev1.ProtocolTCP), string(corev1.ProtocolUDP), string(corev1.ProtocolSCTP)}))
+			}
+			if port.Port < 0 || port.Port > 0xffff {
+				errs = append(errs, field.Invalid(path.Child("port"), port.Port, "must be between 1 and 65535"))
+			}
+			switch {
+			case port.EndPort == 0:
+			case port.Port == 0:
+				errs = append(errs, field.Required(path.Child("port"), "required with endPort"))
+			case port.EndPort < port.Port || port.EndPort > 0xffff:
+				errs = append(errs, field.Invalid(path.Child("endPort"), port.EndPort, "must be between port and 65535"))
+			}
+		}
+	}
+	return errs
+}
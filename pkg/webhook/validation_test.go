@@ -0,0 +1,533 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testKey = "x4ZF7QuJd3wsbtLs7ESOrpl2ahUXvMqmdvc1HFvdzXQ="
+
+func TestValidateWireGuardPeer(t *testing.T) {
+	valid := func() *wgk8s.WireGuardPeer {
+		return &wgk8s.WireGuardPeer{
+			Spec: wgk8s.WireGuardPeerSpec{
+				PublicKey: testKey,
+				Endpoint:  "192.0.2.1:51820",
+				IPs:       []string{"10.0.0.1/32", "fd00::1/128"},
+				Routes:    []string{"10.1.0.0/16"},
+			},
+		}
+	}
+	tcs := []struct {
+		name         string
+		mutate       func(*wgk8s.WireGuardPeer)
+		expectFields []string
+	}{
+		{
+			name:   "valid",
+			mutate: func(*wgk8s.WireGuardPeer) {},
+		},
+		{
+			name:   "hostname endpoint",
+			mutate: func(p *wgk8s.WireGuardPeer) { p.Spec.Endpoint = "vpn.example.com:51820" },
+		},
+		{
+			name:         "bad public key",
+			mutate:       func(p *wgk8s.WireGuardPeer) { p.Spec.PublicKey = "nope" },
+			expectFields: []string{"spec.publicKey"},
+		},
+		{
+			name:         "bad preshared key",
+			mutate:       func(p *wgk8s.WireGuardPeer) { p.Spec.PresharedKey = "nope" },
+			expectFields: []string{"spec.presharedKey"},
+		},
+		{
+			name:   "client-only",
+			mutate: func(p *wgk8s.WireGuardPeer) { p.Spec.Endpoint = "" },
+		},
+		{
+			name:         "endpoint without port",
+			mutate:       func(p *wgk8s.WireGuardPeer) { p.Spec.Endpoint = "192.0.2.1" },
+			expectFields: []string{"spec.endpoint"},
+		},
+		{
+			name:         "endpoint port out of range",
+			mutate:       func(p *wgk8s.WireGuardPeer) { p.Spec.Endpoint = "[2001:db8::1]:70000" },
+			expectFields: []string{"spec.endpoint"},
+		},
+		{
+			name: "bad endpoint candidate",
+			mutate: func(p *wgk8s.WireGuardPeer) {
+				p.Spec.Endpoints = []string{"192.168.1.10:51820", "192.168.1.11"}
+			},
+			expectFields: []string{"spec.endpoints[1]"},
+		},
+		{
+			name: "bad tcp endpoint",
+			mutate: func(p *wgk8s.WireGuardPeer) {
+				p.Spec.TCPEndpoint = "vpn.example.com"
+			},
+			expectFields: []string{"spec.tcpEndpoint"},
+		},
+		{
+			name: "bad observed endpoint",
+			mutate: func(p *wgk8s.WireGuardPeer) {
+				p.Status.ObservedEndpoints = []wgk8s.ObservedEndpoint{
+					{PublicKey: testKey, Endpoint: "198.51.100.7:40123"},
+					{PublicKey: "nope", Endpoint: "198.51.100.8"},
+				}
+			},
+			expectFields: []string{"status.observedEndpoints[1].publicKey", "status.observedEndpoints[1].endpoint"},
+		},
+		{
+			name: "unnamed peer health",
+			mutate: func(p *wgk8s.WireGuardPeer) {
+				p.Status.PeerHealth = []wgk8s.PeerHealth{{Name: "a", Reachable: true}, {Reachable: true}}
+			},
+			expectFields: []string{"status.peerHealth[1].name"},
+		},
+		{
+			name: "bad ips and routes",
+			mutate: func(p *wgk8s.WireGuardPeer) {
+				p.Spec.IPs = []string{"10.0.0.1/32", "10.0.0.2"}
+				p.Spec.Routes = []string{"10.1.0.0/33"}
+			},
+			expectFields: []string{"spec.ips[1]", "spec.routes[0]"},
+		},
+		{
+			name: "clamped route not offered",
+			mutate: func(p *wgk8s.WireGuardPeer) {
+				p.Spec.ClampMSSRoutes = []string{"10.1.0.0/16", "10.2.0.0/16"}
+			},
+			expectFields: []string{"spec.clampMSSRoutes[1]"},
+		},
+		{
+			name: "bad reflected routes",
+			mutate: func(p *wgk8s.WireGuardPeer) {
+				p.Spec.ReflectedRoutes = []wgk8s.ReflectedRoute{
+					{CIDR: "10.2.0.0/16", Path: []string{"leaf", "gateway"}},
+					{CIDR: "10.3.0.0"},
+				}
+			},
+			expectFields: []string{"spec.reflectedRoutes[1].cidr", "spec.reflectedRoutes[1].path"},
+		},
+		{
+			name: "bad services",
+			mutate: func(p *wgk8s.WireGuardPeer) {
+				p.Spec.Services = []wgk8s.ExportedService{
+					{Name: "web.default.svc.cluster.local", IPs: []string{"10.96.0.10"}},
+					{Name: "Web_", IPs: []string{"10.96.0.11/32"}},
+				}
+			},
+			expectFields: []string{"spec.services[1].name", "spec.services[1].ips[0]"},
+		},
+		{
+			name:         "keepalive out of range",
+			mutate:       func(p *wgk8s.WireGuardPeer) { p.Spec.KeepAliveSeconds = 70000 },
+			expectFields: []string{"spec.keepalive"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			p := valid()
+			tc.mutate(p)
+			errs := ValidateWireGuardPeer(p)
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			require.Equal(t, tc.expectFields, fields)
+		})
+	}
+}
+
+func TestValidateWireGuardPeerConflicts(t *testing.T) {
+	const otherKey = "cGd1Ga4vdjb7a+e4prmvqgnPTWl2XLdJp6Ybgq4RBWk="
+	others := []wgk8s.WireGuardPeer{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "a"},
+			Spec: wgk8s.WireGuardPeerSpec{
+				PublicKey: testKey,
+				IPs:       []string{"10.0.0.1/32", "fd00::1/128"},
+				Routes:    []string{"10.1.0.0/16", "fd01::/64"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "b"},
+			Spec: wgk8s.WireGuardPeerSpec{
+				PublicKey:     otherKey,
+				IPs:           []string{"10.0.0.2/32"},
+				Routes:        []string{"10.2.0.0/16"},
+				RoutePriority: 10,
+			},
+		},
+	}
+	peer := &wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "c"},
+		Spec: wgk8s.WireGuardPeerSpec{
+			PublicKey: testKey,
+			IPs:       []string{"10.0.0.1/24", "10.0.0.2/32", "10.0.0.3/32", "invalid"},
+			Routes:    []string{"10.1.2.0/24", "10.2.0.0/16", "fd01::/48", "10.3.0.0/16"},
+		},
+	}
+	var fields []string
+	for _, e := range ValidateWireGuardPeerConflicts(peer, others) {
+		fields = append(fields, e.Field)
+	}
+	require.Equal(t, []string{
+		"spec.publicKey",
+		"spec.ips[0]",
+		"spec.ips[1]",
+	}, fields, "routes overlapping a's or b's aren't conflicts")
+
+	peer.Spec.RoutePriority = 5
+	peer.Spec.PublicKey = otherKey
+	peer.Spec.IPs = []string{"10.0.0.3/32"}
+	fields = nil
+	for _, e := range ValidateWireGuardPeerConflicts(peer, others) {
+		fields = append(fields, e.Field)
+	}
+	require.Equal(t, []string{"spec.publicKey"}, fields)
+
+	// A peer doesn't conflict with its own previous version.
+	peer.Name = "b"
+	require.Empty(t, ValidateWireGuardPeerConflicts(peer, others))
+}
+
+func TestValidateWireGuardPeerConflictsSharedRoute(t *testing.T) {
+	gateway := func(name, key, ip string) wgk8s.WireGuardPeer {
+		return wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: wgk8s.WireGuardPeerSpec{
+				PublicKey: key,
+				IPs:       []string{ip},
+				Routes:    []string{"10.1.0.0/16"},
+			},
+		}
+	}
+	a := gateway("gw-a", testKey, "10.0.0.1/32")
+	b := gateway("gw-b", "cGd1Ga4vdjb7a+e4prmvqgnPTWl2XLdJp6Ybgq4RBWk=", "10.0.0.2/32")
+	require.Empty(t, ValidateWireGuardPeerConflicts(&b, []wgk8s.WireGuardPeer{a}),
+		"two gateways with the default routePriority share a route for ECMP or failover")
+}
+
+func TestValidateIPPool(t *testing.T) {
+	tcs := []struct {
+		name         string
+		spec         wgk8s.IPPoolSpec
+		expectFields []string
+	}{
+		{
+			name: "valid",
+			spec: wgk8s.IPPoolSpec{
+				IPRanges: []wgk8s.IPRange{
+					{CIDR: "10.0.0.0/24", Start: "10.0.0.10", End: "10.0.0.20"},
+					{CIDR: "10.0.0.0/24", Start: "10.0.0.21"},
+					{CIDR: "fd00::/64"},
+				},
+				Reserved:     []string{"10.0.0.15"},
+				ExcludeCIDRs: []string{"10.0.0.16/30"},
+				Strategy:     wgk8s.IPAllocationSequential,
+			},
+		},
+		{
+			name:         "no ranges",
+			expectFields: []string{"spec.ipRanges"},
+		},
+		{
+			name: "bad cidr",
+			spec: wgk8s.IPPoolSpec{
+				IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0"}},
+			},
+			expectFields: []string{"spec.ipRanges[0].cidr"},
+		},
+		{
+			name: "start and end outside cidr",
+			spec: wgk8s.IPPoolSpec{
+				IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/24", Start: "10.0.1.1", End: "fd00::1"}},
+			},
+			expectFields: []string{"spec.ipRanges[0].start", "spec.ipRanges[0].end"},
+		},
+		{
+			name: "start after end",
+			spec: wgk8s.IPPoolSpec{
+				IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/24", Start: "10.0.0.20", End: "10.0.0.10"}},
+			},
+			expectFields: []string{"spec.ipRanges[0].start"},
+		},
+		{
+			name: "overlapping ranges",
+			spec: wgk8s.IPPoolSpec{
+				IPRanges: []wgk8s.IPRange{
+					{CIDR: "10.0.0.0/16"},
+					{CIDR: "fd00::/64"},
+					{CIDR: "10.0.0.0/24", Start: "10.0.0.100"},
+				},
+			},
+			expectFields: []string{"spec.ipRanges[2]"},
+		},
+		{
+			name: "bad reserved, excludes and strategy",
+			spec: wgk8s.IPPoolSpec{
+				IPRanges:     []wgk8s.IPRange{{CIDR: "10.0.0.0/24"}},
+				Reserved:     []string{"10.0.0.0/32"},
+				ExcludeCIDRs: []string{"10.0.0.1"},
+				Strategy:     "lowest",
+			},
+			expectFields: []string{"spec.reserved[0]", "spec.excludeCIDRs[0]", "spec.strategy"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			errs := ValidateIPPool(&wgk8s.IPPool{Spec: tc.spec})
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			require.Equal(t, tc.expectFields, fields)
+		})
+	}
+}
+
+func TestValidateIPPoolOverlap(t *testing.T) {
+	others := []wgk8s.IPPool{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "a"},
+			Spec: wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{
+				{CIDR: "10.0.0.0/24", Start: "10.0.0.1", End: "10.0.0.99"},
+				{CIDR: "fd00::/64"},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "b"},
+			Spec:       wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.1.0.0/16"}}},
+		},
+	}
+	pool := &wgk8s.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "c"},
+		Spec: wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{
+			{CIDR: "10.0.0.0/24", Start: "10.0.0.100"},
+			{CIDR: "10.1.2.0/24"},
+			{CIDR: "fd00::/48"},
+			{CIDR: "invalid"},
+		}},
+	}
+	var fields []string
+	for _, e := range ValidateIPPoolOverlap(pool, others) {
+		fields = append(fields, e.Field)
+	}
+	require.Equal(t, []string{"spec.ipRanges[1]", "spec.ipRanges[2]"}, fields)
+
+	// A pool doesn't overlap its own previous version.
+	pool.Name = "a"
+	pool.Spec.IPRanges = others[0].Spec.IPRanges
+	require.Empty(t, ValidateIPPoolOverlap(pool, others))
+}
+
+func TestValidateIPClaim(t *testing.T) {
+	claim := func(name, pool, ip string) *wgk8s.IPClaim {
+		c := &wgk8s.IPClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       wgk8s.IPClaimSpec{IP: ip},
+		}
+		if pool != "" {
+			c.SetLabels(map[string]string{wgk8s.IPPoolLabel: pool})
+		}
+		return c
+	}
+	tcs := []struct {
+		name         string
+		claim        *wgk8s.IPClaim
+		expectFields []string
+	}{
+		{
+			name:  "valid",
+			claim: claim(wgk8s.IPClaimName("pool", "10.0.0.1"), "pool", "10.0.0.1"),
+		},
+		{
+			name:         "wrong name",
+			claim:        claim("mine", "pool", "10.0.0.1"),
+			expectFields: []string{"metadata.name"},
+		},
+		{
+			name:         "ip with prefix",
+			claim:        claim(wgk8s.IPClaimName("pool", "10.0.0.1"), "pool", "10.0.0.1/32"),
+			expectFields: []string{"spec.ip"},
+		},
+		{
+			name:         "missing pool label",
+			claim:        claim(wgk8s.IPClaimName("pool", "10.0.0.1"), "", "10.0.0.1"),
+			expectFields: []string{"metadata.labels[" + wgk8s.IPPoolLabel + "]"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			errs := ValidateIPClaim(tc.claim)
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			require.Equal(t, tc.expectFields, fields)
+		})
+	}
+}
+
+func TestValidateMesh(t *testing.T) {
+	tcs := []struct {
+		name         string
+		namespace    string
+		spec         wgk8s.MeshSpec
+		expectFields []string
+	}{
+		{
+			name: "valid",
+			spec: wgk8s.MeshSpec{
+				PeerSelector:         &metav1.LabelSelector{MatchLabels: map[string]string{"site": "a"}},
+				KeepAliveSeconds:     25,
+				MTU:                  1420,
+				IPClaimGCGracePeriod: &metav1.Duration{Duration: time.Hour},
+			},
+		},
+		{
+			name: "empty",
+		},
+		{
+			name: "invalid",
+			spec: wgk8s.MeshSpec{
+				PeerSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "site", Operator: "Bogus"},
+				}},
+				KeepAliveSeconds:     -1,
+				MTU:                  100,
+				IPClaimGCGracePeriod: &metav1.Duration{Duration: -time.Second},
+			},
+			expectFields: []string{"spec.peerSelector", "spec.keepalive", "spec.mtu", "spec.ipClaimGCGracePeriod"},
+		},
+		{
+			name: "hub and spoke",
+			spec: wgk8s.MeshSpec{
+				Topology:    wgk8s.TopologyHubAndSpoke,
+				HubSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "hub"}},
+			},
+		},
+		{
+			name:         "hub and spoke without hubs",
+			spec:         wgk8s.MeshSpec{Topology: wgk8s.TopologyHubAndSpoke},
+			expectFields: []string{"spec.hubSelector"},
+		},
+		{
+			name:         "zoned without gateways",
+			spec:         wgk8s.MeshSpec{Topology: wgk8s.TopologyZoned},
+			expectFields: []string{"spec.hubSelector"},
+		},
+		{
+			name:         "unsupported topology",
+			spec:         wgk8s.MeshSpec{Topology: "Ring"},
+			expectFields: []string{"spec.topology"},
+		},
+		{
+			name:         "invalid revoked key",
+			spec:         wgk8s.MeshSpec{RevokedPublicKeys: []string{"xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", "nope"}},
+			expectFields: []string{"spec.revokedPublicKeys[1]"},
+		},
+		{
+			name:         "invalid allowed endpoint cidr",
+			spec:         wgk8s.MeshSpec{AllowedEndpointCIDRs: []string{"10.0.0.0/8", "10.1.2.3"}},
+			expectFields: []string{"spec.allowedEndpointCIDRs[1]"},
+		},
+		{
+			name:         "shared with namespaces",
+			namespace:    "tenant-a",
+			spec:         wgk8s.MeshSpec{SharedWithNamespaces: []string{"tenant-b", "Tenant_C", "tenant-a", "tenant-b"}},
+			expectFields: []string{"spec.sharedWithNamespaces[1]", "spec.sharedWithNamespaces[2]", "spec.sharedWithNamespaces[3]"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			errs := ValidateMesh(&wgk8s.Mesh{ObjectMeta: metav1.ObjectMeta{Namespace: tc.namespace}, Spec: tc.spec})
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			require.Equal(t, tc.expectFields, fields)
+		})
+	}
+}
+
+func TestValidateWireGuardMeshPolicy(t *testing.T) {
+	invalidSelector := metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: "Bogus"},
+	}}
+	tcs := []struct {
+		name         string
+		spec         wgk8s.WireGuardMeshPolicySpec
+		expectFields []string
+	}{
+		{
+			name: "valid",
+			spec: wgk8s.WireGuardMeshPolicySpec{
+				PeerSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+				Ingress: []wgk8s.MeshPolicyIngressRule{{
+					From: []wgk8s.MeshPolicyPeer{{PeerSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}}},
+					Ports: []wgk8s.MeshPolicyPort{
+						{Port: 5432},
+						{Protocol: corev1.ProtocolUDP, Port: 8000, EndPort: 8010},
+						{Protocol: corev1.ProtocolSCTP},
+					},
+				}},
+			},
+		},
+		{
+			name: "deny all",
+		},
+		{
+			name: "invalid selectors",
+			spec: wgk8s.WireGuardMeshPolicySpec{
+				PeerSelector: invalidSelector,
+				Ingress: []wgk8s.MeshPolicyIngressRule{{
+					From: []wgk8s.MeshPolicyPeer{{}, {PeerSelector: invalidSelector}},
+				}},
+			},
+			expectFields: []string{"spec.peerSelector", "spec.ingress[0].from[1].peerSelector"},
+		},
+		{
+			name: "invalid ports",
+			spec: wgk8s.WireGuardMeshPolicySpec{
+				Ingress: []wgk8s.MeshPolicyIngressRule{{
+					Ports: []wgk8s.MeshPolicyPort{
+						{Protocol: "ICMP"},
+						{Port: 70000},
+						{EndPort: 80},
+						{Port: 80, EndPort: 79},
+					},
+				}},
+			},
+			expectFields: []string{
+				"spec.ingress[0].ports[0].protocol",
+				"spec.ingress[0].ports[1].port",
+				"spec.ingress[0].ports[2].port",
+				"spec.ingress[0].ports[3].endPort",
+			},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			errs := ValidateWireGuardMeshPolicy(&wgk8s.WireGuardMeshPolicy{Spec: tc.spec})
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			require.Equal(t, tc.expectFields, fields)
+		})
+	}
+}
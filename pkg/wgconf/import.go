@@ -0,0 +1,156 @@
+package wgconf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	wgmeshClient "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/typed/wgmesh/v1alpha1"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	wglog "github.com/jcodybaker/wgmesh/pkg/log"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+
+	log "github.com/sirupsen/logrus"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Import creates or updates each peer in the registry. A peer replaces the record with its name or
+// public key; only the fields a WireGuard configuration describes are changed, so labels and other
+// settings added since an earlier import are kept. A record with the peer's name but another public
+// key belongs to a different peer and isn't touched; these are reported together after the other
+// peers are imported. Peers which matched a record by public key are renamed to match it.
+func Import(ll log.FieldLogger, r registry.Registry, peers []*wgk8s.WireGuardPeer) error {
+	list, err := r.WatchPeers(nil, nil).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing WireGuardPeers: %w", err)
+	}
+	byName := make(map[string]*wgk8s.WireGuardPeer)
+	byKey := make(map[string]*wgk8s.WireGuardPeer)
+	for i := range list.(*wgk8s.WireGuardPeerList).Items {
+		p := &list.(*wgk8s.WireGuardPeerList).Items[i]
+		byName[p.GetName()] = p
+		byKey[p.Spec.PublicKey] = p
+	}
+
+	var conflicts []string
+	for _, peer := range peers {
+		ll := wglog.WithPeer(ll, peer)
+		existing, ok := byKey[peer.Spec.PublicKey]
+		if !ok {
+			if named, ok := byName[peer.GetName()]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("%s exists with public key %s", peer.GetName(), named.Spec.PublicKey))
+				continue
+			}
+			if _, err = r.Register(peer); err != nil {
+				return fmt.Errorf("creating WireGuardPeer %q: %w", peer.GetName(), err)
+			}
+			ll.Info("created WireGuardPeer")
+			continue
+		}
+		updated := existing.DeepCopy()
+		updated.Spec.Endpoint = peer.Spec.Endpoint
+		updated.Spec.PresharedKey = peer.Spec.PresharedKey
+		updated.Spec.IPs = peer.Spec.IPs
+		updated.Spec.Routes = peer.Spec.Routes
+		updated.Spec.KeepAliveSeconds = peer.Spec.KeepAliveSeconds
+		peer.Name = existing.GetName()
+		ll = wglog.WithPeer(ll, peer)
+		if equalSpec(existing.Spec, updated.Spec) {
+			ll.Info("WireGuardPeer is unchanged")
+			continue
+		}
+		if _, err = r.Update(updated); err != nil {
+			return fmt.Errorf("updating WireGuardPeer %q: %w", existing.GetName(), err)
+		}
+		ll.Info("updated WireGuardPeer")
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("skipped peers whose names are taken: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+func equalSpec(a, b wgk8s.WireGuardPeerSpec) bool {
+	return a.Endpoint == b.Endpoint &&
+		a.PresharedKey == b.PresharedKey &&
+		strings.Join(a.IPs, ",") == strings.Join(b.IPs, ",") &&
+		strings.Join(a.Routes, ",") == strings.Join(b.Routes, ",") &&
+		a.KeepAliveSeconds == b.KeepAliveSeconds
+}
+
+// IPClaims returns claims reserving each of the peers' IPs which fall within the pool, so IPAM won't
+// assign them to other peers. The claims name the peer rather than being owned by it (see
+// IPClaimSpec.Peer), so they're kept if the peer is deleted.
+func IPClaims(pool *wgk8s.IPPool, peers []*wgk8s.WireGuardPeer) ([]*wgk8s.IPClaim, error) {
+	var cidrs []*net.IPNet
+	for _, r := range pool.Spec.IPRanges {
+		_, cidr, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q has invalid CIDR %q: %w", pool.GetName(), r.CIDR, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	var out []*wgk8s.IPClaim
+	for _, peer := range peers {
+		for _, s := range peer.Spec.IPs {
+			ip, _, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("peer %q has invalid IP %q: %w", peer.GetName(), s, err)
+			}
+			for _, cidr := range cidrs {
+				if !cidr.Contains(ip) {
+					continue
+				}
+				out = append(out, &wgk8s.IPClaim{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      wgk8s.IPClaimName(pool.GetName(), ip.String()),
+						Namespace: pool.GetNamespace(),
+						Labels:    map[string]string{wgk8s.IPPoolLabel: pool.GetName()},
+					},
+					Spec: wgk8s.IPClaimSpec{
+						IP:   ip.String(),
+						Peer: peer.GetName(),
+					},
+				})
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// CreateIPClaims creates the claims. A claim which already reserves its address for the same peer
+// is left alone; addresses claimed for other peers are reported together after the other claims
+// are created.
+func CreateIPClaims(ll log.FieldLogger, client wgmeshClient.IPClaimInterface, claims []*wgk8s.IPClaim) error {
+	var conflicts []string
+	for _, claim := range claims {
+		ll := ll.WithField("k8s_name", claim.GetName())
+		_, err := client.Create(claim)
+		if err == nil {
+			ll.Info("created IPClaim")
+			continue
+		}
+		if !k8sErrors.IsAlreadyExists(err) {
+			return fmt.Errorf("creating IPClaim %q: %w", claim.GetName(), err)
+		}
+		existing, err := client.Get(claim.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("getting IPClaim %q: %w", claim.GetName(), err)
+		}
+		holder := existing.Spec.Peer
+		for _, o := range existing.GetOwnerReferences() {
+			holder = o.Name
+		}
+		if holder != claim.Spec.Peer {
+			conflicts = append(conflicts, fmt.Sprintf("%s is claimed by %q", claim.Spec.IP, holder))
+			continue
+		}
+		ll.Info("IPClaim is unchanged")
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("addresses are claimed by other peers: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
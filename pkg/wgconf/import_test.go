@@ -0,0 +1,96 @@
+package wgconf
+
+import (
+	"testing"
+
+	"github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/generated/clientset/versioned/fake"
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/jcodybaker/wgmesh/pkg/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestImport(t *testing.T) {
+	r, err := registry.NewMemory("ns")
+	require.NoError(t, err)
+	_, err = r.Register(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "renamed", Labels: map[string]string{"role": "laptop"}},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: publicKeyA, IPs: []string{"10.0.0.9/32"}},
+	})
+	require.NoError(t, err)
+	_, err = r.Register(&wgk8s.WireGuardPeer{
+		ObjectMeta: metav1.ObjectMeta{Name: "site-b"},
+		Spec:       wgk8s.WireGuardPeerSpec{PublicKey: "other"},
+	})
+	require.NoError(t, err)
+
+	peers := []*wgk8s.WireGuardPeer{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "laptop"},
+			Spec:       wgk8s.WireGuardPeerSpec{PublicKey: publicKeyA, IPs: []string{"10.0.0.2/32"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "site-b"},
+			Spec:       wgk8s.WireGuardPeerSpec{PublicKey: publicKeyB},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "site-c"},
+			Spec:       wgk8s.WireGuardPeerSpec{PublicKey: "pk-c", Endpoint: "c.example.com:51820"},
+		},
+	}
+	err = Import(logrus.New(), r, peers)
+	require.Error(t, err, "site-b's name is taken by another key")
+	require.Contains(t, err.Error(), "site-b")
+
+	// The existing record keeps its name and labels.
+	require.Equal(t, "renamed", peers[0].GetName())
+	got, err := r.Get("renamed")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.2/32"}, got.Spec.IPs)
+	require.Equal(t, "laptop", got.GetLabels()["role"])
+	got, err = r.Get("site-b")
+	require.NoError(t, err)
+	require.Equal(t, "other", got.Spec.PublicKey)
+	got, err = r.Get("site-c")
+	require.NoError(t, err)
+	require.Equal(t, "c.example.com:51820", got.Spec.Endpoint)
+
+	// Importing again changes nothing.
+	require.NoError(t, Import(logrus.New(), r, []*wgk8s.WireGuardPeer{peers[0], peers[2]}))
+}
+
+func TestIPClaims(t *testing.T) {
+	pool := &wgk8s.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool", Namespace: "ns"},
+		Spec:       wgk8s.IPPoolSpec{IPRanges: []wgk8s.IPRange{{CIDR: "10.0.0.0/24"}}},
+	}
+	claims, err := IPClaims(pool, []*wgk8s.WireGuardPeer{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "a"},
+			Spec:       wgk8s.WireGuardPeerSpec{IPs: []string{"10.0.0.2/32", "10.1.0.2/32"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "b"},
+			Spec:       wgk8s.WireGuardPeerSpec{IPs: []string{"10.0.0.3/32"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, claims, 2, "addresses outside the pool aren't claimed")
+	require.Equal(t, "pool-10-0-0-2", claims[0].GetName())
+	require.Equal(t, wgk8s.IPClaimSpec{IP: "10.0.0.2", Peer: "a"}, claims[0].Spec)
+
+	cs := fake.NewSimpleClientset(&wgk8s.IPClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool-10-0-0-3", Namespace: "ns"},
+		Spec:       wgk8s.IPClaimSpec{IP: "10.0.0.3", Peer: "c"},
+	})
+	client := cs.WgmeshV1alpha1().IPClaims("ns")
+	err = CreateIPClaims(logrus.New(), client, claims)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `10.0.0.3 is claimed by "c"`)
+	got, err := client.Get("pool-10-0-0-2", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "a", got.Spec.Peer)
+
+	require.NoError(t, CreateIPClaims(logrus.New(), client, claims[:1]), "existing claims for the same peer are kept")
+}
@@ -0,0 +1,335 @@
+// Package wgconf reads hand-managed WireGuard configurations, from `wg showconf` output, wg-quick
+// files, or a running device, so they can be imported into a registry.
+package wgconf
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Config is a WireGuard interface and its peers.
+type Config struct {
+	// PrivateKey is nil if the configuration didn't include one.
+	PrivateKey *wgtypes.Key
+	ListenPort int
+	// Addresses are the interface's own addresses, from wg-quick's Address or the device.
+	Addresses []net.IPNet
+	Peers     []Peer
+}
+
+// Peer is a [Peer] section of a configuration.
+type Peer struct {
+	// Name is taken from a "# Name = ..." comment, a convention of several WireGuard
+	// configuration tools, which either precedes the section or starts it. It's empty if there
+	// wasn't one.
+	Name                string
+	PublicKey           wgtypes.Key
+	PresharedKey        *wgtypes.Key
+	Endpoint            string
+	AllowedIPs          []net.IPNet
+	PersistentKeepalive int
+}
+
+// wgQuickKeys are wg-quick settings which don't describe WireGuard itself.
+var wgQuickKeys = map[string]bool{
+	"dns":        true,
+	"mtu":        true,
+	"table":      true,
+	"preup":      true,
+	"postup":     true,
+	"predown":    true,
+	"postdown":   true,
+	"saveconfig": true,
+	"fwmark":     true,
+}
+
+var nameComment = regexp.MustCompile(`(?i)^#\s*name\s*[=:]\s*(.+)$`)
+
+// Parse reads a configuration in the format of `wg showconf` or a wg-quick file.
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{}
+	var section, name string
+	var peer *Peer
+	// sectionKeys counts the keys set in the current section.
+	var sectionKeys int
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if m := nameComment.FindStringSubmatch(line); m != nil {
+			if peer != nil && sectionKeys == 0 {
+				peer.Name = strings.TrimSpace(m[1])
+			} else {
+				name = strings.TrimSpace(m[1])
+			}
+			continue
+		}
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			sectionKeys = 0
+			switch section {
+			case "interface":
+			case "peer":
+				c.Peers = append(c.Peers, Peer{Name: name})
+				peer = &c.Peers[len(c.Peers)-1]
+				name = ""
+				continue
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %q", lineNum, line)
+			}
+			peer = nil
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNum)
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := strings.TrimSpace(kv[1])
+		sectionKeys++
+		var err error
+		switch section {
+		case "interface":
+			err = c.set(key, value)
+		case "peer":
+			err = peer.set(key, value)
+		default:
+			err = fmt.Errorf("%q is outside of a section", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, p := range c.Peers {
+		if p.PublicKey == (wgtypes.Key{}) {
+			return nil, fmt.Errorf("peer %d has no PublicKey", i+1)
+		}
+	}
+	return c, nil
+}
+
+func (c *Config) set(key, value string) error {
+	switch key {
+	case "privatekey":
+		k, err := wgtypes.ParseKey(value)
+		if err != nil {
+			return fmt.Errorf("invalid PrivateKey: %w", err)
+		}
+		c.PrivateKey = &k
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid ListenPort %q: %w", value, err)
+		}
+		c.ListenPort = int(port)
+	case "address":
+		addrs, err := parseCIDRs(value)
+		if err != nil {
+			return fmt.Errorf("invalid Address: %w", err)
+		}
+		c.Addresses = append(c.Addresses, addrs...)
+	default:
+		if !wgQuickKeys[key] {
+			return fmt.Errorf("unknown [Interface] key %q", key)
+		}
+	}
+	return nil
+}
+
+func (p *Peer) set(key, value string) error {
+	switch key {
+	case "publickey":
+		k, err := wgtypes.ParseKey(value)
+		if err != nil {
+			return fmt.Errorf("invalid PublicKey: %w", err)
+		}
+		p.PublicKey = k
+	case "presharedkey":
+		k, err := wgtypes.ParseKey(value)
+		if err != nil {
+			return fmt.Errorf("invalid PresharedKey: %w", err)
+		}
+		p.PresharedKey = &k
+	case "endpoint":
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return fmt.Errorf("invalid Endpoint %q: %w", value, err)
+		}
+		p.Endpoint = value
+	case "allowedips":
+		ipNets, err := parseCIDRs(value)
+		if err != nil {
+			return fmt.Errorf("invalid AllowedIPs: %w", err)
+		}
+		p.AllowedIPs = append(p.AllowedIPs, ipNets...)
+	case "persistentkeepalive":
+		if value == "off" {
+			p.PersistentKeepalive = 0
+			return nil
+		}
+		seconds, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid PersistentKeepalive %q: %w", value, err)
+		}
+		p.PersistentKeepalive = int(seconds)
+	default:
+		return fmt.Errorf("unknown [Peer] key %q", key)
+	}
+	return nil
+}
+
+// parseCIDRs parses a comma separated list of addresses, keeping the address rather than the
+// network. Addresses without a prefix length are host addresses.
+func parseCIDRs(value string) ([]net.IPNet, error) {
+	var out []net.IPNet
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			out = append(out, hostNet(ip))
+			continue
+		}
+		ip, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ipNet.IP = ip
+		out = append(out, *ipNet)
+	}
+	return out, nil
+}
+
+func hostNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// FromDevice builds a configuration from a running device and its interface addresses. A device
+// only knows the address each peer last sent from, so peers' endpoints may be stale or, for roaming
+// peers, unreachable; prefer the configuration file when there is one.
+func FromDevice(d *wgtypes.Device, addresses []net.IPNet) *Config {
+	c := &Config{
+		ListenPort: d.ListenPort,
+		Addresses:  addresses,
+	}
+	if d.PrivateKey != (wgtypes.Key{}) {
+		k := d.PrivateKey
+		c.PrivateKey = &k
+	}
+	for _, p := range d.Peers {
+		peer := Peer{
+			PublicKey:           p.PublicKey,
+			AllowedIPs:          p.AllowedIPs,
+			PersistentKeepalive: int(p.PersistentKeepaliveInterval.Seconds()),
+		}
+		if p.PresharedKey != (wgtypes.Key{}) {
+			k := p.PresharedKey
+			peer.PresharedKey = &k
+		}
+		if p.Endpoint != nil {
+			peer.Endpoint = p.Endpoint.String()
+		}
+		c.Peers = append(c.Peers, peer)
+	}
+	return c
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// PeerName returns the WireGuardPeer name for a peer: its Name comment, sanitized, or else a name
+// derived from its public key.
+func PeerName(p *Peer) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(p.Name), "-"), "-.")
+	if len(name) > 253 {
+		name = strings.Trim(name[:253], "-.")
+	}
+	if name != "" {
+		return name
+	}
+	return "wg-" + hex.EncodeToString(p.PublicKey[:6])
+}
+
+// WireGuardPeers converts the configuration's peers to WireGuardPeers. AllowedIPs which are single
+// addresses become the peer's IPs, and wider prefixes become its Routes. If self is set, the
+// interface itself becomes a WireGuardPeer with that name, published at endpointAddr and the
+// ListenPort; this requires the PrivateKey.
+func (c *Config) WireGuardPeers(self, endpointAddr string) ([]*wgk8s.WireGuardPeer, error) {
+	var out []*wgk8s.WireGuardPeer
+	if self != "" {
+		if c.PrivateKey == nil {
+			return nil, fmt.Errorf("the interface's PrivateKey is required to import it")
+		}
+		peer := &wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: self},
+			Spec: wgk8s.WireGuardPeerSpec{
+				PublicKey: c.PrivateKey.PublicKey().String(),
+			},
+		}
+		for _, addr := range c.Addresses {
+			peer.Spec.IPs = append(peer.Spec.IPs, (&net.IPNet{IP: addr.IP, Mask: hostNet(addr.IP).Mask}).String())
+		}
+		if endpointAddr != "" {
+			if c.ListenPort == 0 {
+				return nil, fmt.Errorf("the interface's ListenPort is required to publish its endpoint")
+			}
+			peer.Spec.Endpoint = net.JoinHostPort(endpointAddr, strconv.Itoa(c.ListenPort))
+		}
+		out = append(out, peer)
+	}
+	names := make(map[string]bool)
+	for i := range c.Peers {
+		p := &c.Peers[i]
+		name := PeerName(p)
+		if names[name] || name == self {
+			return nil, fmt.Errorf("more than one peer is named %q", name)
+		}
+		names[name] = true
+		peer := &wgk8s.WireGuardPeer{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: wgk8s.WireGuardPeerSpec{
+				Endpoint:         p.Endpoint,
+				PublicKey:        p.PublicKey.String(),
+				KeepAliveSeconds: p.PersistentKeepalive,
+			},
+		}
+		if p.PresharedKey != nil {
+			peer.Spec.PresharedKey = p.PresharedKey.String()
+		}
+		for _, ipNet := range p.AllowedIPs {
+			ones, bits := ipNet.Mask.Size()
+			if ones == bits {
+				peer.Spec.IPs = append(peer.Spec.IPs, ipNet.String())
+				continue
+			}
+			network := net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+			peer.Spec.Routes = append(peer.Spec.Routes, network.String())
+		}
+		out = append(out, peer)
+	}
+	return out, nil
+}
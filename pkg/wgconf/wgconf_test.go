@@ -0,0 +1,151 @@
+package wgconf
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	wgk8s "github.com/jcodybaker/wgmesh/pkg/apis/wgmesh/v1alpha1"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	privateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	publicKeyA = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	publicKeyB = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+	psk        = "E7TQOT8sVB5EaDKoVRjg6aQ8Q2trlmjdsjWvb20Nh0c="
+)
+
+func TestParse(t *testing.T) {
+	conf := `# wg-quick config
+[Interface]
+PrivateKey = ` + privateKey + `
+ListenPort = 51820
+Address = 10.0.0.1/24, fd00::1/64
+DNS = 10.0.0.53
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+# Name = Laptop
+[Peer]
+PublicKey = ` + publicKeyA + `
+PresharedKey = ` + psk + `
+AllowedIPs = 10.0.0.2/32
+PersistentKeepalive = 25
+
+[Peer]
+# Name = site b
+PublicKey = ` + publicKeyB + `
+Endpoint = b.example.com:51820
+AllowedIPs = 10.0.0.3, 192.168.10.5/24 # the office LAN
+`
+	c, err := Parse(strings.NewReader(conf))
+	require.NoError(t, err)
+	require.Equal(t, 51820, c.ListenPort)
+	require.Equal(t, privateKey, c.PrivateKey.String())
+	require.Len(t, c.Peers, 2)
+	require.Equal(t, "Laptop", c.Peers[0].Name)
+	require.Equal(t, psk, c.Peers[0].PresharedKey.String())
+	require.Equal(t, 25, c.Peers[0].PersistentKeepalive)
+	require.Equal(t, "site b", c.Peers[1].Name)
+	require.Nil(t, c.Peers[1].PresharedKey)
+
+	peers, err := c.WireGuardPeers("gateway", "gw.example.com")
+	require.NoError(t, err)
+	self, err := wgtypes.ParseKey(privateKey)
+	require.NoError(t, err)
+	var specs []wgk8s.WireGuardPeerSpec
+	var names []string
+	for _, p := range peers {
+		names = append(names, p.GetName())
+		specs = append(specs, p.Spec)
+	}
+	require.Equal(t, []string{"gateway", "laptop", "site-b"}, names)
+	require.Equal(t, []wgk8s.WireGuardPeerSpec{
+		{
+			Endpoint:  "gw.example.com:51820",
+			PublicKey: self.PublicKey().String(),
+			IPs:       []string{"10.0.0.1/32", "fd00::1/128"},
+		},
+		{
+			PublicKey:        publicKeyA,
+			PresharedKey:     psk,
+			IPs:              []string{"10.0.0.2/32"},
+			KeepAliveSeconds: 25,
+		},
+		{
+			Endpoint:  "b.example.com:51820",
+			PublicKey: publicKeyB,
+			IPs:       []string{"10.0.0.3/32"},
+			Routes:    []string{"192.168.10.0/24"},
+		},
+	}, specs)
+}
+
+func TestParseErrors(t *testing.T) {
+	tcs := []struct {
+		name      string
+		conf      string
+		expectErr string
+	}{
+		{
+			name:      "unknown key",
+			conf:      "[Peer]\nPublicKey = " + publicKeyA + "\nAllowedIP = 10.0.0.2/32\n",
+			expectErr: `line 3: unknown [Peer] key "allowedip"`,
+		},
+		{
+			name:      "bad key",
+			conf:      "[Interface]\nPrivateKey = nope\n",
+			expectErr: "line 2: invalid PrivateKey",
+		},
+		{
+			name:      "no public key",
+			conf:      "[Peer]\nAllowedIPs = 10.0.0.2/32\n",
+			expectErr: "peer 1 has no PublicKey",
+		},
+		{
+			name:      "outside section",
+			conf:      "ListenPort = 51820\n",
+			expectErr: "line 1:",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.conf))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectErr)
+		})
+	}
+}
+
+func TestFromDevice(t *testing.T) {
+	keyA, err := wgtypes.ParseKey(publicKeyA)
+	require.NoError(t, err)
+	_, allowed, err := net.ParseCIDR("10.0.0.2/32")
+	require.NoError(t, err)
+	c := FromDevice(&wgtypes.Device{
+		ListenPort: 51820,
+		Peers: []wgtypes.Peer{{
+			PublicKey:                   keyA,
+			Endpoint:                    &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4500},
+			AllowedIPs:                  []net.IPNet{*allowed},
+			PersistentKeepaliveInterval: 25 * time.Second,
+		}},
+	}, nil)
+	require.Nil(t, c.PrivateKey)
+
+	_, err = c.WireGuardPeers("self", "")
+	require.Error(t, err, "importing the interface requires its private key")
+
+	peers, err := c.WireGuardPeers("", "")
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	require.Equal(t, "wg-c53201039adb", peers[0].GetName())
+	require.Equal(t, wgk8s.WireGuardPeerSpec{
+		Endpoint:         "192.0.2.1:4500",
+		PublicKey:        publicKeyA,
+		IPs:              []string{"10.0.0.2/32"},
+		KeepAliveSeconds: 25,
+	}, peers[0].Spec)
+}